@@ -1,6 +1,9 @@
 package calculator
 
 import (
+	"encoding/gob"
+	"io"
+
 	"github.com/aecra/raft/raft"
 )
 
@@ -28,6 +31,9 @@ func NewCalculator() raft.Application {
 }
 
 func (app *Calculator) ApplyCommand(command interface{}) interface{} {
+	if txn, ok := command.(Txn); ok {
+		return app.applyTxn(txn)
+	}
 	entry := command.(Entry)
 	switch entry.Method {
 	case "create":
@@ -65,6 +71,24 @@ func (app *Calculator) ApplyCommand(command interface{}) interface{} {
 	}
 }
 
+// SnapshotTo encodes the calculators to w with gob.
+func (app *Calculator) SnapshotTo(w io.Writer) error {
+	return gob.NewEncoder(w).Encode(app)
+}
+
+// RestoreFrom replaces the calculators with the ones encoded by SnapshotTo.
+func (app *Calculator) RestoreFrom(r io.Reader) error {
+	var restored Calculator
+	if err := gob.NewDecoder(r).Decode(&restored); err != nil {
+		return err
+	}
+	if restored.Calculator == nil {
+		restored.Calculator = make(map[int][]int)
+	}
+	*app = restored
+	return nil
+}
+
 func (app *Calculator) createCalculator() (instanceId int) {
 	app.LastInstanceId++
 	app.Calculator[app.LastInstanceId] = make([]int, 0)
@@ -1,6 +1,9 @@
 package calculator
 
-import "testing"
+import (
+	"bytes"
+	"testing"
+)
 
 func TestCreate(t *testing.T) {
 	app := NewCalculator()
@@ -187,3 +190,65 @@ func TestGet(t *testing.T) {
 		t.Errorf("Expected get to succeed")
 	}
 }
+
+func TestSnapshotRestore(t *testing.T) {
+	app := NewCalculator()
+	res := app.ApplyCommand(Entry{Method: "create"})
+	instanceId := res.(Result).Value
+	app.ApplyCommand(Entry{Method: "create"})
+	app.ApplyCommand(Entry{Method: "push", InstanceId: instanceId, Operand: 7})
+	var buf bytes.Buffer
+	if err := app.(*Calculator).SnapshotTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewCalculator()
+	if err := restored.(*Calculator).RestoreFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	res = restored.ApplyCommand(Entry{Method: "get", InstanceId: instanceId})
+	if !res.(Result).Result || res.(Result).Value != 7 {
+		t.Errorf("Expected get to return 7, got %+v", res)
+	}
+	res = restored.ApplyCommand(Entry{Method: "push", InstanceId: instanceId + 1, Operand: 1})
+	if !res.(Result).Result {
+		t.Errorf("Expected the empty calculator to be restored")
+	}
+	res = restored.ApplyCommand(Entry{Method: "create"})
+	if res.(Result).Value != instanceId+2 {
+		t.Errorf("Expected create to return %d, got %+v", instanceId+2, res)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	app := NewCalculator()
+	instanceId := app.ApplyCommand(Entry{Method: "create"}).(Result).Value
+	res := app.ApplyCommand(Txn{Ops: []Entry{
+		{Method: "push", InstanceId: instanceId, Operand: 2},
+		{Method: "push", InstanceId: instanceId, Operand: 3},
+		{Method: "mul", InstanceId: instanceId},
+	}})
+	if txn := res.(TxnResult); !txn.Committed || len(txn.Results) != 3 || txn.Results[2].Value != 6 {
+		t.Fatalf("Expected the transaction to compute 6, got %+v", txn)
+	}
+
+	// A transaction failing on its last operation leaves no trace.
+	res = app.ApplyCommand(Txn{Ops: []Entry{
+		{Method: "create"},
+		{Method: "push", InstanceId: instanceId, Operand: 0},
+		{Method: "push", InstanceId: instanceId, Operand: 1},
+		{Method: "div", InstanceId: instanceId},
+	}})
+	if txn := res.(TxnResult); txn.Committed || len(txn.Results) != 4 || txn.Results[3].Result {
+		t.Fatalf("Expected the division by zero to abort the transaction, got %+v", txn)
+	}
+	if res := app.ApplyCommand(Entry{Method: "pop", InstanceId: instanceId}); res.(Result) != (Result{true, 6}) {
+		t.Errorf("Expected the stack to be restored, got %+v", res)
+	}
+	if res := app.ApplyCommand(Entry{Method: "pop", InstanceId: instanceId}); res.(Result).Result {
+		t.Errorf("Expected the stack to hold only 6, got %+v", res)
+	}
+	if res := app.ApplyCommand(Entry{Method: "create"}); res.(Result).Value != instanceId+1 {
+		t.Errorf("Expected the calculator created by the transaction to be undone, got %+v", res)
+	}
+}
@@ -0,0 +1,60 @@
+package calculator
+
+import "encoding/gob"
+
+func init() {
+	gob.Register(Txn{})
+	gob.Register(TxnResult{})
+}
+
+// Txn is a command applying Ops atomically, as a single log entry. The
+// operations are applied in order, each seeing the effects of the ones before
+// it; if one of them fails, the calculators are left as they were before the
+// transaction.
+type Txn struct {
+	Ops []Entry
+}
+
+// TxnResult is the result of a Txn. Committed reports whether its operations
+// took effect, and Results holds the results of the ones applied, the last
+// being the one that failed if it didn't.
+type TxnResult struct {
+	Committed bool
+	Results   []Result
+}
+
+// applyTxn applies the operations of txn, undoing them if one fails. Before
+// an operation changes a calculator for the first time, its stack is saved to
+// be restored.
+func (app *Calculator) applyTxn(txn Txn) TxnResult {
+	lastInstanceId := app.LastInstanceId
+	saved := make(map[int][]int)
+	existed := make(map[int]bool)
+	result := TxnResult{Results: make([]Result, 0, len(txn.Ops))}
+	for _, op := range txn.Ops {
+		instanceId := op.InstanceId
+		if op.Method == "create" {
+			instanceId = app.LastInstanceId + 1
+		}
+		if _, ok := existed[instanceId]; !ok {
+			stack, ok := app.Calculator[instanceId]
+			saved[instanceId] = append([]int(nil), stack...)
+			existed[instanceId] = ok
+		}
+		res := app.ApplyCommand(op).(Result)
+		result.Results = append(result.Results, res)
+		if !res.Result {
+			for id, stack := range saved {
+				if existed[id] {
+					app.Calculator[id] = stack
+				} else {
+					delete(app.Calculator, id)
+				}
+			}
+			app.LastInstanceId = lastInstanceId
+			return result
+		}
+	}
+	result.Committed = true
+	return result
+}
@@ -0,0 +1,559 @@
+// Package client submits commands to a Raft cluster from another process. It
+// keeps track of the leader, following the hints of the servers that aren't,
+// and retries submissions with exponential backoff.
+//
+// A submission that reached the leader but whose outcome is unknown, because
+// it timed out or the connection dropped, may still be applied. Submit
+// returns raft.ErrUnknownResult (or the connection error) in that case, while
+// SubmitIdempotent retries it, which is only safe for commands whose effect
+// doesn't change when applied twice. SubmitWithToken retries any command
+// safely, as the servers apply it once.
+//
+// Read and ReadStale answer queries without going through the log. The reads
+// of a Client wait for the server to have applied the entries the Client saw,
+// committing its commands or reflected by its previous reads, so that it reads
+// its own writes and never sees the state go back in time, even from a
+// follower.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"github.com/aecra/raft/raft"
+)
+
+// Options configures a Client.
+type Options struct {
+	// Addrs are the addresses of the servers, Addrs[i] being the address of
+	// server IDs[i].
+	Addrs []string
+
+	// IDs are the IDs of the servers, which their leader hints refer to. They
+	// default to raft.IntID(0) to raft.IntID(len(Addrs)-1).
+	IDs []raft.ServerID
+
+	// GroupId is the group the commands are submitted to, raft.DefaultGroup
+	// by default.
+	GroupId int
+
+	// Codec encodes the commands and decodes the results. It must be the
+	// Codec of the servers, raft.GobCodec by default.
+	Codec raft.Codec
+
+	// MaxAttempts is the number of times a command is sent before giving up,
+	// 10 by default.
+	MaxAttempts int
+
+	// MinBackoff and MaxBackoff bound the delay between attempts, which
+	// doubles after every failed round of attempts. They default to 50ms
+	// and 1s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// DialContext connects to a server, over TCP by default. Dialing is
+	// given up once ctx is done.
+	DialContext func(ctx context.Context, addr string) (net.Conn, error)
+
+	// Dial connects to a server, if DialContext isn't set.
+	//
+	// Deprecated: use DialContext, which can be canceled.
+	Dial func(addr string) (net.Conn, error)
+
+	// Token is the cluster token of the servers, if they have one.
+	Token string
+
+	// Session identifies the client to the servers, which limit the rate of
+	// each session to Config.SessionSubmitRate. Clients with the same Session
+	// share the limit.
+	Session string
+}
+
+// Client submits commands to a cluster. It's safe for concurrent use.
+type Client struct {
+	opts Options
+
+	mu sync.Mutex
+
+	// leader is the server the next command is sent to first, and reader
+	// the one the next stale read is.
+	leader int
+	reader int
+
+	// lastIndex is the index of the last entry the client saw, committing
+	// its commands or reflected by its reads, which its reads wait for.
+	lastIndex int
+
+	// conns are the connections to the servers, opened on first use, and
+	// versions the versions of the wire protocol they negotiated.
+	conns    map[int]*rpc.Client
+	versions map[int]int
+}
+
+// New returns a client of the cluster whose servers are at opts.Addrs.
+func New(opts Options) (*Client, error) {
+	if len(opts.Addrs) == 0 {
+		return nil, errors.New("client: no server address")
+	}
+	if opts.IDs == nil {
+		opts.IDs = make([]raft.ServerID, len(opts.Addrs))
+		for i := range opts.IDs {
+			opts.IDs[i] = raft.IntID(i)
+		}
+	}
+	if len(opts.IDs) != len(opts.Addrs) {
+		return nil, errors.New("client: IDs and Addrs have different lengths")
+	}
+	if opts.Codec == nil {
+		opts.Codec = raft.GobCodec{}
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 10
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 50 * time.Millisecond
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = time.Second
+		if opts.MaxBackoff < opts.MinBackoff {
+			opts.MaxBackoff = opts.MinBackoff
+		}
+	}
+	if opts.DialContext == nil && opts.Dial != nil {
+		dial := opts.Dial
+		opts.DialContext = func(ctx context.Context, addr string) (net.Conn, error) {
+			return dial(addr)
+		}
+	}
+	if opts.DialContext == nil {
+		var dialer net.Dialer
+		opts.DialContext = func(ctx context.Context, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp", addr)
+		}
+	}
+	return &Client{opts: opts, lastIndex: -1, conns: make(map[int]*rpc.Client), versions: make(map[int]int)}, nil
+}
+
+// Close closes the connections to the servers.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	for id, conn := range c.conns {
+		if cerr := conn.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(c.conns, id)
+	}
+	return err
+}
+
+// Submit submits command and returns the result of applying it. It retries
+// as long as the command is known not to have been appended to the log.
+func (c *Client) Submit(ctx context.Context, command interface{}) (interface{}, error) {
+	committed, err := c.submit(ctx, command, "", false)
+	return committed.Result, err
+}
+
+// SubmitIdempotent is Submit, also retrying when the command may have been
+// applied already.
+func (c *Client) SubmitIdempotent(ctx context.Context, command interface{}) (interface{}, error) {
+	committed, err := c.submit(ctx, command, "", true)
+	return committed.Result, err
+}
+
+// SubmitWithToken is SubmitIdempotent for any command: the servers apply the
+// command once however many times it's submitted with token, as
+// raft.ConsensusModule.SubmitIdempotent does, so retrying it is safe. token
+// must be unique to the command, a UUID for instance.
+func (c *Client) SubmitWithToken(ctx context.Context, token string, command interface{}) (interface{}, error) {
+	committed, err := c.submit(ctx, command, token, true)
+	return committed.Result, err
+}
+
+// SubmitIndexed is Submit, also returning the index and term of the log entry
+// the command was committed at.
+func (c *Client) SubmitIndexed(ctx context.Context, command interface{}) (raft.SubmitResult, error) {
+	return c.submit(ctx, command, "", false)
+}
+
+// Submit submits command with c and returns its result as an R. It's a typed
+// wrapper around Client.Submit.
+func Submit[R any](ctx context.Context, c *Client, command interface{}) (R, error) {
+	var zero R
+	result, err := c.Submit(ctx, command)
+	if err != nil {
+		return zero, err
+	}
+	r, ok := result.(R)
+	if !ok {
+		return zero, &ResultTypeError{Result: result}
+	}
+	return r, nil
+}
+
+// ResultTypeError is returned by the typed Submit when the result doesn't
+// have the requested type.
+type ResultTypeError struct {
+	Result interface{}
+}
+
+func (e *ResultTypeError) Error() string {
+	return "client: unexpected result type"
+}
+
+func (c *Client) submit(ctx context.Context, command interface{}, token string, idempotent bool) (raft.SubmitResult, error) {
+	data, err := c.opts.Codec.Encode(command)
+	if err != nil {
+		return raft.SubmitResult{}, err
+	}
+	args := raft.ClientSubmitArgs{GroupId: c.opts.GroupId, Command: data, Session: c.opts.Session, Token: token}
+	backoff := c.opts.MinBackoff
+	var lastErr error
+	for attempt := 0; attempt < c.opts.MaxAttempts; attempt++ {
+		id := c.target()
+		var reply raft.ClientSubmitReply
+		err := c.call(ctx, id, "Client.Submit", &args, &reply)
+		if err == nil && reply.Committed {
+			c.saw(reply.Index)
+		}
+		switch {
+		case err == nil && reply.Committed && reply.ApplyError != "":
+			// The command was applied, unsuccessfully; retrying would apply
+			// it again.
+			return raft.SubmitResult{Index: reply.Index, Term: reply.Term}, &raft.ApplyError{Err: errors.New(reply.ApplyError)}
+		case err == nil && reply.Committed:
+			result, err := c.opts.Codec.Decode(reply.Result)
+			if err != nil {
+				return raft.SubmitResult{}, err
+			}
+			return raft.SubmitResult{Result: result, Index: reply.Index, Term: reply.Term}, nil
+		case err == nil && reply.Throttled:
+			// Back off, and try the leader again.
+			lastErr = raft.ErrThrottled
+		case err == nil && reply.EnqueueTimedOut:
+			// The command was withdrawn before being appended, so it's safe
+			// to submit it to the leader again.
+			lastErr = raft.ErrEnqueueTimeout
+		case err == nil && !reply.Accepted:
+			lastErr = &raft.NotLeaderError{Leader: reply.LeaderHint}
+			if c.follow(id, reply.LeaderHint) {
+				// Go straight to the leader the server pointed at.
+				continue
+			}
+		case err == nil:
+			if !idempotent {
+				return raft.SubmitResult{}, raft.ErrUnknownResult
+			}
+			lastErr = raft.ErrUnknownResult
+		case errors.Is(err, raft.ErrUnauthenticated):
+			return raft.SubmitResult{}, err
+		case errors.Is(err, errNotSent):
+			lastErr = err
+			c.next(id)
+		case isServerError(err):
+			// The server rejected the command without submitting it, and
+			// would do so again.
+			return raft.SubmitResult{}, err
+		default:
+			if !idempotent {
+				return raft.SubmitResult{}, err
+			}
+			lastErr = err
+			c.next(id)
+		}
+		if err := c.backOff(ctx, &backoff); err != nil {
+			return raft.SubmitResult{}, err
+		}
+	}
+	return raft.SubmitResult{}, lastErr
+}
+
+// Read answers query, with the raft.Querier of the application, as a
+// linearizable read on the leader, like raft.ConsensusModule.Read: the answer
+// reflects all the commands committed before Read was called.
+func (c *Client) Read(ctx context.Context, query interface{}) (interface{}, error) {
+	return c.read(ctx, query, 0)
+}
+
+// ReadStale answers query from the state of any server, as long as it
+// reflects the commands committed maxStaleness ago, like
+// raft.ConsensusModule.ReadStale, and the entries c saw. Queries go to the
+// server at Addrs[0] first, the nearest one for instance, and to the next one
+// when a server is too stale.
+func (c *Client) ReadStale(ctx context.Context, query interface{}, maxStaleness time.Duration) (interface{}, error) {
+	if maxStaleness <= 0 {
+		return nil, errors.New("client: the staleness of a stale read must be positive")
+	}
+	return c.read(ctx, query, maxStaleness)
+}
+
+// read is Read if maxStaleness is 0, and ReadStale otherwise. Reads have no
+// effect, so they're retried whatever happened to the previous attempts.
+func (c *Client) read(ctx context.Context, query interface{}, maxStaleness time.Duration) (interface{}, error) {
+	data, err := c.opts.Codec.Encode(query)
+	if err != nil {
+		return nil, err
+	}
+	stale := maxStaleness > 0
+	backoff := c.opts.MinBackoff
+	var lastErr error
+	for attempt := 0; attempt < c.opts.MaxAttempts; attempt++ {
+		id := c.target()
+		if stale {
+			id = c.readTarget()
+		}
+		args := raft.ClientReadArgs{GroupId: c.opts.GroupId, Query: data, MaxStaleness: maxStaleness, MinIndex: c.seen()}
+		var reply raft.ClientReadReply
+		err := c.call(ctx, id, "Client.Read", &args, &reply)
+		switch {
+		case err == nil && reply.Accepted:
+			answer, err := c.opts.Codec.Decode(reply.Result)
+			if err != nil {
+				return nil, err
+			}
+			c.saw(reply.Index)
+			return answer, nil
+		case err == nil && reply.Behind:
+			lastErr = raft.ErrTooStale
+			if stale {
+				c.nextReader(id)
+			}
+		case err == nil:
+			lastErr = &raft.NotLeaderError{Leader: reply.LeaderHint}
+			if c.follow(id, reply.LeaderHint) {
+				continue
+			}
+		case errors.Is(err, raft.ErrUnauthenticated), isServerError(err):
+			return nil, err
+		default:
+			lastErr = err
+			if stale {
+				c.nextReader(id)
+			} else {
+				c.next(id)
+			}
+		}
+		if err := c.backOff(ctx, &backoff); err != nil {
+			return nil, err
+		}
+	}
+	return nil, lastErr
+}
+
+// backOff waits for backoff, or returns ctx.Err() if ctx is done first, and
+// doubles backoff up to MaxBackoff.
+func (c *Client) backOff(ctx context.Context, backoff *time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(*backoff):
+	}
+	*backoff *= 2
+	if *backoff > c.opts.MaxBackoff {
+		*backoff = c.opts.MaxBackoff
+	}
+	return nil
+}
+
+// errNotSent wraps the errors of connecting to a server, after which the
+// command certainly wasn't submitted.
+var errNotSent = errors.New("client: couldn't connect to server")
+
+func isServerError(err error) bool {
+	_, ok := err.(rpc.ServerError)
+	return ok
+}
+
+// call calls serviceMethod on server id with args, a *raft.ClientSubmitArgs
+// or *raft.ClientReadArgs, connecting to it if needed.
+func (c *Client) call(ctx context.Context, id int, serviceMethod string, args interface{}, reply interface{}) error {
+	conn, version, err := c.conn(ctx, id)
+	if err == raft.ErrUnauthenticated {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("%w: %v", errNotSent, err)
+	}
+	switch args := args.(type) {
+	case *raft.ClientSubmitArgs:
+		args.ProtocolVersion = version
+	case *raft.ClientReadArgs:
+		args.ProtocolVersion = version
+	}
+	call := conn.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-call.Done:
+	}
+	err = call.Error
+	if err != nil && !isServerError(err) {
+		// The connection is broken.
+		c.drop(id, conn)
+		if err == rpc.ErrShutdown {
+			// The client was already shut down, so nothing was sent.
+			return fmt.Errorf("%w: %v", errNotSent, err)
+		}
+	}
+	return err
+}
+
+// conn returns the connection to server id, and the version of the wire
+// protocol it negotiated. A server of a release too far apart from the
+// client's is skipped like an unreachable one, as the others may run another
+// release during a rolling upgrade.
+func (c *Client) conn(ctx context.Context, id int) (*rpc.Client, int, error) {
+	c.mu.Lock()
+	if conn, ok := c.conns[id]; ok {
+		version := c.versions[id]
+		c.mu.Unlock()
+		return conn, version, nil
+	}
+	c.mu.Unlock()
+
+	// An unreachable or slow server mustn't hold up the calls to the
+	// others, so c.mu isn't held while connecting.
+	conn, version, err := c.dial(ctx, id)
+	if err != nil {
+		return nil, 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if existing, ok := c.conns[id]; ok {
+		// Another call connected meanwhile.
+		conn.Close()
+		return existing, c.versions[id], nil
+	}
+	c.conns[id] = conn
+	c.versions[id] = version
+	return conn, version, nil
+}
+
+// dial connects to server id, authenticates to it and negotiates the version
+// of the wire protocol, giving up once ctx is done.
+func (c *Client) dial(ctx context.Context, id int) (*rpc.Client, int, error) {
+	netConn, err := c.opts.DialContext(ctx, c.opts.Addrs[id])
+	if err != nil {
+		return nil, 0, err
+	}
+	// The handshake is interrupted by closing the connection.
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			netConn.Close()
+		case <-stop:
+		}
+	}()
+	conn, version, err := c.handshake(netConn)
+	close(stop)
+	<-stopped
+	if ctx.Err() != nil {
+		if err == nil {
+			conn.Close()
+		}
+		return nil, 0, ctx.Err()
+	}
+	return conn, version, err
+}
+
+// handshake authenticates to the server at the other end of netConn and
+// negotiates the version of the wire protocol with it. netConn is closed if
+// it fails.
+func (c *Client) handshake(netConn net.Conn) (*rpc.Client, int, error) {
+	if c.opts.Token != "" {
+		if err := raft.Authenticate(netConn, c.opts.Token); err != nil {
+			netConn.Close()
+			return nil, 0, err
+		}
+	}
+	conn := rpc.NewClient(netConn)
+	version, err := raft.NegotiateVersion(conn)
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	return conn, version, nil
+}
+
+// drop forgets the broken connection conn to server id.
+func (c *Client) drop(id int, conn *rpc.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conns[id] == conn {
+		conn.Close()
+		delete(c.conns, id)
+	}
+}
+
+// target returns the server to send the next command to.
+func (c *Client) target() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.leader
+}
+
+// readTarget returns the server to send the next stale read to.
+func (c *Client) readTarget() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reader
+}
+
+// nextReader moves the stale reads on to the server after id, which failed
+// or was too stale.
+func (c *Client) nextReader(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reader == id {
+		c.reader = (id + 1) % len(c.opts.Addrs)
+	}
+}
+
+// saw records that the client saw the entry at index.
+func (c *Client) saw(index int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if index > c.lastIndex {
+		c.lastIndex = index
+	}
+}
+
+// seen returns the index of the last entry the client saw.
+func (c *Client) seen() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastIndex
+}
+
+// follow records the server whose ID is hint as the leader after server id
+// redirected a command. It returns false if the hint is useless, in which
+// case the next server is tried instead.
+func (c *Client) follow(id int, hint raft.ServerID) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, serverId := range c.opts.IDs {
+		if serverId == hint && hint != raft.NoServer && i != id {
+			c.leader = i
+			return true
+		}
+	}
+	c.leader = (id + 1) % len(c.opts.Addrs)
+	return false
+}
+
+// next moves on to the server after id, which failed.
+func (c *Client) next(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.leader == id {
+		c.leader = (id + 1) % len(c.opts.Addrs)
+	}
+}
@@ -0,0 +1,418 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aecra/raft/kvstore"
+	"github.com/aecra/raft/raft"
+)
+
+// startCluster starts num servers running a kvstore, configured by opts, and
+// returns their addresses.
+func startCluster(t *testing.T, num int, opts ...raft.Option) []string {
+	t.Helper()
+	_, addrs := startServers(t, num, func(i int) []raft.Option { return opts })
+	return addrs
+}
+
+// startServers is startCluster, the options of server i given by opts. It
+// also returns the servers.
+func startServers(t *testing.T, num int, opts func(i int) []raft.Option) ([]*raft.Server, []string) {
+	t.Helper()
+	var servers []*raft.Server
+	ready := make(chan interface{})
+	for i := 0; i < num; i++ {
+		serverOpts := append([]raft.Option{raft.WithCluster(num, ready), raft.WithApplication(kvstore.NewKVStore())}, opts(i)...)
+		s, err := raft.NewServer(i, serverOpts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Serve()
+		servers = append(servers, s)
+	}
+	var addrs []string
+	for i, s := range servers {
+		for j, peer := range servers {
+			if i != j {
+				if err := s.ConnectToPeer(j, peer.GetListenAddr()); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		addrs = append(addrs, s.GetListenAddr().String())
+	}
+	close(ready)
+	t.Cleanup(func() {
+		for _, s := range servers {
+			s.DisconnectAll()
+		}
+		for _, s := range servers {
+			s.Shutdown()
+		}
+	})
+	return servers, addrs
+}
+
+func TestSubmit(t *testing.T) {
+	addrs := startCluster(t, 3)
+	c, err := New(Options{Addrs: addrs, MaxAttempts: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := c.Submit(ctx, kvstore.Entry{Method: "put", Key: "a", Value: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := Submit[kvstore.Result](ctx, c, kvstore.Entry{Method: "get", Key: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != (kvstore.Result{Result: true, Value: "1"}) {
+		t.Errorf("Expected get to return 1, got %+v", res)
+	}
+	if _, err := Submit[string](ctx, c, kvstore.Entry{Method: "get", Key: "a"}); err == nil {
+		t.Error("Expected a result type error")
+	}
+	first, err := c.SubmitIndexed(ctx, kvstore.Entry{Method: "put", Key: "b", Value: "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := c.SubmitIndexed(ctx, kvstore.Entry{Method: "get", Key: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Index <= first.Index || second.Term < first.Term || first.Term < 1 {
+		t.Errorf("Expected increasing positions, got index %d term %d then index %d term %d", first.Index, first.Term, second.Index, second.Term)
+	}
+	if second.Result != (kvstore.Result{Result: true, Value: "2"}) {
+		t.Errorf("Expected get to return 2, got %+v", second.Result)
+	}
+
+	// The client now sends commands to the leader directly.
+	var reply raft.ClientSubmitReply
+	data, _ := raft.GobCodec{}.Encode(kvstore.Entry{Method: "get", Key: "a"})
+	if err := c.call(ctx, c.target(), "Client.Submit", &raft.ClientSubmitArgs{Command: data}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if !reply.Accepted {
+		t.Errorf("Expected server %d to be the leader, it redirected to %s", c.target(), reply.LeaderHint)
+	}
+}
+
+// hungServer returns the address of a server that accepts connections but
+// never answers.
+func hungServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	return l.Addr().String()
+}
+
+func TestHungServer(t *testing.T) {
+	addrs := startCluster(t, 3)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// A leader is elected first, so that the client only tries the hung
+	// server when told to.
+	ready, err := New(Options{Addrs: addrs, MaxAttempts: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ready.Close()
+	if _, err := ready.Submit(ctx, kvstore.Entry{Method: "put", Key: "a", Value: "0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := New(Options{
+		Addrs:       append(addrs, hungServer(t)),
+		IDs:         []raft.ServerID{raft.IntID(0), raft.IntID(1), raft.IntID(2), raft.IntID(3)},
+		MaxAttempts: 50,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Connecting to the hung server doesn't hold up the calls to the others,
+	// and gives up once its context is done.
+	hungCtx, cancelHung := context.WithCancel(context.Background())
+	defer cancelHung()
+	connected := make(chan error, 1)
+	go func() {
+		_, _, err := c.conn(hungCtx, 3)
+		connected <- err
+	}()
+	if _, err := c.Submit(ctx, kvstore.Entry{Method: "put", Key: "a", Value: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-connected:
+		t.Fatalf("Connected to the hung server: %v", err)
+	default:
+	}
+	cancelHung()
+	select {
+	case err := <-connected:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Connecting to the hung server failed with %v, want context.Canceled", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Connecting to the hung server went on after its context was canceled")
+	}
+}
+
+func TestSubmitUnknownGroup(t *testing.T) {
+	addrs := startCluster(t, 3)
+	c, err := New(Options{Addrs: addrs, GroupId: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_, err = c.Submit(context.Background(), kvstore.Entry{Method: "get", Key: "a"})
+	var serverErr rpc.ServerError
+	if !errors.As(err, &serverErr) {
+		t.Errorf("Expected a server error, got %v", err)
+	}
+}
+
+// failingApp fails the commands whose method is "fail". It's stateless, so
+// the servers can share it.
+type failingApp struct{}
+
+func (failingApp) ApplyCommand(command interface{}) interface{} {
+	return kvstore.Result{Result: true}
+}
+
+func (app failingApp) ApplyCommandChecked(command interface{}) (interface{}, error) {
+	if command.(kvstore.Entry).Method == "fail" {
+		return nil, errors.New("failed on purpose")
+	}
+	return app.ApplyCommand(command), nil
+}
+
+func TestSubmitApplyError(t *testing.T) {
+	addrs := startCluster(t, 3, raft.WithApplication(failingApp{}))
+	c, err := New(Options{Addrs: addrs, MaxAttempts: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	committed, err := c.SubmitIndexed(ctx, kvstore.Entry{Method: "fail"})
+	var applyErr *raft.ApplyError
+	if !errors.As(err, &applyErr) || applyErr.Err.Error() != "failed on purpose" {
+		t.Fatalf("Expected an ApplyError, got %v", err)
+	}
+	if committed.Term < 1 {
+		t.Errorf("Expected the failed command's position, got %+v", committed)
+	}
+	if _, err := c.Submit(ctx, kvstore.Entry{Method: "put"}); err != nil {
+		t.Errorf("Expected a successful command, got %v", err)
+	}
+}
+
+func TestSubmitWithToken(t *testing.T) {
+	addrs := startCluster(t, 3)
+	c, err := New(Options{Addrs: addrs, MaxAttempts: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := c.Submit(ctx, kvstore.Entry{Method: "put", Key: "a", Value: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	// The compare-and-swap succeeds once; its retry gets the same result
+	// rather than failing against the swapped value.
+	cas := kvstore.Entry{Method: "cas", Key: "a", Expected: "1", Value: "2"}
+	for i := 0; i < 2; i++ {
+		res, err := c.SubmitWithToken(ctx, "cas-a", cas)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != (kvstore.Result{Result: true, Value: "1"}) {
+			t.Errorf("Expected attempt %d to return the first result, got %+v", i, res)
+		}
+	}
+}
+
+func TestSubmitThrottled(t *testing.T) {
+	addrs := startCluster(t, 3, raft.WithConfig(raft.Config{SessionSubmitRate: 2}))
+	c, err := New(Options{Addrs: addrs, MaxAttempts: 50, Session: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	put := kvstore.Entry{Method: "put", Key: "a", Value: "1"}
+	if _, err := c.Submit(ctx, put); err != nil {
+		t.Fatal(err)
+	}
+
+	// The session has a burst of 2 commands.
+	c.opts.MaxAttempts = 1
+	for i := 0; i < 3; i++ {
+		_, err = c.Submit(ctx, put)
+	}
+	if err != raft.ErrThrottled {
+		t.Errorf("Expected ErrThrottled, got %v", err)
+	}
+
+	other, err := New(Options{Addrs: addrs, MaxAttempts: 50, Session: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if _, err := other.Submit(ctx, put); err != nil {
+		t.Errorf("Expected another session not to be throttled, got %v", err)
+	}
+}
+
+func TestSubmitEnqueueTimeout(t *testing.T) {
+	// The commands wait longer for the group commit window than the apply
+	// timeout allows, so the leader withdraws each of them.
+	addrs := startCluster(t, 3, raft.WithConfig(raft.Config{GroupCommitWindow: 300 * time.Millisecond, ApplyTimeout: 50 * time.Millisecond}))
+	c, err := New(Options{Addrs: addrs, MaxAttempts: 20, MaxBackoff: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The client keeps retrying on the leader rather than looking for
+	// another one.
+	_, err = c.Submit(ctx, kvstore.Entry{Method: "put", Key: "a", Value: "1"})
+	if err != raft.ErrEnqueueTimeout {
+		t.Errorf("Expected ErrEnqueueTimeout, got %v", err)
+	}
+}
+
+func TestSubmitTooLarge(t *testing.T) {
+	addrs := startCluster(t, 3, raft.WithConfig(raft.Config{MaxCommandBytes: 1024}))
+	c, err := New(Options{Addrs: addrs, MaxAttempts: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The leader rejects the command for good, rather than as throttled.
+	_, err = c.Submit(ctx, kvstore.Entry{Method: "put", Key: "a", Value: strings.Repeat("x", 2000)})
+	var serverErr rpc.ServerError
+	if !errors.As(err, &serverErr) || !strings.Contains(err.Error(), "exceeds the maximum") {
+		t.Errorf("Expected the command to be too large, got %v", err)
+	}
+}
+
+func TestReadYourWrites(t *testing.T) {
+	transports := make([]*raft.FaultTransport, 3)
+	servers, addrs := startServers(t, 3, func(i int) []raft.Option {
+		transports[i] = raft.NewFaultTransport(nil)
+		return []raft.Option{raft.WithTransport(transports[i])}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	leader := -1
+	for leader < 0 && ctx.Err() == nil {
+		time.Sleep(50 * time.Millisecond)
+		for i, s := range servers {
+			if _, _, isLeader := s.Report(); isLeader {
+				leader = i
+			}
+		}
+	}
+	// The stale reads go to the lagging follower first.
+	lagging := (leader + 1) % 3
+	ordered := append([]string{addrs[lagging]}, append(addrs[lagging+1:], addrs[:lagging]...)...)
+	ids := make([]raft.ServerID, 3)
+	for i := range ids {
+		ids[i] = raft.IntID((lagging + i) % 3)
+	}
+	c, err := New(Options{Addrs: ordered, IDs: ids, MaxAttempts: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// The follower refuses stale reads until it knows it's fresh.
+	for {
+		if _, err := servers[lagging].ReadStale(kvstore.Query{Method: "get", Key: "a"}, time.Second); err == nil {
+			break
+		} else if ctx.Err() != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Then it gets the entries well after the other one commits them.
+	transports[leader].SetPolicy(func(to raft.ServerID, serviceMethod string) raft.Fault {
+		if to == raft.IntID(lagging) && serviceMethod == "ConsensusModule.AppendEntries" {
+			return raft.Fault{Delay: 100 * time.Millisecond}
+		}
+		return raft.Fault{}
+	})
+	for i := 0; i < 5; i++ {
+		value := fmt.Sprint(i)
+		if _, err := c.Submit(ctx, kvstore.Entry{Method: "put", Key: "a", Value: value}); err != nil {
+			t.Fatal(err)
+		}
+		answer, err := c.ReadStale(ctx, kvstore.Query{Method: "get", Key: "a"}, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if answer != (kvstore.Result{Result: true, Value: value}) {
+			t.Errorf("Expected the stale read to see the write of %s, got %+v", value, answer)
+		}
+	}
+	if c.readTarget() != 0 {
+		t.Errorf("Expected the stale reads to be answered by the lagging follower, they moved to %d", c.readTarget())
+	}
+
+	answer, err := c.Read(ctx, kvstore.Query{Method: "get", Key: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer != (kvstore.Result{Result: true, Value: "4"}) {
+		t.Errorf("Expected the linearizable read to see the last write, got %+v", answer)
+	}
+}
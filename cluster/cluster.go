@@ -1,15 +1,88 @@
 package cluster
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/aecra/raft/raft"
+	"github.com/aecra/raft/storage"
+	"github.com/aecra/raft/storage/wal"
+	"os"
+	"path/filepath"
 	"strconv"
+	"sync"
+	"time"
 )
 
 type Cluster struct {
+	// Servers are the nodes of the cluster: the num initial members, then
+	// the nodes added by AddNode.
 	Servers        []*raft.Server
 	num            int
 	NewApplication func() raft.Application
 	ready          chan interface{}
+
+	// DataDir is where the nodes persist their state, in a write-ahead log
+	// per node. If it's empty, the state is kept in memory.
+	DataDir  string
+	storages []storage.Storage
+
+	// Config holds the timing and snapshot parameters of the nodes.
+	Config raft.Config
+
+	// Nodes, if set, holds an entry per node overriding the settings above
+	// for that node, to model heterogeneous deployments. It must be set
+	// before Serve.
+	Nodes []NodeConfig
+
+	// Token is the cluster token the nodes authenticate connections with. If
+	// it's empty, connections aren't authenticated.
+	Token string
+
+	// checkers stop the invariant checkers started by CheckInvariants.
+	checkers []func()
+
+	// transports inject the faults set with SetFaults in the RPCs of the
+	// nodes.
+	transports []*raft.FaultTransport
+
+	// removed holds the nodes removed by RemoveNode.
+	removed []bool
+
+	// leader is the node Submit tries first, the last one known to lead, or
+	// -1 if none is known. applied holds the commands applied by each node,
+	// for the Check methods. crashed holds the nodes stopped by Crash and
+	// not restarted yet, and the removed ones; it and Servers are only
+	// written with mu locked, for Submit and the invariant checkers to read
+	// them concurrently with AddNode, RemoveNode and Restart.
+	mu      sync.Mutex
+	crashed []bool
+	leader  int
+	applied [][]raft.CommitEntry
+}
+
+// NodeConfig overrides the settings of the Cluster for one of its nodes. Its
+// zero value keeps them all.
+type NodeConfig struct {
+	// ListenAddr is the address the node listens on, any free port if it's
+	// empty.
+	ListenAddr string
+
+	// DataDir is the directory of the write-ahead log of the node, rather
+	// than a directory of Cluster.DataDir. The state of the node is kept in
+	// memory if both are empty.
+	DataDir string
+
+	// Config replaces Cluster.Config for the node if it's not nil.
+	Config *raft.Config
+}
+
+// node returns the overrides of node i.
+func (c *Cluster) node(i int) NodeConfig {
+	if i < len(c.Nodes) {
+		return c.Nodes[i]
+	}
+	return NodeConfig{}
 }
 
 func NewCluster(num int, NewApplication func() raft.Application) *Cluster {
@@ -18,20 +91,111 @@ func NewCluster(num int, NewApplication func() raft.Application) *Cluster {
 		num:            num,
 		NewApplication: NewApplication,
 		ready:          make(chan interface{}),
+		storages:       make([]storage.Storage, num),
+		transports:     make([]*raft.FaultTransport, num),
+		crashed:        make([]bool, num),
+		removed:        make([]bool, num),
+		leader:         -1,
+		applied:        make([][]raft.CommitEntry, num),
+	}
+	for i := range c.transports {
+		c.transports[i] = raft.NewFaultTransport(nil)
 	}
 	return c
 }
 
+// SetFaults injects faults in the RPCs node i sends to its peers according to
+// policy, from now on; nil stops injecting them. It may be called before
+// Serve or while the cluster runs, to partition it and heal it for instance.
+func (c *Cluster) SetFaults(i int, policy raft.FaultPolicy) {
+	c.transports[i].SetPolicy(policy)
+}
+
+// Restore bootstraps the nodes of a new cluster from the backup archive at
+// path, written by raft.WriteBackup or raftctl backup. It must be called
+// before Serve, with an empty DataDir if it's set.
+func (c *Cluster) Restore(path string) error {
+	for i := 0; i < c.num; i++ {
+		if err := c.openStorage(i); err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = raft.RestoreBackup(f, c.NewApplication(), nil, c.storages[i])
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("restoring node %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// openStorage opens the storage of node i, unless it's already open. It's a
+// write-ahead log in the DataDir of the node or in DataDir, or in memory if
+// both are empty.
+func (c *Cluster) openStorage(i int) error {
+	if c.storages[i] != nil {
+		return nil
+	}
+	dir := c.node(i).DataDir
+	if dir == "" && c.DataDir != "" {
+		dir = filepath.Join(c.DataDir, fmt.Sprintf("node-%d", i))
+	}
+	if dir == "" {
+		c.storages[i] = storage.NewMemoryStorage()
+		return nil
+	}
+	w, err := wal.Open(dir, wal.Options{})
+	if err != nil {
+		return err
+	}
+	c.storages[i] = w
+	return nil
+}
+
+// start creates node i, on its storage and with a new application, and
+// serves it.
+func (c *Cluster) start(i int) error {
+	if err := c.openStorage(i); err != nil {
+		return fmt.Errorf("failed to open storage of node %d: %v", i, err)
+	}
+	node := c.node(i)
+	config := c.Config
+	if node.Config != nil {
+		config = *node.Config
+	}
+	c.transports[i].Transport = raft.TCPTransport{Addr: node.ListenAddr}
+	s, err := raft.NewServer(i,
+		raft.WithCluster(c.num, c.ready),
+		raft.WithApplication(c.NewApplication()),
+		raft.WithStorage(c.storages[i]),
+		raft.WithConfig(config),
+		raft.WithToken(c.Token),
+		raft.WithTransport(c.transports[i]),
+		raft.WithApplyHook(c.recordApplied(i)))
+	if err != nil {
+		return fmt.Errorf("failed to create node %d: %v", i, err)
+	}
+	c.mu.Lock()
+	c.Servers[i] = s
+	c.mu.Unlock()
+	s.Serve()
+	return nil
+}
+
 func (c *Cluster) Serve() {
 	for i := 0; i < c.num; i++ {
-		c.Servers[i] = raft.NewServer(i, c.num, c.ready, c.NewApplication())
-		c.Servers[i].Serve()
+		if err := c.start(i); err != nil {
+			panic(err.Error())
+		}
 	}
 	// Connect all peers to each other.
 	for i := 0; i < c.num; i++ {
 		for j := 0; j < c.num; j++ {
 			if i != j {
-				err := c.Servers[i].ConnectToPeer(j, c.Servers[j].GetListenAddr())
+				err := c.Servers[i].Connect(raft.IntID(j), c.Servers[j].GetListenAddr())
 				if err != nil {
 					panic("Failed to connect to peer " + strconv.Itoa(j))
 				}
@@ -43,20 +207,184 @@ func (c *Cluster) Serve() {
 }
 
 func (c *Cluster) Shutdown() {
-	for i := 0; i < c.num; i++ {
-		c.Servers[i].DisconnectAll()
+	c.mu.Lock()
+	checkers := c.checkers
+	c.mu.Unlock()
+	for _, stop := range checkers {
+		stop()
 	}
-	for i := 0; i < c.num; i++ {
-		c.Servers[i].Shutdown()
+	for i := range c.Servers {
+		if !c.crashed[i] {
+			c.Servers[i].DisconnectAll()
+		}
+	}
+	for i := range c.Servers {
+		if !c.crashed[i] {
+			c.Servers[i].Shutdown()
+		}
 	}
+	for i := range c.Servers {
+		if c.storages[i] != nil {
+			c.storages[i].Close()
+		}
+	}
+}
+
+// Crash stops node i abruptly, as if its process were killed: its pending
+// proposals fail, and it keeps only the state it persisted. The entries it
+// appended but didn't replicate yet stay in its log, which a new leader may
+// overwrite once it's restarted. Crash and Restart mustn't be called
+// concurrently with the other methods of the Cluster.
+func (c *Cluster) Crash(i int) {
+	if c.crashed[i] {
+		return
+	}
+	c.mu.Lock()
+	c.crashed[i] = true
+	c.mu.Unlock()
+	c.Servers[i].Stop(context.Background())
+	c.storages[i].Close()
+	c.storages[i] = nil
+}
+
+// Restart restarts node i, stopped by Crash, from the state it persisted, with
+// a new application, which the node replays its log into once it learns the
+// commit index. Its peers connect to it again at its new address. The node
+// must persist its state in a data directory.
+func (c *Cluster) Restart(i int) error {
+	if c.removed[i] {
+		return fmt.Errorf("cluster: node %d was removed", i)
+	}
+	if !c.crashed[i] {
+		return fmt.Errorf("cluster: node %d is running", i)
+	}
+	if c.node(i).DataDir == "" && c.DataDir == "" {
+		return fmt.Errorf("cluster: node %d keeps its state in memory, lost in the crash", i)
+	}
+	if err := c.start(i); err != nil {
+		return fmt.Errorf("cluster: %v", err)
+	}
+	c.mu.Lock()
+	c.crashed[i] = false
+	c.mu.Unlock()
+	return c.connect(i)
 }
 
+// connect connects node i and the other running nodes to each other, at the
+// current address of node i.
+func (c *Cluster) connect(i int) error {
+	for j := range c.Servers {
+		if j == i || c.crashed[j] {
+			continue
+		}
+		if err := c.Servers[i].Connect(raft.IntID(j), c.Servers[j].GetListenAddr()); err != nil {
+			return fmt.Errorf("cluster: connecting node %d to %d: %v", i, j, err)
+		}
+		c.Servers[j].Disconnect(raft.IntID(i))
+		if err := c.Servers[j].Connect(raft.IntID(i), c.Servers[i].GetListenAddr()); err != nil {
+			return fmt.Errorf("cluster: connecting node %d to %d: %v", j, i, err)
+		}
+	}
+	return nil
+}
+
+// Submit submits command to the leader, and returns its result and whether it
+// was committed, like raft.Server.Submit. It tries the last node known to
+// lead first, or else the leader known by the node that heard from its leader
+// last, then follows the leader hints of the nodes that aren't the leader, and
+// only falls back to trying the other nodes in turn when they have none. It
+// may be called concurrently with itself, AddNode and RemoveNode.
 func (c *Cluster) Submit(command interface{}) (interface{}, bool) {
-	for i := 0; i < c.num; i++ {
-		res, ok := c.Servers[i].Submit(command)
-		if ok {
-			return res, ok
+	// The crashed and removed nodes count as tried.
+	c.mu.Lock()
+	servers := c.Servers
+	tried := append([]bool(nil), c.crashed...)
+	next := c.leader
+	c.mu.Unlock()
+	index := func(id raft.ServerID) int {
+		for i := range tried {
+			if raft.IntID(i) == id {
+				return i
+			}
+		}
+		return -1
+	}
+	if next < 0 {
+		next = index(leaderHint(servers, tried))
+	}
+	for {
+		if next < 0 || tried[next] {
+			next = -1
+			for i := range tried {
+				if !tried[i] {
+					next = i
+					break
+				}
+			}
+			if next < 0 {
+				return nil, false
+			}
+		}
+		tried[next] = true
+		committed, err := servers[next].SubmitIndexed(context.Background(), command)
+		var applyErr *raft.ApplyError
+		if err == nil || errors.As(err, &applyErr) {
+			c.mu.Lock()
+			c.leader = next
+			c.mu.Unlock()
+			if applyErr != nil {
+				return applyErr, true
+			}
+			return committed.Result, true
+		}
+		var notLeader *raft.NotLeaderError
+		if errors.As(err, &notLeader) {
+			next = index(notLeader.Leader)
+		} else {
+			id, _ := servers[next].Leader()
+			next = index(id)
+		}
+	}
+}
+
+// leaderHint returns the leader known by the running node of servers that
+// heard from its leader last, or NoServer if none knows of one. crashed holds
+// the nodes that aren't running.
+func leaderHint(servers []*raft.Server, crashed []bool) raft.ServerID {
+	hint, contact := raft.NoServer, time.Time{}
+	for i, s := range servers {
+		if crashed[i] {
+			continue
+		}
+		status, err := s.Status()
+		if err != nil || status.Leader == raft.NoServer {
+			continue
+		}
+		if hint == raft.NoServer || status.LastContact.After(contact) {
+			hint, contact = status.Leader, status.LastContact
+		}
+	}
+	return hint
+}
+
+// WaitForLeader waits up to timeout for a node that didn't crash to lead the
+// cluster, and returns its index. Submit tries it first.
+func (c *Cluster) WaitForLeader(timeout time.Duration) (int, error) {
+	for deadline := time.Now().Add(timeout); ; {
+		for i := range c.Servers {
+			if c.crashed[i] {
+				continue
+			}
+			if id, _ := c.Servers[i].Leader(); id == raft.IntID(i) {
+				c.mu.Lock()
+				c.leader = i
+				c.mu.Unlock()
+				return i, nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return -1, fmt.Errorf("cluster: no leader elected in %v", timeout)
 		}
+		time.Sleep(10 * time.Millisecond)
 	}
-	return nil, false
 }
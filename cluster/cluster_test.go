@@ -1,17 +1,28 @@
 package cluster
 
 import (
+	"context"
 	"github.com/aecra/raft/raft"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
 type TestStruct struct {
-	A int
+	mu sync.Mutex
+	A  int
 }
 
 func (ts *TestStruct) ApplyCommand(interface{}) interface{} {
-	return nil
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.A++
+	return ts.A
 }
 func NewTestApplication() raft.Application {
 	return &TestStruct{}
@@ -22,6 +33,555 @@ func TestCluster(t *testing.T) {
 
 	cluster := NewCluster(num, NewTestApplication)
 	cluster.Serve()
-	time.Sleep(2 * time.Second)
+	if _, err := cluster.WaitForLeader(2 * time.Second); err != nil {
+		t.Error(err)
+	}
 	cluster.Shutdown()
 }
+
+func TestClusterPersistence(t *testing.T) {
+	num := 3
+	dir := t.TempDir()
+
+	cluster := NewCluster(num, NewTestApplication)
+	cluster.DataDir = dir
+	cluster.Serve()
+	if _, err := cluster.WaitForLeader(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if res, ok := cluster.Submit(i); !ok || res != i {
+			t.Fatalf("Expected submit %d to succeed, got %v", i, res)
+		}
+	}
+	cluster.Shutdown()
+
+	// The restarted cluster replays the persisted log into fresh
+	// applications once a new entry is committed.
+	cluster = NewCluster(num, NewTestApplication)
+	cluster.DataDir = dir
+	cluster.Serve()
+	defer cluster.Shutdown()
+	if _, err := cluster.WaitForLeader(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if res, ok := cluster.Submit(4); !ok || res != 4 {
+		t.Errorf("Expected the log to be restored, got %v", res)
+	}
+}
+
+func TestClusterFaults(t *testing.T) {
+	num := 3
+
+	cluster := NewCluster(num, NewTestApplication)
+	for i := 0; i < num; i++ {
+		cluster.SetFaults(i, raft.RandomFaults(int64(i), raft.FaultRates{Duplicate: 0.2, Reorder: 0.2, MaxDelay: 5 * time.Millisecond}))
+	}
+	cluster.Serve()
+	defer cluster.Shutdown()
+	cluster.CheckInvariants(t, 10*time.Millisecond)
+	if _, err := cluster.WaitForLeader(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 10; i++ {
+		if res, ok := cluster.Submit(i); !ok || res != i {
+			t.Fatalf("Expected submit %d to succeed, got %v", i, res)
+		}
+	}
+}
+
+func TestClusterSubmitFollowsLeader(t *testing.T) {
+	num := 3
+
+	cluster := NewCluster(num, NewTestApplication)
+	cluster.Serve()
+	defer cluster.Shutdown()
+	if _, err := cluster.WaitForLeader(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if res, ok := cluster.Submit(1); !ok || res != 1 {
+		t.Fatalf("Expected submit 1 to succeed, got %v", res)
+	}
+	leader := cluster.leader
+	if id, _ := cluster.Servers[leader].Leader(); id != raft.IntID(leader) {
+		t.Fatalf("Cluster tracks node %d as the leader, which isn't", leader)
+	}
+
+	// Once the leader is cut off, Submit finds the next one.
+	cluster.SetFaults(leader, func(to raft.ServerID, serviceMethod string) raft.Fault {
+		return raft.Fault{Drop: true}
+	})
+	time.Sleep(2 * time.Second)
+	if res, ok := cluster.Submit(2); !ok || res != 2 {
+		t.Fatalf("Expected submit 2 to succeed, got %v", res)
+	}
+	if cluster.leader == leader {
+		t.Errorf("Cluster still tracks node %d as the leader after it was cut off", leader)
+	}
+}
+
+func TestClusterChecks(t *testing.T) {
+	num := 3
+
+	cluster := NewCluster(num, NewTestApplication)
+	cluster.Serve()
+	defer cluster.Shutdown()
+	leader, _ := cluster.CheckSingleLeader(t)
+	for i := 1; i <= 3; i++ {
+		if _, ok := cluster.Submit(i); !ok {
+			t.Fatalf("Expected submit %d to succeed", i)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+	for i := 1; i <= 3; i++ {
+		cluster.CheckCommittedN(t, i, num)
+	}
+
+	// A command the leader can't replicate isn't committed.
+	cluster.SetFaults(leader, func(to raft.ServerID, serviceMethod string) raft.Fault {
+		return raft.Fault{Drop: true}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := cluster.Servers[leader].SubmitIndexed(ctx, 4); err != raft.ErrUnknownResult {
+		t.Fatalf("Expected the cut-off leader to append the command with an unknown result, got %v", err)
+	}
+	cluster.CheckNotCommitted(t, 4)
+}
+
+func TestClusterNodeConfig(t *testing.T) {
+	num := 3
+	dir := t.TempDir()
+
+	cluster := NewCluster(num, NewTestApplication)
+	// Node 0 never stands for election, and node 1 has its own address and
+	// data directory.
+	cluster.Nodes = []NodeConfig{
+		{Config: &raft.Config{ElectionTimeoutMin: time.Minute, ElectionTimeoutMax: time.Minute}},
+		{ListenAddr: "127.0.0.1:0", DataDir: dir},
+	}
+	cluster.Serve()
+	defer cluster.Shutdown()
+	leader, _ := cluster.CheckSingleLeader(t)
+	if leader == 0 {
+		t.Errorf("Node 0 leads despite its election timeout")
+	}
+	if res, ok := cluster.Submit(1); !ok || res != 1 {
+		t.Fatalf("Expected submit 1 to succeed, got %v", res)
+	}
+	if host, _, _ := net.SplitHostPort(cluster.Servers[1].GetListenAddr().String()); host != "127.0.0.1" {
+		t.Errorf("Node 1 listens at %s, want 127.0.0.1", cluster.Servers[1].GetListenAddr())
+	}
+	if files, err := os.ReadDir(dir); err != nil || len(files) == 0 {
+		t.Errorf("Node 1 persisted nothing in its data directory (%v)", err)
+	}
+}
+
+// waitCommittedN waits up to 2 seconds for command to be applied by n nodes.
+func waitCommittedN(t *testing.T, cluster *Cluster, command interface{}, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		count, _ := cluster.CheckCommitted(t, command)
+		if count == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d nodes applied %v, want %d", count, command, n)
+		}
+	}
+}
+
+func TestClusterCrashFollower(t *testing.T) {
+	num := 3
+
+	cluster := NewCluster(num, NewTestApplication)
+	cluster.DataDir = t.TempDir()
+	cluster.Serve()
+	defer cluster.Shutdown()
+	cluster.CheckInvariants(t, 10*time.Millisecond)
+	leader, _ := cluster.CheckSingleLeader(t)
+	for i := 1; i <= 3; i++ {
+		if _, ok := cluster.Submit(i); !ok {
+			t.Fatalf("Expected submit %d to succeed", i)
+		}
+	}
+	follower := (leader + 1) % num
+	cluster.Crash(follower)
+	for i := 4; i <= 6; i++ {
+		if _, ok := cluster.Submit(i); !ok {
+			t.Fatalf("Expected submit %d to succeed without the crashed follower", i)
+		}
+	}
+
+	// The restarted follower replays its log, and catches up with the
+	// entries committed while it was down.
+	if err := cluster.Restart(follower); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cluster.Submit(7); !ok {
+		t.Fatal("Expected submit 7 to succeed")
+	}
+	for i := 1; i <= 7; i++ {
+		waitCommittedN(t, cluster, i, num)
+	}
+	cluster.CheckApplied(t)
+	cluster.CheckLogs(t)
+}
+
+func TestClusterCrashLeaderMidCommit(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		fault     raft.Fault
+		committed bool
+	}{
+		// The leader crashes before replicating the entry: the next leader
+		// doesn't have it, and overwrites it in the log of the restarted
+		// node.
+		{"Unreplicated", raft.Fault{Drop: true}, false},
+		// The leader crashes after replicating the entry, but before
+		// learning it's replicated: the next leader commits it.
+		{"Replicated", raft.Fault{DropReply: true}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			num := 3
+
+			cluster := NewCluster(num, NewTestApplication)
+			cluster.DataDir = t.TempDir()
+			cluster.Serve()
+			defer cluster.Shutdown()
+			cluster.CheckInvariants(t, 10*time.Millisecond)
+			leader, _ := cluster.CheckSingleLeader(t)
+			if _, ok := cluster.Submit(1); !ok {
+				t.Fatal("Expected submit 1 to succeed")
+			}
+
+			cluster.SetFaults(leader, func(to raft.ServerID, serviceMethod string) raft.Fault {
+				return tc.fault
+			})
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			if _, err := cluster.Servers[leader].SubmitIndexed(ctx, 2); err != raft.ErrUnknownResult {
+				t.Fatalf("Expected the command to be appended with an unknown result, got %v", err)
+			}
+			cluster.Crash(leader)
+			cluster.SetFaults(leader, nil)
+			if _, err := cluster.WaitForLeader(2 * time.Second); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := cluster.Submit(3); !ok {
+				t.Fatal("Expected submit 3 to succeed on the next leader")
+			}
+			if err := cluster.Restart(leader); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := cluster.Submit(4); !ok {
+				t.Fatal("Expected submit 4 to succeed")
+			}
+
+			for _, command := range []int{1, 3, 4} {
+				waitCommittedN(t, cluster, command, num)
+			}
+			if tc.committed {
+				waitCommittedN(t, cluster, 2, num)
+			} else {
+				cluster.CheckNotCommitted(t, 2)
+			}
+			cluster.CheckApplied(t)
+			cluster.CheckLogs(t)
+		})
+	}
+}
+
+func TestClusterRestartAll(t *testing.T) {
+	num := 3
+
+	cluster := NewCluster(num, NewTestApplication)
+	cluster.DataDir = t.TempDir()
+	cluster.Serve()
+	defer cluster.Shutdown()
+	cluster.CheckInvariants(t, 10*time.Millisecond)
+	if _, err := cluster.WaitForLeader(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if _, ok := cluster.Submit(i); !ok {
+			t.Fatalf("Expected submit %d to succeed", i)
+		}
+	}
+	if err := cluster.Restart(0); err == nil {
+		t.Error("Expected restarting a running node to fail")
+	}
+	for i := 0; i < num; i++ {
+		cluster.Crash(i)
+	}
+	for i := 0; i < num; i++ {
+		if err := cluster.Restart(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := cluster.WaitForLeader(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cluster.Submit(4); !ok {
+		t.Fatal("Expected submit 4 to succeed after the restart")
+	}
+	for i := 1; i <= 4; i++ {
+		waitCommittedN(t, cluster, i, num)
+	}
+	cluster.CheckApplied(t)
+	cluster.CheckLogs(t)
+}
+
+// submitLoad submits distinct commands to the cluster from workers goroutines
+// until stop is closed. The function it returns waits for them, and returns
+// the commands that were committed.
+func submitLoad(cluster *Cluster, workers int, stop chan struct{}) func() []interface{} {
+	var mu sync.Mutex
+	var committed []interface{}
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for k := 0; ; k++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				command := w*1000000 + k
+				if _, ok := cluster.Submit(command); ok {
+					mu.Lock()
+					committed = append(committed, command)
+					mu.Unlock()
+				} else {
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+		}(w)
+	}
+	return func() []interface{} {
+		wg.Wait()
+		return committed
+	}
+}
+
+// waitAppliedByRunning waits up to 5 seconds for every running node to apply
+// all of commands.
+func waitAppliedByRunning(t *testing.T, cluster *Cluster, commands []interface{}) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		node, missing := -1, interface{}(nil)
+		cluster.mu.Lock()
+		for i, entries := range cluster.applied {
+			if cluster.crashed[i] {
+				continue
+			}
+			applied := make(map[interface{}]bool, len(entries))
+			for _, entry := range entries {
+				applied[entry.Command] = true
+			}
+			for _, command := range commands {
+				if !applied[command] {
+					node, missing = i, command
+					break
+				}
+			}
+			if node >= 0 {
+				break
+			}
+		}
+		cluster.mu.Unlock()
+		if node < 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("node %d didn't apply the committed command %v", node, missing)
+		}
+	}
+}
+
+// checkMembership checks the safety of the cluster after membership changes:
+// no committed command is lost by the running nodes, they applied and logged
+// the same commands at the same indexes, and agree on the leader of each term.
+func checkMembership(t *testing.T, cluster *Cluster, committed []interface{}) {
+	t.Helper()
+	if len(committed) == 0 {
+		t.Fatal("No command was committed")
+	}
+	waitAppliedByRunning(t, cluster, committed)
+	cluster.CheckSingleLeader(t)
+	cluster.CheckApplied(t)
+	cluster.CheckLogs(t)
+	cluster.CheckElections(t)
+}
+
+func TestClusterMembershipUnderLoad(t *testing.T) {
+	num := 3
+
+	cluster := NewCluster(num, NewTestApplication)
+	cluster.Serve()
+	defer cluster.Shutdown()
+	cluster.CheckInvariants(t, 10*time.Millisecond)
+	leader, _ := cluster.CheckSingleLeader(t)
+	stop := make(chan struct{})
+	wait := submitLoad(cluster, 3, stop)
+
+	// Grow the cluster to 5 nodes, remove its leader, which hands the
+	// leadership over first, and a follower, all while commands flow.
+	for i := 0; i < 2; i++ {
+		if _, err := cluster.AddNode(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := cluster.RemoveNode(leader); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	newLeader, _ := cluster.CheckSingleLeader(t)
+	if newLeader == leader {
+		t.Fatalf("The removed node %d still leads", leader)
+	}
+	follower := (leader + 1) % num
+	if follower == newLeader {
+		follower = (leader + 2) % num
+	}
+	if err := cluster.RemoveNode(follower); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(stop)
+	committed := wait()
+
+	cm, err := cluster.Servers[3].Group(raft.DefaultGroup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := cm.Status()
+	if want := []raft.ServerID{raft.IntID(3 - leader - follower), "3", "4"}; !reflect.DeepEqual(status.Peers, want) {
+		t.Errorf("The members are %v, want %v", status.Peers, want)
+	}
+	checkMembership(t, cluster, committed)
+}
+
+func TestClusterMembershipPartition(t *testing.T) {
+	num := 3
+
+	cluster := NewCluster(num, NewTestApplication)
+	cluster.Serve()
+	defer cluster.Shutdown()
+	cluster.CheckInvariants(t, 10*time.Millisecond)
+	leader, _ := cluster.CheckSingleLeader(t)
+	stop := make(chan struct{})
+	wait := submitLoad(cluster, 2, stop)
+
+	// isolate cuts node i off from the others, or heals the partition if i
+	// is negative.
+	isolate := func(i int) {
+		for j := range cluster.Servers {
+			if j == i {
+				cluster.SetFaults(j, func(to raft.ServerID, serviceMethod string) raft.Fault {
+					return raft.Fault{Drop: true}
+				})
+			} else if i >= 0 {
+				isolated := raft.IntID(i)
+				cluster.SetFaults(j, func(to raft.ServerID, serviceMethod string) raft.Fault {
+					return raft.Fault{Drop: to == isolated}
+				})
+			} else {
+				cluster.SetFaults(j, nil)
+			}
+		}
+	}
+
+	// A node is added while a follower is cut off: the leader and the other
+	// follower are a majority of the 4 nodes with the new one.
+	follower := (leader + 1) % num
+	isolate(follower)
+	added, err := cluster.AddNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	isolate(-1)
+
+	// The leader is cut off and replaced, and then removed once the
+	// partition heals.
+	isolate(leader)
+	time.Sleep(time.Second)
+	isolate(-1)
+	if err := cluster.RemoveNode(leader); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(stop)
+	committed := wait()
+
+	cm, err := cluster.Servers[added].Group(raft.DefaultGroup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := cm.Status()
+	if len(status.Peers) != num || hasMember(status.Peers, raft.IntID(leader)) {
+		t.Errorf("The members are %v, want 3 without node %d", status.Peers, leader)
+	}
+	checkMembership(t, cluster, committed)
+}
+
+func TestInvariantChecker(t *testing.T) {
+	// sample returns the sample of node, in state and term, holding an entry
+	// per term of terms, the first committed ones committed.
+	sample := func(node int, state string, term, committed int, terms ...int) nodeSample {
+		s := nodeSample{node: node, status: raft.StatusReply{State: state, Term: term, LastLogIndex: len(terms) - 1}}
+		for i, entryTerm := range terms {
+			s.entries = append(s.entries, raft.LogEntryInfo{Index: i, Term: entryTerm, Command: strconv.Itoa(entryTerm*100 + i), Committed: i < committed})
+		}
+		return s
+	}
+	for _, tc := range []struct {
+		name    string
+		samples [][]nodeSample
+		want    string
+	}{
+		{"Valid", [][]nodeSample{
+			{sample(0, "Leader", 1, 1, 1, 1), sample(1, "Follower", 1, 0, 1)},
+			{sample(0, "Follower", 2, 2, 1, 1), sample(1, "Leader", 2, 2, 1, 1, 2)},
+		}, ""},
+		{"ElectionSafety", [][]nodeSample{
+			{sample(0, "Leader", 1, 0, 1)},
+			{sample(1, "Leader", 1, 0, 1)},
+		}, "election safety"},
+		{"LeaderAppendOnly", [][]nodeSample{
+			{sample(0, "Leader", 2, 0, 1, 2)},
+			{sample(0, "Leader", 2, 0, 1)},
+		}, "leader append-only"},
+		{"LogMatching", [][]nodeSample{
+			{sample(0, "Follower", 3, 0, 1, 3), sample(1, "Follower", 3, 0, 2, 3)},
+		}, "log matching"},
+		{"LeaderCompleteness", [][]nodeSample{
+			{sample(0, "Follower", 1, 2, 1, 1)},
+			{sample(1, "Leader", 2, 0, 1)},
+		}, "leader completeness"},
+		{"StateMachineSafety", [][]nodeSample{
+			{sample(0, "Follower", 2, 2, 1, 1)},
+			{sample(1, "Follower", 2, 2, 1, 2)},
+		}, "state machine safety"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			checker := newInvariantChecker()
+			var err error
+			for _, samples := range tc.samples {
+				if err = checker.check(samples); err != nil {
+					break
+				}
+			}
+			if tc.want == "" && err != nil {
+				t.Errorf("Expected no violation, got %v", err)
+			}
+			if tc.want != "" && (err == nil || !strings.HasPrefix(err.Error(), tc.want)) {
+				t.Errorf("Expected a %s violation, got %v", tc.want, err)
+			}
+		})
+	}
+}
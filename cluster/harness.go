@@ -0,0 +1,218 @@
+package cluster
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aecra/raft/raft"
+)
+
+// The Check methods assert the safety properties of Raft on the cluster, for
+// the correctness tests of applications run on it. They fail the test they're
+// given with t.Fatalf. The commands they look for are compared with
+// reflect.DeepEqual, and expected to be submitted once each.
+
+// recordApplied returns the hook recording the commands node i applies to the
+// default group.
+func (c *Cluster) recordApplied(i int) func(groupId int, entry raft.CommitEntry) {
+	return func(groupId int, entry raft.CommitEntry) {
+		if groupId != raft.DefaultGroup {
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.applied[i] = append(c.applied[i], entry)
+	}
+}
+
+// CheckSingleLeader checks that one node leads the cluster, retrying for up to
+// 2 seconds while there's none, and returns its index and term. It fails t if
+// two nodes lead in the same term, or if no node leads. If nodes lead in
+// different terms, which happens until a deposed leader hears from the new
+// one, the one of the latest term is returned.
+func (c *Cluster) CheckSingleLeader(t testing.TB) (int, int) {
+	t.Helper()
+	for attempt := 0; attempt < 8; attempt++ {
+		leader, leaderTerm := -1, -1
+		leaders := make(map[int]int)
+		for i := range c.Servers {
+			_, term, isLeader := c.Servers[i].Report()
+			if !isLeader {
+				continue
+			}
+			if other, ok := leaders[term]; ok {
+				t.Fatalf("nodes %d and %d both lead term %d", other, i, term)
+			}
+			leaders[term] = i
+			if term > leaderTerm {
+				leader, leaderTerm = i, term
+			}
+		}
+		if leader >= 0 {
+			c.mu.Lock()
+			c.leader = leader
+			c.mu.Unlock()
+			return leader, leaderTerm
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	t.Fatalf("no node leads the cluster")
+	return -1, -1
+}
+
+// CheckNoLeader checks that no node leads the cluster.
+func (c *Cluster) CheckNoLeader(t testing.TB) {
+	t.Helper()
+	for i := range c.Servers {
+		if _, term, isLeader := c.Servers[i].Report(); isLeader {
+			t.Fatalf("node %d leads term %d, want no leader", i, term)
+		}
+	}
+}
+
+// CheckCommitted checks that command was applied, and that the nodes that
+// applied it did so at the same index, where the others applied nothing
+// yet. It returns the number of nodes that applied it and its index.
+func (c *Cluster) CheckCommitted(t testing.TB, command interface{}) (int, int) {
+	t.Helper()
+	c.mu.Lock()
+	applied := make([][]raft.CommitEntry, len(c.applied))
+	for i := range applied {
+		applied[i] = append([]raft.CommitEntry(nil), c.applied[i]...)
+	}
+	c.mu.Unlock()
+
+	count, index := 0, -1
+	for i, entries := range applied {
+		for _, entry := range entries {
+			if !reflect.DeepEqual(entry.Command, command) {
+				continue
+			}
+			if index != -1 && entry.Index != index {
+				t.Fatalf("node %d applied %v at index %d, and another node at %d", i, command, entry.Index, index)
+			}
+			index = entry.Index
+			count++
+			break
+		}
+	}
+	if count == 0 {
+		t.Fatalf("no node applied %v", command)
+	}
+	for i, entries := range applied {
+		for _, entry := range entries {
+			if entry.Index == index && !reflect.DeepEqual(entry.Command, command) {
+				t.Fatalf("node %d applied %v at index %d, where others applied %v", i, entry.Command, index, command)
+			}
+		}
+	}
+	return count, index
+}
+
+// CheckCommittedN checks that command was applied by n nodes, like
+// CheckCommitted.
+func (c *Cluster) CheckCommittedN(t testing.TB, command interface{}, n int) {
+	t.Helper()
+	if count, _ := c.CheckCommitted(t, command); count != n {
+		t.Fatalf("%d nodes applied %v, want %d", count, command, n)
+	}
+}
+
+// CheckNotCommitted checks that no node applied command.
+func (c *Cluster) CheckNotCommitted(t testing.TB, command interface{}) {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, entries := range c.applied {
+		for _, entry := range entries {
+			if reflect.DeepEqual(entry.Command, command) {
+				t.Fatalf("node %d applied %v at index %d, want it not committed", i, command, entry.Index)
+			}
+		}
+	}
+}
+
+// CheckApplied checks that the nodes applied the same command at each index,
+// including the ones replayed by nodes restarted after a Crash, which apply
+// their log again from their last snapshot.
+func (c *Cluster) CheckApplied(t testing.TB) {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	type application struct {
+		node    int
+		command interface{}
+	}
+	byIndex := make(map[int]application)
+	for i, entries := range c.applied {
+		for _, entry := range entries {
+			first, ok := byIndex[entry.Index]
+			if !ok {
+				byIndex[entry.Index] = application{node: i, command: entry.Command}
+			} else if !reflect.DeepEqual(entry.Command, first.command) {
+				t.Fatalf("node %d applied %v at index %d, where node %d applied %v", i, entry.Command, entry.Index, first.node, first.command)
+			}
+		}
+	}
+}
+
+// CheckLogs checks that the running nodes agree on the term and command of
+// the entries they know to be committed, which their logs still hold.
+func (c *Cluster) CheckLogs(t testing.TB) {
+	t.Helper()
+	type logged struct {
+		node int
+		raft.LogEntryInfo
+	}
+	byIndex := make(map[int]logged)
+	for i := range c.Servers {
+		if c.crashed[i] {
+			continue
+		}
+		entries, err := c.Servers[i].ReadEntries(0, -1)
+		if err != nil {
+			t.Fatalf("reading the log of node %d: %v", i, err)
+		}
+		for _, entry := range entries {
+			if !entry.Committed {
+				continue
+			}
+			first, ok := byIndex[entry.Index]
+			if !ok {
+				byIndex[entry.Index] = logged{node: i, LogEntryInfo: entry}
+			} else if entry.Term != first.Term || entry.Command != first.Command {
+				t.Fatalf("node %d committed %s of term %d at index %d, where node %d committed %s of term %d", i, entry.Command, entry.Term, entry.Index, first.node, first.Command, first.Term)
+			}
+		}
+	}
+}
+
+// CheckElections checks that the running nodes agree on the leader of each
+// term, among the recent elections of their raft.Metrics: Raft elects at most
+// one leader per term.
+func (c *Cluster) CheckElections(t testing.TB) {
+	t.Helper()
+	type elected struct {
+		node   int
+		leader raft.ServerID
+	}
+	byTerm := make(map[int]elected)
+	for i := range c.Servers {
+		if c.crashed[i] {
+			continue
+		}
+		metrics, err := c.Servers[i].Metrics()
+		if err != nil {
+			t.Fatalf("reading the metrics of node %d: %v", i, err)
+		}
+		for _, election := range metrics.RecentElections {
+			first, ok := byTerm[election.Term]
+			if !ok {
+				byTerm[election.Term] = elected{node: i, leader: election.Leader}
+			} else if election.Leader != first.leader {
+				t.Fatalf("node %d saw %s lead term %d, where node %d saw %s", i, election.Leader, election.Term, first.node, first.leader)
+			}
+		}
+	}
+}
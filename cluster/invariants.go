@@ -0,0 +1,243 @@
+package cluster
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aecra/raft/raft"
+)
+
+// nodeSample is the state of a node at some point: its status, and its log
+// past its snapshot.
+type nodeSample struct {
+	node    int
+	status  raft.StatusReply
+	entries []raft.LogEntryInfo
+}
+
+// entry returns the entry of the sample at index, if the log holds it.
+func (s nodeSample) entry(index int) (raft.LogEntryInfo, bool) {
+	if len(s.entries) == 0 {
+		return raft.LogEntryInfo{}, false
+	}
+	i := index - s.entries[0].Index
+	if i < 0 || i >= len(s.entries) {
+		return raft.LogEntryInfo{}, false
+	}
+	return s.entries[i], true
+}
+
+// lastIndex returns the index of the last entry of the sample's log.
+func (s nodeSample) lastIndex() int {
+	return s.status.LastLogIndex
+}
+
+// committedEntry is an entry seen committed, by node in term.
+type committedEntry struct {
+	raft.LogEntryInfo
+	node int
+	term int
+}
+
+// invariantChecker checks the samples of the nodes of a cluster, taken over
+// time, against the safety properties of Raft of figure 3 of the paper:
+// election safety, leader append-only, log matching, leader completeness and
+// state machine safety.
+type invariantChecker struct {
+	// leaders holds the node seen leading each term.
+	leaders map[int]int
+
+	// leading holds the last sample of each node seen leading.
+	leading map[int]nodeSample
+
+	// committed holds the entries seen committed, by index.
+	committed map[int]committedEntry
+}
+
+func newInvariantChecker() *invariantChecker {
+	return &invariantChecker{
+		leaders:   make(map[int]int),
+		leading:   make(map[int]nodeSample),
+		committed: make(map[int]committedEntry),
+	}
+}
+
+// sameEntry reports whether a and b are the same entry, as far as their
+// summaries tell.
+func sameEntry(a, b raft.LogEntryInfo) bool {
+	return a.Term == b.Term && a.Command == b.Command
+}
+
+// check checks samples, taken at the same time, against the ones checked
+// before, and returns the first violation it finds.
+func (ic *invariantChecker) check(samples []nodeSample) error {
+	for _, s := range samples {
+		if err := ic.checkLeader(s); err != nil {
+			return err
+		}
+	}
+	for i, a := range samples {
+		for _, b := range samples[i+1:] {
+			if err := checkLogMatching(a, b); err != nil {
+				return err
+			}
+		}
+	}
+	for _, s := range samples {
+		for _, entry := range s.entries {
+			if !entry.Committed {
+				continue
+			}
+			first, ok := ic.committed[entry.Index]
+			if !ok {
+				ic.committed[entry.Index] = committedEntry{LogEntryInfo: entry, node: s.node, term: s.status.Term}
+			} else if !sameEntry(entry, first.LogEntryInfo) {
+				return fmt.Errorf("state machine safety: node %d committed %s of term %d at index %d, where node %d committed %s of term %d",
+					s.node, entry.Command, entry.Term, entry.Index, first.node, first.Command, first.Term)
+			}
+		}
+	}
+	return nil
+}
+
+// checkLeader checks the election safety, leader append-only and leader
+// completeness properties on s, if the node leads.
+func (ic *invariantChecker) checkLeader(s nodeSample) error {
+	if s.status.State != "Leader" {
+		delete(ic.leading, s.node)
+		return nil
+	}
+	term := s.status.Term
+	if other, ok := ic.leaders[term]; ok && other != s.node {
+		return fmt.Errorf("election safety: nodes %d and %d both led term %d", other, s.node, term)
+	}
+	ic.leaders[term] = s.node
+
+	if prev, ok := ic.leading[s.node]; ok && prev.status.Term == term {
+		if s.lastIndex() < prev.lastIndex() {
+			return fmt.Errorf("leader append-only: the log of node %d, leading term %d, shrank from index %d to %d", s.node, term, prev.lastIndex(), s.lastIndex())
+		}
+		for _, before := range prev.entries {
+			if after, ok := s.entry(before.Index); ok && !sameEntry(before, after) {
+				return fmt.Errorf("leader append-only: node %d, leading term %d, replaced %s of term %d at index %d with %s of term %d",
+					s.node, term, before.Command, before.Term, before.Index, after.Command, after.Term)
+			}
+		}
+	}
+	ic.leading[s.node] = s
+
+	// The entries seen committed by a node in a term before this one were
+	// committed before this term, so the leader must have them; the ones its
+	// log no longer holds were compacted into its snapshot.
+	for index, committed := range ic.committed {
+		if committed.term >= term {
+			continue
+		}
+		if index > s.lastIndex() {
+			return fmt.Errorf("leader completeness: node %d, leading term %d, lacks index %d, committed by node %d in term %d", s.node, term, index, committed.node, committed.term)
+		}
+		if entry, ok := s.entry(index); ok && !sameEntry(entry, committed.LogEntryInfo) {
+			return fmt.Errorf("leader completeness: node %d, leading term %d, holds %s of term %d at index %d, where node %d committed %s of term %d",
+				s.node, term, entry.Command, entry.Term, index, committed.node, committed.Command, committed.Term)
+		}
+	}
+	return nil
+}
+
+// checkLogMatching checks the log matching property on a and b: if their logs
+// hold an entry with the same index and term, they hold the same entries up
+// to it. Only the indexes both logs still hold are compared.
+func checkLogMatching(a, b nodeSample) error {
+	last := a.lastIndex()
+	if b.lastIndex() < last {
+		last = b.lastIndex()
+	}
+	matched := false
+	for index := last; index >= 0; index-- {
+		x, okA := a.entry(index)
+		y, okB := b.entry(index)
+		if !okA || !okB {
+			break
+		}
+		if !matched {
+			matched = x.Term == y.Term
+			continue
+		}
+		if !sameEntry(x, y) {
+			return fmt.Errorf("log matching: nodes %d and %d agree on a later entry, but hold %s of term %d and %s of term %d at index %d",
+				a.node, b.node, x.Command, x.Term, y.Command, y.Term, index)
+		}
+	}
+	return nil
+}
+
+// sample samples the running nodes. A node whose state changes while it's
+// sampled is left out.
+func (c *Cluster) sample() []nodeSample {
+	c.mu.Lock()
+	servers := append([]*raft.Server(nil), c.Servers...)
+	crashed := append([]bool(nil), c.crashed...)
+	c.mu.Unlock()
+	var samples []nodeSample
+	for i, s := range servers {
+		if crashed[i] {
+			continue
+		}
+		cm, err := s.Group(raft.DefaultGroup)
+		if err != nil {
+			continue
+		}
+		before := cm.Status()
+		entries, err := cm.ReadEntries(0, -1)
+		after := cm.Status()
+		if err != nil || after.State == "Dead" || before.State != after.State || before.Term != after.Term || before.LastLogIndex != after.LastLogIndex {
+			continue
+		}
+		samples = append(samples, nodeSample{node: i, status: after, entries: entries})
+	}
+	return samples
+}
+
+// CheckInvariants checks the safety properties of Raft on the cluster while
+// the test runs, rather than once as the other Check methods do: it samples
+// the logs and states of the running nodes every interval until Shutdown or
+// the end of t, and checks them and their history for two leaders in a term,
+// a leader overwriting its log, logs agreeing on an entry but not on the ones
+// before it, a leader lacking an entry committed before its term, and nodes
+// committing different entries at the same index. It fails t with t.Errorf on
+// the first violation.
+func (c *Cluster) CheckInvariants(t testing.TB, interval time.Duration) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		checker := newInvariantChecker()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			if err := checker.check(c.sample()); err != nil {
+				t.Errorf("cluster: %v", err)
+				<-stop
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	stopChecking := func() {
+		once.Do(func() {
+			close(stop)
+			<-done
+		})
+	}
+	c.mu.Lock()
+	c.checkers = append(c.checkers, stopChecking)
+	c.mu.Unlock()
+	t.Cleanup(stopChecking)
+}
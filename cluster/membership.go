@@ -0,0 +1,150 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aecra/raft/raft"
+)
+
+// membershipTimeout is how long AddNode and RemoveNode keep trying to have
+// their change committed.
+const membershipTimeout = 10 * time.Second
+
+// AddNode starts a new node, which isn't a member of the cluster, connects it
+// and the running nodes to each other, and adds it to the cluster through the
+// leader. It returns the index of the node in Servers. It must be called after
+// Serve, and concurrently with no other method of the Cluster but Submit.
+func (c *Cluster) AddNode() (int, error) {
+	// The node counts as crashed until it's started, for Submit to skip it.
+	c.mu.Lock()
+	i := len(c.Servers)
+	c.Servers = append(c.Servers, nil)
+	c.storages = append(c.storages, nil)
+	c.transports = append(c.transports, raft.NewFaultTransport(nil))
+	c.crashed = append(c.crashed, true)
+	c.removed = append(c.removed, false)
+	c.applied = append(c.applied, nil)
+	c.mu.Unlock()
+	if err := c.start(i); err != nil {
+		return -1, fmt.Errorf("cluster: %v", err)
+	}
+	c.mu.Lock()
+	c.crashed[i] = false
+	c.mu.Unlock()
+	if err := c.connect(i); err != nil {
+		return -1, err
+	}
+
+	id, addr := raft.IntID(i), c.Servers[i].GetListenAddr().String()
+	err := c.reconfigure(func(cm *raft.ConsensusModule) error {
+		return cm.AddServer(id, addr)
+	}, func(peers []raft.ServerID) bool {
+		return hasMember(peers, id)
+	})
+	if err != nil {
+		return -1, fmt.Errorf("cluster: adding node %d: %v", i, err)
+	}
+	return i, nil
+}
+
+// RemoveNode removes node i from the cluster through the leader, handing the
+// leadership over to another member first if i leads, and then stops it. A
+// removed node can't be restarted. It must be called concurrently with no
+// other method of the Cluster but Submit.
+func (c *Cluster) RemoveNode(i int) error {
+	if c.crashed[i] {
+		return fmt.Errorf("cluster: node %d isn't running", i)
+	}
+	id := raft.IntID(i)
+	err := c.reconfigure(func(cm *raft.ConsensusModule) error {
+		status := cm.Status()
+		if status.Id != id {
+			return cm.RemoveServer(id)
+		}
+		for _, peer := range status.Peers {
+			if j := c.indexOf(peer); j >= 0 && j != i && !c.crashed[j] {
+				if err := cm.TransferLeadership(peer); err != nil {
+					return err
+				}
+				return fmt.Errorf("handing the leadership of node %d over to node %d", i, j)
+			}
+		}
+		return errors.New("no running member to hand the leadership over to")
+	}, func(peers []raft.ServerID) bool {
+		return !hasMember(peers, id)
+	})
+	if err != nil {
+		return fmt.Errorf("cluster: removing node %d: %v", i, err)
+	}
+
+	c.mu.Lock()
+	c.crashed[i] = true
+	c.mu.Unlock()
+	c.removed[i] = true
+	for j := range c.Servers {
+		if !c.crashed[j] {
+			c.Servers[j].Disconnect(id)
+		}
+	}
+	c.Servers[i].DisconnectAll()
+	c.Servers[i].Stop(context.Background())
+	c.storages[i].Close()
+	c.storages[i] = nil
+	return nil
+}
+
+// reconfigure has the leader carry out change, a membership change, trying
+// again on whichever node leads then until it succeeds or membershipTimeout
+// passes. An attempt that fails may still have been appended, and be committed
+// later: once one failed, reconfigure also returns when done tells that the
+// members the leader knows reflect the change.
+func (c *Cluster) reconfigure(change func(cm *raft.ConsensusModule) error, done func(peers []raft.ServerID) bool) error {
+	deadline := time.Now().Add(membershipTimeout)
+	var err error
+	for {
+		leader, waitErr := c.WaitForLeader(time.Until(deadline))
+		if waitErr != nil {
+			if err != nil {
+				return err
+			}
+			return waitErr
+		}
+		cm, groupErr := c.Servers[leader].Group(raft.DefaultGroup)
+		if groupErr != nil {
+			return groupErr
+		}
+		if err != nil && done(cm.Status().Peers) {
+			return nil
+		}
+		if err = change(cm); err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// indexOf returns the index of node id in Servers, or -1 if it's not a node.
+func (c *Cluster) indexOf(id raft.ServerID) int {
+	for i := range c.Servers {
+		if raft.IntID(i) == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// hasMember reports whether peers holds id.
+func hasMember(peers []raft.ServerID, id raft.ServerID) bool {
+	for _, peer := range peers {
+		if peer == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+// Command raft-bench generates load against a running Raft cluster whose
+// application is kvstore, and reports the throughput and the latency
+// percentiles of the commands it submitted.
+//
+// Usage:
+//
+//	raft-bench [-addrs host:port,...] [-group id] [-token token] [flags]
+//
+// It runs -clients concurrent clients for -duration, each submitting "put"
+// commands with values of -size bytes to -keys distinct keys, one at a time.
+// The latency of a command is measured from its submission to the client
+// receiving its result, retries to find the leader included. Commands that
+// fail are counted apart and left out of the latencies.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aecra/raft/client"
+	"github.com/aecra/raft/kvstore"
+	"github.com/aecra/raft/raft"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: raft-bench [flags]
+
+flags:
+`)
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+// result is what a client measured.
+type result struct {
+	latencies []time.Duration
+	errors    int
+	lastErr   error
+}
+
+func main() {
+	addrs := flag.String("addrs", "localhost:8080", "comma-separated addresses of the servers, the i-th being server i")
+	group := flag.Int("group", raft.DefaultGroup, "ID of the group")
+	token := flag.String("token", os.Getenv("RAFT_TOKEN"), "cluster token, $RAFT_TOKEN by default")
+	clients := flag.Int("clients", 16, "number of concurrent clients")
+	duration := flag.Duration("duration", 10*time.Second, "duration of the run")
+	size := flag.Int("size", 128, "size of the values in bytes")
+	keys := flag.Int("keys", 1000, "number of distinct keys")
+	timeout := flag.Duration("timeout", 5*time.Second, "timeout of a command")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 0 || *clients <= 0 || *duration <= 0 || *size < 0 || *keys <= 0 {
+		usage()
+	}
+
+	c, err := client.New(client.Options{Addrs: strings.Split(*addrs, ","), GroupId: *group, Token: *token})
+	if err != nil {
+		fatal(err)
+	}
+	defer c.Close()
+
+	value := strings.Repeat("x", *size)
+	results := make([]result, *clients)
+	deadline := time.Now().Add(*duration)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range results {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := &results[i]
+			for n := 0; time.Now().Before(deadline); n++ {
+				entry := kvstore.Entry{Method: "put", Key: strconv.Itoa((n**clients + i) % *keys), Value: value}
+				ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+				submitted := time.Now()
+				_, err := c.SubmitIdempotent(ctx, entry)
+				cancel()
+				if err != nil {
+					r.errors++
+					r.lastErr = err
+					continue
+				}
+				r.latencies = append(r.latencies, time.Since(submitted))
+			}
+		}()
+	}
+	wg.Wait()
+	report(results, time.Since(start), *size)
+}
+
+// report prints the throughput and latency percentiles of results, measured
+// over elapsed.
+func report(results []result, elapsed time.Duration, size int) {
+	var latencies []time.Duration
+	var errors int
+	var lastErr error
+	for _, r := range results {
+		latencies = append(latencies, r.latencies...)
+		errors += r.errors
+		if r.lastErr != nil {
+			lastErr = r.lastErr
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	ops := float64(len(latencies)) / elapsed.Seconds()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "commands:\t%d\n", len(latencies))
+	fmt.Fprintf(w, "errors:\t%d\n", errors)
+	fmt.Fprintf(w, "duration:\t%v\n", elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "throughput:\t%.1f ops/s, %.2f MB/s\n", ops, ops*float64(size)/1e6)
+	if len(latencies) > 0 {
+		var sum time.Duration
+		for _, l := range latencies {
+			sum += l
+		}
+		fmt.Fprintf(w, "latency mean:\t%v\n", (sum / time.Duration(len(latencies))).Round(time.Microsecond))
+		for _, q := range []float64{0.5, 0.9, 0.99, 0.999} {
+			fmt.Fprintf(w, "latency p%g:\t%v\n", q*100, percentile(latencies, q).Round(time.Microsecond))
+		}
+		fmt.Fprintf(w, "latency max:\t%v\n", latencies[len(latencies)-1].Round(time.Microsecond))
+	}
+	w.Flush()
+	if lastErr != nil {
+		fmt.Fprintln(os.Stderr, "raft-bench: last error:", lastErr)
+	}
+}
+
+// percentile returns the q-quantile of sorted, which isn't empty.
+func percentile(sorted []time.Duration, q float64) time.Duration {
+	i := int(q * float64(len(sorted)))
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "raft-bench:", err)
+	os.Exit(1)
+}
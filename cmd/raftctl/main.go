@@ -0,0 +1,335 @@
+// Command raftctl inspects and reconfigures a running Raft cluster through the
+// "Admin" RPC service of its servers.
+//
+// Usage:
+//
+//	raftctl [-addr host:port] [-group id] [-token token] <command> [arguments]
+//
+// The commands are:
+//
+//	status                         show the state of the server
+//	health [max-lag]               show whether the server is alive and ready
+//	list-peers                     list the members of the group
+//	add-server <id> <addr>         add server id, listening at addr
+//	remove-server <id>             remove server id
+//	forget-peer <id>               remove server id, gone for good, and disconnect from it
+//	transfer-leadership <id>       hand the leadership over to server id
+//	snapshot                       take a snapshot now
+//	log-inspect [from [to]]        print the entries in [from, to) of the log
+//	maintenance on|off             stop or resume standing for election
+//	backup <file>                  write a backup archive of the group to file
+//	check-state                    compare the states of the servers of the group
+//	config [key=value ...]         show or change the tunable parameters
+//
+// add-server, remove-server, forget-peer and transfer-leadership must be sent to the
+// leader; raftctl prints the leader's ID when the server isn't. maintenance
+// applies to all the groups of the server, and "on" hands the leadership of
+// the groups it leads over to other servers. backup is best sent to the
+// leader, which knows of the most committed entries. Archives are restored
+// into the storage of the servers of a new cluster with raft.RestoreBackup,
+// which needs the application.
+//
+// check-state must be sent to the leader. It prints the checksum of the state
+// of every server at the state barrier the leader logs, and exits with status
+// 1 if they differ, which means the application isn't deterministic.
+//
+// config changes the parameters of the server it's sent to, without
+// restarting it; the keys are election-timeout-min, election-timeout-max,
+// heartbeat-interval and snapshot-threshold. It prints the values in effect.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aecra/raft/raft"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: raftctl [flags] <command> [arguments]
+
+commands:
+  status
+  health [max-lag]
+  list-peers
+  add-server <id> <addr>
+  remove-server <id>
+  forget-peer <id>
+  transfer-leadership <id>
+  snapshot
+  log-inspect [from [to]]
+  maintenance on|off
+  backup <file>
+  check-state
+  config [key=value ...]
+
+flags:
+`)
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	addr := flag.String("addr", "localhost:8080", "address of the server")
+	group := flag.Int("group", raft.DefaultGroup, "ID of the group")
+	token := flag.String("token", os.Getenv("RAFT_TOKEN"), "cluster token, $RAFT_TOKEN by default")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+	}
+
+	conn, err := net.Dial("tcp", *addr)
+	if err != nil {
+		fatal(err)
+	}
+	if *token != "" {
+		if err := raft.Authenticate(conn, *token); err != nil {
+			fatal(err)
+		}
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+
+	args := flag.Args()[1:]
+	switch flag.Arg(0) {
+	case "status":
+		err = status(client, *group)
+	case "health":
+		err = health(client, *group, args)
+	case "list-peers":
+		err = listPeers(client, *group)
+	case "add-server":
+		if len(args) != 2 {
+			usage()
+		}
+		err = client.Call("Admin.AddServer", raft.ServerArgs{GroupId: *group, Id: raft.ServerID(args[0]), Addr: args[1]}, &struct{}{})
+	case "remove-server":
+		if len(args) != 1 {
+			usage()
+		}
+		err = client.Call("Admin.RemoveServer", raft.ServerArgs{GroupId: *group, Id: raft.ServerID(args[0])}, &struct{}{})
+	case "forget-peer":
+		if len(args) != 1 {
+			usage()
+		}
+		err = client.Call("Admin.ForgetPeer", raft.ServerArgs{GroupId: *group, Id: raft.ServerID(args[0])}, &struct{}{})
+	case "transfer-leadership":
+		if len(args) != 1 {
+			usage()
+		}
+		err = client.Call("Admin.TransferLeadership", raft.ServerArgs{GroupId: *group, Id: raft.ServerID(args[0])}, &struct{}{})
+	case "snapshot":
+		var reply raft.SnapshotReply
+		err = client.Call("Admin.Snapshot", raft.AdminArgs{GroupId: *group}, &reply)
+		if err == nil {
+			fmt.Printf("snapshot taken at index %d, term %d\n", reply.Index, reply.Term)
+		}
+	case "log-inspect":
+		err = logInspect(client, *group, args)
+	case "maintenance":
+		if len(args) != 1 || args[0] != "on" && args[0] != "off" {
+			usage()
+		}
+		enter := args[0] == "on"
+		err = client.Call("Admin.Maintenance", raft.MaintenanceArgs{Enter: enter, TransferLeadership: enter}, &struct{}{})
+	case "backup":
+		if len(args) != 1 {
+			usage()
+		}
+		var reply raft.BackupReply
+		err = client.Call("Admin.Backup", raft.AdminArgs{GroupId: *group}, &reply)
+		if err == nil {
+			err = os.WriteFile(args[0], reply.Archive, 0o600)
+		}
+	case "check-state":
+		err = checkState(client, *group)
+	case "config":
+		err = updateConfig(client, *group, args)
+	default:
+		usage()
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func status(client *rpc.Client, group int) error {
+	var reply raft.StatusReply
+	if err := client.Call("Admin.Status", raft.AdminArgs{GroupId: group}, &reply); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "id:\t%s\n", reply.Id)
+	fmt.Fprintf(w, "state:\t%s\n", reply.State)
+	fmt.Fprintf(w, "term:\t%d\n", reply.Term)
+	fmt.Fprintf(w, "leader:\t%s\n", reply.Leader)
+	fmt.Fprintf(w, "last contact:\t%s\n", since(reply.LastContact))
+	fmt.Fprintf(w, "commit index:\t%d\n", reply.CommitIndex)
+	fmt.Fprintf(w, "last applied:\t%d\n", reply.LastApplied)
+	fmt.Fprintf(w, "apply lag:\t%d\n", reply.ApplyLag)
+	fmt.Fprintf(w, "maintenance:\t%v\n", reply.Maintenance)
+	fmt.Fprintf(w, "last log index:\t%d\n", reply.LastLogIndex)
+	fmt.Fprintf(w, "snapshot index:\t%d\n", reply.SnapshotIndex)
+	fmt.Fprintf(w, "peers:\t%v\n", reply.Peers)
+	return w.Flush()
+}
+
+func health(client *rpc.Client, group int, args []string) error {
+	healthArgs := raft.HealthArgs{GroupId: group}
+	if len(args) > 1 {
+		usage()
+	}
+	if len(args) > 0 {
+		healthArgs.MaxLag = atoi(args[0])
+	}
+	var reply raft.Health
+	if err := client.Call("Admin.Health", healthArgs, &reply); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "alive:\t%v\n", reply.Alive)
+	fmt.Fprintf(w, "ready:\t%v\n", reply.Ready)
+	fmt.Fprintf(w, "leader:\t%s\n", reply.Leader)
+	fmt.Fprintf(w, "lag:\t%d\n", reply.Lag)
+	fmt.Fprintf(w, "quorum contact:\t%v\n", reply.QuorumContact)
+	fmt.Fprintf(w, "last contact:\t%s\n", since(reply.LastContact))
+	return w.Flush()
+}
+
+// since describes how long ago t was, or "never" if it's the zero time.
+func since(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return time.Since(t).Round(time.Millisecond).String() + " ago"
+}
+
+func listPeers(client *rpc.Client, group int) error {
+	var reply raft.ListPeersReply
+	if err := client.Call("Admin.ListPeers", raft.AdminArgs{GroupId: group}, &reply); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tADDRESS\tSTATE\tNEXT INDEX\tMATCH INDEX\tLAG")
+	for _, peer := range reply.Peers {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\n", peer.Id, peer.Addr, peer.State, peer.NextIndex, peer.MatchIndex, peer.Lag)
+	}
+	return w.Flush()
+}
+
+func logInspect(client *rpc.Client, group int, args []string) error {
+	logArgs := raft.LogArgs{GroupId: group, To: -1}
+	if len(args) > 2 {
+		usage()
+	}
+	if len(args) > 0 {
+		logArgs.From = atoi(args[0])
+	}
+	if len(args) > 1 {
+		logArgs.To = atoi(args[1])
+	}
+	var reply raft.LogReply
+	if err := client.Call("Admin.Log", logArgs, &reply); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "INDEX\tTERM\tCOMMITTED\tCOMMAND")
+	for _, entry := range reply.Entries {
+		command := entry.Command
+		if entry.Config {
+			command = "config " + command
+		}
+		fmt.Fprintf(w, "%d\t%d\t%t\t%s\n", entry.Index, entry.Term, entry.Committed, command)
+	}
+	return w.Flush()
+}
+
+func checkState(client *rpc.Client, group int) error {
+	var reply raft.StateReport
+	if err := client.Call("Admin.CheckState", raft.AdminArgs{GroupId: group}, &reply); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "state barrier at index %d\n", reply.Index)
+	fmt.Fprintln(w, "ID\tCHECKSUM\tERROR")
+	for _, replica := range reply.Replicas {
+		if replica.Err != "" {
+			fmt.Fprintf(w, "%s\t-\t%s\n", replica.Id, replica.Err)
+		} else {
+			fmt.Fprintf(w, "%s\t%016x\t\n", replica.Id, replica.Checksum)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if reply.Diverged() {
+		return fmt.Errorf("the states of the servers diverged at index %d", reply.Index)
+	}
+	return nil
+}
+
+func updateConfig(client *rpc.Client, group int, args []string) error {
+	update := raft.UpdateConfigArgs{GroupId: group}
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			usage()
+		}
+		switch key {
+		case "election-timeout-min":
+			update.Update.ElectionTimeoutMin = duration(value)
+		case "election-timeout-max":
+			update.Update.ElectionTimeoutMax = duration(value)
+		case "heartbeat-interval":
+			update.Update.HeartbeatInterval = duration(value)
+		case "snapshot-threshold":
+			update.Update.SnapshotThreshold = atoi(value)
+		default:
+			fatal(fmt.Errorf("unknown parameter %q", key))
+		}
+	}
+	var reply raft.ConfigUpdate
+	if err := client.Call("Admin.UpdateConfig", update, &reply); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "election-timeout-min:\t%v\n", reply.ElectionTimeoutMin)
+	fmt.Fprintf(w, "election-timeout-max:\t%v\n", reply.ElectionTimeoutMax)
+	fmt.Fprintf(w, "heartbeat-interval:\t%v\n", reply.HeartbeatInterval)
+	fmt.Fprintf(w, "snapshot-threshold:\t%d\n", reply.SnapshotThreshold)
+	return w.Flush()
+}
+
+func duration(s string) time.Duration {
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		fatal(fmt.Errorf("invalid duration %q", s))
+	}
+	return d
+}
+
+func atoi(s string) int {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		fatal(fmt.Errorf("invalid number %q", s))
+	}
+	return n
+}
+
+// fatal prints err and exits. Errors returned by the server lose their type
+// over RPC, so a redirection to the leader is recognized by its message.
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "raftctl:", err)
+	if strings.Contains(err.Error(), "not the leader") {
+		fmt.Fprintln(os.Stderr, "raftctl: send the command to the leader, see status")
+	}
+	os.Exit(1)
+}
@@ -0,0 +1,408 @@
+// Command raftd runs a node of a Raft cluster whose application is kvstore, as
+// a standalone daemon.
+//
+// Usage:
+//
+//	raftd -config raftd.yaml [flags]
+//
+// The configuration file, in YAML or TOML, is described by the config package,
+// and its keys may be overridden by RAFT_ environment variables. The node
+// listens for its peers, raftctl and the clients of the client package at
+// "listen", ":7000" by default, and serves on "http", ":8000" by default:
+//
+//	GET /kv/<key>                  the value of key, committed like a command
+//	PUT /kv/<key>[?ttl=<d>]        set key to the request body, for d if set
+//	DELETE /kv/<key>               delete key
+//	GET /kv/?prefix=<p>            the keys starting with p, read with Read
+//	GET /kv/?start=<a>&end=<b>     the keys in [a, b), read with Read
+//	GET /watch/<prefix>            stream the changes of the keys starting with prefix
+//	/metrics                       the metrics in the Prometheus text format
+//	/healthz, /readyz              the liveness and readiness probes
+//
+// The /kv/<key> requests answer the JSON of a kvstore.Result, and the scans,
+// which take an optional limit=<n> too, the JSON of the matching
+// kvstore.Pairs in the order of their keys. /watch/ streams the JSON of the
+// kvstore.Events the node applies, one per line, until the client goes away
+// or the node drops the watch. A node that isn't the
+// leader answers 503, with the ID and address of the leader it knows in the
+// Raft-Leader and Raft-Leader-Addr headers.
+//
+// If "admin" is set, the node serves the RaftAdmin gRPC service of the
+// raftadmin package there, over its TLS if it has one and plaintext
+// otherwise, to the calls carrying its token.
+//
+// raftd starts elections once it reaches a quorum of its peers. On SIGINT or
+// SIGTERM, it hands the leadership over to a peer, stops serving and exits
+// once its state is persisted. Under systemd, with Type=notify, it reports
+// when it's ready and stopping through $NOTIFY_SOCKET.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aecra/raft/config"
+	"github.com/aecra/raft/kvstore"
+	"github.com/aecra/raft/raft"
+	"github.com/aecra/raft/raft/raftadmin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// retryInterval is how often raftd dials the peers it couldn't reach yet.
+const retryInterval = 500 * time.Millisecond
+
+// expireInterval is how often the leader deletes the expired keys.
+const expireInterval = time.Second
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: raftd -config file [flags]
+
+flags:
+`)
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	path := flag.String("config", "raftd.yaml", "configuration file, in YAML or TOML")
+	requestTimeout := flag.Duration("request-timeout", 5*time.Second, "how long an HTTP request waits for its result")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "how long the graceful shutdown may take")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 0 {
+		usage()
+	}
+	cfg, err := config.Load(*path)
+	if err != nil {
+		fatal(err)
+	}
+	if cfg.Listen == "" {
+		cfg.Listen = ":7000"
+	}
+	if cfg.HTTP == "" {
+		cfg.HTTP = ":8000"
+	}
+
+	store, err := cfg.OpenStorage()
+	if err != nil {
+		fatal(err)
+	}
+	defer store.Close()
+
+	ready := make(chan interface{})
+	opts, err := cfg.Options(ready)
+	if err != nil {
+		fatal(err)
+	}
+	app := kvstore.NewKVStore().(*kvstore.KVStore)
+	opts = append(opts, raft.WithApplication(app), raft.WithStorage(store))
+	s, err := raft.NewServerWithID(raft.ServerID(cfg.ID), opts...)
+	if err != nil {
+		fatal(err)
+	}
+	s.Serve()
+	quit := make(chan struct{})
+	go connectPeers(s, cfg, ready, quit)
+	expirerCtx, stopExpirer := context.WithCancel(context.Background())
+	expirer := &kvstore.Expirer{Server: s, Store: app, Interval: expireInterval}
+	go expirer.Run(expirerCtx)
+
+	mux := http.NewServeMux()
+	mux.Handle("/kv/", gateway(s, *requestTimeout))
+	mux.Handle("/watch/", watch(app, quit))
+	mux.Handle("/metrics", s.MetricsHandler())
+	health := s.HealthHandler(cfg.MaxLag)
+	mux.Handle("/healthz", health)
+	mux.Handle("/readyz", health)
+	httpServer := &http.Server{Addr: cfg.HTTP, Handler: mux}
+	listener, err := net.Listen("tcp", cfg.HTTP)
+	if err != nil {
+		fatal(err)
+	}
+	go func() {
+		if err := httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			fatal(err)
+		}
+	}()
+	log.Printf("raftd %s serving HTTP at %s", cfg.ID, listener.Addr())
+	var adminServer *grpc.Server
+	if cfg.Admin != "" {
+		if adminServer, err = serveAdmin(s, cfg); err != nil {
+			fatal(err)
+		}
+	}
+	sdNotify("READY=1")
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Printf("raftd %s received %v; shutting down", cfg.ID, sig)
+	sdNotify("STOPPING=1")
+	close(quit)
+	stopExpirer()
+	shutdown(s, httpServer, adminServer, *shutdownTimeout)
+}
+
+// serveAdmin serves the RaftAdmin gRPC service of s at cfg.Admin, over the TLS
+// of the node if it has one.
+func serveAdmin(s *raft.Server, cfg *config.Config) (*grpc.Server, error) {
+	var opts []grpc.ServerOption
+	if cfg.TLS.CertFile != "" {
+		tlsConfig, err := cfg.TLS.Config()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	adminServer := raftadmin.NewServer(s, cfg.Token, opts...)
+	listener, err := net.Listen("tcp", cfg.Admin)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		if err := adminServer.Serve(listener); err != nil {
+			fatal(err)
+		}
+	}()
+	log.Printf("raftd %s serving RaftAdmin at %s", cfg.ID, listener.Addr())
+	return adminServer, nil
+}
+
+// shutdown drains the server, handing the leadership over if it has it so
+// that the cluster doesn't wait for an election timeout, and then stops
+// serving HTTP, RaftAdmin if adminServer isn't nil, and the server within
+// timeout.
+func shutdown(s *raft.Server, httpServer *http.Server, adminServer *grpc.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := s.Drain(ctx); err != nil {
+		log.Printf("raftd: draining the server: %v", err)
+	}
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Printf("raftd: stopping HTTP: %v", err)
+	}
+	if adminServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			adminServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			adminServer.Stop()
+		}
+	}
+	if err := s.Stop(ctx); err != nil {
+		log.Printf("raftd: stopping the server: %v", err)
+	}
+}
+
+// connectPeers dials the peers of s until it reaches all of them, closing
+// ready once it reaches a quorum of the cluster so that s starts elections.
+func connectPeers(s *raft.Server, cfg *config.Config, ready chan interface{}, quit chan struct{}) {
+	connected := make(map[string]bool)
+	started := false
+	ticker := time.NewTicker(retryInterval)
+	defer ticker.Stop()
+	for {
+		for id, addr := range cfg.Peers {
+			if id == cfg.ID || connected[id] {
+				continue
+			}
+			tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+			if err == nil {
+				err = s.Connect(raft.ServerID(id), tcpAddr)
+			}
+			if err == nil {
+				connected[id] = true
+			}
+		}
+		if !started && len(connected)+1 > len(cfg.Peers)/2 {
+			log.Printf("raftd %s reached %d of %d servers; starting", cfg.ID, len(connected)+1, len(cfg.Peers))
+			close(ready)
+			started = true
+		}
+		if len(connected)+1 == len(cfg.Peers) {
+			return
+		}
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// gateway returns the handler of the /kv/ requests, which submits them to s
+// as kvstore commands, waiting up to timeout for their result.
+func gateway(s *raft.Server, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry := kvstore.Entry{Key: strings.TrimPrefix(r.URL.Path, "/kv/")}
+		if entry.Key == "" && r.Method == http.MethodGet {
+			scan(s, timeout, w, r)
+			return
+		}
+		if entry.Key == "" {
+			http.Error(w, "missing key", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			entry.Method = "get"
+		case http.MethodPut:
+			value, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			entry.Method, entry.Value = "put", string(value)
+			if ttl := r.URL.Query().Get("ttl"); ttl != "" {
+				d, err := time.ParseDuration(ttl)
+				if err != nil || d <= 0 {
+					http.Error(w, "bad ttl", http.StatusBadRequest)
+					return
+				}
+				// The deadline is read from the clock of the leader, which
+				// alone accepts the command and expires the key.
+				entry.Expires = kvstore.Deadline(time.Now(), d)
+			}
+		case http.MethodDelete:
+			entry.Method = "delete"
+		default:
+			w.Header().Set("Allow", "GET, PUT, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		committed, err := s.SubmitIndexed(ctx, entry)
+		respond(s, w, committed.Result, err)
+	})
+}
+
+// scan answers a range or prefix scan of the keys with a linearizable read,
+// which the leader serves without going through the log.
+func scan(s *raft.Server, timeout time.Duration, w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	query := kvstore.Query{
+		Method: "range",
+		Start:  params.Get("start"),
+		End:    params.Get("end"),
+		Prefix: params.Get("prefix"),
+	}
+	if query.Prefix != "" {
+		query.Method = "prefix"
+	}
+	if limit := params.Get("limit"); limit != "" {
+		var err error
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			http.Error(w, "bad limit", http.StatusBadRequest)
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	pairs, err := s.Read(ctx, query)
+	respond(s, w, pairs, err)
+}
+
+// respond writes the JSON of result, or the status of err.
+func respond(s *raft.Server, w http.ResponseWriter, result interface{}, err error) {
+	var notLeader *raft.NotLeaderError
+	switch {
+	case errors.As(err, &notLeader):
+		if id, addr := s.Leader(); id != raft.NoServer {
+			w.Header().Set("Raft-Leader", string(id))
+			w.Header().Set("Raft-Leader-Addr", addr)
+		}
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case err == raft.ErrLeaderNotReady, err == raft.ErrEnqueueTimeout:
+		// The command wasn't appended, and may be sent again.
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case err == raft.ErrThrottled, err == raft.ErrProposalQueueFull:
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	case err == raft.ErrUnknownResult, errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// watch returns the handler of the /watch/ requests, which stream the changes
+// of the keys of app starting with the prefix in their path until quit is
+// closed.
+func watch(app *kvstore.KVStore, quit chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		events, cancel := app.Watch(strings.TrimPrefix(r.URL.Path, "/watch/"))
+		defer cancel()
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		flusher, _ := w.(http.Flusher)
+		encoder := json.NewEncoder(w)
+		for {
+			if flusher != nil {
+				flusher.Flush()
+			}
+			select {
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				if err := encoder.Encode(event); err != nil {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			case <-quit:
+				return
+			}
+		}
+	})
+}
+
+// sdNotify sends state to the service manager if it set $NOTIFY_SOCKET, as
+// systemd does for the services of Type=notify.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		log.Printf("raftd: notifying the service manager: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("raftd: notifying the service manager: %v", err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "raftd:", err)
+	os.Exit(1)
+}
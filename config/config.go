@@ -0,0 +1,331 @@
+// Package config loads the configuration of a Raft node from a YAML or TOML
+// file, with environment variable overrides, and turns it into the options of
+// a raft.Server.
+//
+// A YAML file looks like:
+//
+//	id: node-0
+//	listen: ":7000"
+//	peers:
+//	  node-0: 10.0.0.1:7000
+//	  node-1: 10.0.0.2:7000
+//	  node-2: 10.0.0.3:7000
+//	data_dir: /var/lib/raft
+//	peer_rpc: grpc
+//	tls:
+//	  cert_file: /etc/raft/node-0.pem
+//	  key_file: /etc/raft/node-0-key.pem
+//	  ca_file: /etc/raft/ca.pem
+//	election_timeout_min: 300ms
+//	election_timeout_max: 600ms
+//
+// and a TOML file has the same keys. Every key can be overridden by the
+// environment variable RAFT_ followed by the key in upper case, the keys of
+// tls being prefixed with TLS_, as in RAFT_DATA_DIR or RAFT_TLS_CERT_FILE.
+// RAFT_PEERS lists the peers as comma-separated id=address pairs.
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml"
+	"gopkg.in/yaml.v3"
+
+	"github.com/aecra/raft/raft"
+	"github.com/aecra/raft/raft/raftpb"
+	"github.com/aecra/raft/storage"
+	"github.com/aecra/raft/storage/wal"
+)
+
+// envPrefix starts the environment variables overriding the keys of a file.
+const envPrefix = "RAFT_"
+
+// Config is the configuration of a node.
+type Config struct {
+	// ID is the ID of the node, which must be one of Peers.
+	ID string `yaml:"id" toml:"id"`
+
+	// Listen is the address the node listens on, any free port if it's
+	// empty, and Advertise the one its peers and clients reach it at, if it
+	// differs.
+	Listen    string `yaml:"listen" toml:"listen"`
+	Advertise string `yaml:"advertise" toml:"advertise"`
+
+	// Peers maps the IDs of the nodes of the cluster, this one included, to
+	// their addresses.
+	Peers map[string]string `yaml:"peers" toml:"peers"`
+
+	// DataDir is the directory of the write-ahead log of the node. The state
+	// is kept in memory if it's empty.
+	DataDir string `yaml:"data_dir" toml:"data_dir"`
+
+	// TLS secures the connections between the nodes if its files are set.
+	TLS TLS `yaml:"tls" toml:"tls"`
+
+	// PeerRPC is the wire format of the RequestVote, AppendEntries and
+	// InstallSnapshot RPCs between the nodes: "gob", the default, or "grpc"
+	// for the Raft gRPC service of package raftpb. All the nodes must use the
+	// same one.
+	PeerRPC string `yaml:"peer_rpc" toml:"peer_rpc"`
+
+	// Token is the cluster token the connections authenticate with, if it's
+	// not empty.
+	Token string `yaml:"token" toml:"token"`
+
+	// HTTP is the address the node serves its HTTP endpoints at, such as
+	// metrics and health probes, and MaxLag the number of entries it may lag
+	// behind while ready.
+	HTTP   string `yaml:"http" toml:"http"`
+	MaxLag int    `yaml:"max_lag" toml:"max_lag"`
+
+	// Admin is the address the node serves the RaftAdmin gRPC service of
+	// package raftadmin at, if it's not empty, over TLS if the node has it.
+	// The calls authenticate with Token.
+	Admin string `yaml:"admin" toml:"admin"`
+
+	// The parameters of raft.Config; the zero ones take its defaults.
+	ElectionTimeoutMin Duration `yaml:"election_timeout_min" toml:"election_timeout_min"`
+	ElectionTimeoutMax Duration `yaml:"election_timeout_max" toml:"election_timeout_max"`
+	HeartbeatInterval  Duration `yaml:"heartbeat_interval" toml:"heartbeat_interval"`
+	CommitTimeout      Duration `yaml:"commit_timeout" toml:"commit_timeout"`
+	ApplyTimeout       Duration `yaml:"apply_timeout" toml:"apply_timeout"`
+	SnapshotThreshold  int      `yaml:"snapshot_threshold" toml:"snapshot_threshold"`
+	MaxPending         int      `yaml:"max_pending" toml:"max_pending"`
+	MaxCommandBytes    int      `yaml:"max_command_bytes" toml:"max_command_bytes"`
+	DeadPeerTimeout    Duration `yaml:"dead_peer_timeout" toml:"dead_peer_timeout"`
+}
+
+// TLS holds the paths of the PEM files securing the connections of a node:
+// its certificate and key, and the certificate of the authority the
+// certificates of its peers are checked against.
+type TLS struct {
+	CertFile string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile  string `yaml:"key_file" toml:"key_file"`
+	CAFile   string `yaml:"ca_file" toml:"ca_file"`
+}
+
+// Duration is a time.Duration written as a string in a file, such as
+// "150ms".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// Load reads the configuration file at path, YAML if its extension is .yaml
+// or .yml and TOML if it's .toml, applies the overrides of the environment
+// and validates the result.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := new(Config)
+	switch ext := filepath.Ext(path); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, c)
+	case ".toml":
+		err = toml.Unmarshal(data, c)
+	default:
+		return nil, fmt.Errorf("config: unknown format %q of %s", ext, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config: %s: %v", path, err)
+	}
+	if err := c.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("config: %s: %v", path, err)
+	}
+	return c, nil
+}
+
+// applyEnv overrides the fields of c with the environment variables lookup
+// finds for their keys.
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	return applyEnv(reflect.ValueOf(c).Elem(), envPrefix, lookup)
+}
+
+func applyEnv(v reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		name := prefix + strings.ToUpper(v.Type().Field(i).Tag.Get("yaml"))
+		if field.Type() == reflect.TypeOf(TLS{}) {
+			if err := applyEnv(field, name+"_", lookup); err != nil {
+				return err
+			}
+			continue
+		}
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		var err error
+		switch p := field.Addr().Interface().(type) {
+		case *string:
+			*p = value
+		case *int:
+			*p, err = strconv.Atoi(value)
+		case *Duration:
+			err = p.UnmarshalText([]byte(value))
+		case *map[string]string:
+			*p, err = parsePeers(value)
+		default:
+			panic(fmt.Sprintf("config: field %s of unsupported type %s", name, field.Type()))
+		}
+		if err != nil {
+			return fmt.Errorf("config: $%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// parsePeers parses comma-separated id=address pairs.
+func parsePeers(s string) (map[string]string, error) {
+	peers := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		id, addr, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("peer %q isn't an id=address pair", pair)
+		}
+		peers[id] = addr
+	}
+	return peers, nil
+}
+
+// Validate checks that c describes a node of its cluster with a valid
+// raft.Config.
+func (c *Config) Validate() error {
+	if c.ID == "" {
+		return errors.New("the node ID is empty")
+	}
+	if _, ok := c.Peers[c.ID]; !ok {
+		return fmt.Errorf("node %q isn't one of the peers", c.ID)
+	}
+	for id, addr := range c.Peers {
+		if id != c.ID && addr == "" {
+			return fmt.Errorf("peer %q has no address", id)
+		}
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return errors.New("tls needs both cert_file and key_file")
+	}
+	if c.TLS.CAFile != "" && c.TLS.CertFile == "" {
+		return errors.New("tls has a ca_file but no certificate")
+	}
+	if c.MaxLag < 0 {
+		return errors.New("max_lag is negative")
+	}
+	if c.PeerRPC != "" && c.PeerRPC != "gob" && c.PeerRPC != "grpc" {
+		return fmt.Errorf("peer_rpc %q isn't gob or grpc", c.PeerRPC)
+	}
+	return c.RaftConfig().Validate()
+}
+
+// RaftConfig returns the raft.Config of the node.
+func (c *Config) RaftConfig() raft.Config {
+	return raft.Config{
+		ElectionTimeoutMin: c.ElectionTimeoutMin.Duration,
+		ElectionTimeoutMax: c.ElectionTimeoutMax.Duration,
+		HeartbeatInterval:  c.HeartbeatInterval.Duration,
+		CommitTimeout:      c.CommitTimeout.Duration,
+		ApplyTimeout:       c.ApplyTimeout.Duration,
+		SnapshotThreshold:  c.SnapshotThreshold,
+		MaxPending:         c.MaxPending,
+		MaxCommandBytes:    c.MaxCommandBytes,
+		DeadPeerTimeout:    c.DeadPeerTimeout.Duration,
+	}
+}
+
+// Members returns the IDs of the nodes of the cluster, sorted.
+func (c *Config) Members() []raft.ServerID {
+	ids := make([]raft.ServerID, 0, len(c.Peers))
+	for id := range c.Peers {
+		ids = append(ids, raft.ServerID(id))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// OpenStorage opens the storage of the node: its write-ahead log in DataDir,
+// or memory if DataDir is empty.
+func (c *Config) OpenStorage() (storage.Storage, error) {
+	if c.DataDir == "" {
+		return storage.NewMemoryStorage(), nil
+	}
+	return wal.Open(c.DataDir, wal.Options{})
+}
+
+// Options returns the options creating the server of the node with
+// raft.NewServerWithID(raft.ServerID(c.ID), ...): its members, whose servers
+// start elections when ready is closed, its transport, over TLS if it's
+// configured, the wire format of its RPCs, its addresses, token and
+// raft.Config. The application and
+// storage are the caller's.
+func (c *Config) Options(ready chan interface{}) ([]raft.Option, error) {
+	opts := []raft.Option{
+		raft.WithMembers(c.Members(), ready),
+		raft.WithToken(c.Token),
+		raft.WithConfig(c.RaftConfig()),
+	}
+	if c.TLS.CertFile == "" {
+		opts = append(opts, raft.WithListenAddr(c.Listen))
+	} else {
+		tlsConfig, err := c.TLS.Config()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, raft.WithTransport(TLSTransport{Addr: c.Listen, Config: tlsConfig}))
+	}
+	if c.PeerRPC == "grpc" {
+		opts = append(opts, raft.WithPeerRPC(raftpb.GRPC{}))
+	}
+	if c.Advertise != "" {
+		opts = append(opts, raft.WithAdvertiseAddr(c.Advertise))
+	}
+	return opts, nil
+}
+
+// Config loads the certificates of t into a tls.Config authenticating both
+// ends of the connections: the nodes present the certificate of t, and check
+// that the ones of their peers are signed by the authority of CAFile, or by
+// the system's if it's empty.
+func (t TLS) Config() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("config: %v", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("config: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("config: no certificate in %s", t.CAFile)
+		}
+		config.RootCAs = pool
+		config.ClientCAs = pool
+	}
+	return config, nil
+}
@@ -0,0 +1,231 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aecra/raft/raft"
+)
+
+const yamlFile = `
+id: b
+listen: ":7001"
+peers:
+  a: host-a:7000
+  b: host-b:7001
+  c: host-c:7002
+data_dir: /var/lib/raft
+peer_rpc: grpc
+election_timeout_min: 300ms
+election_timeout_max: 600ms
+snapshot_threshold: 500
+`
+
+const tomlFile = `
+id = "b"
+listen = ":7001"
+data_dir = "/var/lib/raft"
+peer_rpc = "grpc"
+election_timeout_min = "300ms"
+election_timeout_max = "600ms"
+snapshot_threshold = 500
+
+[peers]
+a = "host-a:7000"
+b = "host-b:7001"
+c = "host-c:7002"
+`
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	want := &Config{
+		ID:                 "b",
+		Listen:             ":7001",
+		Peers:              map[string]string{"a": "host-a:7000", "b": "host-b:7001", "c": "host-c:7002"},
+		DataDir:            "/var/lib/raft",
+		PeerRPC:            "grpc",
+		ElectionTimeoutMin: Duration{300 * time.Millisecond},
+		ElectionTimeoutMax: Duration{600 * time.Millisecond},
+		SnapshotThreshold:  500,
+	}
+	for name, content := range map[string]string{"node.yaml": yamlFile, "node.toml": tomlFile} {
+		c, err := Load(writeFile(t, name, content))
+		if err != nil {
+			t.Errorf("Load(%s): %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(c, want) {
+			t.Errorf("Load(%s) = %+v, want %+v", name, c, want)
+		}
+	}
+	if ids := want.Members(); !reflect.DeepEqual(ids, []raft.ServerID{"a", "b", "c"}) {
+		t.Errorf("Members = %v, want [a b c]", ids)
+	}
+
+	if _, err := Load(writeFile(t, "node.ini", yamlFile)); err == nil {
+		t.Error("Expected a file of unknown format to be refused")
+	}
+}
+
+func TestEnvOverrides(t *testing.T) {
+	t.Setenv("RAFT_ID", "d")
+	t.Setenv("RAFT_PEERS", "a=host-a:7000, d=host-d:7003")
+	t.Setenv("RAFT_ELECTION_TIMEOUT_MAX", "1s")
+	t.Setenv("RAFT_SNAPSHOT_THRESHOLD", "10")
+	t.Setenv("RAFT_TLS_CA_FILE", "/etc/raft/ca.pem")
+	c := new(Config)
+	if err := c.applyEnv(os.LookupEnv); err != nil {
+		t.Fatal(err)
+	}
+	want := &Config{
+		ID:                 "d",
+		Peers:              map[string]string{"a": "host-a:7000", "d": "host-d:7003"},
+		ElectionTimeoutMax: Duration{time.Second},
+		SnapshotThreshold:  10,
+		TLS:                TLS{CAFile: "/etc/raft/ca.pem"},
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("Got %+v from the environment, want %+v", c, want)
+	}
+
+	t.Setenv("RAFT_SNAPSHOT_THRESHOLD", "ten")
+	if err := c.applyEnv(os.LookupEnv); err == nil {
+		t.Error("Expected a bad integer to be refused")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() *Config {
+		return &Config{ID: "a", Peers: map[string]string{"a": "", "b": "host-b:7000"}}
+	}
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	for name, change := range map[string]func(c *Config){
+		"NoID":         func(c *Config) { c.ID = "" },
+		"NotAPeer":     func(c *Config) { c.ID = "c" },
+		"NoPeerAddr":   func(c *Config) { c.Peers["b"] = "" },
+		"CertNoKey":    func(c *Config) { c.TLS.CertFile = "cert.pem" },
+		"CANoCert":     func(c *Config) { c.TLS.CAFile = "ca.pem" },
+		"NegativeLag":  func(c *Config) { c.MaxLag = -1 },
+		"BadPeerRPC":   func(c *Config) { c.PeerRPC = "json" },
+		"BadRaftConfg": func(c *Config) { c.MaxPending = -1 },
+	} {
+		c := valid()
+		change(c)
+		if err := c.Validate(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// writeCertificates writes a certificate authority and a certificate it signs
+// for 127.0.0.1 to dir.
+func writeCertificates(t *testing.T, dir string) TLS {
+	t.Helper()
+	writePEM := func(name, typ string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "raft test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, cert, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return TLS{
+		CertFile: writePEM("node.pem", "CERTIFICATE", certDER),
+		KeyFile:  writePEM("node-key.pem", "EC PRIVATE KEY", keyDER),
+		CAFile:   writePEM("ca.pem", "CERTIFICATE", caDER),
+	}
+}
+
+func TestTLSTransport(t *testing.T) {
+	files := writeCertificates(t, t.TempDir())
+	config, err := files.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := TLSTransport{Addr: "127.0.0.1:0", Config: config}
+	listener, err := transport.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := transport.Dial(listener.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+		t.Errorf("Read %q, %v over TLS, want the echo of ping", reply, err)
+	}
+}
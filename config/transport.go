@@ -0,0 +1,33 @@
+package config
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// TLSTransport is a raft.Transport over TLS.
+type TLSTransport struct {
+	// Addr is the address to listen on, ":0" (any free port) if empty.
+	Addr string
+
+	// Config is the TLS configuration of both the listener and the
+	// connections dialed to peers, whose host name is set from their
+	// address.
+	Config *tls.Config
+}
+
+func (t TLSTransport) Listen() (net.Listener, error) {
+	addr := t.Addr
+	if addr == "" {
+		addr = ":0"
+	}
+	return tls.Listen("tcp", addr, t.Config)
+}
+
+func (t TLSTransport) Dial(addr net.Addr) (net.Conn, error) {
+	config := t.Config.Clone()
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		config.ServerName = host
+	}
+	return tls.Dial(addr.Network(), addr.String(), config)
+}
@@ -0,0 +1,240 @@
+// Package kvstore is a key-value store application for Raft, and the reference
+// implementation of raft.Application: its commands can be sent with either
+// GobCodec or JSONCodec, and it implements raft.Snapshotter. It also
+// implements raft.Querier, answering the range and prefix scans of its
+// ordered keys read with Server.Read, without going through the log, and
+// reports the changes of its keys to their watchers as it applies them.
+package kvstore
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aecra/raft/raft"
+)
+
+func init() {
+	// Register the command, query and result types for the default GobCodec.
+	gob.Register(Entry{})
+	gob.Register(Result{})
+	gob.Register(Txn{})
+	gob.Register(TxnResult{})
+	gob.Register(Query{})
+	gob.Register([]Pair{})
+}
+
+// JSONCodec encodes Entry and Txn commands as JSON. All the servers of a
+// cluster must use it for clients in other languages to submit commands.
+var JSONCodec raft.Codec = jsonCodec{}
+
+type KVStore struct {
+	Data map[string]string
+
+	// Expires holds the time the keys set with a deadline expire at, in Unix
+	// nanoseconds.
+	Expires map[string]int64
+
+	// mu guards Data and keys against the queries, which are answered
+	// concurrently with the commands.
+	mu sync.RWMutex
+
+	// keys holds the keys of Data, sorted.
+	keys []string
+
+	// watchers are the watches of the keys, notified of their changes.
+	watchers map[*watcher]bool
+}
+
+// Entry is a command. Method is one of "get", "put", "delete", "cas" and
+// "expire". "cas" sets Key to Value if its current value is Expected. "put"
+// and "cas" set Key to expire at Expires, in Unix nanoseconds, if it's
+// positive, and to never expire otherwise. "expire" deletes Key if it's still
+// set to expire at Expires; the leader's Expirer submits it.
+type Entry struct {
+	Method   string
+	Key      string
+	Value    string
+	Expected string
+	Expires  int64
+}
+
+// Result is the result of a command. For "get" and "delete", Result reports
+// whether Key was set, and for "cas" whether it was swapped. Value is the
+// value of Key before the command.
+type Result struct {
+	Result bool
+	Value  string
+}
+
+func NewKVStore() raft.Application {
+	return &KVStore{Data: make(map[string]string), Expires: make(map[string]int64)}
+}
+
+func (app *KVStore) ApplyCommand(command interface{}) interface{} {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	if txn, ok := command.(Txn); ok {
+		return app.applyTxn(txn)
+	}
+	entry := command.(Entry)
+	switch entry.Method {
+	case "get":
+		value, ok := app.Data[entry.Key]
+		return Result{ok, value}
+	case "put":
+		old := app.Data[entry.Key]
+		app.set(entry.Key, entry.Value, entry.Expires)
+		return Result{true, old}
+	case "delete":
+		old, ok := app.Data[entry.Key]
+		if ok {
+			app.remove(entry.Key)
+		}
+		return Result{ok, old}
+	case "cas":
+		old, ok := app.Data[entry.Key]
+		if !ok || old != entry.Expected {
+			return Result{false, old}
+		}
+		app.set(entry.Key, entry.Value, entry.Expires)
+		return Result{true, old}
+	case "expire":
+		old, ok := app.Data[entry.Key]
+		if !ok || app.Expires[entry.Key] != entry.Expires {
+			return Result{false, old}
+		}
+		app.remove(entry.Key)
+		return Result{true, old}
+	default:
+		return Result{false, ""}
+	}
+}
+
+// set sets key to value, expiring at expires if it's positive, and adds key to
+// the sorted keys if it's new.
+func (app *KVStore) set(key, value string, expires int64) {
+	if expires > 0 {
+		app.Expires[key] = expires
+	} else {
+		delete(app.Expires, key)
+	}
+	if _, ok := app.Data[key]; !ok {
+		i := sort.SearchStrings(app.keys, key)
+		app.keys = append(app.keys, "")
+		copy(app.keys[i+1:], app.keys[i:])
+		app.keys[i] = key
+	}
+	app.Data[key] = value
+	app.notify(Event{Key: key, Value: value})
+}
+
+// remove deletes key, which must be set.
+func (app *KVStore) remove(key string) {
+	delete(app.Data, key)
+	delete(app.Expires, key)
+	i := sort.SearchStrings(app.keys, key)
+	app.keys = append(app.keys[:i], app.keys[i+1:]...)
+	app.notify(Event{Key: key, Deleted: true})
+}
+
+// SnapshotTo encodes the keys to w with gob.
+func (app *KVStore) SnapshotTo(w io.Writer) error {
+	app.mu.RLock()
+	defer app.mu.RUnlock()
+	return gob.NewEncoder(w).Encode(app)
+}
+
+// RestoreFrom replaces the keys with the ones encoded by SnapshotTo.
+func (app *KVStore) RestoreFrom(r io.Reader) error {
+	var restored struct {
+		Data    map[string]string
+		Expires map[string]int64
+	}
+	if err := gob.NewDecoder(r).Decode(&restored); err != nil {
+		return err
+	}
+	if restored.Data == nil {
+		restored.Data = make(map[string]string)
+	}
+	if restored.Expires == nil {
+		restored.Expires = make(map[string]int64)
+	}
+	keys := make([]string, 0, len(restored.Data))
+	for key := range restored.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	app.Data, app.Expires, app.keys = restored.Data, restored.Expires, keys
+	// The changes the snapshot covers are unknown.
+	for w := range app.watchers {
+		app.unwatch(w)
+	}
+	return nil
+}
+
+// Query is a read-only query, answered by Query. Method is one of "get",
+// "range" and "prefix". "get" reads Key, answering a Result like the "get"
+// command. "range" scans the keys in [Start, End), up to the last one if End
+// is empty, and "prefix" the keys starting with Prefix; they answer the
+// matching Pairs in the order of their keys, at most Limit of them if it's
+// positive.
+type Query struct {
+	Method string
+	Key    string
+	Start  string
+	End    string
+	Prefix string
+	Limit  int
+}
+
+// Pair is a key and its value, answered by a scan.
+type Pair struct {
+	Key   string
+	Value string
+}
+
+// Query answers query, a Query, from the current state of the store. Sent
+// through Server.Read, the answer is linearizable: it reflects all the
+// commands committed before the read.
+func (app *KVStore) Query(query interface{}) (interface{}, error) {
+	q, ok := query.(Query)
+	if !ok {
+		return nil, fmt.Errorf("kvstore: unknown query %T", query)
+	}
+	app.mu.RLock()
+	defer app.mu.RUnlock()
+	switch q.Method {
+	case "get":
+		value, ok := app.Data[q.Key]
+		return Result{ok, value}, nil
+	case "range":
+		return app.scan(q.Start, func(key string) bool {
+			return q.End == "" || key < q.End
+		}, q.Limit), nil
+	case "prefix":
+		return app.scan(q.Prefix, func(key string) bool {
+			return strings.HasPrefix(key, q.Prefix)
+		}, q.Limit), nil
+	default:
+		return nil, fmt.Errorf("kvstore: unknown query method %q", q.Method)
+	}
+}
+
+// scan returns the pairs of the keys from start on, in order, as long as they
+// match, and at most limit of them if it's positive.
+func (app *KVStore) scan(start string, match func(key string) bool, limit int) []Pair {
+	pairs := []Pair{}
+	for _, key := range app.keys[sort.SearchStrings(app.keys, start):] {
+		if !match(key) || limit > 0 && len(pairs) == limit {
+			break
+		}
+		pairs = append(pairs, Pair{key, app.Data[key]})
+	}
+	return pairs
+}
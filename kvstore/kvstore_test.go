@@ -0,0 +1,334 @@
+package kvstore
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aecra/raft/raft"
+)
+
+func TestPutGet(t *testing.T) {
+	app := NewKVStore()
+	res := app.ApplyCommand(Entry{Method: "get", Key: "a"})
+	if res.(Result).Result {
+		t.Errorf("Expected get of a missing key to fail")
+	}
+	app.ApplyCommand(Entry{Method: "put", Key: "a", Value: "1"})
+	res = app.ApplyCommand(Entry{Method: "put", Key: "a", Value: "2"})
+	if res.(Result) != (Result{true, "1"}) {
+		t.Errorf("Expected put to return the old value, got %+v", res)
+	}
+	res = app.ApplyCommand(Entry{Method: "get", Key: "a"})
+	if res.(Result) != (Result{true, "2"}) {
+		t.Errorf("Expected get to return 2, got %+v", res)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	app := NewKVStore()
+	app.ApplyCommand(Entry{Method: "put", Key: "a", Value: "1"})
+	res := app.ApplyCommand(Entry{Method: "delete", Key: "a"})
+	if res.(Result) != (Result{true, "1"}) {
+		t.Errorf("Expected delete to succeed, got %+v", res)
+	}
+	res = app.ApplyCommand(Entry{Method: "delete", Key: "a"})
+	if res.(Result).Result {
+		t.Errorf("Expected delete of a missing key to fail")
+	}
+}
+
+func TestCAS(t *testing.T) {
+	app := NewKVStore()
+	res := app.ApplyCommand(Entry{Method: "cas", Key: "a", Value: "1"})
+	if res.(Result).Result {
+		t.Errorf("Expected cas of a missing key to fail")
+	}
+	app.ApplyCommand(Entry{Method: "put", Key: "a", Value: "1"})
+	res = app.ApplyCommand(Entry{Method: "cas", Key: "a", Expected: "0", Value: "2"})
+	if res.(Result) != (Result{false, "1"}) {
+		t.Errorf("Expected cas with a stale value to fail, got %+v", res)
+	}
+	res = app.ApplyCommand(Entry{Method: "cas", Key: "a", Expected: "1", Value: "2"})
+	if !res.(Result).Result {
+		t.Errorf("Expected cas to succeed")
+	}
+	res = app.ApplyCommand(Entry{Method: "get", Key: "a"})
+	if res.(Result).Value != "2" {
+		t.Errorf("Expected get to return 2, got %+v", res)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	app := NewKVStore()
+	app.ApplyCommand(Entry{Method: "put", Key: "a", Value: "1"})
+	app.ApplyCommand(Entry{Method: "put", Key: "b", Value: "2"})
+	var buf bytes.Buffer
+	if err := app.(*KVStore).SnapshotTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewKVStore()
+	if err := restored.(*KVStore).RestoreFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"a": "1", "b": "2"} {
+		res := restored.ApplyCommand(Entry{Method: "get", Key: key})
+		if res.(Result) != (Result{true, want}) {
+			t.Errorf("Expected get of %s to return %s, got %+v", key, want, res)
+		}
+	}
+	pairs, err := restored.(*KVStore).Query(Query{Method: "range"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Pair{{"a", "1"}, {"b", "2"}}; !reflect.DeepEqual(pairs, want) {
+		t.Errorf("Expected the restored keys to scan as %v, got %v", want, pairs)
+	}
+}
+
+func TestScans(t *testing.T) {
+	app := NewKVStore().(*KVStore)
+	for _, key := range []string{"user/2", "order/1", "user/1", "user/3", "zone"} {
+		app.ApplyCommand(Entry{Method: "put", Key: key, Value: "v" + key})
+	}
+	app.ApplyCommand(Entry{Method: "delete", Key: "user/3"})
+	for _, test := range []struct {
+		query Query
+		keys  []string
+	}{
+		{Query{Method: "range"}, []string{"order/1", "user/1", "user/2", "zone"}},
+		{Query{Method: "range", Start: "p", End: "user/2"}, []string{"user/1"}},
+		{Query{Method: "range", Start: "user/1", Limit: 2}, []string{"user/1", "user/2"}},
+		{Query{Method: "prefix", Prefix: "user/"}, []string{"user/1", "user/2"}},
+		{Query{Method: "prefix", Prefix: "nothing"}, []string{}},
+	} {
+		res, err := app.Query(test.query)
+		if err != nil {
+			t.Fatalf("%+v: %v", test.query, err)
+		}
+		keys := []string{}
+		for _, pair := range res.([]Pair) {
+			if pair.Value != "v"+pair.Key {
+				t.Errorf("%+v: Expected %s to have value v%s, got %s", test.query, pair.Key, pair.Key, pair.Value)
+			}
+			keys = append(keys, pair.Key)
+		}
+		if !reflect.DeepEqual(keys, test.keys) {
+			t.Errorf("%+v: Expected keys %v, got %v", test.query, test.keys, keys)
+		}
+	}
+
+	if res, err := app.Query(Query{Method: "get", Key: "zone"}); err != nil || res.(Result) != (Result{true, "vzone"}) {
+		t.Errorf("Expected get of zone to return vzone, got %+v, %v", res, err)
+	}
+	if _, err := app.Query(Query{Method: "scan"}); err == nil {
+		t.Error("Expected an unknown query method to be refused")
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	entry := Entry{Method: "cas", Key: "a", Value: "2", Expected: "1"}
+	for name, codec := range map[string]raft.Codec{"gob": raft.GobCodec{}, "json": JSONCodec} {
+		data, err := codec.Encode(entry)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		decoded, err := codec.Decode(data)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if decoded != entry {
+			t.Errorf("%s: Expected %+v, got %+v", name, entry, decoded)
+		}
+
+		txn := Txn{Ops: []Entry{entry, {Method: "delete", Key: "b"}}}
+		if data, err = codec.Encode(txn); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if decoded, err = codec.Decode(data); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(decoded, txn) {
+			t.Errorf("%s: Expected %+v, got %+v", name, txn, decoded)
+		}
+	}
+}
+
+func TestTTL(t *testing.T) {
+	app := NewKVStore().(*KVStore)
+	now := time.Unix(1000, 0)
+	app.ApplyCommand(Entry{Method: "put", Key: "a", Value: "1", Expires: Deadline(now, time.Second)})
+	app.ApplyCommand(Entry{Method: "put", Key: "b", Value: "2", Expires: Deadline(now, time.Minute)})
+	app.ApplyCommand(Entry{Method: "put", Key: "c", Value: "3"})
+	if expired := app.Expired(now); len(expired) != 0 {
+		t.Errorf("Expected no key to have expired yet, got %+v", expired)
+	}
+	expired := app.Expired(now.Add(2 * time.Second))
+	if want := []Entry{{Method: "expire", Key: "a", Expires: Deadline(now, time.Second)}}; !reflect.DeepEqual(expired, want) {
+		t.Fatalf("Expected %+v, got %+v", want, expired)
+	}
+
+	// A key refreshed after the leader found it expired isn't deleted.
+	app.ApplyCommand(Entry{Method: "put", Key: "a", Value: "4", Expires: Deadline(now, time.Hour)})
+	if res := app.ApplyCommand(expired[0]); res.(Result).Result {
+		t.Errorf("Expected the expiration of a refreshed key to fail")
+	}
+	app.ApplyCommand(Entry{Method: "put", Key: "a", Value: "5"})
+	if expired := app.Expired(now.Add(2 * time.Hour)); len(expired) != 1 || expired[0].Key != "b" {
+		t.Errorf("Expected only b to expire once a is set without a deadline, got %+v", expired)
+	}
+
+	var buf bytes.Buffer
+	if err := app.SnapshotTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewKVStore().(*KVStore)
+	if err := restored.RestoreFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expired = restored.Expired(now.Add(2 * time.Hour))
+	if len(expired) != 1 || expired[0].Key != "b" {
+		t.Fatalf("Expected b to expire after a restore, got %+v", expired)
+	}
+	if res := restored.ApplyCommand(expired[0]); res.(Result) != (Result{true, "2"}) {
+		t.Errorf("Expected b to be deleted, got %+v", res)
+	}
+	if res := restored.ApplyCommand(Entry{Method: "get", Key: "b"}); res.(Result).Result {
+		t.Errorf("Expected b to be gone")
+	}
+}
+
+func TestExpirer(t *testing.T) {
+	app := NewKVStore().(*KVStore)
+	ready := make(chan interface{})
+	s, err := raft.NewServer(0, raft.WithCluster(1, ready), raft.WithApplication(app))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Serve()
+	close(ready)
+	defer s.Shutdown()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go (&Expirer{Server: s, Store: app, Interval: 10 * time.Millisecond}).Run(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := s.SubmitIndexed(ctx, Entry{Method: "put", Key: "a", Value: "1", Expires: Deadline(time.Now(), 50*time.Millisecond)})
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Submit: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for {
+		res, err := s.SubmitIndexed(ctx, Entry{Method: "get", Key: "a"})
+		if err == nil && !res.Result.(Result).Result {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a to expire, got %+v, %v", res.Result, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	app := NewKVStore().(*KVStore)
+	users, cancel := app.Watch("user/")
+	defer cancel()
+	all, cancelAll := app.Watch("")
+	app.ApplyCommand(Entry{Method: "put", Key: "user/1", Value: "a"})
+	app.ApplyCommand(Entry{Method: "put", Key: "order/1", Value: "b"})
+	app.ApplyCommand(Entry{Method: "cas", Key: "user/1", Expected: "z", Value: "c"})
+	app.ApplyCommand(Entry{Method: "delete", Key: "user/1"})
+	app.ApplyCommand(Entry{Method: "delete", Key: "user/2"})
+
+	want := []Event{{Key: "user/1", Value: "a"}, {Key: "user/1", Deleted: true}}
+	for _, event := range want {
+		if got := <-users; got != event {
+			t.Errorf("Expected %+v, got %+v", event, got)
+		}
+	}
+	select {
+	case event := <-users:
+		t.Errorf("Expected no other event, got %+v", event)
+	default:
+	}
+	if len(all) != 3 {
+		t.Errorf("Expected the watch of every key to get 3 events, got %d", len(all))
+	}
+	cancelAll()
+	for range all {
+	}
+
+	// A watcher that falls behind is dropped.
+	for i := 0; i <= watchBuffer; i++ {
+		app.ApplyCommand(Entry{Method: "put", Key: "user/1", Value: "a"})
+	}
+	n := 0
+	for range users {
+		n++
+	}
+	if n != watchBuffer {
+		t.Errorf("Expected the dropped watcher to get %d events, got %d", watchBuffer, n)
+	}
+
+	// So are the watchers of a store restoring a snapshot.
+	events, cancel := app.Watch("")
+	defer cancel()
+	var buf bytes.Buffer
+	if err := app.SnapshotTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.RestoreFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-events; ok {
+		t.Error("Expected the watch to be closed by the restore")
+	}
+}
+
+func TestTxn(t *testing.T) {
+	app := NewKVStore().(*KVStore)
+	app.ApplyCommand(Entry{Method: "put", Key: "alice", Value: "10"})
+	events, cancel := app.Watch("")
+	defer cancel()
+
+	// A transfer that checks both balances commits both writes.
+	res := app.ApplyCommand(Txn{Ops: []Entry{
+		{Method: "cas", Key: "alice", Expected: "10", Value: "7"},
+		{Method: "put", Key: "bob", Value: "3"},
+		{Method: "get", Key: "bob"},
+	}})
+	want := TxnResult{Committed: true, Results: []Result{{true, "10"}, {true, ""}, {true, "3"}}}
+	if !reflect.DeepEqual(res, want) {
+		t.Fatalf("Expected %+v, got %+v", want, res)
+	}
+	for _, event := range []Event{{Key: "alice", Value: "7"}, {Key: "bob", Value: "3"}} {
+		if got := <-events; got != event {
+			t.Errorf("Expected %+v, got %+v", event, got)
+		}
+	}
+
+	// One with a failed cas has no effect.
+	res = app.ApplyCommand(Txn{Ops: []Entry{
+		{Method: "delete", Key: "alice"},
+		{Method: "cas", Key: "bob", Expected: "0", Value: "5"},
+	}})
+	want = TxnResult{Results: []Result{{true, "7"}, {false, "3"}}}
+	if !reflect.DeepEqual(res, want) {
+		t.Fatalf("Expected %+v, got %+v", want, res)
+	}
+	if res := app.ApplyCommand(Entry{Method: "get", Key: "alice"}); res.(Result) != (Result{true, "7"}) {
+		t.Errorf("Expected alice to be kept, got %+v", res)
+	}
+	if len(events) != 0 {
+		t.Errorf("Expected the aborted transaction not to be watched, got %d events", len(events))
+	}
+}
@@ -0,0 +1,74 @@
+package kvstore
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/aecra/raft/raft"
+)
+
+// Deadline returns the Expires of a key set now to live for ttl.
+func Deadline(now time.Time, ttl time.Duration) int64 {
+	return now.Add(ttl).UnixNano()
+}
+
+// Expired returns the "expire" commands of the keys whose deadline passed at
+// now, the earliest first.
+func (app *KVStore) Expired(now time.Time) []Entry {
+	app.mu.RLock()
+	defer app.mu.RUnlock()
+	var expired []Entry
+	for key, expires := range app.Expires {
+		if expires <= now.UnixNano() {
+			expired = append(expired, Entry{Method: "expire", Key: key, Expires: expires})
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		if expired[i].Expires != expired[j].Expires {
+			return expired[i].Expires < expired[j].Expires
+		}
+		return expired[i].Key < expired[j].Key
+	})
+	return expired
+}
+
+// Expirer deletes the expired keys of a store while its server leads.
+//
+// The store never reads the clock itself: the servers apply the commands at
+// different times, and would disagree on which keys expired. Keys are set to
+// expire at a time written in their command, by the leader's gateway for
+// instance, and only the leader's Expirer decides that they did, by
+// submitting "expire" commands that every server applies alike. Until it
+// does, an expired key can still be read.
+type Expirer struct {
+	Server *raft.Server
+	Store  *KVStore
+
+	// Interval is how often the leader looks for expired keys.
+	Interval time.Duration
+}
+
+// Run submits the "expire" commands of the keys the clock of the server says
+// expired, every Interval while it's the leader, until ctx is done. The
+// commands of a key refreshed in the meantime don't delete it.
+func (e *Expirer) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, _, isLeader := e.Server.Report(); !isLeader {
+			continue
+		}
+		for _, entry := range e.Store.Expired(time.Now()) {
+			if _, err := e.Server.SubmitIndexed(ctx, entry); err != nil {
+				// The next round retries the keys left.
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package kvstore
+
+import "encoding/json"
+
+// Txn is a command applying Ops atomically, as a single log entry. The
+// operations are applied in order, each seeing the writes of the ones before
+// it; if a "cas" fails, or an operation isn't a "get", "put", "delete" or
+// "cas", none of them take effect. The watchers are notified of the writes
+// once the transaction committed.
+type Txn struct {
+	Ops []Entry
+}
+
+// TxnResult is the result of a Txn. Committed reports whether its operations
+// took effect, and Results holds the results of the ones applied, the last
+// being the one that failed if it didn't.
+type TxnResult struct {
+	Committed bool
+	Results   []Result
+}
+
+// txnWrite is the value an operation of a transaction wrote to a key.
+type txnWrite struct {
+	value   string
+	deleted bool
+	expires int64
+}
+
+// applyTxn applies the operations of txn to a staging area, and the writes
+// staged to the store if all of them succeeded.
+// Expects app.mu to be locked.
+func (app *KVStore) applyTxn(txn Txn) TxnResult {
+	staged := make(map[string]txnWrite)
+	// order holds the keys written, in the order of their first write.
+	var order []string
+	lookup := func(key string) (string, bool) {
+		if w, ok := staged[key]; ok {
+			return w.value, !w.deleted
+		}
+		value, ok := app.Data[key]
+		return value, ok
+	}
+	write := func(key string, w txnWrite) {
+		if _, ok := staged[key]; !ok {
+			order = append(order, key)
+		}
+		staged[key] = w
+	}
+
+	result := TxnResult{Results: make([]Result, 0, len(txn.Ops))}
+	for _, op := range txn.Ops {
+		old, ok := lookup(op.Key)
+		switch op.Method {
+		case "get":
+			result.Results = append(result.Results, Result{ok, old})
+		case "put":
+			write(op.Key, txnWrite{value: op.Value, expires: op.Expires})
+			result.Results = append(result.Results, Result{true, old})
+		case "delete":
+			write(op.Key, txnWrite{deleted: true})
+			result.Results = append(result.Results, Result{ok, old})
+		case "cas":
+			if !ok || old != op.Expected {
+				result.Results = append(result.Results, Result{false, old})
+				return result
+			}
+			write(op.Key, txnWrite{value: op.Value, expires: op.Expires})
+			result.Results = append(result.Results, Result{true, old})
+		default:
+			result.Results = append(result.Results, Result{false, ""})
+			return result
+		}
+	}
+
+	for _, key := range order {
+		w := staged[key]
+		if !w.deleted {
+			app.set(key, w.value, w.expires)
+		} else if _, ok := app.Data[key]; ok {
+			app.remove(key)
+		}
+	}
+	result.Committed = true
+	return result
+}
+
+// jsonCodec is JSONCodec.
+type jsonCodec struct{}
+
+// jsonCommand holds the fields of both an Entry and a Txn, which a command
+// decoded as JSON is told apart by.
+type jsonCommand struct {
+	Entry
+	Ops []Entry
+}
+
+func (jsonCodec) Encode(command interface{}) ([]byte, error) {
+	return json.Marshal(command)
+}
+
+func (jsonCodec) Decode(data []byte) (interface{}, error) {
+	var command jsonCommand
+	if err := json.Unmarshal(data, &command); err != nil {
+		return nil, err
+	}
+	if command.Ops != nil {
+		return Txn{Ops: command.Ops}, nil
+	}
+	return command.Entry, nil
+}
@@ -0,0 +1,72 @@
+package kvstore
+
+import "strings"
+
+// watchBuffer is the number of events a watcher may fall behind by before
+// it's dropped.
+const watchBuffer = 256
+
+// Event is a committed change of a key, reported to its watchers. Value is
+// the new value of Key, unless Deleted is set because it was deleted or
+// expired.
+type Event struct {
+	Key     string
+	Value   string
+	Deleted bool
+}
+
+// watcher is a channel receiving the events of the keys starting with prefix.
+type watcher struct {
+	prefix string
+	events chan Event
+}
+
+// Watch returns a channel receiving the changes of the keys starting with
+// prefix, a single key being watched with the key as prefix, from now on and
+// in the order they're applied, and a function canceling the watch. Every
+// server of the cluster can be watched, as they all apply the committed
+// commands, though followers report them later than the leader.
+//
+// The channel is closed when the watch is canceled, or if the events can't be
+// reported anymore: when the watcher falls too far behind, or when a snapshot
+// replaces the state of the store. The watcher must then read the keys again,
+// and watch them anew.
+func (app *KVStore) Watch(prefix string) (<-chan Event, func()) {
+	w := &watcher{prefix: prefix, events: make(chan Event, watchBuffer)}
+	app.mu.Lock()
+	if app.watchers == nil {
+		app.watchers = make(map[*watcher]bool)
+	}
+	app.watchers[w] = true
+	app.mu.Unlock()
+	return w.events, func() {
+		app.mu.Lock()
+		defer app.mu.Unlock()
+		app.unwatch(w)
+	}
+}
+
+// notify reports event to the watchers of its key, dropping the ones whose
+// buffer is full.
+// Expects app.mu to be locked.
+func (app *KVStore) notify(event Event) {
+	for w := range app.watchers {
+		if !strings.HasPrefix(event.Key, w.prefix) {
+			continue
+		}
+		select {
+		case w.events <- event:
+		default:
+			app.unwatch(w)
+		}
+	}
+}
+
+// unwatch closes the channel of w, unless it was already.
+// Expects app.mu to be locked.
+func (app *KVStore) unwatch(w *watcher) {
+	if app.watchers[w] {
+		delete(app.watchers, w)
+		close(w.events)
+	}
+}
@@ -0,0 +1,278 @@
+// Package linearizability checks whether a history of concurrent operations
+// is linearizable with respect to a sequential model. The checker follows the
+// algorithm used by porcupine (Wing & Gong, with Lowe's memoization): it
+// searches for a total order of the operations that respects real time and is
+// accepted by the model, caching (linearized set, state) pairs it has already
+// explored.
+package linearizability
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Operation is a single completed (or abandoned) client operation.
+type Operation struct {
+	// ClientId identifies the client issuing the operation.
+	ClientId int
+
+	// Input is the operation as submitted by the client.
+	Input interface{}
+
+	// Call is the time at which the operation was invoked.
+	Call int64
+
+	// Output is the result observed by the client. It's nil if the outcome is
+	// unknown, e.g. the operation timed out and may or may not have been
+	// applied.
+	Output interface{}
+
+	// Return is the time at which the result was observed. Operations whose
+	// outcome is unknown have Return set to math.MaxInt64.
+	Return int64
+}
+
+// Model is a sequential specification of the system under test.
+type Model struct {
+	// Init returns the initial state of the model.
+	Init func() interface{}
+
+	// Step applies input to state and reports whether output is a legal
+	// result of doing so, along with the new state. Step must not modify
+	// state in place.
+	Step func(state interface{}, input interface{}, output interface{}) (bool, interface{})
+
+	// Equal reports whether two states are equal. If nil, states are compared
+	// with ==.
+	Equal func(state1, state2 interface{}) bool
+}
+
+func (m Model) equal(state1, state2 interface{}) bool {
+	if m.Equal == nil {
+		return state1 == state2
+	}
+	return m.Equal(state1, state2)
+}
+
+// Recorder records the history of operations issued by concurrent clients.
+// It's safe for concurrent use.
+type Recorder struct {
+	mu      sync.Mutex
+	start   time.Time
+	history []Operation
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{start: time.Now()}
+}
+
+// Record invokes fn on behalf of the client and records the operation. fn
+// returns the observed output and whether the outcome is known; an unknown
+// outcome is recorded as an operation that may take effect at any time after
+// its invocation.
+func (r *Recorder) Record(clientId int, input interface{}, fn func() (interface{}, bool)) (interface{}, bool) {
+	call := time.Since(r.start).Nanoseconds()
+	output, ok := fn()
+	ret := time.Since(r.start).Nanoseconds()
+	op := Operation{ClientId: clientId, Input: input, Call: call, Output: output, Return: ret}
+	if !ok {
+		op.Output = nil
+		op.Return = math.MaxInt64
+	}
+	r.mu.Lock()
+	r.history = append(r.history, op)
+	r.mu.Unlock()
+	return output, ok
+}
+
+// History returns a copy of the operations recorded so far.
+func (r *Recorder) History() []Operation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	history := make([]Operation, len(r.history))
+	copy(history, r.history)
+	return history
+}
+
+// entry is a call or return event in the history. Call entries point at their
+// matching return entry.
+type entry struct {
+	id    int
+	call  bool
+	value interface{}
+	time  int64
+	match *entry
+	prev  *entry
+	next  *entry
+}
+
+// makeEntries converts a history into a doubly linked list of call and return
+// events ordered by time, with a sentinel head.
+func makeEntries(history []Operation) *entry {
+	type event struct {
+		id    int
+		call  bool
+		value interface{}
+		time  int64
+	}
+	events := make([]event, 0, 2*len(history))
+	for i, op := range history {
+		events = append(events, event{id: i, call: true, value: op.Input, time: op.Call})
+		events = append(events, event{id: i, call: false, value: op.Output, time: op.Return})
+	}
+	// Calls sort before returns happening at the same time, so that touching
+	// operations are considered concurrent.
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].time != events[j].time {
+			return events[i].time < events[j].time
+		}
+		return events[i].call && !events[j].call
+	})
+
+	head := &entry{id: -1}
+	last := head
+	returns := make(map[int]*entry)
+	var calls []*entry
+	for _, ev := range events {
+		e := &entry{id: ev.id, call: ev.call, value: ev.value, time: ev.time, prev: last}
+		last.next = e
+		last = e
+		if ev.call {
+			calls = append(calls, e)
+		} else {
+			returns[ev.id] = e
+		}
+	}
+	for _, c := range calls {
+		c.match = returns[c.id]
+	}
+	return head
+}
+
+// lift removes a call entry and its matching return from the list.
+func lift(e *entry) {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+	match := e.match
+	match.prev.next = match.next
+	if match.next != nil {
+		match.next.prev = match.prev
+	}
+}
+
+// unlift reinserts an entry removed by lift.
+func unlift(e *entry) {
+	match := e.match
+	match.prev.next = match
+	if match.next != nil {
+		match.next.prev = match
+	}
+	e.prev.next = e
+	e.next.prev = e
+}
+
+// bitset tracks which operations have been linearized.
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) set(i int) {
+	b[i/64] |= 1 << uint(i%64)
+}
+
+func (b bitset) clear(i int) {
+	b[i/64] &^= 1 << uint(i%64)
+}
+
+func (b bitset) clone() bitset {
+	c := make(bitset, len(b))
+	copy(c, b)
+	return c
+}
+
+func (b bitset) equals(c bitset) bool {
+	for i := range b {
+		if b[i] != c[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (b bitset) hash() uint64 {
+	h := uint64(len(b))
+	for _, v := range b {
+		h ^= v
+		h *= 1099511628211
+	}
+	return h
+}
+
+type cacheEntry struct {
+	linearized bitset
+	state      interface{}
+}
+
+type callsEntry struct {
+	entry *entry
+	state interface{}
+}
+
+// CheckOperations reports whether history is linearizable with respect to
+// model.
+func CheckOperations(model Model, history []Operation) bool {
+	head := makeEntries(history)
+	state := model.Init()
+	linearized := newBitset(len(history))
+	cache := make(map[uint64][]cacheEntry)
+	var calls []callsEntry
+
+	e := head.next
+	for head.next != nil {
+		if e.call {
+			ok, newState := model.Step(state, e.value, e.match.value)
+			if ok {
+				newLinearized := linearized.clone()
+				newLinearized.set(e.id)
+				if !cacheContains(model, cache, newLinearized, newState) {
+					h := newLinearized.hash()
+					cache[h] = append(cache[h], cacheEntry{newLinearized, newState})
+					calls = append(calls, callsEntry{e, state})
+					state = newState
+					linearized.set(e.id)
+					lift(e)
+					e = head.next
+					continue
+				}
+			}
+			e = e.next
+		} else {
+			// We reached a return without being able to linearize its call;
+			// backtrack.
+			if len(calls) == 0 {
+				return false
+			}
+			top := calls[len(calls)-1]
+			calls = calls[:len(calls)-1]
+			e = top.entry
+			state = top.state
+			linearized.clear(e.id)
+			unlift(e)
+			e = e.next
+		}
+	}
+	return true
+}
+
+func cacheContains(model Model, cache map[uint64][]cacheEntry, linearized bitset, state interface{}) bool {
+	for _, c := range cache[linearized.hash()] {
+		if linearized.equals(c.linearized) && model.equal(state, c.state) {
+			return true
+		}
+	}
+	return false
+}
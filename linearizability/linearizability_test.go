@@ -0,0 +1,97 @@
+package linearizability
+
+import (
+	"math"
+	"testing"
+)
+
+type registerInput struct {
+	Write bool
+	Value int
+}
+
+// registerModel is a single integer register supporting reads and writes.
+var registerModel = Model{
+	Init: func() interface{} {
+		return 0
+	},
+	Step: func(state interface{}, input interface{}, output interface{}) (bool, interface{}) {
+		in := input.(registerInput)
+		if in.Write {
+			return true, in.Value
+		}
+		return output == nil || output.(int) == state.(int), state
+	},
+}
+
+// counterModel is a counter where each increment returns the new value.
+var counterModel = Model{
+	Init: func() interface{} {
+		return 0
+	},
+	Step: func(state interface{}, input interface{}, output interface{}) (bool, interface{}) {
+		next := state.(int) + 1
+		return output == nil || output.(int) == next, next
+	},
+}
+
+func TestLinearizableRegister(t *testing.T) {
+	history := []Operation{
+		{ClientId: 0, Input: registerInput{true, 100}, Call: 0, Output: 0, Return: 100},
+		{ClientId: 1, Input: registerInput{false, 0}, Call: 25, Output: 100, Return: 75},
+		{ClientId: 2, Input: registerInput{false, 0}, Call: 30, Output: 0, Return: 60},
+	}
+	if !CheckOperations(registerModel, history) {
+		t.Errorf("Expected history to be linearizable")
+	}
+}
+
+func TestNonLinearizableRegister(t *testing.T) {
+	history := []Operation{
+		{ClientId: 0, Input: registerInput{true, 200}, Call: 0, Output: 0, Return: 100},
+		{ClientId: 1, Input: registerInput{false, 0}, Call: 10, Output: 200, Return: 30},
+		{ClientId: 2, Input: registerInput{false, 0}, Call: 40, Output: 0, Return: 90},
+	}
+	if CheckOperations(registerModel, history) {
+		t.Errorf("Expected history not to be linearizable")
+	}
+}
+
+func TestUnknownOutcome(t *testing.T) {
+	// The write timed out, but a later read observed it.
+	history := []Operation{
+		{ClientId: 0, Input: registerInput{true, 1}, Call: 0, Output: nil, Return: math.MaxInt64},
+		{ClientId: 1, Input: registerInput{false, 0}, Call: 10, Output: 1, Return: 20},
+	}
+	if !CheckOperations(registerModel, history) {
+		t.Errorf("Expected history to be linearizable")
+	}
+}
+
+func TestDoubleApply(t *testing.T) {
+	// A single increment applied twice shows up as a skipped value.
+	history := []Operation{
+		{ClientId: 0, Input: nil, Call: 0, Output: 1, Return: 10},
+		{ClientId: 0, Input: nil, Call: 20, Output: 3, Return: 30},
+	}
+	if CheckOperations(counterModel, history) {
+		t.Errorf("Expected double apply to be detected")
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	r := NewRecorder()
+	r.Record(0, nil, func() (interface{}, bool) { return 1, true })
+	r.Record(0, nil, func() (interface{}, bool) { return nil, false })
+	r.Record(1, nil, func() (interface{}, bool) { return 2, true })
+	history := r.History()
+	if len(history) != 3 {
+		t.Fatalf("Expected 3 operations, got %d", len(history))
+	}
+	if history[1].Return != math.MaxInt64 {
+		t.Errorf("Expected unknown outcome to never return")
+	}
+	if !CheckOperations(counterModel, history) {
+		t.Errorf("Expected history to be linearizable")
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"encoding/gob"
 	"github.com/aecra/raft/calculator"
 	"github.com/aecra/raft/cluster"
+	"github.com/aecra/raft/linearizability"
+	"math/rand"
+	"sync"
 	"testing"
 	"time"
 )
@@ -15,8 +18,9 @@ func TestRaftApplication(t *testing.T) {
 	c := cluster.NewCluster(num, calculator.NewCalculator)
 	c.Serve()
 
-	// leave some time for cluster to elect leader
-	time.Sleep(2 * time.Second)
+	if _, err := c.WaitForLeader(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
 
 	// test calculator create
 	res, ok := c.Submit(calculator.Entry{Method: "create"})
@@ -121,3 +125,93 @@ func TestRaftApplication(t *testing.T) {
 	}
 	c.Shutdown()
 }
+
+// cloneCalculator returns a deep copy of a calculator.
+func cloneCalculator(app *calculator.Calculator) *calculator.Calculator {
+	clone := calculator.NewCalculator().(*calculator.Calculator)
+	clone.LastInstanceId = app.LastInstanceId
+	for id, stack := range app.Calculator {
+		clone.Calculator[id] = append([]int{}, stack...)
+	}
+	return clone
+}
+
+// calculatorModel is the sequential specification of the calculator. Its
+// state is a *calculator.Calculator that is never modified in place.
+var calculatorModel = linearizability.Model{
+	Init: func() interface{} {
+		return calculator.NewCalculator()
+	},
+	Step: func(state interface{}, input interface{}, output interface{}) (bool, interface{}) {
+		app := cloneCalculator(state.(*calculator.Calculator))
+		res := app.ApplyCommand(input)
+		return output == nil || output.(calculator.Result) == res, app
+	},
+	Equal: func(state1, state2 interface{}) bool {
+		app1, app2 := state1.(*calculator.Calculator), state2.(*calculator.Calculator)
+		if app1.LastInstanceId != app2.LastInstanceId || len(app1.Calculator) != len(app2.Calculator) {
+			return false
+		}
+		for id, s1 := range app1.Calculator {
+			s2, ok := app2.Calculator[id]
+			if !ok || len(s1) != len(s2) {
+				return false
+			}
+			for i := range s1 {
+				if s1[i] != s2[i] {
+					return false
+				}
+			}
+		}
+		return true
+	},
+}
+
+func TestRaftLinearizability(t *testing.T) {
+	gob.Register(calculator.Entry{})
+	num := 3
+	c := cluster.NewCluster(num, calculator.NewCalculator)
+	c.Serve()
+	defer c.Shutdown()
+
+	if _, err := c.WaitForLeader(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := linearizability.NewRecorder()
+	create := calculator.Entry{Method: "create"}
+	res, ok := recorder.Record(0, create, func() (interface{}, bool) {
+		return c.Submit(create)
+	})
+	if !ok || res.(calculator.Result).Result != true {
+		t.Fatalf("Expected create to succeed")
+	}
+	instanceId := res.(calculator.Result).Value
+
+	// Several clients operate on the same instance concurrently, so results
+	// delivered to the wrong Submit or applied twice break linearizability.
+	clients := 4
+	methods := []string{"push", "push", "pop", "add", "sub", "mul", "inc", "dec", "get"}
+	var wg sync.WaitGroup
+	for client := 0; client < clients; client++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				entry := calculator.Entry{
+					Method:     methods[rand.Intn(len(methods))],
+					InstanceId: instanceId,
+					Operand:    rand.Intn(10),
+				}
+				recorder.Record(client, entry, func() (interface{}, bool) {
+					return c.Submit(entry)
+				})
+			}
+		}(client)
+	}
+	wg.Wait()
+
+	if !linearizability.CheckOperations(calculatorModel, recorder.History()) {
+		t.Errorf("Expected history to be linearizable")
+	}
+}
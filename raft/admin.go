@@ -0,0 +1,314 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+)
+
+// AdminArgs selects the group an admin RPC applies to.
+type AdminArgs struct {
+	GroupId int
+}
+
+// StatusReply describes the state of a server's CM.
+type StatusReply struct {
+	Id            ServerID
+	State         string
+	Term          int
+	Leader        ServerID
+	CommitIndex   int
+	LastApplied   int
+	LastLogIndex  int
+	SnapshotIndex int
+	Peers         []ServerID
+
+	// ApplyLag is the number of committed entries not applied yet.
+	ApplyLag int
+
+	// Maintenance is set if the server is in maintenance mode.
+	Maintenance bool
+
+	// LastContact is when a follower last heard from Leader, or a leader
+	// was last acknowledged by a majority, and the zero time if it never
+	// was.
+	LastContact time.Time
+}
+
+// PeerStatus describes a member of a group. NextIndex, MatchIndex and Lag are
+// only known by the leader, and are -1 elsewhere, as is State empty.
+type PeerStatus struct {
+	Id         ServerID
+	Addr       string
+	NextIndex  int
+	MatchIndex int
+	State      string
+	Lag        int
+}
+
+type ListPeersReply struct {
+	Peers []PeerStatus
+}
+
+// ServerArgs names the server added, removed, or given the leadership by an
+// admin RPC. Addr is only used to add a server.
+type ServerArgs struct {
+	GroupId int
+	Id      ServerID
+	Addr    string
+}
+
+// MaintenanceArgs puts a server in maintenance mode if Enter is set, and takes
+// it out of it otherwise. TransferLeadership is passed to EnterMaintenance.
+type MaintenanceArgs struct {
+	Enter              bool
+	TransferLeadership bool
+}
+
+// SnapshotReply is the index and term of the last entry a snapshot covers.
+type SnapshotReply struct {
+	Index int
+	Term  int
+}
+
+// BackupReply is an archive written by WriteBackup.
+type BackupReply struct {
+	Archive []byte
+}
+
+// LogArgs selects the entries in [From, To) of a group's log. To is the end of
+// the log if it's negative.
+type LogArgs struct {
+	GroupId int
+	From    int
+	To      int
+}
+
+// LogEntryInfo describes a log entry, its command formatted with %+v. Config
+// is set if it's a membership change, and Committed if the server knows it's
+// committed.
+type LogEntryInfo struct {
+	Index     int
+	Term      int
+	Command   string
+	Config    bool
+	Committed bool
+}
+
+type LogReply struct {
+	Entries []LogEntryInfo
+}
+
+// StateChecksumArgs asks a server for the checksum of its state at the state
+// barrier at Index, which it waits at most Timeout to apply.
+type StateChecksumArgs struct {
+	ProtocolVersion int
+	GroupId         int
+	Index           int
+	Timeout         time.Duration
+}
+
+type StateChecksumReply struct {
+	Checksum uint64
+}
+
+// UpdateConfigArgs changes the tunable parameters of a group with
+// UpdateConfig. The reply is their new values.
+type UpdateConfigArgs struct {
+	GroupId int
+	Update  ConfigUpdate
+}
+
+// adminService is registered as the "Admin" RPC service of the server, for
+// operators to inspect and reconfigure the groups it hosts, with raftctl for
+// instance.
+type adminService struct {
+	s *Server
+}
+
+// Status describes the state of cm.
+func (cm *ConsensusModule) Status() StatusReply {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	var status StatusReply
+	status.Id = cm.id
+	status.State = cm.state.String()
+	status.Term = cm.currentTerm
+	status.Leader = cm.leaderId
+	status.CommitIndex = cm.commitIndex
+	status.LastApplied = cm.lastApplied
+	status.LastLogIndex, _ = cm.lastLogIndexAndTerm()
+	status.SnapshotIndex = cm.snapshotIndex
+	status.Peers = cm.sortedPeerIds()
+	status.ApplyLag = cm.commitIndex - cm.appliedIndex
+	status.Maintenance = cm.maintenance
+	status.LastContact = cm.lastContact
+	return status
+}
+
+// ListPeers describes the members of the group of cm, as far as it knows.
+func (cm *ConsensusModule) ListPeers() []PeerStatus {
+	var statuses []PeerStatus
+	cm.mu.Lock()
+	lastLogIndex, _ := cm.lastLogIndexAndTerm()
+	peers := cm.membershipAt(lastLogIndex)
+	for _, id := range cm.sortedPeerIds() {
+		peer := PeerStatus{Id: id, Addr: peers[id], NextIndex: -1, MatchIndex: -1, Lag: -1}
+		if cm.state == Leader {
+			if id == cm.id {
+				peer.NextIndex, peer.MatchIndex = lastLogIndex+1, lastLogIndex
+				peer.State = "leader"
+			} else {
+				peer.NextIndex, peer.MatchIndex = cm.nextIndex[id], cm.matchIndex[id]
+				peer.State = cm.replicationState(id).String()
+			}
+			peer.Lag = lastLogIndex - peer.MatchIndex
+		}
+		statuses = append(statuses, peer)
+	}
+	cm.mu.Unlock()
+
+	// The addresses of the initial members are only known by the server.
+	for i, peer := range statuses {
+		if peer.Addr == "" {
+			statuses[i].Addr = cm.server.knownAddr(peer.Id)
+		}
+	}
+	return statuses
+}
+
+func (a *adminService) Status(args AdminArgs, reply *StatusReply) error {
+	cm, err := a.s.group(args.GroupId)
+	if err != nil {
+		return err
+	}
+	*reply = cm.Status()
+	return nil
+}
+
+func (a *adminService) Health(args HealthArgs, reply *Health) error {
+	cm, err := a.s.group(args.GroupId)
+	if err != nil {
+		return err
+	}
+	*reply = cm.Health(args.MaxLag)
+	return nil
+}
+
+func (a *adminService) ListPeers(args AdminArgs, reply *ListPeersReply) error {
+	cm, err := a.s.group(args.GroupId)
+	if err != nil {
+		return err
+	}
+	reply.Peers = cm.ListPeers()
+	return nil
+}
+
+func (a *adminService) AddServer(args ServerArgs, reply *struct{}) error {
+	cm, err := a.s.group(args.GroupId)
+	if err != nil {
+		return err
+	}
+	if args.Addr == "" {
+		return fmt.Errorf("raft: the address of server %s is missing", args.Id)
+	}
+	return cm.AddServer(args.Id, args.Addr)
+}
+
+func (a *adminService) RemoveServer(args ServerArgs, reply *struct{}) error {
+	cm, err := a.s.group(args.GroupId)
+	if err != nil {
+		return err
+	}
+	return cm.RemoveServer(args.Id)
+}
+
+func (a *adminService) ForgetPeer(args ServerArgs, reply *struct{}) error {
+	cm, err := a.s.group(args.GroupId)
+	if err != nil {
+		return err
+	}
+	return cm.ForgetPeer(args.Id)
+}
+
+func (a *adminService) TransferLeadership(args ServerArgs, reply *struct{}) error {
+	cm, err := a.s.group(args.GroupId)
+	if err != nil {
+		return err
+	}
+	return cm.TransferLeadership(args.Id)
+}
+
+func (a *adminService) Maintenance(args MaintenanceArgs, reply *struct{}) error {
+	if !args.Enter {
+		a.s.ExitMaintenance()
+		return nil
+	}
+	return a.s.EnterMaintenance(args.TransferLeadership)
+}
+
+func (a *adminService) Snapshot(args AdminArgs, reply *SnapshotReply) error {
+	cm, err := a.s.group(args.GroupId)
+	if err != nil {
+		return err
+	}
+	reply.Index, reply.Term, err = cm.TakeSnapshot()
+	return err
+}
+
+func (a *adminService) Backup(args AdminArgs, reply *BackupReply) error {
+	cm, err := a.s.group(args.GroupId)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := cm.WriteBackup(&buf); err != nil {
+		return err
+	}
+	reply.Archive = buf.Bytes()
+	return nil
+}
+
+func (a *adminService) Log(args LogArgs, reply *LogReply) error {
+	cm, err := a.s.group(args.GroupId)
+	if err != nil {
+		return err
+	}
+	reply.Entries, err = cm.ReadEntries(intMax(args.From, 0), args.To)
+	return err
+}
+
+func (a *adminService) UpdateConfig(args UpdateConfigArgs, reply *ConfigUpdate) error {
+	cm, err := a.s.group(args.GroupId)
+	if err != nil {
+		return err
+	}
+	*reply, err = cm.UpdateConfig(args.Update)
+	return err
+}
+
+func (a *adminService) StateChecksum(args StateChecksumArgs, reply *StateChecksumReply) error {
+	if err := a.s.checkVersion(args.ProtocolVersion); err != nil {
+		return err
+	}
+	cm, err := a.s.group(args.GroupId)
+	if err != nil {
+		return err
+	}
+	reply.Checksum, err = cm.StateChecksum(args.Index, args.Timeout)
+	return err
+}
+
+func (a *adminService) CheckState(args AdminArgs, reply *StateReport) error {
+	cm, err := a.s.group(args.GroupId)
+	if err != nil {
+		return err
+	}
+	report, err := cm.CheckState(context.Background())
+	if err != nil {
+		return err
+	}
+	*reply = *report
+	return nil
+}
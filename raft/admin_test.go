@@ -0,0 +1,200 @@
+package raft
+
+import (
+	"bytes"
+	"net/rpc"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotHeader(t *testing.T) {
+	header := snapshotHeader{Version: snapshotFormatVersion, Index: 7, Term: 2, Members: map[ServerID]string{"a": "", "b": "", "c": "localhost:1234"}}
+	var buf bytes.Buffer
+	if err := writeSnapshotHeader(&buf, header); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString("app data")
+	got, appData, ok, err := readSnapshotHeader(buf.Bytes())
+	if err != nil || !ok {
+		t.Fatalf("readSnapshotHeader: ok %v, err %v", ok, err)
+	}
+	if !reflect.DeepEqual(got, header) || string(appData) != "app data" {
+		t.Errorf("got %+v and %q, want %+v and %q", got, appData, header, "app data")
+	}
+	if err := got.check(7, 2); err != nil {
+		t.Errorf("check(7, 2): %v", err)
+	}
+	if err := got.check(8, 2); err == nil {
+		t.Errorf("Expected the header of the snapshot at 7 not to pass for the one at 8")
+	}
+
+	// Snapshots in a newer format are refused.
+	buf.Reset()
+	if err := writeSnapshotHeader(&buf, snapshotHeader{Version: snapshotFormatVersion + 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := readSnapshotHeader(buf.Bytes()); err == nil {
+		t.Errorf("Expected a header of a newer format version to be refused")
+	}
+
+	// The membership of the snapshots taken when server IDs were ints is
+	// converted.
+	buf.Reset()
+	if err := writeSnapshotHeader(&buf, snapshotHeader{Peers: map[int]string{0: "", 5: "localhost:1234"}}); err != nil {
+		t.Fatal(err)
+	}
+	got, _, _, err = readSnapshotHeader(buf.Bytes())
+	if want := map[ServerID]string{"0": "", "5": "localhost:1234"}; err != nil || !reflect.DeepEqual(got.Members, want) || got.Peers != nil {
+		t.Errorf("got %+v (err %v) for a legacy header, want members %v", got, err, want)
+	}
+	if err := got.check(7, 2); err != nil {
+		t.Errorf("Expected a header without version not to be checked, got %v", err)
+	}
+
+	// Snapshots taken before the header existed are the application's data.
+	_, appData, ok, err = readSnapshotHeader([]byte("app data"))
+	if err != nil || ok || string(appData) != "app data" {
+		t.Errorf("got %q, ok %v, err %v for a snapshot without header", appData, ok, err)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	num := 5
+	var servers []*Server
+	var apps []*listApp
+	ready := make(chan interface{})
+	// Server num isn't a member of the initial cluster; it's added below.
+	for i := 0; i <= num; i++ {
+		apps = append(apps, &listApp{})
+		s, err := NewServer(i, WithCluster(num, ready), WithApplication(apps[i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, s)
+		servers[i].Serve()
+	}
+	for i := 0; i < num; i++ {
+		for j := 0; j < num; j++ {
+			if i != j {
+				if err := servers[i].ConnectToPeer(j, servers[j].GetListenAddr()); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	close(ready)
+	// Servers wait for their connections to be closed to shut down.
+	var clients []*rpc.Client
+	defer func() {
+		for _, client := range clients {
+			client.Close()
+		}
+		for _, s := range servers {
+			s.DisconnectAll()
+		}
+		for _, s := range servers {
+			s.Shutdown()
+		}
+	}()
+
+	admin := func(i int) *rpc.Client {
+		t.Helper()
+		client, err := rpc.Dial("tcp", servers[i].GetListenAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, client)
+		return client
+	}
+	// findLeader returns the leader, waiting for one other than old to be
+	// elected.
+	findLeader := func(old int) int {
+		t.Helper()
+		for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); {
+			for i, s := range servers {
+				if _, _, isLeader := s.cm.Report(); isLeader && i != old {
+					return i
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatal("No leader elected")
+		return -1
+	}
+
+	leader := findLeader(-1)
+	client := admin(leader)
+	for i := 0; i < 3; i++ {
+		if _, ok := servers[leader].Submit(i); !ok {
+			t.Fatalf("Submit %d failed", i)
+		}
+	}
+
+	follower := (leader + 1) % num
+	err := admin(follower).Call("Admin.AddServer", ServerArgs{Id: IntID(num), Addr: servers[num].GetListenAddr().String()}, &struct{}{})
+	if err == nil || !strings.Contains(err.Error(), "not the leader") {
+		t.Errorf("AddServer on a follower returned %v", err)
+	}
+	err = client.Call("Admin.AddServer", ServerArgs{Id: IntID(num), Addr: servers[num].GetListenAddr().String()}, &struct{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := servers[leader].Submit(3); !ok {
+		t.Fatal("Submit 3 failed")
+	}
+	want := []int{0, 1, 2, 3}
+	for deadline := time.Now().Add(3 * time.Second); !reflect.DeepEqual(apps[num].get(), want); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the added server to apply %v, got %v", want, apps[num].get())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	var status StatusReply
+	if err := admin(num).Call("Admin.Status", AdminArgs{}, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Leader != IntID(leader) || !reflect.DeepEqual(status.Peers, []ServerID{"0", "1", "2", "3", "4", "5"}) {
+		t.Errorf("Status of the added server is %+v", status)
+	}
+	var peers ListPeersReply
+	if err := client.Call("Admin.ListPeers", AdminArgs{}, &peers); err != nil {
+		t.Fatal(err)
+	}
+	if len(peers.Peers) != num+1 || peers.Peers[num].MatchIndex != status.LastLogIndex {
+		t.Errorf("ListPeers returned %+v", peers.Peers)
+	}
+	var logReply LogReply
+	if err := client.Call("Admin.Log", LogArgs{To: -1}, &logReply); err != nil {
+		t.Fatal(err)
+	}
+	if len(logReply.Entries) != 5 || !logReply.Entries[3].Config {
+		t.Errorf("Log returned %+v", logReply.Entries)
+	}
+	var snapshot SnapshotReply
+	if err := client.Call("Admin.Snapshot", AdminArgs{}, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Index != 4 {
+		t.Errorf("Snapshot taken at index %d, want 4", snapshot.Index)
+	}
+
+	if err := client.Call("Admin.TransferLeadership", ServerArgs{Id: IntID(follower)}, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if newLeader := findLeader(leader); newLeader != follower {
+		t.Fatalf("Leader is %d after the transfer, want %d", newLeader, follower)
+	}
+	if err := admin(follower).Call("Admin.RemoveServer", ServerArgs{Id: IntID(leader)}, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := servers[follower].Submit(4); !ok {
+		t.Fatal("Submit 4 failed")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := apps[leader].get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("The removed server applied %v", got)
+	}
+}
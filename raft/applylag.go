@@ -0,0 +1,79 @@
+package raft
+
+import "errors"
+
+// ErrProposalQueueFull is returned to clients whose commands are rejected
+// because the leader has Config.MaxPending entries that aren't committed yet.
+// The commands weren't appended, so they can be resubmitted once replication
+// catches up.
+var ErrProposalQueueFull = errors.New("raft: proposal queue full")
+
+// ApplyStats describes how far the application lags behind the log.
+type ApplyStats struct {
+	// CommitIndex is the index of the last committed entry, and AppliedIndex
+	// the index of the last entry the application finished applying.
+	CommitIndex  int
+	AppliedIndex int
+
+	// Lag is CommitIndex-AppliedIndex, and MaxLag the largest Lag seen.
+	Lag    int
+	MaxLag int
+
+	// Rejected is the number of commands rejected because Lag exceeded
+	// Config.MaxApplyLag.
+	Rejected int
+}
+
+// ApplyStats returns the apply lag statistics of cm.
+func (cm *ConsensusModule) ApplyStats() ApplyStats {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return ApplyStats{
+		CommitIndex:  cm.commitIndex,
+		AppliedIndex: cm.appliedIndex,
+		Lag:          cm.commitIndex - cm.appliedIndex,
+		MaxLag:       cm.maxApplyLag,
+		Rejected:     cm.lagRejected,
+	}
+}
+
+// notifyCommit wakes commitChanSender up to apply the newly committed
+// entries, and records the apply lag. It doesn't block: commitChanSender
+// applies all the committed entries it finds, so one pending notification is
+// enough.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) notifyCommit() {
+	if lag := cm.commitIndex - cm.appliedIndex; lag > cm.maxApplyLag {
+		cm.maxApplyLag = lag
+	}
+	select {
+	case cm.newCommitReadyChan <- struct{}{}:
+	default:
+	}
+}
+
+// lagging is applyLagging for callers that don't hold cm.mu.
+func (cm *ConsensusModule) lagging() bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.applyLagging()
+}
+
+// applyLagging reports whether the application lags too far behind the log to
+// accept new commands, and counts the rejection if so.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) applyLagging() bool {
+	if cm.config.MaxApplyLag > 0 && cm.commitIndex-cm.appliedIndex > cm.config.MaxApplyLag {
+		cm.lagRejected++
+		return true
+	}
+	return false
+}
+
+// pendingFull reports whether the leader has too many uncommitted entries,
+// counting the commands queued to be appended, to accept new commands.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) pendingFull() bool {
+	lastLogIndex, _ := cm.lastLogIndexAndTerm()
+	return cm.config.MaxPending > 0 && lastLogIndex+len(cm.appendQueue)-cm.commitIndex >= cm.config.MaxPending
+}
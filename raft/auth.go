@@ -0,0 +1,95 @@
+package raft
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// ErrUnauthenticated is returned by Authenticate when the server rejects the
+// token.
+var ErrUnauthenticated = errors.New("raft: connection rejected, bad cluster token")
+
+// authMagic starts the handshake a connection opens with when the servers
+// have a cluster token. It's followed by the uvarint length of the token and
+// the token itself, and the server answers with authAccepted, or closes the
+// connection.
+var authMagic = []byte("RAFTAUTH")
+
+const (
+	authAccepted = 1
+
+	// maxTokenSize bounds the token a server reads from a connection.
+	maxTokenSize = 4096
+
+	// authTimeout is the time a connection has to authenticate.
+	authTimeout = 5 * time.Second
+)
+
+// WithToken sets the cluster token. A server with a token only serves the
+// connections that open with it, so that other processes on the network can't
+// vote, append entries or submit commands; peers and clients send it with
+// Authenticate. All the servers of a cluster must use the same one.
+func WithToken(token string) Option {
+	return func(s *Server) {
+		s.token = token
+	}
+}
+
+// Authenticate sends token over conn, which was just opened to a server, and
+// waits for the server to accept it. Clients must call it before sending any
+// RPC to servers that have a token.
+func Authenticate(conn net.Conn, token string) error {
+	var size [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(size[:], uint64(len(token)))
+	msg := append(append(append([]byte(nil), authMagic...), size[:n]...), token...)
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+	var reply [1]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil || reply[0] != authAccepted {
+		return ErrUnauthenticated
+	}
+	return nil
+}
+
+// checkToken reads the handshake of an incoming connection and reports whether
+// it carries the server's token.
+func (s *Server) checkToken(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(authTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	magic := make([]byte, len(authMagic))
+	if _, err := io.ReadFull(conn, magic); err != nil || !bytes.Equal(magic, authMagic) {
+		return false
+	}
+	size, err := binary.ReadUvarint(byteReader{conn})
+	if err != nil || size > maxTokenSize {
+		return false
+	}
+	token := make([]byte, size)
+	if _, err := io.ReadFull(conn, token); err != nil {
+		return false
+	}
+	if subtle.ConstantTimeCompare(token, []byte(s.token)) != 1 {
+		return false
+	}
+	_, err = conn.Write([]byte{authAccepted})
+	return err == nil
+}
+
+// byteReader reads a connection byte by byte, so that binary.ReadUvarint
+// doesn't consume more than the token's length.
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r.Reader, b[:])
+	return b[0], err
+}
@@ -0,0 +1,70 @@
+package raft
+
+import (
+	"net"
+	"net/rpc"
+	"testing"
+)
+
+func TestToken(t *testing.T) {
+	s, err := NewServer(0, WithCluster(1, make(chan interface{})), WithToken("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Serve()
+	defer s.Shutdown()
+	addr := s.GetListenAddr().String()
+
+	status := func(token string) error {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if token != "" {
+			if err := Authenticate(conn, token); err != nil {
+				return err
+			}
+		}
+		client := rpc.NewClient(conn)
+		defer client.Close()
+		var reply StatusReply
+		return client.Call("Admin.Status", AdminArgs{}, &reply)
+	}
+	if err := status("secret"); err != nil {
+		t.Errorf("RPC with the token failed: %v", err)
+	}
+	if err := status("wrong"); err != ErrUnauthenticated {
+		t.Errorf("got %v with a wrong token, want ErrUnauthenticated", err)
+	}
+	if err := status(""); err == nil {
+		t.Error("RPC without the token succeeded")
+	}
+}
+
+func TestTokenPeers(t *testing.T) {
+	ready := make(chan interface{})
+	var servers []*Server
+	for i, token := range []string{"secret", "secret", "other"} {
+		s, err := NewServer(i, WithCluster(3, ready), WithToken(token))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Serve()
+		servers = append(servers, s)
+	}
+	defer func() {
+		for _, s := range servers {
+			s.DisconnectAll()
+		}
+		for _, s := range servers {
+			s.Shutdown()
+		}
+	}()
+	if err := servers[0].ConnectToPeer(1, servers[1].GetListenAddr()); err != nil {
+		t.Errorf("Connecting peers with the same token failed: %v", err)
+	}
+	if err := servers[0].ConnectToPeer(2, servers[2].GetListenAddr()); err != ErrUnauthenticated {
+		t.Errorf("got %v connecting peers with different tokens, want ErrUnauthenticated", err)
+	}
+}
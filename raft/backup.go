@@ -0,0 +1,203 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aecra/raft/storage"
+)
+
+// backupMagic starts the archives written by WriteBackup.
+var backupMagic = []byte("RAFTBAK1")
+
+// backupArchive is what WriteBackup encodes with gob after backupMagic: the
+// last snapshot of a group, if any, and the committed entries following it,
+// their commands encoded by the Codec of the server.
+type backupArchive struct {
+	HasSnapshot bool
+	Snapshot    storage.Snapshot
+	First       int
+	Entries     []WireEntry
+}
+
+// WriteBackup writes an archive of the group to w, for RestoreBackup: its
+// last snapshot and the committed entries following it. The archive holds
+// what this server knows to be committed, so it's most up to date on the
+// leader.
+func (cm *ConsensusModule) WriteBackup(w io.Writer) error {
+	cm.mu.Lock()
+	if cm.state == Dead {
+		cm.mu.Unlock()
+		return errors.New("raft: stopped")
+	}
+	if cm.witness {
+		cm.mu.Unlock()
+		return errors.New("raft: witnesses don't have the commands to back up")
+	}
+	// The snapshot is only replaced with cm.mu locked, so it matches
+	// snapshotIndex.
+	snap, hasSnapshot, err := cm.storage.Snapshot()
+	if err != nil {
+		cm.mu.Unlock()
+		return err
+	}
+	first := cm.snapshotIndex + 1
+	entries := append([]LogEntry(nil), cm.log[:cm.commitIndex-cm.snapshotIndex]...)
+	cm.mu.Unlock()
+
+	archive := backupArchive{HasSnapshot: hasSnapshot, Snapshot: snap, First: first}
+	for i, entry := range entries {
+		if err := verifyChecksum(first+i, entry); err != nil {
+			return err
+		}
+		cc, isConfig := entry.Command.(configChange)
+		chunk, isChunk := entry.Command.(commandChunk)
+		barrier, isBarrier := entry.Command.(stateBarrier)
+		var command []byte
+		var token string
+		switch {
+		case isConfig:
+			command, err = encodeConfigChange(cc)
+		case isChunk:
+			command, err = encodeChunk(chunk)
+		case isBarrier:
+			command, err = encodeStateBarrier(barrier)
+		default:
+			command, token, err = encodeCommand(cm.codec, entry.Command)
+		}
+		if err != nil {
+			return fmt.Errorf("encoding entry %d: %v", first+i, err)
+		}
+		archive.Entries = append(archive.Entries, WireEntry{
+			Command:  command,
+			Term:     entry.Term,
+			Config:   isConfig,
+			Chunk:    isChunk,
+			Barrier:  isBarrier,
+			Token:    token,
+			Checksum: wireChecksum(entry.Term, command, token),
+		})
+	}
+	if _, err := w.Write(backupMagic); err != nil {
+		return err
+	}
+	return gob.NewEncoder(w).Encode(archive)
+}
+
+// WriteBackup writes an archive of the default group to w, like
+// ConsensusModule.WriteBackup.
+func (s *Server) WriteBackup(w io.Writer) error {
+	cm, err := s.group(DefaultGroup)
+	if err != nil {
+		return err
+	}
+	return cm.WriteBackup(w)
+}
+
+// RestoreBackup bootstraps store, which must be empty, for a server of a new
+// cluster from the archive written by WriteBackup read from r. app is a fresh
+// instance of the application, and must implement Snapshotter: the snapshot
+// of the archive is restored into it and the entries are applied to it, and
+// its state is saved to store as a single snapshot. The new cluster thus
+// starts with all the commands of the archive applied. codec decodes the
+// commands; it's GobCodec if nil.
+//
+// Every server of the new cluster is restored from the same archive. The
+// membership of the new cluster is the one WithCluster gives it; the servers
+// added to the old one at runtime aren't.
+func RestoreBackup(r io.Reader, app Application, codec Codec, store storage.Storage) error {
+	s, ok := app.(Snapshotter)
+	if !ok {
+		return errors.New("raft: the application can't be snapshotted")
+	}
+	if codec == nil {
+		codec = GobCodec{}
+	}
+	if last, err := store.LastIndex(); err != nil {
+		return err
+	} else if last != -1 {
+		return errors.New("raft: the storage to restore a backup into isn't empty")
+	}
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(backupMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || !bytes.Equal(magic, backupMagic) {
+		return errors.New("raft: not a backup archive")
+	}
+	var archive backupArchive
+	if err := gob.NewDecoder(br).Decode(&archive); err != nil {
+		return fmt.Errorf("raft: reading backup archive: %v", err)
+	}
+
+	index, term := -1, -1
+	// The commands submitted with a token are applied once, but the new
+	// cluster starts without their results.
+	applied := make(map[string]bool)
+	var chunks chunkAssembler
+	if archive.HasSnapshot {
+		header, appData, _, err := readSnapshotHeader(archive.Snapshot.Data)
+		if err != nil {
+			return err
+		}
+		for _, r := range header.Tokens {
+			applied[r.Token] = true
+		}
+		chunks.restore(header.Chunks)
+		if err := restoreSnapshot(s, header, appData); err != nil {
+			return err
+		}
+		index, term = archive.Snapshot.Index, archive.Snapshot.Term
+	}
+	for i, entry := range archive.Entries {
+		if wireChecksum(entry.Term, entry.Command, entry.Token) != entry.Checksum {
+			return &ChecksumError{Index: archive.First + i}
+		}
+		index, term = archive.First+i, entry.Term
+		if entry.Config || entry.Barrier {
+			// The membership is the new cluster's, and the state barriers
+			// compared states of the old one.
+			continue
+		}
+		data := entry.Command
+		if entry.Chunk {
+			chunk, err := decodeChunk(entry.Command)
+			if err != nil {
+				return fmt.Errorf("decoding entry %d: %v", index, err)
+			}
+			var whole bool
+			if data, whole = chunks.add(chunk); !whole {
+				continue
+			}
+		} else {
+			chunks.interrupt()
+		}
+		command, err := codec.Decode(data)
+		if err != nil {
+			return fmt.Errorf("decoding entry %d: %v", index, err)
+		}
+		if entry.Token != "" {
+			if applied[entry.Token] {
+				continue
+			}
+			applied[entry.Token] = true
+		}
+		app.ApplyCommand(command)
+	}
+	if index == -1 {
+		return errors.New("raft: the backup archive is empty")
+	}
+
+	// The snapshot has no header, so the servers start with the membership
+	// of WithMembers or WithCluster.
+	var data bytes.Buffer
+	if err := s.SnapshotTo(&data); err != nil {
+		return err
+	}
+	if err := store.SaveSnapshot(storage.Snapshot{Index: index, Term: term, Data: data.Bytes()}); err != nil {
+		return err
+	}
+	return store.SetHardState(storage.HardState{CurrentTerm: term})
+}
@@ -0,0 +1,149 @@
+package raft
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"math"
+	"reflect"
+	"sort"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ChecksumError reports a log entry whose command doesn't match the checksum
+// computed when it was appended to the leader's log.
+type ChecksumError struct {
+	Index int
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("raft: checksum mismatch in log entry %d", e.Index)
+}
+
+// entryChecksum returns the CRC-32C of the term and command of a log entry.
+// It's never 0, which marks the entries appended before checksums existed.
+//
+// Every server computes it when the entry is appended to its log, as commands
+// can decode to different values on different servers, depending on the
+// Codec. AppendEntries carries a wireChecksum of the encoded entry instead.
+// The command is hashed by value rather than by its encoding, because gob
+// doesn't encode maps deterministically: the exported fields of structs, the
+// elements of slices, arrays and maps (in the order of their hashed keys) and
+// the values pointers and interfaces point to. Nil and empty slices and maps
+// hash the same, as do nil pointers and pointers to zero values, since storage
+// backends may decode one as the other.
+func entryChecksum(term int, command interface{}) uint32 {
+	h := crc32.New(castagnoli)
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(term))
+	h.Write(buf[:])
+	hashValue(h, reflect.ValueOf(command))
+	if sum := h.Sum32(); sum != 0 {
+		return sum
+	}
+	return 1
+}
+
+// verifyChecksums verifies entries, the first of which has index first.
+func verifyChecksums(first int, entries []LogEntry) error {
+	for i, entry := range entries {
+		if err := verifyChecksum(first+i, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wireChecksum returns the CRC-32C of the term, encoded command and token, if
+// any, of an entry sent in AppendEntries.
+func wireChecksum(term int, command []byte, token string) uint32 {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(term))
+	sum := crc32.Update(crc32.Checksum(buf[:], castagnoli), castagnoli, command)
+	return crc32.Update(sum, castagnoli, []byte(token))
+}
+
+// verifyChecksum returns a *ChecksumError if entry, at index, was corrupted.
+func verifyChecksum(index int, entry LogEntry) error {
+	if entry.Checksum != 0 && entryChecksum(entry.Term, entry.Command) != entry.Checksum {
+		return &ChecksumError{Index: index}
+	}
+	return nil
+}
+
+func hashValue(h hash.Hash32, v reflect.Value) {
+	var buf [8]byte
+	writeUint := func(n uint64) {
+		binary.BigEndian.PutUint64(buf[:], n)
+		h.Write(buf[:])
+	}
+	if !v.IsValid() {
+		h.Write([]byte{0})
+		return
+	}
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() || v.Elem().IsZero() {
+			h.Write([]byte{0})
+		} else {
+			hashValue(h, v.Elem())
+		}
+		return
+	case reflect.Interface:
+		hashValue(h, v.Elem())
+		return
+	}
+	h.Write([]byte{byte(v.Kind())})
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			writeUint(1)
+		} else {
+			writeUint(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		writeUint(uint64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		writeUint(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		writeUint(math.Float64bits(v.Float()))
+	case reflect.Complex64, reflect.Complex128:
+		writeUint(math.Float64bits(real(v.Complex())))
+		writeUint(math.Float64bits(imag(v.Complex())))
+	case reflect.String:
+		writeUint(uint64(v.Len()))
+		h.Write([]byte(v.String()))
+	case reflect.Slice, reflect.Array:
+		writeUint(uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			hashValue(h, v.Index(i))
+		}
+	case reflect.Map:
+		// Hash each key and value on its own, and the pairs in the order
+		// of their keys' hashes.
+		pairs := make([][2]uint32, 0, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			k, e := crc32.New(castagnoli), crc32.New(castagnoli)
+			hashValue(k, iter.Key())
+			hashValue(e, iter.Value())
+			pairs = append(pairs, [2]uint32{k.Sum32(), e.Sum32()})
+		}
+		sort.Slice(pairs, func(i, j int) bool {
+			return pairs[i][0] < pairs[j][0] || pairs[i][0] == pairs[j][0] && pairs[i][1] < pairs[j][1]
+		})
+		writeUint(uint64(len(pairs)))
+		for _, pair := range pairs {
+			writeUint(uint64(pair[0])<<32 | uint64(pair[1]))
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			if t.Field(i).IsExported() {
+				hashValue(h, v.Field(i))
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+)
+
+type checksumCommand struct {
+	Name   string
+	Counts map[string]int
+	Next   *checksumCommand
+	Tags   []string
+	hidden int
+}
+
+func TestEntryChecksum(t *testing.T) {
+	command := checksumCommand{
+		Name:   "a",
+		Counts: map[string]int{"x": 1, "y": 2, "z": 3},
+		Next:   &checksumCommand{Name: "b"},
+		hidden: 1,
+	}
+	sum := entryChecksum(1, command)
+	if sum == 0 {
+		t.Fatal("entryChecksum returned 0")
+	}
+
+	// Decoding the command, as storage backends do, keeps the checksum.
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(command); err != nil {
+		t.Fatal(err)
+	}
+	var decoded checksumCommand
+	if err := gob.NewDecoder(&buf).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if got := entryChecksum(1, decoded); got != sum {
+		t.Errorf("checksum of the decoded command is %x, want %x", got, sum)
+	}
+
+	changed := decoded
+	changed.Counts = map[string]int{"x": 1, "y": 2, "z": 4}
+	if entryChecksum(1, changed) == sum {
+		t.Error("changing a map value kept the checksum")
+	}
+	if entryChecksum(2, command) == sum {
+		t.Error("changing the term kept the checksum")
+	}
+
+	entry := LogEntry{Command: command, Term: 1, Checksum: sum}
+	if err := verifyChecksum(3, entry); err != nil {
+		t.Error(err)
+	}
+	entry.Command = changed
+	if err, ok := verifyChecksum(3, entry).(*ChecksumError); !ok || err.Index != 3 {
+		t.Errorf("verifyChecksum returned %v for a corrupted entry", err)
+	}
+	entry.Checksum = 0
+	if err := verifyChecksum(3, entry); err != nil {
+		t.Errorf("verifyChecksum returned %v for an entry without checksum", err)
+	}
+}
+
+func TestUpgradeLegacyConfigChange(t *testing.T) {
+	// A configuration change logged when server IDs were ints decodes with
+	// its ID in Id, and its checksum covers the fields it had then.
+	var buf bytes.Buffer
+	legacy := legacyConfigChange{Add: true, Id: 3, Addr: "localhost:1234"}
+	if err := gob.NewEncoder(&buf).Encode(legacy); err != nil {
+		t.Fatal(err)
+	}
+	var cc configChange
+	if err := gob.NewDecoder(&buf).Decode(&cc); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := upgradeEntry(7, LogEntry{Command: cc, Term: 2, Checksum: entryChecksum(2, legacy)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := configChange{Add: true, Server: "3", Addr: "localhost:1234"}
+	if entry.Command != want {
+		t.Errorf("Upgraded change is %+v, want %+v", entry.Command, want)
+	}
+	if err := verifyChecksum(7, entry); err != nil {
+		t.Errorf("Upgraded entry fails verification: %v", err)
+	}
+
+	if _, err := upgradeEntry(7, LogEntry{Command: cc, Term: 2, Checksum: entryChecksum(3, legacy)}); err == nil {
+		t.Error("Corrupted legacy entry passed verification")
+	}
+}
@@ -0,0 +1,253 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"sync"
+	"time"
+)
+
+func init() {
+	// Storage backends encode commands with gob, chunks included.
+	gob.Register(commandChunk{})
+}
+
+// commandChunk is the command of a log entry holding a part of a command
+// submitted with SubmitChunked: Data are the bytes of part Part of Parts of
+// the command encoded by the Codec. The leader appends the parts of a command
+// as contiguous entries, and the application gets the command once the last
+// part is applied. AppendEntries carries chunks encoded with gob rather than
+// the Codec, with WireEntry.Chunk set.
+type commandChunk struct {
+	Part, Parts int
+	Data        []byte
+}
+
+func (c commandChunk) String() string {
+	return fmt.Sprintf("chunk %d/%d (%d bytes)", c.Part+1, c.Parts, len(c.Data))
+}
+
+// chunkPart is the command a chunk is applied as until its command is whole:
+// the application doesn't see it, and its result is nil.
+type chunkPart struct{}
+
+// chunkFailure is the command the last chunk of a command is applied as if
+// the reassembled command can't be decoded. Its result is an *ApplyError.
+type chunkFailure struct {
+	err error
+}
+
+// chunkAssembler collects the parts of a chunked command as they're applied.
+// It's part of the replicated state, saved in snapshots, as a snapshot may be
+// taken between the parts of a command.
+type chunkAssembler struct {
+	mu sync.Mutex
+
+	// parts holds the data of the parts applied so far of the command being
+	// reassembled.
+	parts [][]byte
+}
+
+// add adds the next applied chunk, and returns the encoded command if it was
+// the last part. A chunk that doesn't follow the parts collected so far drops
+// them: the rest of their command was overwritten by the entries of a new
+// leader.
+func (a *chunkAssembler) add(chunk commandChunk) ([]byte, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if chunk.Part != len(a.parts) {
+		a.parts = nil
+		if chunk.Part != 0 {
+			return nil, false
+		}
+	}
+	a.parts = append(a.parts, chunk.Data)
+	if len(a.parts) < chunk.Parts {
+		return nil, false
+	}
+	data := bytes.Join(a.parts, nil)
+	a.parts = nil
+	return data, true
+}
+
+// interrupt drops the parts collected so far, as an entry that isn't a chunk
+// was applied after them.
+func (a *chunkAssembler) interrupt() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.parts = nil
+}
+
+// pending returns the parts collected so far, to save in a snapshot.
+func (a *chunkAssembler) pending() [][]byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([][]byte(nil), a.parts...)
+}
+
+// restore replaces the parts collected so far with the ones saved in a
+// snapshot.
+func (a *chunkAssembler) restore(parts [][]byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.parts = parts
+}
+
+// assemble returns entries with the commands of their chunks replaced: by the
+// reassembled command for the last part of a command, and by chunkPart for
+// the others, so that apply applies each chunked command once.
+func (cm *ConsensusModule) assemble(entries []LogEntry) []LogEntry {
+	var assembled []LogEntry
+	for i, entry := range entries {
+		chunk, isChunk := entry.Command.(commandChunk)
+		if !isChunk {
+			cm.chunks.interrupt()
+			if assembled != nil {
+				assembled[i] = entry
+			}
+			continue
+		}
+		if assembled == nil {
+			assembled = make([]LogEntry, len(entries))
+			copy(assembled, entries[:i])
+		}
+		assembled[i] = entry
+		data, whole := cm.chunks.add(chunk)
+		if !whole {
+			assembled[i].Command = chunkPart{}
+			continue
+		}
+		command, err := cm.codec.Decode(data)
+		if err != nil {
+			assembled[i].Command = chunkFailure{fmt.Errorf("raft: decoding chunked command: %v", err)}
+			continue
+		}
+		assembled[i].Command = command
+	}
+	if assembled == nil {
+		return entries
+	}
+	return assembled
+}
+
+// SubmitChunked is SubmitIndexed for commands that may be larger than
+// Config.MaxCommandBytes once encoded by the Codec. The encoding of a larger
+// command is split into parts of half that size, appended as contiguous log
+// entries, and the command is applied, once, when the last of them is; its
+// result is the command's, and the entries of the other parts have nil
+// results. Commands that fit in one entry are submitted like SubmitIndexed.
+func (cm *ConsensusModule) SubmitChunked(ctx context.Context, command interface{}) (SubmitResult, error) {
+	if cm.electionOnly {
+		return SubmitResult{}, ErrElectionOnly
+	}
+	data, err := cm.codec.Encode(command)
+	if err != nil {
+		return SubmitResult{}, fmt.Errorf("raft: encoding command: %v", err)
+	}
+	size := cm.config.MaxCommandBytes / 2
+	if len(data) <= cm.config.MaxCommandBytes || size == 0 {
+		return cm.submit(ctx, command)
+	}
+	var chunks []commandChunk
+	for start := 0; start < len(data); start += size {
+		chunks = append(chunks, commandChunk{Part: len(chunks), Data: data[start:intMin(start+size, len(data))]})
+	}
+	for i := range chunks {
+		chunks[i].Parts = len(chunks)
+	}
+
+	submitted := time.Now()
+	cm.mu.Lock()
+	if cm.state != Leader || cm.transferring || cm.draining {
+		leader := cm.leaderId
+		if leader == cm.id {
+			leader = NoServer
+		}
+		cm.mu.Unlock()
+		return SubmitResult{}, &NotLeaderError{Leader: leader}
+	}
+	if cm.applyLagging() {
+		cm.mu.Unlock()
+		return SubmitResult{}, ErrThrottled
+	}
+	if cm.pendingFull() {
+		cm.mu.Unlock()
+		return SubmitResult{}, ErrProposalQueueFull
+	}
+	term := cm.currentTerm
+	index, resultChan, err := cm.proposeChunks(chunks)
+	cm.mu.Unlock()
+	if err != nil {
+		return SubmitResult{}, err
+	}
+	cm.metrics.submitToAppend.observe(time.Since(submitted))
+	cm.triggerAE()
+	return cm.awaitSubmitted(ctx, submitted, index, term, resultChan)
+}
+
+// SubmitChunked submits command to the default group, like
+// ConsensusModule.SubmitChunked.
+func (s *Server) SubmitChunked(ctx context.Context, command interface{}) (SubmitResult, error) {
+	cm, err := s.group(DefaultGroup)
+	if err != nil {
+		return SubmitResult{}, err
+	}
+	return cm.SubmitChunked(ctx, command)
+}
+
+// proposeChunks appends chunks to the log of the leader as contiguous entries
+// and registers a proposal for the last one, whose result is the command's.
+// It returns the index of the last entry and the channel its result is
+// delivered on.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) proposeChunks(chunks []commandChunk) (int, chan interface{}, error) {
+	entries := make([]LogEntry, len(chunks))
+	for i, chunk := range chunks {
+		entries[i] = LogEntry{Command: chunk, Term: cm.currentTerm, Checksum: entryChecksum(cm.currentTerm, chunk)}
+	}
+	first := cm.snapshotIndex + 1 + len(cm.log)
+	if err := cm.persistEntries(first, entries); err != nil {
+		cm.raftLog("failed to persist chunked command: %v", err)
+		return 0, nil, err
+	}
+	cm.log = append(cm.log, entries...)
+	last := first + len(entries) - 1
+	for index := first; index <= last; index++ {
+		if p, ok := cm.proposals[index]; ok {
+			// A command proposed at this index in an earlier term was
+			// overwritten and will never be applied.
+			close(p.resultChan)
+			delete(cm.proposals, index)
+		}
+	}
+	resultChan := make(chan interface{}, 1)
+	cm.proposals[last] = proposal{term: cm.currentTerm, resultChan: resultChan, appended: time.Now()}
+	return last, resultChan, nil
+}
+
+func encodeChunk(chunk commandChunk) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(chunk); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeChunk(data []byte) (commandChunk, error) {
+	var chunk commandChunk
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&chunk)
+	return chunk, err
+}
+
+// skipApply reports whether command isn't passed to the application: it's a
+// membership change, applied when appended, a part of a chunked command, or a
+// state barrier.
+func skipApply(command interface{}) bool {
+	switch command.(type) {
+	case configChange, chunkPart, stateBarrier:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,207 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// NotLeaderError is returned to clients submitting a command to a server that
+// isn't the leader of the group. Leader is the ID of the leader as far as the
+// server knows, or NoServer.
+type NotLeaderError struct {
+	Leader ServerID
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.Leader == NoServer {
+		return "raft: not the leader, leader unknown"
+	}
+	return fmt.Sprintf("raft: not the leader, try server %s", e.Leader)
+}
+
+// CommandTooLargeError is returned to clients submitting a command whose
+// encoding is larger than Config.MaxCommandBytes. The command wasn't appended.
+type CommandTooLargeError struct {
+	Size, Max int
+}
+
+func (e *CommandTooLargeError) Error() string {
+	return fmt.Sprintf("raft: command of %d bytes exceeds the maximum of %d", e.Size, e.Max)
+}
+
+// ErrUnknownResult is returned to clients when a command was appended to the
+// leader's log but wasn't applied in time. It may still be applied later, so
+// only idempotent commands can safely be resubmitted.
+var ErrUnknownResult = errors.New("raft: command result unknown")
+
+// ClientSubmitArgs is a command submitted by a client, encoded by the Codec
+// of the server.
+type ClientSubmitArgs struct {
+	// ProtocolVersion is the version of the wire protocol of the connection,
+	// negotiated with NegotiateVersion.
+	ProtocolVersion int
+
+	GroupId int
+	Command []byte
+
+	// Session identifies the client for Config.SessionSubmitRate.
+	Session string
+
+	// Token, if set, identifies the command as with SubmitIdempotent, so
+	// that it's applied once however many times it's submitted.
+	Token string
+}
+
+// ClientSubmitReply is the outcome of a ClientSubmitArgs. If Accepted is
+// false, the command wasn't appended: either Throttled is set, because of the
+// submit rate limits, of the apply lag of the leader or of its uncommitted
+// entries, or EnqueueTimedOut, because the command was withdrawn with
+// ErrEnqueueTimeout, or LeaderHint is the ID of the leader or NoServer. If
+// Committed is true, Result is the result of applying the command, encoded by
+// the Codec of the server, unless ApplyError holds the error the application
+// failed with, and Index and Term locate the entry it was committed at.
+type ClientSubmitReply struct {
+	Accepted        bool
+	Committed       bool
+	Throttled       bool
+	EnqueueTimedOut bool
+	LeaderHint      ServerID
+	Result          []byte
+	ApplyError      string
+	Index           int
+	Term            int
+}
+
+// ClientReadArgs is a query sent by a client, encoded by the Codec of the
+// server. The application must implement Querier.
+type ClientReadArgs struct {
+	ProtocolVersion int
+
+	GroupId int
+	Query   []byte
+
+	// MaxStaleness, if positive, lets any server answer from a state as
+	// stale as ReadStale allows. Otherwise the read is linearizable, and only
+	// the leader answers it, as with Read.
+	MaxStaleness time.Duration
+
+	// MinIndex is the index of the last entry the client's session saw,
+	// committing its commands or reflected by its reads. The server waits to
+	// have applied it before answering, so that the session reads its own
+	// writes and never sees the state go back in time.
+	MinIndex int
+}
+
+// ClientReadReply is the answer to a ClientReadArgs. If Accepted is false,
+// the query wasn't answered: either Behind is set, because the server is too
+// stale or didn't apply MinIndex in time, or the leader hasn't committed an
+// entry of its term yet, and another server or a later attempt may answer
+// it, or LeaderHint is the ID of the leader or NoServer. Otherwise Result is
+// the answer, encoded by the Codec of the server, which reflects the log up
+// to Index at least.
+type ClientReadReply struct {
+	Accepted   bool
+	Behind     bool
+	LeaderHint ServerID
+	Result     []byte
+	Index      int
+}
+
+// clientService is registered as the "Client" RPC service of the server, for
+// clients in other processes to submit commands.
+type clientService struct {
+	s *Server
+}
+
+func (c *clientService) Submit(args ClientSubmitArgs, reply *ClientSubmitReply) error {
+	if err := c.s.checkVersion(args.ProtocolVersion); err != nil {
+		return err
+	}
+	cm, err := c.s.group(args.GroupId)
+	if err != nil {
+		return err
+	}
+	command, err := cm.codec.Decode(args.Command)
+	if err != nil {
+		return fmt.Errorf("decoding command: %v", err)
+	}
+	// Only the leader's throttle counts; the other servers redirect.
+	if cm.Leader() == c.s.serverId && (!c.s.throttle.allow(args.Session) || cm.lagging()) {
+		reply.Throttled = true
+		return nil
+	}
+	if args.Token != "" {
+		command = idempotentCommand{Token: args.Token, Command: command}
+	}
+	committed, err := cm.submit(context.Background(), command)
+	var applyErr *ApplyError
+	switch {
+	case err == nil:
+		reply.Accepted, reply.Committed = true, true
+		reply.Index, reply.Term = committed.Index, committed.Term
+		reply.Result, err = cm.codec.Encode(committed.Result)
+		if err != nil {
+			return fmt.Errorf("encoding result: %v", err)
+		}
+	case errors.As(err, &applyErr):
+		reply.Accepted, reply.Committed = true, true
+		reply.Index, reply.Term = committed.Index, committed.Term
+		reply.ApplyError = applyErr.Err.Error()
+	case err == ErrUnknownResult:
+		reply.Accepted = true
+	case err == ErrThrottled, err == ErrProposalQueueFull:
+		reply.Throttled = true
+	case err == ErrEnqueueTimeout:
+		reply.EnqueueTimedOut = true
+	case errors.As(err, new(*CommandTooLargeError)):
+		// The client would get the same error from any server.
+		return err
+	default:
+		reply.LeaderHint = cm.Leader()
+	}
+	return nil
+}
+
+func (c *clientService) Read(args ClientReadArgs, reply *ClientReadReply) error {
+	if err := c.s.checkVersion(args.ProtocolVersion); err != nil {
+		return err
+	}
+	cm, err := c.s.group(args.GroupId)
+	if err != nil {
+		return err
+	}
+	query, err := cm.codec.Decode(args.Query)
+	if err != nil {
+		return fmt.Errorf("decoding query: %v", err)
+	}
+	if err := cm.WaitApplied(args.MinIndex, cm.config.CommitTimeout); err == ErrApplyTimeout {
+		reply.Behind = true
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var answer interface{}
+	if args.MaxStaleness > 0 {
+		answer, reply.Index, err = cm.readStale(query, args.MaxStaleness)
+	} else {
+		answer, reply.Index, err = cm.read(context.Background(), query)
+	}
+	var notLeader *NotLeaderError
+	switch {
+	case err == nil:
+		reply.Accepted = true
+		reply.Result, err = cm.codec.Encode(answer)
+		if err != nil {
+			return fmt.Errorf("encoding answer: %v", err)
+		}
+	case err == ErrTooStale, err == ErrLeaderNotReady, err == context.DeadlineExceeded:
+		reply.Behind = true
+	case errors.As(err, &notLeader):
+		reply.LeaderHint = notLeader.Leader
+	default:
+		return err
+	}
+	return nil
+}
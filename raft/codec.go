@@ -0,0 +1,67 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"reflect"
+)
+
+// Codec encodes the commands of log entries sent between servers. Every
+// server of a cluster must use the same Codec. Storage backends encode
+// commands on their own.
+type Codec interface {
+	Encode(command interface{}) ([]byte, error)
+	Decode(data []byte) (interface{}, error)
+}
+
+// GobCodec encodes commands with gob, so their concrete types must be
+// registered with gob.Register. It's the default Codec.
+type GobCodec struct{}
+
+// commandWrapper lets gob encode the dynamic type of a command.
+type commandWrapper struct {
+	Command interface{}
+}
+
+func (GobCodec) Encode(command interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(commandWrapper{command}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Decode(data []byte) (interface{}, error) {
+	var wrapper commandWrapper
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&wrapper); err != nil {
+		return nil, err
+	}
+	return wrapper.Command, nil
+}
+
+// JSONCodec encodes commands as JSON, which clients written in other
+// languages can produce, and which tolerates added and removed fields.
+type JSONCodec struct {
+	// New returns a pointer to a new command, which Decode unmarshals into
+	// and returns the value of. If it's nil, commands are decoded as
+	// json.Unmarshal decodes into an interface{}.
+	New func() interface{}
+}
+
+func (c JSONCodec) Encode(command interface{}) ([]byte, error) {
+	return json.Marshal(command)
+}
+
+func (c JSONCodec) Decode(data []byte) (interface{}, error) {
+	if c.New == nil {
+		var command interface{}
+		err := json.Unmarshal(data, &command)
+		return command, err
+	}
+	command := c.New()
+	if err := json.Unmarshal(data, command); err != nil {
+		return nil, err
+	}
+	return reflect.ValueOf(command).Elem().Interface(), nil
+}
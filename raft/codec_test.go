@@ -0,0 +1,53 @@
+package raft
+
+import (
+	"encoding/gob"
+	"reflect"
+	"testing"
+)
+
+type testCommand struct {
+	Op    string
+	Value int
+}
+
+func init() {
+	gob.Register(testCommand{})
+}
+
+func TestCodecs(t *testing.T) {
+	for name, codec := range map[string]Codec{
+		"Gob":  GobCodec{},
+		"JSON": JSONCodec{New: func() interface{} { return new(testCommand) }},
+	} {
+		t.Run(name, func(t *testing.T) {
+			want := testCommand{Op: "set", Value: 3}
+			data, err := codec.Encode(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := codec.Decode(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Expected %#v, got %#v", want, got)
+			}
+		})
+	}
+}
+
+func TestJSONCodecWithoutNew(t *testing.T) {
+	data, err := JSONCodec{}.Encode(testCommand{Op: "set", Value: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := JSONCodec{}.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"Op": "set", "Value": 3.0}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %#v, got %#v", want, got)
+	}
+}
@@ -0,0 +1,221 @@
+package raft
+
+import (
+	"fmt"
+	"time"
+)
+
+// Config holds the tunable parameters of a Server. Zero fields take the
+// values of DefaultConfig.
+type Config struct {
+	// ElectionTimeoutMin and ElectionTimeoutMax bound the election timeout,
+	// which is picked at random between them every time a follower or
+	// candidate starts waiting for a leader.
+	ElectionTimeoutMin time.Duration
+	ElectionTimeoutMax time.Duration
+
+	// HeartbeatInterval is how often a leader sends AEs to its followers when
+	// it has nothing new to send. It must be below ElectionTimeoutMin, or
+	// followers start elections while the leader is alive.
+	HeartbeatInterval time.Duration
+
+	// CommitTimeout is how long Submit waits for a command to be applied
+	// before giving up. SubmitContext waits until the deadline of its context
+	// instead, if it has one.
+	CommitTimeout time.Duration
+
+	// ApplyTimeout, if set, bounds how long a command submitted to the
+	// leader may wait to be replicated, whatever the deadline of the
+	// submission's context, so that clients aren't stuck behind a wedged
+	// replication pipeline. A command still queued to be appended, with a
+	// GroupCommitWindow, is withdrawn and fails with ErrEnqueueTimeout; one
+	// appended but not committed fails with ErrUnknownResult.
+	ApplyTimeout time.Duration
+
+	// SnapshotThreshold is the number of applied entries after which a
+	// Snapshotter application is snapshotted and the log compacted.
+	SnapshotThreshold int
+
+	// SnapshotChunkSize is the maximum size of the data sent in one
+	// InstallSnapshot RPC.
+	SnapshotChunkSize int
+
+	// CatchUpRate limits the bandwidth used to send snapshots and committed
+	// entries to lagging followers, in bytes per second, so that rebuilding a
+	// follower doesn't starve heartbeats and the replication of new entries.
+	// Zero means no limit.
+	CatchUpRate int
+
+	// SubmitRate limits the commands a server accepts from clients, in
+	// commands per second, with bursts of one second's worth. The commands
+	// over the limit are rejected with ErrThrottled. Zero means no limit.
+	SubmitRate int
+
+	// SessionSubmitRate is SubmitRate for each client session, as set by
+	// client.Options.Session. Zero means no limit.
+	SessionSubmitRate int
+
+	// MaxApplyBatch is the maximum number of committed entries handed to the
+	// application at a time.
+	MaxApplyBatch int
+
+	// MaxApplyLag is the number of committed entries the application may
+	// lag behind before the leader rejects new commands, as throttled ones.
+	// Zero means no limit.
+	MaxApplyLag int
+
+	// MaxPending is the number of entries a leader may have appended but not
+	// committed yet before it rejects new commands with ErrProposalQueueFull,
+	// so that its log doesn't grow unboundedly ahead of replication. Zero
+	// means no limit.
+	MaxPending int
+
+	// GroupCommitWindow is how long a leader collects the commands submitted
+	// concurrently before appending them to its log with a single storage
+	// write, and fsync, raising the throughput of a slow disk at the cost of
+	// the window's latency. Zero appends each command as it's submitted.
+	GroupCommitWindow time.Duration
+
+	// MaxCommandBytes is the largest encoding of a command, by the Codec,
+	// that Submit accepts. Larger commands are rejected with a
+	// *CommandTooLargeError, so that a single one can't hold up the
+	// replication of the others.
+	MaxCommandBytes int
+
+	// ResolveInterval is how often the host names in the addresses of the
+	// peers are resolved again. A peer whose host name no longer resolves to
+	// the address it's connected at is redialed. Zero disables it.
+	ResolveInterval time.Duration
+
+	// LagAlertThreshold is the number of entries a follower may lag behind
+	// the leader before the leader reports it with a PeerLagEvent. Zero
+	// disables the reports.
+	LagAlertThreshold int
+
+	// SlowStorageThreshold is how long a write to the storage may take
+	// before the server reports it with a SlowStorageEvent, to detect a slow
+	// disk. Zero disables the reports.
+	SlowStorageThreshold time.Duration
+
+	// ApplyPanicPolicy is what a server does when its application panics
+	// applying a command: it halts the group by default.
+	ApplyPanicPolicy PanicPolicy
+
+	// GossipInterval is how often a server set up with WithGossip exchanges
+	// the members it knows of with another one.
+	GossipInterval time.Duration
+
+	// PreferredZone is the zone, set by WithZone, the leader should run in.
+	// A leader in another zone hands its leadership over to an up-to-date
+	// follower in it after ZoneTransferDelay. Empty disables it.
+	PreferredZone string
+
+	// ZoneTransferDelay is how long a leader outside PreferredZone leads
+	// before handing its leadership over, and waits between attempts.
+	ZoneTransferDelay time.Duration
+
+	// DeadPeerTimeout is how long a leader waits for a peer to acknowledge
+	// its AEs before removing it from the group with ForgetPeer, as dead. It
+	// can't be below ElectionTimeoutMax. Zero disables it.
+	DeadPeerTimeout time.Duration
+
+	// IdempotencyCacheSize is the number of results of commands submitted
+	// with SubmitIdempotent that are kept, to answer retries. It's part of
+	// the replicated state, so it must be the same on all the servers.
+	IdempotencyCacheSize int
+
+	// Seed seeds the random generator each group of a server draws its
+	// election timeouts from, mixed with the server ID and group, so that a
+	// test run can be reproduced by seed. Zero seeds it from the clock.
+	Seed int64
+}
+
+// DefaultConfig returns the default parameters.
+func DefaultConfig() Config {
+	return Config{
+		ElectionTimeoutMin: 150 * time.Millisecond,
+		ElectionTimeoutMax: 300 * time.Millisecond,
+		HeartbeatInterval:  50 * time.Millisecond,
+		CommitTimeout:      650 * time.Millisecond,
+		SnapshotThreshold:  1000,
+		SnapshotChunkSize:  64 * 1024,
+		MaxApplyBatch:      1024,
+		MaxCommandBytes:    1 << 20,
+		GossipInterval:     time.Second,
+		ZoneTransferDelay:  time.Second,
+
+		IdempotencyCacheSize: 10000,
+	}
+}
+
+// withDefaults returns c with its zero fields set from DefaultConfig.
+func (c Config) withDefaults() Config {
+	d := DefaultConfig()
+	if c.ElectionTimeoutMin == 0 {
+		c.ElectionTimeoutMin = d.ElectionTimeoutMin
+	}
+	if c.ElectionTimeoutMax == 0 {
+		c.ElectionTimeoutMax = d.ElectionTimeoutMax
+	}
+	if c.HeartbeatInterval == 0 {
+		c.HeartbeatInterval = d.HeartbeatInterval
+	}
+	if c.CommitTimeout == 0 {
+		c.CommitTimeout = d.CommitTimeout
+	}
+	if c.SnapshotThreshold == 0 {
+		c.SnapshotThreshold = d.SnapshotThreshold
+	}
+	if c.SnapshotChunkSize == 0 {
+		c.SnapshotChunkSize = d.SnapshotChunkSize
+	}
+	if c.MaxApplyBatch == 0 {
+		c.MaxApplyBatch = d.MaxApplyBatch
+	}
+	if c.GossipInterval == 0 {
+		c.GossipInterval = d.GossipInterval
+	}
+	if c.ZoneTransferDelay == 0 {
+		c.ZoneTransferDelay = d.ZoneTransferDelay
+	}
+	if c.MaxCommandBytes == 0 {
+		c.MaxCommandBytes = d.MaxCommandBytes
+	}
+	if c.IdempotencyCacheSize == 0 {
+		c.IdempotencyCacheSize = d.IdempotencyCacheSize
+	}
+	return c
+}
+
+// Validate checks that the parameters of c, with defaults filled in, are
+// consistent.
+func (c Config) Validate() error {
+	c = c.withDefaults()
+	switch {
+	case c.ElectionTimeoutMin < 0, c.ElectionTimeoutMax < 0, c.HeartbeatInterval < 0, c.CommitTimeout < 0, c.ApplyTimeout < 0, c.ResolveInterval < 0, c.GossipInterval < 0, c.ZoneTransferDelay < 0, c.SlowStorageThreshold < 0, c.GroupCommitWindow < 0, c.DeadPeerTimeout < 0:
+		return fmt.Errorf("raft: negative duration in config %+v", c)
+	case c.ElectionTimeoutMax < c.ElectionTimeoutMin:
+		return fmt.Errorf("raft: election timeout max %v is below min %v", c.ElectionTimeoutMax, c.ElectionTimeoutMin)
+	case c.HeartbeatInterval >= c.ElectionTimeoutMin:
+		return fmt.Errorf("raft: heartbeat interval %v is not below election timeout min %v", c.HeartbeatInterval, c.ElectionTimeoutMin)
+	case c.DeadPeerTimeout != 0 && c.DeadPeerTimeout < c.ElectionTimeoutMax:
+		return fmt.Errorf("raft: dead peer timeout %v is below election timeout max %v", c.DeadPeerTimeout, c.ElectionTimeoutMax)
+	case c.SnapshotThreshold < 0:
+		return fmt.Errorf("raft: negative snapshot threshold %d", c.SnapshotThreshold)
+	case c.SnapshotChunkSize < 0:
+		return fmt.Errorf("raft: negative snapshot chunk size %d", c.SnapshotChunkSize)
+	case c.CatchUpRate < 0:
+		return fmt.Errorf("raft: negative catch-up rate %d", c.CatchUpRate)
+	case c.SubmitRate < 0, c.SessionSubmitRate < 0:
+		return fmt.Errorf("raft: negative submit rate in config %+v", c)
+	case c.MaxApplyBatch < 0, c.MaxApplyLag < 0, c.LagAlertThreshold < 0, c.MaxPending < 0:
+		return fmt.Errorf("raft: negative apply limit in config %+v", c)
+	case c.MaxCommandBytes < 0:
+		return fmt.Errorf("raft: negative maximum command size %d", c.MaxCommandBytes)
+	case c.IdempotencyCacheSize < 0:
+		return fmt.Errorf("raft: negative idempotency cache size %d", c.IdempotencyCacheSize)
+	case c.ApplyPanicPolicy != PanicHalt && c.ApplyPanicPolicy != PanicStepDown:
+		return fmt.Errorf("raft: unknown apply panic policy %v", c.ApplyPanicPolicy)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package raft
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConfigValidate(t *testing.T) {
+	if err := (Config{}).Validate(); err != nil {
+		t.Errorf("Expected the zero config to be valid, got %v", err)
+	}
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Errorf("Expected the default config to be valid, got %v", err)
+	}
+	for name, c := range map[string]Config{
+		"NegativeTimeout":  {CommitTimeout: -time.Second},
+		"InvertedRange":    {ElectionTimeoutMin: 300 * time.Millisecond, ElectionTimeoutMax: 200 * time.Millisecond},
+		"SlowHeartbeat":    {HeartbeatInterval: 200 * time.Millisecond},
+		"NegativeChunk":    {SnapshotChunkSize: -1},
+		"NegativeApplyLag": {MaxApplyLag: -1},
+		"NegativePending":  {MaxPending: -1},
+		"NegativeCommand":  {MaxCommandBytes: -1},
+		"NegativeCatchUp":  {CatchUpRate: -1},
+		"NegativeSnapshot": {SnapshotThreshold: -1},
+		"NegativeGossip":   {GossipInterval: -time.Second},
+		"NegativeTokens":   {IdempotencyCacheSize: -1},
+		"NegativeZone":     {ZoneTransferDelay: -time.Second},
+		"UnknownPolicy":    {ApplyPanicPolicy: 5},
+		"NegativeDeadPeer": {DeadPeerTimeout: -time.Second},
+		"QuickDeadPeer":    {DeadPeerTimeout: 100 * time.Millisecond},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("%s: expected %+v to be invalid", name, c)
+		}
+	}
+}
+
+func TestConfigDefaults(t *testing.T) {
+	c := Config{HeartbeatInterval: 10 * time.Millisecond}.withDefaults()
+	if c.HeartbeatInterval != 10*time.Millisecond {
+		t.Errorf("Expected the heartbeat interval to be kept, got %v", c.HeartbeatInterval)
+	}
+	if c.ElectionTimeoutMin != DefaultConfig().ElectionTimeoutMin {
+		t.Errorf("Expected the default election timeout, got %v", c.ElectionTimeoutMin)
+	}
+}
@@ -0,0 +1,126 @@
+package raft
+
+import (
+	"errors"
+	"time"
+)
+
+// A server that's gone for good, its machine decommissioned for instance,
+// stays a member of its groups until it's removed, and the leader keeps
+// sending it AEs every heartbeat, and counting it in the majorities. It can
+// be forgotten with ForgetPeer, or automatically once it hasn't acknowledged
+// an AE for Config.DeadPeerTimeout.
+
+// DeadPeerEvent reports that the leader is removing Peer from the group, as
+// it didn't hear from it for Silence, more than Config.DeadPeerTimeout.
+type DeadPeerEvent struct {
+	GroupId int
+	Peer    ServerID
+	Silence time.Duration
+}
+
+func (e *DeadPeerEvent) Group() int { return e.GroupId }
+
+// ForgetPeer removes the dead server id from the group, like RemoveServer,
+// and drops the connection to it once it's a member of none of the groups of
+// the server, so that it's no longer dialed. It must be called on the leader.
+func (cm *ConsensusModule) ForgetPeer(id ServerID) error {
+	if err := cm.RemoveServer(id); err != nil {
+		return err
+	}
+	cm.server.forgetPeer(id)
+	return nil
+}
+
+// ForgetPeer removes the dead server id from the default group, like
+// ConsensusModule.ForgetPeer.
+func (s *Server) ForgetPeer(id ServerID) error {
+	cm, err := s.group(DefaultGroup)
+	if err != nil {
+		return err
+	}
+	return cm.ForgetPeer(id)
+}
+
+// forgetPeer disconnects the server from peer id, and forgets its address,
+// unless it's still a member of one of its groups.
+func (s *Server) forgetPeer(id ServerID) {
+	s.mu.Lock()
+	for _, cm := range s.groups {
+		cm.mu.Lock()
+		_, member := cm.peerIds[id]
+		cm.mu.Unlock()
+		if member {
+			s.mu.Unlock()
+			return
+		}
+	}
+	s.mu.Unlock()
+	if err := s.Disconnect(id); err != nil {
+		s.logger.Printf("[%v] disconnecting from %s failed: %v", s.serverId, id, err)
+	}
+}
+
+// runDeadPeerRemoval forgets the peers that don't acknowledge the AEs of the
+// leadership of term for Config.DeadPeerTimeout, one at a time, until cm
+// loses the leadership. It's started by startLeader when the timeout is set.
+func (cm *ConsensusModule) runDeadPeerRemoval(term int) {
+	since := time.Now()
+	ticker := time.NewTicker(cm.config.DeadPeerTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-cm.done:
+			return
+		}
+		cm.mu.Lock()
+		if cm.state != Leader || cm.currentTerm != term {
+			cm.mu.Unlock()
+			return
+		}
+		id, silence := cm.deadPeer(since, time.Now())
+		if id != NoServer {
+			cm.raftLog("%s didn't answer for %v; removing it", id, silence)
+			cm.observe(&DeadPeerEvent{GroupId: cm.groupId, Peer: id, Silence: silence})
+		}
+		cm.mu.Unlock()
+		if id == NoServer {
+			continue
+		}
+
+		if err := cm.ForgetPeer(id); err != nil {
+			var notLeader *NotLeaderError
+			if errors.As(err, &notLeader) {
+				return
+			}
+			cm.raftLog("failed to remove %s: %v", id, err)
+		}
+	}
+}
+
+// deadPeer returns the peer that has been silent the longest, if it's been
+// for Config.DeadPeerTimeout, counting from since at most, when cm became the
+// leader, and how long it's been silent. It returns NoServer if there's none,
+// or if cm isn't in contact with a quorum, as the commit of the removal needs
+// one anyway and cm is likely the one cut off.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) deadPeer(since, now time.Time) (ServerID, time.Duration) {
+	if cm.lastContact.IsZero() || now.Sub(cm.lastContact) > cm.config.ElectionTimeoutMax {
+		return NoServer, 0
+	}
+	dead, longest := NoServer, time.Duration(0)
+	for _, id := range cm.sortedPeerIds() {
+		if id == cm.id {
+			continue
+		}
+		last := cm.acks[id]
+		if last.Before(since) {
+			last = since
+		}
+		if silence := now.Sub(last); silence >= cm.config.DeadPeerTimeout && silence > longest {
+			dead, longest = id, silence
+		}
+	}
+	return dead, longest
+}
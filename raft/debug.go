@@ -0,0 +1,107 @@
+package raft
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// debugLogTail is the number of log entries the debug dashboard shows by
+// default.
+const debugLogTail = 20
+
+// debugGroup is what the debug dashboard shows of a group.
+type debugGroup struct {
+	Id     int
+	Status StatusReply
+	Peers  []PeerStatus
+	Log    []LogEntryInfo
+	Err    error
+}
+
+var debugTemplate = template.Must(template.New("debug").Parse(`<!DOCTYPE html>
+<html>
+<head><title>raft {{.Id}}</title></head>
+<body>
+<h1>Server {{.Id}}</h1>
+{{range .Groups}}
+<h2>Group {{.Id}}</h2>
+{{if .Err}}<p>{{.Err}}</p>{{else}}
+<table>
+<tr><th align="left">state</th><td>{{.Status.State}}</td></tr>
+<tr><th align="left">term</th><td>{{.Status.Term}}</td></tr>
+<tr><th align="left">leader</th><td>{{.Status.Leader}}</td></tr>
+<tr><th align="left">commit index</th><td>{{.Status.CommitIndex}}</td></tr>
+<tr><th align="left">last applied</th><td>{{.Status.LastApplied}}</td></tr>
+<tr><th align="left">apply lag</th><td>{{.Status.ApplyLag}}</td></tr>
+<tr><th align="left">last log index</th><td>{{.Status.LastLogIndex}}</td></tr>
+<tr><th align="left">snapshot index</th><td>{{.Status.SnapshotIndex}}</td></tr>
+<tr><th align="left">maintenance</th><td>{{.Status.Maintenance}}</td></tr>
+</table>
+<h3>Peers</h3>
+<table>
+<tr><th align="left">id</th><th align="left">address</th><th align="left">state</th><th align="right">next index</th><th align="right">match index</th><th align="right">lag</th></tr>
+{{range .Peers}}<tr><td>{{.Id}}</td><td>{{.Addr}}</td><td>{{.State}}</td><td align="right">{{.NextIndex}}</td><td align="right">{{.MatchIndex}}</td><td align="right">{{.Lag}}</td></tr>
+{{end}}</table>
+<h3>Log</h3>
+<table>
+<tr><th align="right">index</th><th align="right">term</th><th align="left">command</th></tr>
+{{range .Log}}<tr><td align="right">{{.Index}}</td><td align="right">{{.Term}}</td><td>{{if .Config}}config {{end}}{{.Command}}</td></tr>
+{{end}}</table>
+{{end}}{{end}}
+</body>
+</html>
+`))
+
+// DebugHandler returns an HTTP handler rendering the state of the groups of
+// the server as an HTML page: their term, state, commit and apply indexes, the
+// replication progress of their peers, and the tail of their log, of the
+// length given by the tail query parameter, 20 entries by default. It exposes
+// the commands in the log, so it should only be served to operators.
+func (s *Server) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tail := debugLogTail
+		if param := r.URL.Query().Get("tail"); param != "" {
+			n, err := strconv.Atoi(param)
+			if err != nil || n < 0 {
+				http.Error(w, "invalid tail "+strconv.Quote(param), http.StatusBadRequest)
+				return
+			}
+			tail = n
+		}
+
+		s.mu.Lock()
+		ids := make([]int, 0, len(s.groups))
+		for id := range s.groups {
+			ids = append(ids, id)
+		}
+		s.mu.Unlock()
+		sort.Ints(ids)
+
+		admin := &adminService{s}
+		page := struct {
+			Id     ServerID
+			Groups []debugGroup
+		}{Id: s.serverId}
+		for _, id := range ids {
+			g := debugGroup{Id: id}
+			g.Err = admin.Status(AdminArgs{GroupId: id}, &g.Status)
+			if g.Err == nil {
+				var peers ListPeersReply
+				g.Err = admin.ListPeers(AdminArgs{GroupId: id}, &peers)
+				g.Peers = peers.Peers
+			}
+			if g.Err == nil {
+				var log LogReply
+				g.Err = admin.Log(LogArgs{GroupId: id, From: g.Status.LastLogIndex + 1 - tail, To: -1}, &log)
+				g.Log = log.Entries
+			}
+			page.Groups = append(page.Groups, g)
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := debugTemplate.Execute(w, page); err != nil {
+			s.logger.Printf("[%v] rendering the debug page failed: %v", s.serverId, err)
+		}
+	})
+}
@@ -0,0 +1,242 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"sync"
+	"time"
+)
+
+func init() {
+	// Storage backends encode commands with gob, state barriers included.
+	gob.Register(stateBarrier{})
+}
+
+// maxStateChecksums is the number of checksums taken at state barriers a CM
+// keeps.
+const maxStateChecksums = 16
+
+// ErrNoStateChecksum is returned when a server has no checksum of its state at
+// an index: the entry there isn't a state barrier, the application isn't a
+// StateChecksummer, the server restored a snapshot covering the barrier
+// rather than applying it, or its checksum was evicted by later ones.
+var ErrNoStateChecksum = errors.New("raft: no checksum of the state at that index")
+
+// stateBarrier is the command of a log entry logged by CheckState. Every
+// server checksums the state of its application right after applying it,
+// and before applying the next entry, so that the checksums of all the
+// servers are of the same state if the application is deterministic. The CM
+// doesn't pass it to the Application.
+type stateBarrier struct {
+	// Leader is the server that logged the barrier.
+	Leader ServerID
+}
+
+func encodeStateBarrier(b stateBarrier) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(b); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeStateBarrier(data []byte) (stateBarrier, error) {
+	var b stateBarrier
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&b)
+	return b, err
+}
+
+// stateChecksum is the checksum of the state of the application taken at the
+// state barrier at Index.
+type stateChecksum struct {
+	Index int
+	Sum   uint64
+}
+
+// ReplicaState is the checksum of the state of a server at the index of a
+// StateReport, or the error that kept the server from reporting it.
+type ReplicaState struct {
+	Id       ServerID
+	Checksum uint64
+	Err      string
+}
+
+// StateReport compares the states of the servers of a group at Index.
+type StateReport struct {
+	Index    int
+	Replicas []ReplicaState
+}
+
+// Diverged reports whether two of the servers that reported a checksum
+// disagree, which means that the application isn't deterministic, or that the
+// state of one of them is corrupted.
+func (r *StateReport) Diverged() bool {
+	first := -1
+	for i, replica := range r.Replicas {
+		if replica.Err != "" {
+			continue
+		}
+		if first < 0 {
+			first = i
+		} else if replica.Checksum != r.Replicas[first].Checksum {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckState compares the states of the servers of the group, to catch an
+// application that isn't deterministic. The leader logs a state barrier,
+// which every server checksums its state at as it applies it, and asks them
+// all for their checksum. The application must be a StateChecksummer.
+//
+// The servers that don't report a checksum, witnesses, the ones restoring a
+// snapshot past the barrier or the ones that don't apply it in time, are
+// listed with their error in the report; they don't count as diverging.
+// CheckState waits until ctx is done, or for Config.CommitTimeout if ctx has
+// no deadline. It returns a *NotLeaderError if cm isn't the leader.
+func (cm *ConsensusModule) CheckState(ctx context.Context) (*StateReport, error) {
+	if _, ok := cm.app.(StateChecksummer); !ok {
+		return nil, errors.New("raft: the application doesn't checksum its state")
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cm.config.CommitTimeout)
+		defer cancel()
+	}
+
+	submitted := time.Now()
+	cm.mu.Lock()
+	if cm.state != Leader || cm.transferring || cm.draining {
+		leader := cm.leaderId
+		if leader == cm.id {
+			leader = NoServer
+		}
+		cm.mu.Unlock()
+		return nil, &NotLeaderError{Leader: leader}
+	}
+	term := cm.currentTerm
+	index, resultChan, err := cm.propose(stateBarrier{Leader: cm.id})
+	peerIds := cm.sortedPeerIds()
+	witnesses := make(map[ServerID]bool)
+	for id := range cm.witnesses {
+		witnesses[id] = true
+	}
+	cm.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	cm.triggerAE()
+	if _, err := cm.awaitSubmitted(ctx, submitted, index, term, resultChan); err != nil {
+		return nil, err
+	}
+
+	deadline, _ := ctx.Deadline()
+	report := &StateReport{Index: index, Replicas: make([]ReplicaState, len(peerIds))}
+	var wg sync.WaitGroup
+	for i, id := range peerIds {
+		i, id := i, id
+		report.Replicas[i].Id = id
+		switch {
+		case witnesses[id]:
+			report.Replicas[i].Err = "witness"
+			continue
+		case id == cm.id:
+			sum, err := cm.stateChecksumAt(index)
+			report.Replicas[i].Checksum = sum
+			if err != nil {
+				report.Replicas[i].Err = err.Error()
+			}
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			args := StateChecksumArgs{GroupId: cm.groupId, Index: index, Timeout: time.Until(deadline)}
+			var reply StateChecksumReply
+			if err := cm.server.Call(ctx, id, "Admin.StateChecksum", args, &reply); err != nil {
+				report.Replicas[i].Err = err.Error()
+				return
+			}
+			report.Replicas[i].Checksum = reply.Checksum
+		}()
+	}
+	wg.Wait()
+	if report.Diverged() {
+		cm.raftLog("the states of the servers diverged at %d: %+v", index, report.Replicas)
+	}
+	return report, nil
+}
+
+// CheckState compares the states of the servers of the default group, like
+// ConsensusModule.CheckState.
+func (s *Server) CheckState(ctx context.Context) (*StateReport, error) {
+	cm, err := s.group(DefaultGroup)
+	if err != nil {
+		return nil, err
+	}
+	return cm.CheckState(ctx)
+}
+
+// StateChecksum waits for the state barrier at index to be applied, for at
+// most timeout, and returns the checksum of the state cm took then. It
+// returns ErrNoStateChecksum if there's none.
+func (cm *ConsensusModule) StateChecksum(index int, timeout time.Duration) (uint64, error) {
+	if err := cm.WaitApplied(index, timeout); err != nil {
+		return 0, err
+	}
+	return cm.stateChecksumAt(index)
+}
+
+// stateChecksumAt returns the checksum taken at the state barrier at index.
+func (cm *ConsensusModule) stateChecksumAt(index int) (uint64, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for _, c := range cm.stateChecksums {
+		if c.Index == index {
+			return c.Sum, nil
+		}
+	}
+	return 0, ErrNoStateChecksum
+}
+
+// barrierEnd returns the index the batch of entries applied from first up to
+// end must stop at: the first state barrier in between, if any, so that the
+// state is checksummed right after it's applied.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) barrierEnd(first, end int) int {
+	for i := first; i <= end; i++ {
+		if _, ok := cm.log[i-cm.snapshotIndex-1].Command.(stateBarrier); ok {
+			return i
+		}
+	}
+	return end
+}
+
+// checksumState checksums the state of the application if the last of the
+// entries just applied is a state barrier.
+func (cm *ConsensusModule) checksumState(entries []LogEntry) (uint64, bool) {
+	if len(entries) == 0 {
+		return 0, false
+	}
+	if _, ok := entries[len(entries)-1].Command.(stateBarrier); !ok {
+		return 0, false
+	}
+	c, ok := cm.app.(StateChecksummer)
+	if !ok {
+		return 0, false
+	}
+	return c.StateChecksum(), true
+}
+
+// recordStateChecksum saves the checksum taken at the state barrier at index,
+// evicting the oldest past maxStateChecksums.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) recordStateChecksum(index int, sum uint64) {
+	cm.stateChecksums = append(cm.stateChecksums, stateChecksum{Index: index, Sum: sum})
+	if len(cm.stateChecksums) > maxStateChecksums {
+		cm.stateChecksums = cm.stateChecksums[1:]
+	}
+}
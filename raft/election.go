@@ -0,0 +1,64 @@
+package raft
+
+// election tallies the votes of an election a CM stands for. A CM starts one
+// per term it campaigns in, and counts every reply to its RequestVotes in it,
+// with cm.mu locked: a vote counts once per voter, only in the term it was
+// granted in, and the CM becomes leader at most once per election.
+type election struct {
+	term int
+
+	// granted holds the servers that voted for the CM, itself included.
+	granted map[ServerID]bool
+
+	// won is set once the CM became leader through the election.
+	won bool
+}
+
+// newElection starts the election cm stands for in its current term, with its
+// own vote, and makes cm leader right away if that vote is a quorum.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) newElection() {
+	cm.election = &election{term: cm.currentTerm, granted: map[ServerID]bool{cm.id: true}}
+	cm.tallyVotes()
+}
+
+// recordVote counts the reply of peerId to the RequestVote cm sent it in term.
+// A reply of a later term makes cm a follower. The replies of an election cm
+// already won or left, as those of an earlier term arriving while cm
+// campaigns again, don't count.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) recordVote(term int, peerId ServerID, reply RequestVoteReply) {
+	if reply.Term > cm.currentTerm {
+		cm.raftLog("term out of date in RequestVoteReply")
+		cm.becomeFollower(reply.Term)
+		return
+	}
+	e := cm.election
+	if cm.state != Candidate || e == nil || e.won || e.term != term || cm.currentTerm != term {
+		cm.raftLog("RequestVoteReply of term %d is for an election already decided", term)
+		return
+	}
+	if reply.Term == term && reply.VoteGranted {
+		e.granted[peerId] = true
+		cm.tallyVotes()
+	}
+}
+
+// tallyVotes makes cm leader if the votes granted it in its election are a
+// quorum of the current members.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) tallyVotes() {
+	e := cm.election
+	votes := 0
+	for id := range e.granted {
+		if _, member := cm.peerIds[id]; member {
+			votes++
+		}
+	}
+	if votes*2 <= len(cm.peerIds) {
+		return
+	}
+	e.won = true
+	cm.raftLog("wins election with %d votes", votes)
+	cm.startLeader()
+}
@@ -0,0 +1,180 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/rpc"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// ErrInjectedFault is the error of the RPCs a FaultTransport drops.
+var ErrInjectedFault = errors.New("raft: injected fault")
+
+// Fault is what a FaultTransport does to an RPC.
+type Fault struct {
+	// Drop loses the request: the RPC fails with ErrInjectedFault without
+	// reaching the peer. DropReply loses the reply instead: the peer handles
+	// the request, but the RPC fails all the same.
+	Drop      bool
+	DropReply bool
+
+	// Delay holds the request back before sending it.
+	Delay time.Duration
+
+	// Duplicate sends the request twice; the peer handles both, and the
+	// reply of the copy is discarded.
+	Duplicate bool
+
+	// Reorder holds the request back until the next request to the same peer
+	// is sent, or for FaultTransport.ReorderWindow if there's none.
+	Reorder bool
+}
+
+// FaultPolicy decides the fault injected in an RPC sent to server to. It's
+// called concurrently.
+type FaultPolicy func(to ServerID, serviceMethod string) Fault
+
+// FaultRates are the probabilities of the faults injected by RandomFaults.
+type FaultRates struct {
+	Drop, DropReply, Duplicate, Reorder float64
+
+	// MaxDelay bounds the delay of the RPCs, drawn uniformly.
+	MaxDelay time.Duration
+}
+
+// RandomFaults returns a policy injecting faults at random at the given
+// rates, drawn from a generator seeded with seed.
+func RandomFaults(seed int64, rates FaultRates) FaultPolicy {
+	var mu sync.Mutex
+	rng := rand.New(rand.NewSource(seed))
+	return func(to ServerID, serviceMethod string) Fault {
+		mu.Lock()
+		defer mu.Unlock()
+		fault := Fault{
+			Drop:      rng.Float64() < rates.Drop,
+			DropReply: rng.Float64() < rates.DropReply,
+			Duplicate: rng.Float64() < rates.Duplicate,
+			Reorder:   rng.Float64() < rates.Reorder,
+		}
+		if rates.MaxDelay > 0 {
+			fault.Delay = time.Duration(rng.Int63n(int64(rates.MaxDelay)))
+		}
+		return fault
+	}
+}
+
+// FaultTransport is a Transport injecting faults in the RPCs the server sends
+// to its peers, according to its policy, for failure tests. It wraps another
+// Transport, which carries the RPCs it lets through. Give each server its own
+// FaultTransport with WithTransport.
+type FaultTransport struct {
+	Transport
+
+	// ReorderWindow is the longest a reordered RPC is held back, 50ms if
+	// it's zero.
+	ReorderWindow time.Duration
+
+	mu     sync.Mutex
+	policy FaultPolicy
+
+	// held are closed when the next request to a peer is sent, releasing the
+	// reordered requests waiting for it.
+	held map[ServerID]chan struct{}
+}
+
+// NewFaultTransport returns a FaultTransport wrapping transport, TCPTransport
+// if it's nil. It injects no faults until SetPolicy is called.
+func NewFaultTransport(transport Transport) *FaultTransport {
+	if transport == nil {
+		transport = TCPTransport{}
+	}
+	return &FaultTransport{Transport: transport, held: make(map[ServerID]chan struct{})}
+}
+
+// SetPolicy replaces the policy of t; nil injects no faults. It may be called
+// while the server runs, to heal a partition for instance.
+func (t *FaultTransport) SetPolicy(policy FaultPolicy) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.policy = policy
+}
+
+// call sends an RPC to server to through peer, injecting the fault the policy
+// decides.
+func (t *FaultTransport) call(ctx context.Context, peer *rpc.Client, to ServerID, serviceMethod string, args interface{}, reply interface{}) error {
+	t.mu.Lock()
+	policy := t.policy
+	t.mu.Unlock()
+	var fault Fault
+	if policy != nil {
+		fault = policy(to, serviceMethod)
+	}
+
+	if fault.Delay > 0 {
+		timer := time.NewTimer(fault.Delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+	if fault.Drop {
+		return ErrInjectedFault
+	}
+	if fault.Reorder {
+		t.hold(to)
+	}
+	// Go writes the request before returning, so the requests held back
+	// are only released once this one is on its way.
+	call := goCall(ctx, peer, serviceMethod, args, reply)
+	if !fault.Reorder {
+		t.release(to)
+	}
+	if fault.Duplicate {
+		copyReply := reflect.New(reflect.TypeOf(reply).Elem()).Interface()
+		peer.Go(serviceMethod, args, copyReply, make(chan *rpc.Call, 1))
+	}
+	if err := awaitCall(ctx, call, reply); err != nil {
+		return err
+	}
+	if fault.DropReply {
+		return ErrInjectedFault
+	}
+	return nil
+}
+
+// hold waits for the next request to server to to be sent, or for the reorder
+// window.
+func (t *FaultTransport) hold(to ServerID) {
+	t.mu.Lock()
+	ch := t.held[to]
+	if ch == nil {
+		ch = make(chan struct{})
+		t.held[to] = ch
+	}
+	window := t.ReorderWindow
+	t.mu.Unlock()
+	if window <= 0 {
+		window = 50 * time.Millisecond
+	}
+	timer := time.NewTimer(window)
+	defer timer.Stop()
+	select {
+	case <-ch:
+	case <-timer.C:
+	}
+}
+
+// release lets the requests held back for server to go.
+func (t *FaultTransport) release(to ServerID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ch := t.held[to]; ch != nil {
+		close(ch)
+		delete(t.held, to)
+	}
+}
@@ -0,0 +1,261 @@
+package raft
+
+import (
+	"context"
+	"io"
+	"log"
+	"testing"
+)
+
+// fuzzLogLimit bounds the logs the fuzz targets build.
+const fuzzLogLimit = 64
+
+// fuzzEntry is an entry of a log built by the fuzz targets. Its command tells
+// apart the entries of different logs at the same index and term.
+type fuzzEntry struct {
+	term    int
+	command int
+}
+
+// fuzzLog builds a log whose terms grow from start by the bytes of data,
+// modulo step, times scale.
+func fuzzLog(data []byte, start, step, scale int, command func(i int) int) []fuzzEntry {
+	if len(data) > fuzzLogLimit {
+		data = data[:fuzzLogLimit]
+	}
+	var entries []fuzzEntry
+	term := start
+	for i, b := range data {
+		term += int(b) % step * scale
+		entries = append(entries, fuzzEntry{term: term, command: command(i)})
+	}
+	return entries
+}
+
+// newFuzzCM returns a follower holding entries, the first commit+1 of them
+// applied, in term with votedFor. Its peers aren't connected and it never
+// stands for election; it only answers the RPCs it's called with.
+func newFuzzCM(t *testing.T, entries []fuzzEntry, commit, term int, votedFor ServerID) *ConsensusModule {
+	t.Helper()
+	s, err := NewServer(0, WithCluster(3, make(chan interface{})), WithApplication(&listApp{}), WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm := NewConsensusModule(s)
+	t.Cleanup(func() { cm.Stop(context.Background()) })
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for _, entry := range entries {
+		cm.log = append(cm.log, LogEntry{Command: entry.command, Term: entry.term, Checksum: entryChecksum(entry.term, entry.command)})
+	}
+	if err := cm.persistEntries(0, cm.log); err != nil {
+		t.Fatal(err)
+	}
+	cm.currentTerm, cm.votedFor = term, votedFor
+	if err := cm.persistHardState(); err != nil {
+		t.Fatal(err)
+	}
+	cm.commitIndex, cm.lastApplied, cm.appliedIndex = commit, commit, commit
+	return cm
+}
+
+// fuzzLogOf returns the log of cm.
+// Expects cm.mu to be locked.
+func fuzzLogOf(cm *ConsensusModule) []fuzzEntry {
+	var entries []fuzzEntry
+	for _, entry := range cm.log {
+		entries = append(entries, fuzzEntry{term: entry.Term, command: entry.Command.(int)})
+	}
+	return entries
+}
+
+// samePrefix reports whether a and b hold the same n first entries.
+func samePrefix(a, b []fuzzEntry, n int) bool {
+	if len(a) < n || len(b) < n {
+		return false
+	}
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// FuzzAppendEntries sends a follower an AE from a leader whose log is
+// consistent with the follower's, as Raft's safety properties make it: the
+// follower's log is a prefix of the leader's, holding all the entries the
+// follower committed, followed by entries of terms the leader never had
+// entries of, odd where the leader's are even. The AE carries any slice of the
+// leader's log, as a leader catching the follower up, or a stale or duplicated
+// AE, would. The follower must keep its term from decreasing, its committed
+// entries and its terms ordered, accept the entries only where its log
+// matches the leader's, and only commit entries of the leader's log.
+func FuzzAppendEntries(f *testing.F) {
+	// The leader holds back the entries the follower lacks, which it
+	// committed: the follower mustn't commit its stale entries in their
+	// place.
+	f.Add([]byte{0, 1, 0, 1}, []byte{1, 0}, uint8(2), uint8(2), uint8(1), uint8(0), uint8(4), uint8(0), uint8(0))
+	f.Add([]byte{0, 0, 0, 0, 0}, []byte{0, 0, 0}, uint8(2), uint8(2), uint8(3), uint8(1), uint8(5), uint8(0), uint8(0))
+	f.Add([]byte{}, []byte{0}, uint8(0), uint8(0), uint8(0), uint8(0), uint8(0), uint8(1), uint8(3))
+	f.Fuzz(func(t *testing.T, leaderTerms, staleTerms []byte, shared, committed, prev, count, leaderCommit, leaderBump, followerBump uint8) {
+		// The leader's terms are even, and the follower's stale ones odd.
+		leaderLog := fuzzLog(leaderTerms, 2, 2, 2, func(i int) int { return i })
+		n := int(shared) % (len(leaderLog) + 1)
+		followerLog := append([]fuzzEntry(nil), leaderLog[:n]...)
+		start := 1
+		if n > 0 {
+			start = leaderLog[n-1].term + 1
+		}
+		for _, entry := range fuzzLog(staleTerms, start, 2, 2, func(i int) int { return -n - i - 1 }) {
+			if len(followerLog) < fuzzLogLimit {
+				followerLog = append(followerLog, entry)
+			}
+		}
+		commit := int(committed)%(n+1) - 1
+
+		leaderTerm := 2 + 2*int(leaderBump%3)
+		if len(leaderLog) > 0 {
+			leaderTerm += leaderLog[len(leaderLog)-1].term
+		}
+		followerTerm := int(followerBump % 4)
+		if len(followerLog) > 0 {
+			followerTerm += followerLog[len(followerLog)-1].term
+		}
+		cm := newFuzzCM(t, followerLog, commit, followerTerm, NoServer)
+
+		args := AppendEntriesArgs{
+			Term:         leaderTerm,
+			LeaderId:     IntID(1),
+			PrevLogIndex: int(prev)%(len(leaderLog)+1) - 1,
+			PrevLogTerm:  -1,
+			LeaderCommit: int(leaderCommit)%(len(leaderLog)+1) - 1,
+		}
+		if args.PrevLogIndex >= 0 {
+			args.PrevLogTerm = leaderLog[args.PrevLogIndex].term
+		}
+		sent := leaderLog[args.PrevLogIndex+1:]
+		sent = sent[:int(count)%(len(sent)+1)]
+		for _, entry := range sent {
+			command, token, err := encodeCommand(cm.codec, entry.command)
+			if err != nil {
+				t.Fatal(err)
+			}
+			args.Entries = append(args.Entries, WireEntry{Command: command, Term: entry.term, Token: token, Checksum: wireChecksum(entry.term, command, token)})
+		}
+		lastSent := args.PrevLogIndex + len(sent)
+
+		var reply AppendEntriesReply
+		if err := cm.AppendEntries(args, &reply); err != nil {
+			t.Fatal(err)
+		}
+
+		cm.mu.Lock()
+		defer cm.mu.Unlock()
+		got := fuzzLogOf(cm)
+		wantTerm := followerTerm
+		if leaderTerm > wantTerm {
+			wantTerm = leaderTerm
+		}
+		if cm.currentTerm != wantTerm || reply.Term != wantTerm {
+			t.Fatalf("Term %d with reply %d after an AE of term %d in term %d, want %d", cm.currentTerm, reply.Term, leaderTerm, followerTerm, wantTerm)
+		}
+		if leaderTerm < followerTerm && reply.Success {
+			t.Fatalf("Accepted an AE of term %d in term %d", leaderTerm, followerTerm)
+		}
+		if !reply.Success && !samePrefix(got, followerLog, len(followerLog)) {
+			t.Fatalf("Rejected the AE but changed the log from %v to %v", followerLog, got)
+		}
+		if reply.Success && !samePrefix(got, leaderLog, lastSent+1) {
+			t.Fatalf("Accepted the AE up to index %d, but the log %v doesn't match the leader's %v", lastSent, got, leaderLog)
+		}
+		if !samePrefix(got, followerLog, commit+1) {
+			t.Fatalf("Changed committed entries: the log was %v up to commit index %d, and is %v", followerLog, commit, got)
+		}
+		for i := 1; i < len(got); i++ {
+			if got[i].term < got[i-1].term {
+				t.Fatalf("The terms of the log %v decrease at index %d", got, i)
+			}
+		}
+		if cm.commitIndex < commit || cm.commitIndex >= len(got) {
+			t.Fatalf("Commit index %d, was %d, with %d entries", cm.commitIndex, commit, len(got))
+		}
+		if !samePrefix(got, leaderLog, cm.commitIndex+1) {
+			t.Fatalf("Committed up to index %d the log %v, which differs from the leader's %v", cm.commitIndex, got, leaderLog)
+		}
+	})
+}
+
+// FuzzRequestVote asks a follower with any log, term and vote for the votes of
+// two candidates. It must keep its term from decreasing, grant at most one
+// vote per term, durably, and only to a candidate whose log is at least as
+// up-to-date as its own.
+func FuzzRequestVote(f *testing.F) {
+	f.Add([]byte{0, 1, 1}, uint8(0), false, int8(1), int8(2), int8(3), int8(1), int8(3), int8(3))
+	f.Add([]byte{}, uint8(1), true, int8(0), int8(-1), int8(-1), int8(0), int8(-1), int8(-1))
+	f.Fuzz(func(t *testing.T, terms []byte, termBump uint8, voted bool, term1, index1, lastTerm1, term2, index2, lastTerm2 int8) {
+		entries := fuzzLog(terms, 1, 3, 1, func(i int) int { return i })
+		term := int(termBump % 4)
+		lastIndex, lastTerm := len(entries)-1, -1
+		if len(entries) > 0 {
+			lastTerm = entries[lastIndex].term
+			term += lastTerm
+		}
+		votedFor := NoServer
+		if voted {
+			votedFor = IntID(0)
+		}
+		cm := newFuzzCM(t, entries, -1, term, votedFor)
+
+		// grants records the votes granted, by term.
+		grants := make(map[int]ServerID)
+		for i, a := range []RequestVoteArgs{
+			{Term: term + int(term1)%4, CandidateId: IntID(1), LastLogIndex: lastIndex + int(index1)%4, LastLogTerm: lastTerm + int(lastTerm1)%4},
+			{Term: term + int(term2)%4, CandidateId: IntID(2), LastLogIndex: lastIndex + int(index2)%4, LastLogTerm: lastTerm + int(lastTerm2)%4},
+		} {
+			cm.mu.Lock()
+			before, beforeVote := cm.currentTerm, cm.votedFor
+			cm.mu.Unlock()
+			var reply RequestVoteReply
+			if err := cm.RequestVote(a, &reply); err != nil {
+				t.Fatal(err)
+			}
+
+			cm.mu.Lock()
+			after, vote := cm.currentTerm, cm.votedFor
+			got := fuzzLogOf(cm)
+			cm.mu.Unlock()
+			wantTerm := before
+			if a.Term > wantTerm {
+				wantTerm = a.Term
+			}
+			if after != wantTerm || reply.Term != wantTerm {
+				t.Fatalf("Vote %d: term %d with reply %d after a RequestVote of term %d in term %d, want %d", i, after, reply.Term, a.Term, before, wantTerm)
+			}
+			if !samePrefix(got, entries, len(entries)) || len(got) != len(entries) {
+				t.Fatalf("Vote %d: RequestVote changed the log from %v to %v", i, entries, got)
+			}
+			if !reply.VoteGranted {
+				continue
+			}
+			if a.Term != after || vote != a.CandidateId {
+				t.Fatalf("Vote %d: granted in term %d, for %s, to %+v", i, after, vote, a)
+			}
+			if a.Term == before && beforeVote != NoServer && beforeVote != a.CandidateId {
+				t.Fatalf("Vote %d: granted to %s in term %d, which already voted for %s", i, a.CandidateId, a.Term, beforeVote)
+			}
+			if other, ok := grants[a.Term]; ok && other != a.CandidateId {
+				t.Fatalf("Vote %d: granted to both %s and %s in term %d", i, other, a.CandidateId, a.Term)
+			}
+			grants[a.Term] = a.CandidateId
+			if a.LastLogTerm < lastTerm || (a.LastLogTerm == lastTerm && a.LastLogIndex < lastIndex) {
+				t.Fatalf("Vote %d: granted to %+v, whose log is behind (%d, %d)", i, a, lastIndex, lastTerm)
+			}
+			st, ok, err := cm.storage.HardState()
+			if err != nil || !ok || st.CurrentTerm != after || ServerID(st.VotedFor) != vote {
+				t.Fatalf("Vote %d: granted in term %d to %s, but persisted %+v (%v)", i, after, vote, st, err)
+			}
+		}
+	})
+}
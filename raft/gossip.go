@@ -0,0 +1,193 @@
+package raft
+
+import (
+	"math/rand"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// WithGossip makes the server discover the addresses of its peers by gossip,
+// so that only a few seed addresses need to be configured instead of calling
+// Connect for every peer. Every Config.GossipInterval, the server exchanges
+// the members it knows of, with their addresses, with a random one of them or
+// of seeds, which are the addresses of some servers of the cluster. It
+// advertises itself at advertise, or at the address of its listener if it's
+// empty. The servers discovered are dialed like the ones passed to Connect;
+// gossip doesn't change the membership of any group.
+func WithGossip(advertise string, seeds ...string) Option {
+	return func(s *Server) {
+		s.gossip = &gossipState{advertise: advertise, seeds: seeds}
+	}
+}
+
+// GossipMember is a server known by gossip. Incarnation is set when the server
+// starts gossiping, so that the address it advertises after a restart
+// replaces the one it advertised before.
+type GossipMember struct {
+	Addr        string
+	Incarnation int64
+}
+
+// GossipArgs and GossipReply are the members known by the two servers of a
+// gossip exchange.
+type GossipArgs struct {
+	Members map[ServerID]GossipMember
+}
+
+type GossipReply struct {
+	Members map[ServerID]GossipMember
+}
+
+// gossipState is the gossip state of a server. Its mu is taken after s.mu.
+type gossipState struct {
+	advertise string
+	seeds     []string
+
+	mu      sync.Mutex
+	members map[ServerID]GossipMember
+}
+
+// gossipService serves the gossip exchanges of the peers.
+type gossipService struct {
+	s *Server
+}
+
+// Exchange merges the members known by the caller, and replies with the ones
+// known by this server.
+func (g *gossipService) Exchange(args GossipArgs, reply *GossipReply) error {
+	g.s.mergeGossip(args.Members)
+	reply.Members = g.s.gossipMembers()
+	return nil
+}
+
+// GossipMembers returns the addresses of the servers known by gossip,
+// including this one. It's empty without WithGossip.
+func (s *Server) GossipMembers() map[ServerID]string {
+	addrs := make(map[ServerID]string)
+	for id, m := range s.gossipMembers() {
+		addrs[id] = m.Addr
+	}
+	return addrs
+}
+
+// gossipMembers returns a copy of the members known by gossip.
+func (s *Server) gossipMembers() map[ServerID]GossipMember {
+	if s.gossip == nil {
+		return nil
+	}
+	s.gossip.mu.Lock()
+	defer s.gossip.mu.Unlock()
+	members := make(map[ServerID]GossipMember, len(s.gossip.members))
+	for id, m := range s.gossip.members {
+		members[id] = m
+	}
+	return members
+}
+
+// startGossip advertises the server at addr, the address of its listener
+// unless WithGossip set one.
+// Expects s.mu to be locked.
+func (s *Server) startGossip(addr string) {
+	if s.gossip.advertise != "" {
+		addr = s.gossip.advertise
+	}
+	s.gossip.mu.Lock()
+	s.gossip.members = map[ServerID]GossipMember{
+		s.serverId: {Addr: addr, Incarnation: time.Now().UnixNano()},
+	}
+	s.gossip.mu.Unlock()
+}
+
+// mergeGossip adds to the members known by gossip the ones of members that are
+// unknown or have a more recent incarnation, and makes the server dial them
+// at their new address. The server's own entry is never replaced.
+func (s *Server) mergeGossip(members map[ServerID]GossipMember) {
+	changed := make(map[ServerID]string)
+	s.gossip.mu.Lock()
+	for id, m := range members {
+		if id == s.serverId || id == NoServer || m.Addr == "" {
+			continue
+		}
+		if known, ok := s.gossip.members[id]; !ok || m.Incarnation > known.Incarnation {
+			s.gossip.members[id] = m
+			changed[id] = m.Addr
+		}
+	}
+	s.gossip.mu.Unlock()
+
+	discovered := make(map[ServerID]string)
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	for id, addr := range changed {
+		current := s.dialedAddrs[id]
+		if s.peerClients[id] == nil {
+			s.addrMu.Lock()
+			current = s.peerAddrs[id]
+			s.addrMu.Unlock()
+		}
+		if current == nil || current.String() != addr {
+			s.logger.Printf("[%v] discovered %s at %s", s.serverId, id, addr)
+			s.redial(id, peerAddr(addr))
+			discovered[id] = addr
+		}
+	}
+	s.mu.Unlock()
+	s.saveAddrs(discovered)
+}
+
+// runGossip exchanges members with a random member or seed every
+// Config.GossipInterval, until the server stops.
+func (s *Server) runGossip() {
+	ticker := time.NewTicker(s.config.GossipInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-ticker.C:
+		}
+
+		var targets []string
+		for id, m := range s.gossipMembers() {
+			if id != s.serverId {
+				targets = append(targets, m.Addr)
+			}
+		}
+		targets = append(targets, s.gossip.seeds...)
+		if len(targets) == 0 {
+			continue
+		}
+		addr := targets[rand.Intn(len(targets))]
+		if err := s.exchangeGossip(addr); err != nil {
+			s.logger.Printf("[%v] gossip with %s failed: %v", s.serverId, addr, err)
+		}
+	}
+}
+
+// exchangeGossip exchanges members with the server at addr, over a connection
+// of its own: the server's ID may be unknown, for a seed.
+func (s *Server) exchangeGossip(addr string) error {
+	conn, err := s.transport.Dial(peerAddr(addr))
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(s.config.GossipInterval))
+	if s.token != "" {
+		if err := Authenticate(conn, s.token); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+	var reply GossipReply
+	if err := client.Call("Gossip.Exchange", GossipArgs{s.gossipMembers()}, &reply); err != nil {
+		return err
+	}
+	s.mergeGossip(reply.Members)
+	return nil
+}
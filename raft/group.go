@@ -0,0 +1,162 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aecra/raft/storage"
+)
+
+// DefaultGroup is the consensus group the server creates in Serve, with the
+// application and storage given to NewServer. Submit goes to it.
+const DefaultGroup = 0
+
+// ErrUnknownGroup is returned for a group the server doesn't host.
+var ErrUnknownGroup = errors.New("raft: unknown group")
+
+// groupRouter is registered as the RPC service of the server. It dispatches
+// each call to the CM of the group named in its arguments, so that all the
+// groups share the listener and the connections to peers.
+type groupRouter struct {
+	s *Server
+}
+
+func (r *groupRouter) RequestVote(args RequestVoteArgs, reply *RequestVoteReply) error {
+	if err := r.s.checkVersion(args.ProtocolVersion); err != nil {
+		return err
+	}
+	cm, err := r.s.group(args.GroupId)
+	if err != nil {
+		return err
+	}
+	return cm.RequestVote(args, reply)
+}
+
+func (r *groupRouter) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply) error {
+	if err := r.s.checkVersion(args.ProtocolVersion); err != nil {
+		return err
+	}
+	cm, err := r.s.group(args.GroupId)
+	if err != nil {
+		return err
+	}
+	return cm.AppendEntries(args, reply)
+}
+
+func (r *groupRouter) InstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	if err := r.s.checkVersion(args.ProtocolVersion); err != nil {
+		return err
+	}
+	cm, err := r.s.group(args.GroupId)
+	if err != nil {
+		return err
+	}
+	return cm.InstallSnapshot(args, reply)
+}
+
+func (r *groupRouter) TimeoutNow(args TimeoutNowArgs, reply *TimeoutNowReply) error {
+	if err := r.s.checkVersion(args.ProtocolVersion); err != nil {
+		return err
+	}
+	cm, err := r.s.group(args.GroupId)
+	if err != nil {
+		return err
+	}
+	return cm.TimeoutNow(args, reply)
+}
+
+// group returns the CM of group groupId. A group that isn't hosted answers
+// RPCs with an error, as an unreachable peer would.
+func (s *Server) group(groupId int) (*ConsensusModule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cm, ok := s.groups[groupId]
+	if !ok {
+		return nil, fmt.Errorf("%w: group %d isn't hosted by server %s", ErrUnknownGroup, groupId, s.serverId)
+	}
+	return cm, nil
+}
+
+// Group returns the CM of group groupId, for the services that administer
+// the groups of a server from other packages.
+func (s *Server) Group(groupId int) (*ConsensusModule, error) {
+	return s.group(groupId)
+}
+
+// CreateGroup starts hosting group groupId, applying its commands to app and
+// persisting its state in store, or in memory if store is nil. The group is
+// made of the same servers as the default group, and must be created on each
+// of them. It can be called once Serve was called.
+func (s *Server) CreateGroup(groupId int, app Application, store storage.Storage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.groups[groupId]; ok {
+		return fmt.Errorf("group %d already exists", groupId)
+	}
+	if store == nil {
+		store = storage.NewMemoryStorage()
+	}
+	s.groups[groupId] = newConsensusModule(s, groupId, app, store)
+	return nil
+}
+
+// RemoveGroup stops group groupId, waiting for its goroutines to exit, and
+// stops hosting it. The group's storage isn't closed. The default group can't
+// be removed.
+func (s *Server) RemoveGroup(groupId int) error {
+	if groupId == DefaultGroup {
+		return fmt.Errorf("the default group can't be removed")
+	}
+	s.mu.Lock()
+	cm, ok := s.groups[groupId]
+	delete(s.groups, groupId)
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("group %d doesn't exist", groupId)
+	}
+	return cm.Stop(context.Background())
+}
+
+// TakeSnapshot snapshots the default group right away, like
+// ConsensusModule.TakeSnapshot.
+func (s *Server) TakeSnapshot() (index int, term int, err error) {
+	cm, err := s.group(DefaultGroup)
+	if err != nil {
+		return 0, 0, err
+	}
+	return cm.TakeSnapshot()
+}
+
+// SubmitTo submits command to group groupId, like Submit does to the default
+// group. It returns false if the group isn't hosted.
+func (s *Server) SubmitTo(groupId int, command interface{}) (interface{}, bool) {
+	return s.SubmitToContext(context.Background(), groupId, command)
+}
+
+// SubmitToContext is SubmitTo, waiting for the command like
+// ConsensusModule.SubmitContext.
+func (s *Server) SubmitToContext(ctx context.Context, groupId int, command interface{}) (interface{}, bool) {
+	cm, err := s.group(groupId)
+	if err != nil {
+		return nil, false
+	}
+	if cm.Leader() == s.serverId && !s.throttle.allow("") {
+		return nil, false
+	}
+	return cm.SubmitContext(ctx, command)
+}
+
+// SubmitToIndexed is SubmitToContext, also returning the index and term the
+// command was committed at, or the reason it failed, like
+// ConsensusModule.SubmitIndexed.
+func (s *Server) SubmitToIndexed(ctx context.Context, groupId int, command interface{}) (SubmitResult, error) {
+	cm, err := s.group(groupId)
+	if err != nil {
+		return SubmitResult{}, err
+	}
+	if cm.Leader() == s.serverId && !s.throttle.allow("") {
+		return SubmitResult{}, ErrThrottled
+	}
+	return cm.SubmitIndexed(ctx, command)
+}
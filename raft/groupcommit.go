@@ -0,0 +1,132 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrEnqueueTimeout is returned by Submit when a command is still queued to be
+// appended to the leader's log once Config.ApplyTimeout passes, or its context
+// is done. The command was withdrawn from the queue, and may be submitted
+// again.
+var ErrEnqueueTimeout = errors.New("raft: command not appended in time")
+
+// queuedCommand is a command submitted to a leader with a GroupCommitWindow,
+// waiting to be appended to its log along with the ones submitted at the same
+// time.
+type queuedCommand struct {
+	command   interface{}
+	submitted time.Time
+
+	// appended receives the outcome of the append.
+	appended chan appendOutcome
+}
+
+// appendOutcome is the outcome of appending a queued command: the index and
+// term of its entry and the channel its result is delivered on, or the error
+// that kept it out of the log.
+type appendOutcome struct {
+	index, term int
+	resultChan  chan interface{}
+	err         error
+}
+
+// enqueue queues command to be appended with the others submitted within
+// Config.GroupCommitWindow, starting the window if it's the first, and returns
+// the channel the outcome is sent on.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) enqueue(command interface{}, submitted time.Time) chan appendOutcome {
+	appended := make(chan appendOutcome, 1)
+	cm.appendQueue = append(cm.appendQueue, queuedCommand{command: command, submitted: submitted, appended: appended})
+	if len(cm.appendQueue) == 1 {
+		cm.spawn(func() {
+			timer := time.NewTimer(cm.config.GroupCommitWindow)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-cm.done:
+			}
+			cm.flushAppends()
+		})
+	}
+	return appended
+}
+
+// awaitAppend waits for the outcome of appending the command queued with
+// appended, and withdraws the command from the queue, failing it with
+// ErrEnqueueTimeout, if ctx is done or Config.ApplyTimeout passes since it was
+// submitted first.
+func (cm *ConsensusModule) awaitAppend(ctx context.Context, appended chan appendOutcome, submitted time.Time) appendOutcome {
+	var timeout <-chan time.Time
+	if cm.config.ApplyTimeout > 0 {
+		timer := time.NewTimer(time.Until(submitted.Add(cm.config.ApplyTimeout)))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case outcome := <-appended:
+		return outcome
+	case <-ctx.Done():
+	case <-timeout:
+	}
+
+	cm.mu.Lock()
+	for i, q := range cm.appendQueue {
+		if q.appended == appended {
+			cm.appendQueue = append(cm.appendQueue[:i], cm.appendQueue[i+1:]...)
+			cm.mu.Unlock()
+			cm.raftLog("withdrew a command queued for %v", time.Since(submitted))
+			return appendOutcome{err: ErrEnqueueTimeout}
+		}
+	}
+	cm.mu.Unlock()
+	// flushAppends took the command out of the queue. It sends the outcome
+	// of every command it takes once it released cm.mu, on the buffered
+	// channel and without waiting for anything else, so this doesn't block
+	// for long.
+	return <-appended
+}
+
+// flushAppends appends the queued commands to the log with a single storage
+// write, and hands each its outcome. If cm lost the leadership in the
+// meantime, the commands aren't appended.
+func (cm *ConsensusModule) flushAppends() {
+	cm.mu.Lock()
+	queue := cm.appendQueue
+	cm.appendQueue = nil
+	if len(queue) == 0 {
+		cm.mu.Unlock()
+		return
+	}
+	if cm.state != Leader || cm.transferring || cm.draining {
+		leader := cm.leaderId
+		if leader == cm.id {
+			leader = NoServer
+		}
+		cm.mu.Unlock()
+		for _, q := range queue {
+			q.appended <- appendOutcome{err: &NotLeaderError{Leader: leader}}
+		}
+		return
+	}
+	commands := make([]interface{}, len(queue))
+	for i, q := range queue {
+		commands[i] = q.command
+	}
+	term := cm.currentTerm
+	first, resultChans, err := cm.proposeAll(commands)
+	cm.mu.Unlock()
+
+	for i, q := range queue {
+		if err != nil {
+			q.appended <- appendOutcome{err: err}
+			continue
+		}
+		cm.metrics.submitToAppend.observe(time.Since(q.submitted))
+		q.appended <- appendOutcome{index: first + i, term: term, resultChan: resultChans[i]}
+	}
+	if err == nil {
+		cm.triggerAE()
+	}
+}
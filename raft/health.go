@@ -0,0 +1,93 @@
+package raft
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Health describes the health of a server in a group, for load balancers and
+// orchestrators.
+type Health struct {
+	// Alive is set unless the CM stopped, after a checksum error for
+	// instance.
+	Alive bool
+
+	// Leader is the leader known by the server, NoServer if there's none.
+	Leader ServerID
+
+	// LastContact is when a follower last heard from Leader, or a leader was
+	// last acknowledged by a majority, and the zero time if it never was.
+	LastContact time.Time
+
+	// Lag is the number of entries committed by the leader, as far as the
+	// server knows, that the server didn't apply yet.
+	Lag int
+
+	// QuorumContact is set if the server heard from a quorum within the
+	// maximum election timeout: a follower from its leader, or a leader from
+	// a majority of the group.
+	QuorumContact bool
+
+	// Ready is set if the server is alive, knows of a leader, is in contact
+	// with a quorum and lags by no more than the entries allowed.
+	Ready bool
+}
+
+// HealthArgs selects the group whose health an admin RPC reports, and the
+// number of entries the server may lag behind while ready.
+type HealthArgs struct {
+	GroupId int
+	MaxLag  int
+}
+
+// Health reports the health of cm, which is ready if it lags behind the
+// leader by at most maxLag entries.
+func (cm *ConsensusModule) Health(maxLag int) Health {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	h := Health{Alive: cm.state != Dead, Leader: cm.leaderId, LastContact: cm.lastContact}
+	if cm.state == Leader {
+		h.Leader = cm.id
+	}
+	h.Lag = intMax(cm.leaderCommit, cm.commitIndex) - cm.appliedIndex
+	h.QuorumContact = !cm.lastContact.IsZero() && time.Since(cm.lastContact) <= cm.config.ElectionTimeoutMax
+	h.Ready = h.Alive && h.Leader != NoServer && h.QuorumContact && h.Lag <= maxLag
+	return h
+}
+
+// Health reports the health of the default group, like
+// ConsensusModule.Health.
+func (s *Server) Health(maxLag int) (Health, error) {
+	cm, err := s.group(DefaultGroup)
+	if err != nil {
+		return Health{}, err
+	}
+	return cm.Health(maxLag), nil
+}
+
+// HealthHandler returns an HTTP handler serving the health of the default
+// group: /healthz answers 200 while the server is alive, and /readyz while
+// it's ready with maxLag, and 503 otherwise. Both write the Health as JSON.
+// It's meant to be mounted on the server's own HTTP server, as the liveness
+// and readiness probes of an orchestrator.
+func (s *Server) HealthHandler(maxLag int) http.Handler {
+	mux := http.NewServeMux()
+	probe := func(ok func(Health) bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			h, err := s.Health(maxLag)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if !ok(h) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			json.NewEncoder(w).Encode(h)
+		}
+	}
+	mux.Handle("/healthz", probe(func(h Health) bool { return h.Alive }))
+	mux.Handle("/readyz", probe(func(h Health) bool { return h.Ready }))
+	return mux
+}
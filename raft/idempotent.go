@@ -0,0 +1,160 @@
+package raft
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"sync"
+)
+
+func init() {
+	// Storage backends encode commands with gob, idempotent ones included.
+	gob.Register(idempotentCommand{})
+}
+
+// idempotentCommand is the command of a log entry submitted with
+// SubmitIdempotent. The CM applies Command unless a command with the same
+// Token was applied before, in which case the entry's result is that
+// command's. AppendEntries carries Token apart from Command, which is encoded
+// by the Codec.
+type idempotentCommand struct {
+	Token   string
+	Command interface{}
+}
+
+// tokenRecord is the result of the command applied with a token, as saved in
+// snapshots. ApplyError holds the message of an *ApplyError result, which
+// gob couldn't encode.
+type tokenRecord struct {
+	Token      string
+	Result     interface{}
+	ApplyError string
+}
+
+// tokenCache holds the results of the last commands applied with a token. It's
+// part of the replicated state: every server records the same tokens in the
+// same order, and evicts the oldest ones past Config.IdempotencyCacheSize, so
+// it must be the same on all of them.
+type tokenCache struct {
+	mu   sync.Mutex
+	size int
+
+	results map[string]interface{}
+
+	// order holds the tokens of results, oldest first.
+	order []string
+}
+
+func newTokenCache(size int) *tokenCache {
+	return &tokenCache{size: size, results: make(map[string]interface{})}
+}
+
+// lookup returns the result of the command applied with token, if any.
+func (c *tokenCache) lookup(token string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result, ok := c.results[token]
+	return result, ok
+}
+
+// record saves the result of the command applied with token, evicting the
+// oldest result if the cache is full.
+func (c *tokenCache) record(token string, result interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.results[token] = result
+	c.order = append(c.order, token)
+	for len(c.order) > c.size {
+		delete(c.results, c.order[0])
+		c.order = c.order[1:]
+	}
+}
+
+// records returns the cached results, oldest first, to save in a snapshot.
+func (c *tokenCache) records() []tokenRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	records := make([]tokenRecord, len(c.order))
+	for i, token := range c.order {
+		records[i] = tokenRecord{Token: token}
+		if applyErr, ok := c.results[token].(*ApplyError); ok {
+			records[i].ApplyError = applyErr.Err.Error()
+		} else {
+			records[i].Result = c.results[token]
+		}
+	}
+	return records
+}
+
+// restore replaces the cached results with the ones saved in a snapshot.
+func (c *tokenCache) restore(records []tokenRecord) {
+	c.mu.Lock()
+	c.results = make(map[string]interface{})
+	c.order = nil
+	c.mu.Unlock()
+	for _, r := range records {
+		if r.ApplyError != "" {
+			c.record(r.Token, &ApplyError{Err: errors.New(r.ApplyError)})
+		} else {
+			c.record(r.Token, r.Result)
+		}
+	}
+}
+
+// SubmitIdempotent is Submit for a command identified by token: the result of
+// applying it is recorded with token in the replicated state, and a command
+// submitted again with the same token is committed but not applied again: it
+// gets that result. A client whose submission timed out can thus retry it
+// without applying it twice, as long as fewer than Config.IdempotencyCacheSize
+// commands were submitted with other tokens in between. An empty token
+// submits command like Submit. The results of the commands are saved in
+// snapshots with gob, so their types must be registered with gob.Register.
+func (cm *ConsensusModule) SubmitIdempotent(token string, command interface{}) (interface{}, bool) {
+	return cm.SubmitIdempotentContext(context.Background(), token, command)
+}
+
+// SubmitIdempotentContext is SubmitIdempotent, waiting for the command to be
+// applied until ctx is done rather than for Config.CommitTimeout if ctx has a
+// deadline.
+func (cm *ConsensusModule) SubmitIdempotentContext(ctx context.Context, token string, command interface{}) (interface{}, bool) {
+	if token == "" {
+		return cm.SubmitContext(ctx, command)
+	}
+	return cm.SubmitContext(ctx, idempotentCommand{Token: token, Command: command})
+}
+
+// SubmitIdempotent submits command with token to the default group, like
+// ConsensusModule.SubmitIdempotent.
+func (s *Server) SubmitIdempotent(token string, command interface{}) (interface{}, bool) {
+	return s.SubmitToIdempotent(context.Background(), DefaultGroup, token, command)
+}
+
+// SubmitToIdempotent submits command with token to group groupId, like
+// ConsensusModule.SubmitIdempotentContext.
+func (s *Server) SubmitToIdempotent(ctx context.Context, groupId int, token string, command interface{}) (interface{}, bool) {
+	cm, err := s.group(groupId)
+	if err != nil {
+		return nil, false
+	}
+	return cm.SubmitIdempotentContext(ctx, token, command)
+}
+
+// encodeCommand encodes command for AppendEntries and backups with codec,
+// returning the token of an idempotent command apart.
+func encodeCommand(codec Codec, command interface{}) (data []byte, token string, err error) {
+	if ic, ok := command.(idempotentCommand); ok {
+		data, err = codec.Encode(ic.Command)
+		return data, ic.Token, err
+	}
+	data, err = codec.Encode(command)
+	return data, "", err
+}
+
+// decodeCommand decodes a command encoded by encodeCommand.
+func decodeCommand(codec Codec, data []byte, token string) (interface{}, error) {
+	command, err := codec.Decode(data)
+	if err != nil || token == "" {
+		return command, err
+	}
+	return idempotentCommand{Token: token, Command: command}, nil
+}
@@ -0,0 +1,60 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+)
+
+// maxCommandSummary is the length commands are cut to in the LogEntryInfos
+// returned by ReadEntries.
+const maxCommandSummary = 256
+
+// ReadEntries describes the entries in [from, to) of the log of cm, to inspect
+// a stuck cluster for instance: their index and term, whether they're known
+// to be committed, and a summary of their command, formatted with %+v and cut
+// to a few hundred bytes. to is the end of the log if it's negative. The
+// entries covered by the last snapshot are gone, and left out.
+func (cm *ConsensusModule) ReadEntries(from, to int) ([]LogEntryInfo, error) {
+	if from < 0 {
+		return nil, errors.New("raft: negative log index")
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	lastLogIndex, _ := cm.lastLogIndexAndTerm()
+	from = intMax(from, cm.snapshotIndex+1)
+	if to < 0 || to > lastLogIndex+1 {
+		to = lastLogIndex + 1
+	}
+	var entries []LogEntryInfo
+	for i := from; i < to; i++ {
+		entry := cm.log[i-cm.snapshotIndex-1]
+		_, isConfig := entry.Command.(configChange)
+		entries = append(entries, LogEntryInfo{
+			Index:     i,
+			Term:      entry.Term,
+			Command:   summarizeCommand(entry.Command),
+			Config:    isConfig,
+			Committed: i <= cm.commitIndex,
+		})
+	}
+	return entries, nil
+}
+
+// ReadEntries describes the entries of the default group in [from, to), like
+// ConsensusModule.ReadEntries.
+func (s *Server) ReadEntries(from, to int) ([]LogEntryInfo, error) {
+	cm, err := s.group(DefaultGroup)
+	if err != nil {
+		return nil, err
+	}
+	return cm.ReadEntries(from, to)
+}
+
+// summarizeCommand formats command with %+v, cut to maxCommandSummary bytes.
+func summarizeCommand(command interface{}) string {
+	summary := fmt.Sprintf("%+v", command)
+	if len(summary) > maxCommandSummary {
+		summary = fmt.Sprintf("%s... (%d bytes)", summary[:maxCommandSummary], len(summary))
+	}
+	return summary
+}
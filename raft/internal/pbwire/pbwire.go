@@ -0,0 +1,179 @@
+// Package pbwire encodes and decodes the fields of protobuf messages, for the
+// packages that encode raft's messages by hand rather than with generated
+// code.
+package pbwire
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Encoder appends the fields of a message to B. Fields with the zero value
+// are left out.
+type Encoder struct {
+	B []byte
+}
+
+func (e *Encoder) Uint(num protowire.Number, v int) {
+	if v != 0 {
+		e.B = protowire.AppendTag(e.B, num, protowire.VarintType)
+		e.B = protowire.AppendVarint(e.B, uint64(uint32(v)))
+	}
+}
+
+func (e *Encoder) Int(num protowire.Number, v int) {
+	if v != 0 {
+		e.B = protowire.AppendTag(e.B, num, protowire.VarintType)
+		e.B = protowire.AppendVarint(e.B, uint64(int64(v)))
+	}
+}
+
+func (e *Encoder) Sint(num protowire.Number, v int) {
+	if v != 0 {
+		e.B = protowire.AppendTag(e.B, num, protowire.VarintType)
+		e.B = protowire.AppendVarint(e.B, protowire.EncodeZigZag(int64(v)))
+	}
+}
+
+func (e *Encoder) Bool(num protowire.Number, v bool) {
+	if v {
+		e.B = protowire.AppendTag(e.B, num, protowire.VarintType)
+		e.B = protowire.AppendVarint(e.B, 1)
+	}
+}
+
+func (e *Encoder) Fixed32(num protowire.Number, v uint32) {
+	if v != 0 {
+		e.B = protowire.AppendTag(e.B, num, protowire.Fixed32Type)
+		e.B = protowire.AppendFixed32(e.B, v)
+	}
+}
+
+func (e *Encoder) String(num protowire.Number, v string) {
+	if v != "" {
+		e.B = protowire.AppendTag(e.B, num, protowire.BytesType)
+		e.B = protowire.AppendString(e.B, v)
+	}
+}
+
+func (e *Encoder) Bytes(num protowire.Number, v []byte) {
+	if len(v) > 0 {
+		e.B = protowire.AppendTag(e.B, num, protowire.BytesType)
+		e.B = protowire.AppendBytes(e.B, v)
+	}
+}
+
+// Message appends an embedded message, even an empty one, as the elements
+// of repeated fields can't be left out.
+func (e *Encoder) Message(num protowire.Number, v []byte) {
+	e.B = protowire.AppendTag(e.B, num, protowire.BytesType)
+	e.B = protowire.AppendBytes(e.B, v)
+}
+
+// Field is a field of a message being decoded: its varint or fixed32 value,
+// or its bytes. Its methods decode the value into a Go variable, or fail if
+// the field doesn't have the matching wire type.
+type Field struct {
+	Num   protowire.Number
+	typ   protowire.Type
+	value uint64
+	data  []byte
+}
+
+// Decode calls f with each field of the message data. Unknown fields are up
+// to f to skip.
+func Decode(data []byte, f func(Field) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return fmt.Errorf("pbwire: %v", protowire.ParseError(n))
+		}
+		data = data[n:]
+		fd := Field{Num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			fd.value, n = protowire.ConsumeVarint(data)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(data)
+			fd.value = uint64(v)
+		case protowire.BytesType:
+			fd.data, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return fmt.Errorf("pbwire: field %d: %v", num, protowire.ParseError(n))
+		}
+		data = data[n:]
+		if err := f(fd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check returns an error if the field doesn't have the wire type typ.
+func (f Field) check(typ protowire.Type) error {
+	if f.typ != typ {
+		return fmt.Errorf("pbwire: field %d has wire type %d, want %d", f.Num, f.typ, typ)
+	}
+	return nil
+}
+
+func (f Field) Uint(v *int) error {
+	if err := f.check(protowire.VarintType); err != nil {
+		return err
+	}
+	*v = int(uint32(f.value))
+	return nil
+}
+
+func (f Field) Int(v *int) error {
+	if err := f.check(protowire.VarintType); err != nil {
+		return err
+	}
+	*v = int(int64(f.value))
+	return nil
+}
+
+func (f Field) Sint(v *int) error {
+	if err := f.check(protowire.VarintType); err != nil {
+		return err
+	}
+	*v = int(protowire.DecodeZigZag(f.value))
+	return nil
+}
+
+func (f Field) Bool(v *bool) error {
+	if err := f.check(protowire.VarintType); err != nil {
+		return err
+	}
+	*v = f.value != 0
+	return nil
+}
+
+func (f Field) Fixed32(v *uint32) error {
+	if err := f.check(protowire.Fixed32Type); err != nil {
+		return err
+	}
+	*v = uint32(f.value)
+	return nil
+}
+
+func (f Field) Bytes(v *[]byte) error {
+	if err := f.check(protowire.BytesType); err != nil {
+		return err
+	}
+	*v = append([]byte(nil), f.data...)
+	return nil
+}
+
+func (f Field) String(v *string) error {
+	if err := f.check(protowire.BytesType); err != nil {
+		return err
+	}
+	*v = string(f.data)
+	return nil
+}
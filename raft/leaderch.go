@@ -0,0 +1,42 @@
+package raft
+
+import "errors"
+
+// ErrElectionOnly is returned by the Submit functions of a server created with
+// WithElectionOnly, which only elects leaders.
+var ErrElectionOnly = errors.New("raft: the server only elects leaders")
+
+// LeaderCh returns a channel receiving true when cm becomes the leader, and
+// false when it stops being the leader, for applications to start and stop
+// leader-only work. The channel only holds the latest change: a change that
+// isn't received before the next one is replaced by it, so the last value
+// received always tells whether cm is the leader. It's the same channel for
+// the lifetime of cm.
+func (cm *ConsensusModule) LeaderCh() <-chan bool {
+	return cm.leaderCh
+}
+
+// LeaderCh returns the channel of the leadership changes of the default group,
+// like ConsensusModule.LeaderCh. It may be called before Serve.
+func (s *Server) LeaderCh() <-chan bool {
+	return s.leaderCh
+}
+
+// notifyLeader sends leader on the LeaderCh of cm, replacing the change it
+// holds if it wasn't received.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) notifyLeader(leader bool) {
+	select {
+	case cm.leaderCh <- leader:
+		return
+	default:
+	}
+	select {
+	case <-cm.leaderCh:
+	default:
+	}
+	select {
+	case cm.leaderCh <- leader:
+	default:
+	}
+}
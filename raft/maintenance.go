@@ -0,0 +1,99 @@
+package raft
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// EnterMaintenance puts the server in maintenance mode: in all its groups, it
+// keeps voting and replicating entries, but doesn't stand for election, so
+// that it can be patched or restarted without the groups electing it. If
+// transferLeadership is set, the groups it leads then hand their leadership
+// over to a follower. The server stays in maintenance mode if that fails.
+func (s *Server) EnterMaintenance(transferLeadership bool) error {
+	s.mu.Lock()
+	s.maintenance = true
+	groups := make([]*ConsensusModule, 0, len(s.groups))
+	for _, cm := range s.groups {
+		groups = append(groups, cm)
+	}
+	s.mu.Unlock()
+	for _, cm := range groups {
+		cm.setMaintenance(true)
+	}
+	if !transferLeadership {
+		return nil
+	}
+	for _, cm := range groups {
+		if err := cm.transferLeadershipAway(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExitMaintenance takes the server out of maintenance mode.
+func (s *Server) ExitMaintenance() {
+	s.mu.Lock()
+	s.maintenance = false
+	groups := make([]*ConsensusModule, 0, len(s.groups))
+	for _, cm := range s.groups {
+		groups = append(groups, cm)
+	}
+	s.mu.Unlock()
+	for _, cm := range groups {
+		cm.setMaintenance(false)
+	}
+}
+
+// InMaintenance reports whether the server is in maintenance mode.
+func (s *Server) InMaintenance() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maintenance
+}
+
+// setMaintenance sets whether cm is in maintenance mode.
+func (cm *ConsensusModule) setMaintenance(on bool) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.maintenance = on
+	// A server leaving maintenance waits for a full election timeout, to
+	// hear from the leader before campaigning.
+	cm.electionResetEvent = time.Now()
+}
+
+// transferLeadershipAway hands the leadership of cm over to a follower,
+// trying the most up-to-date ones first. It's a no-op if cm isn't the leader.
+func (cm *ConsensusModule) transferLeadershipAway() error {
+	cm.mu.Lock()
+	if cm.state != Leader {
+		cm.mu.Unlock()
+		return nil
+	}
+	var candidates []ServerID
+	for id := range cm.peerIds {
+		if id != cm.id && !cm.witnesses[id] {
+			candidates = append(candidates, id)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return cm.matchIndex[candidates[i]] > cm.matchIndex[candidates[j]]
+	})
+	cm.mu.Unlock()
+
+	err := errors.New("raft: no follower to transfer the leadership to")
+	for _, id := range candidates {
+		if err = cm.TransferLeadership(id); err == nil {
+			return nil
+		}
+		var notLeader *NotLeaderError
+		if errors.As(err, &notLeader) {
+			// The leadership moved on meanwhile.
+			return nil
+		}
+		cm.raftLog("failed to transfer the leadership to %s: %v", id, err)
+	}
+	return err
+}
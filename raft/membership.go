@@ -0,0 +1,462 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+func init() {
+	// Storage backends encode commands with gob, configuration changes
+	// included.
+	gob.Register(configChange{})
+}
+
+// configChange is the command of a log entry adding or removing a server.
+// The CM applies it itself rather than passing it to the Application, and it
+// takes effect as soon as it's appended to the log, as described in section
+// 4.1 of the Raft dissertation. Only one server is added or removed at a time.
+type configChange struct {
+	Add    bool
+	Server ServerID
+
+	// Addr is the address of an added server, which the other servers dial
+	// to reach it.
+	Addr string
+
+	// Id is the ID of the server in the changes logged when server IDs were
+	// ints. upgrade moves it to Server.
+	Id int
+}
+
+// legacyConfigChange has the fields configChange had when server IDs were
+// ints, which the checksums of the changes logged then cover.
+type legacyConfigChange struct {
+	Add  bool
+	Id   int
+	Addr string
+}
+
+// upgrade returns cc with its server in Server, moved from Id if cc was logged
+// when server IDs were ints.
+func (cc configChange) upgrade() configChange {
+	if cc.Server == NoServer {
+		cc.Server, cc.Id = IntID(cc.Id), 0
+	}
+	return cc
+}
+
+// upgradeEntry upgrades entry, at index, if it's a configuration change
+// logged when server IDs were ints: its checksum is verified as it was
+// computed then, and computed again for the upgraded change.
+func upgradeEntry(index int, entry LogEntry) (LogEntry, error) {
+	cc, ok := entry.Command.(configChange)
+	if !ok || cc.Server != NoServer {
+		return entry, nil
+	}
+	if entry.Checksum != 0 {
+		if entryChecksum(entry.Term, legacyConfigChange{Add: cc.Add, Id: cc.Id, Addr: cc.Addr}) != entry.Checksum {
+			return entry, &ChecksumError{Index: index}
+		}
+		entry.Checksum = entryChecksum(entry.Term, cc.upgrade())
+	}
+	entry.Command = cc.upgrade()
+	return entry, nil
+}
+
+// ErrConfigChangePending is returned when a membership change is requested
+// while the previous one isn't committed yet.
+var ErrConfigChangePending = errors.New("raft: a membership change is already in progress")
+
+// ErrTransferTimeout is returned by TransferLeadership when the target doesn't
+// catch up with the log of the leader within an election timeout.
+var ErrTransferTimeout = errors.New("raft: the leadership transfer timed out")
+
+// encodeConfigChange encodes cc for AppendEntries. Configuration changes are
+// always gob-encoded, whatever the Codec of the server.
+func encodeConfigChange(cc configChange) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeConfigChange(data []byte) (configChange, error) {
+	var cc configChange
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&cc)
+	return cc.upgrade(), err
+}
+
+// snapshotMagic starts the snapshots taken by the CM. It's followed by the
+// length of the gob-encoded snapshotHeader, the header itself and the data
+// written by the Application. Snapshots without it are read as the data of
+// the Application alone, taken with the initial membership.
+var snapshotMagic = []byte("RAFTSNP1")
+
+// snapshotFormatVersion is the version of the snapshot format written by this
+// server, recorded in snapshotHeader.Version. It's increased when the format
+// changes in a way the servers running the previous versions can't read; they
+// refuse such snapshots rather than restoring them wrong.
+const snapshotFormatVersion = 1
+
+// snapshotHeader holds the state of the CM that a snapshot must restore
+// along with the Application's.
+type snapshotHeader struct {
+	// Version is the snapshotFormatVersion of the server that wrote the
+	// snapshot. The snapshots written before versioning have 0, and are read
+	// as version 1.
+	Version int
+
+	// Index and Term are those of the last entry the snapshot covers. They're
+	// 0 in the snapshots written before versioning.
+	Index, Term int
+
+	// SchemaVersion is the version of the Application's data, if the
+	// Application is a VersionedSnapshotter.
+	SchemaVersion int
+
+	// Members is the membership at the snapshot's index, the addresses of
+	// the servers added at runtime included.
+	Members map[ServerID]string
+
+	// Peers is the membership in the snapshots taken when server IDs were
+	// ints. readSnapshotHeader moves it to Members.
+	Peers map[int]string
+
+	// Tokens are the results of the last commands submitted with
+	// SubmitIdempotent, oldest first.
+	Tokens []tokenRecord
+
+	// Chunks are the parts applied so far of a command submitted with
+	// SubmitChunked whose last part follows the snapshot.
+	Chunks [][]byte
+
+	// StateChecksum is the checksum of the Application's state, if it's a
+	// StateChecksummer.
+	StateChecksum *uint64
+}
+
+// writeSnapshotHeader writes the start of a snapshot, up to the
+// Application's data, to w.
+func writeSnapshotHeader(w io.Writer, header snapshotHeader) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(header); err != nil {
+		return err
+	}
+	var size [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(size[:], uint64(buf.Len()))
+	for _, b := range [][]byte{snapshotMagic, size[:n], buf.Bytes()} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSnapshotHeader splits data into its header and the Application's data.
+// ok is false if data has no header. It fails if the header has a format
+// version newer than this server's.
+func readSnapshotHeader(data []byte) (header snapshotHeader, appData []byte, ok bool, err error) {
+	if !bytes.HasPrefix(data, snapshotMagic) {
+		return snapshotHeader{}, data, false, nil
+	}
+	rest := data[len(snapshotMagic):]
+	size, n := binary.Uvarint(rest)
+	if n <= 0 || uint64(len(rest)-n) < size {
+		return snapshotHeader{}, nil, false, fmt.Errorf("bad snapshot header")
+	}
+	rest = rest[n:]
+	if err := gob.NewDecoder(bytes.NewReader(rest[:size])).Decode(&header); err != nil {
+		return snapshotHeader{}, nil, false, err
+	}
+	if header.Version > snapshotFormatVersion {
+		return snapshotHeader{}, nil, false, fmt.Errorf("raft: snapshot format version %d is newer than this server's, %d", header.Version, snapshotFormatVersion)
+	}
+	if header.Members == nil && header.Peers != nil {
+		header.Members = make(map[ServerID]string, len(header.Peers))
+		for id, addr := range header.Peers {
+			header.Members[IntID(id)] = addr
+		}
+		header.Peers = nil
+	}
+	return header, rest[size:], true, nil
+}
+
+// check verifies that the header belongs to the snapshot of the entry at
+// index in term, as storage.Snapshot records it.
+func (header snapshotHeader) check(index, term int) error {
+	if header.Version > 0 && (header.Index != index || header.Term != term) {
+		return fmt.Errorf("raft: snapshot header is for index %d term %d, not index %d term %d", header.Index, header.Term, index, term)
+	}
+	return nil
+}
+
+// restoreSnapshot replaces the state of s with appData, the Application's
+// data of a snapshot with header, and checks the checksum of the restored
+// state if the header has one.
+func restoreSnapshot(s Snapshotter, header snapshotHeader, appData []byte) error {
+	var err error
+	if v, ok := s.(VersionedSnapshotter); !ok {
+		err = s.RestoreFrom(bytes.NewReader(appData))
+	} else if header.SchemaVersion > v.SchemaVersion() {
+		return fmt.Errorf("raft: snapshot schema version %d is newer than the application's, %d", header.SchemaVersion, v.SchemaVersion())
+	} else {
+		err = v.RestoreFromVersion(bytes.NewReader(appData), header.SchemaVersion)
+	}
+	if err != nil {
+		return err
+	}
+	if c, ok := s.(StateChecksummer); ok && header.StateChecksum != nil {
+		if sum := c.StateChecksum(); sum != *header.StateChecksum {
+			return fmt.Errorf("%w: snapshot %d has %x, the state %x", ErrStateChecksumMismatch, header.Index, *header.StateChecksum, sum)
+		}
+	}
+	return nil
+}
+
+// initialPeers returns the membership the group starts with, set by
+// WithMembers or WithCluster.
+func (cm *ConsensusModule) initialPeers() map[ServerID]string {
+	peers := make(map[ServerID]string)
+	for _, id := range cm.server.members {
+		peers[id] = ""
+	}
+	return peers
+}
+
+// membershipAt returns the membership in effect at index, which is either in
+// the log or covered by the snapshot.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) membershipAt(index int) map[ServerID]string {
+	peers := make(map[ServerID]string, len(cm.basePeers))
+	for id, addr := range cm.basePeers {
+		peers[id] = addr
+	}
+	for i := cm.snapshotIndex + 1; i <= index; i++ {
+		if cc, ok := cm.log[i-cm.snapshotIndex-1].Command.(configChange); ok {
+			if cc.Add {
+				peers[cc.Server] = cc.Addr
+			} else {
+				delete(peers, cc.Server)
+			}
+		}
+	}
+	return peers
+}
+
+// updateMembership sets peerIds to the membership of the last configuration
+// change in the log, or to basePeers if there's none. It's called whenever
+// configuration changes are appended to or removed from the log.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) updateMembership() {
+	lastLogIndex, _ := cm.lastLogIndexAndTerm()
+	peers := cm.membershipAt(lastLogIndex)
+	cm.peerIds = make(map[ServerID]ServerID, len(peers))
+	for id, addr := range peers {
+		cm.peerIds[id] = id
+		if addr != "" && id != cm.id {
+			cm.server.learnPeerAddr(id, addr)
+		}
+		if _, ok := cm.nextIndex[id]; !ok && cm.state == Leader {
+			// A new peer most likely has an empty log; it's sent the whole
+			// log, or the snapshot.
+			cm.nextIndex[id] = 0
+			cm.matchIndex[id] = -1
+			cm.probing[id] = true
+		}
+	}
+	cm.raftLog("membership is now %v", cm.peerIds)
+}
+
+// hasConfigChange reports whether entries hold a configuration change.
+func hasConfigChange(entries []LogEntry) bool {
+	for _, entry := range entries {
+		if _, ok := entry.Command.(configChange); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// AddServer adds server id, listening at addr, to the group. It must be
+// called on the leader, and returns once the change is committed. The new
+// server must be created with the same WithMembers as the others; it stays
+// passive until the leader replicates the change to it.
+func (cm *ConsensusModule) AddServer(id ServerID, addr string) error {
+	return cm.changeMembership(configChange{Add: true, Server: id, Addr: addr})
+}
+
+// RemoveServer removes server id from the group. It must be called on the
+// leader, and the leader can't remove itself: its leadership has to be
+// transferred first.
+func (cm *ConsensusModule) RemoveServer(id ServerID) error {
+	return cm.changeMembership(configChange{Add: false, Server: id})
+}
+
+func (cm *ConsensusModule) changeMembership(cc configChange) error {
+	cm.mu.Lock()
+	if cm.state != Leader {
+		leader := cm.leaderId
+		cm.mu.Unlock()
+		return &NotLeaderError{Leader: leader}
+	}
+	_, member := cm.peerIds[cc.Server]
+	var err error
+	switch {
+	case cc.Server == NoServer:
+		err = errors.New("raft: the server ID is empty")
+	case cc.Add && member:
+		err = fmt.Errorf("raft: server %s is already a member", cc.Server)
+	case !cc.Add && !member:
+		err = fmt.Errorf("raft: server %s isn't a member", cc.Server)
+	case !cc.Add && cc.Server == cm.id:
+		err = errors.New("raft: the leader can't remove itself; transfer its leadership first")
+	case hasConfigChange(cm.log[cm.commitIndex-cm.snapshotIndex:]):
+		// Changing one server at a time keeps the majorities of the old and
+		// new memberships overlapping, as long as changes don't overlap.
+		err = ErrConfigChangePending
+	}
+	if err != nil {
+		cm.mu.Unlock()
+		return err
+	}
+	index, resultChan, err := cm.propose(cc)
+	if err != nil {
+		cm.mu.Unlock()
+		return err
+	}
+	cm.updateMembership()
+	cm.mu.Unlock()
+
+	cm.triggerAE()
+	if _, ok := cm.awaitResult(context.Background(), index, resultChan, time.Time{}); !ok {
+		return ErrUnknownResult
+	}
+	return nil
+}
+
+// TimeoutNowArgs asks a follower to start an election right away, to take
+// over the leadership. See section 3.10 of the Raft dissertation.
+type TimeoutNowArgs struct {
+	ProtocolVersion int
+	GroupId         int
+	Term            int
+	LeaderId        ServerID
+}
+
+type TimeoutNowReply struct {
+	Term int
+
+	// Declined is set if the follower can't stand for election, being a
+	// witness or in maintenance mode.
+	Declined bool
+}
+
+// TimeoutNow RPC.
+func (cm *ConsensusModule) TimeoutNow(args TimeoutNowArgs, reply *TimeoutNowReply) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.state == Dead {
+		return nil
+	}
+	cm.raftLog("TimeoutNow: %+v", args)
+	reply.Term = cm.currentTerm
+	if args.Term != cm.currentTerm || cm.state != Follower {
+		return nil
+	}
+	if !cm.canCampaign() {
+		reply.Declined = true
+		return nil
+	}
+	cm.startElection()
+	return nil
+}
+
+// TransferLeadership hands the leadership over to server id. It must be
+// called on the leader, which stops accepting commands, waits for id to have
+// its whole log and tells it to start an election. It returns once the
+// election is started; id wins it unless a server with a more up-to-date log
+// competes with it.
+func (cm *ConsensusModule) TransferLeadership(id ServerID) error {
+	cm.mu.Lock()
+	if cm.state != Leader {
+		leader := cm.leaderId
+		cm.mu.Unlock()
+		return &NotLeaderError{Leader: leader}
+	}
+	if _, member := cm.peerIds[id]; !member || id == cm.id || cm.witnesses[id] {
+		cm.mu.Unlock()
+		return fmt.Errorf("raft: can't transfer the leadership to server %s", id)
+	}
+	if cm.transferring {
+		cm.mu.Unlock()
+		return errors.New("raft: a leadership transfer is already in progress")
+	}
+	cm.transferring = true
+	term := cm.currentTerm
+	cm.mu.Unlock()
+	defer func() {
+		cm.mu.Lock()
+		cm.transferring = false
+		cm.mu.Unlock()
+	}()
+
+	// Give up after an election timeout, as the dissertation suggests, so
+	// that the group doesn't stay unavailable.
+	cm.mu.Lock()
+	deadline := time.Now().Add(cm.config.ElectionTimeoutMax)
+	cm.mu.Unlock()
+	for {
+		cm.mu.Lock()
+		if cm.state != Leader || cm.currentTerm != term {
+			cm.mu.Unlock()
+			return errors.New("raft: lost the leadership during the transfer")
+		}
+		lastLogIndex, _ := cm.lastLogIndexAndTerm()
+		caughtUp := cm.matchIndex[id] == lastLogIndex
+		cm.mu.Unlock()
+		if caughtUp {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: server %s didn't catch up", ErrTransferTimeout, id)
+		}
+		cm.triggerAE()
+		time.Sleep(cm.heartbeatInterval() / 5)
+	}
+
+	// The target's election deposes this leader, so the TimeoutNow isn't
+	// sent in its role: its reply would be cancelled.
+	args := TimeoutNowArgs{GroupId: cm.groupId, Term: term, LeaderId: cm.id}
+	var reply TimeoutNowReply
+	if err := cm.server.Call(context.Background(), id, "ConsensusModule.TimeoutNow", args, &reply); err != nil {
+		return err
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if reply.Term > cm.currentTerm {
+		cm.becomeFollower(reply.Term)
+	}
+	if reply.Declined {
+		return fmt.Errorf("raft: server %s declined the leadership", id)
+	}
+	return nil
+}
+
+// sortedPeerIds returns the IDs of the members, in increasing order.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) sortedPeerIds() []ServerID {
+	ids := make([]ServerID, 0, len(cm.peerIds))
+	for id := range cm.peerIds {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
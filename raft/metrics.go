@@ -0,0 +1,474 @@
+package raft
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// latencyBounds are the upper bounds of the buckets of the latency
+// histograms: 50µs, doubling up to about 26s.
+var latencyBounds = func() []time.Duration {
+	bounds := make([]time.Duration, 20)
+	for i := range bounds {
+		bounds[i] = 50 * time.Microsecond << i
+	}
+	return bounds
+}()
+
+// Histogram is a snapshot of the distribution of a latency.
+type Histogram struct {
+	// Bounds are the upper bounds of the buckets. Counts[i] is the number of
+	// observations in bucket i, above Bounds[i-1] and up to Bounds[i]; the
+	// last count is of the observations above the last bound.
+	Bounds []time.Duration
+	Counts []uint64
+
+	// Count is the number of observations, and Sum their total.
+	Count uint64
+	Sum   time.Duration
+}
+
+// Quantile returns an upper bound of the q-quantile of the observations: the
+// bound of the bucket it falls in, or the last bound if it's above it. It
+// returns 0 if there's no observation.
+func (h Histogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(h.Count))
+	if rank >= h.Count {
+		rank = h.Count - 1
+	}
+	var seen uint64
+	for i, n := range h.Counts {
+		seen += n
+		if seen > rank && i < len(h.Bounds) {
+			return h.Bounds[i]
+		}
+	}
+	return h.Bounds[len(h.Bounds)-1]
+}
+
+// Mean returns the mean of the observations, or 0 if there's none.
+func (h Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// histogram records the observations of a Histogram.
+type histogram struct {
+	mu sync.Mutex
+	h  Histogram
+}
+
+func newHistogram(bounds []time.Duration) *histogram {
+	return &histogram{h: Histogram{Bounds: bounds, Counts: make([]uint64, len(bounds)+1)}}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.Search(len(h.h.Bounds), func(i int) bool { return d <= h.h.Bounds[i] })
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.h.Counts[i]++
+	h.h.Count++
+	h.h.Sum += d
+}
+
+// snapshot returns a copy of the histogram.
+func (h *histogram) snapshot() Histogram {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.h
+	s.Counts = append([]uint64(nil), h.h.Counts...)
+	return s
+}
+
+// Metrics are the latencies of a group on a server. The stages of a command
+// are measured on the leader it's submitted to, so that the stage adding the
+// tail latency can be told apart.
+type Metrics struct {
+	// SubmitToAppend is the time from a command's submission to its entry
+	// being persisted in the leader's log.
+	SubmitToAppend Histogram
+
+	// AppendToCommit is the time from a command's entry being persisted to
+	// its being committed, that is replicated to a quorum.
+	AppendToCommit Histogram
+
+	// CommitToApply is the time from a command being committed to the
+	// application having applied it.
+	CommitToApply Histogram
+
+	// ElectionsStarted is the number of elections cm stood in, of which it
+	// won ElectionsWon and lost ElectionsLost, either to another candidate
+	// or to a split vote; one may still be in progress. A steady rise of
+	// ElectionsStarted across the servers is an election storm.
+	ElectionsStarted uint64
+	ElectionsWon     uint64
+	ElectionsLost    uint64
+
+	// ElectionDuration is the time from the election timeout to cm becoming
+	// the leader, over the elections it lost to split votes in between.
+	ElectionDuration Histogram
+
+	// VotesGranted is the number of votes cm granted to candidates, itself
+	// excluded.
+	VotesGranted uint64
+
+	// LeaderChanges is the number of times cm learned of a leader other than
+	// the last one it knew.
+	LeaderChanges uint64
+
+	// RecentElections are the last recentElections leaders cm learned of,
+	// oldest first.
+	RecentElections []Election
+
+	// StorageAppend is the time the storage takes to persist appended
+	// entries, and StorageSync the time it takes to persist the term and
+	// vote, both of which include the fsync of a durable storage.
+	StorageAppend Histogram
+	StorageSync   Histogram
+
+	// Peers are the metrics of the links to the other members, sorted by
+	// ID, as measured while cm led the group.
+	Peers []PeerMetrics
+}
+
+// recentElections is the number of elections Metrics.RecentElections keeps.
+const recentElections = 10
+
+// Election is a leader a CM learned of: the term it leads, and when.
+type Election struct {
+	Term   int
+	Leader ServerID
+	Time   time.Time
+}
+
+// PeerMetrics are the metrics of the link from a leader to a follower.
+type PeerMetrics struct {
+	Id ServerID
+
+	// RTT is the round-trip time of the AEs the follower answered.
+	RTT Histogram
+
+	// Calls is the number of AEs sent to the follower, of which Failures
+	// got no reply, for the follower was down or unreachable.
+	Calls    uint64
+	Failures uint64
+}
+
+// FailureRate returns the share of the calls to the follower that failed, or
+// 0 if there was none.
+func (m PeerMetrics) FailureRate() float64 {
+	if m.Calls == 0 {
+		return 0
+	}
+	return float64(m.Failures) / float64(m.Calls)
+}
+
+// groupMetrics records the Metrics of a CM. Its histograms have their own
+// locks; its other fields are guarded by cm.mu.
+type groupMetrics struct {
+	submitToAppend   *histogram
+	appendToCommit   *histogram
+	commitToApply    *histogram
+	electionDuration *histogram
+	storageAppend    *histogram
+	storageSync      *histogram
+
+	electionsStarted, electionsWon, electionsLost uint64
+	votesGranted, leaderChanges                   uint64
+
+	// campaignStart is when the election timeout that made cm a candidate
+	// fired, or zero if it isn't one.
+	campaignStart time.Time
+
+	// lastLeader is the last leader cm knew.
+	lastLeader ServerID
+
+	// elections are the last recentElections leaders cm learned of.
+	elections []Election
+
+	// peers are the metrics of the links to the peers cm sent AEs to.
+	peers map[ServerID]*peerMetrics
+}
+
+// peerMetrics records the PeerMetrics of a link.
+type peerMetrics struct {
+	rtt             *histogram
+	calls, failures uint64
+}
+
+func newGroupMetrics() *groupMetrics {
+	return &groupMetrics{
+		submitToAppend:   newHistogram(latencyBounds),
+		appendToCommit:   newHistogram(latencyBounds),
+		commitToApply:    newHistogram(latencyBounds),
+		electionDuration: newHistogram(latencyBounds),
+		storageAppend:    newHistogram(latencyBounds),
+		storageSync:      newHistogram(latencyBounds),
+		peers:            make(map[ServerID]*peerMetrics),
+	}
+}
+
+// Metrics returns the latencies and the election counts measured in cm.
+func (cm *ConsensusModule) Metrics() Metrics {
+	cm.mu.Lock()
+	m := Metrics{
+		ElectionsStarted: cm.metrics.electionsStarted,
+		ElectionsWon:     cm.metrics.electionsWon,
+		ElectionsLost:    cm.metrics.electionsLost,
+		VotesGranted:     cm.metrics.votesGranted,
+		LeaderChanges:    cm.metrics.leaderChanges,
+		RecentElections:  append([]Election(nil), cm.metrics.elections...),
+	}
+	for _, id := range cm.sortedPeerIds() {
+		if p, ok := cm.metrics.peers[id]; ok && id != cm.id {
+			m.Peers = append(m.Peers, PeerMetrics{Id: id, RTT: p.rtt.snapshot(), Calls: p.calls, Failures: p.failures})
+		}
+	}
+	cm.mu.Unlock()
+	m.SubmitToAppend = cm.metrics.submitToAppend.snapshot()
+	m.AppendToCommit = cm.metrics.appendToCommit.snapshot()
+	m.CommitToApply = cm.metrics.commitToApply.snapshot()
+	m.ElectionDuration = cm.metrics.electionDuration.snapshot()
+	m.StorageAppend = cm.metrics.storageAppend.snapshot()
+	m.StorageSync = cm.metrics.storageSync.snapshot()
+	return m
+}
+
+// Metrics returns the metrics of the default group, like
+// ConsensusModule.Metrics.
+func (s *Server) Metrics() (Metrics, error) {
+	cm, err := s.group(DefaultGroup)
+	if err != nil {
+		return Metrics{}, err
+	}
+	return cm.Metrics(), nil
+}
+
+// markCommitted records the commit time of the proposals up to index, after
+// the leader advanced its commit index from the one before from.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) markCommitted(from, index int) {
+	now := time.Now()
+	for i := from; i <= index; i++ {
+		if p, ok := cm.proposals[i]; ok && p.committed.IsZero() {
+			p.committed = now
+			cm.proposals[i] = p
+		}
+	}
+}
+
+// observeApplied records the latencies of proposal p, whose command was just
+// applied.
+func (cm *ConsensusModule) observeApplied(p proposal) {
+	if p.committed.IsZero() {
+		// The leader that appended it lost the leadership before the commit.
+		return
+	}
+	cm.metrics.appendToCommit.observe(p.committed.Sub(p.appended))
+	cm.metrics.commitToApply.observe(time.Since(p.committed))
+}
+
+// observeCampaign records that cm starts an election, which loses the
+// previous one if cm was already a candidate.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) observeCampaign() {
+	m := cm.metrics
+	if cm.state == Candidate {
+		m.electionsLost++
+	} else {
+		m.campaignStart = time.Now()
+	}
+	m.electionsStarted++
+}
+
+// observeElected records that cm won the election it stood in.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) observeElected() {
+	m := cm.metrics
+	m.electionsWon++
+	m.electionDuration.observe(time.Since(m.campaignStart))
+	m.campaignStart = time.Time{}
+	cm.observeLeader()
+}
+
+// observeDefeat records that cm, a candidate, lost its election to another.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) observeDefeat() {
+	cm.metrics.electionsLost++
+	cm.metrics.campaignStart = time.Time{}
+}
+
+// observeLeader counts a leader change if cm.leaderId isn't the last leader
+// cm knew, and records the election of the current term if it's the first
+// leader of the term cm learns of.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) observeLeader() {
+	m := cm.metrics
+	if cm.leaderId == NoServer {
+		return
+	}
+	if cm.leaderId != m.lastLeader {
+		m.lastLeader = cm.leaderId
+		m.leaderChanges++
+	}
+	if n := len(m.elections); n > 0 && m.elections[n-1].Term == cm.currentTerm {
+		return
+	}
+	m.elections = append(m.elections, Election{Term: cm.currentTerm, Leader: cm.leaderId, Time: time.Now()})
+	if len(m.elections) > recentElections {
+		m.elections = m.elections[len(m.elections)-recentElections:]
+	}
+}
+
+// observeAE records an AE sent to peerId, answered after rtt if ok.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) observeAE(peerId ServerID, rtt time.Duration, ok bool) {
+	p := cm.metrics.peers[peerId]
+	if p == nil {
+		p = &peerMetrics{rtt: newHistogram(latencyBounds)}
+		cm.metrics.peers[peerId] = p
+	}
+	p.calls++
+	if ok {
+		p.rtt.observe(rtt)
+	} else {
+		p.failures++
+	}
+}
+
+// The storage operations reported by SlowStorageEvent.
+const (
+	StorageAppendOp = "append"
+	StorageSyncOp   = "hard state"
+)
+
+// SlowStorageEvent reports that the storage took Duration, more than
+// Config.SlowStorageThreshold, to carry out Op, StorageAppendOp or
+// StorageSyncOp.
+type SlowStorageEvent struct {
+	GroupId  int
+	Op       string
+	Duration time.Duration
+}
+
+func (e *SlowStorageEvent) Group() int { return e.GroupId }
+
+// observeStorage records that the storage took d to carry out op, measured by
+// h, and reports it if it's slow.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) observeStorage(op string, h *histogram, d time.Duration) {
+	h.observe(d)
+	if threshold := cm.config.SlowStorageThreshold; threshold > 0 && d > threshold {
+		cm.raftLog("slow storage: %s took %v", op, d)
+		cm.observe(&SlowStorageEvent{GroupId: cm.groupId, Op: op, Duration: d})
+	}
+}
+
+// metricFamilies are the histograms of Metrics as exported by MetricsHandler.
+var metricFamilies = []struct {
+	name, help string
+	get        func(Metrics) Histogram
+}{
+	{"raft_submit_to_append_seconds", "Time from a command's submission to its entry being persisted by the leader.", func(m Metrics) Histogram { return m.SubmitToAppend }},
+	{"raft_append_to_commit_seconds", "Time from a command's entry being persisted by the leader to its commit.", func(m Metrics) Histogram { return m.AppendToCommit }},
+	{"raft_commit_to_apply_seconds", "Time from a command's commit to its application.", func(m Metrics) Histogram { return m.CommitToApply }},
+	{"raft_storage_append_seconds", "Time the storage takes to persist appended entries.", func(m Metrics) Histogram { return m.StorageAppend }},
+	{"raft_storage_sync_seconds", "Time the storage takes to persist the term and vote.", func(m Metrics) Histogram { return m.StorageSync }},
+	{"raft_election_duration_seconds", "Time from the election timeout to the server becoming the leader.", func(m Metrics) Histogram { return m.ElectionDuration }},
+}
+
+// counterFamilies are the counters of Metrics as exported by MetricsHandler.
+var counterFamilies = []struct {
+	name, help string
+	get        func(Metrics) uint64
+}{
+	{"raft_elections_started_total", "Elections the server stood in.", func(m Metrics) uint64 { return m.ElectionsStarted }},
+	{"raft_elections_won_total", "Elections the server won.", func(m Metrics) uint64 { return m.ElectionsWon }},
+	{"raft_elections_lost_total", "Elections the server lost, to another candidate or a split vote.", func(m Metrics) uint64 { return m.ElectionsLost }},
+	{"raft_votes_granted_total", "Votes the server granted to other candidates.", func(m Metrics) uint64 { return m.VotesGranted }},
+	{"raft_leader_changes_total", "Times the server learned of a new leader.", func(m Metrics) uint64 { return m.LeaderChanges }},
+}
+
+// peerCounterFamilies are the counters of PeerMetrics as exported by
+// MetricsHandler.
+var peerCounterFamilies = []struct {
+	name, help string
+	get        func(PeerMetrics) uint64
+}{
+	{"raft_peer_calls_total", "AEs the leader sent to the peer.", func(m PeerMetrics) uint64 { return m.Calls }},
+	{"raft_peer_call_failures_total", "AEs to the peer that got no reply.", func(m PeerMetrics) uint64 { return m.Failures }},
+}
+
+// writeHistogram writes h in the Prometheus text format as the histogram name
+// with labels.
+func writeHistogram(w io.Writer, name, labels string, h Histogram) {
+	var cumulative uint64
+	for j, bound := range h.Bounds {
+		cumulative += h.Counts[j]
+		fmt.Fprintf(w, "%s_bucket{%s,le=%q} %d\n", name, labels, strconv.FormatFloat(bound.Seconds(), 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.Count)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.Sum.Seconds())
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.Count)
+}
+
+// MetricsHandler returns an HTTP handler serving the Metrics of all the
+// groups of the server in the Prometheus text format, labeled by group, for
+// a Prometheus server to scrape.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		ids := make([]int, 0, len(s.groups))
+		for id := range s.groups {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		groups := make([]*ConsensusModule, len(ids))
+		for i, id := range ids {
+			groups[i] = s.groups[id]
+		}
+		s.mu.Unlock()
+		metrics := make([]Metrics, len(groups))
+		for i, cm := range groups {
+			metrics[i] = cm.Metrics()
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, f := range metricFamilies {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", f.name, f.help, f.name)
+			for i, m := range metrics {
+				writeHistogram(w, f.name, fmt.Sprintf("group=%q", strconv.Itoa(ids[i])), f.get(m))
+			}
+		}
+		fmt.Fprintf(w, "# HELP raft_peer_rtt_seconds Round-trip time of the AEs the peer answered.\n# TYPE raft_peer_rtt_seconds histogram\n")
+		for i, m := range metrics {
+			for _, p := range m.Peers {
+				writeHistogram(w, "raft_peer_rtt_seconds", fmt.Sprintf("group=%q,peer=%q", strconv.Itoa(ids[i]), p.Id), p.RTT)
+			}
+		}
+		for _, f := range counterFamilies {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", f.name, f.help, f.name)
+			for i, m := range metrics {
+				fmt.Fprintf(w, "%s{group=%q} %d\n", f.name, strconv.Itoa(ids[i]), f.get(m))
+			}
+		}
+		for _, f := range peerCounterFamilies {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", f.name, f.help, f.name)
+			for i, m := range metrics {
+				for _, p := range m.Peers {
+					fmt.Fprintf(w, "%s{group=%q,peer=%q} %d\n", f.name, strconv.Itoa(ids[i]), p.Id, f.get(p))
+				}
+			}
+		}
+	})
+}
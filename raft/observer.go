@@ -0,0 +1,51 @@
+package raft
+
+// Event is something noteworthy that happened in a group of a server, passed
+// to the Observer set by WithObserver. It's one of the *Event types of this
+// package, such as *ApplyPanicEvent.
+type Event interface {
+	// Group returns the ID of the group the event happened in.
+	Group() int
+}
+
+// Observer is called with the events of the groups of a server, in order, by a
+// goroutine of the server. It may call the methods of the server, but the
+// events that happen while it runs are dropped once eventBuffer are pending.
+type Observer func(Event)
+
+// eventBuffer is the number of events waiting for the Observer beyond which
+// new ones are dropped, so that a slow Observer doesn't hold the groups up.
+const eventBuffer = 256
+
+// WithObserver sets the Observer the events of the server are passed to.
+func WithObserver(observer Observer) Option {
+	return func(s *Server) {
+		s.observer = observer
+	}
+}
+
+// observe passes e to the Observer of the server, if it has one. It doesn't
+// block, so it can be called with cm.mu locked.
+func (cm *ConsensusModule) observe(e Event) {
+	if cm.server.observer == nil {
+		return
+	}
+	select {
+	case cm.server.events <- e:
+	default:
+		cm.raftLog("dropped event %T: the observer is behind", e)
+	}
+}
+
+// dispatchEvents passes the events of the server to its Observer until the
+// server stops.
+func (s *Server) dispatchEvents() {
+	for {
+		select {
+		case e := <-s.events:
+			s.observer(e)
+		case <-s.quit:
+			return
+		}
+	}
+}
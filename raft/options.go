@@ -0,0 +1,133 @@
+package raft
+
+import (
+	"log"
+
+	"github.com/aecra/raft/storage"
+)
+
+// Option configures a Server created by NewServer.
+type Option func(*Server)
+
+// WithMembers sets the IDs of the servers the cluster starts with, and the
+// channel whose closing tells the server that its peers are connected and
+// that it can start elections.
+func WithMembers(ids []ServerID, ready chan interface{}) Option {
+	return func(s *Server) {
+		s.members = ids
+		s.ready = ready
+	}
+}
+
+// WithCluster is WithMembers for a cluster of num servers with IDs IntID(0)
+// to IntID(num-1).
+func WithCluster(num int, ready chan interface{}) Option {
+	ids := make([]ServerID, num)
+	for i := range ids {
+		ids[i] = IntID(i)
+	}
+	return WithMembers(ids, ready)
+}
+
+// WithApplication sets the state machine committed commands are applied to.
+func WithApplication(app Application) Option {
+	return func(s *Server) {
+		s.app = app
+	}
+}
+
+// WithStorage sets the storage persisting the Raft state of the server. By
+// default, the state is kept in memory and lost on restart. The caller closes
+// the storage once the server stopped.
+func WithStorage(store storage.Storage) Option {
+	return func(s *Server) {
+		s.storage = store
+	}
+}
+
+// WithDataDir persists the Raft state of the server in a write-ahead log in
+// dir, the default persistent backend, which NewServer opens and Stop closes.
+// WithStorage takes precedence over it.
+func WithDataDir(dir string) Option {
+	return func(s *Server) {
+		s.dataDir = dir
+	}
+}
+
+// WithTransport sets the Transport used to communicate with peers,
+// TCPTransport by default.
+func WithTransport(transport Transport) Option {
+	return func(s *Server) {
+		s.transport = transport
+	}
+}
+
+// WithApplyHook sets a function called with each command the server passes to
+// the application of a group, once applied, by the goroutine applying the
+// commands of the group. Test harnesses record the commands applied by each
+// server with it.
+func WithApplyHook(hook func(groupId int, entry CommitEntry)) Option {
+	return func(s *Server) {
+		s.applyHook = hook
+	}
+}
+
+// WithListenAddr makes the server listen on addr, a host:port to bind such as
+// "0.0.0.0:7000" or ":7000", rather than on any free port. It's a shorthand
+// for WithTransport(TCPTransport{Addr: addr}), which it replaces.
+func WithListenAddr(addr string) Option {
+	return WithTransport(TCPTransport{Addr: addr})
+}
+
+// WithAdvertiseAddr sets the address peers and clients reach the server at,
+// when it differs from the one it listens on, behind a NAT or in a container
+// for instance. GetListenAddr returns it, and the server announces it to the
+// peers it gossips with.
+func WithAdvertiseAddr(addr string) Option {
+	return func(s *Server) {
+		s.advertiseAddr = addr
+	}
+}
+
+// WithLogger sets the logger of the server, the standard logger by default.
+func WithLogger(logger *log.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+// WithConfig sets the timing and snapshot parameters. Its zero fields take
+// their default values.
+func WithConfig(config Config) Option {
+	return func(s *Server) {
+		s.config = config
+	}
+}
+
+// WithWitness makes the server a witness in all its groups: it votes and
+// acknowledges entries, but doesn't store or apply commands, and never becomes
+// leader. The application set by WithApplication or CreateGroup is unused.
+func WithWitness() Option {
+	return func(s *Server) {
+		s.witness = true
+	}
+}
+
+// WithElectionOnly makes the server only elect leaders, for an application
+// that just needs to know which of its instances is active: it watches
+// LeaderCh, and calls VerifyLeader before acting as the leader. The server has
+// no application, refuses commands with ErrElectionOnly, and its log only
+// holds membership changes.
+func WithElectionOnly() Option {
+	return func(s *Server) {
+		s.electionOnly = true
+	}
+}
+
+// WithCodec sets the Codec encoding the commands sent to peers, GobCodec by
+// default. All the servers of a cluster must use the same one.
+func WithCodec(codec Codec) Option {
+	return func(s *Server) {
+		s.codec = codec
+	}
+}
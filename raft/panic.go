@@ -0,0 +1,100 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// ErrApplyFailed is returned by the requests needing the application of a
+// server that panicked applying a command under PanicStepDown, such as
+// TakeSnapshot.
+var ErrApplyFailed = errors.New("raft: the application panicked")
+
+// PanicPolicy is what a server does when its application panics applying a
+// command, as set by Config.ApplyPanicPolicy. In both cases, the panic is
+// recovered and reported as an *ApplyPanicEvent, and the command and the ones
+// after it aren't applied: the state of the application is unknown.
+type PanicPolicy int
+
+const (
+	// PanicHalt stops the group on the server, like a checksum error.
+	PanicHalt PanicPolicy = iota
+
+	// PanicStepDown keeps the group running without applying commands: the
+	// server steps down if it leads, and never stands for election again, but
+	// it keeps replicating entries and voting, so that the group keeps its
+	// quorum until the server is repaired.
+	PanicStepDown
+)
+
+func (p PanicPolicy) String() string {
+	switch p {
+	case PanicHalt:
+		return "halt"
+	case PanicStepDown:
+		return "step-down"
+	default:
+		return fmt.Sprintf("PanicPolicy(%d)", int(p))
+	}
+}
+
+// ApplyPanicEvent reports that the application panicked applying the entry at
+// Index, with Value, and that the server applied the policy Policy.
+type ApplyPanicEvent struct {
+	GroupId int
+	Index   int
+	Value   interface{}
+	Stack   string
+	Policy  PanicPolicy
+}
+
+func (e *ApplyPanicEvent) Group() int { return e.GroupId }
+
+// applyPanic is a panic recovered while applying the entry at index.
+type applyPanic struct {
+	index int
+	value interface{}
+	stack string
+}
+
+// recoverApply recovers a panic of the application applying the entry at
+// *index into *p. It must be deferred.
+func recoverApply(index *int, p **applyPanic) {
+	if v := recover(); v != nil {
+		*p = &applyPanic{index: *index, value: v, stack: string(debug.Stack())}
+	}
+}
+
+// handleApplyPanic reports p and applies Config.ApplyPanicPolicy.
+func (cm *ConsensusModule) handleApplyPanic(p *applyPanic) {
+	policy := cm.config.ApplyPanicPolicy
+	cm.server.logger.Printf("[%s] the application panicked applying entry %d: %v\n%s", cm.id, p.index, p.value, p.stack)
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.observe(&ApplyPanicEvent{GroupId: cm.groupId, Index: p.index, Value: p.value, Stack: p.stack, Policy: policy})
+	if policy == PanicHalt {
+		cm.stop()
+		return
+	}
+	cm.applyFailed = true
+	cm.lastApplied = cm.appliedIndex
+	for index, p := range cm.proposals {
+		close(p.resultChan)
+		delete(cm.proposals, index)
+	}
+	for _, request := range cm.snapshotRequests {
+		request <- snapshotResult{cm.snapshotIndex, cm.snapshotTerm, ErrApplyFailed}
+	}
+	cm.snapshotRequests = nil
+	if cm.state == Leader {
+		cm.raftLog("steps down after the application panicked")
+		cm.newRole()
+		cm.state = Follower
+		cm.leaderId = NoServer
+		cm.notifyLeader(false)
+		cm.failReads()
+		cm.electionResetEvent = time.Now()
+	}
+}
@@ -0,0 +1,179 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// PeerRPC carries the RequestVote, AppendEntries and InstallSnapshot RPCs the
+// groups exchange in a wire format of its own, rather than gob over net/rpc.
+// raftpb.GRPC sends the messages of raft.proto over gRPC. All the servers of a
+// cluster must use the same one.
+//
+// Its connections are opened by the Transport of the server, authenticated
+// with the cluster token, and accepted on the same listener as the net/rpc
+// ones, which still carry the other RPCs and negotiate the protocol version.
+// They must open with the HTTP/2 client preface, as gRPC's do, for the server
+// to tell them apart. The faults of a FaultTransport aren't injected in them.
+type PeerRPC interface {
+	// Serve answers the RPCs received on the connections l accepts with h,
+	// until l is closed.
+	Serve(l net.Listener, h PeerHandler) error
+
+	// NewClient returns a client calling the RPCs of a peer over the
+	// connections opened by dial.
+	NewClient(dial func(ctx context.Context) (net.Conn, error)) (PeerClient, error)
+}
+
+// PeerHandler answers the RPCs served by a PeerRPC.
+type PeerHandler interface {
+	RequestVote(args RequestVoteArgs, reply *RequestVoteReply) error
+	AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply) error
+	InstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) error
+}
+
+// PeerClient calls the RPCs of a peer. It's safe for concurrent use.
+type PeerClient interface {
+	// Call calls serviceMethod, "ConsensusModule.RequestVote",
+	// "ConsensusModule.AppendEntries" or "ConsensusModule.InstallSnapshot",
+	// with args, and decodes its reply into reply. It returns ctx.Err() if ctx
+	// is done first, and then leaves reply alone.
+	Call(ctx context.Context, serviceMethod string, args, reply interface{}) error
+
+	Close() error
+}
+
+// WithPeerRPC makes the server exchange the RequestVote, AppendEntries and
+// InstallSnapshot RPCs with its peers through rpc.
+func WithPeerRPC(rpc PeerRPC) Option {
+	return func(s *Server) {
+		s.peerRPC = rpc
+	}
+}
+
+// peerRPCMethods are the RPCs a PeerRPC carries.
+var peerRPCMethods = map[string]bool{
+	"ConsensusModule.RequestVote":     true,
+	"ConsensusModule.AppendEntries":   true,
+	"ConsensusModule.InstallSnapshot": true,
+}
+
+// http2Preface opens the connections of HTTP/2 clients, and so of gRPC.
+var http2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+// dialPeer opens a connection to the peer at addr, and authenticates it. The
+// Transport dials without a context, so the deadline of ctx only bounds the
+// authentication.
+func (s *Server) dialPeer(ctx context.Context, addr net.Addr) (net.Conn, error) {
+	conn, err := s.transport.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	if s.token != "" {
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+			defer conn.SetDeadline(time.Time{})
+		}
+		if err := Authenticate(conn, s.token); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// routeConn hands conn, just accepted and authenticated, over to the PeerRPC
+// if it opens with the HTTP/2 preface, and then waits for the PeerRPC to close
+// it or for the server to stop. Otherwise it returns conn for net/rpc to serve,
+// with the bytes it read put back.
+func (s *Server) routeConn(conn net.Conn) (net.Conn, bool) {
+	r := bufio.NewReaderSize(conn, len(http2Preface))
+	peeked := &peekedConn{Conn: conn, r: r, closed: make(chan struct{})}
+	if b, err := r.Peek(1); err != nil || b[0] != http2Preface[0] {
+		return peeked, false
+	}
+	// A gob stream opening with the same byte carries a message longer than
+	// the preface, so peeking it doesn't block.
+	if b, err := r.Peek(len(http2Preface)); err != nil || !bytes.Equal(b, http2Preface) {
+		return peeked, false
+	}
+	select {
+	case s.peerListener.conns <- peeked:
+	case <-s.quit:
+		conn.Close()
+		return nil, true
+	}
+	select {
+	case <-peeked.closed:
+	case <-s.quit:
+	}
+	return nil, true
+}
+
+// peekedConn is a connection whose first bytes were read into r, which also
+// tells when it's closed.
+type peekedConn struct {
+	net.Conn
+	r      *bufio.Reader
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *peekedConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// connListener is the listener of the connections routeConn hands over to the
+// PeerRPC.
+type connListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	once  sync.Once
+	done  chan struct{}
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{addr: addr, conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+// closePeer closes the clients of peer id, which the next RPC to it redials.
+// Expects s.mu to be locked.
+func (s *Server) closePeer(id ServerID) error {
+	var err error
+	if client := s.peerClients[id]; client != nil {
+		err = client.Close()
+		s.peerClients[id] = nil
+	}
+	if client := s.rpcClients[id]; client != nil {
+		client.Close()
+		delete(s.rpcClients, id)
+	}
+	return err
+}
@@ -0,0 +1,156 @@
+package raft
+
+import (
+	"fmt"
+	"time"
+)
+
+// ReplicationState is how a leader replicates its log to a follower.
+type ReplicationState int
+
+const (
+	// Probing means the leader is looking for the last entry the follower
+	// shares with it, after it became leader or the follower rejected an AE.
+	Probing ReplicationState = iota
+
+	// Replicating means the follower accepts the entries it's sent.
+	Replicating
+
+	// Snapshotting means the follower is sent the snapshot, because the
+	// entries it needs were compacted.
+	Snapshotting
+)
+
+func (s ReplicationState) String() string {
+	switch s {
+	case Probing:
+		return "probing"
+	case Replicating:
+		return "replicating"
+	case Snapshotting:
+		return "snapshotting"
+	default:
+		return fmt.Sprintf("ReplicationState(%d)", int(s))
+	}
+}
+
+// PeerProgress is the replication progress of a follower, as known by the
+// leader.
+type PeerProgress struct {
+	Id         ServerID
+	State      ReplicationState
+	NextIndex  int
+	MatchIndex int
+
+	// Lag is the number of entries of the leader's log the follower doesn't
+	// have, and LagBytes their encoded size, as far as the log still holds
+	// them.
+	Lag      int
+	LagBytes int
+
+	// LastContact is when the leader sent the last AE the follower
+	// acknowledged, or the zero time.
+	LastContact time.Time
+
+	// Zone is the zone the follower reported, set by WithZone.
+	Zone string
+}
+
+// PeerLagEvent reports that the follower Peer lags Lag entries behind the
+// leader, more than Config.LagAlertThreshold, or, if Recovered is set, that it
+// caught up within it again.
+type PeerLagEvent struct {
+	GroupId   int
+	Peer      ServerID
+	Lag       int
+	Recovered bool
+}
+
+func (e *PeerLagEvent) Group() int { return e.GroupId }
+
+// ReplicationProgress returns the progress of the followers of cm, sorted by
+// ID, or nil if cm isn't the leader.
+func (cm *ConsensusModule) ReplicationProgress() []PeerProgress {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.state != Leader {
+		return nil
+	}
+	lastLogIndex, _ := cm.lastLogIndexAndTerm()
+	var progress []PeerProgress
+	for _, id := range cm.sortedPeerIds() {
+		if id == cm.id {
+			continue
+		}
+		p := PeerProgress{
+			Id:          id,
+			State:       cm.replicationState(id),
+			NextIndex:   cm.nextIndex[id],
+			MatchIndex:  cm.matchIndex[id],
+			Lag:         lastLogIndex - cm.matchIndex[id],
+			LastContact: cm.acks[id],
+			Zone:        cm.zones[id],
+		}
+		for i := intMax(cm.matchIndex[id]+1, cm.snapshotIndex+1); i <= lastLogIndex; i++ {
+			entry := cm.log[i-cm.snapshotIndex-1]
+			var command []byte
+			if cc, ok := entry.Command.(configChange); ok {
+				command, _ = encodeConfigChange(cc)
+			} else if chunk, ok := entry.Command.(commandChunk); ok {
+				command, _ = encodeChunk(chunk)
+			} else if barrier, ok := entry.Command.(stateBarrier); ok {
+				command, _ = encodeStateBarrier(barrier)
+			} else {
+				command, _, _ = encodeCommand(cm.codec, entry.Command)
+			}
+			p.LagBytes += len(command)
+		}
+		progress = append(progress, p)
+	}
+	return progress
+}
+
+// ReplicationProgress returns the progress of the followers in the default
+// group, like ConsensusModule.ReplicationProgress.
+func (s *Server) ReplicationProgress() ([]PeerProgress, error) {
+	cm, err := s.group(DefaultGroup)
+	if err != nil {
+		return nil, err
+	}
+	return cm.ReplicationProgress(), nil
+}
+
+// replicationState returns how the leader cm replicates to peer id.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) replicationState(id ServerID) ReplicationState {
+	switch {
+	case cm.snapshotTransfers[id] != nil:
+		return Snapshotting
+	case cm.probing[id]:
+		return Probing
+	default:
+		return Replicating
+	}
+}
+
+// checkLag reports the followers of the leader cm whose lag crossed
+// Config.LagAlertThreshold, either way, since the last check.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) checkLag() {
+	threshold := cm.config.LagAlertThreshold
+	if threshold == 0 {
+		return
+	}
+	lastLogIndex, _ := cm.lastLogIndexAndTerm()
+	for id := range cm.peerIds {
+		if id == cm.id {
+			continue
+		}
+		lag := lastLogIndex - cm.matchIndex[id]
+		if lagging := lag > threshold; lagging != cm.lagAlerted[id] {
+			cm.lagAlerted[id] = lagging
+			cm.raftLog("%s lags %d entries behind", id, lag)
+			cm.observe(&PeerLagEvent{GroupId: cm.groupId, Peer: id, Lag: lag, Recovered: !lagging})
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"strings"
+)
+
+// The format of the RPC messages servers exchange is versioned, so that a
+// cluster can be upgraded one server at a time across releases that change
+// it. Every connection negotiates, when it's opened, the highest version both
+// of its ends speak, and the arguments of the RPCs sent over it carry that
+// version in their ProtocolVersion field. A release that changes the format
+// bumps ProtocolVersion, and keeps handling the messages of the versions down
+// to MinProtocolVersion, branching on their ProtocolVersion; once all the
+// servers run it, the next release may raise MinProtocolVersion.
+
+const (
+	// ProtocolVersion is the latest version of the wire protocol this
+	// release speaks.
+	ProtocolVersion = 1
+
+	// MinProtocolVersion is the oldest version of the wire protocol this
+	// release speaks. Releases from before the protocol was versioned speak
+	// version 1, and send a ProtocolVersion of 0.
+	MinProtocolVersion = 1
+)
+
+// ProtocolVersionError is returned when the two ends of a connection have no
+// version of the wire protocol in common, or an RPC carries a version the
+// server doesn't speak. The releases of the servers are too far apart.
+type ProtocolVersionError struct {
+	// Min and Max are the versions the local server speaks, and PeerMin and
+	// PeerMax the ones the other end speaks.
+	Min, Max         int
+	PeerMin, PeerMax int
+}
+
+func (e *ProtocolVersionError) Error() string {
+	return fmt.Sprintf("raft: no protocol version in common: speaks %d to %d, the other end %d to %d", e.Min, e.Max, e.PeerMin, e.PeerMax)
+}
+
+// NegotiateArgs holds the versions of the wire protocol the end opening a
+// connection speaks.
+type NegotiateArgs struct {
+	Min, Max int
+}
+
+// NegotiateReply holds the version the connection uses.
+type NegotiateReply struct {
+	Version int
+}
+
+// protocolService is registered as the "Protocol" RPC service of the server.
+type protocolService struct {
+	s *Server
+}
+
+func (p *protocolService) Negotiate(args NegotiateArgs, reply *NegotiateReply) error {
+	version, err := commonVersion(p.s.minVersion, p.s.maxVersion, args.Min, args.Max)
+	reply.Version = version
+	return err
+}
+
+// commonVersion returns the highest version in both [min, max] and [peerMin,
+// peerMax].
+func commonVersion(min, max, peerMin, peerMax int) (int, error) {
+	version := intMin(max, peerMax)
+	if version < intMax(min, peerMin) {
+		return 0, &ProtocolVersionError{Min: min, Max: max, PeerMin: peerMin, PeerMax: peerMax}
+	}
+	return version, nil
+}
+
+// NegotiateVersion negotiates the version of the wire protocol of client,
+// just connected to a server, as this release speaks it. The RPCs sent over
+// client must carry it in the ProtocolVersion field of their arguments.
+func NegotiateVersion(client *rpc.Client) (int, error) {
+	return negotiateVersion(client, MinProtocolVersion, ProtocolVersion)
+}
+
+// negotiateVersion is NegotiateVersion for an end speaking the versions in
+// [min, max]. The servers of releases from before the protocol was versioned
+// don't have the Protocol service; they speak version 1.
+func negotiateVersion(client *rpc.Client, min, max int) (int, error) {
+	var reply NegotiateReply
+	err := client.Call("Protocol.Negotiate", NegotiateArgs{Min: min, Max: max}, &reply)
+	var serverErr rpc.ServerError
+	switch {
+	case err == nil:
+		return reply.Version, nil
+	case errors.As(err, &serverErr) && strings.HasPrefix(string(serverErr), "rpc: can't find service"):
+		return commonVersion(min, max, 1, 1)
+	case errors.As(err, &serverErr) && strings.HasPrefix(string(serverErr), "raft: no protocol version in common"):
+		// The server's error lost its type on the wire.
+		return 0, errors.New(string(serverErr))
+	}
+	return 0, err
+}
+
+// checkVersion checks that the server speaks version, the ProtocolVersion of
+// the arguments of an RPC it received. 0 is the version of the peers of
+// releases from before the protocol was versioned: 1.
+func (s *Server) checkVersion(version int) error {
+	if version == 0 {
+		version = 1
+	}
+	if version < s.minVersion || version > s.maxVersion {
+		return &ProtocolVersionError{Min: s.minVersion, Max: s.maxVersion, PeerMin: version, PeerMax: version}
+	}
+	return nil
+}
+
+// versionedArgs are the arguments of the RPCs servers send each other, which
+// carry the version of the protocol of their connection.
+type versionedArgs interface {
+	// withProtocolVersion returns a copy of the arguments carrying version.
+	withProtocolVersion(version int) interface{}
+}
+
+func (a RequestVoteArgs) withProtocolVersion(version int) interface{} {
+	a.ProtocolVersion = version
+	return a
+}
+
+func (a AppendEntriesArgs) withProtocolVersion(version int) interface{} {
+	a.ProtocolVersion = version
+	return a
+}
+
+func (a InstallSnapshotArgs) withProtocolVersion(version int) interface{} {
+	a.ProtocolVersion = version
+	return a
+}
+
+func (a TimeoutNowArgs) withProtocolVersion(version int) interface{} {
+	a.ProtocolVersion = version
+	return a
+}
+
+func (a StateChecksumArgs) withProtocolVersion(version int) interface{} {
+	a.ProtocolVersion = version
+	return a
+}
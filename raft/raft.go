@@ -5,11 +5,17 @@
 package raft
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"hash/fnv"
+	"io"
 	"math/rand"
 	"sync"
 	"time"
+
+	"github.com/aecra/raft/storage"
 )
 
 // CommitEntry is the data reported by Raft to the commit channel. Each commit
@@ -53,15 +59,145 @@ func (s CMState) String() string {
 type LogEntry struct {
 	Command interface{}
 	Term    int
+
+	// Checksum is computed by entryChecksum when the entry is appended, and
+	// verified before the entry is sent and applied. It's 0 for the entries
+	// persisted before checksums were added.
+	Checksum uint32
 }
 
 type Application interface {
 	ApplyCommand(interface{}) interface{}
 }
 
-type CommittedResult struct {
-	Result interface{}
-	Index  int
+// BatchApplier is implemented by Applications that apply committed commands
+// in batches, to amortize locking and disk writes. The CM then calls
+// ApplyBatch instead of ApplyCommand with all the entries committed since the
+// last call.
+type BatchApplier interface {
+	// ApplyBatch applies the commands of entries in order and returns their
+	// results, in the same order.
+	ApplyBatch(entries []CommitEntry) []interface{}
+}
+
+// CheckedApplier is implemented by Applications whose commands can fail. The
+// CM then calls ApplyCommandChecked instead of ApplyCommand, and an error it
+// returns is reported to the submitter as an *ApplyError, apart from the
+// failures to commit the command. The command is committed either way: it
+// must fail the same way on every server. A BatchApplier reports failures by
+// returning *ApplyError results.
+type CheckedApplier interface {
+	ApplyCommandChecked(command interface{}) (interface{}, error)
+}
+
+// ApplyError is returned when the application failed to apply a committed
+// command, as reported by a CheckedApplier.
+type ApplyError struct {
+	Err error
+}
+
+func (e *ApplyError) Error() string {
+	return "raft: applying the command failed: " + e.Err.Error()
+}
+
+func (e *ApplyError) Unwrap() error {
+	return e.Err
+}
+
+// Snapshotter is implemented by Applications whose state can be saved and
+// restored. The CM snapshots such applications every Config.SnapshotThreshold
+// applied entries and drops those entries from its log; followers that fall
+// behind the snapshot are sent it with InstallSnapshot.
+//
+// Snapshots are streamed, so an application with a large state doesn't have
+// to build a copy of it in memory. The snapshot is still stored as a whole by
+// the storage.Storage.
+type Snapshotter interface {
+	// SnapshotTo writes the state of the application, reflecting the
+	// commands applied so far, to w.
+	SnapshotTo(w io.Writer) error
+
+	// RestoreFrom replaces the state of the application with a snapshot
+	// read from r.
+	RestoreFrom(r io.Reader) error
+}
+
+// VersionedSnapshotter is implemented by Snapshotters whose snapshot format
+// changes across versions of the application. The version of the data is
+// recorded in the snapshots, so that a new version of the application can
+// migrate the snapshots of an old one, and an old version refuses those of a
+// newer one rather than misreading them.
+type VersionedSnapshotter interface {
+	Snapshotter
+
+	// SchemaVersion returns the version of the data written by SnapshotTo.
+	SchemaVersion() int
+
+	// RestoreFromVersion is RestoreFrom for a snapshot of the given version,
+	// at most SchemaVersion. The snapshots taken before the application
+	// implemented VersionedSnapshotter have version 0.
+	RestoreFromVersion(r io.Reader, version int) error
+}
+
+// StateChecksummer is implemented by Snapshotters that can checksum their
+// state. The checksum of the state a snapshot captures is recorded in it, and
+// checked against the one of the state restored from it, so that a truncated
+// or corrupted snapshot halts the server rather than silently diverging it
+// from its peers.
+type StateChecksummer interface {
+	// StateChecksum returns a checksum of the state of the application,
+	// reflecting the commands applied so far. It's called between two calls
+	// to ApplyCommand or ApplyBatch, and after a restore.
+	StateChecksum() uint64
+}
+
+// ErrStateChecksumMismatch is returned when the state restored from a
+// snapshot doesn't have the checksum recorded in it.
+var ErrStateChecksumMismatch = errors.New("raft: the restored state doesn't match the snapshot's checksum")
+
+// ConcurrentSnapshotter is implemented by Snapshotters that can capture their
+// state cheaply, by copy-on-write for instance, and write it out later, so
+// that commands are applied while a snapshot is persisted rather than wait
+// for SnapshotTo to return.
+type ConcurrentSnapshotter interface {
+	Snapshotter
+
+	// Snapshot captures the state of the application, reflecting the
+	// commands applied so far. It's called between two calls to
+	// ApplyCommand or ApplyBatch, so it doesn't race with them, and should
+	// return quickly.
+	Snapshot() (AppSnapshot, error)
+}
+
+// AppSnapshot is the state of an application captured by
+// ConcurrentSnapshotter.Snapshot. It's persisted while the application goes
+// on applying commands, so it mustn't see their effects.
+type AppSnapshot interface {
+	// Persist writes the captured state to w, in the format RestoreFrom
+	// reads.
+	Persist(w io.Writer) error
+
+	// Release is called once the snapshot was persisted, or failed to be,
+	// to free the resources it holds.
+	Release()
+}
+
+// proposal is a command submitted to a leader that is waiting to be applied.
+type proposal struct {
+	// term is the term the command was appended in. If the entry applied at
+	// the proposal's index has another term, the command was overwritten by a
+	// later leader and never committed.
+	term int
+
+	// resultChan receives the result of applying the command. It's closed if
+	// the command is known not to have been committed, or if its result is
+	// lost.
+	resultChan chan interface{}
+
+	// appended is when the command was persisted in the leader's log, and
+	// committed when the leader committed it, for Metrics.
+	appended  time.Time
+	committed time.Time
 }
 
 // ConsensusModule (CM) implements a single node of Raft consensus.
@@ -70,14 +206,20 @@ type ConsensusModule struct {
 	mu sync.Mutex
 
 	// id is the server ID of this CM.
-	id int
+	id ServerID
+
+	// groupId identifies the consensus group of this CM among those hosted
+	// by its server.
+	groupId int
 
-	// maxId is the maximum assigned ID of the cluster.
-	// New peer will get maxId+1 as its ID from leader.
-	maxId int
+	// peerIds lists the IDs of our peers in the cluster. It's the membership
+	// of the last configuration change in the log.
+	peerIds map[ServerID]ServerID
 
-	// peerIds lists the IDs of our peers in the cluster.
-	peerIds map[int]int
+	// basePeers is the membership at snapshotIndex, the initial one if
+	// there's no snapshot, with the addresses of the servers added at
+	// runtime.
+	basePeers map[ServerID]string
 
 	// server is the server containing this CM. It's used to issue RPC calls
 	// to peer.
@@ -86,33 +228,217 @@ type ConsensusModule struct {
 	// app is the application under raft.
 	app Application
 
-	// commitChan is the channel where this CM is going to report committed
-	// result. It will be received in function Submit.
-	committedResultChan chan CommittedResult
+	// storage is used to persist the term, vote and log so that the CM can
+	// be restored after a restart.
+	storage storage.Storage
+
+	// config holds the timing and snapshot parameters, with defaults filled
+	// in.
+	config Config
+
+	// proposals are the commands submitted to this CM that are waiting to be
+	// applied, keyed by log index. commitChanSender resolves them.
+	proposals map[int]proposal
+
+	// appendQueue are the commands waiting for the GroupCommitWindow to end
+	// to be appended to the log.
+	appendQueue []queuedCommand
+
+	// pendingReads are the reads waiting for the leader to confirm its
+	// leadership.
+	pendingReads []*readRequest
+
+	// metrics records the latencies of the commands submitted to cm.
+	metrics *groupMetrics
+
+	// rand draws the election timeouts. It has its own lock, as the election
+	// timer draws them without cm.mu.
+	randMu sync.Mutex
+	rand   *rand.Rand
+
+	// tokens holds the results of the commands applied with a token. It has
+	// its own lock, as commitChanSender updates it while applying entries.
+	tokens *tokenCache
+
+	// chunks reassembles the commands submitted with SubmitChunked as their
+	// parts are applied.
+	chunks *chunkAssembler
+
+	// leaderCh receives the leadership changes of cm; see LeaderCh.
+	leaderCh chan bool
 
 	// newCommitReadyChan is an internal notification channel used by goroutines
 	// that commit new entries to the log to notify followers that these entries
-	// may be sent on commitChan.
+	// may be sent on commitChan. Notifications are sent with notifyCommit.
 	newCommitReadyChan chan struct{}
 
 	// triggerAEChan is an internal notification channel used to trigger
-	// sending new AEs to followers when interesting changes occurred.
+	// sending new AEs to followers when interesting changes occurred. Its
+	// buffer of one is a dirty flag: any number of triggers made while a
+	// round is pending coalesce into it, and triggerAE never waits for the
+	// timer loop.
 	triggerAEChan chan struct{}
 
+	// done is closed when the CM becomes Dead, to wake up the goroutines
+	// waiting on timers.
+	done chan struct{}
+
+	// roleCtx is done when the CM leaves the role and term it was created
+	// for, so that the RPCs it sent in them, RequestVotes of an abandoned
+	// election or AEs of a deposed leader, are cancelled rather than linger.
+	// cancelRole cancels it.
+	roleCtx    context.Context
+	cancelRole context.CancelFunc
+
+	// wg tracks the goroutines started with spawn, which Stop waits for.
+	wg sync.WaitGroup
+
 	// Persistent Raft state on all servers
 	currentTerm int
-	votedFor    int
+	votedFor    ServerID
 	log         []LogEntry
 
+	// snapshotIndex and snapshotTerm are the index and term of the last entry
+	// covered by the snapshot; log holds the entries following it.
+	snapshotIndex int
+	snapshotTerm  int
+
+	// pendingSnapshot is the snapshot being received from the leader.
+	pendingSnapshot *pendingSnapshot
+
+	// leaderId is the leader of the current term as far as this CM knows, or
+	// NoServer. Clients submitting to a follower are redirected to it.
+	leaderId ServerID
+
+	// election tallies the votes of the last election the CM stood for.
+	election *election
+
 	// Volatile Raft state on all servers
 	commitIndex        int
 	lastApplied        int
 	state              CMState
 	electionResetEvent time.Time
 
+	// appliedIndex is the index of the last entry the application finished
+	// applying, whereas lastApplied is the last one handed to it. maxApplyLag
+	// and lagRejected are reported by ApplyStats.
+	appliedIndex int
+	maxApplyLag  int
+	lagRejected  int
+
+	// appliedChan is closed, and replaced, whenever appliedIndex advances,
+	// to wake the callers of WaitApplied up.
+	appliedChan chan struct{}
+
+	// stateChecksums are the checksums of the state of the application taken
+	// at the last state barriers applied, oldest first.
+	stateChecksums []stateChecksum
+
+	// lastContact is the last time a follower heard from its leader, or a
+	// leader was acknowledged by a majority. freshAt is the last contact
+	// whose committed entries the application applied: ReadStale serves
+	// reads as of then. On a follower, pendingContact is the oldest AE whose
+	// log matched that isn't reflected in freshAt yet, and pendingCommit the
+	// commit index the leader sent with it.
+	lastContact    time.Time
+	freshAt        time.Time
+	pendingContact time.Time
+	pendingCommit  int
+
+	// leaderCommit is the commit index of the last AE received from the
+	// leader, which Health measures how far behind a follower is from.
+	leaderCommit int
+
 	// Volatile Raft state on leaders
-	nextIndex  map[int]int
-	matchIndex map[int]int
+	nextIndex  map[ServerID]int
+	matchIndex map[ServerID]int
+
+	// acks holds, for each peer, when the leader sent the last AE it
+	// acknowledged.
+	acks map[ServerID]time.Time
+
+	// snapshotTransfers tracks the snapshots being sent to peers.
+	snapshotTransfers map[ServerID]*snapshotTransfer
+
+	// probing holds the peers the leader is looking for the last shared entry
+	// of, and lagAlerted the ones it reported lagging behind.
+	probing    map[ServerID]bool
+	lagAlerted map[ServerID]bool
+
+	// sending holds the peers an AE is in flight to. The leader sends one at
+	// a time to each peer, and marks in resend the peers that missed a round
+	// meanwhile, to send them another as soon as the reply is in.
+	sending map[ServerID]bool
+	resend  map[ServerID]bool
+
+	// transferring is set while the leader hands its leadership over to
+	// another server. It rejects commands meanwhile.
+	transferring bool
+
+	// draining is set once the server started shutting down gracefully. cm
+	// rejects commands, and doesn't lead again after handing its leadership
+	// over.
+	draining bool
+
+	// snapshotRequests are the callers of snapshotNow waiting for
+	// commitChanSender to take a snapshot.
+	snapshotRequests []chan snapshotResult
+
+	// persistingSnapshots is the number of snapshots of a
+	// ConcurrentSnapshotter being persisted in the background.
+	persistingSnapshots int
+
+	// catchUpLimiter limits the bandwidth of snapshot transfers and of the
+	// committed entries sent to lagging followers. It's nil if unlimited.
+	catchUpLimiter *rateLimiter
+
+	// codec encodes the commands sent in AppendEntries.
+	codec Codec
+
+	// witness is set if this CM is a witness. Its log holds the terms of the
+	// entries and the membership changes, but no commands.
+	witness bool
+
+	// electionOnly is set if this CM only elects a leader, and refuses
+	// commands.
+	electionOnly bool
+
+	// witnesses are the peers known to be witnesses. Leaders send them
+	// entries without their commands.
+	witnesses map[ServerID]bool
+
+	// zone is the zone of this server, and zones the ones the peers reported
+	// in their AE replies.
+	zone  string
+	zones map[ServerID]string
+
+	// maintenance is set while the server is in maintenance mode.
+	maintenance bool
+
+	// applyFailed is set once the application panicked under PanicStepDown:
+	// cm no longer applies entries nor stands for election.
+	applyFailed bool
+}
+
+// pendingSnapshot is a snapshot whose chunks are being received.
+type pendingSnapshot struct {
+	index int
+	term  int
+	data  []byte
+}
+
+// snapshotTransfer is the progress of sending a snapshot to a peer. It
+// outlives the goroutine sending it, so that a transfer interrupted by a
+// failed RPC resumes where it stopped.
+type snapshotTransfer struct {
+	// index is the last index covered by the snapshot being sent.
+	index int
+
+	// offset is where the next chunk starts.
+	offset int
+
+	// active is set while a goroutine is sending chunks.
+	active bool
 }
 
 // NewConsensusModule creates a new CM with the given ID, list of peer IDs and
@@ -120,108 +446,377 @@ type ConsensusModule struct {
 // it's safe to start its state machine. commitChan is going to be used by the
 // CM to send log entries that have been committed by the Raft cluster.
 func NewConsensusModule(server *Server) *ConsensusModule {
+	return newConsensusModule(server, DefaultGroup, server.app, server.storage)
+}
+
+// newConsensusModule creates the CM of group groupId on server, applying
+// commands to app and persisting its state in store.
+func newConsensusModule(server *Server, groupId int, app Application, store storage.Storage) *ConsensusModule {
 	cm := new(ConsensusModule)
 	cm.id = server.serverId
-	cm.peerIds = make(map[int]int)
-	for i := 0; i < server.num; i++ {
-		cm.peerIds[i] = i
-	}
-	cm.app = server.app
+	cm.groupId = groupId
+	cm.app = app
+	cm.storage = store
+	cm.config = server.config
 	cm.server = server
-	cm.committedResultChan = make(chan CommittedResult)
-	cm.newCommitReadyChan = make(chan struct{}, 16)
+	cm.proposals = make(map[int]proposal)
+	cm.metrics = newGroupMetrics()
+	cm.rand = newCMRand(cm.config.Seed, cm.id, groupId)
+	cm.newCommitReadyChan = make(chan struct{}, 1)
 	cm.triggerAEChan = make(chan struct{}, 1)
+	cm.done = make(chan struct{})
+	cm.roleCtx, cm.cancelRole = context.WithCancel(context.Background())
 	cm.state = Follower
-	cm.votedFor = -1
+	cm.votedFor = NoServer
+	cm.leaderId = NoServer
+	cm.snapshotIndex = -1
+	cm.snapshotTerm = -1
 	cm.commitIndex = -1
 	cm.lastApplied = -1
-	cm.nextIndex = make(map[int]int)
-	cm.matchIndex = make(map[int]int)
+	cm.appliedIndex = -1
+	cm.appliedChan = make(chan struct{})
+	cm.leaderCommit = -1
+	cm.nextIndex = make(map[ServerID]int)
+	cm.matchIndex = make(map[ServerID]int)
+	cm.acks = make(map[ServerID]time.Time)
+	cm.snapshotTransfers = make(map[ServerID]*snapshotTransfer)
+	cm.probing = make(map[ServerID]bool)
+	cm.sending = make(map[ServerID]bool)
+	cm.resend = make(map[ServerID]bool)
+	cm.lagAlerted = make(map[ServerID]bool)
+	cm.tokens = newTokenCache(cm.config.IdempotencyCacheSize)
+	cm.chunks = &chunkAssembler{}
+	cm.leaderCh = make(chan bool, 1)
+	if groupId == DefaultGroup {
+		cm.leaderCh = server.leaderCh
+	}
+	cm.catchUpLimiter = newRateLimiter(cm.config.CatchUpRate)
+	cm.codec = server.codec
+	cm.witness = server.witness
+	cm.electionOnly = server.electionOnly
+	if cm.witness || cm.electionOnly {
+		cm.app = witnessApp{}
+	}
+	cm.witnesses = make(map[ServerID]bool)
+	cm.zone = server.zone
+	cm.zones = make(map[ServerID]string)
+	cm.maintenance = server.maintenance
+	cm.basePeers = cm.initialPeers()
+
+	if err := cm.restoreFromStorage(); err != nil {
+		panic(fmt.Sprintf("[%s] failed to restore from storage: %v", cm.id, err))
+	}
 
-	go func() {
+	cm.spawn(func() {
 		// The CM is dormant until ready is signaled; then, it starts a countdown
 		// for leader election.
-		<-cm.server.ready
+		select {
+		case <-cm.server.ready:
+		case <-cm.done:
+			return
+		}
 		cm.mu.Lock()
 		cm.electionResetEvent = time.Now()
 		cm.mu.Unlock()
-		cm.runElectionTimer()
-	}()
+		cm.run()
+	})
 
-	go cm.commitChanSender()
+	cm.spawn(cm.commitChanSender)
 	return cm
 }
 
-// Report reports the state of this CM.
-func (cm *ConsensusModule) Report() (id int, term int, isLeader bool) {
+// spawn runs f in a new goroutine that Stop waits for. It must be called
+// either from a goroutine started by spawn, or with cm.mu locked and cm not
+// Dead, so that no goroutine is added once Stop started waiting.
+func (cm *ConsensusModule) spawn(f func()) {
+	cm.wg.Add(1)
+	go func() {
+		defer cm.wg.Done()
+		f()
+	}()
+}
+
+// Report reports the state of this CM. Status reports more of it, including
+// the leader it knows and when it last heard from it.
+func (cm *ConsensusModule) Report() (id ServerID, term int, isLeader bool) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 	return cm.id, cm.currentTerm, cm.state == Leader
 }
 
+// Leader returns the ID of the leader of the current term as far as this CM
+// knows, or NoServer if it doesn't know.
+func (cm *ConsensusModule) Leader() ServerID {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.leaderId
+}
+
 // Submit submits a new command to the CM. This function doesn't block; clients
 // read the commit channel passed in the constructor to be notified of new
 // committed entries. It returns true iff this CM is the leader - in which case
 // the command is accepted. If false is returned, the client will have to find
-// a different CM to submit this command to.
+// a different CM to submit this command to. If the application failed to apply
+// the command, the result is the *ApplyError.
 func (cm *ConsensusModule) Submit(command interface{}) (interface{}, bool) {
+	return cm.SubmitContext(context.Background(), command)
+}
+
+// SubmitContext is Submit, waiting for the command to be applied until ctx is
+// done rather than for Config.CommitTimeout if ctx has a deadline.
+func (cm *ConsensusModule) SubmitContext(ctx context.Context, command interface{}) (interface{}, bool) {
+	committed, err := cm.SubmitIndexed(ctx, command)
+	var applyErr *ApplyError
+	if errors.As(err, &applyErr) {
+		return applyErr, true
+	}
+	return committed.Result, err == nil
+}
+
+// SubmitResult is the result of applying a command, and the index and term of
+// the log entry it was committed at. The index and term identify the command
+// across the cluster, to build fencing tokens or deduplicate retries for
+// instance.
+type SubmitResult struct {
+	Result interface{}
+	Index  int
+	Term   int
+}
+
+// SubmitIndexed is SubmitContext, also returning the index and term the
+// command was committed at. It tells the failures apart: a *NotLeaderError,
+// ErrThrottled, ErrProposalQueueFull, ErrEnqueueTimeout or a
+// *CommandTooLargeError if the command wasn't appended to the log,
+// ErrUnknownResult if it was but its result is unknown, and an
+// *ApplyError, along with the index and term, if the application failed to
+// apply it.
+func (cm *ConsensusModule) SubmitIndexed(ctx context.Context, command interface{}) (SubmitResult, error) {
+	return cm.submit(ctx, command)
+}
+
+// submit is SubmitIndexed. Only ErrUnknownResult and *ApplyError mean that the
+// command was appended to the log.
+func (cm *ConsensusModule) submit(ctx context.Context, command interface{}) (SubmitResult, error) {
+	if cm.electionOnly {
+		return SubmitResult{}, ErrElectionOnly
+	}
+	submitted := time.Now()
 	cm.mu.Lock()
 	cm.raftLog("Submit received by %v: %v", cm.state, command)
-	if cm.state == Leader {
-		cm.log = append(cm.log, LogEntry{Command: command, Term: cm.currentTerm})
-		cm.raftLog("... log=%v", cm.log)
-		currentLogIndex := len(cm.log) - 1
+	if cm.state != Leader || cm.transferring || cm.draining {
+		leader := cm.leaderId
+		if leader == cm.id {
+			leader = NoServer
+		}
+		cm.mu.Unlock()
+		return SubmitResult{}, &NotLeaderError{Leader: leader}
+	}
+	if cm.applyLagging() {
+		cm.mu.Unlock()
+		return SubmitResult{}, ErrThrottled
+	}
+	if cm.pendingFull() {
+		cm.mu.Unlock()
+		return SubmitResult{}, ErrProposalQueueFull
+	}
+	// Commands that can't be sent to followers are rejected upfront.
+	data, _, err := encodeCommand(cm.codec, command)
+	if err != nil {
+		cm.raftLog("failed to encode command: %v", err)
 		cm.mu.Unlock()
+		return SubmitResult{}, fmt.Errorf("raft: encoding command: %v", err)
+	}
+	if len(data) > cm.config.MaxCommandBytes {
+		cm.mu.Unlock()
+		return SubmitResult{}, &CommandTooLargeError{Size: len(data), Max: cm.config.MaxCommandBytes}
+	}
+	if cm.config.GroupCommitWindow > 0 {
+		appended := cm.enqueue(command, submitted)
+		cm.mu.Unlock()
+		outcome := cm.awaitAppend(ctx, appended, submitted)
+		if outcome.err != nil {
+			return SubmitResult{}, outcome.err
+		}
+		return cm.awaitSubmitted(ctx, submitted, outcome.index, outcome.term, outcome.resultChan)
+	}
+	term := cm.currentTerm
+	index, resultChan, err := cm.propose(command)
+	cm.mu.Unlock()
+	if err != nil {
+		return SubmitResult{}, err
+	}
+	cm.metrics.submitToAppend.observe(time.Since(submitted))
 
-		cm.triggerAEChan <- struct{}{}
-		// In many cases, the commit would be fail.
-		// If it succeeds, it would not longer than 650ms.
-		ticker := time.NewTicker(650 * time.Millisecond)
-		for {
-			select {
-			case <-ticker.C:
-				ticker.Stop()
-				return nil, false
-			case committedResult := <-cm.committedResultChan:
-				// the committed result is not belonging current submitted
-				// command.
-				if committedResult.Index != currentLogIndex {
-					cm.committedResultChan <- committedResult
-					time.Sleep(5 * time.Millisecond)
-					continue
-				}
-				return committedResult.Result, true
+	cm.triggerAE()
+	return cm.awaitSubmitted(ctx, submitted, index, term, resultChan)
+}
+
+// awaitSubmitted waits for the result of the command submitted at index in
+// term, and returns it as submit does. The command must be committed within
+// Config.ApplyTimeout of submitted, if it's set.
+func (cm *ConsensusModule) awaitSubmitted(ctx context.Context, submitted time.Time, index, term int, resultChan chan interface{}) (SubmitResult, error) {
+	var commitBy time.Time
+	if cm.config.ApplyTimeout > 0 {
+		commitBy = submitted.Add(cm.config.ApplyTimeout)
+	}
+	result, ok := cm.awaitResult(ctx, index, resultChan, commitBy)
+	if !ok {
+		return SubmitResult{}, ErrUnknownResult
+	}
+	// The proposal only gets a result if the entry applied at index is the one
+	// appended in term.
+	if applyErr, ok := result.(*ApplyError); ok {
+		return SubmitResult{Index: index, Term: term}, applyErr
+	}
+	return SubmitResult{Result: result, Index: index, Term: term}, nil
+}
+
+// propose appends command to the log of the leader and registers a proposal
+// for it. It returns the index of the entry and the channel its result is
+// delivered on.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) propose(command interface{}) (int, chan interface{}, error) {
+	index, resultChans, err := cm.proposeAll([]interface{}{command})
+	if err != nil {
+		return 0, nil, err
+	}
+	return index, resultChans[0], nil
+}
+
+// proposeAll appends commands to the log of the leader with a single storage
+// write and registers a proposal for each. It returns the index of the first
+// entry and the channels their results are delivered on.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) proposeAll(commands []interface{}) (int, []chan interface{}, error) {
+	entries := make([]LogEntry, len(commands))
+	for i, command := range commands {
+		entries[i] = LogEntry{Command: command, Term: cm.currentTerm, Checksum: entryChecksum(cm.currentTerm, command)}
+	}
+	first := cm.snapshotIndex + 1 + len(cm.log)
+	if err := cm.persistEntries(first, entries); err != nil {
+		cm.raftLog("failed to persist command: %v", err)
+		return 0, nil, err
+	}
+	cm.log = append(cm.log, entries...)
+	cm.raftLog("... log=%v", cm.log)
+	now := time.Now()
+	resultChans := make([]chan interface{}, len(commands))
+	for i := range commands {
+		index := first + i
+		if p, ok := cm.proposals[index]; ok {
+			// A command proposed at this index in an earlier term was
+			// overwritten and will never be applied.
+			close(p.resultChan)
+		}
+		resultChans[i] = make(chan interface{}, 1)
+		cm.proposals[index] = proposal{term: cm.currentTerm, resultChan: resultChans[i], appended: now}
+	}
+	return first, resultChans, nil
+}
+
+// awaitResult waits for the result of the proposal at index. ok is false if
+// it isn't applied before ctx is done, or within CommitTimeout if ctx has no
+// deadline, if it isn't committed by commitBy unless that's the zero time, or
+// if it's known not to be committed.
+func (cm *ConsensusModule) awaitResult(ctx context.Context, index int, resultChan chan interface{}, commitBy time.Time) (result interface{}, ok bool) {
+	// In many cases, the commit would be fail.
+	// If it succeeds, it would not take longer than CommitTimeout.
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cm.config.CommitTimeout)
+		defer cancel()
+	}
+	var commitTimeout <-chan time.Time
+	if !commitBy.IsZero() {
+		timer := time.NewTimer(time.Until(commitBy))
+		defer timer.Stop()
+		commitTimeout = timer.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+		case <-commitTimeout:
+			cm.mu.Lock()
+			committed := index <= cm.commitIndex
+			cm.mu.Unlock()
+			if committed {
+				// It only has to be applied now.
+				commitTimeout = nil
+				continue
 			}
+			cm.raftLog("index %d not committed by the apply timeout", index)
+		case result, ok := <-resultChan:
+			return result, ok
+		}
+		cm.mu.Lock()
+		if p, ok := cm.proposals[index]; ok && p.resultChan == resultChan {
+			delete(cm.proposals, index)
 		}
+		cm.mu.Unlock()
+		return nil, false
 	}
+}
 
-	cm.mu.Unlock()
-	return nil, false
+// Stop stops this CM, failing its pending proposals, and waits for all its
+// goroutines to exit. If ctx is done first, it returns ctx.Err(); the
+// goroutines still exit, once their RPCs to peers return.
+func (cm *ConsensusModule) Stop(ctx context.Context) error {
+	cm.halt()
+	return waitContext(ctx, &cm.wg)
 }
 
-// Stop stops this CM, cleaning up its state. This method returns quickly, but
-// it may take a bit of time (up to ~election timeout) for all goroutines to
-// exit.
-func (cm *ConsensusModule) Stop() {
+// halt makes cm Dead without waiting for its goroutines. The goroutines of cm
+// call it rather than Stop, which would wait for themselves.
+func (cm *ConsensusModule) halt() {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
+	cm.stop()
+}
+
+// stop makes cm Dead and fails its pending proposals. It's a no-op if cm is
+// already Dead.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) stop() {
+	if cm.state == Dead {
+		return
+	}
+	if cm.state == Leader {
+		cm.notifyLeader(false)
+		cm.failReads()
+	}
 	cm.state = Dead
+	cm.cancelRole()
 	cm.raftLog("becomes Dead")
 	close(cm.newCommitReadyChan)
+	close(cm.done)
+	for _, request := range cm.snapshotRequests {
+		request <- snapshotResult{cm.snapshotIndex, cm.snapshotTerm, fmt.Errorf("raft: stopped")}
+	}
+	cm.snapshotRequests = nil
+	for index, p := range cm.proposals {
+		close(p.resultChan)
+		delete(cm.proposals, index)
+	}
 }
 
 // raftLog logs a debugging message is DebugCM > 0.
 func (cm *ConsensusModule) raftLog(format string, args ...interface{}) {
-	format = fmt.Sprintf("[%d] ", cm.id) + format
-	log.Printf(format, args...)
+	if cm.groupId == DefaultGroup {
+		format = fmt.Sprintf("[%s] ", cm.id) + format
+	} else {
+		format = fmt.Sprintf("[%s/%d] ", cm.id, cm.groupId) + format
+	}
+	cm.server.logger.Printf(format, args...)
 }
 
 // RequestVoteArgs See figure 2 in the paper.
 type RequestVoteArgs struct {
-	Term         int
-	CandidateId  int
-	LastLogIndex int
-	LastLogTerm  int
+	ProtocolVersion int
+	GroupId         int
+	Term            int
+	CandidateId     ServerID
+	LastLogIndex    int
+	LastLogTerm     int
 }
 
 type RequestVoteReply struct {
@@ -237,22 +832,39 @@ func (cm *ConsensusModule) RequestVote(args RequestVoteArgs, reply *RequestVoteR
 		return nil
 	}
 	lastLogIndex, lastLogTerm := cm.lastLogIndexAndTerm()
-	cm.raftLog("RequestVote: %+v [currentTerm=%d, votedFor=%d, log index/term=(%d, %d)]", args, cm.currentTerm, cm.votedFor, lastLogIndex, lastLogTerm)
+	cm.raftLog("RequestVote: %+v [currentTerm=%d, votedFor=%q, log index/term=(%d, %d)]", args, cm.currentTerm, cm.votedFor, lastLogIndex, lastLogTerm)
 
+	// A new term and the vote granted in it are persisted in a single write,
+	// so that a crash can't leave the term persisted without the vote, nor
+	// the reply go out before either is durable.
+	changed := false
 	if args.Term > cm.currentTerm {
 		cm.raftLog("... term out of date in RequestVote")
-		cm.becomeFollower(args.Term)
+		cm.stepDown(args.Term)
+		changed = true
 	}
 
-	if cm.currentTerm == args.Term &&
-		(cm.votedFor == -1 || cm.votedFor == args.CandidateId) &&
+	granted := cm.currentTerm == args.Term &&
+		(cm.votedFor == NoServer || cm.votedFor == args.CandidateId) &&
 		(args.LastLogTerm > lastLogTerm ||
-			(args.LastLogTerm == lastLogTerm && args.LastLogIndex >= lastLogIndex)) {
-		reply.VoteGranted = true
+			(args.LastLogTerm == lastLogTerm && args.LastLogIndex >= lastLogIndex))
+	if granted {
 		cm.votedFor = args.CandidateId
+		changed = true
+	}
+	if changed {
+		if err := cm.persistHardState(); err != nil {
+			// Neither the term nor the vote is acknowledged unless it's
+			// durable.
+			cm.raftLog("failed to persist term and vote: %v", err)
+			cm.stop()
+			return nil
+		}
+	}
+	reply.VoteGranted = granted
+	if granted {
+		cm.metrics.votesGranted++
 		cm.electionResetEvent = time.Now()
-	} else {
-		reply.VoteGranted = false
 	}
 	reply.Term = cm.currentTerm
 	cm.raftLog("... RequestVote reply: %+v", reply)
@@ -261,18 +873,62 @@ func (cm *ConsensusModule) RequestVote(args RequestVoteArgs, reply *RequestVoteR
 
 // AppendEntriesArgs See figure 2 in the paper.
 type AppendEntriesArgs struct {
-	Term     int
-	LeaderId int
+	ProtocolVersion int
+	GroupId         int
+	Term            int
+	LeaderId        ServerID
 
 	PrevLogIndex int
 	PrevLogTerm  int
-	Entries      []LogEntry
+	Entries      []WireEntry
 	LeaderCommit int
 }
 
+// WireEntry is a log entry as sent in AppendEntries, its command encoded by
+// the Codec of the server.
+type WireEntry struct {
+	Command []byte
+	Term    int
+
+	// Config is set if Command is a membership change, which is encoded
+	// with gob rather than the Codec.
+	Config bool
+
+	// Chunk is set if Command is a part of a command submitted with
+	// SubmitChunked, which is also encoded with gob.
+	Chunk bool
+
+	// Barrier is set if Command is a state barrier logged by CheckState,
+	// also encoded with gob.
+	Barrier bool
+
+	// Token is the token of a command submitted with SubmitIdempotent.
+	Token string
+
+	// Checksum is the wireChecksum of Term, Command and Token, which the
+	// follower verifies before decoding Command.
+	Checksum uint32
+
+	// Stripped is set if Command was left out because the follower is a
+	// witness.
+	Stripped bool
+}
+
 type AppendEntriesReply struct {
 	Term    int
 	Success bool
+
+	// Witness is set if the follower is a witness.
+	Witness bool
+
+	// Zone is the zone of the follower, set by WithZone.
+	Zone string
+
+	// If Hinted is set, LastLogIndex is the last index of the follower's log,
+	// so that the leader skips the entries it doesn't have when it rejects an
+	// AE for lacking PrevLogIndex.
+	Hinted       bool
+	LastLogIndex int
 }
 
 func (cm *ConsensusModule) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply) error {
@@ -282,37 +938,103 @@ func (cm *ConsensusModule) AppendEntries(args AppendEntriesArgs, reply *AppendEn
 		return nil
 	}
 	cm.raftLog("AppendEntries: %+v", args)
-
+	reply.Witness = cm.witness
+	reply.Zone = cm.zone
+
+	// A new term is persisted along with the entries the AE appends, in a
+	// single write, or on its own before the reply if it appends none.
+	termSaved := true
+	defer func() {
+		if termSaved || cm.state == Dead {
+			return
+		}
+		if err := cm.persistHardState(); err != nil {
+			cm.raftLog("failed to persist term: %v", err)
+			cm.stop()
+			*reply = AppendEntriesReply{}
+		}
+	}()
 	if args.Term > cm.currentTerm {
 		cm.raftLog("... term out of date in AppendEntries")
-		cm.becomeFollower(args.Term)
+		cm.stepDown(args.Term)
+		termSaved = false
 	}
 
 	reply.Success = false
 	if args.Term == cm.currentTerm {
 		if cm.state != Follower {
-			cm.becomeFollower(args.Term)
+			// A candidate of the same term keeps its vote, so its hard
+			// state doesn't change.
+			cm.stepDown(args.Term)
 		}
 		cm.electionResetEvent = time.Now()
+		cm.lastContact = cm.electionResetEvent
+		cm.leaderId = args.LeaderId
+		cm.observeLeader()
+		cm.leaderCommit = args.LeaderCommit
+
+		newEntries := make([]LogEntry, len(args.Entries))
+		for i, entry := range args.Entries {
+			if wireChecksum(entry.Term, entry.Command, entry.Token) != entry.Checksum {
+				cm.raftLog("... %v", &ChecksumError{Index: args.PrevLogIndex + 1 + i})
+				reply.Term = cm.currentTerm
+				return nil
+			}
+			var command interface{}
+			var err error
+			switch {
+			case entry.Config:
+				command, err = decodeConfigChange(entry.Command)
+			case cm.witness:
+				// Witnesses drop commands, even if the leader didn't.
+			case entry.Stripped:
+				err = fmt.Errorf("the command was left out, but this server isn't a witness")
+			case entry.Chunk:
+				command, err = decodeChunk(entry.Command)
+			case entry.Barrier:
+				command, err = decodeStateBarrier(entry.Command)
+			default:
+				command, err = decodeCommand(cm.codec, entry.Command, entry.Token)
+			}
+			if err != nil {
+				cm.raftLog("... failed to decode entry %d: %v", args.PrevLogIndex+1+i, err)
+				reply.Term = cm.currentTerm
+				return nil
+			}
+			newEntries[i] = LogEntry{Command: command, Term: entry.Term, Checksum: entryChecksum(entry.Term, command)}
+		}
+
+		// The entries covered by our snapshot are committed, so they match
+		// the leader's; only the ones following it are compared.
+		prevLogIndex, prevLogTerm := args.PrevLogIndex, args.PrevLogTerm
+		if prevLogIndex < cm.snapshotIndex {
+			if skip := cm.snapshotIndex - prevLogIndex; skip < len(newEntries) {
+				newEntries = newEntries[skip:]
+			} else {
+				newEntries = nil
+			}
+			prevLogIndex, prevLogTerm = cm.snapshotIndex, cm.snapshotTerm
+		}
+		lastLogIndex, _ := cm.lastLogIndexAndTerm()
+		reply.Hinted, reply.LastLogIndex = true, lastLogIndex
 
 		// Does our log contain an entry at PrevLogIndex whose term matches
 		// PrevLogTerm? Note that in the extreme case of PrevLogIndex=-1 this is
 		// vacuously true.
-		if args.PrevLogIndex == -1 ||
-			(args.PrevLogIndex < len(cm.log) && args.PrevLogTerm == cm.log[args.PrevLogIndex].Term) {
-			reply.Success = true
+		if prevLogIndex == -1 ||
+			(prevLogIndex <= lastLogIndex && prevLogTerm == cm.entryTerm(prevLogIndex)) {
 
 			// Find an insertion point - where there's a term mismatch between
 			// the existing log starting at PrevLogIndex+1 and the new entries sent
 			// in the RPC.
-			logInsertIndex := args.PrevLogIndex + 1
+			logInsertIndex := prevLogIndex + 1
 			newEntriesIndex := 0
 
 			for {
-				if logInsertIndex >= len(cm.log) || newEntriesIndex >= len(args.Entries) {
+				if logInsertIndex > lastLogIndex || newEntriesIndex >= len(newEntries) {
 					break
 				}
-				if cm.log[logInsertIndex].Term != args.Entries[newEntriesIndex].Term {
+				if cm.entryTerm(logInsertIndex) != newEntries[newEntriesIndex].Term {
 					break
 				}
 				logInsertIndex++
@@ -323,18 +1045,41 @@ func (cm *ConsensusModule) AppendEntries(args AppendEntriesArgs, reply *AppendEn
 			//   term mismatches with an entry from the leader
 			// - newEntriesIndex points at the end of Entries, or an index where the
 			//   term mismatches with the corresponding log entry
-			if newEntriesIndex < len(args.Entries) {
-				cm.raftLog("... inserting entries %v from index %d", args.Entries[newEntriesIndex:], logInsertIndex)
-				cm.log = append(cm.log[:logInsertIndex], args.Entries[newEntriesIndex:]...)
+			if newEntriesIndex < len(newEntries) {
+				cm.raftLog("... inserting entries %v from index %d", newEntries[newEntriesIndex:], logInsertIndex)
+				// Entries are only acknowledged once they're durable; the leader
+				// will retry them if persisting fails.
+				var err error
+				if termSaved {
+					err = cm.persistEntries(logInsertIndex, newEntries[newEntriesIndex:])
+				} else if err = cm.persistState(logInsertIndex, newEntries[newEntriesIndex:]); err == nil {
+					termSaved = true
+				}
+				if err != nil {
+					cm.raftLog("... failed to persist entries: %v", err)
+					reply.Term = cm.currentTerm
+					return nil
+				}
+				truncated := cm.log[logInsertIndex-cm.snapshotIndex-1:]
+				changed := hasConfigChange(truncated) || hasConfigChange(newEntries[newEntriesIndex:])
+				cm.log = append(cm.log[:logInsertIndex-cm.snapshotIndex-1], newEntries[newEntriesIndex:]...)
 				cm.raftLog("... log is now: %v", cm.log)
+				if changed {
+					cm.updateMembership()
+				}
 			}
+			reply.Success = true
 
-			// Set commit index.
-			if args.LeaderCommit > cm.commitIndex {
-				cm.commitIndex = intMin(args.LeaderCommit, len(cm.log)-1)
+			// Set commit index. Only the entries up to the last one sent are
+			// known to match the leader's: the ones following it may be
+			// stale, when the leader held entries back from a lagging
+			// follower.
+			if lastNewIndex := prevLogIndex + len(newEntries); args.LeaderCommit > cm.commitIndex && lastNewIndex > cm.commitIndex {
+				cm.commitIndex = intMin(args.LeaderCommit, lastNewIndex)
 				cm.raftLog("... setting commitIndex=%d", cm.commitIndex)
-				cm.newCommitReadyChan <- struct{}{}
+				cm.notifyCommit()
 			}
+			cm.noteContact(args.LeaderCommit)
 		}
 	}
 
@@ -343,190 +1088,368 @@ func (cm *ConsensusModule) AppendEntries(args AppendEntriesArgs, reply *AppendEn
 	return nil
 }
 
+// InstallSnapshotArgs carries a chunk of the leader's snapshot. See figure
+// 13 in the paper.
+type InstallSnapshotArgs struct {
+	ProtocolVersion int
+	GroupId         int
+	Term            int
+	LeaderId        ServerID
+
+	LastIncludedIndex int
+	LastIncludedTerm  int
+
+	// Offset is where Data starts in the snapshot, and Done is set on the
+	// last chunk.
+	Offset int
+	Data   []byte
+	Done   bool
+}
+
+type InstallSnapshotReply struct {
+	Term int
+
+	// Offset is where the follower expects the next chunk to start. It
+	// differs from the end of the chunk sent if the follower didn't get the
+	// previous chunks, or already had this one.
+	Offset int
+
+	// Installed is set once the follower holds the snapshot, or a later one.
+	Installed bool
+}
+
+func (cm *ConsensusModule) InstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.state == Dead {
+		return nil
+	}
+	cm.raftLog("InstallSnapshot: index=%d, term=%d, offset=%d, %d bytes, done=%v", args.LastIncludedIndex, args.LastIncludedTerm, args.Offset, len(args.Data), args.Done)
+
+	if args.Term > cm.currentTerm {
+		cm.raftLog("... term out of date in InstallSnapshot")
+		cm.becomeFollower(args.Term)
+		if cm.state == Dead {
+			return nil
+		}
+	}
+	reply.Term = cm.currentTerm
+	if args.Term < cm.currentTerm {
+		return nil
+	}
+	if cm.state != Follower {
+		cm.becomeFollower(args.Term)
+		if cm.state == Dead {
+			return nil
+		}
+	}
+	cm.electionResetEvent = time.Now()
+	cm.lastContact = cm.electionResetEvent
+	cm.leaderId = args.LeaderId
+	cm.observeLeader()
+
+	if args.LastIncludedIndex <= cm.snapshotIndex {
+		reply.Installed = true
+		return nil
+	}
+	pending := cm.pendingSnapshot
+	if pending == nil || pending.index != args.LastIncludedIndex || pending.term != args.LastIncludedTerm {
+		// A new snapshot replaces the one being received.
+		pending = &pendingSnapshot{index: args.LastIncludedIndex, term: args.LastIncludedTerm}
+		cm.pendingSnapshot = pending
+	}
+	if args.Offset != len(pending.data) {
+		cm.raftLog("... expected offset %d", len(pending.data))
+		reply.Offset = len(pending.data)
+		return nil
+	}
+	pending.data = append(pending.data, args.Data...)
+	reply.Offset = len(pending.data)
+	if !args.Done {
+		return nil
+	}
+
+	cm.pendingSnapshot = nil
+	snap := storage.Snapshot{Index: pending.index, Term: pending.term, Data: pending.data}
+	header, _, hasHeader, err := readSnapshotHeader(snap.Data)
+	if err == nil {
+		err = header.check(snap.Index, snap.Term)
+	}
+	if err != nil {
+		cm.raftLog("... received a bad snapshot: %v", err)
+		reply.Offset = 0
+		return nil
+	}
+	if err := cm.storage.SaveSnapshot(snap); err != nil {
+		// The leader will send the snapshot again.
+		cm.raftLog("... failed to persist snapshot: %v", err)
+		reply.Offset = 0
+		return nil
+	}
+	// Keep the entries following the snapshot if our log agrees with it, as
+	// the storage does.
+	lastLogIndex, _ := cm.lastLogIndexAndTerm()
+	if snap.Index <= lastLogIndex && cm.entryTerm(snap.Index) == snap.Term {
+		cm.log = append([]LogEntry(nil), cm.log[snap.Index-cm.snapshotIndex:]...)
+	} else {
+		cm.log = nil
+	}
+	cm.snapshotIndex = snap.Index
+	cm.snapshotTerm = snap.Term
+	if hasHeader {
+		cm.basePeers = header.Members
+	} else {
+		cm.basePeers = cm.initialPeers()
+	}
+	cm.updateMembership()
+	if snap.Index > cm.commitIndex {
+		cm.commitIndex = snap.Index
+	}
+	cm.raftLog("... installed snapshot; log is now: %v", cm.log)
+	reply.Installed = true
+	cm.notifyCommit()
+	return nil
+}
+
 // electionTimeout generates a pseudo-random election timeout duration.
 func (cm *ConsensusModule) electionTimeout() time.Duration {
-	return time.Duration(150+rand.Intn(150)) * time.Millisecond
+	spread := cm.config.ElectionTimeoutMax - cm.config.ElectionTimeoutMin
+	if spread <= 0 {
+		return cm.config.ElectionTimeoutMin
+	}
+	cm.randMu.Lock()
+	defer cm.randMu.Unlock()
+	return cm.config.ElectionTimeoutMin + time.Duration(cm.rand.Int63n(int64(spread)))
 }
 
-// runElectionTimer implements an election timer. It should be launched whenever
-// we want to start a timer towards becoming a candidate in a new election.
-//
-// This function is blocking and should be launched in a separate goroutine;
-// it's designed to work for a single (one-shot) election timer, as it exits
-// whenever the CM state changes from follower/candidate or the term changes.
-func (cm *ConsensusModule) runElectionTimer() {
-	timeoutDuration := cm.electionTimeout()
-	cm.mu.Lock()
-	termStarted := cm.currentTerm
-	cm.mu.Unlock()
-	cm.raftLog("election timer started (%v), term=%d", timeoutDuration, termStarted)
+// newCMRand returns the random generator of the CM of group groupId on server
+// id. With a zero seed, it's seeded from the clock. Otherwise it's seeded with
+// seed mixed with id and groupId, so that the CMs of a cluster sharing a seed
+// draw different, but reproducible, timeouts.
+func newCMRand(seed int64, id ServerID, groupId int) *rand.Rand {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s/%d", id, groupId)
+	return rand.New(rand.NewSource(seed ^ int64(h.Sum64())))
+}
 
-	// This loops until either:
-	// - we discover the election timer is no longer needed, or
-	// - the election timer expires and this CM becomes a candidate
-	// In a follower, this typically keeps running in the background for the
-	// duration of the CM's lifetime.
+// run is the timer loop of cm, started once its peers are ready. While cm
+// follows or campaigns, it starts an election when the election timeout
+// elapses without hearing from a leader; while cm leads, it starts a round of
+// AEs every heartbeat interval, and whenever triggerAE asks for one. All the
+// timers of cm are served by this one goroutine, rather than by one per
+// election and one per leadership. Only the timers are: the RPC handlers and
+// the submissions lock cm.mu from their own goroutines, and leaderSendAEs
+// sends each AE from a goroutine of its own.
+func (cm *ConsensusModule) run() {
 	ticker := time.NewTicker(10 * time.Millisecond)
 	defer ticker.Stop()
+	heartbeat := time.NewTimer(cm.heartbeatInterval())
+	defer heartbeat.Stop()
+
+	// timeout is the election timeout drawn when cm entered timeoutState in
+	// timeoutTerm. A new one is drawn whenever either changes.
+	var timeout time.Duration
+	timeoutState, timeoutTerm := Dead, -1
 	for {
-		<-ticker.C
+		select {
+		case <-ticker.C:
+		case <-heartbeat.C:
+			heartbeat.Reset(cm.heartbeatInterval())
+			cm.leaderSendAEs()
+			continue
+		case <-cm.triggerAEChan:
+			if !heartbeat.Stop() {
+				<-heartbeat.C
+			}
+			heartbeat.Reset(cm.heartbeatInterval())
+			cm.leaderSendAEs()
+			continue
+		case <-cm.done:
+			return
+		}
 
 		cm.mu.Lock()
 		if cm.state != Candidate && cm.state != Follower {
-			cm.raftLog("in election timer state=%s, bailing out", cm.state)
 			cm.mu.Unlock()
-			return
+			continue
 		}
-
-		if termStarted != cm.currentTerm {
-			cm.raftLog("in election timer term changed from %d to %d, bailing out", termStarted, cm.currentTerm)
-			cm.mu.Unlock()
-			return
+		if cm.state != timeoutState || cm.currentTerm != timeoutTerm {
+			timeout = cm.electionTimeout()
+			timeoutState, timeoutTerm = cm.state, cm.currentTerm
+			cm.raftLog("election timer started (%v), term=%d", timeout, cm.currentTerm)
 		}
 
 		// Start an election if we haven't heard from a leader or haven't voted for
 		// someone for the duration of the timeout.
-		if elapsed := time.Since(cm.electionResetEvent); elapsed >= timeoutDuration {
-			cm.startElection()
-			cm.mu.Unlock()
-			return
+		if elapsed := time.Since(cm.electionResetEvent); elapsed >= timeout {
+			if cm.canCampaign() {
+				cm.startElection()
+			} else {
+				cm.electionResetEvent = time.Now()
+			}
 		}
 		cm.mu.Unlock()
 	}
 }
 
+// canCampaign reports whether cm may stand for election. Servers that were
+// removed, or not added yet, would only disrupt the group; witnesses can't
+// lead, as they don't have the commands; and servers in maintenance mode or
+// shutting down are about to go down.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) canCampaign() bool {
+	_, member := cm.peerIds[cm.id]
+	return member && !cm.witness && !cm.maintenance && !cm.draining && !cm.applyFailed
+}
+
 // startElection starts a new election with this CM as a candidate.
 // Expects cm.mu to be locked.
 func (cm *ConsensusModule) startElection() {
+	cm.observeCampaign()
+	ctx := cm.newRole()
 	cm.state = Candidate
+	cm.leaderId = NoServer
 	cm.currentTerm += 1
 	savedCurrentTerm := cm.currentTerm
 	cm.electionResetEvent = time.Now()
 	cm.votedFor = cm.id
+	if err := cm.persistHardState(); err != nil {
+		cm.raftLog("failed to persist candidacy: %v", err)
+		cm.stop()
+		return
+	}
 	cm.raftLog("becomes Candidate (currentTerm=%d); log=%v", savedCurrentTerm, cm.log)
 
-	votesReceived := 1
+	cm.newElection()
+	if cm.state != Candidate {
+		// A single-server cluster elects itself.
+		return
+	}
 
 	// Send RequestVote RPCs to all other servers concurrently.
 	for _, peerId := range cm.peerIds {
-		go func(peerId int) {
-			cm.mu.Lock()
+		if peerId == cm.id {
+			continue
+		}
+		peerId := peerId
+		cm.spawn(func() {
+			cm.mu.Lock()
 			savedLastLogIndex, savedLastLogTerm := cm.lastLogIndexAndTerm()
 			cm.mu.Unlock()
 
 			args := RequestVoteArgs{
+				GroupId:      cm.groupId,
 				Term:         savedCurrentTerm,
 				CandidateId:  cm.id,
 				LastLogIndex: savedLastLogIndex,
 				LastLogTerm:  savedLastLogTerm,
 			}
 
-			cm.raftLog("sending RequestVote to %d: %+v", peerId, args)
+			cm.raftLog("sending RequestVote to %s: %+v", peerId, args)
 			var reply RequestVoteReply
-			if err := cm.server.Call(peerId, "ConsensusModule.RequestVote", args, &reply); err == nil {
+			if err := cm.server.Call(ctx, peerId, "ConsensusModule.RequestVote", args, &reply); err == nil {
 				cm.mu.Lock()
 				defer cm.mu.Unlock()
 				cm.raftLog("received RequestVoteReply %+v", reply)
-
-				if cm.state != Candidate {
-					cm.raftLog("while waiting for reply, state = %v", cm.state)
-					return
-				}
-
-				if reply.Term > savedCurrentTerm {
-					cm.raftLog("term out of date in RequestVoteReply")
-					cm.becomeFollower(reply.Term)
-					return
-				} else if reply.Term == savedCurrentTerm {
-					if reply.VoteGranted {
-						votesReceived += 1
-						if votesReceived*2 > len(cm.peerIds)+1 {
-							// Won the election!
-							cm.raftLog("wins election with %d votes", votesReceived)
-							cm.startLeader()
-							return
-						}
-					}
-				}
+				cm.recordVote(savedCurrentTerm, peerId, reply)
 			} else {
-				cm.raftLog("error sending RequestVote to %d: %v", peerId, err)
+				cm.raftLog("error sending RequestVote to %s: %v", peerId, err)
 			}
-		}(peerId)
+		})
 	}
+}
 
-	// Run another election timer, in case this election is not successful.
-	go cm.runElectionTimer()
+// newRole cancels the RPCs cm sent in its current role and term, and returns
+// the context of those of the next one.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) newRole() context.Context {
+	cm.cancelRole()
+	cm.roleCtx, cm.cancelRole = context.WithCancel(context.Background())
+	return cm.roleCtx
 }
 
-// becomeFollower makes cm a follower and resets its state.
+// becomeFollower makes cm a follower and resets its state, as stepDown does,
+// and persists its term. It stops cm if that fails.
 // Expects cm.mu to be locked.
 func (cm *ConsensusModule) becomeFollower(term int) {
+	if cm.state == Dead {
+		return
+	}
+	cm.stepDown(term)
+	if err := cm.persistHardState(); err != nil {
+		cm.raftLog("failed to persist term: %v", err)
+		cm.stop()
+	}
+}
+
+// stepDown makes cm a follower in term and resets its state, without
+// persisting it: the caller persists the term, along with whatever else it
+// saves, before acting on it. The vote of cm is only reset when term is a
+// new one, so that a candidate stepping down in its own term doesn't vote
+// again in it.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) stepDown(term int) {
+	if cm.state == Dead {
+		// Replies to RPCs sent before cm stopped must not revive it.
+		return
+	}
 	cm.raftLog("becomes Follower with term=%d; log=%v", term, cm.log)
+	if cm.state != Follower || term != cm.currentTerm {
+		cm.newRole()
+	}
+	if cm.state == Leader {
+		cm.notifyLeader(false)
+		cm.failReads()
+	} else if cm.state == Candidate {
+		cm.observeDefeat()
+	}
 	cm.state = Follower
+	if term > cm.currentTerm {
+		cm.leaderId = NoServer
+		cm.votedFor = NoServer
+	}
 	cm.currentTerm = term
-	cm.votedFor = -1
 	cm.electionResetEvent = time.Now()
-
-	go cm.runElectionTimer()
 }
 
 // startLeader switches cm into a leader state and begins process of heartbeats.
 // Expects cm.mu to be locked.
 func (cm *ConsensusModule) startLeader() {
+	cm.newRole()
 	cm.state = Leader
+	cm.leaderId = cm.id
+	cm.observeElected()
+	cm.notifyLeader(true)
 
+	lastLogIndex, _ := cm.lastLogIndexAndTerm()
 	for _, peerId := range cm.peerIds {
-		cm.nextIndex[peerId] = len(cm.log)
+		cm.nextIndex[peerId] = lastLogIndex + 1
 		cm.matchIndex[peerId] = -1
 	}
+	cm.snapshotTransfers = make(map[ServerID]*snapshotTransfer)
+	cm.acks = make(map[ServerID]time.Time)
+	cm.probing = make(map[ServerID]bool)
+	cm.lagAlerted = make(map[ServerID]bool)
+	cm.sending = make(map[ServerID]bool)
+	cm.resend = make(map[ServerID]bool)
+	for _, peerId := range cm.peerIds {
+		cm.probing[peerId] = true
+	}
 	cm.raftLog("becomes Leader; term=%d, nextIndex=%v, matchIndex=%v; log=%v", cm.currentTerm, cm.nextIndex, cm.matchIndex, cm.log)
 
-	// This goroutine runs in the background and sends AEs to peers.
-	go cm.runAEsTimer(50 * time.Millisecond)
-}
-
-// runAEsTimer implements the leader's background loop that sends AEs to peers.
-// This function is blocking and should be launched in a separate goroutine;
-// it will exit when the CM state changes to follower/candidate.
-func (cm *ConsensusModule) runAEsTimer(heartbeatTimeout time.Duration) {
-	// Immediately send AEs to peers.
-	cm.leaderSendAEs()
-	ticker := time.NewTimer(heartbeatTimeout)
-	defer ticker.Stop()
-	for {
-		doSend := false
-		select {
-		case <-ticker.C:
-			doSend = true
-
-			// Reset timer to fire again after heartbeatTimeout.
-			ticker.Stop()
-			ticker.Reset(heartbeatTimeout)
-		case _, ok := <-cm.triggerAEChan:
-			if ok {
-				doSend = true
-			} else {
-				return
-			}
-
-			// Reset timer for heartbeatTimeout.
-			if !ticker.Stop() {
-				<-ticker.C
-			}
-			ticker.Reset(heartbeatTimeout)
-		}
-
-		if doSend {
-			// If this isn't a leader anymore, stop the heartbeat loop.
-			cm.mu.Lock()
-			if cm.state != Leader {
-				cm.mu.Unlock()
-				return
-			}
-			cm.mu.Unlock()
-			cm.leaderSendAEs()
-		}
-
+	// The timer loop sends the first round of AEs right away, and the next
+	// ones every heartbeat.
+	cm.triggerAE()
+	if cm.config.PreferredZone != "" && cm.zone != cm.config.PreferredZone {
+		term := cm.currentTerm
+		cm.spawn(func() { cm.runZonePreference(term) })
+	}
+	if cm.config.DeadPeerTimeout > 0 {
+		term := cm.currentTerm
+		cm.spawn(func() { cm.runDeadPeerRemoval(term) })
 	}
 }
 
@@ -539,97 +1462,345 @@ func (cm *ConsensusModule) leaderSendAEs() {
 		return
 	}
 	savedCurrentTerm := cm.currentTerm
-	cm.mu.Unlock()
-
-	for _, peerId := range cm.peerIds {
-		cm.mu.Lock()
-		if cm.id == peerId {
-			cm.mu.Unlock()
+	peerIds := make([]ServerID, 0, len(cm.peerIds))
+	for peerId := range cm.peerIds {
+		if peerId != cm.id {
+			peerIds = append(peerIds, peerId)
+		}
+	}
+	if len(peerIds) == 0 {
+		// A group of one is its own majority, and commits the entries of its
+		// term as soon as they're persisted.
+		cm.lastContact = cm.quorumContact(time.Now())
+		cm.updateFreshness()
+		cm.confirmReads()
+		savedCommitIndex := cm.commitIndex
+		if lastLogIndex, lastLogTerm := cm.lastLogIndexAndTerm(); cm.isQuorum(1) && lastLogTerm == cm.currentTerm && lastLogIndex > savedCommitIndex {
+			cm.commitIndex = lastLogIndex
+			cm.raftLog("leader sets commitIndex := %d", cm.commitIndex)
+			cm.markCommitted(savedCommitIndex+1, cm.commitIndex)
+			cm.notifyCommit()
+		}
+	}
+	cm.checkLag()
+	for _, peerId := range peerIds {
+		peerId := peerId
+		if cm.sending[peerId] {
+			cm.resend[peerId] = true
 			continue
 		}
-		cm.mu.Unlock()
-		go func(peerId int) {
+		cm.sending[peerId] = true
+		cm.spawn(func() {
+			cm.sendAE(peerId, savedCurrentTerm)
 			cm.mu.Lock()
-			ni := cm.nextIndex[peerId]
-			prevLogIndex := ni - 1
-			prevLogTerm := -1
-			if prevLogIndex >= 0 {
-				prevLogTerm = cm.log[prevLogIndex].Term
+			defer cm.mu.Unlock()
+			delete(cm.sending, peerId)
+			if cm.resend[peerId] {
+				delete(cm.resend, peerId)
+				cm.triggerAE()
 			}
-			entries := cm.log[ni:]
+		})
+	}
+	cm.mu.Unlock()
+}
 
-			args := AppendEntriesArgs{
-				Term:         savedCurrentTerm,
-				LeaderId:     cm.id,
-				PrevLogIndex: prevLogIndex,
-				PrevLogTerm:  prevLogTerm,
-				Entries:      entries,
-				LeaderCommit: cm.commitIndex,
-			}
-			cm.mu.Unlock()
-			cm.raftLog("sending AppendEntries to %v: ni=%d, args=%+v", peerId, ni, args)
-			var reply AppendEntriesReply
-			if err := cm.server.Call(peerId, "ConsensusModule.AppendEntries", args, &reply); err == nil {
-				cm.mu.Lock()
-				defer cm.mu.Unlock()
-				if reply.Term > cm.currentTerm {
-					cm.raftLog("term out of date in heartbeat reply")
-					cm.becomeFollower(reply.Term)
-					return
-				}
+// sendAE sends an AE of term savedCurrentTerm to peerId, or starts sending it
+// the snapshot if the entries it needs were compacted, and handles the reply.
+func (cm *ConsensusModule) sendAE(peerId ServerID, savedCurrentTerm int) {
+	cm.mu.Lock()
+	ni := cm.nextIndex[peerId]
+	if ni <= cm.snapshotIndex {
+		// The entries the peer needs were compacted.
+		cm.startSnapshotTransfer(peerId, savedCurrentTerm)
+		cm.mu.Unlock()
+		return
+	}
+	prevLogIndex := ni - 1
+	prevLogTerm := -1
+	if prevLogIndex >= 0 {
+		prevLogTerm = cm.entryTerm(prevLogIndex)
+	}
+	entries := cm.log[ni-cm.snapshotIndex-1:]
+	witness := cm.witnesses[peerId]
+	ctx := cm.roleCtx
+
+	args := AppendEntriesArgs{
+		GroupId:      cm.groupId,
+		Term:         savedCurrentTerm,
+		LeaderId:     cm.id,
+		PrevLogIndex: prevLogIndex,
+		PrevLogTerm:  prevLogTerm,
+		LeaderCommit: cm.commitIndex,
+	}
+	cm.mu.Unlock()
+	for i, entry := range entries {
+		if err := verifyChecksum(ni+i, entry); err != nil {
+			// A corrupted log must not be replicated.
+			cm.raftLog("%v", err)
+			cm.halt()
+			return
+		}
+		cc, isConfig := entry.Command.(configChange)
+		chunk, isChunk := entry.Command.(commandChunk)
+		barrier, isBarrier := entry.Command.(stateBarrier)
+		var command []byte
+		var token string
+		var err error
+		switch {
+		case isConfig:
+			command, err = encodeConfigChange(cc)
+		case witness:
+			// Witnesses only need the term of the entry.
+		case isChunk:
+			command, err = encodeChunk(chunk)
+		case isBarrier:
+			command, err = encodeStateBarrier(barrier)
+		default:
+			command, token, err = encodeCommand(cm.codec, entry.Command)
+		}
+		if err != nil {
+			cm.raftLog("failed to encode entry %d for %s: %v", ni+i, peerId, err)
+			return
+		}
+		// A peer catching up on committed entries gets as many as the
+		// rate limit allows. New entries only follow once it has
+		// caught up, and the AE is still a heartbeat otherwise.
+		if ni+i <= args.LeaderCommit && !cm.catchUpLimiter.allow(len(command)) {
+			break
+		}
+		args.Entries = append(args.Entries, WireEntry{
+			Command:  command,
+			Term:     entry.Term,
+			Config:   isConfig,
+			Chunk:    isChunk && !witness,
+			Barrier:  isBarrier && !witness,
+			Token:    token,
+			Checksum: wireChecksum(entry.Term, command, token),
+			Stripped: witness && !isConfig,
+		})
+	}
+	cm.raftLog("sending AppendEntries to %s: ni=%d, args=%+v", peerId, ni, args)
+	sentAt := time.Now()
+	var reply AppendEntriesReply
+	if err := cm.server.Call(ctx, peerId, "ConsensusModule.AppendEntries", args, &reply); err == nil {
+		cm.mu.Lock()
+		defer cm.mu.Unlock()
+		if cm.state == Dead {
+			return
+		}
+		cm.observeAE(peerId, time.Since(sentAt), true)
+		if reply.Witness && !cm.witnesses[peerId] {
+			cm.raftLog("%s is a witness", peerId)
+			cm.witnesses[peerId] = true
+		}
+		cm.zones[peerId] = reply.Zone
+		if reply.Term > cm.currentTerm {
+			cm.raftLog("term out of date in heartbeat reply")
+			cm.becomeFollower(reply.Term)
+			return
+		}
 
-				if cm.state == Leader && savedCurrentTerm == reply.Term {
-					if reply.Success {
-						cm.nextIndex[peerId] = ni + len(entries)
-						cm.matchIndex[peerId] = cm.nextIndex[peerId] - 1
-
-						savedCommitIndex := cm.commitIndex
-						for i := cm.commitIndex + 1; i < len(cm.log); i++ {
-							if cm.log[i].Term == cm.currentTerm {
-								matchCount := 1
-								for _, peerId := range cm.peerIds {
-									if cm.matchIndex[peerId] >= i {
-										matchCount++
-									}
-								}
-								if matchCount*2 > len(cm.peerIds)+1 {
-									cm.commitIndex = i
-								}
+		if cm.state == Leader && savedCurrentTerm == reply.Term {
+			if sentAt.After(cm.acks[peerId]) {
+				cm.acks[peerId] = sentAt
+				cm.lastContact = cm.quorumContact(time.Now())
+				cm.updateFreshness()
+				cm.confirmReads()
+			}
+			if reply.Success {
+				delete(cm.probing, peerId)
+				cm.nextIndex[peerId] = ni + len(args.Entries)
+				cm.matchIndex[peerId] = cm.nextIndex[peerId] - 1
+
+				savedCommitIndex := cm.commitIndex
+				lastLogIndex, _ := cm.lastLogIndexAndTerm()
+				for i := cm.commitIndex + 1; i <= lastLogIndex; i++ {
+					if cm.entryTerm(i) == cm.currentTerm {
+						matchCount := 1
+						for _, peerId := range cm.peerIds {
+							if cm.matchIndex[peerId] >= i {
+								matchCount++
 							}
 						}
-						cm.raftLog("AppendEntries reply from %d success: nextIndex := %v, matchIndex := %v; commitIndex := %d", peerId, cm.nextIndex, cm.matchIndex, cm.commitIndex)
-						if cm.commitIndex != savedCommitIndex {
-							cm.raftLog("leader sets commitIndex := %d", cm.commitIndex)
-							// Commit index changed: the leader considers new entries to be
-							// committed. Send new entries on the commit channel to this
-							// leader's clients, and notify followers by sending them AEs.
-							cm.newCommitReadyChan <- struct{}{}
-							cm.triggerAEChan <- struct{}{}
+						if cm.isQuorum(matchCount) {
+							cm.commitIndex = i
 						}
-					} else {
-						cm.nextIndex[peerId] = ni - 1
-						cm.raftLog("AppendEntries reply from %d !success: nextIndex := %d", peerId, ni-1)
 					}
 				}
+				cm.raftLog("AppendEntries reply from %s success: nextIndex := %v, matchIndex := %v; commitIndex := %d", peerId, cm.nextIndex, cm.matchIndex, cm.commitIndex)
+				if cm.commitIndex != savedCommitIndex {
+					cm.raftLog("leader sets commitIndex := %d", cm.commitIndex)
+					cm.markCommitted(savedCommitIndex+1, cm.commitIndex)
+					// Commit index changed: the leader considers new entries to be
+					// committed. Send new entries on the commit channel to this
+					// leader's clients, and notify followers by sending them AEs.
+					cm.notifyCommit()
+					cm.triggerAE()
+				}
 			} else {
-				cm.raftLog("AppendEntries RPC to %d failed: %v", peerId, err)
+				cm.probing[peerId] = true
+				cm.nextIndex[peerId] = ni - 1
+				if reply.Hinted && reply.LastLogIndex+1 < ni-1 {
+					// The follower lacks all the entries in between.
+					cm.nextIndex[peerId] = reply.LastLogIndex + 1
+				}
+				cm.raftLog("AppendEntries reply from %s !success: nextIndex := %d", peerId, cm.nextIndex[peerId])
+				if cm.nextIndex[peerId] <= cm.snapshotIndex {
+					// The entries the follower needs were compacted;
+					// it's sent the snapshot instead.
+					cm.startSnapshotTransfer(peerId, savedCurrentTerm)
+				} else if reply.Hinted {
+					cm.triggerAE()
+				}
 			}
-		}(peerId)
+		}
+	} else if ctx.Err() != nil {
+		// The leader stepped down; that's no failure of the peer.
+		cm.raftLog("AppendEntries RPC to %s cancelled: %v", peerId, err)
+	} else {
+		cm.raftLog("AppendEntries RPC to %s failed: %v", peerId, err)
+		cm.mu.Lock()
+		cm.observeAE(peerId, 0, false)
+		cm.mu.Unlock()
+	}
+}
+
+// isQuorum reports whether count servers, this one included, are a majority
+// of the membership. A CM that isn't a member, such as a leader that removed
+// itself, doesn't count.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) isQuorum(count int) bool {
+	if _, member := cm.peerIds[cm.id]; !member {
+		count--
+	}
+	return count*2 > len(cm.peerIds)
+}
+
+// triggerAE asks the timer loop to send a round of AEs. It never blocks: if a
+// round is already pending, it will carry whatever was appended since.
+func (cm *ConsensusModule) triggerAE() {
+	select {
+	case cm.triggerAEChan <- struct{}{}:
+	default:
+	}
+}
+
+// startSnapshotTransfer starts sending the snapshot to peerId, unless it's
+// already being sent.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) startSnapshotTransfer(peerId ServerID, term int) {
+	transfer := cm.snapshotTransfers[peerId]
+	if transfer != nil && transfer.active {
+		return
+	}
+	if transfer == nil || transfer.index != cm.snapshotIndex {
+		transfer = &snapshotTransfer{index: cm.snapshotIndex}
+		cm.snapshotTransfers[peerId] = transfer
+	}
+	transfer.active = true
+	ctx := cm.roleCtx
+	cm.spawn(func() { cm.sendSnapshot(ctx, peerId, term, transfer) })
+}
+
+// sendSnapshot sends the snapshot to peerId in chunks of SnapshotChunkSize,
+// starting at the offset of transfer. It returns once the peer installed it,
+// an RPC fails or cm is no longer the leader of term, which cancels ctx; the
+// next heartbeat resumes a failed transfer.
+func (cm *ConsensusModule) sendSnapshot(ctx context.Context, peerId ServerID, term int, transfer *snapshotTransfer) {
+	defer func() {
+		cm.mu.Lock()
+		transfer.active = false
+		cm.mu.Unlock()
+	}()
+	snap, ok, err := cm.storage.Snapshot()
+	if err != nil || !ok || snap.Index != transfer.index {
+		// A newer snapshot replaced it; the next heartbeat sends that one.
+		cm.raftLog("can't read snapshot %d for %s: ok=%v, err=%v", transfer.index, peerId, ok, err)
+		cm.mu.Lock()
+		delete(cm.snapshotTransfers, peerId)
+		cm.mu.Unlock()
+		return
+	}
+
+	cm.mu.Lock()
+	offset := transfer.offset
+	witness := cm.witnesses[peerId]
+	cm.mu.Unlock()
+	if witness {
+		if snap.Data, err = stripSnapshot(snap.Data); err != nil {
+			cm.raftLog("can't strip snapshot %d for %s: %v", transfer.index, peerId, err)
+			return
+		}
+	}
+	offset = intMin(offset, len(snap.Data))
+	for {
+		end := intMin(offset+cm.config.SnapshotChunkSize, len(snap.Data))
+		args := InstallSnapshotArgs{
+			GroupId:           cm.groupId,
+			Term:              term,
+			LeaderId:          cm.id,
+			LastIncludedIndex: snap.Index,
+			LastIncludedTerm:  snap.Term,
+			Offset:            offset,
+			Data:              snap.Data[offset:end],
+			Done:              end == len(snap.Data),
+		}
+		cm.catchUpLimiter.wait(end - offset)
+		cm.raftLog("sending InstallSnapshot to %s: index=%d, offset=%d, %d bytes", peerId, snap.Index, offset, end-offset)
+		var reply InstallSnapshotReply
+		if err := cm.server.Call(ctx, peerId, "ConsensusModule.InstallSnapshot", args, &reply); err != nil {
+			cm.raftLog("InstallSnapshot RPC to %s failed: %v", peerId, err)
+			return
+		}
+
+		cm.mu.Lock()
+		if reply.Term > cm.currentTerm {
+			cm.raftLog("term out of date in InstallSnapshot reply")
+			cm.becomeFollower(reply.Term)
+			cm.mu.Unlock()
+			return
+		}
+		if cm.state != Leader || cm.currentTerm != term {
+			cm.mu.Unlock()
+			return
+		}
+		if reply.Installed {
+			cm.raftLog("InstallSnapshot reply from %s: installed %d", peerId, snap.Index)
+			cm.nextIndex[peerId] = intMax(cm.nextIndex[peerId], snap.Index+1)
+			cm.matchIndex[peerId] = intMax(cm.matchIndex[peerId], snap.Index)
+			delete(cm.snapshotTransfers, peerId)
+			cm.mu.Unlock()
+			return
+		}
+		offset = intMin(reply.Offset, len(snap.Data))
+		transfer.offset = offset
+		cm.mu.Unlock()
 	}
 }
 
 // lastLogIndexAndTerm returns the last log index and the last log entry's term
-// (or -1 if there's no log) for this server.
+// (or -1 if there's no log) for this server. An empty log following a
+// snapshot ends with the last entry the snapshot covers.
 // Expects cm.mu to be locked.
 func (cm *ConsensusModule) lastLogIndexAndTerm() (int, int) {
 	if len(cm.log) > 0 {
-		lastIndex := len(cm.log) - 1
-		return lastIndex, cm.log[lastIndex].Term
+		lastIndex := cm.snapshotIndex + len(cm.log)
+		return lastIndex, cm.log[len(cm.log)-1].Term
 	} else {
-		return -1, -1
+		return cm.snapshotIndex, cm.snapshotTerm
 	}
 }
 
+// entryTerm returns the term of the entry at index, which is either in the
+// log or the last one covered by the snapshot.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) entryTerm(index int) int {
+	if index == cm.snapshotIndex {
+		return cm.snapshotTerm
+	}
+	return cm.log[index-cm.snapshotIndex-1].Term
+}
+
 // commitChanSender is responsible for sending committed entries on
 // cm.commitChan. It watches newCommitReadyChan for notifications and calculates
 // which new entries are ready to be sent. This method should run in a separate
@@ -640,22 +1811,125 @@ func (cm *ConsensusModule) commitChanSender() {
 	for range cm.newCommitReadyChan {
 		// Find which entries we have to apply.
 		cm.mu.Lock()
+		if cm.applyFailed {
+			cm.mu.Unlock()
+			continue
+		}
+		var restore []byte
+		if cm.lastApplied < cm.snapshotIndex {
+			// A snapshot from the leader replaced entries that weren't
+			// applied yet.
+			snap, _, err := cm.storage.Snapshot()
+			if err != nil {
+				cm.raftLog("failed to read snapshot: %v", err)
+				cm.stop()
+				cm.mu.Unlock()
+				continue
+			}
+			restore = snap.Data
+			cm.lastApplied = snap.Index
+			// The results of the commands the snapshot covers are lost.
+			for index, p := range cm.proposals {
+				if index <= snap.Index {
+					close(p.resultChan)
+					delete(cm.proposals, index)
+				}
+			}
+		}
 		savedLastApplied := cm.lastApplied
 		var entries []LogEntry
 		if cm.commitIndex > cm.lastApplied {
-			entries = cm.log[cm.lastApplied+1 : cm.commitIndex+1]
-			cm.lastApplied = cm.commitIndex
+			// The application gets at most MaxApplyBatch entries at a time;
+			// the rest are left for the next round.
+			end := intMin(cm.commitIndex, cm.lastApplied+cm.config.MaxApplyBatch)
+			end = cm.barrierEnd(cm.lastApplied+1, end)
+			entries = cm.log[cm.lastApplied-cm.snapshotIndex : end-cm.snapshotIndex]
+			cm.lastApplied = end
 		}
 		cm.mu.Unlock()
+		if restore != nil {
+			cm.raftLog("commitChanSender restoring snapshot at %d", savedLastApplied)
+			s, ok := cm.app.(Snapshotter)
+			if !ok {
+				cm.raftLog("received a snapshot, but the application can't restore it")
+				cm.halt()
+				continue
+			}
+			header, appData, _, err := readSnapshotHeader(restore)
+			if err == nil {
+				err = restoreSnapshot(s, header, appData)
+			}
+			if err == nil {
+				cm.tokens.restore(header.Tokens)
+				cm.chunks.restore(header.Chunks)
+			}
+			if err != nil {
+				cm.raftLog("failed to restore snapshot: %v", err)
+				cm.halt()
+				continue
+			}
+		}
 		cm.raftLog("commitChanSender entries=%v, savedLastApplied=%d", entries, savedLastApplied)
+		if err := verifyChecksums(savedLastApplied+1, entries); err != nil {
+			cm.raftLog("%v", err)
+			cm.halt()
+			continue
+		}
 
+		results, panicked := cm.apply(entries, savedLastApplied+1)
+		if panicked != nil {
+			// Only the entries before the one that panicked were applied.
+			entries = entries[:panicked.index-savedLastApplied-1]
+		}
+		sum, checksummed := cm.checksumState(entries)
+		cm.mu.Lock()
+		if checksummed {
+			cm.recordStateChecksum(savedLastApplied+len(entries), sum)
+		}
 		for i, entry := range entries {
-			res := cm.app.ApplyCommand(entry.Command)
-			if cm.state == Leader {
-				cm.raftLog("leader sent commitChan entry=%+v", entry)
-				cm.committedResultChan <- CommittedResult{
-					Result: res,
-					Index:  savedLastApplied + i + 1,
+			index := savedLastApplied + i + 1
+			if p, ok := cm.proposals[index]; ok {
+				delete(cm.proposals, index)
+				if p.term == entry.Term {
+					cm.raftLog("delivering result of entry=%+v", entry)
+					cm.observeApplied(p)
+					p.resultChan <- results[i]
+				} else {
+					close(p.resultChan)
+				}
+			}
+		}
+		if applied := savedLastApplied + len(entries); applied > cm.appliedIndex {
+			cm.appliedIndex = applied
+			close(cm.appliedChan)
+			cm.appliedChan = make(chan struct{})
+		}
+		cm.updateFreshness()
+		if panicked != nil {
+			cm.mu.Unlock()
+			cm.handleApplyPanic(panicked)
+			continue
+		}
+		if cm.commitIndex > cm.lastApplied && cm.state != Dead {
+			cm.notifyCommit()
+		}
+		requests := cm.snapshotRequests
+		cm.snapshotRequests = nil
+		cm.mu.Unlock()
+		if s, ok := cm.app.(ConcurrentSnapshotter); ok {
+			if len(requests) > 0 || len(entries) > 0 {
+				cm.startSnapshot(s, savedLastApplied+len(entries), requests)
+			}
+		} else if s, ok := cm.app.(Snapshotter); ok {
+			applied := savedLastApplied + len(entries)
+			if len(requests) > 0 {
+				index, term, err := cm.takeSnapshot(s, applied, true)
+				for _, request := range requests {
+					request <- snapshotResult{index, term, err}
+				}
+			} else if len(entries) > 0 {
+				if _, _, err := cm.takeSnapshot(s, applied, false); err != nil {
+					cm.raftLog("%v", err)
 				}
 			}
 		}
@@ -663,9 +1937,407 @@ func (cm *ConsensusModule) commitChanSender() {
 	cm.raftLog("commitChanSender done")
 }
 
+// snapshotResult is the outcome of a TakeSnapshot request.
+type snapshotResult struct {
+	index int
+	term  int
+	err   error
+}
+
+// TakeSnapshot snapshots the application and compacts the log right away,
+// rather than once SnapshotThreshold entries were applied, for instance
+// before a maintenance or a backup. It returns the index and term of the last
+// entry the snapshot covers. If no entry was applied since the last snapshot,
+// that one is returned.
+func (cm *ConsensusModule) TakeSnapshot() (index int, term int, err error) {
+	if _, ok := cm.app.(Snapshotter); !ok {
+		return 0, 0, fmt.Errorf("raft: the application can't be snapshotted")
+	}
+	request := make(chan snapshotResult, 1)
+	cm.mu.Lock()
+	if cm.state == Dead {
+		cm.mu.Unlock()
+		return 0, 0, fmt.Errorf("raft: stopped")
+	}
+	if cm.applyFailed {
+		// commitChanSender no longer serves the requests.
+		cm.mu.Unlock()
+		return 0, 0, ErrApplyFailed
+	}
+	// commitChanSender owns the application; it takes the snapshot between
+	// two batches of commands.
+	cm.snapshotRequests = append(cm.snapshotRequests, request)
+	cm.notifyCommit()
+	cm.mu.Unlock()
+	result := <-request
+	return result.index, result.term, result.err
+}
+
+// apply applies entries, the first of which has index first, to the
+// application and returns their results. A BatchApplier gets them in a
+// single call. If the application panics, the panic is returned, and only the
+// results of the entries before panicked.index are set.
+// Membership changes were applied when appended; their result is nil. The
+// commands whose token was applied before aren't applied again; their result
+// is the earlier one's. A chunked command is applied with its last part; the
+// other parts have nil results.
+func (cm *ConsensusModule) apply(entries []LogEntry, first int) (results []interface{}, panicked *applyPanic) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	entries = cm.assemble(entries)
+	results = make([]interface{}, len(entries))
+	// current is the entry being applied, or the first of the batch.
+	current := first
+	defer recoverApply(&current, &panicked)
+	if b, ok := cm.app.(BatchApplier); ok {
+		batch := make([]CommitEntry, 0, len(entries))
+		var positions []int
+		// tokens holds the position of the first command of the batch with
+		// each token, and duplicates maps the positions of the later ones to
+		// it.
+		tokens := make(map[string]int)
+		duplicates := make(map[int]int)
+		for i, entry := range entries {
+			command := entry.Command
+			if skipApply(command) {
+				continue
+			}
+			if f, ok := command.(chunkFailure); ok {
+				results[i] = &ApplyError{Err: f.err}
+				continue
+			}
+			if ic, ok := command.(idempotentCommand); ok {
+				if result, ok := cm.tokens.lookup(ic.Token); ok {
+					results[i] = result
+					continue
+				}
+				if j, ok := tokens[ic.Token]; ok {
+					duplicates[i] = j
+					continue
+				}
+				tokens[ic.Token] = i
+				command = ic.Command
+			}
+			batch = append(batch, CommitEntry{Command: command, Index: first + i, Term: entry.Term})
+			positions = append(positions, i)
+		}
+		if len(batch) == 0 {
+			return results, nil
+		}
+		batchResults := b.ApplyBatch(batch)
+		if len(batchResults) != len(batch) {
+			panic(fmt.Sprintf("ApplyBatch returned %d results for %d entries", len(batchResults), len(batch)))
+		}
+		for j, i := range positions {
+			results[i] = batchResults[j]
+			if ic, ok := entries[i].Command.(idempotentCommand); ok {
+				cm.tokens.record(ic.Token, results[i])
+			}
+			cm.applied(batch[j])
+		}
+		for i, j := range duplicates {
+			results[i] = results[j]
+		}
+		return results, nil
+	}
+	checked, isChecked := cm.app.(CheckedApplier)
+	for i, entry := range entries {
+		command := entry.Command
+		if skipApply(command) {
+			continue
+		}
+		if f, ok := command.(chunkFailure); ok {
+			results[i] = &ApplyError{Err: f.err}
+			continue
+		}
+		ic, hasToken := command.(idempotentCommand)
+		if hasToken {
+			if result, ok := cm.tokens.lookup(ic.Token); ok {
+				results[i] = result
+				continue
+			}
+			command = ic.Command
+		}
+		current = first + i
+		if !isChecked {
+			results[i] = cm.app.ApplyCommand(command)
+		} else if result, err := checked.ApplyCommandChecked(command); err != nil {
+			results[i] = &ApplyError{Err: err}
+		} else {
+			results[i] = result
+		}
+		if hasToken {
+			cm.tokens.record(ic.Token, results[i])
+		}
+		cm.applied(CommitEntry{Command: command, Index: first + i, Term: entry.Term})
+	}
+	return results, nil
+}
+
+// applied passes entry, whose command was just applied, to the hook set by
+// WithApplyHook.
+func (cm *ConsensusModule) applied(entry CommitEntry) {
+	if cm.server.applyHook != nil {
+		cm.server.applyHook(cm.groupId, entry)
+	}
+}
+
+// takeSnapshot snapshots the application, whose state reflects the entries
+// up to applied, and compacts the log. Unless force is set, it only does so
+// if SnapshotThreshold entries were applied since the last snapshot. It
+// returns the index and term of the last snapshot.
+func (cm *ConsensusModule) takeSnapshot(s Snapshotter, applied int, force bool) (int, int, error) {
+	header, due, snapshotIndex, snapshotTerm := cm.snapshotDue(s, applied, force)
+	if !due {
+		return snapshotIndex, snapshotTerm, nil
+	}
+	return cm.saveSnapshot(header, s.SnapshotTo)
+}
+
+// startSnapshot captures the state of s at applied if a snapshot is due, or
+// requests ask for one, and persists it in the background while the next
+// commands are applied. The requests are answered once it's persisted. An
+// automatic snapshot isn't started while another one is being persisted.
+// It's called by the apply goroutine.
+func (cm *ConsensusModule) startSnapshot(s ConcurrentSnapshotter, applied int, requests []chan snapshotResult) {
+	answer := func(index, term int, err error) {
+		for _, request := range requests {
+			request <- snapshotResult{index, term, err}
+		}
+		if err != nil && len(requests) == 0 {
+			cm.raftLog("%v", err)
+		}
+	}
+	header, due, snapshotIndex, snapshotTerm := cm.snapshotDue(s, applied, len(requests) > 0)
+	cm.mu.Lock()
+	busy := cm.persistingSnapshots > 0 && len(requests) == 0
+	cm.mu.Unlock()
+	if !due || busy {
+		answer(snapshotIndex, snapshotTerm, nil)
+		return
+	}
+	snap, err := s.Snapshot()
+	if err != nil {
+		answer(snapshotIndex, snapshotTerm, fmt.Errorf("failed to snapshot application: %v", err))
+		return
+	}
+	cm.mu.Lock()
+	cm.persistingSnapshots++
+	cm.mu.Unlock()
+	cm.spawn(func() {
+		defer snap.Release()
+		index, term, err := cm.saveSnapshot(header, snap.Persist)
+		cm.mu.Lock()
+		cm.persistingSnapshots--
+		cm.mu.Unlock()
+		answer(index, term, err)
+	})
+}
+
+// snapshotDue reports whether a snapshot of s at applied is due, because
+// SnapshotThreshold entries were applied since the last one or force is set,
+// and returns its header if it is. It returns the index and term of the last
+// snapshot either way. It's called by the apply goroutine, so that the header
+// reflects the entries applied up to applied.
+func (cm *ConsensusModule) snapshotDue(s Snapshotter, applied int, force bool) (snapshotHeader, bool, int, int) {
+	cm.mu.Lock()
+	due := applied > cm.snapshotIndex && (force || applied-cm.snapshotIndex >= cm.config.SnapshotThreshold)
+	snapshotIndex, snapshotTerm := cm.snapshotIndex, cm.snapshotTerm
+	var peers map[ServerID]string
+	var appliedTerm int
+	if due {
+		peers = cm.membershipAt(applied)
+		appliedTerm = cm.entryTerm(applied)
+	}
+	cm.mu.Unlock()
+	if !due {
+		return snapshotHeader{}, false, snapshotIndex, snapshotTerm
+	}
+	header := snapshotHeader{Version: snapshotFormatVersion, Index: applied, Term: appliedTerm, Members: peers, Tokens: cm.tokens.records(), Chunks: cm.chunks.pending()}
+	if v, ok := s.(VersionedSnapshotter); ok {
+		header.SchemaVersion = v.SchemaVersion()
+	}
+	if c, ok := s.(StateChecksummer); ok {
+		sum := c.StateChecksum()
+		header.StateChecksum = &sum
+	}
+	return header, true, snapshotIndex, snapshotTerm
+}
+
+// saveSnapshot writes header and the application state written by write, and
+// persists them as the snapshot at header.Index, compacting the log up to it.
+// It returns the index and term of the last snapshot.
+func (cm *ConsensusModule) saveSnapshot(header snapshotHeader, write func(io.Writer) error) (int, int, error) {
+	var data bytes.Buffer
+	if err := writeSnapshotHeader(&data, header); err != nil {
+		return cm.lastSnapshot(fmt.Errorf("failed to write snapshot header: %v", err))
+	}
+	if err := write(&data); err != nil {
+		return cm.lastSnapshot(fmt.Errorf("failed to snapshot application: %v", err))
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.state == Dead || header.Index <= cm.snapshotIndex {
+		// A snapshot from the leader, or a later one of ours, overtook this
+		// one.
+		return cm.snapshotIndex, cm.snapshotTerm, nil
+	}
+	snap := storage.Snapshot{Index: header.Index, Term: header.Term, Data: data.Bytes()}
+	if err := cm.storage.SaveSnapshot(snap); err != nil {
+		// The log is kept whole; the next snapshot may succeed.
+		return cm.snapshotIndex, cm.snapshotTerm, fmt.Errorf("failed to persist snapshot: %v", err)
+	}
+	cm.log = append([]LogEntry(nil), cm.log[header.Index-cm.snapshotIndex:]...)
+	cm.snapshotIndex = snap.Index
+	cm.snapshotTerm = snap.Term
+	cm.basePeers = header.Members
+	cm.raftLog("snapshot taken at %d, term=%d", snap.Index, snap.Term)
+	return snap.Index, snap.Term, nil
+}
+
+// lastSnapshot returns the index and term of the last snapshot, and err.
+func (cm *ConsensusModule) lastSnapshot(err error) (int, int, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.snapshotIndex, cm.snapshotTerm, err
+}
+
+// restoreFromStorage restores the persistent state of this CM from storage.
+// This should be called in the constructor, before any concurrency concerns.
+func (cm *ConsensusModule) restoreFromStorage() error {
+	st, ok, err := cm.storage.HardState()
+	if err != nil {
+		return err
+	}
+	if ok {
+		cm.currentTerm = st.CurrentTerm
+		cm.votedFor = ServerID(st.VotedFor)
+	}
+	snap, ok, err := cm.storage.Snapshot()
+	if err != nil {
+		return err
+	}
+	if ok {
+		s, isSnapshotter := cm.app.(Snapshotter)
+		if !isSnapshotter {
+			return fmt.Errorf("storage holds a snapshot, but the application can't restore it")
+		}
+		header, appData, hasHeader, err := readSnapshotHeader(snap.Data)
+		if err == nil {
+			err = header.check(snap.Index, snap.Term)
+		}
+		if err != nil {
+			return err
+		}
+		if err := restoreSnapshot(s, header, appData); err != nil {
+			return err
+		}
+		if hasHeader {
+			cm.basePeers = header.Members
+		}
+		cm.tokens.restore(header.Tokens)
+		cm.chunks.restore(header.Chunks)
+		cm.snapshotIndex = snap.Index
+		cm.snapshotTerm = snap.Term
+		cm.commitIndex = snap.Index
+		cm.lastApplied = snap.Index
+		cm.appliedIndex = snap.Index
+	}
+	firstIndex, err := cm.storage.FirstIndex()
+	if err != nil {
+		return err
+	}
+	lastIndex, err := cm.storage.LastIndex()
+	if err != nil {
+		return err
+	}
+	entries, err := cm.storage.Entries(firstIndex, lastIndex+1)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		logEntry, err := upgradeEntry(entry.Index, LogEntry{Command: entry.Command, Term: entry.Term, Checksum: entry.Checksum})
+		if err != nil {
+			return err
+		}
+		if err := verifyChecksum(entry.Index, logEntry); err != nil {
+			return err
+		}
+		cm.log = append(cm.log, logEntry)
+	}
+	cm.updateMembership()
+	return nil
+}
+
+// persistHardState saves the current term and vote to storage. A CM that
+// can't persist them can't safely take part in elections; callers stop it on
+// failure.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) persistHardState() error {
+	start := time.Now()
+	err := cm.storage.SetHardState(storage.HardState{CurrentTerm: cm.currentTerm, VotedFor: string(cm.votedFor)})
+	cm.observeStorage(StorageSyncOp, cm.metrics.storageSync, time.Since(start))
+	return err
+}
+
+// persistEntries saves entries to storage at index from on, replacing
+// whatever was stored from that index on.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) persistEntries(from int, entries []LogEntry) error {
+	start := time.Now()
+	err := cm.storage.Append(storedEntries(from, entries))
+	cm.observeStorage(StorageAppendOp, cm.metrics.storageAppend, time.Since(start))
+	return err
+}
+
+// persistState saves the hard state of cm and entries at index from on, as
+// persistHardState and persistEntries do, in a single write if the storage
+// is a storage.Saver, and otherwise the hard state first.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) persistState(from int, entries []LogEntry) error {
+	start := time.Now()
+	err := storage.Save(cm.storage, storage.HardState{CurrentTerm: cm.currentTerm, VotedFor: string(cm.votedFor)}, storedEntries(from, entries))
+	cm.observeStorage(StorageAppendOp, cm.metrics.storageAppend, time.Since(start))
+	return err
+}
+
+// storedEntries returns entries as saved to storage at index from on.
+func storedEntries(from int, entries []LogEntry) []storage.Entry {
+	stored := make([]storage.Entry, len(entries))
+	for i, entry := range entries {
+		stored[i] = storage.Entry{Index: from + i, Term: entry.Term, Command: entry.Command, Checksum: entry.Checksum}
+	}
+	return stored
+}
+
+// waitContext waits for wg, or for ctx to be done, in which case it returns
+// ctx.Err().
+func waitContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func intMin(a, b int) int {
 	if a < b {
 		return a
 	}
 	return b
 }
+
+func intMax(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
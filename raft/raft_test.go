@@ -1,8 +1,28 @@
 package raft
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/aecra/raft/storage"
+	"github.com/aecra/raft/storage/wal"
 )
 
 func TestServer(t *testing.T) {
@@ -10,7 +30,11 @@ func TestServer(t *testing.T) {
 	var cluster []*Server
 	ready := make(chan interface{})
 	for i := 0; i < num; i++ {
-		cluster = append(cluster, NewServer(i, num, ready, nil))
+		s, err := NewServer(i, WithCluster(num, ready))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cluster = append(cluster, s)
 		cluster[i].Serve()
 	}
 
@@ -36,3 +60,3465 @@ func TestServer(t *testing.T) {
 		cluster[i].Shutdown()
 	}
 }
+
+// listApp records the commands it applies, so its snapshots grow with them
+// and span several chunks.
+type listApp struct {
+	mu       sync.Mutex
+	commands []int
+}
+
+func (app *listApp) ApplyCommand(command interface{}) interface{} {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	app.commands = append(app.commands, command.(int))
+	return len(app.commands)
+}
+
+func (app *listApp) SnapshotTo(w io.Writer) error {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	return json.NewEncoder(w).Encode(app.commands)
+}
+
+func (app *listApp) RestoreFrom(r io.Reader) error {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	app.commands = nil
+	return json.NewDecoder(r).Decode(&app.commands)
+}
+
+func (app *listApp) Query(query interface{}) (interface{}, error) {
+	return len(app.get()), nil
+}
+
+func (app *listApp) get() []int {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	return append([]int(nil), app.commands...)
+}
+
+func TestSnapshotCatchUp(t *testing.T) {
+	config := Config{SnapshotThreshold: 10, SnapshotChunkSize: 16, CatchUpRate: 1024}
+	num := 5
+	var servers []*Server
+	var apps []*listApp
+	ready := make(chan interface{})
+	for i := 0; i < num; i++ {
+		apps = append(apps, &listApp{})
+		s, err := NewServer(i, WithCluster(num, ready), WithApplication(apps[i]), WithConfig(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, s)
+		servers[i].Serve()
+	}
+	for i := 0; i < num; i++ {
+		for j := 0; j < num; j++ {
+			if i != j {
+				if err := servers[i].ConnectToPeer(j, servers[j].GetListenAddr()); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	close(ready)
+	defer func() {
+		for _, s := range servers {
+			s.DisconnectAll()
+		}
+		for _, s := range servers {
+			s.Shutdown()
+		}
+	}()
+
+	leader := -1
+	for deadline := time.Now().Add(3 * time.Second); leader == -1; {
+		if time.Now().After(deadline) {
+			t.Fatal("No leader elected")
+		}
+		time.Sleep(50 * time.Millisecond)
+		for i, s := range servers {
+			if _, _, isLeader := s.cm.Report(); isLeader {
+				leader = i
+			}
+		}
+	}
+
+	// Cut a follower off while the others commit enough entries to compact
+	// them.
+	follower := (leader + 1) % num
+	for i := 0; i < num; i++ {
+		if i != follower {
+			servers[i].DisconnectPeer(follower)
+			servers[follower].DisconnectPeer(i)
+		}
+	}
+	var want []int
+	for i := 0; i < 30; i++ {
+		if _, ok := servers[leader].Submit(i); !ok {
+			t.Fatalf("Submit %d failed", i)
+		}
+		want = append(want, i)
+	}
+	servers[leader].cm.mu.Lock()
+	snapshotIndex := servers[leader].cm.snapshotIndex
+	servers[leader].cm.mu.Unlock()
+	if snapshotIndex < 10 {
+		t.Fatalf("Expected the leader to compact its log, snapshot index is %d", snapshotIndex)
+	}
+
+	// The follower can only catch up through the snapshot.
+	for i := 0; i < num; i++ {
+		if i != follower {
+			if err := servers[i].ConnectToPeer(follower, servers[follower].GetListenAddr()); err != nil {
+				t.Fatal(err)
+			}
+			if err := servers[follower].ConnectToPeer(i, servers[i].GetListenAddr()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); !reflect.DeepEqual(apps[follower].get(), want); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected follower to apply %v, got %v", want, apps[follower].get())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestSnapshotAfterLeaderChange(t *testing.T) {
+	var apps []*listApp
+	servers := startCluster(t, 3, func(i int) []Option {
+		apps = append(apps, &listApp{})
+		return []Option{WithApplication(apps[i]), WithConfig(Config{SnapshotThreshold: 30})}
+	})
+	leader := waitLeader(t, servers, -1)
+	follower, successor := (leader+1)%3, (leader+2)%3
+	for i := 0; i < 3; i++ {
+		if i != follower {
+			servers[i].Disconnect(IntID(follower))
+			servers[follower].Disconnect(IntID(i))
+		}
+	}
+	var want []int
+	for i := 0; i < 59; i++ {
+		if _, ok := servers[leader].Submit(i); !ok {
+			t.Fatalf("Submit %d failed", i)
+		}
+		want = append(want, i)
+	}
+
+	// The new leader starts probing the follower from the end of its log,
+	// most of which the follower lacks, and the rest was compacted: the
+	// follower's reply sends it straight to the snapshot.
+	if err := servers[leader].cm.TransferLeadership(IntID(successor)); err != nil {
+		t.Fatal(err)
+	}
+	if newLeader := waitLeader(t, servers, leader); newLeader != successor {
+		t.Fatalf("Leader is %d after the transfer, want %d", newLeader, successor)
+	}
+	for i := 0; i < 3; i++ {
+		if i != follower {
+			if err := servers[i].Connect(IntID(follower), servers[follower].GetListenAddr()); err != nil {
+				t.Fatal(err)
+			}
+			if err := servers[follower].Connect(IntID(i), servers[i].GetListenAddr()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// The new leader only commits the last entries of the old one along with
+	// one of its own term. The follower campaigned while it was cut off, so
+	// its higher term may depose the successor once it's reconnected.
+	submitToLeader(t, servers, "59", 59)
+	want = append(want, 59)
+	for deadline := time.Now().Add(3 * time.Second); !reflect.DeepEqual(apps[follower].get(), want); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected follower to apply %v, got %v", want, apps[follower].get())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInstallSnapshotResume(t *testing.T) {
+	app := &listApp{}
+	// The server is never made ready, so it stays a follower.
+	s, err := NewServer(0, WithCluster(2, make(chan interface{})), WithApplication(app))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Serve()
+	defer s.Shutdown()
+
+	want := []int{1, 2, 3, 4, 5}
+	data, _ := json.Marshal(want)
+	args := InstallSnapshotArgs{Term: 1, LeaderId: "1", LastIncludedIndex: 4, LastIncludedTerm: 1}
+	send := func(offset, end int) InstallSnapshotReply {
+		t.Helper()
+		args.Offset, args.Data, args.Done = offset, data[offset:end], end == len(data)
+		var reply InstallSnapshotReply
+		if err := s.cm.InstallSnapshot(args, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	if reply := send(0, 4); reply.Offset != 4 || reply.Installed {
+		t.Fatalf("Expected offset 4, got %+v", reply)
+	}
+	// The leader didn't get the reply and sends the chunk again.
+	if reply := send(0, 4); reply.Offset != 4 {
+		t.Fatalf("Expected offset 4 after a duplicate chunk, got %+v", reply)
+	}
+	// A chunk past the expected offset is rejected.
+	if reply := send(8, len(data)); reply.Offset != 4 || reply.Installed {
+		t.Fatalf("Expected offset 4 after a gap, got %+v", reply)
+	}
+	if reply := send(4, len(data)); !reply.Installed {
+		t.Fatalf("Expected snapshot to be installed, got %+v", reply)
+	}
+	for deadline := time.Now().Add(time.Second); !reflect.DeepEqual(app.get(), want); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected app to be restored to %v, got %v", want, app.get())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// batchApp is a listApp applying commands in batches.
+type batchApp struct {
+	listApp
+	indexes []int
+}
+
+func (app *batchApp) ApplyBatch(entries []CommitEntry) []interface{} {
+	results := make([]interface{}, len(entries))
+	for i, entry := range entries {
+		results[i] = app.ApplyCommand(entry.Command)
+		app.mu.Lock()
+		app.indexes = append(app.indexes, entry.Index)
+		app.mu.Unlock()
+	}
+	return results
+}
+
+func TestBatchApplier(t *testing.T) {
+	num := 3
+	var servers []*Server
+	var apps []*batchApp
+	ready := make(chan interface{})
+	for i := 0; i < num; i++ {
+		apps = append(apps, &batchApp{})
+		// Commands are sent as JSON rather than gob.
+		codec := JSONCodec{New: func() interface{} { return new(int) }}
+		s, err := NewServer(i, WithCluster(num, ready), WithApplication(apps[i]), WithCodec(codec))
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, s)
+		servers[i].Serve()
+	}
+	for i := 0; i < num; i++ {
+		for j := 0; j < num; j++ {
+			if i != j {
+				if err := servers[i].ConnectToPeer(j, servers[j].GetListenAddr()); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	close(ready)
+	defer func() {
+		for _, s := range servers {
+			s.DisconnectAll()
+		}
+		for _, s := range servers {
+			s.Shutdown()
+		}
+	}()
+
+	var want []int
+	for i := 0; i < 5; {
+		time.Sleep(50 * time.Millisecond)
+		for _, s := range servers {
+			if res, ok := s.Submit(i); ok {
+				if res != len(want)+1 {
+					t.Fatalf("Expected result %d, got %v", len(want)+1, res)
+				}
+				want = append(want, i)
+				i++
+				break
+			}
+		}
+	}
+	for i, app := range apps {
+		for deadline := time.Now().Add(time.Second); !reflect.DeepEqual(app.get(), want); {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected server %d to apply %v, got %v", i, want, app.get())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		app.mu.Lock()
+		indexes := app.indexes
+		app.mu.Unlock()
+		if !reflect.DeepEqual(indexes, []int{0, 1, 2, 3, 4}) {
+			t.Errorf("Expected server %d to apply indexes 0 to 4, got %v", i, indexes)
+		}
+	}
+}
+
+func TestNewServerOptions(t *testing.T) {
+	if _, err := NewServer(0); err == nil {
+		t.Error("NewServer accepted a server without WithCluster")
+	}
+	_, err := NewServer(0, WithCluster(3, make(chan interface{})), WithConfig(Config{HeartbeatInterval: time.Second}))
+	if err == nil {
+		t.Error("NewServer accepted a heartbeat interval longer than the election timeout")
+	}
+
+	// The CM goroutines may still log after Shutdown returns.
+	logs := &lockedBuffer{}
+	s, err := NewServer(0, WithCluster(3, make(chan interface{})), WithLogger(log.New(logs, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Serve()
+	s.Shutdown()
+	if !strings.Contains(logs.String(), "listening at") {
+		t.Error("the logger given with WithLogger wasn't used")
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestGroups(t *testing.T) {
+	num := 3
+	var servers []*Server
+	ready := make(chan interface{})
+	for i := 0; i < num; i++ {
+		s, err := NewServer(i, WithCluster(num, ready), WithApplication(&listApp{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, s)
+		servers[i].Serve()
+	}
+	for i := 0; i < num; i++ {
+		for j := 0; j < num; j++ {
+			if i != j {
+				if err := servers[i].ConnectToPeer(j, servers[j].GetListenAddr()); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	close(ready)
+	defer func() {
+		for _, s := range servers {
+			s.DisconnectAll()
+		}
+		for _, s := range servers {
+			s.Shutdown()
+		}
+	}()
+
+	// Each group applies its own commands to its own applications.
+	apps := map[int][]*listApp{}
+	for _, group := range []int{1, 2} {
+		for _, s := range servers {
+			app := &listApp{}
+			apps[group] = append(apps[group], app)
+			if err := s.CreateGroup(group, app, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := servers[0].CreateGroup(1, &listApp{}, nil); err == nil {
+		t.Error("CreateGroup accepted an existing group")
+	}
+	submit := func(group, command int) {
+		t.Helper()
+		for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); {
+			for _, s := range servers {
+				if _, ok := s.SubmitTo(group, command); ok {
+					return
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("group %d never committed %d", group, command)
+	}
+	submit(1, 10)
+	submit(2, 20)
+	submit(1, 11)
+	want := map[int][]int{1: {10, 11}, 2: {20}}
+	for group, groupApps := range apps {
+		for i, app := range groupApps {
+			for deadline := time.Now().Add(time.Second); !reflect.DeepEqual(app.get(), want[group]); {
+				if time.Now().After(deadline) {
+					t.Fatalf("server %d applied %v to group %d, want %v", i, app.get(), group, want[group])
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}
+
+	for _, s := range servers {
+		if err := s.RemoveGroup(2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := servers[0].SubmitTo(2, 21); ok {
+		t.Error("SubmitTo succeeded on a removed group")
+	}
+	if err := servers[0].RemoveGroup(DefaultGroup); err == nil {
+		t.Error("RemoveGroup removed the default group")
+	}
+	submit(1, 12)
+}
+
+// gatedApp blocks in ApplyBatch until gate is closed, and records the size of
+// the batches it gets.
+type gatedApp struct {
+	gate chan struct{}
+
+	mu      sync.Mutex
+	batches []int
+}
+
+func (app *gatedApp) ApplyCommand(command interface{}) interface{} {
+	panic("ApplyCommand called on a BatchApplier")
+}
+
+func (app *gatedApp) ApplyBatch(entries []CommitEntry) []interface{} {
+	<-app.gate
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	app.batches = append(app.batches, len(entries))
+	return make([]interface{}, len(entries))
+}
+
+func TestApplyLag(t *testing.T) {
+	num := 3
+	config := Config{MaxApplyBatch: 2, MaxApplyLag: 2}
+	gate := make(chan struct{})
+	var servers []*Server
+	var apps []*gatedApp
+	ready := make(chan interface{})
+	for i := 0; i < num; i++ {
+		apps = append(apps, &gatedApp{gate: gate})
+		s, err := NewServer(i, WithCluster(num, ready), WithApplication(apps[i]), WithConfig(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, s)
+		servers[i].Serve()
+	}
+	for i := 0; i < num; i++ {
+		for j := 0; j < num; j++ {
+			if i != j {
+				if err := servers[i].ConnectToPeer(j, servers[j].GetListenAddr()); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	close(ready)
+	defer func() {
+		for _, s := range servers {
+			s.DisconnectAll()
+		}
+		for _, s := range servers {
+			s.Shutdown()
+		}
+	}()
+
+	leader := -1
+	for deadline := time.Now().Add(3 * time.Second); leader == -1; {
+		if time.Now().After(deadline) {
+			t.Fatal("No leader elected")
+		}
+		time.Sleep(50 * time.Millisecond)
+		for i, s := range servers {
+			if _, _, isLeader := s.cm.Report(); isLeader {
+				leader = i
+			}
+		}
+	}
+	cm := servers[leader].cm
+
+	// The commands are committed, but the application doesn't apply them.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			servers[leader].Submit(i)
+		}(i)
+	}
+	for deadline := time.Now().Add(time.Second); cm.ApplyStats().Lag <= config.MaxApplyLag; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the apply lag to exceed %d, stats are %+v", config.MaxApplyLag, cm.ApplyStats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := servers[leader].Submit(5); ok {
+		t.Error("Submit succeeded while the application lags")
+	}
+	if stats := cm.ApplyStats(); stats.Rejected != 1 || stats.MaxLag < stats.Lag {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	close(gate)
+	wg.Wait()
+	for deadline := time.Now().Add(time.Second); cm.ApplyStats().Lag != 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the application to catch up, stats are %+v", cm.ApplyStats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := servers[leader].Submit(6); !ok {
+		t.Error("Submit failed once the application caught up")
+	}
+	apps[leader].mu.Lock()
+	defer apps[leader].mu.Unlock()
+	for _, size := range apps[leader].batches {
+		if size > config.MaxApplyBatch {
+			t.Errorf("Got a batch of %d entries, want at most %d", size, config.MaxApplyBatch)
+		}
+	}
+}
+
+func TestApplyOverlapsReplication(t *testing.T) {
+	gate := make(chan struct{})
+	apps := make([]*gatedApp, 3)
+	servers := startCluster(t, 3, func(i int) []Option {
+		apps[i] = &gatedApp{gate: gate}
+		return []Option{WithApplication(apps[i])}
+	})
+	leader := waitLeader(t, servers, -1)
+	cm := servers[leader].cm
+
+	// While the application is stuck on the first batch, the next commands
+	// are still replicated and committed.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			servers[leader].Submit(i)
+		}(i)
+		time.Sleep(10 * time.Millisecond)
+	}
+	for deadline := time.Now().Add(time.Second); ; {
+		cm.mu.Lock()
+		committed, applied := cm.commitIndex, cm.appliedIndex
+		cm.mu.Unlock()
+		if committed == 3 && applied == -1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the 4 commands to be committed before any is applied, got commit index %d and applied index %d", committed, applied)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(gate)
+	wg.Wait()
+	apps[leader].mu.Lock()
+	defer apps[leader].mu.Unlock()
+	total := 0
+	for _, size := range apps[leader].batches {
+		total += size
+	}
+	if total != 4 {
+		t.Errorf("Expected the application to apply 4 commands, got batches %v", apps[leader].batches)
+	}
+}
+
+// cowApp is a listApp whose snapshots are captured as a copy of its commands
+// and persisted once gate is closed.
+type cowApp struct {
+	listApp
+	gate     chan struct{}
+	released chan struct{}
+}
+
+func (app *cowApp) Snapshot() (AppSnapshot, error) {
+	return cowSnapshot{app, app.get()}, nil
+}
+
+type cowSnapshot struct {
+	app      *cowApp
+	commands []int
+}
+
+func (s cowSnapshot) Persist(w io.Writer) error {
+	<-s.app.gate
+	return json.NewEncoder(w).Encode(s.commands)
+}
+
+func (s cowSnapshot) Release() {
+	s.app.released <- struct{}{}
+}
+
+func TestConcurrentSnapshot(t *testing.T) {
+	app := &cowApp{gate: make(chan struct{}), released: make(chan struct{}, 10)}
+	servers := startCluster(t, 1, func(i int) []Option {
+		return []Option{WithApplication(app), WithConfig(Config{SnapshotThreshold: 5})}
+	})
+	waitLeader(t, servers, -1)
+	cm := servers[0].cm
+
+	// The commands keep being applied while the first snapshot is persisted.
+	for i := 0; i < 10; i++ {
+		if _, ok := servers[0].Submit(i); !ok {
+			t.Fatalf("Submit %d failed while a snapshot is persisted", i)
+		}
+	}
+	cm.mu.Lock()
+	snapshotIndex := cm.snapshotIndex
+	cm.mu.Unlock()
+	if snapshotIndex != -1 {
+		t.Fatalf("Expected no snapshot before it's persisted, got one at %d", snapshotIndex)
+	}
+
+	close(app.gate)
+	select {
+	case <-app.released:
+	case <-time.After(time.Second):
+		t.Fatal("The snapshot wasn't released")
+	}
+	cm.mu.Lock()
+	snapshotIndex = cm.snapshotIndex
+	cm.mu.Unlock()
+	if snapshotIndex != 4 {
+		t.Fatalf("Expected the snapshot at index 4, got %d", snapshotIndex)
+	}
+	snap, _, err := cm.storage.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, appData, _, err := readSnapshotHeader(snap.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var commands []int
+	if err := json.Unmarshal(appData, &commands); err != nil || !reflect.DeepEqual(commands, []int{0, 1, 2, 3, 4}) {
+		t.Errorf("Expected the snapshot to hold the first 5 commands, got %v (err=%v)", commands, err)
+	}
+}
+
+// checksumApp is a listApp that checksums its state.
+type checksumApp struct {
+	listApp
+}
+
+func (app *checksumApp) StateChecksum() uint64 {
+	h := fnv.New64a()
+	for _, command := range app.get() {
+		fmt.Fprintf(h, "%d,", command)
+	}
+	return h.Sum64()
+}
+
+func TestStateChecksum(t *testing.T) {
+	app := &checksumApp{}
+	servers := startCluster(t, 1, func(i int) []Option {
+		return []Option{WithApplication(app)}
+	})
+	waitLeader(t, servers, -1)
+	for i := 0; i < 3; i++ {
+		if _, ok := servers[0].Submit(i); !ok {
+			t.Fatalf("Submit %d failed", i)
+		}
+	}
+	if _, _, err := servers[0].TakeSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	snap, _, err := servers[0].cm.storage.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, appData, _, err := readSnapshotHeader(snap.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.StateChecksum == nil || *header.StateChecksum != app.StateChecksum() {
+		t.Fatalf("Expected the snapshot to record checksum %x, got %v", app.StateChecksum(), header.StateChecksum)
+	}
+	if err := restoreSnapshot(&checksumApp{}, header, appData); err != nil {
+		t.Errorf("Restoring the snapshot: %v", err)
+	}
+
+	// A snapshot truncated to its first two commands is refused.
+	truncated, err := json.Marshal(app.get()[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreSnapshot(&checksumApp{}, header, truncated); !errors.Is(err, ErrStateChecksumMismatch) {
+		t.Errorf("Restoring a truncated snapshot returned %v, want ErrStateChecksumMismatch", err)
+	}
+}
+
+func TestCheckState(t *testing.T) {
+	apps := make([]*checksumApp, 3)
+	servers := startCluster(t, 3, func(i int) []Option {
+		apps[i] = &checksumApp{}
+		return []Option{WithApplication(apps[i])}
+	})
+	leader := waitLeader(t, servers, -1)
+	for i := 0; i < 5; i++ {
+		if _, ok := servers[leader].Submit(i); !ok {
+			t.Fatalf("Submit %d failed", i)
+		}
+	}
+	report, err := servers[leader].CheckState(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Diverged() {
+		t.Fatalf("Expected the states to match, got %+v", report.Replicas)
+	}
+	for _, replica := range report.Replicas {
+		if replica.Err != "" || replica.Checksum != apps[leader].StateChecksum() {
+			t.Errorf("Server %s reported %x, %q, want %x", replica.Id, replica.Checksum, replica.Err, apps[leader].StateChecksum())
+		}
+	}
+
+	// A follower whose state was changed behind the log's back diverges.
+	follower := (leader + 1) % 3
+	apps[follower].mu.Lock()
+	apps[follower].commands[0] = 99
+	apps[follower].mu.Unlock()
+	report, err = servers[leader].CheckState(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Diverged() {
+		t.Errorf("Expected the states to diverge, got %+v", report.Replicas)
+	}
+
+	var notLeader *NotLeaderError
+	if _, err := servers[follower].CheckState(context.Background()); !errors.As(err, &notLeader) {
+		t.Errorf("CheckState on a follower returned %v, want a *NotLeaderError", err)
+	}
+}
+
+func TestStop(t *testing.T) {
+	before := runtime.NumGoroutine()
+	num := 3
+	config := Config{CommitTimeout: 5 * time.Second}
+	var servers []*Server
+	ready := make(chan interface{})
+	for i := 0; i < num; i++ {
+		s, err := NewServer(i, WithCluster(num, ready), WithApplication(&listApp{}), WithConfig(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, s)
+		servers[i].Serve()
+	}
+	for i := 0; i < num; i++ {
+		for j := 0; j < num; j++ {
+			if i != j {
+				if err := servers[i].ConnectToPeer(j, servers[j].GetListenAddr()); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	close(ready)
+
+	leader := -1
+	for deadline := time.Now().Add(3 * time.Second); leader == -1; {
+		if time.Now().After(deadline) {
+			t.Fatal("No leader elected")
+		}
+		time.Sleep(50 * time.Millisecond)
+		for i, s := range servers {
+			if _, _, isLeader := s.cm.Report(); isLeader {
+				leader = i
+			}
+		}
+	}
+
+	// Cut the leader off, so that its command stays pending until it stops.
+	for i := 0; i < num; i++ {
+		if i != leader {
+			servers[leader].DisconnectPeer(i)
+		}
+	}
+	submitted := make(chan bool)
+	go func() {
+		_, ok := servers[leader].Submit(1)
+		submitted <- ok
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for _, s := range servers {
+		if err := s.Stop(ctx); err != nil {
+			t.Fatalf("Stop: %v", err)
+		}
+	}
+	select {
+	case ok := <-submitted:
+		if ok {
+			t.Error("Submit succeeded on a leader cut off from its peers")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The pending proposal wasn't failed by Stop")
+	}
+
+	// Only the goroutines of the runtime and of finished timers may remain.
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > before; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left after Stop, %d before the servers started", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWitness(t *testing.T) {
+	num := 3
+	witness := num - 1
+	var servers []*Server
+	var apps []*listApp
+	ready := make(chan interface{})
+	for i := 0; i < num; i++ {
+		apps = append(apps, &listApp{})
+		opts := []Option{WithCluster(num, ready), WithApplication(apps[i])}
+		if i == witness {
+			opts = append(opts, WithWitness())
+		}
+		s, err := NewServer(i, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, s)
+		servers[i].Serve()
+	}
+	for i := 0; i < num; i++ {
+		for j := 0; j < num; j++ {
+			if i != j {
+				if err := servers[i].ConnectToPeer(j, servers[j].GetListenAddr()); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	close(ready)
+	defer func() {
+		for _, s := range servers {
+			s.DisconnectAll()
+		}
+		for _, s := range servers {
+			s.Shutdown()
+		}
+	}()
+
+	findLeader := func() int {
+		for deadline := time.Now().Add(3 * time.Second); ; {
+			if time.Now().After(deadline) {
+				t.Fatal("No leader elected")
+			}
+			time.Sleep(50 * time.Millisecond)
+			for i, s := range servers {
+				if _, _, isLeader := s.cm.Report(); isLeader {
+					return i
+				}
+			}
+		}
+	}
+	leader := findLeader()
+	if leader == witness {
+		t.Fatal("The witness became leader")
+	}
+	if _, ok := servers[leader].Submit(1); !ok {
+		t.Fatal("Submit failed")
+	}
+
+	// The leader and the witness make a quorum without the other server.
+	other := 1 - leader
+	for i := 0; i < num; i++ {
+		if i != other {
+			servers[i].DisconnectPeer(other)
+			servers[other].DisconnectPeer(i)
+		}
+	}
+	if _, ok := servers[leader].Submit(2); !ok {
+		t.Fatal("Submit failed with the witness and the leader connected")
+	}
+	if got := apps[leader].get(); !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Errorf("Leader applied %v, want [1 2]", got)
+	}
+	if got := apps[witness].get(); len(got) != 0 {
+		t.Errorf("Witness applied %v", got)
+	}
+	// They also make the majority confirming the leadership for reads.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if answer, err := servers[leader].Read(ctx, nil); err != nil || answer != 2 {
+		t.Errorf("Read with the witness and the leader connected returned %v, %v, want 2", answer, err)
+	}
+	if answer, err := servers[leader].ReadStale(nil, time.Second); err != nil || answer != 2 {
+		t.Errorf("ReadStale with the witness and the leader connected returned %v, %v, want 2", answer, err)
+	}
+	if got := apps[witness].get(); len(got) != 0 {
+		t.Errorf("Witness applied %v after the reads", got)
+	}
+	cm := servers[witness].cm
+	cm.mu.Lock()
+	for i, entry := range cm.log {
+		if entry.Command != nil {
+			t.Errorf("Witness stored command %v at %d", entry.Command, cm.snapshotIndex+1+i)
+		}
+	}
+	cm.mu.Unlock()
+	if err := servers[leader].cm.TransferLeadership(IntID(witness)); err == nil {
+		t.Error("Leadership was transferred to the witness")
+	}
+
+	// Without the witness, the leader alone can't confirm its leadership.
+	servers[leader].DisconnectPeer(witness)
+	servers[witness].DisconnectPeer(leader)
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := servers[leader].VerifyLeader(ctx); err == nil {
+		t.Error("VerifyLeader succeeded with the leader cut off from the witness")
+	}
+}
+
+// startCluster starts num connected servers, the options of server i given by
+// opts, and shuts them down when the test ends.
+func startCluster(t testing.TB, num int, opts func(i int) []Option) []*Server {
+	t.Helper()
+	var servers []*Server
+	ready := make(chan interface{})
+	for i := 0; i < num; i++ {
+		s, err := NewServer(i, append([]Option{WithCluster(num, ready)}, opts(i)...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, s)
+		servers[i].Serve()
+	}
+	t.Cleanup(func() {
+		for _, s := range servers {
+			s.DisconnectAll()
+		}
+		for _, s := range servers {
+			s.Shutdown()
+		}
+	})
+	for i := 0; i < num; i++ {
+		for j := 0; j < num; j++ {
+			if i != j {
+				if err := servers[i].ConnectToPeer(j, servers[j].GetListenAddr()); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	close(ready)
+	return servers
+}
+
+// waitLeader waits for one of servers, other than except, to lead the default
+// group, and returns its index.
+func waitLeader(t testing.TB, servers []*Server, except int) int {
+	t.Helper()
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); {
+		time.Sleep(50 * time.Millisecond)
+		for i, s := range servers {
+			if _, _, isLeader := s.cm.Report(); isLeader && i != except {
+				return i
+			}
+		}
+	}
+	t.Fatal("No leader elected")
+	return -1
+}
+
+// submitToLeader submits command with token to whichever server leads, until
+// one commits it, for tests where the leadership may change. A submission
+// that failed may be committed all the same: the token keeps command from
+// being applied twice.
+func submitToLeader(t testing.TB, servers []*Server, token string, command interface{}) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if _, ok := servers[waitLeader(t, servers, -1)].SubmitIdempotent(token, command); ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Submit(%v) failed", command)
+		}
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	servers := startCluster(t, 3, func(i int) []Option { return nil })
+	leader := waitLeader(t, servers, -1)
+
+	if err := servers[leader].EnterMaintenance(true); err != nil {
+		t.Fatal(err)
+	}
+	if !servers[leader].InMaintenance() {
+		t.Error("InMaintenance is false after EnterMaintenance")
+	}
+	newLeader := waitLeader(t, servers, leader)
+	if err := servers[newLeader].cm.TransferLeadership(IntID(leader)); err == nil {
+		t.Error("The leadership was transferred to a server in maintenance")
+	}
+
+	// The server in maintenance doesn't stand for election, even when the
+	// leader fails.
+	for i := range servers {
+		if i != newLeader {
+			servers[i].DisconnectPeer(newLeader)
+			servers[newLeader].DisconnectPeer(i)
+		}
+	}
+	next := waitLeader(t, servers, newLeader)
+	if next == leader {
+		t.Errorf("Server %d was elected while in maintenance", leader)
+	}
+
+	servers[leader].ExitMaintenance()
+	if servers[leader].InMaintenance() {
+		t.Error("InMaintenance is true after ExitMaintenance")
+	}
+}
+
+func TestReadStale(t *testing.T) {
+	apps := []*listApp{{}, {}, {}}
+	servers := startCluster(t, len(apps), func(i int) []Option {
+		return []Option{WithApplication(apps[i])}
+	})
+	leader := waitLeader(t, servers, -1)
+	for i := 1; i <= 3; i++ {
+		if _, ok := servers[leader].Submit(i); !ok {
+			t.Fatal("Submit failed")
+		}
+	}
+
+	follower := (leader + 1) % len(servers)
+	for deadline := time.Now().Add(time.Second); ; {
+		n, err := servers[follower].ReadStale(nil, time.Second)
+		if err == nil && n == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("ReadStale on the follower = %v, %v; want 3", n, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n, err := servers[leader].ReadStale(nil, time.Second); err != nil || n != 3 {
+		t.Errorf("ReadStale on the leader = %v, %v; want 3", n, err)
+	}
+
+	// A follower cut off from the leader only serves reads as stale as the
+	// last time it heard from it.
+	for i := range servers {
+		if i != follower {
+			servers[i].DisconnectPeer(follower)
+			servers[follower].DisconnectPeer(i)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := servers[follower].ReadStale(nil, 50*time.Millisecond); err != ErrTooStale {
+		t.Errorf("ReadStale on a partitioned follower returned %v, want ErrTooStale", err)
+	}
+	if n, err := servers[follower].ReadStale(nil, time.Minute); err != nil || n != 3 {
+		t.Errorf("ReadStale with a large bound = %v, %v; want 3", n, err)
+	}
+}
+
+func TestReadStaleRejoin(t *testing.T) {
+	// The leader sends the committed entries a lagging follower misses at
+	// 2000 bytes per second, about 40 entries, so the follower rejoins a few
+	// seconds behind.
+	apps := []*listApp{{}, {}, {}}
+	servers := startCluster(t, len(apps), func(i int) []Option {
+		return []Option{WithApplication(apps[i]), WithConfig(Config{CatchUpRate: 2000})}
+	})
+	leader := waitLeader(t, servers, -1)
+	follower := (leader + 1) % len(servers)
+	// The follower doesn't campaign while cut off, so it rejoins in the term
+	// of the leader.
+	servers[follower].EnterMaintenance(false)
+	for i := range servers {
+		if i != follower {
+			servers[i].DisconnectPeer(follower)
+			servers[follower].DisconnectPeer(i)
+		}
+	}
+	want := 100
+	for i := 0; i < want; i++ {
+		if _, ok := servers[leader].Submit(i); !ok {
+			t.Fatalf("Submit(%d) failed", i)
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+	for i := range servers {
+		if i != follower {
+			if err := servers[i].ConnectToPeer(follower, servers[follower].GetListenAddr()); err != nil {
+				t.Fatal(err)
+			}
+			if err := servers[follower].ConnectToPeer(i, servers[i].GetListenAddr()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// The heartbeats the follower gets while catching up don't make its
+	// state any fresher.
+	behind := false
+	for deadline := time.Now().Add(20 * time.Second); ; {
+		n, err := servers[follower].ReadStale(nil, 500*time.Millisecond)
+		if err == nil {
+			if n != want {
+				t.Fatalf("ReadStale on the rejoining follower = %v, want %d or ErrTooStale", n, want)
+			}
+			break
+		}
+		if err != ErrTooStale {
+			t.Fatalf("ReadStale on the rejoining follower returned %v", err)
+		}
+		behind = true
+		if time.Now().After(deadline) {
+			t.Fatalf("The follower didn't catch up; it applied %d commands", len(apps[follower].get()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !behind {
+		t.Error("The follower caught up before it could be read behind")
+	}
+}
+
+func TestTakeSnapshot(t *testing.T) {
+	servers := startCluster(t, 3, func(i int) []Option {
+		return []Option{WithApplication(&listApp{})}
+	})
+	leader := waitLeader(t, servers, -1)
+	for i := 1; i <= 3; i++ {
+		if _, ok := servers[leader].Submit(i); !ok {
+			t.Fatal("Submit failed")
+		}
+	}
+	_, term, _ := servers[leader].cm.Report()
+
+	index, snapshotTerm, err := servers[leader].TakeSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != 2 || snapshotTerm != term {
+		t.Errorf("TakeSnapshot = %d, %d; want 2, %d", index, snapshotTerm, term)
+	}
+	cm := servers[leader].cm
+	cm.mu.Lock()
+	if len(cm.log) != 0 {
+		t.Errorf("%d entries left in the log after TakeSnapshot", len(cm.log))
+	}
+	cm.mu.Unlock()
+
+	// Without new entries, the same snapshot is returned.
+	if index, snapshotTerm, err := servers[leader].TakeSnapshot(); err != nil || index != 2 || snapshotTerm != term {
+		t.Errorf("Second TakeSnapshot = %d, %d, %v; want 2, %d", index, snapshotTerm, err, term)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	config := Config{SnapshotThreshold: 3}
+	servers := startCluster(t, 3, func(i int) []Option {
+		return []Option{WithApplication(&listApp{}), WithConfig(config)}
+	})
+	leader := waitLeader(t, servers, -1)
+	for i := 1; i <= 5; i++ {
+		if _, ok := servers[leader].Submit(i); !ok {
+			t.Fatal("Submit failed")
+		}
+	}
+	var archive bytes.Buffer
+	if err := servers[leader].WriteBackup(&archive); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new cluster restored from the archive starts with all its commands
+	// applied.
+	var apps []*listApp
+	var stores []storage.Storage
+	for i := 0; i < 3; i++ {
+		store := storage.NewMemoryStorage()
+		if err := RestoreBackup(bytes.NewReader(archive.Bytes()), &listApp{}, nil, store); err != nil {
+			t.Fatal(err)
+		}
+		stores = append(stores, store)
+		apps = append(apps, &listApp{})
+	}
+	if err := RestoreBackup(bytes.NewReader(archive.Bytes()), &listApp{}, nil, stores[0]); err == nil {
+		t.Error("RestoreBackup succeeded into a storage that isn't empty")
+	}
+	restored := startCluster(t, 3, func(i int) []Option {
+		return []Option{WithApplication(apps[i]), WithStorage(stores[i]), WithConfig(config)}
+	})
+	for i, app := range apps {
+		if got := app.get(); !reflect.DeepEqual(got, []int{1, 2, 3, 4, 5}) {
+			t.Errorf("Server %d restored %v, want [1 2 3 4 5]", i, got)
+		}
+	}
+	leader = waitLeader(t, restored, -1)
+	if result, ok := restored[leader].Submit(6); !ok || result != 6 {
+		t.Errorf("Submit to the restored cluster = %v, %v; want 6", result, ok)
+	}
+}
+
+func TestPeerAddressBook(t *testing.T) {
+	var stores []storage.Storage
+	for i := 0; i < 3; i++ {
+		stores = append(stores, storage.NewMemoryStorage())
+	}
+	servers := startCluster(t, 3, func(i int) []Option {
+		return []Option{WithApplication(&listApp{}), WithStorage(stores[i])}
+	})
+	leader := waitLeader(t, servers, -1)
+	if _, ok := servers[leader].Submit(1); !ok {
+		t.Fatal("Submit failed")
+	}
+	var addrs []string
+	for _, s := range servers {
+		addrs = append(addrs, s.GetListenAddr().String())
+		s.Shutdown()
+	}
+
+	// Restarted at the same addresses, the servers dial each other at the
+	// addresses they saved, without Connect.
+	ready := make(chan interface{})
+	var restarted []*Server
+	for i := 0; i < 3; i++ {
+		s, err := NewServer(i, WithCluster(3, ready), WithApplication(&listApp{}), WithStorage(stores[i]), WithTransport(TCPTransport{Addr: addrs[i]}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Serve()
+		defer s.Shutdown()
+		restarted = append(restarted, s)
+	}
+	close(ready)
+	leader = waitLeader(t, restarted, -1)
+	if _, ok := restarted[leader].Submit(2); !ok {
+		t.Error("Submit to the restarted cluster failed")
+	}
+}
+
+// blockingBook is a storage whose SetPeerAddrs blocks until release is
+// closed, signaling saving when it starts.
+type blockingBook struct {
+	*storage.MemoryStorage
+	saving  chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingBook) SetPeerAddrs(addrs map[string]string) error {
+	select {
+	case b.saving <- struct{}{}:
+	default:
+	}
+	<-b.release
+	return b.MemoryStorage.SetPeerAddrs(addrs)
+}
+
+func TestSaveAddrsUnlocked(t *testing.T) {
+	book := &blockingBook{MemoryStorage: storage.NewMemoryStorage(), saving: make(chan struct{}, 1), release: make(chan struct{})}
+	s, err := NewServer(0, WithCluster(3, make(chan interface{})), WithApplication(&listApp{}), WithStorage(book), WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Serve()
+	defer s.Stop(context.Background())
+	released := false
+	release := func() {
+		if !released {
+			released = true
+			close(book.release)
+		}
+	}
+	defer release()
+
+	updated := make(chan error, 1)
+	go func() {
+		updated <- s.UpdatePeerAddress(IntID(1), peerAddr("127.0.0.1:1"))
+	}()
+	<-book.saving
+
+	// While the address is written, the server and its groups stay usable,
+	// and learning an address with a CM's lock held doesn't wait for the
+	// write.
+	cm, err := s.Group(DefaultGroup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.GetListenAddr()
+		cm.mu.Lock()
+		s.learnPeerAddr(IntID(2), "127.0.0.1:2")
+		cm.mu.Unlock()
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("The server is locked while a peer address is saved")
+	}
+
+	release()
+	if err := <-updated; err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(3 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		addrs, err := book.PeerAddrs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addrs["1"] == "127.0.0.1:1" && addrs["2"] == "127.0.0.1:2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Saved %v, want the addresses of servers 1 and 2", addrs)
+		}
+	}
+}
+
+func TestUpdatePeerAddress(t *testing.T) {
+	var stores []storage.Storage
+	for i := 0; i < 3; i++ {
+		stores = append(stores, storage.NewMemoryStorage())
+	}
+	servers := startCluster(t, 3, func(i int) []Option {
+		return []Option{WithApplication(&listApp{}), WithStorage(stores[i])}
+	})
+	leader := waitLeader(t, servers, -1)
+	if _, ok := servers[leader].Submit(1); !ok {
+		t.Fatal("Submit failed")
+	}
+
+	// The follower comes back on another port; the others are told its new
+	// address instead of removing it and adding it back.
+	follower := (leader + 1) % len(servers)
+	servers[follower].Shutdown()
+	ready := make(chan interface{})
+	app := &listApp{}
+	moved, err := NewServer(follower, WithCluster(3, ready), WithApplication(app), WithStorage(stores[follower]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved.Serve()
+	defer moved.Shutdown()
+	for i, s := range servers {
+		if i == follower {
+			continue
+		}
+		if err := moved.Connect(IntID(i), s.GetListenAddr()); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.UpdatePeerAddress(IntID(follower), moved.GetListenAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(ready)
+
+	if _, ok := servers[leader].Submit(2); !ok {
+		t.Fatal("Submit failed")
+	}
+	for deadline := time.Now().Add(3 * time.Second); !reflect.DeepEqual(app.get(), []int{1, 2}); {
+		if time.Now().After(deadline) {
+			t.Fatalf("The moved follower applied %v, want [1 2]", app.get())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := servers[leader].UpdatePeerAddress(IntID(leader), moved.GetListenAddr()); err == nil {
+		t.Error("UpdatePeerAddress of the server itself succeeded")
+	}
+}
+
+func TestResolvePeers(t *testing.T) {
+	var mu sync.Mutex
+	ips := []string{"127.0.0.1", "::1"}
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return ips, nil
+	}
+	t.Cleanup(func() { lookupHost = net.DefaultResolver.LookupHost })
+
+	// The servers aren't ready, so only the re-resolution touches their
+	// connection.
+	ready := make(chan interface{})
+	var servers []*Server
+	for i := 0; i < 2; i++ {
+		s, err := NewServer(i, WithCluster(2, ready), WithConfig(Config{ResolveInterval: 10 * time.Millisecond}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Serve()
+		defer s.Shutdown()
+		servers = append(servers, s)
+	}
+	_, port, err := net.SplitHostPort(servers[1].GetListenAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := peerAddr(net.JoinHostPort("localhost", port))
+	if err := servers[0].Connect(IntID(1), addr); err != nil {
+		t.Fatal(err)
+	}
+	client := func() *rpc.Client {
+		servers[0].mu.Lock()
+		defer servers[0].mu.Unlock()
+		return servers[0].peerClients[IntID(1)]
+	}
+	connected := client()
+
+	time.Sleep(50 * time.Millisecond)
+	if client() != connected {
+		t.Fatal("The connection was replaced while its host name resolved to it")
+	}
+
+	mu.Lock()
+	ips = []string{"192.0.2.1"}
+	mu.Unlock()
+	for deadline := time.Now().Add(time.Second); client() != nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("The connection wasn't closed after its host name moved")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	servers[0].addrMu.Lock()
+	redialed := servers[0].peerAddrs[IntID(1)]
+	servers[0].addrMu.Unlock()
+	if redialed != addr {
+		t.Errorf("The peer is redialed at %v, want %v", redialed, addr)
+	}
+}
+
+func TestGossip(t *testing.T) {
+	// Only the first server's address is configured, as the seed of the
+	// others; they discover each other through it.
+	ready := make(chan interface{})
+	config := Config{GossipInterval: 20 * time.Millisecond}
+	var servers []*Server
+	var seeds []string
+	for i := 0; i < 3; i++ {
+		s, err := NewServer(i, WithCluster(3, ready), WithApplication(&listApp{}), WithConfig(config), WithGossip("", seeds...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Serve()
+		defer s.Shutdown()
+		servers = append(servers, s)
+		seeds = []string{servers[0].GetListenAddr().String()}
+	}
+	close(ready)
+
+	for deadline := time.Now().Add(3 * time.Second); len(servers[1].GossipMembers()) < 3 || len(servers[0].GossipMembers()) < 3; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Members known by gossip: %v, %v", servers[0].GossipMembers(), servers[1].GossipMembers())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if addr := servers[1].GossipMembers()[IntID(2)]; addr != servers[2].GetListenAddr().String() {
+		t.Errorf("Server 2 is known at %s, want %s", addr, servers[2].GetListenAddr())
+	}
+	leader := waitLeader(t, servers, -1)
+	if _, ok := servers[leader].Submit(1); !ok {
+		t.Error("Submit failed")
+	}
+}
+
+// podTransport dials the pods of a StatefulSet at the addresses they listen
+// at, which it maps their DNS names to.
+type podTransport struct {
+	mu    *sync.Mutex
+	addrs map[string]string
+}
+
+func (t podTransport) Listen() (net.Listener, error) {
+	return TCPTransport{}.Listen()
+}
+
+func (t podTransport) Dial(addr net.Addr) (net.Conn, error) {
+	pod, _, _ := strings.Cut(addr.String(), ".")
+	t.mu.Lock()
+	listening, ok := t.addrs[pod]
+	t.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no pod %s", pod)
+	}
+	return net.Dial("tcp", listening)
+}
+
+func TestStatefulSet(t *testing.T) {
+	transport := podTransport{new(sync.Mutex), make(map[string]string)}
+	set := StatefulSet{Service: "raft.default.svc.cluster.local", Replicas: 3, Port: 7000}
+	start := func(ordinal int) *Server {
+		set := set
+		set.Hostname = fmt.Sprintf("raft-%d", ordinal)
+		s, err := NewStatefulSetServer(set, WithApplication(&listApp{}), WithTransport(transport))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Serve()
+		t.Cleanup(s.Shutdown)
+		transport.mu.Lock()
+		transport.addrs[set.Hostname] = s.GetListenAddr().String()
+		transport.mu.Unlock()
+		return s
+	}
+
+	// Alone, the first pod waits for a quorum rather than starting elections.
+	servers := []*Server{start(0)}
+	time.Sleep(500 * time.Millisecond)
+	if id, term, _ := servers[0].cm.Report(); id != "raft-0" || term != 0 {
+		t.Fatalf("Server %q reached term %d without a quorum", id, term)
+	}
+	servers = append(servers, start(1))
+	leader := waitLeader(t, servers, -1)
+	servers = append(servers, start(2))
+	if _, ok := servers[leader].Submit(1); !ok {
+		t.Error("Submit failed")
+	}
+
+	for _, hostname := range []string{"raft", "raft-x", "raft-3"} {
+		set := set
+		set.Hostname = hostname
+		if _, err := NewStatefulSetServer(set); err == nil {
+			t.Errorf("NewStatefulSetServer accepted hostname %q", hostname)
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	servers := startCluster(t, 3, func(i int) []Option {
+		return []Option{WithApplication(&listApp{})}
+	})
+	leader := waitLeader(t, servers, -1)
+	if _, ok := servers[leader].Submit(1); !ok {
+		t.Fatal("Submit failed")
+	}
+	follower := servers[(leader+1)%len(servers)]
+	probe := func(path string) int {
+		w := httptest.NewRecorder()
+		follower.HealthHandler(0).ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+	for deadline := time.Now().Add(time.Second); probe("/readyz") != http.StatusOK; {
+		if time.Now().After(deadline) {
+			h, _ := follower.Health(0)
+			t.Fatalf("The follower isn't ready: %+v", h)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if h, _ := follower.Health(0); h.Leader != IntID(leader) || h.Lag != 0 {
+		t.Errorf("Health of the follower is %+v, want leader %s and no lag", h, IntID(leader))
+	}
+	if status, err := follower.Status(); err != nil || status.Leader != IntID(leader) || time.Since(status.LastContact) > time.Second {
+		t.Errorf("Status of the follower is %+v (%v), want leader %s contacted within a second", status, err, IntID(leader))
+	}
+
+	// Alone, the follower is alive but loses contact with a quorum.
+	for _, s := range servers {
+		if s != follower {
+			s.Shutdown()
+		}
+	}
+	for deadline := time.Now().Add(time.Second); probe("/readyz") != http.StatusServiceUnavailable; {
+		if time.Now().After(deadline) {
+			t.Fatal("The follower stayed ready without a quorum")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	before, _ := follower.Health(0)
+	time.Sleep(100 * time.Millisecond)
+	if after, _ := follower.Health(0); !after.LastContact.Equal(before.LastContact) {
+		t.Errorf("The follower heard from a quorum at %v, after losing contact at %v", after.LastContact, before.LastContact)
+	}
+	if code := probe("/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz answered %d, want %d", code, http.StatusOK)
+	}
+	follower.Shutdown()
+	if code := probe("/healthz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/healthz answered %d after Shutdown, want %d", code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestDebugHandler(t *testing.T) {
+	servers := startCluster(t, 3, func(i int) []Option {
+		return []Option{WithApplication(&listApp{})}
+	})
+	leader := waitLeader(t, servers, -1)
+	for i := 1; i <= 3; i++ {
+		if _, ok := servers[leader].Submit(i); !ok {
+			t.Fatal("Submit failed")
+		}
+	}
+
+	w := httptest.NewRecorder()
+	servers[leader].DebugHandler().ServeHTTP(w, httptest.NewRequest("GET", "/?tail=2", nil))
+	page := w.Body.String()
+	if w.Code != http.StatusOK {
+		t.Fatalf("The dashboard answered %d: %s", w.Code, page)
+	}
+	for _, want := range []string{"<h2>Group 0</h2>", "<td>Leader</td>", "<td>" + string(IntID((leader+1)%3)) + "</td>"} {
+		if !strings.Contains(page, want) {
+			t.Errorf("The dashboard lacks %q:\n%s", want, page)
+		}
+	}
+	if rows := strings.Count(page, `<tr><td align="right">`); rows != 2 {
+		t.Errorf("The dashboard shows %d log entries, want 2:\n%s", rows, page)
+	}
+
+	w = httptest.NewRecorder()
+	servers[leader].DebugHandler().ServeHTTP(w, httptest.NewRequest("GET", "/?tail=x", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("The dashboard answered %d to an invalid tail, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestUIHandler(t *testing.T) {
+	servers := startCluster(t, 3, func(i int) []Option {
+		return []Option{WithApplication(&listApp{})}
+	})
+	leader := waitLeader(t, servers, -1)
+	if _, ok := servers[leader].Submit(1); !ok {
+		t.Fatal("Submit failed")
+	}
+
+	w := httptest.NewRecorder()
+	servers[leader].UIHandler().ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "?format=json") {
+		t.Fatalf("The UI page answered %d:\n%s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	servers[leader].UIHandler().ServeHTTP(w, httptest.NewRequest("GET", "/?format=json", nil))
+	var state struct {
+		Id     ServerID
+		Groups []uiGroup
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &state); err != nil {
+		t.Fatalf("The UI state isn't JSON: %v\n%s", err, w.Body.String())
+	}
+	if state.Id != IntID(leader) || len(state.Groups) != 1 {
+		t.Fatalf("Got the UI state %+v, want the default group of server %d", state, leader)
+	}
+	g := state.Groups[0]
+	if g.Status.State != "Leader" || len(g.Peers) != 3 {
+		t.Errorf("Got the group %+v, want a leader of 3 servers", g)
+	}
+	if n := len(g.Elections); n == 0 || g.Elections[n-1].Leader != IntID(leader) || g.Elections[n-1].Term != g.Status.Term {
+		t.Errorf("Got the elections %+v, want the leader's last", g.Elections)
+	}
+}
+
+func TestSubmitContext(t *testing.T) {
+	servers := startCluster(t, 3, func(i int) []Option {
+		return []Option{WithApplication(&listApp{}), WithConfig(Config{CommitTimeout: 5 * time.Second})}
+	})
+	leader := waitLeader(t, servers, -1)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, ok := servers[leader].SubmitContext(ctx, 1); !ok {
+		t.Fatal("SubmitContext failed")
+	}
+
+	// Without its followers, the leader can't commit; the deadline, rather
+	// than the commit timeout, ends the wait.
+	for i, s := range servers {
+		if i != leader {
+			s.Shutdown()
+		}
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, ok := servers[leader].SubmitContext(ctx, 2); ok {
+		t.Fatal("SubmitContext succeeded without a quorum")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("SubmitContext returned after %v, past its deadline", elapsed)
+	}
+}
+
+func TestSubmitIndexed(t *testing.T) {
+	servers := startCluster(t, 3, func(i int) []Option {
+		return []Option{WithApplication(&listApp{})}
+	})
+	leader := waitLeader(t, servers, -1)
+	_, term, _ := servers[leader].cm.Report()
+	var indexes []int
+	for i := 1; i <= 2; i++ {
+		committed, err := servers[leader].SubmitIndexed(context.Background(), i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if committed.Term != term {
+			t.Errorf("Command %d committed in term %d, want %d", i, committed.Term, term)
+		}
+		indexes = append(indexes, committed.Index)
+	}
+	if indexes[1] != indexes[0]+1 {
+		t.Errorf("Commands committed at indexes %v, want consecutive ones", indexes)
+	}
+}
+
+func TestWaitApplied(t *testing.T) {
+	var apps []*listApp
+	servers := startCluster(t, 3, func(i int) []Option {
+		apps = append(apps, &listApp{})
+		return []Option{WithApplication(apps[i])}
+	})
+	leader := waitLeader(t, servers, -1)
+	committed, err := servers[leader].SubmitIndexed(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	follower := (leader + 1) % len(servers)
+	if err := servers[follower].WaitApplied(committed.Index, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got := apps[follower].get(); !reflect.DeepEqual(got, []int{1}) {
+		t.Errorf("The follower applied %v after WaitApplied, want [1]", got)
+	}
+
+	if err := servers[follower].WaitApplied(committed.Index+100, 50*time.Millisecond); err != ErrApplyTimeout {
+		t.Errorf("WaitApplied of a future index returned %v, want ErrApplyTimeout", err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		servers[follower].Shutdown()
+	}()
+	start := time.Now()
+	if err := servers[follower].WaitApplied(committed.Index+100, 5*time.Second); err == nil || err == ErrApplyTimeout || time.Since(start) > time.Second {
+		t.Errorf("WaitApplied returned %v after %v when the server stopped", err, time.Since(start))
+	}
+}
+
+// checkedApp is a listApp rejecting negative commands.
+type checkedApp struct {
+	listApp
+}
+
+func (app *checkedApp) ApplyCommandChecked(command interface{}) (interface{}, error) {
+	if command.(int) < 0 {
+		return nil, fmt.Errorf("negative command %d", command)
+	}
+	return app.ApplyCommand(command), nil
+}
+
+func TestApplyError(t *testing.T) {
+	servers := startCluster(t, 3, func(i int) []Option {
+		return []Option{WithApplication(&checkedApp{})}
+	})
+	leader := waitLeader(t, servers, -1)
+	committed, err := servers[leader].SubmitIndexed(context.Background(), -1)
+	var applyErr *ApplyError
+	if !errors.As(err, &applyErr) || applyErr.Err.Error() != "negative command -1" {
+		t.Fatalf("SubmitIndexed of a failing command returned %v, want an ApplyError", err)
+	}
+	if committed.Index < 0 {
+		t.Errorf("The failing command has no index: %+v", committed)
+	}
+	if result, ok := servers[leader].Submit(-2); !ok || !reflect.DeepEqual(result, &ApplyError{Err: fmt.Errorf("negative command -2")}) {
+		t.Errorf("Submit of a failing command returned %v, %v", result, ok)
+	}
+	if result, ok := servers[leader].Submit(1); !ok || result != 1 {
+		t.Errorf("Submit returned %v, %v, want 1", result, ok)
+	}
+
+	follower := (leader + 1) % len(servers)
+	var notLeader *NotLeaderError
+	if _, err := servers[follower].SubmitIndexed(context.Background(), 2); !errors.As(err, &notLeader) {
+		t.Errorf("SubmitIndexed on a follower returned %v, want a NotLeaderError", err)
+	}
+}
+
+// panicApp is a listApp panicking on negative commands once it's fragile.
+type panicApp struct {
+	listApp
+	fragile bool
+}
+
+func (app *panicApp) ApplyCommand(command interface{}) interface{} {
+	app.mu.Lock()
+	fragile := app.fragile
+	app.mu.Unlock()
+	if fragile && command.(int) < 0 {
+		panic(fmt.Sprintf("negative command %d", command))
+	}
+	return app.listApp.ApplyCommand(command)
+}
+
+func TestApplyPanic(t *testing.T) {
+	for _, policy := range []PanicPolicy{PanicHalt, PanicStepDown} {
+		t.Run(policy.String(), func(t *testing.T) {
+			var apps []*panicApp
+			events := make(chan Event, 10)
+			servers := startCluster(t, 3, func(i int) []Option {
+				apps = append(apps, &panicApp{})
+				return []Option{
+					WithApplication(apps[i]),
+					WithConfig(Config{ApplyPanicPolicy: policy}),
+					WithObserver(func(e Event) { events <- e }),
+				}
+			})
+			leader := waitLeader(t, servers, -1)
+			apps[leader].mu.Lock()
+			apps[leader].fragile = true
+			apps[leader].mu.Unlock()
+			if _, ok := servers[leader].Submit(-1); ok {
+				t.Fatal("Submit of a command the leader panics on succeeded")
+			}
+
+			select {
+			case e := <-events:
+				p, ok := e.(*ApplyPanicEvent)
+				if !ok || p.Group() != DefaultGroup || p.Value != "negative command -1" || p.Policy != policy {
+					t.Fatalf("Got event %+v, want the panic", e)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("The panic wasn't observed")
+			}
+
+			// The others elect a new leader, which the server that panicked
+			// keeps replicating entries for, under PanicStepDown.
+			newLeader := waitLeader(t, servers, leader)
+			if _, ok := servers[newLeader].Submit(2); !ok {
+				t.Fatal("Submit to the new leader failed")
+			}
+			h, _ := servers[leader].Health(0)
+			if h.Alive != (policy == PanicStepDown) {
+				t.Errorf("The server that panicked reports %+v", h)
+			}
+			if _, _, isLeader := servers[leader].cm.Report(); isLeader {
+				t.Error("The server that panicked leads")
+			}
+			if policy == PanicStepDown {
+				if _, _, err := servers[leader].TakeSnapshot(); err != ErrApplyFailed {
+					t.Errorf("TakeSnapshot on the server that panicked returned %v, want ErrApplyFailed", err)
+				}
+			}
+		})
+	}
+}
+
+func TestReplicationProgress(t *testing.T) {
+	events := make(chan Event, 10)
+	servers := startCluster(t, 3, func(i int) []Option {
+		return []Option{
+			WithApplication(&listApp{}),
+			WithConfig(Config{LagAlertThreshold: 2}),
+			WithObserver(func(e Event) { events <- e }),
+		}
+	})
+	leader := waitLeader(t, servers, -1)
+	if _, ok := servers[leader].Submit(1); !ok {
+		t.Fatal("Submit failed")
+	}
+	for deadline := time.Now().Add(time.Second); ; {
+		progress, _ := servers[leader].ReplicationProgress()
+		if len(progress) == 2 && progress[0].State == Replicating && progress[0].Lag == 0 &&
+			progress[1].State == Replicating && progress[1].Lag == 0 && !progress[1].LastContact.IsZero() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The followers didn't catch up: %+v", progress)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if progress, _ := servers[(leader+1)%3].ReplicationProgress(); progress != nil {
+		t.Errorf("A follower reports progress %+v", progress)
+	}
+
+	follower := (leader + 1) % len(servers)
+	servers[follower].Shutdown()
+	for i := 2; i <= 4; i++ {
+		if _, ok := servers[leader].Submit(i); !ok {
+			t.Fatal("Submit failed")
+		}
+	}
+	select {
+	case e := <-events:
+		if lag, ok := e.(*PeerLagEvent); !ok || lag.Peer != IntID(follower) || lag.Lag != 3 || lag.Recovered {
+			t.Errorf("Got event %+v, want %s lagging 3 entries", e, IntID(follower))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The lagging follower wasn't reported")
+	}
+	progress, _ := servers[leader].ReplicationProgress()
+	for _, p := range progress {
+		if p.Id == IntID(follower) && (p.Lag != 3 || p.LagBytes == 0) {
+			t.Errorf("The stopped follower's progress is %+v", p)
+		}
+	}
+}
+
+func TestSubmitIdempotent(t *testing.T) {
+	var apps []*listApp
+	servers := startCluster(t, 3, func(i int) []Option {
+		apps = append(apps, &listApp{})
+		return []Option{WithApplication(apps[i]), WithConfig(Config{SnapshotThreshold: 3})}
+	})
+	leader := waitLeader(t, servers, -1)
+	for i := 0; i < 2; i++ {
+		// The retry is committed, but gets the result of the first attempt.
+		if result, ok := servers[leader].SubmitIdempotent("a", 1); !ok || result != 1 {
+			t.Fatalf("Expected result 1, got %v (ok=%v)", result, ok)
+		}
+	}
+	for i := 2; i <= 4; i++ {
+		if _, ok := servers[leader].Submit(i); !ok {
+			t.Fatalf("Submit %d failed", i)
+		}
+	}
+	if result, ok := servers[leader].SubmitIdempotent("a", 1); !ok || result != 1 {
+		t.Fatalf("Expected result 1 after a snapshot, got %v (ok=%v)", result, ok)
+	}
+	want := []int{1, 2, 3, 4}
+	for i, app := range apps {
+		for deadline := time.Now().Add(time.Second); !reflect.DeepEqual(app.get(), want); {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected server %d to apply %v, got %v", i, want, app.get())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// The results are part of the snapshots, for the servers restoring them.
+	snap, ok, err := servers[leader].cm.storage.Snapshot()
+	if err != nil || !ok {
+		t.Fatalf("Expected a snapshot, got ok=%v err=%v", ok, err)
+	}
+	header, _, _, err := readSnapshotHeader(snap.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header.Tokens) != 1 || header.Tokens[0].Token != "a" || header.Tokens[0].Result != 1 {
+		t.Errorf("Expected the snapshot to hold the result of token a, got %+v", header.Tokens)
+	}
+}
+
+func TestTokenCacheEviction(t *testing.T) {
+	c := newTokenCache(2)
+	c.record("a", 1)
+	c.record("b", &ApplyError{Err: errors.New("failed")})
+	c.record("c", 3)
+	if _, ok := c.lookup("a"); ok {
+		t.Errorf("Expected the oldest token to be evicted")
+	}
+	restored := newTokenCache(2)
+	restored.restore(c.records())
+	if result, ok := restored.lookup("b"); !ok || result.(*ApplyError).Err.Error() != "failed" {
+		t.Errorf("Expected the restored apply error of token b, got %v (ok=%v)", result, ok)
+	}
+	if result, ok := restored.lookup("c"); !ok || result != 3 {
+		t.Errorf("Expected the restored result 3 of token c, got %v (ok=%v)", result, ok)
+	}
+}
+
+func TestPreferredZone(t *testing.T) {
+	zones := []string{"east", "west", "west"}
+	servers := startCluster(t, 3, func(i int) []Option {
+		config := Config{PreferredZone: "east", ZoneTransferDelay: 100 * time.Millisecond}
+		return []Option{WithApplication(&listApp{}), WithZone(zones[i]), WithConfig(config)}
+	})
+	for deadline := time.Now().Add(3 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		if _, _, isLeader := servers[0].cm.Report(); isLeader {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the server in the preferred zone to become the leader")
+		}
+	}
+	// A leader elected right away learns the zones of the followers from
+	// their first replies.
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		progress, err := servers[0].ReplicationProgress()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reported := 0
+		for _, p := range progress {
+			if p.Zone == "west" {
+				reported++
+			}
+		}
+		if reported == len(progress) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the followers to report zone west, got %+v", progress)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	servers := startCluster(t, 3, func(i int) []Option {
+		return []Option{WithApplication(&listApp{})}
+	})
+	leader := waitLeader(t, servers, -1)
+	for i := 0; i < 5; i++ {
+		if _, ok := servers[leader].Submit(i); !ok {
+			t.Fatalf("Submit %d failed", i)
+		}
+	}
+	m, err := servers[leader].Metrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, h := range map[string]Histogram{"SubmitToAppend": m.SubmitToAppend, "AppendToCommit": m.AppendToCommit, "CommitToApply": m.CommitToApply} {
+		if h.Count != 5 {
+			t.Errorf("Expected 5 observations of %s, got %d", name, h.Count)
+		}
+		if q := h.Quantile(0.99); q < h.Mean() || q > time.Second {
+			t.Errorf("Expected the 99th percentile of %s to be above its mean %v and below 1s, got %v", name, h.Mean(), q)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	servers[leader].MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`raft_append_to_commit_seconds_count{group="0"} 5`,
+		`raft_commit_to_apply_seconds_bucket{group="0",le="+Inf"} 5`,
+	} {
+		if !strings.Contains(rec.Body.String(), line+"\n") {
+			t.Errorf("Expected the metrics to contain %q, got:\n%s", line, rec.Body.String())
+		}
+	}
+}
+
+func TestElectionMetrics(t *testing.T) {
+	servers := startCluster(t, 3, func(i int) []Option { return nil })
+	leader := waitLeader(t, servers, -1)
+	for i := range servers {
+		if i != leader {
+			servers[i].DisconnectPeer(leader)
+			servers[leader].DisconnectPeer(i)
+		}
+	}
+	newLeader := waitLeader(t, servers, leader)
+
+	var votes uint64
+	for i, s := range servers {
+		m, err := s.Metrics()
+		if err != nil {
+			t.Fatal(err)
+		}
+		votes += m.VotesGranted
+		if m.ElectionsWon+m.ElectionsLost > m.ElectionsStarted {
+			t.Errorf("Server %d won %d and lost %d of %d elections", i, m.ElectionsWon, m.ElectionsLost, m.ElectionsStarted)
+		}
+		if m.ElectionDuration.Count != m.ElectionsWon {
+			t.Errorf("Server %d won %d elections but measured %d", i, m.ElectionsWon, m.ElectionDuration.Count)
+		}
+		if i == newLeader && (m.ElectionsWon == 0 || m.LeaderChanges < 2) {
+			t.Errorf("Expected server %d to have won an election after following %d, got %+v", i, leader, m)
+		}
+	}
+	if votes < 2 {
+		t.Errorf("Expected two elections to have been granted votes, %d were", votes)
+	}
+
+	rec := httptest.NewRecorder()
+	servers[newLeader].MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		"# TYPE raft_elections_won_total counter",
+		"# TYPE raft_election_duration_seconds histogram",
+	} {
+		if !strings.Contains(rec.Body.String(), line+"\n") {
+			t.Errorf("Expected the metrics to contain %q, got:\n%s", line, rec.Body.String())
+		}
+	}
+}
+
+func TestPeerMetrics(t *testing.T) {
+	transports := make([]*FaultTransport, 3)
+	servers := startCluster(t, 3, func(i int) []Option {
+		transports[i] = NewFaultTransport(nil)
+		return []Option{WithTransport(transports[i])}
+	})
+	leader := waitLeader(t, servers, -1)
+	cut, slow := IntID((leader+1)%3), IntID((leader+2)%3)
+	transports[leader].SetPolicy(func(to ServerID, serviceMethod string) Fault {
+		if serviceMethod != "ConsensusModule.AppendEntries" {
+			return Fault{}
+		}
+		return Fault{Drop: to == cut, Delay: 20 * time.Millisecond}
+	})
+	time.Sleep(500 * time.Millisecond)
+
+	m, err := servers[leader].Metrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Peers) != 2 {
+		t.Fatalf("Expected the metrics of 2 peers, got %+v", m.Peers)
+	}
+	for _, p := range m.Peers {
+		switch p.Id {
+		case cut:
+			if p.Failures == 0 || p.FailureRate() <= 0 || p.FailureRate() > 1 {
+				t.Errorf("Expected the AEs to %s to fail, got %d failures of %d calls", p.Id, p.Failures, p.Calls)
+			}
+		case slow:
+			if p.Failures != 0 || p.RTT.Count == 0 || p.RTT.Quantile(0.99) < 20*time.Millisecond {
+				t.Errorf("Expected the AEs to %s to take 20ms, got %d failures and an RTT of %v", p.Id, p.Failures, p.RTT.Quantile(0.99))
+			}
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	servers[leader].MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		fmt.Sprintf(`raft_peer_rtt_seconds_bucket{group="0",peer=%q,le="+Inf"}`, slow),
+		fmt.Sprintf(`raft_peer_call_failures_total{group="0",peer=%q}`, cut),
+	} {
+		if !strings.Contains(rec.Body.String(), line+" ") {
+			t.Errorf("Expected the metrics to contain %q, got:\n%s", line, rec.Body.String())
+		}
+	}
+}
+
+// slowStorage is a storage whose appends take delay.
+type slowStorage struct {
+	storage.Storage
+	delay time.Duration
+}
+
+func (s slowStorage) Append(entries []storage.Entry) error {
+	time.Sleep(s.delay)
+	return s.Storage.Append(entries)
+}
+
+func TestSlowStorage(t *testing.T) {
+	events := make(chan Event, 10)
+	servers := startCluster(t, 1, func(i int) []Option {
+		return []Option{
+			WithApplication(&listApp{}),
+			WithStorage(slowStorage{storage.NewMemoryStorage(), 20 * time.Millisecond}),
+			WithConfig(Config{SlowStorageThreshold: 10 * time.Millisecond}),
+			WithObserver(func(e Event) { events <- e }),
+		}
+	})
+	waitLeader(t, servers, -1)
+	if _, ok := servers[0].Submit(1); !ok {
+		t.Fatal("Submit failed")
+	}
+	select {
+	case e := <-events:
+		if slow, ok := e.(*SlowStorageEvent); !ok || slow.Op != StorageAppendOp || slow.Duration < 20*time.Millisecond {
+			t.Errorf("Got event %+v, want a slow append", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The slow append wasn't reported")
+	}
+
+	m, err := servers[0].Metrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.StorageAppend.Count != 1 || m.StorageAppend.Mean() < 20*time.Millisecond {
+		t.Errorf("Expected an append of 20ms, got %d of %v", m.StorageAppend.Count, m.StorageAppend.Mean())
+	}
+	if m.StorageSync.Count == 0 {
+		t.Error("Expected the term and vote to have been persisted")
+	}
+}
+
+// countingStorage counts the appends to a storage.
+type countingStorage struct {
+	storage.Storage
+	mu      sync.Mutex
+	appends int
+}
+
+func (s *countingStorage) Append(entries []storage.Entry) error {
+	s.mu.Lock()
+	s.appends++
+	s.mu.Unlock()
+	return s.Storage.Append(entries)
+}
+
+func (s *countingStorage) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.appends
+}
+
+func TestGroupCommit(t *testing.T) {
+	stores := make([]*countingStorage, 3)
+	apps := make([]*listApp, 3)
+	servers := startCluster(t, 3, func(i int) []Option {
+		stores[i] = &countingStorage{Storage: storage.NewMemoryStorage()}
+		apps[i] = &listApp{}
+		return []Option{
+			WithApplication(apps[i]),
+			WithStorage(stores[i]),
+			WithConfig(Config{GroupCommitWindow: 20 * time.Millisecond}),
+		}
+	})
+	leader := waitLeader(t, servers, -1)
+	before := stores[leader].count()
+
+	const num = 20
+	var wg sync.WaitGroup
+	indexes := make([]int, num)
+	for i := 0; i < num; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			committed, err := servers[leader].SubmitIndexed(context.Background(), i)
+			if err != nil {
+				t.Errorf("Submit %d: %v", i, err)
+			}
+			indexes[i] = committed.Index
+		}()
+	}
+	wg.Wait()
+
+	if appends := stores[leader].count() - before; appends >= num/2 {
+		t.Errorf("Expected the %d commands to be appended in a few writes, got %d", num, appends)
+	}
+	seen := make(map[int]bool)
+	for i, index := range indexes {
+		if seen[index] {
+			t.Errorf("Command %d was committed at index %d as another", i, index)
+		}
+		seen[index] = true
+	}
+	if got := apps[leader].get(); len(got) != num {
+		t.Errorf("Expected %d commands to be applied, got %v", num, got)
+	}
+}
+
+func TestApplyTimeout(t *testing.T) {
+	t.Run("Enqueue", func(t *testing.T) {
+		// The commands wait longer for the group commit window than the
+		// apply timeout allows: they're withdrawn, and never applied.
+		apps := make([]*listApp, 3)
+		servers := startCluster(t, 3, func(i int) []Option {
+			apps[i] = &listApp{}
+			return []Option{WithApplication(apps[i]), WithConfig(Config{GroupCommitWindow: 300 * time.Millisecond, ApplyTimeout: 50 * time.Millisecond})}
+		})
+		leader := waitLeader(t, servers, -1)
+		start := time.Now()
+		if _, err := servers[leader].SubmitIndexed(context.Background(), 1); err != ErrEnqueueTimeout {
+			t.Fatalf("Expected ErrEnqueueTimeout, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed >= 300*time.Millisecond {
+			t.Errorf("The command failed after %v, past the group commit window", elapsed)
+		}
+		time.Sleep(400 * time.Millisecond)
+		if got := apps[leader].get(); len(got) != 0 {
+			t.Errorf("The withdrawn command was applied: %v", got)
+		}
+	})
+
+	t.Run("Commit", func(t *testing.T) {
+		// The leader can't replicate the command: it fails long before the
+		// deadline of its context.
+		servers := startCluster(t, 3, func(i int) []Option {
+			return []Option{WithApplication(&listApp{}), WithConfig(Config{ApplyTimeout: 100 * time.Millisecond})}
+		})
+		leader := waitLeader(t, servers, -1)
+		for i := range servers {
+			if i != leader {
+				servers[leader].Disconnect(IntID(i))
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		start := time.Now()
+		if _, err := servers[leader].SubmitIndexed(ctx, 1); err != ErrUnknownResult {
+			t.Fatalf("Expected ErrUnknownResult, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed >= time.Second {
+			t.Errorf("The command failed after %v, with an apply timeout of 100ms", elapsed)
+		}
+	})
+}
+
+func TestElectionOnly(t *testing.T) {
+	var isolated atomic.Int32
+	isolated.Store(-1)
+	servers := startCluster(t, 3, func(i int) []Option {
+		transport := NewFaultTransport(nil)
+		transport.SetPolicy(func(to ServerID, serviceMethod string) Fault {
+			id := isolated.Load()
+			return Fault{Drop: id == int32(i) || to == IntID(int(id))}
+		})
+		return []Option{WithElectionOnly(), WithTransport(transport)}
+	})
+	leader := waitLeader(t, servers, -1)
+	select {
+	case isLeader := <-servers[leader].LeaderCh():
+		if !isLeader {
+			t.Error("Expected LeaderCh to report the leadership")
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected LeaderCh to report the leadership")
+	}
+	ctx := context.Background()
+	if err := servers[leader].VerifyLeader(ctx); err != nil {
+		t.Errorf("VerifyLeader on the leader: %v", err)
+	}
+	var notLeader *NotLeaderError
+	if err := servers[(leader+1)%3].VerifyLeader(ctx); !errors.As(err, &notLeader) {
+		t.Errorf("VerifyLeader on a follower returned %v, want a *NotLeaderError", err)
+	}
+	if _, err := servers[leader].SubmitIndexed(ctx, 1); err != ErrElectionOnly {
+		t.Errorf("SubmitIndexed returned %v, want ErrElectionOnly", err)
+	}
+
+	// A leader cut off from its followers can't verify its leadership.
+	isolated.Store(int32(leader))
+	ctx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	if err := servers[leader].VerifyLeader(ctx); err == nil {
+		t.Error("Expected VerifyLeader to fail on an isolated leader")
+	}
+	waitLeader(t, servers, leader)
+}
+
+func TestProtocolVersion(t *testing.T) {
+	for _, tc := range []struct {
+		min, max, peerMin, peerMax int
+		want                       int
+	}{
+		{1, 1, 1, 1, 1},
+		{1, 2, 1, 1, 1},
+		{1, 3, 2, 4, 3},
+		{1, 1, 2, 2, 0},
+	} {
+		version, err := commonVersion(tc.min, tc.max, tc.peerMin, tc.peerMax)
+		if version != tc.want || (err == nil) != (tc.want != 0) {
+			t.Errorf("commonVersion(%d, %d, %d, %d) = %d, %v, want %d", tc.min, tc.max, tc.peerMin, tc.peerMax, version, err, tc.want)
+		}
+	}
+
+	// A server of the next release, which also speaks the current version,
+	// joins a cluster of the current one.
+	servers := startCluster(t, 3, func(i int) []Option {
+		opts := []Option{WithApplication(&listApp{})}
+		if i == 2 {
+			opts = append(opts, func(s *Server) { s.maxVersion = ProtocolVersion + 1 })
+		}
+		return opts
+	})
+	leader := waitLeader(t, servers, -1)
+	if _, ok := servers[leader].Submit(1); !ok {
+		t.Fatal("Submit failed in a cluster of mixed releases")
+	}
+	servers[2].mu.Lock()
+	versions := fmt.Sprint(servers[2].peerVersions)
+	servers[2].mu.Unlock()
+	if want := fmt.Sprint(map[ServerID]int{"0": ProtocolVersion, "1": ProtocolVersion}); versions != want {
+		t.Errorf("The upgraded server negotiated %s, want %s", versions, want)
+	}
+
+	// A server that only speaks a later version can't connect, and RPCs
+	// carrying it are rejected.
+	later, err := NewServer(3, WithCluster(4, make(chan interface{})), func(s *Server) {
+		s.minVersion, s.maxVersion = ProtocolVersion+1, ProtocolVersion+1
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := later.Connect("0", servers[0].GetListenAddr()); err == nil {
+		t.Error("Expected a server of a release too far apart not to connect")
+	}
+	client, err := rpc.Dial("tcp", servers[0].GetListenAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	args := RequestVoteArgs{ProtocolVersion: ProtocolVersion + 1, CandidateId: "3"}
+	if err := client.Call("ConsensusModule.RequestVote", args, &RequestVoteReply{}); err == nil {
+		t.Error("Expected an RPC of an unknown protocol version to be rejected")
+	}
+	args.ProtocolVersion = 0
+	if err := client.Call("ConsensusModule.RequestVote", args, &RequestVoteReply{}); err != nil {
+		t.Errorf("Expected an RPC of a release from before versioning to be served: %v", err)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	servers := startCluster(t, 3, func(i int) []Option {
+		return []Option{WithApplication(&listApp{})}
+	})
+	leader := waitLeader(t, servers, -1)
+	for i := 1; i <= 3; i++ {
+		if _, ok := servers[leader].Submit(i); !ok {
+			t.Fatalf("Submit %d failed", i)
+		}
+	}
+
+	// The drained leader hands its leadership over right away, rather than
+	// leaving the others to wait for an election timeout.
+	start := time.Now()
+	if err := servers[leader].Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	newLeader := waitLeader(t, servers, leader)
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("The next leader was elected after %v", elapsed)
+	}
+	var notLeader *NotLeaderError
+	if _, err := servers[leader].SubmitIndexed(context.Background(), 4); !errors.As(err, &notLeader) {
+		t.Errorf("The drained server accepted a command: %v", err)
+	}
+	cm := servers[leader].cm
+	cm.mu.Lock()
+	snapshotIndex, appliedIndex := cm.snapshotIndex, cm.appliedIndex
+	cm.mu.Unlock()
+	if snapshotIndex != appliedIndex || snapshotIndex < 2 {
+		t.Errorf("The drained server snapshotted at %d, applied up to %d", snapshotIndex, appliedIndex)
+	}
+
+	// It keeps replicating entries, but doesn't lead again, even when the
+	// others step aside.
+	if _, ok := servers[newLeader].Submit(5); !ok {
+		t.Fatal("Submit to the next leader failed")
+	}
+	if err := servers[newLeader].cm.TransferLeadership(servers[leader].serverId); err == nil {
+		t.Error("Expected the drained server to decline the leadership")
+	}
+	if _, _, isLeader := servers[leader].Report(); isLeader {
+		t.Error("The drained server leads again")
+	}
+	servers[leader].Shutdown()
+	if _, ok := servers[waitLeader(t, servers, leader)].Submit(6); !ok {
+		t.Error("Submit failed after the drained server stopped")
+	}
+}
+
+func TestDeadPeerRemoval(t *testing.T) {
+	var isolated atomic.Int32
+	isolated.Store(-1)
+	events := make(chan Event, 10)
+	servers := startCluster(t, 3, func(i int) []Option {
+		transport := NewFaultTransport(nil)
+		transport.SetPolicy(func(to ServerID, serviceMethod string) Fault {
+			id := isolated.Load()
+			return Fault{Drop: id == int32(i) || to == IntID(int(id))}
+		})
+		return []Option{
+			WithApplication(&listApp{}),
+			WithTransport(transport),
+			WithConfig(Config{DeadPeerTimeout: 500 * time.Millisecond}),
+			WithObserver(func(e Event) { events <- e }),
+		}
+	})
+	leader := waitLeader(t, servers, -1)
+	dead := (leader + 1) % 3
+	if err := servers[leader].ForgetPeer("missing"); err == nil {
+		t.Error("Expected forgetting a server that isn't a member to fail")
+	}
+
+	isolated.Store(int32(dead))
+	select {
+	case e := <-events:
+		d, ok := e.(*DeadPeerEvent)
+		if !ok || d.Peer != IntID(dead) || d.Silence < 500*time.Millisecond {
+			t.Fatalf("Got event %+v, want the removal of %d", e, dead)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("The dead peer wasn't removed")
+	}
+	for start := time.Now(); ; time.Sleep(20 * time.Millisecond) {
+		servers[leader].cm.mu.Lock()
+		_, member := servers[leader].cm.peerIds[IntID(dead)]
+		servers[leader].cm.mu.Unlock()
+		servers[leader].mu.Lock()
+		connected := servers[leader].peerClients[IntID(dead)] != nil
+		servers[leader].mu.Unlock()
+		if !member && !connected {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatalf("Expected the leader to forget %d, member: %v, connected: %v", dead, member, connected)
+		}
+	}
+	if _, ok := servers[leader].Submit(1); !ok {
+		t.Error("Submit failed after the removal")
+	}
+}
+
+func TestSubmitTyped(t *testing.T) {
+	servers := startCluster(t, 3, func(i int) []Option {
+		sum := 0
+		return []Option{WithApplication(TypedApplication[int, string](func(n int) string {
+			sum += n
+			return fmt.Sprint(sum)
+		}))}
+	})
+	leader := waitLeader(t, servers, -1)
+	ctx := context.Background()
+	for i, want := range []string{"1", "3", "6"} {
+		got, err := SubmitTyped[int, string](ctx, servers[leader], i+1)
+		if err != nil || got != want {
+			t.Errorf("SubmitTyped(%d) = %q, %v, want %q", i+1, got, err, want)
+		}
+	}
+	var typeErr *ResultTypeError
+	if _, err := SubmitTyped[int, bool](ctx, servers[leader], 4); !errors.As(err, &typeErr) || typeErr.Result != "10" {
+		t.Errorf("Submitting with the wrong result type returned %v, want a *ResultTypeError", err)
+	}
+	var notLeader *NotLeaderError
+	if _, err := SubmitTyped[int, string](ctx, servers[(leader+1)%3], 5); !errors.As(err, &notLeader) {
+		t.Errorf("Submitting to a follower returned %v, want a *NotLeaderError", err)
+	}
+}
+
+func TestCallContext(t *testing.T) {
+	servers := startCluster(t, 3, func(i int) []Option { return nil })
+	leader := waitLeader(t, servers, -1)
+	follower := (leader + 1) % 3
+
+	// The peer waits for an index far ahead to be applied before replying.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	args := StateChecksumArgs{Index: 1000, Timeout: 10 * time.Second}
+	reply := StateChecksumReply{Checksum: 7}
+	start := time.Now()
+	err := servers[leader].Call(ctx, IntID(follower), "Admin.StateChecksum", args, &reply)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Call returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Call returned after %v, want as soon as ctx is done", elapsed)
+	}
+	if reply.Checksum != 7 {
+		t.Errorf("The reply was overwritten: %+v", reply)
+	}
+
+	// The RPCs of a leader are cancelled when it steps down.
+	cm := servers[leader].cm
+	cm.mu.Lock()
+	roleCtx := cm.roleCtx
+	cm.mu.Unlock()
+	if err := cm.TransferLeadership(IntID(follower)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-roleCtx.Done():
+	case <-time.After(time.Second):
+		t.Error("The context of the leader's RPCs wasn't cancelled when it stepped down")
+	}
+}
+
+func TestReadEntries(t *testing.T) {
+	servers := startCluster(t, 3, func(i int) []Option {
+		return []Option{WithApplication(&listApp{})}
+	})
+	leader := waitLeader(t, servers, -1)
+	var results []SubmitResult
+	for i := 1; i <= 3; i++ {
+		result, err := servers[leader].SubmitIndexed(context.Background(), i)
+		if err != nil {
+			t.Fatalf("Submit %d: %v", i, err)
+		}
+		results = append(results, result)
+	}
+
+	entries, err := servers[leader].ReadEntries(0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) < 3 {
+		t.Fatalf("ReadEntries returned %+v, want the 3 submitted commands", entries)
+	}
+	for i, entry := range entries[len(entries)-3:] {
+		want := LogEntryInfo{Index: results[i].Index, Term: results[i].Term, Command: fmt.Sprint(i + 1), Committed: true}
+		if entry != want {
+			t.Errorf("Entry %d is %+v, want %+v", i, entry, want)
+		}
+	}
+	first := results[1].Index
+	if entries, err := servers[leader].ReadEntries(first, first+1); err != nil || len(entries) != 1 || entries[0].Index != first {
+		t.Errorf("ReadEntries(%d, %d) = %+v, %v, want the entry at %d", first, first+1, entries, err, first)
+	}
+	if _, err := servers[leader].ReadEntries(-1, -1); err == nil {
+		t.Error("Expected a negative index to be refused")
+	}
+
+	long := summarizeCommand(strings.Repeat("x", 2*maxCommandSummary))
+	if !strings.HasPrefix(long, strings.Repeat("x", maxCommandSummary)+"...") || len(long) > maxCommandSummary+32 {
+		t.Errorf("Expected a long command to be cut, got %q", long)
+	}
+}
+
+func TestUpdateConfig(t *testing.T) {
+	var mu sync.Mutex
+	heartbeats := 0
+	servers := startCluster(t, 3, func(i int) []Option {
+		transport := NewFaultTransport(nil)
+		transport.SetPolicy(func(to ServerID, serviceMethod string) Fault {
+			if serviceMethod == "ConsensusModule.AppendEntries" {
+				mu.Lock()
+				heartbeats++
+				mu.Unlock()
+			}
+			return Fault{}
+		})
+		return []Option{WithApplication(&listApp{}), WithTransport(transport)}
+	})
+	leader := waitLeader(t, servers, -1)
+	count := func() int {
+		mu.Lock()
+		before := heartbeats
+		mu.Unlock()
+		time.Sleep(300 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		return heartbeats - before
+	}
+
+	// A heartbeat interval above the election timeout is refused.
+	if _, err := servers[leader].UpdateConfig(ConfigUpdate{HeartbeatInterval: time.Second}); err == nil {
+		t.Error("Expected an invalid config to be refused")
+	}
+	slow := count()
+	current, err := servers[leader].UpdateConfig(ConfigUpdate{HeartbeatInterval: 10 * time.Millisecond, SnapshotThreshold: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ConfigUpdate{ElectionTimeoutMin: 150 * time.Millisecond, ElectionTimeoutMax: 300 * time.Millisecond, HeartbeatInterval: 10 * time.Millisecond, SnapshotThreshold: 5}
+	if current != want {
+		t.Errorf("UpdateConfig returned %+v, want %+v", current, want)
+	}
+	if fast := count(); fast < 2*slow {
+		t.Errorf("Expected the leader to send heartbeats faster, sent %d AEs after the update, %d before", fast, slow)
+	}
+
+	for i := 0; i < 6; i++ {
+		if _, ok := servers[leader].Submit(i); !ok {
+			t.Fatalf("Submit %d failed", i)
+		}
+	}
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		servers[leader].cm.mu.Lock()
+		snapshotIndex := servers[leader].cm.snapshotIndex
+		servers[leader].cm.mu.Unlock()
+		if snapshotIndex >= 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a snapshot after 5 entries, the snapshot index is %d", snapshotIndex)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReadBatching(t *testing.T) {
+	var mu sync.Mutex
+	rounds := 0
+	servers := startCluster(t, 3, func(i int) []Option {
+		transport := NewFaultTransport(nil)
+		transport.SetPolicy(func(to ServerID, serviceMethod string) Fault {
+			if serviceMethod == "ConsensusModule.AppendEntries" {
+				mu.Lock()
+				rounds++
+				mu.Unlock()
+			}
+			return Fault{}
+		})
+		return []Option{WithApplication(&listApp{}), WithTransport(transport)}
+	})
+	leader := waitLeader(t, servers, -1)
+	ctx := context.Background()
+	if _, err := servers[leader].Read(ctx, nil); err != ErrLeaderNotReady {
+		t.Errorf("Read before a commit in the term returned %v, want ErrLeaderNotReady", err)
+	}
+	var notLeader *NotLeaderError
+	if _, err := servers[(leader+1)%3].Read(ctx, nil); !errors.As(err, &notLeader) {
+		t.Errorf("Read on a follower returned %v, want a *NotLeaderError", err)
+	}
+	if _, ok := servers[leader].Submit(1); !ok {
+		t.Fatal("Submit failed")
+	}
+
+	const num = 50
+	mu.Lock()
+	before := rounds
+	mu.Unlock()
+	var wg sync.WaitGroup
+	for i := 0; i < num; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if n, err := servers[leader].Read(ctx, nil); err != nil || n != 1 {
+				t.Errorf("Read returned %v, %v, want the 1 command applied", n, err)
+			}
+		}()
+	}
+	wg.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	// Each round sends an AE to both followers.
+	if sent := rounds - before; sent >= num {
+		t.Errorf("Expected the %d reads to share a few rounds, the leader sent %d AEs", num, sent)
+	}
+}
+
+func TestFaultTransport(t *testing.T) {
+	num := 3
+	transports := make([]*FaultTransport, num)
+	apps := make([]*listApp, num)
+	servers := startCluster(t, num, func(i int) []Option {
+		transports[i] = NewFaultTransport(nil)
+		apps[i] = &listApp{}
+		return []Option{WithTransport(transports[i]), WithApplication(apps[i])}
+	})
+	leader := waitLeader(t, servers, -1)
+
+	// Cut a follower off, and mistreat the RPCs between the others.
+	cut := (leader + 1) % num
+	for i, transport := range transports {
+		i := i
+		random := RandomFaults(int64(i), FaultRates{Duplicate: 0.3, Reorder: 0.3, MaxDelay: 5 * time.Millisecond})
+		transport.SetPolicy(func(to ServerID, serviceMethod string) Fault {
+			if i == cut || to == IntID(cut) {
+				return Fault{Drop: true}
+			}
+			return random(to, serviceMethod)
+		})
+	}
+	var want []int
+	for i := 0; i < 20; i++ {
+		if _, ok := servers[leader].Submit(i); !ok {
+			t.Fatalf("Submit(%d) failed", i)
+		}
+		want = append(want, i)
+	}
+	if got := apps[leader].get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Leader applied %v, want %v", got, want)
+	}
+	if got := apps[cut].get(); len(got) != 0 {
+		t.Errorf("Cut off follower applied %v", got)
+	}
+
+	// Once healed, the follower catches up. Its term rose while it was cut
+	// off, so it may depose the leader.
+	for _, transport := range transports {
+		transport.SetPolicy(nil)
+	}
+	submitToLeader(t, servers, "20", 20)
+	want = append(want, 20)
+	for deadline := time.Now().Add(3 * time.Second); !reflect.DeepEqual(apps[cut].get(), want); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Healed follower applied %v, want %v", apps[cut].get(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOneAEInFlight(t *testing.T) {
+	num := 3
+	transports := make([]*FaultTransport, num)
+	servers := startCluster(t, num, func(i int) []Option {
+		transports[i] = NewFaultTransport(nil)
+		return []Option{WithTransport(transports[i]), WithApplication(&listApp{})}
+	})
+	leader := waitLeader(t, servers, -1)
+	slow := IntID((leader + 1) % num)
+	before := runtime.NumGoroutine()
+
+	// The AEs to the slow follower take many heartbeats; the leader waits for
+	// each reply rather than piling up goroutines.
+	transports[leader].SetPolicy(func(to ServerID, serviceMethod string) Fault {
+		if to == slow && serviceMethod == "ConsensusModule.AppendEntries" {
+			return Fault{Delay: time.Second}
+		}
+		return Fault{}
+	})
+	for i := 0; i < 5; i++ {
+		if _, ok := servers[leader].Submit(i); !ok {
+			t.Fatalf("Submit(%d) failed", i)
+		}
+	}
+	time.Sleep(800 * time.Millisecond)
+	if after := runtime.NumGoroutine(); after > before+5 {
+		t.Errorf("Goroutines grew from %d to %d with a slow follower", before, after)
+	}
+	transports[leader].SetPolicy(nil)
+}
+
+func TestCommitUpToLastNewEntry(t *testing.T) {
+	s, err := NewServer(0, WithCluster(3, make(chan interface{})), WithApplication(&listApp{}), WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm := NewConsensusModule(s)
+	defer cm.Stop(context.Background())
+
+	// The follower holds entries 2 and 3 of term 2, from a leader that
+	// didn't commit them. The leader of term 3 has entries of term 3 there,
+	// and committed them, but catches the follower up from entry 1 on
+	// without sending the entries yet.
+	cm.mu.Lock()
+	for i, term := range []int{1, 1, 2, 2} {
+		cm.log = append(cm.log, LogEntry{Command: i, Term: term, Checksum: entryChecksum(term, i)})
+	}
+	if err := cm.persistEntries(0, cm.log); err != nil {
+		t.Fatal(err)
+	}
+	cm.currentTerm = 3
+	cm.mu.Unlock()
+
+	var reply AppendEntriesReply
+	args := AppendEntriesArgs{ProtocolVersion: ProtocolVersion, Term: 3, LeaderId: IntID(1), PrevLogIndex: 1, PrevLogTerm: 1, LeaderCommit: 3}
+	if err := cm.AppendEntries(args, &reply); err != nil || !reply.Success {
+		t.Fatalf("AppendEntries failed: reply %+v, err %v", reply, err)
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.commitIndex != 1 {
+		t.Errorf("Follower committed up to %d, want 1: the entries after the ones sent may be stale", cm.commitIndex)
+	}
+}
+
+func TestMaxPending(t *testing.T) {
+	num := 3
+	transports := make([]*FaultTransport, num)
+	servers := startCluster(t, num, func(i int) []Option {
+		transports[i] = NewFaultTransport(nil)
+		return []Option{WithTransport(transports[i]), WithApplication(&listApp{}), WithConfig(Config{MaxPending: 2})}
+	})
+	leader := waitLeader(t, servers, -1)
+	for i := 0; i < 3; i++ {
+		if _, ok := servers[leader].Submit(i); !ok {
+			t.Fatalf("Submit(%d) failed", i)
+		}
+	}
+
+	// Without replication, the leader takes two more entries.
+	transports[leader].SetPolicy(func(to ServerID, serviceMethod string) Fault {
+		return Fault{Drop: serviceMethod == "ConsensusModule.AppendEntries"}
+	})
+	for i := 3; i < 5; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, err := servers[leader].cm.SubmitIndexed(ctx, i)
+		cancel()
+		if err != ErrUnknownResult {
+			t.Fatalf("Expected Submit(%d) to be appended with an unknown result, got %v", i, err)
+		}
+	}
+	if _, err := servers[leader].cm.SubmitIndexed(context.Background(), 5); err != ErrProposalQueueFull {
+		t.Fatalf("Expected the third uncommitted command to be rejected, got %v", err)
+	}
+
+	// Once they're committed, it takes new commands again.
+	transports[leader].SetPolicy(nil)
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		_, err := servers[leader].cm.SubmitIndexed(context.Background(), 5)
+		if err == nil {
+			break
+		}
+		if err != ErrProposalQueueFull || time.Now().After(deadline) {
+			t.Fatalf("Expected the command to be accepted after the commit, got %v", err)
+		}
+	}
+}
+
+func TestMaxCommandBytes(t *testing.T) {
+	servers := startCluster(t, 3, func(i int) []Option {
+		return []Option{WithApplication(nopApp{}), WithConfig(Config{MaxCommandBytes: 1024})}
+	})
+	leader := waitLeader(t, servers, -1)
+	if _, err := servers[leader].cm.SubmitIndexed(context.Background(), strings.Repeat("x", 900)); err != nil {
+		t.Fatalf("Expected a command below the maximum to be committed, got %v", err)
+	}
+	_, err := servers[leader].cm.SubmitIndexed(context.Background(), strings.Repeat("x", 2000))
+	var tooLarge *CommandTooLargeError
+	if !errors.As(err, &tooLarge) || tooLarge.Max != 1024 || tooLarge.Size <= 2000 {
+		t.Fatalf("Expected a CommandTooLargeError, got %v", err)
+	}
+}
+
+// stringsApp records the string commands it applies.
+type stringsApp struct {
+	mu       sync.Mutex
+	commands []string
+}
+
+func (app *stringsApp) ApplyCommand(command interface{}) interface{} {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	app.commands = append(app.commands, command.(string))
+	return len(app.commands)
+}
+
+func (app *stringsApp) get() []string {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	return append([]string(nil), app.commands...)
+}
+
+func TestSubmitChunked(t *testing.T) {
+	apps := []*stringsApp{{}, {}, {}}
+	servers := startCluster(t, 3, func(i int) []Option {
+		return []Option{WithApplication(apps[i]), WithConfig(Config{MaxCommandBytes: 1024})}
+	})
+	leader := waitLeader(t, servers, -1)
+	large := strings.Repeat("x", 5000)
+	result, err := servers[leader].SubmitChunked(context.Background(), large)
+	if err != nil || result.Result != 1 {
+		t.Fatalf("SubmitChunked = %+v, %v, want the result 1", result, err)
+	}
+	result, err = servers[leader].SubmitChunked(context.Background(), "small")
+	if err != nil || result.Result != 2 {
+		t.Fatalf("SubmitChunked = %+v, %v, want the result 2", result, err)
+	}
+	want := []string{large, "small"}
+	for i, app := range apps {
+		deadline := time.Now().Add(2 * time.Second)
+		for !reflect.DeepEqual(app.get(), want) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := app.get(); !reflect.DeepEqual(got, want) {
+			t.Errorf("Server %d applied %d commands, want the chunked one and then the small one", i, len(got))
+		}
+	}
+}
+
+func TestChunkAssembler(t *testing.T) {
+	var a chunkAssembler
+	if _, whole := a.add(commandChunk{Part: 0, Parts: 2, Data: []byte("ab")}); whole {
+		t.Fatalf("Expected the first of two parts not to make the command whole")
+	}
+	// A new command starting over drops the parts of the overwritten one.
+	if _, whole := a.add(commandChunk{Part: 0, Parts: 2, Data: []byte("cd")}); whole {
+		t.Fatalf("Expected the first of two parts not to make the command whole")
+	}
+	if data, whole := a.add(commandChunk{Part: 1, Parts: 2, Data: []byte("ef")}); !whole || string(data) != "cdef" {
+		t.Errorf("add = %q, %v, want \"cdef\", true", data, whole)
+	}
+	a.restore([][]byte{[]byte("gh")})
+	a.interrupt()
+	if _, whole := a.add(commandChunk{Part: 1, Parts: 2, Data: []byte("ij")}); whole {
+		t.Errorf("Expected a part following an interrupted command to be dropped")
+	}
+	if len(a.pending()) != 0 {
+		t.Errorf("Expected no pending parts, got %q", a.pending())
+	}
+}
+
+// versionedApp is a listApp whose snapshots have a schema version.
+type versionedApp struct {
+	listApp
+	version  int
+	restored int
+}
+
+func (app *versionedApp) SchemaVersion() int {
+	return app.version
+}
+
+func (app *versionedApp) RestoreFromVersion(r io.Reader, version int) error {
+	app.restored = version
+	return app.RestoreFrom(r)
+}
+
+func TestVersionedSnapshot(t *testing.T) {
+	servers := startCluster(t, 3, func(i int) []Option {
+		return []Option{WithApplication(&versionedApp{version: 2})}
+	})
+	leader := waitLeader(t, servers, -1)
+	for i := 1; i <= 3; i++ {
+		if _, ok := servers[leader].Submit(i); !ok {
+			t.Fatal("Submit failed")
+		}
+	}
+	index, term, err := servers[leader].TakeSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, _, err := servers[leader].cm.storage.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, appData, _, err := readSnapshotHeader(snap.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Version != snapshotFormatVersion || header.Index != index || header.Term != term || header.SchemaVersion != 2 {
+		t.Errorf("Got the header %+v for the snapshot at %d in term %d of schema version 2", header, index, term)
+	}
+
+	// A newer version of the application migrates the snapshot, and an
+	// older one refuses it.
+	app := &versionedApp{version: 3}
+	if err := restoreSnapshot(app, header, appData); err != nil || app.restored != 2 || !reflect.DeepEqual(app.get(), []int{1, 2, 3}) {
+		t.Errorf("restoreSnapshot: %v; restored version %d and %v", err, app.restored, app.get())
+	}
+	if err := restoreSnapshot(&versionedApp{version: 1}, header, appData); err == nil {
+		t.Errorf("Expected an older application to refuse the snapshot")
+	}
+}
+
+func TestTriggerAECoalesces(t *testing.T) {
+	// The timer loop doesn't run until the cluster is ready, so that none of
+	// the triggers is consumed.
+	s, err := NewServer(0, WithCluster(1, make(chan interface{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Serve()
+	defer s.Shutdown()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.cm.triggerAE()
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("triggerAE blocked")
+	}
+	if pending := len(s.cm.triggerAEChan); pending != 1 {
+		t.Errorf("Expected the triggers to coalesce into one pending round, got %d", pending)
+	}
+}
+
+func TestLeaderCh(t *testing.T) {
+	num := 3
+	transports := make([]*FaultTransport, num)
+	servers := startCluster(t, num, func(i int) []Option {
+		transports[i] = NewFaultTransport(nil)
+		return []Option{WithTransport(transports[i])}
+	})
+	leader := waitLeader(t, servers, -1)
+	receive := func(i int) (bool, bool) {
+		select {
+		case leading := <-servers[i].LeaderCh():
+			return leading, true
+		case <-time.After(3 * time.Second):
+			return false, false
+		}
+	}
+	if leading, ok := receive(leader); !ok || !leading {
+		t.Fatalf("Expected the LeaderCh of the leader to receive true, got %v, %v", leading, ok)
+	}
+
+	// Cut off from the followers, the leader is deposed by the next one.
+	transports[leader].SetPolicy(func(to ServerID, serviceMethod string) Fault {
+		return Fault{Drop: true}
+	})
+	next := waitLeader(t, servers, leader)
+	if leading, ok := receive(next); !ok || !leading {
+		t.Fatalf("Expected the LeaderCh of the new leader to receive true, got %v, %v", leading, ok)
+	}
+	if leading, ok := receive(leader); !ok || leading {
+		t.Fatalf("Expected the LeaderCh of the old leader to receive false, got %v, %v", leading, ok)
+	}
+	for i := range servers {
+		select {
+		case leading := <-servers[i].LeaderCh():
+			t.Errorf("Server %d received %v, want no more changes", i, leading)
+		default:
+		}
+	}
+}
+
+func TestServerLeader(t *testing.T) {
+	servers := startCluster(t, 3, func(i int) []Option { return nil })
+	leader := waitLeader(t, servers, -1)
+	want := servers[leader].GetListenAddr().String()
+	for i, s := range servers {
+		deadline := time.Now().Add(time.Second)
+		id, addr := s.Leader()
+		for (id != IntID(leader) || addr != want) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+			id, addr = s.Leader()
+		}
+		if id != IntID(leader) || addr != want {
+			t.Errorf("Server %d knows the leader %q at %q, want %q at %q", i, id, addr, IntID(leader), want)
+		}
+	}
+}
+
+func TestAdvertiseAddr(t *testing.T) {
+	ready := make(chan interface{})
+	s, err := NewServer(0, WithCluster(1, ready), WithListenAddr("127.0.0.1:0"), WithAdvertiseAddr("raft-0.example:7000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Serve()
+	defer s.Shutdown()
+	if addr := s.GetListenAddr().String(); addr != "raft-0.example:7000" {
+		t.Errorf("GetListenAddr = %s, want the advertised address", addr)
+	}
+	s.mu.Lock()
+	listening := s.listener.Addr().String()
+	s.mu.Unlock()
+	if host, _, _ := net.SplitHostPort(listening); host != "127.0.0.1" {
+		t.Errorf("Listening at %s, want 127.0.0.1", listening)
+	}
+}
+
+func TestDataDir(t *testing.T) {
+	dir := t.TempDir()
+	ready := make(chan interface{})
+	s, err := NewServer(0, WithCluster(1, ready), WithApplication(&listApp{}), WithDataDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Serve()
+	close(ready)
+	waitLeader(t, []*Server{s}, -1)
+	if _, ok := s.Submit(7); !ok {
+		t.Fatal("Submit(7) failed")
+	}
+	s.Shutdown()
+
+	// Stop closed the write-ahead log, so it can be opened again.
+	s, err = NewServer(0, WithCluster(1, make(chan interface{})), WithDataDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.storage.(*wal.WAL); !ok {
+		t.Fatalf("The storage is a %T, want a *wal.WAL", s.storage)
+	}
+	last, err := s.storage.LastIndex()
+	if err != nil || last < 0 {
+		t.Errorf("LastIndex() = %d, %v, want the index of the submitted command", last, err)
+	}
+	s.storage.Close()
+}
+
+func TestSingleServer(t *testing.T) {
+	app := &listApp{}
+	servers := startCluster(t, 1, func(i int) []Option { return []Option{WithApplication(app)} })
+	waitLeader(t, servers, -1)
+	for i := 0; i < 3; i++ {
+		if result, ok := servers[0].Submit(i); !ok || result != i+1 {
+			t.Fatalf("Submit(%d) = %v, %v, want %d, true", i, result, ok, i+1)
+		}
+	}
+	if got := app.get(); !reflect.DeepEqual(got, []int{0, 1, 2}) {
+		t.Errorf("Applied %v, want [0 1 2]", got)
+	}
+}
+
+func TestSeededElectionTimeouts(t *testing.T) {
+	draws := func(seed int64, id ServerID, groupId int) []int64 {
+		rng := newCMRand(seed, id, groupId)
+		var draws []int64
+		for i := 0; i < 10; i++ {
+			draws = append(draws, rng.Int63n(int64(time.Second)))
+		}
+		return draws
+	}
+	if a, b := draws(42, IntID(0), 0), draws(42, IntID(0), 0); !reflect.DeepEqual(a, b) {
+		t.Errorf("Draws with the same seed differ: %v and %v", a, b)
+	}
+	if a, b := draws(42, IntID(0), 0), draws(42, IntID(1), 0); reflect.DeepEqual(a, b) {
+		t.Errorf("Servers 0 and 1 drew the same timeouts %v", a)
+	}
+	if a, b := draws(42, IntID(0), 0), draws(42, IntID(0), 1); reflect.DeepEqual(a, b) {
+		t.Errorf("Groups 0 and 1 drew the same timeouts %v", a)
+	}
+	if a, b := draws(42, IntID(0), 0), draws(43, IntID(0), 0); reflect.DeepEqual(a, b) {
+		t.Errorf("Seeds 42 and 43 drew the same timeouts %v", a)
+	}
+}
+
+func TestElectionVotes(t *testing.T) {
+	// The CM is one of 5 servers, never connected: the test answers its
+	// RequestVotes itself.
+	s, err := NewServer(0, WithCluster(5, make(chan interface{})), WithApplication(&listApp{}), WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm := NewConsensusModule(s)
+	defer cm.Stop(context.Background())
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	granted := func(term int) RequestVoteReply {
+		return RequestVoteReply{Term: term, VoteGranted: true}
+	}
+
+	cm.startElection()
+	first := cm.currentTerm
+	cm.recordVote(first, IntID(1), granted(first))
+	cm.startElection()
+	second := cm.currentTerm
+
+	// The votes of the first election don't count in the second, and a
+	// voter counts once.
+	cm.recordVote(first, IntID(2), granted(first))
+	cm.recordVote(second, IntID(1), granted(second))
+	cm.recordVote(second, IntID(1), granted(second))
+	if cm.state != Candidate {
+		t.Fatalf("Became %v with the votes of 2 servers of 5", cm.state)
+	}
+	cm.recordVote(second, IntID(2), RequestVoteReply{Term: second})
+	cm.recordVote(second, IntID(3), granted(second))
+	if cm.state != Leader || cm.currentTerm != second {
+		t.Fatalf("Still %v in term %d with the votes of 3 servers of 5 in term %d", cm.state, cm.currentTerm, second)
+	}
+
+	// Votes granted once the election is won don't make it leader again.
+	cm.recordVote(second, IntID(4), granted(second))
+	if won := cm.metrics.electionsWon; won != 1 {
+		t.Errorf("Won %d elections, want 1", won)
+	}
+
+	// A reply of a later term deposes it, and one of an earlier term
+	// doesn't take its term back.
+	cm.recordVote(second, IntID(4), RequestVoteReply{Term: second + 1})
+	if cm.state != Follower || cm.currentTerm != second+1 {
+		t.Errorf("%v in term %d after a reply of term %d", cm.state, cm.currentTerm, second+1)
+	}
+	cm.recordVote(second, IntID(4), RequestVoteReply{Term: second})
+	if cm.currentTerm != second+1 {
+		t.Errorf("Term %d after a reply of term %d in term %d", cm.currentTerm, second, second+1)
+	}
+}
+
+// recordingStorage records the writes to a storage.
+type recordingStorage struct {
+	storage.Storage
+	mu     sync.Mutex
+	writes []string
+}
+
+func (s *recordingStorage) record(format string, args ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writes = append(s.writes, fmt.Sprintf(format, args...))
+}
+
+func (s *recordingStorage) SetHardState(st storage.HardState) error {
+	s.record("SetHardState(%d, %q)", st.CurrentTerm, st.VotedFor)
+	return s.Storage.SetHardState(st)
+}
+
+func (s *recordingStorage) Append(entries []storage.Entry) error {
+	s.record("Append(%d)", len(entries))
+	return s.Storage.Append(entries)
+}
+
+func (s *recordingStorage) Save(st storage.HardState, entries []storage.Entry) error {
+	s.record("Save(%d, %q, %d)", st.CurrentTerm, st.VotedFor, len(entries))
+	return storage.Save(s.Storage, st, entries)
+}
+
+// take returns the writes recorded since the last call.
+func (s *recordingStorage) take() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writes := s.writes
+	s.writes = nil
+	return writes
+}
+
+func TestAtomicHardState(t *testing.T) {
+	// The CM is one of 3 servers, never connected: the test sends it RPCs
+	// itself.
+	store := &recordingStorage{Storage: storage.NewMemoryStorage()}
+	s, err := NewServer(0, WithCluster(3, make(chan interface{})), WithApplication(&listApp{}), WithStorage(store), WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm := NewConsensusModule(s)
+	defer cm.Stop(context.Background())
+	expectWrites := func(what string, want ...string) {
+		t.Helper()
+		if got := store.take(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: wrote %q, want %q", what, got, want)
+		}
+	}
+	store.take()
+
+	// A vote in a new term is persisted with the term, in one write.
+	var vote RequestVoteReply
+	if err := cm.RequestVote(RequestVoteArgs{Term: 3, CandidateId: IntID(1), LastLogIndex: -1, LastLogTerm: -1}, &vote); err != nil {
+		t.Fatal(err)
+	}
+	if !vote.VoteGranted {
+		t.Fatalf("Vote not granted: %+v", vote)
+	}
+	expectWrites("RequestVote of a new term", `SetHardState(3, "1")`)
+
+	// So are the entries of an AE of a new term, and its term alone if it
+	// carries none.
+	args := AppendEntriesArgs{Term: 4, LeaderId: IntID(2), PrevLogIndex: -1, PrevLogTerm: -1, LeaderCommit: -1}
+	for _, command := range []int{1, 2} {
+		encoded, token, err := encodeCommand(cm.codec, command)
+		if err != nil {
+			t.Fatal(err)
+		}
+		args.Entries = append(args.Entries, WireEntry{Command: encoded, Term: 4, Token: token, Checksum: wireChecksum(4, encoded, token)})
+	}
+	var reply AppendEntriesReply
+	if err := cm.AppendEntries(args, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if !reply.Success {
+		t.Fatalf("AE rejected: %+v", reply)
+	}
+	expectWrites("AE with entries of a new term", `Save(4, "", 2)`)
+	if err := cm.AppendEntries(AppendEntriesArgs{Term: 4, LeaderId: IntID(2), PrevLogIndex: 1, PrevLogTerm: 4, LeaderCommit: -1}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	expectWrites("heartbeat")
+	if err := cm.AppendEntries(AppendEntriesArgs{Term: 5, LeaderId: IntID(2), PrevLogIndex: 1, PrevLogTerm: 4, LeaderCommit: -1}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	expectWrites("heartbeat of a new term", `SetHardState(5, "")`)
+	if st, _, err := store.HardState(); err != nil || st.CurrentTerm != 5 || st.VotedFor != "" {
+		t.Errorf("Persisted %+v (%v), want term 5 without a vote", st, err)
+	}
+
+	// A candidate stepping down in its own term keeps its vote for itself.
+	cm.mu.Lock()
+	cm.startElection()
+	term := cm.currentTerm
+	cm.mu.Unlock()
+	store.take()
+	if err := cm.AppendEntries(AppendEntriesArgs{Term: term, LeaderId: IntID(2), PrevLogIndex: 1, PrevLogTerm: 4, LeaderCommit: -1}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	expectWrites("AE of the candidate's term")
+	if err := cm.RequestVote(RequestVoteArgs{Term: term, CandidateId: IntID(1), LastLogIndex: 1, LastLogTerm: 4}, &vote); err != nil {
+		t.Fatal(err)
+	}
+	if vote.VoteGranted {
+		t.Errorf("Voted twice in term %d", term)
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.state != Follower || cm.votedFor != cm.id {
+		t.Errorf("%v voting for %q after stepping down in term %d, want a follower voting for itself", cm.state, cm.votedFor, term)
+	}
+}
+
+// nopApp applies commands without keeping them, so that benchmarks measure
+// the consensus module alone.
+type nopApp struct{}
+
+func (nopApp) ApplyCommand(command interface{}) interface{} {
+	return nil
+}
+
+// BenchmarkSubmit measures the throughput of commands of several sizes
+// submitted concurrently to the leader of clusters of 1, 3 and 5 servers with
+// the memory storage, and reports the median and 99th percentile latency of a
+// submission:
+//
+//	go test -run NONE -bench Submit ./raft
+func BenchmarkSubmit(b *testing.B) {
+	logger := log.New(io.Discard, "", 0)
+	for _, num := range []int{1, 3, 5} {
+		for _, size := range []int{128, 1024, 16 * 1024} {
+			b.Run(fmt.Sprintf("nodes=%d/size=%d", num, size), func(b *testing.B) {
+				servers := startCluster(b, num, func(i int) []Option {
+					return []Option{WithApplication(nopApp{}), WithLogger(logger)}
+				})
+				leader := servers[waitLeader(b, servers, -1)]
+				command := strings.Repeat("x", size)
+				latencies := newHistogram(latencyBounds)
+				b.SetBytes(int64(size))
+				b.SetParallelism(16)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						start := time.Now()
+						if _, ok := leader.Submit(command); !ok {
+							b.Error("Submit failed")
+							return
+						}
+						latencies.observe(time.Since(start))
+					}
+				})
+				b.StopTimer()
+				h := latencies.snapshot()
+				b.ReportMetric(float64(h.Quantile(0.5).Microseconds()), "p50-µs")
+				b.ReportMetric(float64(h.Quantile(0.99).Microseconds()), "p99-µs")
+			})
+		}
+	}
+}
+
+func TestServerIDs(t *testing.T) {
+	ids := []ServerID{"node-a", "node-b", "node-c"}
+	ready := make(chan interface{})
+	var servers []*Server
+	for _, id := range ids {
+		s, err := NewServerWithID(id, WithMembers(ids, ready), WithApplication(&listApp{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Serve()
+		defer s.Shutdown()
+		servers = append(servers, s)
+	}
+	for i, s := range servers {
+		for j, peer := range servers {
+			if i != j {
+				if err := s.Connect(ids[j], peer.GetListenAddr()); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	close(ready)
+
+	leader := waitLeader(t, servers, -1)
+	if id, _, _ := servers[leader].cm.Report(); id != ids[leader] {
+		t.Errorf("Leader reports ID %q, want %q", id, ids[leader])
+	}
+	follower := (leader + 1) % len(servers)
+	for deadline := time.Now().Add(time.Second); servers[follower].cm.Leader() != ids[leader]; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Follower knows leader %q, want %q", servers[follower].cm.Leader(), ids[leader])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := servers[leader].cm.TransferLeadership(ids[follower]); err != nil {
+		t.Fatal(err)
+	}
+	if newLeader := waitLeader(t, servers, leader); newLeader != follower {
+		t.Errorf("Leader is %s after the transfer, want %s", ids[newLeader], ids[follower])
+	}
+
+	if _, err := NewServerWithID(NoServer, WithMembers(ids, ready)); err == nil {
+		t.Error("NewServerWithID accepted an empty ID")
+	}
+}
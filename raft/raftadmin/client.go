@@ -0,0 +1,95 @@
+package raftadmin
+
+import (
+	"context"
+	"crypto/tls"
+
+	"github.com/aecra/raft/raft"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// Client calls the RaftAdmin service of a server. It's safe for concurrent
+// use. A failed call returns an error whose status.Code tells why.
+type Client struct {
+	conn  *grpc.ClientConn
+	token string
+}
+
+// NewClient returns a client of the RaftAdmin service served at addr, over
+// TLS configured by tlsConfig or over plaintext if it's nil, sending token
+// with every call if it's not empty. It connects in the background, so it only
+// fails on a bad address.
+func NewClient(addr string, tlsConfig *tls.Config, token string) (*Client, error) {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(creds), grpc.WithDefaultCallOptions(grpc.ForceCodec(codec{})))
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, token: token}, nil
+}
+
+// Close closes the connection of c.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Status describes the state of group groupId on the server.
+func (c *Client) Status(ctx context.Context, groupId int) (raft.StatusReply, error) {
+	var reply raft.StatusReply
+	err := c.call(ctx, "Status", &raft.AdminArgs{GroupId: groupId}, &reply)
+	return reply, err
+}
+
+// ListPeers describes the members of group groupId.
+func (c *Client) ListPeers(ctx context.Context, groupId int) ([]raft.PeerStatus, error) {
+	var reply raft.ListPeersReply
+	err := c.call(ctx, "ListPeers", &raft.AdminArgs{GroupId: groupId}, &reply)
+	return reply.Peers, err
+}
+
+// AddServer adds server id, listening at addr, to group groupId. The server
+// must be the leader of the group.
+func (c *Client) AddServer(ctx context.Context, groupId int, id raft.ServerID, addr string) error {
+	return c.call(ctx, "AddServer", &raft.ServerArgs{GroupId: groupId, Id: id, Addr: addr}, &struct{}{})
+}
+
+// RemoveServer removes server id from group groupId. The server must be the
+// leader of the group.
+func (c *Client) RemoveServer(ctx context.Context, groupId int, id raft.ServerID) error {
+	return c.call(ctx, "RemoveServer", &raft.ServerArgs{GroupId: groupId, Id: id}, &struct{}{})
+}
+
+// TransferLeadership hands the leadership of group groupId over to server id.
+func (c *Client) TransferLeadership(ctx context.Context, groupId int, id raft.ServerID) error {
+	return c.call(ctx, "TransferLeadership", &raft.ServerArgs{GroupId: groupId, Id: id}, &struct{}{})
+}
+
+// Snapshot snapshots the application of group groupId, and returns the index
+// and term of the last entry the snapshot covers.
+func (c *Client) Snapshot(ctx context.Context, groupId int) (index, term int, err error) {
+	var reply raft.SnapshotReply
+	err = c.call(ctx, "Snapshot", &raft.AdminArgs{GroupId: groupId}, &reply)
+	return reply.Index, reply.Term, err
+}
+
+// ReadLog returns the entries in [from, to) of the log of group groupId, up
+// to its end if to is negative.
+func (c *Client) ReadLog(ctx context.Context, groupId, from, to int) ([]raft.LogEntryInfo, error) {
+	var reply raft.LogReply
+	err := c.call(ctx, "ReadLog", &raft.LogArgs{GroupId: groupId, From: from, To: to}, &reply)
+	return reply.Entries, err
+}
+
+// call calls method with args, and decodes its response into reply.
+func (c *Client) call(ctx context.Context, method string, args, reply interface{}) error {
+	if c.token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+c.token)
+	}
+	return c.conn.Invoke(ctx, "/"+ServiceName+"/"+method, args, reply)
+}
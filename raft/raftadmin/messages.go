@@ -0,0 +1,266 @@
+package raftadmin
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aecra/raft/raft"
+	"github.com/aecra/raft/raft/internal/pbwire"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The messages of raftadmin.proto are the types of the Admin RPC service of
+// package raft: GroupRequest is a raft.AdminArgs, ServerRequest a
+// raft.ServerArgs, StatusResponse a raft.StatusReply, ListPeersResponse a
+// raft.ListPeersReply, SnapshotResponse a raft.SnapshotReply, ReadLogRequest
+// a raft.LogArgs, ReadLogResponse a raft.LogReply and Empty a struct{}.
+
+// marshal encodes m, a pointer to one of the types of the messages.
+func marshal(m interface{}) ([]byte, error) {
+	var e pbwire.Encoder
+	switch m := m.(type) {
+	case *struct{}:
+	case *raft.AdminArgs:
+		e.Int(1, m.GroupId)
+	case *raft.ServerArgs:
+		e.Int(1, m.GroupId)
+		e.String(2, string(m.Id))
+		e.String(3, m.Addr)
+	case *raft.StatusReply:
+		e.String(1, string(m.Id))
+		e.String(2, m.State)
+		e.Sint(3, m.Term)
+		e.String(4, string(m.Leader))
+		e.Sint(5, m.CommitIndex)
+		e.Sint(6, m.LastApplied)
+		e.Sint(7, m.LastLogIndex)
+		e.Sint(8, m.SnapshotIndex)
+		for _, id := range m.Peers {
+			e.Message(9, []byte(id))
+		}
+		e.Int(10, m.ApplyLag)
+		e.Bool(11, m.Maintenance)
+		timestamp(&e, 12, m.LastContact)
+	case *raft.ListPeersReply:
+		for _, peer := range m.Peers {
+			var p pbwire.Encoder
+			p.String(1, string(peer.Id))
+			p.String(2, peer.Addr)
+			p.Sint(3, peer.NextIndex)
+			p.Sint(4, peer.MatchIndex)
+			p.String(5, peer.State)
+			p.Sint(6, peer.Lag)
+			e.Message(1, p.B)
+		}
+	case *raft.SnapshotReply:
+		e.Sint(1, m.Index)
+		e.Sint(2, m.Term)
+	case *raft.LogArgs:
+		e.Int(1, m.GroupId)
+		e.Sint(2, m.From)
+		e.Sint(3, m.To)
+	case *raft.LogReply:
+		for _, entry := range m.Entries {
+			var p pbwire.Encoder
+			p.Sint(1, entry.Index)
+			p.Sint(2, entry.Term)
+			p.String(3, entry.Command)
+			p.Bool(4, entry.Config)
+			p.Bool(5, entry.Committed)
+			e.Message(1, p.B)
+		}
+	default:
+		return nil, fmt.Errorf("raftadmin: can't marshal %T", m)
+	}
+	return e.B, nil
+}
+
+// unmarshal decodes data into m, a pointer to one of the types of the
+// messages.
+func unmarshal(data []byte, m interface{}) error {
+	switch m := m.(type) {
+	case *struct{}:
+		return pbwire.Decode(data, func(f pbwire.Field) error { return nil })
+	case *raft.AdminArgs:
+		*m = raft.AdminArgs{}
+		return pbwire.Decode(data, func(f pbwire.Field) error {
+			if f.Num == 1 {
+				return f.Int(&m.GroupId)
+			}
+			return nil
+		})
+	case *raft.ServerArgs:
+		*m = raft.ServerArgs{}
+		return pbwire.Decode(data, func(f pbwire.Field) error {
+			switch f.Num {
+			case 1:
+				return f.Int(&m.GroupId)
+			case 2:
+				return serverID(f, &m.Id)
+			case 3:
+				return f.String(&m.Addr)
+			}
+			return nil
+		})
+	case *raft.StatusReply:
+		*m = raft.StatusReply{}
+		return pbwire.Decode(data, func(f pbwire.Field) error {
+			switch f.Num {
+			case 1:
+				return serverID(f, &m.Id)
+			case 2:
+				return f.String(&m.State)
+			case 3:
+				return f.Sint(&m.Term)
+			case 4:
+				return serverID(f, &m.Leader)
+			case 5:
+				return f.Sint(&m.CommitIndex)
+			case 6:
+				return f.Sint(&m.LastApplied)
+			case 7:
+				return f.Sint(&m.LastLogIndex)
+			case 8:
+				return f.Sint(&m.SnapshotIndex)
+			case 9:
+				var id raft.ServerID
+				if err := serverID(f, &id); err != nil {
+					return err
+				}
+				m.Peers = append(m.Peers, id)
+			case 10:
+				return f.Int(&m.ApplyLag)
+			case 11:
+				return f.Bool(&m.Maintenance)
+			case 12:
+				return readTimestamp(f, &m.LastContact)
+			}
+			return nil
+		})
+	case *raft.ListPeersReply:
+		*m = raft.ListPeersReply{}
+		return pbwire.Decode(data, func(f pbwire.Field) error {
+			if f.Num != 1 {
+				return nil
+			}
+			var data []byte
+			if err := f.Bytes(&data); err != nil {
+				return err
+			}
+			var peer raft.PeerStatus
+			err := pbwire.Decode(data, func(f pbwire.Field) error {
+				switch f.Num {
+				case 1:
+					return serverID(f, &peer.Id)
+				case 2:
+					return f.String(&peer.Addr)
+				case 3:
+					return f.Sint(&peer.NextIndex)
+				case 4:
+					return f.Sint(&peer.MatchIndex)
+				case 5:
+					return f.String(&peer.State)
+				case 6:
+					return f.Sint(&peer.Lag)
+				}
+				return nil
+			})
+			m.Peers = append(m.Peers, peer)
+			return err
+		})
+	case *raft.SnapshotReply:
+		*m = raft.SnapshotReply{}
+		return pbwire.Decode(data, func(f pbwire.Field) error {
+			switch f.Num {
+			case 1:
+				return f.Sint(&m.Index)
+			case 2:
+				return f.Sint(&m.Term)
+			}
+			return nil
+		})
+	case *raft.LogArgs:
+		*m = raft.LogArgs{}
+		return pbwire.Decode(data, func(f pbwire.Field) error {
+			switch f.Num {
+			case 1:
+				return f.Int(&m.GroupId)
+			case 2:
+				return f.Sint(&m.From)
+			case 3:
+				return f.Sint(&m.To)
+			}
+			return nil
+		})
+	case *raft.LogReply:
+		*m = raft.LogReply{}
+		return pbwire.Decode(data, func(f pbwire.Field) error {
+			if f.Num != 1 {
+				return nil
+			}
+			var data []byte
+			if err := f.Bytes(&data); err != nil {
+				return err
+			}
+			var entry raft.LogEntryInfo
+			err := pbwire.Decode(data, func(f pbwire.Field) error {
+				switch f.Num {
+				case 1:
+					return f.Sint(&entry.Index)
+				case 2:
+					return f.Sint(&entry.Term)
+				case 3:
+					return f.String(&entry.Command)
+				case 4:
+					return f.Bool(&entry.Config)
+				case 5:
+					return f.Bool(&entry.Committed)
+				}
+				return nil
+			})
+			m.Entries = append(m.Entries, entry)
+			return err
+		})
+	}
+	return fmt.Errorf("raftadmin: can't unmarshal into %T", m)
+}
+
+func serverID(f pbwire.Field, v *raft.ServerID) error {
+	var s string
+	if err := f.String(&s); err != nil {
+		return err
+	}
+	*v = raft.ServerID(s)
+	return nil
+}
+
+// timestamp encodes t as a google.protobuf.Timestamp, unless it's the zero
+// time.
+func timestamp(e *pbwire.Encoder, num protowire.Number, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	var p pbwire.Encoder
+	p.Int(1, int(t.Unix()))
+	p.Int(2, t.Nanosecond())
+	e.Message(num, p.B)
+}
+
+func readTimestamp(f pbwire.Field, v *time.Time) error {
+	var data []byte
+	if err := f.Bytes(&data); err != nil {
+		return err
+	}
+	var sec, nsec int
+	err := pbwire.Decode(data, func(f pbwire.Field) error {
+		switch f.Num {
+		case 1:
+			return f.Int(&sec)
+		case 2:
+			return f.Int(&nsec)
+		}
+		return nil
+	})
+	*v = time.Unix(int64(sec), int64(nsec))
+	return err
+}
@@ -0,0 +1,459 @@
+package raftadmin
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aecra/raft/kvstore"
+	"github.com/aecra/raft/raft"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	_ "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// startAdmin starts a single-server cluster and its RaftAdmin service, which
+// takes the token "secret" and is built with opts, and returns the server and
+// the address of the service once the server leads.
+func startAdmin(t *testing.T, opts ...grpc.ServerOption) (*raft.Server, string) {
+	t.Helper()
+	ready := make(chan interface{})
+	s, err := raft.NewServer(0, raft.WithCluster(1, ready), raft.WithApplication(kvstore.NewKVStore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Serve()
+	close(ready)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := NewServer(s, "secret", opts...)
+	go gs.Serve(listener)
+	t.Cleanup(func() {
+		gs.Stop()
+		s.Shutdown()
+	})
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if status, err := s.Status(); err == nil && status.State == "Leader" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server 0 didn't become the leader")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return s, listener.Addr().String()
+}
+
+// newClient returns a client of the service at addr, closed by the end of the
+// test.
+func newClient(t *testing.T, addr string, tlsConfig *tls.Config, token string) *Client {
+	t.Helper()
+	c, err := NewClient(addr, tlsConfig, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestAdmin(t *testing.T) {
+	s, addr := startAdmin(t)
+	c := newClient(t, addr, nil, "secret")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	reply, err := c.Status(ctx, raft.DefaultGroup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Id != raft.IntID(0) || reply.State != "Leader" || reply.Leader != raft.IntID(0) {
+		t.Errorf("got status %+v, want server 0 leading", reply)
+	}
+	if _, ok := s.Submit(kvstore.Entry{Method: "put", Key: "a", Value: "1"}); !ok {
+		t.Fatal("submit failed")
+	}
+
+	entries, err := c.ReadLog(ctx, raft.DefaultGroup, -1, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 || !strings.Contains(entries[len(entries)-1].Command, "put") {
+		t.Fatalf("got entries %+v, want the put last", entries)
+	}
+	index, _, err := c.Snapshot(ctx, raft.DefaultGroup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := entries[len(entries)-1].Index; index != want {
+		t.Errorf("got snapshot index %d, want %d", index, want)
+	}
+	if _, err := c.ListPeers(ctx, raft.DefaultGroup); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.AddServer(ctx, raft.DefaultGroup, "1", ""); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v adding a server without an address, want InvalidArgument", err)
+	}
+	if _, err := c.Status(ctx, 7); status.Code(err) != codes.NotFound {
+		t.Errorf("got %v for an unknown group, want NotFound", err)
+	}
+	if err := c.RemoveServer(ctx, raft.DefaultGroup, "9"); status.Code(err) != codes.Unknown {
+		t.Errorf("got %v removing a server that isn't a member, want Unknown", err)
+	}
+	if err := c.call(ctx, "Nope", &struct{}{}, &struct{}{}); status.Code(err) != codes.Unimplemented {
+		t.Errorf("got %v for an unknown method, want Unimplemented", err)
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	_, addr := startAdmin(t)
+	for _, token := range []string{"", "wrong"} {
+		c := newClient(t, addr, nil, token)
+		if _, err := c.Status(context.Background(), raft.DefaultGroup); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("got %v with token %q, want Unauthenticated", err, token)
+		}
+	}
+}
+
+func TestAdminInterceptor(t *testing.T) {
+	var intercepted int32
+	interceptor := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		atomic.AddInt32(&intercepted, 1)
+		return handler(ctx, req)
+	}
+	_, addr := startAdmin(t, grpc.UnaryInterceptor(interceptor))
+	if _, err := newClient(t, addr, nil, "wrong").Status(context.Background(), raft.DefaultGroup); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("got %v with a wrong token, want Unauthenticated", err)
+	}
+	if n := atomic.LoadInt32(&intercepted); n != 0 {
+		t.Errorf("the interceptor saw %d unauthenticated calls", n)
+	}
+	if _, err := newClient(t, addr, nil, "secret").Status(context.Background(), raft.DefaultGroup); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&intercepted); n != 1 {
+		t.Errorf("the interceptor saw %d calls, want 1", n)
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want codes.Code
+	}{
+		{&raft.NotLeaderError{Leader: "1"}, codes.FailedPrecondition},
+		{fmt.Errorf("%w: group 7", raft.ErrUnknownGroup), codes.NotFound},
+		{fmt.Errorf("%w: server 1", raft.ErrTransferTimeout), codes.DeadlineExceeded},
+		{raft.ErrApplyTimeout, codes.DeadlineExceeded},
+		{raft.ErrConfigChangePending, codes.Aborted},
+		{raft.ErrUnknownResult, codes.Unavailable},
+		{raft.ErrApplyFailed, codes.Internal},
+		{status.Error(codes.InvalidArgument, "bad"), codes.InvalidArgument},
+		{errors.New("other"), codes.Unknown},
+	} {
+		if got := status.Code(statusError(tc.err)); got != tc.want {
+			t.Errorf("statusError(%v) has code %v, want %v", tc.err, got, tc.want)
+		}
+	}
+	if statusError(nil) != nil {
+		t.Error("statusError(nil) isn't nil")
+	}
+}
+
+func TestAdminTLS(t *testing.T) {
+	cert, roots := selfSigned(t)
+	_, addr := startAdmin(t, grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{cert}})))
+	c := newClient(t, addr, &tls.Config{RootCAs: roots}, "secret")
+	reply, err := c.Status(context.Background(), raft.DefaultGroup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.State != "Leader" {
+		t.Errorf("got status %+v, want a leader", reply)
+	}
+	plain := newClient(t, addr, nil, "secret")
+	if _, err := plain.Status(context.Background(), raft.DefaultGroup); err == nil {
+		t.Error("a plaintext call to the TLS service succeeded")
+	}
+}
+
+// selfSigned returns a certificate for 127.0.0.1, and a pool of the roots
+// that trust it.
+func selfSigned(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(parsed)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, roots
+}
+
+func TestMessages(t *testing.T) {
+	in := raft.StatusReply{Id: "a", State: "Follower", Term: 3, Leader: "b", CommitIndex: -1, Peers: []raft.ServerID{"b", ""}, Maintenance: true, LastContact: time.Unix(1700000000, 123)}
+	data, err := marshal(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out raft.StatusReply
+	if err := unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Id != in.Id || out.State != in.State || out.Term != in.Term || out.Leader != in.Leader ||
+		out.CommitIndex != in.CommitIndex || len(out.Peers) != 2 || out.Peers[1] != "" || !out.Maintenance || !out.LastContact.Equal(in.LastContact) {
+		t.Errorf("got %+v, want %+v", out, in)
+	}
+}
+
+// fileDescriptor describes raftadmin.proto as protoc does for the generated
+// stubs, and checks that the file declares the same messages and methods.
+func fileDescriptor(t *testing.T) protoreflect.FileDescriptor {
+	t.Helper()
+	field := func(name string, num int32, typ descriptorpb.FieldDescriptorProto_Type, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(name),
+			Number: proto.Int32(num),
+			Type:   typ.Enum(),
+			Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	repeated := func(f *descriptorpb.FieldDescriptorProto) *descriptorpb.FieldDescriptorProto {
+		f.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+		return f
+	}
+	message := func(name string, fields ...*descriptorpb.FieldDescriptorProto) *descriptorpb.DescriptorProto {
+		return &descriptorpb.DescriptorProto{Name: proto.String(name), Field: fields}
+	}
+	rpc := func(name, input, output string) *descriptorpb.MethodDescriptorProto {
+		return &descriptorpb.MethodDescriptorProto{
+			Name:       proto.String(name),
+			InputType:  proto.String(".raftadmin." + input),
+			OutputType: proto.String(".raftadmin." + output),
+		}
+	}
+	const (
+		int64Type   = descriptorpb.FieldDescriptorProto_TYPE_INT64
+		sint64Type  = descriptorpb.FieldDescriptorProto_TYPE_SINT64
+		stringType  = descriptorpb.FieldDescriptorProto_TYPE_STRING
+		boolType    = descriptorpb.FieldDescriptorProto_TYPE_BOOL
+		messageType = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE
+	)
+	file := &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("raftadmin.proto"),
+		Package:    proto.String("raftadmin"),
+		Dependency: []string{"google/protobuf/timestamp.proto"},
+		Syntax:     proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			message("Empty"),
+			message("GroupRequest", field("group_id", 1, int64Type, "")),
+			message("ServerRequest",
+				field("group_id", 1, int64Type, ""),
+				field("id", 2, stringType, ""),
+				field("addr", 3, stringType, "")),
+			message("StatusResponse",
+				field("id", 1, stringType, ""),
+				field("state", 2, stringType, ""),
+				field("term", 3, sint64Type, ""),
+				field("leader", 4, stringType, ""),
+				field("commit_index", 5, sint64Type, ""),
+				field("last_applied", 6, sint64Type, ""),
+				field("last_log_index", 7, sint64Type, ""),
+				field("snapshot_index", 8, sint64Type, ""),
+				repeated(field("peers", 9, stringType, "")),
+				field("apply_lag", 10, int64Type, ""),
+				field("maintenance", 11, boolType, ""),
+				field("last_contact", 12, messageType, ".google.protobuf.Timestamp")),
+			message("PeerStatus",
+				field("id", 1, stringType, ""),
+				field("addr", 2, stringType, ""),
+				field("next_index", 3, sint64Type, ""),
+				field("match_index", 4, sint64Type, ""),
+				field("state", 5, stringType, ""),
+				field("lag", 6, sint64Type, "")),
+			message("ListPeersResponse", repeated(field("peers", 1, messageType, ".raftadmin.PeerStatus"))),
+			message("SnapshotResponse",
+				field("index", 1, sint64Type, ""),
+				field("term", 2, sint64Type, "")),
+			message("ReadLogRequest",
+				field("group_id", 1, int64Type, ""),
+				field("from", 2, sint64Type, ""),
+				field("to", 3, sint64Type, "")),
+			message("LogEntry",
+				field("index", 1, sint64Type, ""),
+				field("term", 2, sint64Type, ""),
+				field("command", 3, stringType, ""),
+				field("config", 4, boolType, ""),
+				field("committed", 5, boolType, "")),
+			message("ReadLogResponse", repeated(field("entries", 1, messageType, ".raftadmin.LogEntry"))),
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("RaftAdmin"),
+			Method: []*descriptorpb.MethodDescriptorProto{
+				rpc("Status", "GroupRequest", "StatusResponse"),
+				rpc("ListPeers", "GroupRequest", "ListPeersResponse"),
+				rpc("AddServer", "ServerRequest", "Empty"),
+				rpc("RemoveServer", "ServerRequest", "Empty"),
+				rpc("TransferLeadership", "ServerRequest", "Empty"),
+				rpc("Snapshot", "GroupRequest", "SnapshotResponse"),
+				rpc("ReadLog", "ReadLogRequest", "ReadLogResponse"),
+			},
+		}},
+	}
+
+	src, err := os.ReadFile("raftadmin.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	declared := func(pattern string) bool {
+		return regexp.MustCompile(`(?m)^\s*` + pattern + `\s*$`).Match(src)
+	}
+	if n := len(regexp.MustCompile(`(?m)^message `).FindAll(src, -1)); n != len(file.MessageType) {
+		t.Errorf("raftadmin.proto declares %d messages, the test %d", n, len(file.MessageType))
+	}
+	for _, m := range file.MessageType {
+		if !declared(`message ` + m.GetName() + ` \{\}?`) {
+			t.Errorf("raftadmin.proto doesn't declare message %s", m.GetName())
+		}
+		for _, f := range m.Field {
+			typ := strings.TrimPrefix(strings.ToLower(f.GetType().String()), "type_")
+			if f.TypeName != nil {
+				typ = strings.TrimPrefix(strings.TrimPrefix(f.GetTypeName(), ".raftadmin."), ".")
+			}
+			if f.GetLabel() == descriptorpb.FieldDescriptorProto_LABEL_REPEATED {
+				typ = "repeated " + typ
+			}
+			if !declared(regexp.QuoteMeta(typ) + ` ` + f.GetName() + ` = ` + strconv.Itoa(int(f.GetNumber())) + `;`) {
+				t.Errorf("raftadmin.proto doesn't declare field %s %s = %d of %s", typ, f.GetName(), f.GetNumber(), m.GetName())
+			}
+		}
+	}
+	methods := file.Service[0].Method
+	if n := len(regexp.MustCompile(`(?m)^\s*rpc `).FindAll(src, -1)); n != len(methods) {
+		t.Errorf("raftadmin.proto declares %d methods, the test %d", n, len(methods))
+	}
+	for _, m := range methods {
+		in, out := strings.TrimPrefix(m.GetInputType(), ".raftadmin."), strings.TrimPrefix(m.GetOutputType(), ".raftadmin.")
+		if !declared(`rpc ` + m.GetName() + `\(` + in + `\) returns \(` + out + `\);`) {
+			t.Errorf("raftadmin.proto doesn't declare rpc %s(%s) returns (%s)", m.GetName(), in, out)
+		}
+	}
+	fd, err := protodesc.NewFile(file, protoregistry.GlobalFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd
+}
+
+// TestGeneratedClient calls the service the way the stubs generated from
+// raftadmin.proto do: with the standard protobuf codec of grpc-go, on
+// messages described by the file.
+func TestGeneratedClient(t *testing.T) {
+	s, addr := startAdmin(t)
+	if _, ok := s.Submit(kvstore.Entry{Method: "put", Key: "a", Value: "1"}); !ok {
+		t.Fatal("submit failed")
+	}
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+
+	service := fileDescriptor(t).Services().ByName("RaftAdmin")
+	call := func(method string, set func(req *dynamicpb.Message)) (*dynamicpb.Message, error) {
+		md := service.Methods().ByName(protoreflect.Name(method))
+		req, resp := dynamicpb.NewMessage(md.Input()), dynamicpb.NewMessage(md.Output())
+		set(req)
+		return resp, conn.Invoke(ctx, "/"+ServiceName+"/"+method, req, resp)
+	}
+	get := func(m protoreflect.Message, name string) protoreflect.Value {
+		return m.Get(m.Descriptor().Fields().ByName(protoreflect.Name(name)))
+	}
+	set := func(m *dynamicpb.Message, name string, v protoreflect.Value) {
+		m.Set(m.Descriptor().Fields().ByName(protoreflect.Name(name)), v)
+	}
+	group := func(req *dynamicpb.Message) {
+		set(req, "group_id", protoreflect.ValueOfInt64(int64(raft.DefaultGroup)))
+	}
+
+	reply, err := call("Status", group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, state := get(reply, "id").String(), get(reply, "state").String(); id != string(raft.IntID(0)) || state != "Leader" {
+		t.Errorf("got server %q in state %q, want server 0 leading", id, state)
+	}
+	if peers := get(reply, "peers").List(); peers.Len() != 1 || peers.Get(0).String() != string(raft.IntID(0)) {
+		t.Errorf("got peers %v, want server 0", peers)
+	}
+
+	log, err := call("ReadLog", func(req *dynamicpb.Message) {
+		group(req)
+		set(req, "from", protoreflect.ValueOfInt64(0))
+		set(req, "to", protoreflect.ValueOfInt64(-1))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := get(log, "entries").List()
+	if entries.Len() == 0 {
+		t.Fatal("got no entries")
+	}
+	last := entries.Get(entries.Len() - 1).Message()
+	if !strings.Contains(get(last, "command").String(), "put") || !get(last, "committed").Bool() || get(last, "index").Int() != int64(entries.Len()-1) {
+		t.Errorf("got last entry %v, want the committed put", last)
+	}
+
+	if _, err := call("AddServer", group); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v adding a server without an address, want InvalidArgument", err)
+	}
+}
@@ -0,0 +1,221 @@
+// Package raftadmin serves the RaftAdmin gRPC service of raftadmin.proto, which
+// administers the groups of a raft.Server: their membership, leadership and
+// snapshots, and their state and logs. Unlike the Admin RPC service the server
+// registers for raftctl, it's a stable surface for dashboards and tools in
+// other languages, which generate their gRPC stubs from raftadmin.proto.
+//
+// The service is served and called with grpc-go, over plaintext or TLS. Its
+// messages are the types of package raft, encoded by hand like the ones of
+// package raftpb, so the package needs no generated code.
+package raftadmin
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+
+	"github.com/aecra/raft/raft"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// ServiceName is the full name of the service, which the paths of its methods
+// start with.
+const ServiceName = "raftadmin.RaftAdmin"
+
+// method is an RPC of the service: newArgs returns a pointer to its request,
+// and call answers it with a pointer to its response.
+type method struct {
+	newArgs func() interface{}
+	call    func(s *raft.Server, args interface{}) (interface{}, error)
+}
+
+var methods = map[string]method{
+	"Status": {
+		func() interface{} { return new(raft.AdminArgs) },
+		func(s *raft.Server, args interface{}) (interface{}, error) {
+			cm, err := s.Group(args.(*raft.AdminArgs).GroupId)
+			if err != nil {
+				return nil, err
+			}
+			status := cm.Status()
+			return &status, nil
+		},
+	},
+	"ListPeers": {
+		func() interface{} { return new(raft.AdminArgs) },
+		func(s *raft.Server, args interface{}) (interface{}, error) {
+			cm, err := s.Group(args.(*raft.AdminArgs).GroupId)
+			if err != nil {
+				return nil, err
+			}
+			return &raft.ListPeersReply{Peers: cm.ListPeers()}, nil
+		},
+	},
+	"AddServer": {
+		func() interface{} { return new(raft.ServerArgs) },
+		func(s *raft.Server, args interface{}) (interface{}, error) {
+			a := args.(*raft.ServerArgs)
+			if a.Addr == "" {
+				return nil, status.Errorf(codes.InvalidArgument, "the address of server %s is missing", a.Id)
+			}
+			cm, err := s.Group(a.GroupId)
+			if err != nil {
+				return nil, err
+			}
+			return &struct{}{}, cm.AddServer(a.Id, a.Addr)
+		},
+	},
+	"RemoveServer": {
+		func() interface{} { return new(raft.ServerArgs) },
+		func(s *raft.Server, args interface{}) (interface{}, error) {
+			a := args.(*raft.ServerArgs)
+			cm, err := s.Group(a.GroupId)
+			if err != nil {
+				return nil, err
+			}
+			return &struct{}{}, cm.RemoveServer(a.Id)
+		},
+	},
+	"TransferLeadership": {
+		func() interface{} { return new(raft.ServerArgs) },
+		func(s *raft.Server, args interface{}) (interface{}, error) {
+			a := args.(*raft.ServerArgs)
+			cm, err := s.Group(a.GroupId)
+			if err != nil {
+				return nil, err
+			}
+			return &struct{}{}, cm.TransferLeadership(a.Id)
+		},
+	},
+	"Snapshot": {
+		func() interface{} { return new(raft.AdminArgs) },
+		func(s *raft.Server, args interface{}) (interface{}, error) {
+			cm, err := s.Group(args.(*raft.AdminArgs).GroupId)
+			if err != nil {
+				return nil, err
+			}
+			var reply raft.SnapshotReply
+			reply.Index, reply.Term, err = cm.TakeSnapshot()
+			return &reply, err
+		},
+	},
+	"ReadLog": {
+		func() interface{} { return new(raft.LogArgs) },
+		func(s *raft.Server, args interface{}) (interface{}, error) {
+			a := args.(*raft.LogArgs)
+			cm, err := s.Group(a.GroupId)
+			if err != nil {
+				return nil, err
+			}
+			if a.From < 0 {
+				a.From = 0
+			}
+			entries, err := cm.ReadEntries(a.From, a.To)
+			return &raft.LogReply{Entries: entries}, err
+		},
+	},
+}
+
+// NewServer returns a gRPC server, built with opts, serving the RaftAdmin
+// service of s. If token isn't empty, only the calls carrying it are served;
+// it's meant to be the cluster token of s, and is checked before the
+// interceptors set in opts run. Pass grpc.Creds in opts to serve over TLS.
+func NewServer(s *raft.Server, token string, opts ...grpc.ServerOption) *grpc.Server {
+	gs := grpc.NewServer(append([]grpc.ServerOption{grpc.ForceServerCodec(codec{})}, opts...)...)
+	desc := grpc.ServiceDesc{
+		ServiceName: ServiceName,
+		HandlerType: (*interface{})(nil),
+		Metadata:    "raftadmin.proto",
+	}
+	for name, m := range methods {
+		desc.Methods = append(desc.Methods, grpc.MethodDesc{MethodName: name, Handler: m.handler(name)})
+	}
+	gs.RegisterService(&desc, &service{s: s, token: token})
+	return gs
+}
+
+// service is the implementation of the service registered by NewServer.
+type service struct {
+	s     *raft.Server
+	token string
+}
+
+// handler returns the gRPC handler of m, the method called name.
+func (m method) handler(name string) func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		args := m.newArgs()
+		if err := dec(args); err != nil {
+			return nil, err
+		}
+		// The token is checked first, so that interceptors only see
+		// authenticated calls.
+		svc := srv.(*service)
+		if err := svc.authenticate(ctx); err != nil {
+			return nil, err
+		}
+		call := func(ctx context.Context, args interface{}) (interface{}, error) {
+			reply, err := m.call(svc.s, args)
+			return reply, statusError(err)
+		}
+		if interceptor == nil {
+			return call(ctx, args)
+		}
+		return interceptor(ctx, args, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + ServiceName + "/" + name}, call)
+	}
+}
+
+// authenticate checks that the call of ctx carries the token of svc.
+func (svc *service) authenticate(ctx context.Context) error {
+	if svc.token == "" {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, auth := range md.Get("authorization") {
+		if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+svc.token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "bad cluster token")
+}
+
+// statusError returns err as a gRPC status whose code tells why the call
+// failed, for the errors of package raft. Statuses are returned as they are,
+// and the other errors take codes.Unknown.
+func statusError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	var notLeader *raft.NotLeaderError
+	code := codes.Unknown
+	switch {
+	case errors.As(err, &notLeader):
+		code = codes.FailedPrecondition
+	case errors.Is(err, raft.ErrUnknownGroup):
+		code = codes.NotFound
+	case errors.Is(err, raft.ErrTransferTimeout), errors.Is(err, raft.ErrApplyTimeout),
+		errors.Is(err, raft.ErrEnqueueTimeout), errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	case errors.Is(err, raft.ErrConfigChangePending):
+		code = codes.Aborted
+	case errors.Is(err, raft.ErrUnknownResult):
+		code = codes.Unavailable
+	case errors.Is(err, raft.ErrApplyFailed):
+		code = codes.Internal
+	}
+	return status.Error(code, err.Error())
+}
+
+// codec encodes the messages of the service with marshal and unmarshal. It's
+// named "proto" as it speaks the protobuf wire format, so clients generated
+// from raftadmin.proto can call the service.
+type codec struct{}
+
+func (codec) Marshal(v interface{}) ([]byte, error)      { return marshal(v) }
+func (codec) Unmarshal(data []byte, v interface{}) error { return unmarshal(data, v) }
+func (codec) Name() string                               { return "proto" }
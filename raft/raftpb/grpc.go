@@ -0,0 +1,120 @@
+package raftpb
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/aecra/raft/raft"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// ServiceName is the full name of the Raft service of raft.proto, which the
+// paths of its methods start with.
+const ServiceName = "raftpb.Raft"
+
+// GRPC is a raft.PeerRPC exchanging the RPCs as the Raft gRPC service of
+// raft.proto. Select it with raft.WithPeerRPC(raftpb.GRPC{}). The connections
+// are secured by the raft.Transport of the servers, so gRPC doesn't add TLS
+// of its own.
+type GRPC struct{}
+
+var _ raft.PeerRPC = GRPC{}
+
+// method is an RPC of the service: newArgs and newReply return pointers to
+// its args and reply, and call answers it with h.
+type method struct {
+	newArgs, newReply func() interface{}
+	call              func(h raft.PeerHandler, args, reply interface{}) error
+}
+
+var methods = map[string]method{
+	"RequestVote": {
+		func() interface{} { return new(raft.RequestVoteArgs) },
+		func() interface{} { return new(raft.RequestVoteReply) },
+		func(h raft.PeerHandler, args, reply interface{}) error {
+			return h.RequestVote(*args.(*raft.RequestVoteArgs), reply.(*raft.RequestVoteReply))
+		},
+	},
+	"AppendEntries": {
+		func() interface{} { return new(raft.AppendEntriesArgs) },
+		func() interface{} { return new(raft.AppendEntriesReply) },
+		func(h raft.PeerHandler, args, reply interface{}) error {
+			return h.AppendEntries(*args.(*raft.AppendEntriesArgs), reply.(*raft.AppendEntriesReply))
+		},
+	},
+	"InstallSnapshot": {
+		func() interface{} { return new(raft.InstallSnapshotArgs) },
+		func() interface{} { return new(raft.InstallSnapshotReply) },
+		func(h raft.PeerHandler, args, reply interface{}) error {
+			return h.InstallSnapshot(*args.(*raft.InstallSnapshotArgs), reply.(*raft.InstallSnapshotReply))
+		},
+	},
+}
+
+// Serve answers the RPCs received on the connections l accepts with h, until
+// l is closed. It then closes the connections.
+func (GRPC) Serve(l net.Listener, h raft.PeerHandler) error {
+	gs := grpc.NewServer(grpc.ForceServerCodec(codec{}))
+	desc := grpc.ServiceDesc{
+		ServiceName: ServiceName,
+		HandlerType: (*raft.PeerHandler)(nil),
+		Metadata:    "raft.proto",
+	}
+	for name, m := range methods {
+		desc.Methods = append(desc.Methods, grpc.MethodDesc{MethodName: name, Handler: m.handler})
+	}
+	gs.RegisterService(&desc, h)
+	err := gs.Serve(l)
+	gs.Stop()
+	return err
+}
+
+func (m method) handler(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+	args, reply := m.newArgs(), m.newReply()
+	if err := dec(args); err != nil {
+		return nil, err
+	}
+	if err := m.call(srv.(raft.PeerHandler), args, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// NewClient returns a client calling the RPCs of a peer over the connections
+// opened by dial. It connects on the first call, and reconnects when the
+// connection breaks.
+func (GRPC) NewClient(dial func(ctx context.Context) (net.Conn, error)) (raft.PeerClient, error) {
+	conn, err := grpc.Dial("passthrough:///raft-peer",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return dial(ctx) }),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(codec{})))
+	if err != nil {
+		return nil, err
+	}
+	return client{conn}, nil
+}
+
+// client is the raft.PeerClient of GRPC.
+type client struct {
+	conn *grpc.ClientConn
+}
+
+func (c client) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	method := strings.TrimPrefix(serviceMethod, "ConsensusModule.")
+	return c.conn.Invoke(ctx, "/"+ServiceName+"/"+method, args, reply)
+}
+
+func (c client) Close() error {
+	return c.conn.Close()
+}
+
+// codec encodes the messages with Marshal and Unmarshal. It's named "proto" as
+// it speaks the protobuf wire format, so that stubs generated from raft.proto
+// can call the service.
+type codec struct{}
+
+func (codec) Marshal(v interface{}) ([]byte, error)      { return Marshal(v) }
+func (codec) Unmarshal(data []byte, v interface{}) error { return Unmarshal(data, v) }
+func (codec) Name() string                               { return "proto" }
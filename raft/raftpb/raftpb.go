@@ -0,0 +1,257 @@
+// Package raftpb encodes the messages of the RequestVote, AppendEntries and
+// InstallSnapshot RPCs in the protobuf wire format, as defined in raft.proto,
+// so that the wire format of the servers doesn't depend on gob and net/rpc.
+// GRPC exchanges them as the Raft gRPC service of raft.proto, for the servers
+// created with raft.WithPeerRPC(raftpb.GRPC{}); implementations in other
+// languages use the definitions of raft.proto.
+//
+// The messages are encoded with protowire rather than generated code, so that
+// building the module needs no protoc. Unknown fields are skipped when
+// decoding, so that fields can be added to the messages.
+package raftpb
+
+import (
+	"fmt"
+
+	"github.com/aecra/raft/raft"
+	"github.com/aecra/raft/raft/internal/pbwire"
+)
+
+// Marshal encodes m, one of the args and reply types of the RequestVote,
+// AppendEntries and InstallSnapshot RPCs, or a pointer to one.
+func Marshal(m interface{}) ([]byte, error) {
+	var e pbwire.Encoder
+	switch m := m.(type) {
+	case *raft.RequestVoteArgs:
+		return Marshal(*m)
+	case *raft.RequestVoteReply:
+		return Marshal(*m)
+	case *raft.AppendEntriesArgs:
+		return Marshal(*m)
+	case *raft.AppendEntriesReply:
+		return Marshal(*m)
+	case *raft.InstallSnapshotArgs:
+		return Marshal(*m)
+	case *raft.InstallSnapshotReply:
+		return Marshal(*m)
+	case raft.RequestVoteArgs:
+		e.Uint(1, m.ProtocolVersion)
+		e.Int(2, m.GroupId)
+		e.Sint(3, m.Term)
+		e.String(4, string(m.CandidateId))
+		e.Sint(5, m.LastLogIndex)
+		e.Sint(6, m.LastLogTerm)
+	case raft.RequestVoteReply:
+		e.Sint(1, m.Term)
+		e.Bool(2, m.VoteGranted)
+	case raft.AppendEntriesArgs:
+		e.Uint(1, m.ProtocolVersion)
+		e.Int(2, m.GroupId)
+		e.Sint(3, m.Term)
+		e.String(4, string(m.LeaderId))
+		e.Sint(5, m.PrevLogIndex)
+		e.Sint(6, m.PrevLogTerm)
+		for _, entry := range m.Entries {
+			e.Message(7, marshalEntry(entry))
+		}
+		e.Sint(8, m.LeaderCommit)
+	case raft.AppendEntriesReply:
+		e.Sint(1, m.Term)
+		e.Bool(2, m.Success)
+		e.Bool(3, m.Witness)
+		e.String(4, m.Zone)
+		e.Bool(5, m.Hinted)
+		e.Sint(6, m.LastLogIndex)
+	case raft.InstallSnapshotArgs:
+		e.Uint(1, m.ProtocolVersion)
+		e.Int(2, m.GroupId)
+		e.Sint(3, m.Term)
+		e.String(4, string(m.LeaderId))
+		e.Sint(5, m.LastIncludedIndex)
+		e.Sint(6, m.LastIncludedTerm)
+		e.Int(7, m.Offset)
+		e.Bytes(8, m.Data)
+		e.Bool(9, m.Done)
+	case raft.InstallSnapshotReply:
+		e.Sint(1, m.Term)
+		e.Int(2, m.Offset)
+		e.Bool(3, m.Installed)
+	default:
+		return nil, fmt.Errorf("raftpb: can't marshal %T", m)
+	}
+	return e.B, nil
+}
+
+func marshalEntry(entry raft.WireEntry) []byte {
+	var e pbwire.Encoder
+	e.Bytes(1, entry.Command)
+	e.Sint(2, entry.Term)
+	e.Bool(3, entry.Config)
+	e.Bool(4, entry.Chunk)
+	e.Bool(5, entry.Barrier)
+	e.String(6, entry.Token)
+	e.Fixed32(7, entry.Checksum)
+	e.Bool(8, entry.Stripped)
+	return e.B
+}
+
+// Unmarshal decodes data into m, a pointer to one of the types Marshal
+// encodes.
+func Unmarshal(data []byte, m interface{}) error {
+	switch m := m.(type) {
+	case *raft.RequestVoteArgs:
+		*m = raft.RequestVoteArgs{}
+		return pbwire.Decode(data, func(f pbwire.Field) error {
+			switch f.Num {
+			case 1:
+				return f.Uint(&m.ProtocolVersion)
+			case 2:
+				return f.Int(&m.GroupId)
+			case 3:
+				return f.Sint(&m.Term)
+			case 4:
+				return serverID(f, &m.CandidateId)
+			case 5:
+				return f.Sint(&m.LastLogIndex)
+			case 6:
+				return f.Sint(&m.LastLogTerm)
+			}
+			return nil
+		})
+	case *raft.RequestVoteReply:
+		*m = raft.RequestVoteReply{}
+		return pbwire.Decode(data, func(f pbwire.Field) error {
+			switch f.Num {
+			case 1:
+				return f.Sint(&m.Term)
+			case 2:
+				return f.Bool(&m.VoteGranted)
+			}
+			return nil
+		})
+	case *raft.AppendEntriesArgs:
+		*m = raft.AppendEntriesArgs{}
+		return pbwire.Decode(data, func(f pbwire.Field) error {
+			switch f.Num {
+			case 1:
+				return f.Uint(&m.ProtocolVersion)
+			case 2:
+				return f.Int(&m.GroupId)
+			case 3:
+				return f.Sint(&m.Term)
+			case 4:
+				return serverID(f, &m.LeaderId)
+			case 5:
+				return f.Sint(&m.PrevLogIndex)
+			case 6:
+				return f.Sint(&m.PrevLogTerm)
+			case 7:
+				var data []byte
+				if err := f.Bytes(&data); err != nil {
+					return err
+				}
+				entry, err := unmarshalEntry(data)
+				if err != nil {
+					return err
+				}
+				m.Entries = append(m.Entries, entry)
+			case 8:
+				return f.Sint(&m.LeaderCommit)
+			}
+			return nil
+		})
+	case *raft.AppendEntriesReply:
+		*m = raft.AppendEntriesReply{}
+		return pbwire.Decode(data, func(f pbwire.Field) error {
+			switch f.Num {
+			case 1:
+				return f.Sint(&m.Term)
+			case 2:
+				return f.Bool(&m.Success)
+			case 3:
+				return f.Bool(&m.Witness)
+			case 4:
+				return f.String(&m.Zone)
+			case 5:
+				return f.Bool(&m.Hinted)
+			case 6:
+				return f.Sint(&m.LastLogIndex)
+			}
+			return nil
+		})
+	case *raft.InstallSnapshotArgs:
+		*m = raft.InstallSnapshotArgs{}
+		return pbwire.Decode(data, func(f pbwire.Field) error {
+			switch f.Num {
+			case 1:
+				return f.Uint(&m.ProtocolVersion)
+			case 2:
+				return f.Int(&m.GroupId)
+			case 3:
+				return f.Sint(&m.Term)
+			case 4:
+				return serverID(f, &m.LeaderId)
+			case 5:
+				return f.Sint(&m.LastIncludedIndex)
+			case 6:
+				return f.Sint(&m.LastIncludedTerm)
+			case 7:
+				return f.Int(&m.Offset)
+			case 8:
+				return f.Bytes(&m.Data)
+			case 9:
+				return f.Bool(&m.Done)
+			}
+			return nil
+		})
+	case *raft.InstallSnapshotReply:
+		*m = raft.InstallSnapshotReply{}
+		return pbwire.Decode(data, func(f pbwire.Field) error {
+			switch f.Num {
+			case 1:
+				return f.Sint(&m.Term)
+			case 2:
+				return f.Int(&m.Offset)
+			case 3:
+				return f.Bool(&m.Installed)
+			}
+			return nil
+		})
+	}
+	return fmt.Errorf("raftpb: can't unmarshal into %T", m)
+}
+
+func unmarshalEntry(data []byte) (raft.WireEntry, error) {
+	var entry raft.WireEntry
+	err := pbwire.Decode(data, func(f pbwire.Field) error {
+		switch f.Num {
+		case 1:
+			return f.Bytes(&entry.Command)
+		case 2:
+			return f.Sint(&entry.Term)
+		case 3:
+			return f.Bool(&entry.Config)
+		case 4:
+			return f.Bool(&entry.Chunk)
+		case 5:
+			return f.Bool(&entry.Barrier)
+		case 6:
+			return f.String(&entry.Token)
+		case 7:
+			return f.Fixed32(&entry.Checksum)
+		case 8:
+			return f.Bool(&entry.Stripped)
+		}
+		return nil
+	})
+	return entry, err
+}
+
+func serverID(f pbwire.Field, v *raft.ServerID) error {
+	var s string
+	if err := f.String(&s); err != nil {
+		return err
+	}
+	*v = raft.ServerID(s)
+	return nil
+}
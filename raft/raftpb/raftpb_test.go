@@ -0,0 +1,216 @@
+package raftpb
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aecra/raft/kvstore"
+	"github.com/aecra/raft/raft"
+)
+
+func TestRoundTrip(t *testing.T) {
+	for name, tc := range map[string]struct {
+		m   interface{}
+		new func() interface{}
+	}{
+		"RequestVoteArgs": {
+			raft.RequestVoteArgs{ProtocolVersion: 1, GroupId: 2, Term: 3, CandidateId: "b", LastLogIndex: -1, LastLogTerm: -1},
+			func() interface{} { return new(raft.RequestVoteArgs) },
+		},
+		"RequestVoteReply": {
+			raft.RequestVoteReply{Term: 3, VoteGranted: true},
+			func() interface{} { return new(raft.RequestVoteReply) },
+		},
+		"AppendEntriesArgs": {
+			raft.AppendEntriesArgs{
+				ProtocolVersion: 1, GroupId: 1 << 40, Term: 4, LeaderId: "a", PrevLogIndex: 7, PrevLogTerm: 3,
+				Entries: []raft.WireEntry{
+					{Command: []byte("set x 1"), Term: 4, Token: "t1", Checksum: 0xdeadbeef},
+					{},
+					{Term: 4, Config: true, Chunk: true, Barrier: true, Stripped: true},
+				},
+				LeaderCommit: 6,
+			},
+			func() interface{} { return new(raft.AppendEntriesArgs) },
+		},
+		"AppendEntriesReply": {
+			raft.AppendEntriesReply{Term: 4, Success: true, Witness: true, Zone: "us-east", Hinted: true, LastLogIndex: -1},
+			func() interface{} { return new(raft.AppendEntriesReply) },
+		},
+		"InstallSnapshotArgs": {
+			raft.InstallSnapshotArgs{ProtocolVersion: 1, Term: 5, LeaderId: "c", LastIncludedIndex: 99, LastIncludedTerm: 5, Offset: 4096, Data: []byte{0, 1, 2}, Done: true},
+			func() interface{} { return new(raft.InstallSnapshotArgs) },
+		},
+		"InstallSnapshotReply": {
+			raft.InstallSnapshotReply{Term: 5, Offset: 4099, Installed: true},
+			func() interface{} { return new(raft.InstallSnapshotReply) },
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			data, err := Marshal(tc.m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := tc.new()
+			if err := Unmarshal(data, got); err != nil {
+				t.Fatal(err)
+			}
+			if got := reflect.ValueOf(got).Elem().Interface(); !reflect.DeepEqual(got, tc.m) {
+				t.Errorf("Expected %#v, got %#v", tc.m, got)
+			}
+		})
+	}
+}
+
+func TestWireFormat(t *testing.T) {
+	data, err := Marshal(&raft.RequestVoteReply{Term: 1, VoteGranted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// term is a sint64, zigzag encoded.
+	if want := []byte{0x08, 0x02, 0x10, 0x01}; !bytes.Equal(data, want) {
+		t.Errorf("Expected %x, got %x", want, data)
+	}
+
+	data, err = Marshal(raft.RequestVoteReply{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 0 {
+		t.Errorf("Expected zero values to be left out, got %x", data)
+	}
+}
+
+func TestUnmarshalSkipsUnknownFields(t *testing.T) {
+	// term = 2, then a field 15 that a later version might add.
+	data := []byte{0x08, 0x04, 0x7a, 0x02, 'h', 'i', 0x10, 0x01}
+	var reply raft.RequestVoteReply
+	if err := Unmarshal(data, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if want := (raft.RequestVoteReply{Term: 2, VoteGranted: true}); reply != want {
+		t.Errorf("Expected %#v, got %#v", want, reply)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	var reply raft.RequestVoteReply
+	for name, data := range map[string][]byte{
+		"Truncated":      {0x08},
+		"WrongWireType":  {0x0a, 0x00},
+		"TruncatedBytes": {0x22, 0x05, 'a'},
+	} {
+		if err := Unmarshal(data, &reply); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if err := Unmarshal(nil, new(int)); err == nil {
+		t.Errorf("Expected unmarshaling into an unknown type to fail")
+	}
+	if _, err := Marshal(1); err == nil {
+		t.Errorf("Expected marshaling an unknown type to fail")
+	}
+}
+
+// countingRPC is GRPC counting the calls made by its clients.
+type countingRPC struct {
+	GRPC
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (c *countingRPC) NewClient(dial func(ctx context.Context) (net.Conn, error)) (raft.PeerClient, error) {
+	client, err := c.GRPC.NewClient(dial)
+	return countingClient{client, c}, err
+}
+
+type countingClient struct {
+	raft.PeerClient
+	rpc *countingRPC
+}
+
+func (c countingClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	err := c.PeerClient.Call(ctx, serviceMethod, args, reply)
+	if err == nil {
+		c.rpc.mu.Lock()
+		c.rpc.calls[serviceMethod]++
+		c.rpc.mu.Unlock()
+	}
+	return err
+}
+
+func TestGRPC(t *testing.T) {
+	const n = 3
+	rpc := &countingRPC{calls: make(map[string]int)}
+	ready := make(chan interface{})
+	var mu sync.Mutex
+	applied := make(map[int]bool)
+	servers := make([]*raft.Server, n)
+	for i := range servers {
+		i := i
+		s, err := raft.NewServer(i, raft.WithCluster(n, ready), raft.WithApplication(kvstore.NewKVStore()),
+			raft.WithToken("secret"), raft.WithPeerRPC(rpc),
+			raft.WithApplyHook(func(groupId int, entry raft.CommitEntry) {
+				if e, ok := entry.Command.(kvstore.Entry); ok && e.Key == "a" {
+					mu.Lock()
+					applied[i] = true
+					mu.Unlock()
+				}
+			}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Serve()
+		servers[i] = s
+		defer s.Shutdown()
+	}
+	for i, s := range servers {
+		for j, peer := range servers {
+			if i != j {
+				if err := s.Connect(raft.IntID(j), peer.GetListenAddr()); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	close(ready)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for submitted := false; !submitted; {
+		if time.Now().After(deadline) {
+			t.Fatal("no server took the command")
+		}
+		for _, s := range servers {
+			if _, ok := s.Submit(kvstore.Entry{Method: "put", Key: "a", Value: "1"}); ok {
+				submitted = true
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for {
+		mu.Lock()
+		count := len(applied)
+		mu.Unlock()
+		if count == n {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the command was applied by %d servers, want %d", count, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rpc.mu.Lock()
+	defer rpc.mu.Unlock()
+	for _, method := range []string{"ConsensusModule.RequestVote", "ConsensusModule.AppendEntries"} {
+		if rpc.calls[method] == 0 {
+			t.Errorf("no %s went through gRPC", method)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package raft
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket limiting the bytes per second a leader sends
+// to followers catching up, so that rebuilding a follower leaves bandwidth to
+// heartbeats and the replication of new entries. It also limits the commands
+// per second clients submit. A nil *rateLimiter doesn't limit anything.
+//
+// Tokens may go negative: a chunk larger than the burst still goes through
+// once tokens are available, and the next one waits until the debt is paid.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter allowing bytesPerSecond, with a burst of
+// one second's worth. It returns nil if bytesPerSecond isn't positive.
+func newRateLimiter(bytesPerSecond int) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:   float64(bytesPerSecond),
+		burst:  float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// refill adds the tokens accumulated since the last call.
+// Expects l.mu to be locked.
+func (l *rateLimiter) refill() {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
+
+// allow takes n tokens and returns true if there are tokens available, and
+// returns false otherwise.
+func (l *rateLimiter) allow(n int) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	if l.tokens <= 0 {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
+
+// take takes n tokens and returns true if there are at least n available,
+// and returns false otherwise. Unlike allow, it never goes into debt.
+func (l *rateLimiter) take(n int) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	if l.tokens < float64(n) {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
+
+// wait blocks until there are tokens available, then takes n.
+func (l *rateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	if l.tokens <= 0 {
+		// Other callers wait for the lock meanwhile, so they queue up.
+		time.Sleep(time.Duration((1 - l.tokens) / l.rate * float64(time.Second)))
+		l.refill()
+	}
+	l.tokens -= float64(n)
+}
@@ -0,0 +1,32 @@
+package raft
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	l := newRateLimiter(1000)
+	if !l.allow(600) || !l.allow(600) {
+		t.Fatal("Expected the burst to be allowed")
+	}
+	// The second call left the bucket in debt.
+	if l.allow(1) {
+		t.Error("Expected the limiter to deny once the burst is spent")
+	}
+	var unlimited *rateLimiter
+	if !unlimited.allow(1 << 30) {
+		t.Error("Expected a nil limiter to allow everything")
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	l := newRateLimiter(1000)
+	start := time.Now()
+	l.wait(1100)
+	// The bucket is 100 bytes in debt, which takes 100ms to pay back.
+	l.wait(1)
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("Expected wait to block for about 100ms, took %v", elapsed)
+	}
+}
@@ -0,0 +1,185 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrLeaderNotReady is returned by Read when the leader didn't commit an
+// entry of its term yet, so that its commit index may lag behind the one of
+// its predecessor.
+var ErrLeaderNotReady = errors.New("raft: the leader didn't commit an entry of its term yet")
+
+// readRequest is a read waiting for the leader to confirm its leadership.
+type readRequest struct {
+	// requested is when the read was registered; an acknowledgment by a
+	// majority of AEs sent after it confirms it.
+	requested time.Time
+
+	// confirmed receives nil once the leadership is confirmed, or the error
+	// failing the read.
+	confirmed chan error
+}
+
+// Read answers query from the state of the application, on the leader, as a
+// linearizable read: the answer reflects all the commands committed before
+// Read was called. It doesn't go through the log. The leader notes its commit
+// index, confirms with a round of AEs that it still leads, and waits for the
+// application to apply up to that index. The reads that arrive while a round
+// is pending share the next one, so that a burst of reads costs a single
+// round. The application must implement Querier.
+//
+// Read waits until ctx is done, or for Config.CommitTimeout if ctx has no
+// deadline. It returns a *NotLeaderError if cm isn't the leader or loses the
+// leadership, and ErrLeaderNotReady if it hasn't committed an entry of its
+// term yet.
+func (cm *ConsensusModule) Read(ctx context.Context, query interface{}) (interface{}, error) {
+	answer, _, err := cm.read(ctx, query)
+	return answer, err
+}
+
+// read is Read, also returning the read index, up to which the answer
+// reflects the log.
+func (cm *ConsensusModule) read(ctx context.Context, query interface{}) (interface{}, int, error) {
+	q, ok := cm.app.(Querier)
+	if !ok {
+		return nil, -1, errors.New("raft: the application doesn't answer queries")
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cm.config.CommitTimeout)
+		defer cancel()
+	}
+
+	cm.mu.Lock()
+	if cm.state != Leader || cm.transferring {
+		leader := cm.leaderId
+		if leader == cm.id {
+			leader = NoServer
+		}
+		cm.mu.Unlock()
+		return nil, -1, &NotLeaderError{Leader: leader}
+	}
+	if cm.commitIndex < 0 || cm.entryTerm(cm.commitIndex) != cm.currentTerm {
+		cm.mu.Unlock()
+		return nil, -1, ErrLeaderNotReady
+	}
+	readIndex := cm.commitIndex
+	read := cm.registerRead()
+	cm.mu.Unlock()
+	if err := cm.awaitConfirmation(ctx, read); err != nil {
+		return nil, -1, err
+	}
+	for {
+		cm.mu.Lock()
+		applied, appliedChan := cm.appliedIndex, cm.appliedChan
+		cm.mu.Unlock()
+		if applied >= readIndex {
+			answer, err := q.Query(query)
+			return answer, readIndex, err
+		}
+		select {
+		case <-appliedChan:
+		case <-cm.done:
+			return nil, -1, errors.New("raft: stopped")
+		case <-ctx.Done():
+			return nil, -1, ctx.Err()
+		}
+	}
+}
+
+// Read answers query in the default group, like ConsensusModule.Read.
+func (s *Server) Read(ctx context.Context, query interface{}) (interface{}, error) {
+	cm, err := s.group(DefaultGroup)
+	if err != nil {
+		return nil, err
+	}
+	return cm.Read(ctx, query)
+}
+
+// VerifyLeader confirms that cm is still the leader with a round of AEs,
+// shared with the concurrent reads and verifications, so that it doesn't act
+// as the leader after being deposed by a partition it didn't notice yet.
+// Unlike Read, it doesn't wait for the leader to commit an entry of its term.
+//
+// VerifyLeader waits until ctx is done, or for Config.CommitTimeout if ctx
+// has no deadline. It returns a *NotLeaderError if cm isn't the leader or
+// loses the leadership.
+func (cm *ConsensusModule) VerifyLeader(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cm.config.CommitTimeout)
+		defer cancel()
+	}
+	cm.mu.Lock()
+	if cm.state != Leader || cm.transferring {
+		leader := cm.leaderId
+		if leader == cm.id {
+			leader = NoServer
+		}
+		cm.mu.Unlock()
+		return &NotLeaderError{Leader: leader}
+	}
+	read := cm.registerRead()
+	cm.mu.Unlock()
+	return cm.awaitConfirmation(ctx, read)
+}
+
+// VerifyLeader confirms the leadership of the default group, like
+// ConsensusModule.VerifyLeader.
+func (s *Server) VerifyLeader(ctx context.Context) error {
+	cm, err := s.group(DefaultGroup)
+	if err != nil {
+		return err
+	}
+	return cm.VerifyLeader(ctx)
+}
+
+// registerRead registers a read waiting for the next confirmation of the
+// leadership.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) registerRead() *readRequest {
+	read := &readRequest{requested: time.Now(), confirmed: make(chan error, 1)}
+	cm.pendingReads = append(cm.pendingReads, read)
+	return read
+}
+
+// awaitConfirmation starts a round of AEs and waits for it to confirm read.
+func (cm *ConsensusModule) awaitConfirmation(ctx context.Context, read *readRequest) error {
+	cm.triggerAE()
+	select {
+	case err := <-read.confirmed:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// confirmReads releases the pending reads that the last acknowledgment of
+// the leadership by a majority, cm.lastContact, confirms.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) confirmReads() {
+	pending := cm.pendingReads[:0]
+	for _, read := range cm.pendingReads {
+		if cm.lastContact.After(read.requested) {
+			read.confirmed <- nil
+		} else {
+			pending = append(pending, read)
+		}
+	}
+	cm.pendingReads = pending
+}
+
+// failReads fails the pending reads of cm, which lost the leadership.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) failReads() {
+	leader := cm.leaderId
+	if leader == cm.id {
+		leader = NoServer
+	}
+	for _, read := range cm.pendingReads {
+		read.confirmed <- &NotLeaderError{Leader: leader}
+	}
+	cm.pendingReads = nil
+}
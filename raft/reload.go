@@ -0,0 +1,82 @@
+package raft
+
+import "time"
+
+// ConfigUpdate holds the parameters of Config that can be changed while a CM
+// runs. Zero fields keep their current value.
+type ConfigUpdate struct {
+	ElectionTimeoutMin time.Duration
+	ElectionTimeoutMax time.Duration
+	HeartbeatInterval  time.Duration
+	SnapshotThreshold  int
+}
+
+// UpdateConfig changes the tunable parameters of cm without restarting it,
+// and returns their new values. The changed config must be valid, or it's
+// refused and cm keeps the current one. The heartbeat interval applies from
+// the next heartbeat, sent right away by a leader, the election timeout from
+// the next one cm waits for, and the snapshot threshold from the next batch
+// of entries applied.
+//
+// Each server is updated on its own: to lower the election timeout of a
+// cluster, lower the heartbeat interval of all its servers first, so that no
+// follower times out waiting for a leader still on the old interval, and
+// raise it last when raising the election timeout.
+func (cm *ConsensusModule) UpdateConfig(update ConfigUpdate) (ConfigUpdate, error) {
+	cm.mu.Lock()
+	config := cm.config
+	if update.ElectionTimeoutMin != 0 {
+		config.ElectionTimeoutMin = update.ElectionTimeoutMin
+	}
+	if update.ElectionTimeoutMax != 0 {
+		config.ElectionTimeoutMax = update.ElectionTimeoutMax
+	}
+	if update.HeartbeatInterval != 0 {
+		config.HeartbeatInterval = update.HeartbeatInterval
+	}
+	if update.SnapshotThreshold != 0 {
+		config.SnapshotThreshold = update.SnapshotThreshold
+	}
+	if err := config.Validate(); err != nil {
+		current := cm.tunables()
+		cm.mu.Unlock()
+		return current, err
+	}
+	cm.config.ElectionTimeoutMin = config.ElectionTimeoutMin
+	cm.config.ElectionTimeoutMax = config.ElectionTimeoutMax
+	cm.config.HeartbeatInterval = config.HeartbeatInterval
+	cm.config.SnapshotThreshold = config.SnapshotThreshold
+	current := cm.tunables()
+	cm.raftLog("config updated: %+v", current)
+	cm.mu.Unlock()
+	cm.triggerAE()
+	return current, nil
+}
+
+// UpdateConfig changes the tunable parameters of the default group, like
+// ConsensusModule.UpdateConfig.
+func (s *Server) UpdateConfig(update ConfigUpdate) (ConfigUpdate, error) {
+	cm, err := s.group(DefaultGroup)
+	if err != nil {
+		return ConfigUpdate{}, err
+	}
+	return cm.UpdateConfig(update)
+}
+
+// heartbeatInterval returns the current heartbeat interval of cm.
+func (cm *ConsensusModule) heartbeatInterval() time.Duration {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.config.HeartbeatInterval
+}
+
+// tunables returns the current values of the parameters UpdateConfig changes.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) tunables() ConfigUpdate {
+	return ConfigUpdate{
+		ElectionTimeoutMin: cm.config.ElectionTimeoutMin,
+		ElectionTimeoutMax: cm.config.ElectionTimeoutMax,
+		HeartbeatInterval:  cm.config.HeartbeatInterval,
+		SnapshotThreshold:  cm.config.SnapshotThreshold,
+	}
+}
@@ -0,0 +1,125 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// lookupHost resolves host names for the re-resolution of peer addresses.
+// Tests replace it.
+var lookupHost = net.DefaultResolver.LookupHost
+
+// UpdatePeerAddress sets the address of server id to addr, for a peer that
+// moved: its connection is closed, and the next RPC to it dials addr. Unlike
+// removing the server and adding it back, it doesn't change the membership of
+// any group. The address is saved if the storage is a storage.AddressBook.
+func (s *Server) UpdatePeerAddress(id ServerID, addr net.Addr) error {
+	if id == NoServer {
+		return errors.New("raft: the server ID is empty")
+	}
+	if id == s.serverId {
+		return errors.New("raft: can't update the address of the server itself")
+	}
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return errors.New("raft: server stopped")
+	}
+	s.redial(id, addr)
+	s.mu.Unlock()
+	s.saveAddrs(map[ServerID]string{id: addr.String()})
+	return nil
+}
+
+// redial makes the next RPC to server id dial addr, closing the current
+// connection to it.
+// Expects s.mu to be locked.
+func (s *Server) redial(id ServerID, addr net.Addr) {
+	s.addrMu.Lock()
+	s.peerAddrs[id] = addr
+	s.addrMu.Unlock()
+	s.closePeer(id)
+	delete(s.remoteAddrs, id)
+}
+
+// resolvePeers resolves the host names of the addresses the peers were dialed
+// at every Config.ResolveInterval, and redials the peers whose connection is
+// no longer at one of the resolved addresses, until the server stops.
+func (s *Server) resolvePeers() {
+	ticker := time.NewTicker(s.config.ResolveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-ticker.C:
+		}
+
+		type peer struct {
+			id           ServerID
+			dialed       net.Addr
+			host, remote string
+		}
+		var peers []peer
+		s.mu.Lock()
+		for id, client := range s.peerClients {
+			remote, ok := s.remoteAddrs[id]
+			if client == nil || !ok {
+				continue
+			}
+			dialed := s.dialedAddrs[id]
+			host, _, err := net.SplitHostPort(dialed.String())
+			if err != nil || net.ParseIP(host) != nil {
+				// Only host names are resolved again.
+				continue
+			}
+			remoteHost, _, err := net.SplitHostPort(remote.String())
+			if err != nil {
+				continue
+			}
+			peers = append(peers, peer{id, dialed, host, remoteHost})
+		}
+		s.mu.Unlock()
+
+		for _, p := range peers {
+			ctx, cancel := context.WithTimeout(context.Background(), s.config.ResolveInterval)
+			ips, err := lookupHost(ctx, p.host)
+			cancel()
+			if err != nil {
+				s.logger.Printf("[%v] resolving %s failed: %v", s.serverId, p.host, err)
+				continue
+			}
+			if containsIP(ips, p.remote) {
+				continue
+			}
+			s.mu.Lock()
+			// The peer may have been redialed or updated meanwhile.
+			if !s.stopped && s.dialedAddrs[p.id] == p.dialed && s.remoteAddrs[p.id] != nil &&
+				sameHost(s.remoteAddrs[p.id], p.remote) {
+				s.logger.Printf("[%v] %s moved from %s to %v; redialing", s.serverId, p.host, p.remote, ips)
+				s.redial(p.id, p.dialed)
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// containsIP reports whether ips holds ip, comparing the parsed addresses so
+// that different spellings of an IPv6 address match.
+func containsIP(ips []string, ip string) bool {
+	parsed := net.ParseIP(ip)
+	for _, candidate := range ips {
+		if candidate == ip || (parsed != nil && parsed.Equal(net.ParseIP(candidate))) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameHost reports whether addr is at host.
+func sameHost(addr net.Addr, host string) bool {
+	h, _, err := net.SplitHostPort(addr.String())
+	return err == nil && h == host
+}
@@ -6,11 +6,17 @@
 package raft
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/rpc"
+	"reflect"
 	"sync"
+
+	"github.com/aecra/raft/storage"
+	"github.com/aecra/raft/storage/wal"
 )
 
 // Server wraps a raft.ConsensusModule along with a rpc.Server that exposes its
@@ -22,52 +28,268 @@ import (
 type Server struct {
 	mu sync.Mutex
 
-	serverId int
+	serverId ServerID
 
-	num int
+	// members are the IDs of the servers the cluster starts with.
+	members []ServerID
 
 	ready chan interface{}
 
 	app Application
 
-	cm *ConsensusModule
+	storage storage.Storage
+
+	// dataDir is the directory of the write-ahead log opened as the storage,
+	// set by WithDataDir. ownStorage is set if the server opened the storage,
+	// so that it closes it.
+	dataDir    string
+	ownStorage bool
+
+	config Config
+
+	transport Transport
+
+	logger *log.Logger
+
+	// codec encodes the commands sent to peers.
+	codec Codec
+
+	// witness is set if the server is a witness.
+	witness bool
+
+	// electionOnly is set if the server only elects leaders, set by
+	// WithElectionOnly.
+	electionOnly bool
+
+	// zone is the zone the server runs in, set by WithZone.
+	zone string
+
+	// maintenance is set while the server is in maintenance mode. The groups
+	// created meanwhile start in it.
+	maintenance bool
+
+	// throttle limits the commands submitted to the server.
+	throttle *submitThrottle
+
+	// token is the cluster token connections must authenticate with, if
+	// it's not empty.
+	token string
+
+	// gossip is the state of the peer discovery set by WithGossip, or nil.
+	gossip *gossipState
+
+	// observer is set by WithObserver, and events holds the events waiting
+	// for it.
+	observer Observer
+	events   chan Event
+
+	// leaderCh is the LeaderCh of the default group.
+	leaderCh chan bool
+
+	// applyHook is set by WithApplyHook.
+	applyHook func(groupId int, entry CommitEntry)
+
+	// statefulSet maps the IDs of the servers of a StatefulSet to their
+	// addresses, for the servers created by NewStatefulSetServer.
+	statefulSet map[ServerID]string
+
+	// cm is the CM of DefaultGroup, and groups holds the CMs of all the
+	// groups hosted by the server, including it.
+	cm     *ConsensusModule
+	groups map[int]*ConsensusModule
 
 	rpcServer *rpc.Server
 	listener  net.Listener
 
-	peerClients map[int]*rpc.Client
+	// advertiseAddr is set by WithAdvertiseAddr.
+	advertiseAddr string
+
+	peerClients map[ServerID]*rpc.Client
+
+	// peerRPC is set by WithPeerRPC. rpcClients are its clients of the peers
+	// connected in peerClients, and peerListener the listener its server
+	// accepts connections on.
+	peerRPC      PeerRPC
+	rpcClients   map[ServerID]PeerClient
+	peerListener *connListener
+
+	// peerVersions are the versions of the wire protocol negotiated by the
+	// connections of peerClients, and minVersion and maxVersion the ones the
+	// server speaks, MinProtocolVersion and ProtocolVersion but in tests.
+	peerVersions           map[ServerID]int
+	minVersion, maxVersion int
+
+	// conns are the connections accepted by the listener that are being
+	// served. Stop closes them.
+	conns map[net.Conn]struct{}
+
+	// stopped is set by Stop. The server then no longer connects to peers.
+	stopped bool
+
+	// dialedAddrs are the addresses peerClients were dialed at, and
+	// remoteAddrs the addresses their connections ended up at, which differ
+	// when the dialed ones have a host name.
+	dialedAddrs map[ServerID]net.Addr
+	remoteAddrs map[ServerID]net.Addr
+
+	// peerAddrs are the addresses of the servers added to a group at
+	// runtime, saved before a restart or given to UpdatePeerAddress, which
+	// Call dials when it has no client for them. addrMu guards it; it's only
+	// held briefly, so it can be taken with a CM's lock held.
+	addrMu    sync.Mutex
+	peerAddrs map[ServerID]net.Addr
+
+	// savedAddrs are the peer addresses saved to the storage, if it's a
+	// storage.AddressBook. bookMu guards it and is taken last; it's held
+	// while the storage writes, so it's never taken with s.mu or a CM's
+	// lock held.
+	bookMu     sync.Mutex
+	savedAddrs map[ServerID]string
+
+	// learnedAddrs are the addresses learnPeerAddr recorded and
+	// saveLearnedAddrs hasn't saved yet; learned signals them. addrMu
+	// guards it.
+	learnedAddrs map[ServerID]string
+	learned      chan struct{}
 
 	quit chan interface{}
 	wg   sync.WaitGroup
 }
 
-func NewServer(serverId int, num int, ready chan interface{}, app Application) *Server {
+// NewServer creates the server IntID(serverId) configured by opts. It's
+// NewServerWithID for the clusters whose servers are numbered from 0.
+func NewServer(serverId int, opts ...Option) (*Server, error) {
+	return NewServerWithID(IntID(serverId), opts...)
+}
+
+// NewServerWithID creates the server serverId configured by opts. WithMembers
+// or WithCluster is required. It returns an error if both are missing or if
+// the Config isn't valid.
+func NewServerWithID(serverId ServerID, opts ...Option) (*Server, error) {
 	s := new(Server)
 	s.serverId = serverId
-	s.num = num
-	s.ready = ready
-	s.app = app
-	s.peerClients = make(map[int]*rpc.Client)
+	s.codec = GobCodec{}
+	s.transport = TCPTransport{}
+	s.logger = log.Default()
+	s.minVersion, s.maxVersion = MinProtocolVersion, ProtocolVersion
+	for _, opt := range opts {
+		opt(s)
+	}
+	if serverId == NoServer {
+		return nil, errors.New("raft: the server ID is empty")
+	}
+	if len(s.members) == 0 || s.ready == nil {
+		return nil, errors.New("raft: NewServer requires WithMembers or WithCluster")
+	}
+	if err := s.config.Validate(); err != nil {
+		return nil, err
+	}
+	s.config = s.config.withDefaults()
+	s.throttle = newSubmitThrottle(s.config)
+	if s.storage == nil && s.dataDir != "" {
+		w, err := wal.Open(s.dataDir, wal.Options{})
+		if err != nil {
+			return nil, err
+		}
+		s.storage, s.ownStorage = w, true
+	}
+	if s.storage == nil {
+		s.storage = storage.NewMemoryStorage()
+	}
+	s.peerClients = make(map[ServerID]*rpc.Client)
+	s.rpcClients = make(map[ServerID]PeerClient)
+	s.peerVersions = make(map[ServerID]int)
+	s.conns = make(map[net.Conn]struct{})
+	s.dialedAddrs = make(map[ServerID]net.Addr)
+	s.remoteAddrs = make(map[ServerID]net.Addr)
+	s.peerAddrs = make(map[ServerID]net.Addr)
+	s.savedAddrs = make(map[ServerID]string)
+	s.learnedAddrs = make(map[ServerID]string)
+	s.learned = make(chan struct{}, 1)
+	if book, ok := s.storage.(storage.AddressBook); ok {
+		// The peers are dialed at their saved addresses until Connect is
+		// called for them.
+		addrs, err := book.PeerAddrs()
+		if err != nil {
+			if s.ownStorage {
+				s.storage.Close()
+			}
+			return nil, err
+		}
+		for id, addr := range addrs {
+			if id := ServerID(id); id != serverId {
+				s.peerAddrs[id] = peerAddr(addr)
+				s.savedAddrs[id] = addr
+			}
+		}
+	}
+	s.groups = make(map[int]*ConsensusModule)
+	s.events = make(chan Event, eventBuffer)
+	s.leaderCh = make(chan bool, 1)
 	s.quit = make(chan interface{})
-	return s
+	return s, nil
+}
+
+// registerServices creates the RPC server and registers the RPC endpoints.
+// groupRouter dispatches the calls to the CM of their group.
+// Expects s.mu to be locked.
+func (s *Server) registerServices() error {
+	s.rpcServer = rpc.NewServer()
+	services := map[string]interface{}{
+		"ConsensusModule": &groupRouter{s},
+		"Client":          &clientService{s},
+		"Admin":           &adminService{s},
+		"Protocol":        &protocolService{s},
+	}
+	if s.gossip != nil {
+		services["Gossip"] = &gossipService{s}
+	}
+	for name, rcvr := range services {
+		if err := s.rpcServer.RegisterName(name, rcvr); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *Server) Serve() {
 	s.mu.Lock()
 	s.cm = NewConsensusModule(s)
+	s.groups[DefaultGroup] = s.cm
 
-	// Create a new RPC server and register the RPC endpoints.
-	s.rpcServer = rpc.NewServer()
-	err := s.rpcServer.RegisterName("ConsensusModule", s.cm)
-	if err != nil {
+	if err := s.registerServices(); err != nil {
+		s.mu.Unlock()
+		s.logger.Printf("[%v] registering the RPC services failed: %v", s.serverId, err)
 		return
 	}
 
-	s.listener, err = net.Listen("tcp", ":0")
+	var err error
+	s.listener, err = s.transport.Listen()
 	if err != nil {
-		log.Fatal(err)
+		s.logger.Fatal(err)
+	}
+	if s.advertiseAddr != "" {
+		s.logger.Printf("[%v] listening at %s, advertised as %s", s.serverId, s.listener.Addr(), s.advertiseAddr)
+	} else {
+		s.logger.Printf("[%v] listening at %s", s.serverId, s.listener.Addr())
+	}
+	if s.gossip != nil {
+		s.startGossip(s.advertisedAddr().String())
+	}
+	if s.peerRPC != nil {
+		s.peerListener = newConnListener(s.listener.Addr())
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if err := s.peerRPC.Serve(s.peerListener, &groupRouter{s}); err != nil {
+				select {
+				case <-s.quit:
+				default:
+					s.logger.Printf("[%v] serving the peer RPCs failed: %v", s.serverId, err)
+				}
+			}
+		}()
 	}
-	log.Printf("[%v] listening at %s", s.serverId, s.listener.Addr())
 	s.mu.Unlock()
 
 	s.wg.Add(1)
@@ -81,90 +303,482 @@ func (s *Server) Serve() {
 				case <-s.quit:
 					return
 				default:
-					log.Fatal("accept error:", err)
+					s.logger.Fatal("accept error:", err)
 				}
 			}
+			s.mu.Lock()
+			if s.stopped {
+				s.mu.Unlock()
+				conn.Close()
+				continue
+			}
+			s.conns[conn] = struct{}{}
+			s.mu.Unlock()
 			s.wg.Add(1)
 			go func() {
-
+				defer s.wg.Done()
+				defer func() {
+					s.mu.Lock()
+					delete(s.conns, conn)
+					s.mu.Unlock()
+				}()
+				if s.token != "" && !s.checkToken(conn) {
+					s.logger.Printf("[%v] rejected connection from %s: bad cluster token", s.serverId, conn.RemoteAddr())
+					conn.Close()
+					return
+				}
+				if s.peerRPC != nil {
+					var handed bool
+					if conn, handed = s.routeConn(conn); handed {
+						return
+					}
+				}
+				// ServeConn returns once conn is closed and the calls it
+				// received are answered.
 				s.rpcServer.ServeConn(conn)
-				s.wg.Done()
 			}()
 		}
 	}()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.saveLearnedAddrs()
+	}()
+	if s.config.ResolveInterval > 0 {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.resolvePeers()
+		}()
+	}
+	if s.gossip != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.runGossip()
+		}()
+	}
+	if s.observer != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.dispatchEvents()
+		}()
+	}
+	if s.statefulSet != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.awaitQuorum()
+		}()
+	}
 }
 
-// DisconnectAll closes all the client connections to peers for this server.
+// DisconnectAll closes all the client connections to peers for this server,
+// and forgets the addresses of the peers added at runtime.
 func (s *Server) DisconnectAll() {
+	s.addrMu.Lock()
+	s.peerAddrs = make(map[ServerID]net.Addr)
+	s.addrMu.Unlock()
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	for id := range s.peerClients {
-		if s.peerClients[id] != nil {
-			err := s.peerClients[id].Close()
-			if err != nil {
-				return
-			}
-			s.peerClients[id] = nil
+		if err := s.closePeer(id); err != nil {
+			return
 		}
 	}
 }
 
-// Shutdown closes the server and waits for it to shut down properly.
+// Shutdown shuts the server down gracefully: it drains it, as Drain does,
+// giving up on the steps left after Config.CommitTimeout, and then stops it
+// and waits for it to stop.
 func (s *Server) Shutdown() {
-	s.cm.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.CommitTimeout)
+	defer cancel()
+	s.Drain(ctx)
+	s.Stop(context.Background())
+}
+
+// Stop stops all the groups of the server right away, failing their pending
+// proposals, and closes its listener and connections. It then waits for the goroutines
+// of the groups and the server, and for the RPCs being served, to finish. If
+// ctx is done first, it returns ctx.Err().
+func (s *Server) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return nil
+	}
+	s.stopped = true
+	groups := make([]*ConsensusModule, 0, len(s.groups))
+	for _, cm := range s.groups {
+		cm.halt()
+		groups = append(groups, cm)
+	}
+	// Closing the connections fails the RPCs the groups are still waiting on,
+	// and lets the RPCs being served finish.
+	for id := range s.peerClients {
+		s.closePeer(id)
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
 	close(s.quit)
-	err := s.listener.Close()
-	if err != nil {
-		return
+	closeErr := s.listener.Close()
+	if s.peerListener != nil {
+		s.peerListener.Close()
+	}
+
+	for _, cm := range groups {
+		if err := cm.Stop(ctx); err != nil {
+			return err
+		}
 	}
-	s.wg.Wait()
+	if err := waitContext(ctx, &s.wg); err != nil {
+		return err
+	}
+	if s.ownStorage {
+		if err := s.storage.Close(); err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
+	return closeErr
 }
 
+// GetListenAddr returns the address peers and clients reach the server at:
+// the one set by WithAdvertiseAddr, or else the one it listens on.
 func (s *Server) GetListenAddr() net.Addr {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.advertisedAddr()
+}
+
+// advertisedAddr is GetListenAddr.
+// Expects s.mu to be locked.
+func (s *Server) advertisedAddr() net.Addr {
+	if s.advertiseAddr != "" {
+		return peerAddr(s.advertiseAddr)
+	}
 	return s.listener.Addr()
 }
 
+// ConnectToPeer connects to server IntID(peerId) at addr.
+//
+// Deprecated: use Connect.
 func (s *Server) ConnectToPeer(peerId int, addr net.Addr) error {
+	return s.Connect(IntID(peerId), addr)
+}
+
+// Connect connects to server peerId at addr, unless it's connected already,
+// and negotiates the version of the wire protocol of the connection. It
+// returns a *ProtocolVersionError if the peer's release is too far apart.
+func (s *Server) Connect(peerId ServerID, addr net.Addr) error {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	if s.peerClients[peerId] == nil {
-		client, err := rpc.Dial(addr.Network(), addr.String())
+	if s.stopped {
+		s.mu.Unlock()
+		return errors.New("raft: server stopped")
+	}
+	connected := s.peerClients[peerId] != nil
+	s.mu.Unlock()
+	if connected {
+		return nil
+	}
+
+	// The negotiation is an RPC, which the peer may only answer once it's
+	// done connecting to this server, so s.mu isn't held meanwhile.
+	conn, err := s.dialPeer(context.Background(), addr)
+	if err != nil {
+		return err
+	}
+	client := rpc.NewClient(conn)
+	version, err := negotiateVersion(client, s.minVersion, s.maxVersion)
+	if err != nil {
+		client.Close()
+		return err
+	}
+	var rpcClient PeerClient
+	if s.peerRPC != nil {
+		rpcClient, err = s.peerRPC.NewClient(func(ctx context.Context) (net.Conn, error) {
+			return s.dialPeer(ctx, addr)
+		})
 		if err != nil {
+			client.Close()
 			return err
 		}
-		s.peerClients[peerId] = client
 	}
+
+	s.mu.Lock()
+	if s.stopped || s.peerClients[peerId] != nil {
+		// The server stopped, or another call connected meanwhile.
+		stopped := s.stopped
+		s.mu.Unlock()
+		client.Close()
+		if rpcClient != nil {
+			rpcClient.Close()
+		}
+		if stopped {
+			return errors.New("raft: server stopped")
+		}
+		return nil
+	}
+	s.peerClients[peerId] = client
+	if rpcClient != nil {
+		s.rpcClients[peerId] = rpcClient
+	}
+	s.peerVersions[peerId] = version
+	s.dialedAddrs[peerId] = addr
+	s.remoteAddrs[peerId] = conn.RemoteAddr()
+	s.mu.Unlock()
+	s.saveAddrs(map[ServerID]string{peerId: addr.String()})
 	return nil
 }
 
-// DisconnectPeer disconnects this server from the peer identified by peerId.
+// DisconnectPeer disconnects this server from server IntID(peerId).
+//
+// Deprecated: use Disconnect.
 func (s *Server) DisconnectPeer(peerId int) error {
+	return s.Disconnect(IntID(peerId))
+}
+
+// Disconnect disconnects this server from the peer identified by peerId.
+// If the peer was added at runtime or its address was saved before a restart,
+// the address is forgotten, so that it stays disconnected until Connect is
+// called. The saved address itself is kept.
+func (s *Server) Disconnect(peerId ServerID) error {
+	s.addrMu.Lock()
+	delete(s.peerAddrs, peerId)
+	s.addrMu.Unlock()
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if s.peerClients[peerId] != nil {
-		err := s.peerClients[peerId].Close()
-		s.peerClients[peerId] = nil
-		return err
-	}
-	return nil
+	return s.closePeer(peerId)
 }
 
-func (s *Server) Call(id int, serviceMethod string, args interface{}, reply interface{}) error {
+// Call calls serviceMethod on peer id, connecting to it first if it was added
+// at runtime, and through the PeerRPC of the server for the RPCs it carries.
+// If ctx is done before the reply arrives, Call returns ctx.Err() and the
+// reply is dropped.
+func (s *Server) Call(ctx context.Context, id ServerID, serviceMethod string, args interface{}, reply interface{}) error {
 	s.mu.Lock()
-	peer := s.peerClients[id]
+	peer, version, rpcClient := s.peerClients[id], s.peerVersions[id], s.rpcClients[id]
 	s.mu.Unlock()
 
+	if peer == nil {
+		s.addrMu.Lock()
+		addr := s.peerAddrs[id]
+		s.addrMu.Unlock()
+		if addr != nil {
+			// The peer was added at runtime; its connection is opened on
+			// first use.
+			if err := s.Connect(id, addr); err != nil {
+				return err
+			}
+			s.mu.Lock()
+			peer, version, rpcClient = s.peerClients[id], s.peerVersions[id], s.rpcClients[id]
+			s.mu.Unlock()
+		}
+	}
+	if v, ok := args.(versionedArgs); ok {
+		args = v.withProtocolVersion(version)
+	}
+
 	// If this is called after shutdown (where client.Close is called), it will
 	// return an error.
 	if peer == nil {
-		return fmt.Errorf("call client %d after it's closed", id)
+		return fmt.Errorf("call client %s after it's closed", id)
+	} else if rpcClient != nil && peerRPCMethods[serviceMethod] {
+		return rpcClient.Call(ctx, serviceMethod, args, reply)
+	} else if faults, ok := s.transport.(*FaultTransport); ok {
+		return faults.call(ctx, peer, id, serviceMethod, args, reply)
 	} else {
-		return peer.Call(serviceMethod, args, reply)
+		return awaitCall(ctx, goCall(ctx, peer, serviceMethod, args, reply), reply)
+	}
+}
+
+// goCall starts calling serviceMethod on peer. net/rpc can't cancel a call,
+// so if ctx can be done, the reply is decoded into a copy of reply, which
+// awaitCall copies back, rather than written to reply after the caller gave
+// up on it.
+func goCall(ctx context.Context, peer *rpc.Client, serviceMethod string, args interface{}, reply interface{}) *rpc.Call {
+	if ctx.Done() != nil {
+		reply = reflect.New(reflect.TypeOf(reply).Elem()).Interface()
+	}
+	return peer.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+}
+
+// awaitCall waits for call, started by goCall, and sets reply to its reply,
+// or returns ctx.Err() if ctx is done first.
+func awaitCall(ctx context.Context, call *rpc.Call, reply interface{}) error {
+	select {
+	case <-call.Done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if call.Error != nil {
+		return call.Error
+	}
+	if call.Reply != reply {
+		reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(call.Reply).Elem())
 	}
+	return nil
 }
 
+// Submit submits command to DefaultGroup. It returns false if the server
+// isn't the leader, the command is throttled, or its result is unknown.
 func (s *Server) Submit(command interface{}) (interface{}, bool) {
-	return s.cm.Submit(command)
+	return s.SubmitTo(DefaultGroup, command)
+}
+
+// SubmitContext is Submit, waiting for the command to be applied until ctx is
+// done rather than for Config.CommitTimeout if ctx has a deadline.
+func (s *Server) SubmitContext(ctx context.Context, command interface{}) (interface{}, bool) {
+	return s.SubmitToContext(ctx, DefaultGroup, command)
 }
+
+// SubmitIndexed is SubmitContext, also returning the index and term the
+// command was committed at, or the reason it failed.
+func (s *Server) SubmitIndexed(ctx context.Context, command interface{}) (SubmitResult, error) {
+	return s.SubmitToIndexed(ctx, DefaultGroup, command)
+}
+
+// Report reports the state of the default group on this server, like
+// ConsensusModule.Report. isLeader is false if the server doesn't serve yet.
+func (s *Server) Report() (id ServerID, term int, isLeader bool) {
+	cm, err := s.group(DefaultGroup)
+	if err != nil {
+		return s.serverId, 0, false
+	}
+	return cm.Report()
+}
+
+// Status describes the state of the default group on this server, like
+// ConsensusModule.Status.
+func (s *Server) Status() (StatusReply, error) {
+	cm, err := s.group(DefaultGroup)
+	if err != nil {
+		return StatusReply{}, err
+	}
+	return cm.Status(), nil
+}
+
+// Leader returns the ID and the address of the leader of the default group as
+// far as this server knows; followers learn it from the leader's
+// AppendEntries. id is NoServer if the server doesn't know the leader, and
+// addr is "" if it doesn't know its address.
+func (s *Server) Leader() (id ServerID, addr string) {
+	cm, err := s.group(DefaultGroup)
+	if err != nil {
+		return NoServer, ""
+	}
+	id = cm.Leader()
+	if id == NoServer {
+		return NoServer, ""
+	}
+	if addr = s.knownAddr(id); addr == "" {
+		s.addrMu.Lock()
+		if a := s.peerAddrs[id]; a != nil {
+			addr = a.String()
+		}
+		s.addrMu.Unlock()
+	}
+	return id, addr
+}
+
+// knownAddr returns the address of server id, or "" if this server never
+// connected to it.
+func (s *Server) knownAddr(id ServerID) string {
+	if id == s.serverId {
+		return s.GetListenAddr().String()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if addr, ok := s.dialedAddrs[id]; ok {
+		return addr.String()
+	}
+	return ""
+}
+
+// learnPeerAddr records the address of server id, which was added to one of
+// the groups, unless the server already has one: an address saved before a
+// restart or given to UpdatePeerAddress is more recent than the one logged
+// when id was added. As the caller may hold a CM's lock, the address is saved
+// in the background, by saveLearnedAddrs.
+func (s *Server) learnPeerAddr(id ServerID, addr string) {
+	s.addrMu.Lock()
+	defer s.addrMu.Unlock()
+	if _, known := s.peerAddrs[id]; known {
+		return
+	}
+	s.peerAddrs[id] = peerAddr(addr)
+	s.learnedAddrs[id] = addr
+	select {
+	case s.learned <- struct{}{}:
+	default:
+	}
+}
+
+// saveLearnedAddrs saves the addresses recorded by learnPeerAddr whenever it
+// records some, until the server stops, and then saves the last ones.
+func (s *Server) saveLearnedAddrs() {
+	for {
+		select {
+		case <-s.learned:
+		case <-s.quit:
+			s.saveAddrs(s.takeLearnedAddrs())
+			return
+		}
+		s.saveAddrs(s.takeLearnedAddrs())
+	}
+}
+
+// takeLearnedAddrs returns the addresses recorded by learnPeerAddr since the
+// last call, leaving out the ones replaced or forgotten since.
+func (s *Server) takeLearnedAddrs() map[ServerID]string {
+	s.addrMu.Lock()
+	defer s.addrMu.Unlock()
+	addrs := make(map[ServerID]string, len(s.learnedAddrs))
+	for id, addr := range s.learnedAddrs {
+		if current := s.peerAddrs[id]; current != nil && current.String() == addr {
+			addrs[id] = addr
+		}
+	}
+	s.learnedAddrs = make(map[ServerID]string)
+	return addrs
+}
+
+// saveAddrs saves addrs as the addresses of their servers if the storage is a
+// storage.AddressBook and any of them changed, so that the server can dial
+// them after a restart. It writes to the storage, so it's called without s.mu
+// or a CM's lock held.
+func (s *Server) saveAddrs(addrs map[ServerID]string) {
+	book, ok := s.storage.(storage.AddressBook)
+	if !ok {
+		return
+	}
+	s.bookMu.Lock()
+	defer s.bookMu.Unlock()
+	changed := false
+	for id, addr := range addrs {
+		if saved, ok := s.savedAddrs[id]; !ok || saved != addr {
+			s.savedAddrs[id] = addr
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	all := make(map[string]string, len(s.savedAddrs))
+	for id, addr := range s.savedAddrs {
+		all[string(id)] = addr
+	}
+	if err := book.SetPeerAddrs(all); err != nil {
+		s.logger.Printf("[%v] saving the peer addresses failed: %v", s.serverId, err)
+	}
+}
+
+// peerAddr is the address of a peer added at runtime. It's dialed over TCP.
+type peerAddr string
+
+func (a peerAddr) Network() string { return "tcp" }
+func (a peerAddr) String() string  { return string(a) }
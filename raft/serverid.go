@@ -0,0 +1,18 @@
+package raft
+
+import "strconv"
+
+// ServerID identifies a server. It's opaque to Raft: any string but
+// NoServer will do, a UUID or a host name for instance, as long as it's
+// unique in the cluster and the server keeps it across restarts.
+type ServerID string
+
+// NoServer stands for no server: no vote cast in a term, or no known leader.
+const NoServer ServerID = ""
+
+// IntID returns the ID of server i of a cluster whose servers are numbered
+// from 0, as WithCluster numbers them. The clusters created when IDs were
+// ints keep their IDs, and their persisted state, this way.
+func IntID(i int) ServerID {
+	return ServerID(strconv.Itoa(i))
+}
@@ -0,0 +1,91 @@
+package raft
+
+import (
+	"context"
+	"time"
+)
+
+// Drain prepares the server to stop without disrupting its groups. In each of
+// them, it stops accepting commands, rejecting them with a *NotLeaderError,
+// and stops standing for election; hands the leadership over to a follower
+// if it leads; waits for its application to apply the entries it knows to be
+// committed; and snapshots the application, if it's a Snapshotter, so that
+// the server replays no log when it restarts. The state of the groups is
+// persisted as it changes, before the RPCs are answered.
+//
+// Drain goes on with the next steps when one fails or ctx is done, and
+// returns the first error. The server keeps serving the RPCs of its peers,
+// voting and replicating entries, until it's stopped.
+func (s *Server) Drain(ctx context.Context) error {
+	s.mu.Lock()
+	groups := make([]*ConsensusModule, 0, len(s.groups))
+	for _, cm := range s.groups {
+		groups = append(groups, cm)
+	}
+	s.mu.Unlock()
+	var firstErr error
+	for _, cm := range groups {
+		if err := cm.drain(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// drain prepares cm to stop, like Server.Drain.
+func (cm *ConsensusModule) drain(ctx context.Context) error {
+	cm.mu.Lock()
+	if cm.state == Dead {
+		cm.mu.Unlock()
+		return nil
+	}
+	cm.draining = true
+	cm.mu.Unlock()
+
+	var firstErr error
+	fail := func(step string, err error) {
+		cm.raftLog("%s while shutting down failed: %v", step, err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := cm.transferLeadershipAway(); err != nil {
+		fail("handing the leadership over", err)
+	}
+
+	timeout := cm.config.CommitTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	cm.mu.Lock()
+	commitIndex := cm.commitIndex
+	cm.mu.Unlock()
+	if err := cm.WaitApplied(commitIndex, timeout); err != nil {
+		fail("applying the committed entries", err)
+	}
+
+	if _, ok := cm.app.(Snapshotter); ok && cm.appliedSinceSnapshot() {
+		snapshotted := make(chan error, 1)
+		go func() {
+			_, _, err := cm.TakeSnapshot()
+			snapshotted <- err
+		}()
+		select {
+		case err := <-snapshotted:
+			if err != nil {
+				fail("snapshotting", err)
+			}
+		case <-ctx.Done():
+			fail("snapshotting", ctx.Err())
+		}
+	}
+	return firstErr
+}
+
+// appliedSinceSnapshot reports whether cm applied entries since its last
+// snapshot.
+func (cm *ConsensusModule) appliedSinceSnapshot() bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.appliedIndex > cm.snapshotIndex
+}
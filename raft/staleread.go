@@ -0,0 +1,115 @@
+package raft
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// Querier is implemented by Applications that answer read-only queries, which
+// ReadStale serves without going through the log. Query may be called
+// concurrently with ApplyCommand.
+type Querier interface {
+	Query(query interface{}) (interface{}, error)
+}
+
+// ErrTooStale is returned by ReadStale when the state of the application may
+// be older than the staleness allowed.
+var ErrTooStale = errors.New("raft: the state of the server is too stale")
+
+// ReadStale answers query from the state of the application, on any server,
+// as long as that state reflects all the commands committed maxStaleness ago.
+// Followers measure it from the last AE of the leader their log matched, once
+// they applied the entries the leader had committed then, and leaders from
+// the last time a majority acknowledged them. The application must implement
+// Querier.
+func (cm *ConsensusModule) ReadStale(query interface{}, maxStaleness time.Duration) (interface{}, error) {
+	answer, _, err := cm.readStale(query, maxStaleness)
+	return answer, err
+}
+
+// readStale is ReadStale, also returning the index of the last entry applied
+// before the query, which the answer reflects at least.
+func (cm *ConsensusModule) readStale(query interface{}, maxStaleness time.Duration) (interface{}, int, error) {
+	q, ok := cm.app.(Querier)
+	if !ok {
+		return nil, -1, errors.New("raft: the application doesn't answer queries")
+	}
+	cm.mu.Lock()
+	dead := cm.state == Dead
+	freshAt := cm.freshAt
+	applied := cm.appliedIndex
+	cm.mu.Unlock()
+	if dead {
+		return nil, -1, errors.New("raft: stopped")
+	}
+	if freshAt.IsZero() || time.Since(freshAt) > maxStaleness {
+		return nil, -1, ErrTooStale
+	}
+	answer, err := q.Query(query)
+	return answer, applied, err
+}
+
+// ReadStale answers query in the default group, like
+// ConsensusModule.ReadStale.
+func (s *Server) ReadStale(query interface{}, maxStaleness time.Duration) (interface{}, error) {
+	cm, err := s.group(DefaultGroup)
+	if err != nil {
+		return nil, err
+	}
+	return cm.ReadStale(query, maxStaleness)
+}
+
+// noteContact records that a follower's log matched the AE it received at
+// lastContact, which carried leaderCommit, the commit index of the leader
+// then. The application is as fresh as that contact once it applied the
+// entries up to leaderCommit. Until then, the later contacts are left out, so
+// that a follower applying steadily still advances freshAt.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) noteContact(leaderCommit int) {
+	if cm.pendingContact.IsZero() {
+		cm.pendingContact, cm.pendingCommit = cm.lastContact, leaderCommit
+	}
+	cm.updateFreshness()
+}
+
+// updateFreshness records that the application is as fresh as the last
+// contact whose committed entries it applied: on a leader, lastContact once it
+// applied all the entries it committed; on a follower, the contact recorded by
+// noteContact once it applied the entries the leader had committed then.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) updateFreshness() {
+	if cm.state == Leader {
+		if cm.appliedIndex >= cm.commitIndex && cm.lastContact.After(cm.freshAt) {
+			cm.freshAt = cm.lastContact
+		}
+		return
+	}
+	if cm.pendingContact.IsZero() || cm.appliedIndex < cm.pendingCommit {
+		return
+	}
+	if cm.pendingContact.After(cm.freshAt) {
+		cm.freshAt = cm.pendingContact
+	}
+	cm.pendingContact = time.Time{}
+}
+
+// quorumContact returns the last time a majority of the group, the leader
+// included, acknowledged the leadership of cm, or the zero time.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) quorumContact(now time.Time) time.Time {
+	times := make([]time.Time, 0, len(cm.peerIds))
+	for id := range cm.peerIds {
+		if id == cm.id {
+			times = append(times, now)
+		} else {
+			times = append(times, cm.acks[id])
+		}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].After(times[j]) })
+	quorum := len(cm.peerIds)/2 + 1
+	if len(times) < quorum {
+		return time.Time{}
+	}
+	return times[quorum-1]
+}
@@ -0,0 +1,113 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatefulSet describes a cluster run as a Kubernetes StatefulSet behind a
+// headless service: its pods are named after the set with their ordinal, as in
+// raft-0, raft-1 and so on, and each one resolves as <pod>.<Service>.
+type StatefulSet struct {
+	// Hostname is the name of the pod the server runs in, os.Hostname() if
+	// it's empty. It's the ID of the server.
+	Hostname string
+
+	// Service is the domain of the headless service, for instance
+	// raft.default.svc.cluster.local.
+	Service string
+
+	// Replicas is the number of pods of the set, which make up the cluster.
+	Replicas int
+
+	// Port is the port the servers listen at.
+	Port int
+}
+
+// statefulSetRetryInterval is how often a server of a StatefulSet dials the
+// peers it couldn't reach while it waits for a quorum of them.
+const statefulSetRetryInterval = 200 * time.Millisecond
+
+// NewStatefulSetServer creates the server of the pod set.Hostname, configured
+// by opts, in a cluster of the set.Replicas pods of set. The server listens at
+// set.Port, and dials its peers at their pod's DNS name, so that Connect isn't
+// needed. It starts elections once it can reach a quorum of the cluster,
+// rather than when a channel passed to WithMembers is closed, so opts must not
+// hold WithMembers or WithCluster.
+func NewStatefulSetServer(set StatefulSet, opts ...Option) (*Server, error) {
+	hostname := set.Hostname
+	if hostname == "" {
+		var err error
+		if hostname, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+	i := strings.LastIndexByte(hostname, '-')
+	ordinal, err := strconv.Atoi(hostname[i+1:])
+	if i < 0 || err != nil || ordinal < 0 {
+		return nil, fmt.Errorf("raft: hostname %q has no StatefulSet ordinal", hostname)
+	}
+	if set.Replicas <= ordinal {
+		return nil, fmt.Errorf("raft: pod %q is beyond the %d replicas", hostname, set.Replicas)
+	}
+	if set.Service == "" {
+		return nil, errors.New("raft: the StatefulSet service is empty")
+	}
+
+	name := hostname[:i]
+	ids := make([]ServerID, set.Replicas)
+	addrs := make(map[ServerID]string, set.Replicas)
+	for ordinal := range ids {
+		pod := fmt.Sprintf("%s-%d", name, ordinal)
+		ids[ordinal] = ServerID(pod)
+		addrs[ids[ordinal]] = fmt.Sprintf("%s.%s:%d", pod, set.Service, set.Port)
+	}
+	ready := make(chan interface{})
+	opts = append([]Option{
+		WithMembers(ids, ready),
+		WithTransport(TCPTransport{Addr: fmt.Sprintf(":%d", set.Port)}),
+		func(s *Server) {
+			s.statefulSet = addrs
+		},
+	}, opts...)
+	return NewServerWithID(ServerID(hostname), opts...)
+}
+
+// awaitQuorum dials the peers of a StatefulSet until a quorum of the cluster
+// is reachable, and then signals that the server is ready. The peers it can't
+// reach yet are dialed when they're first called.
+func (s *Server) awaitQuorum() {
+	connected := make(map[ServerID]bool)
+	for id, addr := range s.statefulSet {
+		if id != s.serverId {
+			s.learnPeerAddr(id, addr)
+		}
+	}
+	ticker := time.NewTicker(statefulSetRetryInterval)
+	defer ticker.Stop()
+	for {
+		for id, addr := range s.statefulSet {
+			if id == s.serverId || connected[id] {
+				continue
+			}
+			if err := s.Connect(id, peerAddr(addr)); err == nil {
+				connected[id] = true
+			}
+		}
+		if len(connected)+1 > len(s.statefulSet)/2 {
+			s.logger.Printf("[%v] reached %d of %d servers; starting", s.serverId, len(connected)+1, len(s.statefulSet))
+			close(s.ready)
+			return
+		}
+
+		select {
+		case <-s.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
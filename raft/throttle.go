@@ -0,0 +1,73 @@
+package raft
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrThrottled is returned to clients whose commands are rejected because
+// they exceed Config.SubmitRate or Config.SessionSubmitRate. The commands
+// weren't appended, so they can be resubmitted after a while.
+var ErrThrottled = errors.New("raft: submission throttled")
+
+const (
+	// maxIdleSessions is the number of client sessions past which the
+	// limiters of idle sessions are dropped.
+	maxIdleSessions = 1024
+
+	// sessionIdleTimeout is how long a session must be unused for its
+	// limiter to be dropped.
+	sessionIdleTimeout = time.Minute
+)
+
+// sessionLimiter is the rate limiter of a client session.
+type sessionLimiter struct {
+	limiter  *rateLimiter
+	lastUsed time.Time
+}
+
+// submitThrottle limits the commands submitted to a server, as a whole and
+// per client session, with Config.SubmitRate and Config.SessionSubmitRate.
+type submitThrottle struct {
+	limiter     *rateLimiter
+	sessionRate int
+
+	mu       sync.Mutex
+	sessions map[string]*sessionLimiter
+}
+
+func newSubmitThrottle(config Config) *submitThrottle {
+	return &submitThrottle{
+		limiter:     newRateLimiter(config.SubmitRate),
+		sessionRate: config.SessionSubmitRate,
+		sessions:    make(map[string]*sessionLimiter),
+	}
+}
+
+// allow reports whether a command of session can be submitted, and takes a
+// token for it if so. The empty session isn't limited on its own.
+func (t *submitThrottle) allow(session string) bool {
+	if session != "" && t.sessionRate > 0 {
+		t.mu.Lock()
+		now := time.Now()
+		sl, ok := t.sessions[session]
+		if !ok {
+			if len(t.sessions) >= maxIdleSessions {
+				for id, idle := range t.sessions {
+					if now.Sub(idle.lastUsed) > sessionIdleTimeout {
+						delete(t.sessions, id)
+					}
+				}
+			}
+			sl = &sessionLimiter{limiter: newRateLimiter(t.sessionRate)}
+			t.sessions[session] = sl
+		}
+		sl.lastUsed = now
+		t.mu.Unlock()
+		if !sl.limiter.take(1) {
+			return false
+		}
+	}
+	return t.limiter.take(1)
+}
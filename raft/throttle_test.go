@@ -0,0 +1,30 @@
+package raft
+
+import "testing"
+
+func TestSubmitThrottle(t *testing.T) {
+	throttle := newSubmitThrottle(Config{SubmitRate: 3, SessionSubmitRate: 1})
+	if !throttle.allow("a") {
+		t.Fatal("first command of session a throttled")
+	}
+	if throttle.allow("a") {
+		t.Error("session a exceeded its rate")
+	}
+	if !throttle.allow("b") {
+		t.Error("session b throttled by session a")
+	}
+	// The rejected command of session a didn't count against the server.
+	if !throttle.allow("") {
+		t.Error("server throttled below its rate")
+	}
+	if throttle.allow("") {
+		t.Error("server exceeded its rate")
+	}
+
+	unlimited := newSubmitThrottle(Config{})
+	for i := 0; i < 100; i++ {
+		if !unlimited.allow("a") {
+			t.Fatal("unlimited throttle rejected a command")
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package raft
+
+import "net"
+
+// Transport provides the connections the Server exchanges RPCs over: it
+// listens for connections from peers and dials them.
+type Transport interface {
+	// Listen returns the listener the server accepts peer connections on.
+	Listen() (net.Listener, error)
+
+	// Dial connects to the peer listening at addr.
+	Dial(addr net.Addr) (net.Conn, error)
+}
+
+// TCPTransport is the default Transport, over plain TCP.
+type TCPTransport struct {
+	// Addr is the address to listen on, ":0" (any free port) if empty.
+	Addr string
+}
+
+func (t TCPTransport) Listen() (net.Listener, error) {
+	addr := t.Addr
+	if addr == "" {
+		addr = ":0"
+	}
+	return net.Listen("tcp", addr)
+}
+
+func (t TCPTransport) Dial(addr net.Addr) (net.Conn, error) {
+	return net.Dial(addr.Network(), addr.String())
+}
@@ -0,0 +1,51 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+)
+
+// TypedApplication is an Application whose commands are all of type C and
+// whose results are of type R, written as a function of them rather than with
+// type assertions. An application that also implements Snapshotter, or
+// another of the optional interfaces, can call a TypedApplication from its own
+// ApplyCommand.
+type TypedApplication[C, R any] func(command C) R
+
+// ApplyCommand applies command, which must be a C.
+func (f TypedApplication[C, R]) ApplyCommand(command interface{}) interface{} {
+	return f(command.(C))
+}
+
+// Submitter submits commands, and reports the index and term they were
+// committed at. It's implemented by Server, ConsensusModule and client.Client.
+type Submitter interface {
+	SubmitIndexed(ctx context.Context, command interface{}) (SubmitResult, error)
+}
+
+// SubmitTyped submits command with s, and returns its result as an R. It
+// fails like s.SubmitIndexed, or with a *ResultTypeError if the command was
+// applied but its result isn't an R. A nil result is the zero R.
+func SubmitTyped[C, R any](ctx context.Context, s Submitter, command C) (R, error) {
+	var result R
+	committed, err := s.SubmitIndexed(ctx, command)
+	if err != nil || committed.Result == nil {
+		return result, err
+	}
+	result, ok := committed.Result.(R)
+	if !ok {
+		return result, &ResultTypeError{Result: committed.Result, Want: fmt.Sprintf("%T", result)}
+	}
+	return result, nil
+}
+
+// ResultTypeError is returned by SubmitTyped when the result of the command
+// doesn't have the requested type. The command was applied.
+type ResultTypeError struct {
+	Result interface{}
+	Want   string
+}
+
+func (e *ResultTypeError) Error() string {
+	return fmt.Sprintf("raft: the command's result is a %T, not a %s", e.Result, e.Want)
+}
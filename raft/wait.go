@@ -0,0 +1,45 @@
+package raft
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrApplyTimeout is returned by WaitApplied when the index isn't applied in
+// time.
+var ErrApplyTimeout = errors.New("raft: the index wasn't applied in time")
+
+// WaitApplied waits until the application of cm finished applying the entry
+// at index, for a client that learned the index of its command from another
+// server, through SubmitIndexed for instance, to read its effects locally. It
+// returns ErrApplyTimeout if that takes longer than timeout, and an error if
+// cm stops.
+func (cm *ConsensusModule) WaitApplied(index int, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		cm.mu.Lock()
+		applied, appliedChan := cm.appliedIndex, cm.appliedChan
+		cm.mu.Unlock()
+		if applied >= index {
+			return nil
+		}
+		select {
+		case <-appliedChan:
+		case <-cm.done:
+			return errors.New("raft: stopped")
+		case <-timer.C:
+			return ErrApplyTimeout
+		}
+	}
+}
+
+// WaitApplied waits for index to be applied in the default group, like
+// ConsensusModule.WaitApplied.
+func (s *Server) WaitApplied(index int, timeout time.Duration) error {
+	cm, err := s.group(DefaultGroup)
+	if err != nil {
+		return err
+	}
+	return cm.WaitApplied(index, timeout)
+}
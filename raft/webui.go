@@ -0,0 +1,192 @@
+package raft
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+)
+
+// uiRefresh is how often the web UI refreshes, in milliseconds.
+const uiRefresh = 1000
+
+// uiGroup is what the web UI shows of a group, as the JSON it polls.
+type uiGroup struct {
+	Id               int          `json:"id"`
+	Status           StatusReply  `json:"status"`
+	Peers            []PeerStatus `json:"peers"`
+	Elections        []Election   `json:"elections"`
+	ElectionsStarted uint64       `json:"electionsStarted"`
+	ElectionsWon     uint64       `json:"electionsWon"`
+	LeaderChanges    uint64       `json:"leaderChanges"`
+}
+
+// UIHandler returns an HTTP handler serving a web UI of the groups of the
+// server, to mount on the same operator's HTTP server as DebugHandler. The
+// page shows, for each group, its members and their roles, the term, the
+// replication progress of the followers as bars, and the recent elections,
+// refreshed every second from the JSON the handler answers with the
+// format=json query parameter: the Status, ListPeers and Metrics of the
+// groups. The replication progress is only known while the server leads the
+// group.
+func (s *Server) UIHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("format") != "json" {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			io.WriteString(w, uiPage)
+			return
+		}
+
+		s.mu.Lock()
+		ids := make([]int, 0, len(s.groups))
+		for id := range s.groups {
+			ids = append(ids, id)
+		}
+		s.mu.Unlock()
+		sort.Ints(ids)
+
+		page := struct {
+			Id      ServerID  `json:"id"`
+			Refresh int       `json:"refresh"`
+			Groups  []uiGroup `json:"groups"`
+		}{Id: s.serverId, Refresh: uiRefresh, Groups: []uiGroup{}}
+		for _, id := range ids {
+			cm, err := s.group(id)
+			if err != nil {
+				// The group was removed in the meantime.
+				continue
+			}
+			metrics := cm.Metrics()
+			page.Groups = append(page.Groups, uiGroup{
+				Id:               id,
+				Status:           cm.Status(),
+				Peers:            cm.ListPeers(),
+				Elections:        metrics.RecentElections,
+				ElectionsStarted: metrics.ElectionsStarted,
+				ElectionsWon:     metrics.ElectionsWon,
+				LeaderChanges:    metrics.LeaderChanges,
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(page); err != nil {
+			s.logger.Printf("[%v] encoding the web UI state failed: %v", s.serverId, err)
+		}
+	})
+}
+
+// uiPage is the web UI, which renders the JSON of UIHandler. It builds its
+// elements with textContent, so the IDs and addresses it shows can't inject
+// markup.
+const uiPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>raft</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { padding: 0.2em 0.8em; text-align: left; }
+.node { display: inline-block; border: 2px solid #999; border-radius: 6px; padding: 0.5em 1em; margin: 0 0.5em 0.5em 0; }
+.leader { border-color: #2a7; }
+.candidate { border-color: #e90; }
+.self { font-weight: bold; }
+progress { width: 12em; }
+#error { color: #c22; }
+</style>
+</head>
+<body>
+<h1 id="title">raft</h1>
+<p id="error"></p>
+<div id="groups"></div>
+<script>
+"use strict";
+
+function el(tag, text, cls) {
+  const e = document.createElement(tag);
+  if (text !== undefined) e.textContent = text;
+  if (cls) e.className = cls;
+  return e;
+}
+
+function row(cells, header) {
+  const tr = el("tr");
+  for (const c of cells) {
+    const td = el(header ? "th" : "td");
+    if (c instanceof Node) td.appendChild(c); else td.textContent = c;
+    tr.appendChild(td);
+  }
+  return tr;
+}
+
+function renderGroup(server, g) {
+  const div = el("div");
+  const st = g.status;
+  div.appendChild(el("h2", "Group " + g.id));
+  div.appendChild(el("p", st.State + " in term " + st.Term + ", leader " + (st.Leader || "unknown") +
+    ", commit index " + st.CommitIndex + ", last applied " + st.LastApplied +
+    (st.Maintenance ? ", in maintenance" : "")));
+
+  const nodes = el("div");
+  for (const p of g.peers || []) {
+    let role = "follower";
+    if (p.Id === st.Leader) role = "leader";
+    if (p.Id === server) role = st.State.toLowerCase();
+    const n = el("div", "", "node " + role + (p.Id === server ? " self" : ""));
+    n.appendChild(el("div", p.Id));
+    n.appendChild(el("small", role));
+    nodes.appendChild(n);
+  }
+  div.appendChild(nodes);
+
+  div.appendChild(el("h3", "Replication"));
+  if (st.State !== "Leader") {
+    div.appendChild(el("p", "Only the leader knows the replication progress."));
+  } else {
+    const table = el("table");
+    table.appendChild(row(["id", "address", "state", "progress", "match index", "lag"], true));
+    for (const p of g.peers || []) {
+      const bar = el("progress");
+      bar.max = Math.max(st.LastLogIndex, 1);
+      bar.value = Math.max(p.MatchIndex, 0);
+      table.appendChild(row([p.Id, p.Addr, p.State, bar, p.MatchIndex + " / " + st.LastLogIndex, p.Lag]));
+    }
+    div.appendChild(table);
+  }
+
+  div.appendChild(el("h3", "Recent elections"));
+  div.appendChild(el("p", g.electionsStarted + " started and " + g.electionsWon + " won by this server, " +
+    g.leaderChanges + " leader changes seen"));
+  const table = el("table");
+  table.appendChild(row(["term", "leader", "learned at"], true));
+  for (const e of (g.elections || []).slice().reverse()) {
+    table.appendChild(row([e.Term, e.Leader, new Date(e.Time).toLocaleTimeString()]));
+  }
+  div.appendChild(table);
+  return div;
+}
+
+let refresh = 1000;
+
+async function update() {
+  try {
+    const resp = await fetch("?format=json", {cache: "no-store"});
+    if (!resp.ok) throw new Error(resp.status + " " + resp.statusText);
+    const state = await resp.json();
+    refresh = state.refresh;
+    document.title = "raft " + state.id;
+    document.getElementById("title").textContent = "Server " + state.id;
+    const groups = document.getElementById("groups");
+    groups.replaceChildren(...state.groups.map(g => renderGroup(state.id, g)));
+    document.getElementById("error").textContent = "";
+  } catch (err) {
+    document.getElementById("error").textContent = "Refreshing failed: " + err.message;
+  }
+  setTimeout(update, refresh);
+}
+
+update();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,38 @@
+package raft
+
+import (
+	"bytes"
+	"io"
+)
+
+// A witness is a server that votes and acknowledges entries, so that it counts
+// toward the quorums of elections and commits, but that neither stores nor
+// applies commands, and never becomes leader. Two servers holding the data and
+// a witness tolerate the failure of any one of them, as three full servers
+// would.
+//
+// The leader learns that a peer is a witness from its AppendEntries replies.
+// From then on, it sends the peer entries without their commands, and
+// snapshots without the Application's data.
+
+// witnessApp is the Application of a witness, and of a server in election-only
+// mode. The commands it's given are nil, and it has no state to snapshot.
+type witnessApp struct{}
+
+func (witnessApp) ApplyCommand(interface{}) interface{} { return nil }
+func (witnessApp) SnapshotTo(io.Writer) error           { return nil }
+func (witnessApp) RestoreFrom(io.Reader) error          { return nil }
+
+// stripSnapshot returns the header of the snapshot data, which is all a
+// witness needs of it.
+func stripSnapshot(data []byte) ([]byte, error) {
+	header, _, ok, err := readSnapshotHeader(data)
+	if err != nil || !ok {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := writeSnapshotHeader(&buf, header); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,81 @@
+package raft
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// Servers may be labeled with the zone they run in, such as an availability
+// zone or a region, with WithZone. Followers report their zone in their
+// AppendEntries replies. With Config.PreferredZone set, a leader outside that
+// zone hands its leadership over to a follower in it once it has led for
+// Config.ZoneTransferDelay, so that clients, which are usually close to the
+// preferred zone, see the latency of that zone. If no server of the preferred
+// zone is up to date, the leader keeps trying every ZoneTransferDelay.
+
+// WithZone labels the server with the zone it runs in, for
+// Config.PreferredZone.
+func WithZone(zone string) Option {
+	return func(s *Server) {
+		s.zone = zone
+	}
+}
+
+// Zone returns the zone of the server set with WithZone.
+func (s *Server) Zone() string {
+	return s.zone
+}
+
+// runZonePreference hands the leadership of term over to a follower in
+// Config.PreferredZone, retrying every Config.ZoneTransferDelay until it
+// succeeds or cm loses the leadership. It's started by startLeader when cm
+// isn't in the preferred zone.
+func (cm *ConsensusModule) runZonePreference(term int) {
+	timer := time.NewTimer(cm.config.ZoneTransferDelay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-cm.done:
+			return
+		}
+		cm.mu.Lock()
+		if cm.state != Leader || cm.currentTerm != term {
+			cm.mu.Unlock()
+			return
+		}
+		candidates := cm.zoneCandidates()
+		cm.mu.Unlock()
+
+		for _, id := range candidates {
+			err := cm.TransferLeadership(id)
+			if err == nil {
+				cm.raftLog("handed the leadership over to %s in zone %s", id, cm.config.PreferredZone)
+				return
+			}
+			var notLeader *NotLeaderError
+			if errors.As(err, &notLeader) {
+				return
+			}
+			cm.raftLog("failed to transfer the leadership to %s: %v", id, err)
+		}
+		timer.Reset(cm.config.ZoneTransferDelay)
+	}
+}
+
+// zoneCandidates returns the followers in the preferred zone that can take
+// the leadership over, the most up-to-date ones first.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) zoneCandidates() []ServerID {
+	var candidates []ServerID
+	for id := range cm.peerIds {
+		if id != cm.id && !cm.witnesses[id] && cm.zones[id] == cm.config.PreferredZone {
+			candidates = append(candidates, id)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return cm.matchIndex[candidates[i]] > cm.matchIndex[candidates[j]]
+	})
+	return candidates
+}
@@ -0,0 +1,224 @@
+// Package shardkv is an example of a key-value store sharded over several Raft
+// groups hosted by the same servers. Keys are hashed to a fixed number of
+// shards, and each shard is assigned to a group. KV routes each operation to
+// the leader of the group of the key's shard, and moves shards between groups
+// to rebalance them when groups are added.
+//
+// Operations and shard moves are serialized by KV, so a shard never receives
+// writes while it's being moved. A real deployment would replicate the shard
+// assignment itself and fence the groups during moves instead.
+package shardkv
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/aecra/raft/raft"
+)
+
+// ErrUnavailable is returned when no server of a group commits a command in
+// time, for instance because it has no leader.
+var ErrUnavailable = errors.New("shardkv: group unavailable")
+
+// submitTimeout is how long KV retries a command before giving up.
+const submitTimeout = 3 * time.Second
+
+// KV is a sharded key-value store running on a cluster of servers.
+type KV struct {
+	mu      sync.Mutex
+	servers []*raft.Server
+
+	// groups are the IDs of the groups, and nextGroup the ID of the next one
+	// added.
+	groups    []int
+	nextGroup int
+
+	// shardGroups is the group each shard is assigned to.
+	shardGroups []int
+
+	// leaders is the index of the server that last committed a command of
+	// each group. It's tried first, as it's most likely still the leader.
+	leaders map[int]int
+}
+
+// Start starts numServers servers hosting numGroups groups, and spreads
+// numShards shards over the groups.
+func Start(numServers, numGroups, numShards int) (*KV, error) {
+	if numGroups <= 0 || numShards < numGroups {
+		return nil, fmt.Errorf("shardkv: can't spread %d shards over %d groups", numShards, numGroups)
+	}
+	kv := &KV{
+		nextGroup:   raft.DefaultGroup + 1,
+		shardGroups: make([]int, numShards),
+		leaders:     make(map[int]int),
+	}
+	ready := make(chan interface{})
+	for i := 0; i < numServers; i++ {
+		s, err := raft.NewServer(i, raft.WithCluster(numServers, ready))
+		if err != nil {
+			kv.Shutdown()
+			return nil, err
+		}
+		s.Serve()
+		kv.servers = append(kv.servers, s)
+	}
+	for i, s := range kv.servers {
+		for j, peer := range kv.servers {
+			if i != j {
+				if err := s.Connect(raft.IntID(j), peer.GetListenAddr()); err != nil {
+					kv.Shutdown()
+					return nil, err
+				}
+			}
+		}
+	}
+	close(ready)
+
+	for i := 0; i < numGroups; i++ {
+		if _, err := kv.AddGroup(); err != nil {
+			kv.Shutdown()
+			return nil, err
+		}
+	}
+	for shard := range kv.shardGroups {
+		kv.shardGroups[shard] = kv.groups[shard%numGroups]
+	}
+	return kv, nil
+}
+
+// Shutdown stops the servers.
+func (kv *KV) Shutdown() {
+	for _, s := range kv.servers {
+		s.DisconnectAll()
+	}
+	for _, s := range kv.servers {
+		s.Shutdown()
+	}
+}
+
+// ShardOf returns the shard of key.
+func (kv *KV) ShardOf(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(kv.shardGroups)))
+}
+
+// GroupOf returns the group shard is assigned to.
+func (kv *KV) GroupOf(shard int) int {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.shardGroups[shard]
+}
+
+// Put sets key to value.
+func (kv *KV) Put(key, value string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	shard := kv.ShardOf(key)
+	_, err := kv.submit(kv.shardGroups[shard], Put{Shard: shard, Key: key, Value: value})
+	return err
+}
+
+// Get returns the value of key. ok is false if it isn't set.
+func (kv *KV) Get(key string) (value string, ok bool, err error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	shard := kv.ShardOf(key)
+	res, err := kv.submit(kv.shardGroups[shard], Get{Shard: shard, Key: key})
+	return res.Value, res.Found, err
+}
+
+// AddGroup creates a new group on all the servers and returns its ID. It
+// hosts no shard until Rebalance is called.
+func (kv *KV) AddGroup() (int, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	group := kv.nextGroup
+	for _, s := range kv.servers {
+		if err := s.CreateGroup(group, NewStore(), nil); err != nil {
+			return 0, err
+		}
+	}
+	kv.nextGroup++
+	kv.groups = append(kv.groups, group)
+	return group, nil
+}
+
+// Rebalance moves shards from the groups hosting the most to those hosting
+// the fewest, until their numbers differ by at most one.
+func (kv *KV) Rebalance() error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	for {
+		shards := make(map[int][]int)
+		for shard, group := range kv.shardGroups {
+			shards[group] = append(shards[group], shard)
+		}
+		most, fewest := kv.groups[0], kv.groups[0]
+		for _, group := range kv.groups {
+			if len(shards[group]) > len(shards[most]) {
+				most = group
+			}
+			if len(shards[group]) < len(shards[fewest]) {
+				fewest = group
+			}
+		}
+		if len(shards[most]) <= len(shards[fewest])+1 {
+			return nil
+		}
+		if err := kv.move(shards[most][0], fewest); err != nil {
+			return err
+		}
+	}
+}
+
+// Move moves shard to group.
+func (kv *KV) Move(shard, group int) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.move(shard, group)
+}
+
+// move copies the keys of shard to group, then assigns the shard to it and
+// drops it from its previous group.
+// Expects kv.mu to be locked.
+func (kv *KV) move(shard, group int) error {
+	from := kv.shardGroups[shard]
+	if from == group {
+		return nil
+	}
+	res, err := kv.submit(from, Export{Shard: shard})
+	if err != nil {
+		return err
+	}
+	if _, err := kv.submit(group, Import{Shard: shard, Data: res.Data}); err != nil {
+		return err
+	}
+	kv.shardGroups[shard] = group
+	_, err = kv.submit(from, Drop{Shard: shard})
+	return err
+}
+
+// submit submits command to group, trying its last known leader first, and
+// retries on all the servers until one commits it.
+// Expects kv.mu to be locked.
+func (kv *KV) submit(group int, command interface{}) (Result, error) {
+	deadline := time.Now().Add(submitTimeout)
+	for {
+		leader := kv.leaders[group]
+		for i := range kv.servers {
+			id := (leader + i) % len(kv.servers)
+			if res, ok := kv.servers[id].SubmitTo(group, command); ok {
+				kv.leaders[group] = id
+				return res.(Result), nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return Result{}, ErrUnavailable
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,87 @@
+package shardkv
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestPutGet(t *testing.T) {
+	kv, err := Start(3, 2, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Shutdown()
+
+	for i := 0; i < 20; i++ {
+		if err := kv.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		value, ok, err := kv.Get(fmt.Sprintf("key%d", i))
+		if err != nil || !ok || value != fmt.Sprintf("value%d", i) {
+			t.Errorf("Get(key%d) = %q, %v, %v", i, value, ok, err)
+		}
+	}
+	if _, ok, err := kv.Get("missing"); err != nil || ok {
+		t.Errorf("Get(missing) = _, %v, %v, want not found", ok, err)
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	kv, err := Start(3, 2, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Shutdown()
+
+	for i := 0; i < 30; i++ {
+		if err := kv.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	group, err := kv.AddGroup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Rebalance(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 9 shards over 3 groups is 3 each.
+	counts := make(map[int]int)
+	for shard := 0; shard < 9; shard++ {
+		counts[kv.GroupOf(shard)]++
+	}
+	if counts[group] != 3 || len(counts) != 3 {
+		t.Errorf("shards per group after rebalancing: %v", counts)
+	}
+	for i := 0; i < 30; i++ {
+		value, ok, err := kv.Get(fmt.Sprintf("key%d", i))
+		if err != nil || !ok || value != fmt.Sprintf("value%d", i) {
+			t.Errorf("Get(key%d) = %q, %v, %v after rebalancing", i, value, ok, err)
+		}
+	}
+}
+
+func TestStoreSnapshot(t *testing.T) {
+	st := NewStore()
+	st.ApplyCommand(Put{Shard: 1, Key: "a", Value: "1"})
+	st.ApplyCommand(Import{Shard: 2, Data: map[string]string{"b": "2"}})
+	var buf bytes.Buffer
+	if err := st.SnapshotTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewStore()
+	if err := restored.RestoreFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored.Shards, st.Shards) {
+		t.Errorf("restored %v, want %v", restored.Shards, st.Shards)
+	}
+	if res := restored.ApplyCommand(Drop{Shard: 2}).(Result); !res.Found {
+		t.Error("Drop didn't find the restored shard")
+	}
+}
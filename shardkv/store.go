@@ -0,0 +1,114 @@
+package shardkv
+
+import (
+	"encoding/gob"
+	"io"
+)
+
+func init() {
+	// Commands are sent to peers with the default GobCodec.
+	gob.Register(Put{})
+	gob.Register(Get{})
+	gob.Register(Export{})
+	gob.Register(Import{})
+	gob.Register(Drop{})
+}
+
+// Put sets Key to Value in Shard.
+type Put struct {
+	Shard int
+	Key   string
+	Value string
+}
+
+// Get reads Key from Shard. It goes through the log so that it's
+// linearizable.
+type Get struct {
+	Shard int
+	Key   string
+}
+
+// Export returns a copy of the keys of Shard, to move it to another group.
+type Export struct {
+	Shard int
+}
+
+// Import installs the keys of Shard exported from another group.
+type Import struct {
+	Shard int
+	Data  map[string]string
+}
+
+// Drop discards Shard once it was moved to another group.
+type Drop struct {
+	Shard int
+}
+
+// Result is the result of applying a command. Found reports whether a Get
+// found its key, or whether the shard of any command is hosted by the group.
+type Result struct {
+	Found bool
+	Value string
+	Data  map[string]string
+}
+
+// Store is the Application of a Raft group: the keys of the shards the group
+// hosts.
+type Store struct {
+	Shards map[int]map[string]string
+}
+
+func NewStore() *Store {
+	return &Store{Shards: make(map[int]map[string]string)}
+}
+
+func (st *Store) ApplyCommand(command interface{}) interface{} {
+	switch c := command.(type) {
+	case Put:
+		if st.Shards[c.Shard] == nil {
+			st.Shards[c.Shard] = make(map[string]string)
+		}
+		st.Shards[c.Shard][c.Key] = c.Value
+		return Result{Found: true}
+	case Get:
+		value, ok := st.Shards[c.Shard][c.Key]
+		return Result{Found: ok, Value: value}
+	case Export:
+		data := make(map[string]string, len(st.Shards[c.Shard]))
+		for k, v := range st.Shards[c.Shard] {
+			data[k] = v
+		}
+		return Result{Found: st.Shards[c.Shard] != nil, Data: data}
+	case Import:
+		data := make(map[string]string, len(c.Data))
+		for k, v := range c.Data {
+			data[k] = v
+		}
+		st.Shards[c.Shard] = data
+		return Result{Found: true}
+	case Drop:
+		_, ok := st.Shards[c.Shard]
+		delete(st.Shards, c.Shard)
+		return Result{Found: ok}
+	default:
+		return Result{}
+	}
+}
+
+// SnapshotTo encodes the shards to w with gob.
+func (st *Store) SnapshotTo(w io.Writer) error {
+	return gob.NewEncoder(w).Encode(st)
+}
+
+// RestoreFrom replaces the shards with the ones encoded by SnapshotTo.
+func (st *Store) RestoreFrom(r io.Reader) error {
+	var restored Store
+	if err := gob.NewDecoder(r).Decode(&restored); err != nil {
+		return err
+	}
+	if restored.Shards == nil {
+		restored.Shards = make(map[int]map[string]string)
+	}
+	*st = restored
+	return nil
+}
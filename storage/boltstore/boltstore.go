@@ -0,0 +1,348 @@
+// Package boltstore implements storage.Storage on top of bbolt, for users who
+// prefer a single-file transactional store over the write-ahead log.
+//
+// Log entries live in the "logs" bucket keyed by their big-endian index, and
+// the hard state, snapshot and peer addresses live in the "stable" bucket.
+// Saving a snapshot deletes the entries it covers. Every call runs in its own
+// transaction, which bbolt fsyncs on commit. Commands are encoded with gob,
+// so their concrete types must be registered with gob.Register.
+package boltstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	"github.com/aecra/raft/storage"
+	bolt "go.etcd.io/bbolt"
+)
+
+// openTimeout is how long Open waits for the lock on a database held by
+// another process.
+const openTimeout = time.Second
+
+var (
+	logsBucket   = []byte("logs")
+	stableBucket = []byte("stable")
+	hardStateKey = []byte("hardStateV2")
+	snapshotKey  = []byte("snapshot")
+	peersKey     = []byte("peers")
+
+	// legacyHardStateKey holds the hard state saved when votes were ints.
+	// It's only read if there's no hard state under hardStateKey.
+	legacyHardStateKey = []byte("hardState")
+)
+
+// BoltStore is a storage.Storage backed by a bbolt database.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// storedEntry is the value stored for each log entry.
+type storedEntry struct {
+	Term     int
+	Command  interface{}
+	Checksum uint32
+}
+
+// Open opens the bbolt database at path, creating it if needed. It fails if
+// the database stays locked by another process for openTimeout.
+func Open(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0640, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(logsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(stableBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func indexKey(index int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(index))
+	return key
+}
+
+func keyIndex(key []byte) int {
+	return int(binary.BigEndian.Uint64(key))
+}
+
+func (b *BoltStore) HardState() (storage.HardState, bool, error) {
+	var st storage.HardState
+	var ok bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(stableBucket)
+		if value := bucket.Get(hardStateKey); value != nil {
+			if len(value) < 8 {
+				return fmt.Errorf("boltstore: bad hard state")
+			}
+			st.CurrentTerm = int(int64(binary.BigEndian.Uint64(value[0:])))
+			st.VotedFor = string(value[8:])
+			ok = true
+			return nil
+		}
+		value := bucket.Get(legacyHardStateKey)
+		if value == nil {
+			return nil
+		}
+		if len(value) != 16 {
+			return fmt.Errorf("boltstore: bad hard state")
+		}
+		st.CurrentTerm = int(int64(binary.BigEndian.Uint64(value[0:])))
+		st.VotedFor = storage.LegacyVotedFor(int(int64(binary.BigEndian.Uint64(value[8:]))))
+		ok = true
+		return nil
+	})
+	return st, ok, err
+}
+
+func (b *BoltStore) SetHardState(st storage.HardState) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return setHardState(tx, st)
+	})
+}
+
+// setHardState saves st in tx.
+func setHardState(tx *bolt.Tx, st storage.HardState) error {
+	value := make([]byte, 8, 8+len(st.VotedFor))
+	binary.BigEndian.PutUint64(value[0:], uint64(st.CurrentTerm))
+	value = append(value, st.VotedFor...)
+	return tx.Bucket(stableBucket).Put(hardStateKey, value)
+}
+
+func (b *BoltStore) PeerAddrs() (map[string]string, error) {
+	addrs := make(map[string]string)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(stableBucket).Get(peersKey)
+		if value == nil {
+			return nil
+		}
+		if err := gob.NewDecoder(bytes.NewReader(value)).Decode(&addrs); err != nil {
+			return fmt.Errorf("boltstore: bad peer addresses: %v", err)
+		}
+		return nil
+	})
+	return addrs, err
+}
+
+func (b *BoltStore) SetPeerAddrs(addrs map[string]string) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(addrs); err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(stableBucket).Put(peersKey, buf.Bytes())
+	})
+}
+
+// snapshot decodes the snapshot saved in tx. Its index and term are -1 if
+// there's none.
+func snapshot(tx *bolt.Tx) (storage.Snapshot, bool, error) {
+	value := tx.Bucket(stableBucket).Get(snapshotKey)
+	if value == nil {
+		return storage.Snapshot{Index: -1, Term: -1}, false, nil
+	}
+	if len(value) < 16 {
+		return storage.Snapshot{}, false, fmt.Errorf("boltstore: bad snapshot")
+	}
+	return storage.Snapshot{
+		Index: int(int64(binary.BigEndian.Uint64(value[0:]))),
+		Term:  int(int64(binary.BigEndian.Uint64(value[8:]))),
+		Data:  append([]byte{}, value[16:]...),
+	}, true, nil
+}
+
+// lastIndex returns the index of the last entry in tx, or of the snapshot
+// if no entry follows it.
+func lastIndex(tx *bolt.Tx) (int, error) {
+	if key, _ := tx.Bucket(logsBucket).Cursor().Last(); key != nil {
+		return keyIndex(key), nil
+	}
+	snap, _, err := snapshot(tx)
+	return snap.Index, err
+}
+
+func (b *BoltStore) FirstIndex() (int, error) {
+	var first int
+	err := b.db.View(func(tx *bolt.Tx) error {
+		snap, _, err := snapshot(tx)
+		first = snap.Index + 1
+		return err
+	})
+	return first, err
+}
+
+func (b *BoltStore) LastIndex() (int, error) {
+	last := -1
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		last, err = lastIndex(tx)
+		return err
+	})
+	return last, err
+}
+
+func (b *BoltStore) Entries(lo, hi int) ([]storage.Entry, error) {
+	if lo < 0 || lo > hi {
+		return nil, storage.ErrOutOfRange
+	}
+	entries := make([]storage.Entry, 0, hi-lo)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		snap, _, err := snapshot(tx)
+		if err != nil {
+			return err
+		}
+		if lo <= snap.Index {
+			return storage.ErrCompacted
+		}
+		c := tx.Bucket(logsBucket).Cursor()
+		for key, value := c.Seek(indexKey(lo)); key != nil && keyIndex(key) < hi; key, value = c.Next() {
+			var stored storedEntry
+			if err := gob.NewDecoder(bytes.NewReader(value)).Decode(&stored); err != nil {
+				return fmt.Errorf("decoding entry %d: %v", keyIndex(key), err)
+			}
+			entries = append(entries, storage.Entry{Index: keyIndex(key), Term: stored.Term, Command: stored.Command, Checksum: stored.Checksum})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) != hi-lo {
+		return nil, storage.ErrOutOfRange
+	}
+	return entries, nil
+}
+
+func (b *BoltStore) Append(entries []storage.Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return appendEntries(tx, entries)
+	})
+}
+
+// Save saves st and appends entries in a single transaction.
+func (b *BoltStore) Save(st storage.HardState, entries []storage.Entry) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := appendEntries(tx, entries); err != nil {
+			return err
+		}
+		return setHardState(tx, st)
+	})
+}
+
+// appendEntries appends entries in tx, overwriting the ones from the index of
+// the first on.
+func appendEntries(tx *bolt.Tx, entries []storage.Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	bucket := tx.Bucket(logsBucket)
+	first := entries[0].Index
+	snap, _, err := snapshot(tx)
+	if err != nil {
+		return err
+	}
+	if first <= snap.Index {
+		return storage.ErrCompacted
+	}
+	last, err := lastIndex(tx)
+	if err != nil {
+		return err
+	}
+	if first > last+1 {
+		return storage.ErrOutOfRange
+	}
+	// Discard the entries that are being overwritten.
+	if err := deleteRange(bucket, first, -1); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(storedEntry{Term: e.Term, Command: e.Command, Checksum: e.Checksum}); err != nil {
+			return err
+		}
+		if err := bucket.Put(indexKey(e.Index), buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *BoltStore) Snapshot() (storage.Snapshot, bool, error) {
+	var snap storage.Snapshot
+	var ok bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		snap, ok, err = snapshot(tx)
+		return err
+	})
+	return snap, ok, err
+}
+
+func (b *BoltStore) SaveSnapshot(snap storage.Snapshot) error {
+	value := make([]byte, 16, 16+len(snap.Data))
+	binary.BigEndian.PutUint64(value[0:], uint64(snap.Index))
+	binary.BigEndian.PutUint64(value[8:], uint64(snap.Term))
+	value = append(value, snap.Data...)
+	return b.db.Update(func(tx *bolt.Tx) error {
+		saved, _, err := snapshot(tx)
+		if err != nil {
+			return err
+		}
+		if snap.Index < saved.Index {
+			return storage.ErrSnapshotOutOfDate
+		}
+		bucket := tx.Bucket(logsBucket)
+		keep := snap.Index == saved.Index && snap.Term == saved.Term
+		if raw := bucket.Get(indexKey(snap.Index)); raw != nil {
+			var stored storedEntry
+			if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&stored); err != nil {
+				return fmt.Errorf("decoding entry %d: %v", snap.Index, err)
+			}
+			keep = stored.Term == snap.Term
+		}
+		end := snap.Index + 1
+		if !keep {
+			end = -1
+		}
+		if err := deleteRange(bucket, 0, end); err != nil {
+			return err
+		}
+		return tx.Bucket(stableBucket).Put(snapshotKey, value)
+	})
+}
+
+// deleteRange deletes the entries in [lo, hi) from bucket, or from lo on if
+// hi is -1. Keys are collected first, as deleting while iterating makes the
+// cursor skip keys.
+func deleteRange(bucket *bolt.Bucket, lo, hi int) error {
+	var stale [][]byte
+	c := bucket.Cursor()
+	for key, _ := c.Seek(indexKey(lo)); key != nil && (hi == -1 || keyIndex(key) < hi); key, _ = c.Next() {
+		stale = append(stale, append([]byte{}, key...))
+	}
+	for _, key := range stale {
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *BoltStore) Close() error {
+	return b.db.Close()
+}
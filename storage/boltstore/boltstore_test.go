@@ -0,0 +1,37 @@
+package boltstore
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/aecra/raft/storage"
+	"github.com/aecra/raft/storage/storagetest"
+)
+
+func open(tb testing.TB, dir string) storage.Storage {
+	b, err := Open(filepath.Join(dir, "raft.db"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return b
+}
+
+func TestBoltStore(t *testing.T) {
+	storagetest.Run(t, open)
+}
+
+func BenchmarkAppend(b *testing.B) {
+	storagetest.Benchmark(b, open)
+}
+
+func TestOpenLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "raft.db")
+	b, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if _, err := Open(path); err == nil {
+		t.Errorf("Expected opening a locked database to fail")
+	}
+}
@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Combined is a Storage made of a LogStore, a StableStore and a
+// SnapshotStore, which may be different backends: a WAL for the log, a small
+// file for the hard state and an object store for the snapshots, for
+// instance.
+type Combined struct {
+	// mu serializes SaveSnapshot, which spans the snapshot and log stores.
+	mu sync.Mutex
+
+	log       LogStore
+	stable    StableStore
+	snapshots SnapshotStore
+}
+
+// Combine returns the Storage made of log, stable and snapshots.
+//
+// SaveSnapshot saves the snapshot before compacting the log. If a crash
+// happens in between, Combine finishes compacting it. It fails if the log was
+// compacted past the saved snapshot, which the snapshot store then lost.
+func Combine(log LogStore, stable StableStore, snapshots SnapshotStore) (*Combined, error) {
+	c := &Combined{log: log, stable: stable, snapshots: snapshots}
+	snap, ok, err := snapshots.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		snap = Snapshot{Index: -1, Term: -1}
+	}
+	first, err := log.FirstIndex()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case first > snap.Index+1:
+		return nil, fmt.Errorf("storage: log compacted up to %d past snapshot %d", first-1, snap.Index)
+	case first <= snap.Index:
+		if err := log.Compact(snap.Index, snap.Term); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *Combined) HardState() (HardState, bool, error) {
+	return c.stable.HardState()
+}
+
+func (c *Combined) SetHardState(st HardState) error {
+	return c.stable.SetHardState(st)
+}
+
+func (c *Combined) FirstIndex() (int, error) {
+	return c.log.FirstIndex()
+}
+
+func (c *Combined) LastIndex() (int, error) {
+	return c.log.LastIndex()
+}
+
+func (c *Combined) Entries(lo, hi int) ([]Entry, error) {
+	return c.log.Entries(lo, hi)
+}
+
+func (c *Combined) Append(entries []Entry) error {
+	return c.log.Append(entries)
+}
+
+func (c *Combined) Snapshot() (Snapshot, bool, error) {
+	return c.snapshots.Snapshot()
+}
+
+func (c *Combined) SaveSnapshot(snap Snapshot) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.snapshots.SaveSnapshot(snap); err != nil {
+		return err
+	}
+	return c.log.Compact(snap.Index, snap.Term)
+}
+
+// PeerAddrs returns the addresses saved in the stable store, or none if it
+// isn't an AddressBook.
+func (c *Combined) PeerAddrs() (map[string]string, error) {
+	if book, ok := c.stable.(AddressBook); ok {
+		return book.PeerAddrs()
+	}
+	return map[string]string{}, nil
+}
+
+// SetPeerAddrs saves addrs in the stable store if it's an AddressBook, and
+// does nothing otherwise.
+func (c *Combined) SetPeerAddrs(addrs map[string]string) error {
+	if book, ok := c.stable.(AddressBook); ok {
+		return book.SetPeerAddrs(addrs)
+	}
+	return nil
+}
+
+// Close closes each of the stores that is an io.Closer, once even if it
+// plays several parts, and returns the first error.
+func (c *Combined) Close() error {
+	var closed []io.Closer
+	var firstErr error
+	for _, store := range []interface{}{c.log, c.stable, c.snapshots} {
+		if l, ok := store.(storageLog); ok {
+			store = l.Storage
+		}
+		closer, ok := store.(io.Closer)
+		if !ok || containsCloser(closed, closer) {
+			continue
+		}
+		closed = append(closed, closer)
+		if err := closer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func containsCloser(closers []io.Closer, c io.Closer) bool {
+	for _, other := range closers {
+		if other == c {
+			return true
+		}
+	}
+	return false
+}
+
+// AsLogStore returns the log of s as a LogStore, so that any Storage can
+// keep the log of a Combined. Compact saves a snapshot without data in s.
+func AsLogStore(s Storage) LogStore {
+	return storageLog{s}
+}
+
+type storageLog struct {
+	Storage
+}
+
+func (l storageLog) Compact(index, term int) error {
+	return l.SaveSnapshot(Snapshot{Index: index, Term: term})
+}
@@ -0,0 +1,293 @@
+// Package encrypted wraps a storage.Storage to encrypt the commands of log
+// entries and the snapshots with AES-GCM before they reach the disk. The hard
+// state, indexes, terms, checksums and peer addresses are stored in
+// plaintext.
+//
+// Data is sealed with the current key of a Keyring and records the ID of the
+// key, so keys can be rotated: Rotate adds a key and seals new data with it,
+// while the data sealed with older keys stays readable as long as their keys
+// are in the keyring. An older key can be dropped once the entries and the
+// snapshot sealed with it were compacted, which KeysInUse reports.
+package encrypted
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/aecra/raft/storage"
+)
+
+// Keyring holds the AES keys of a Storage, of 16, 24 or 32 bytes, by ID.
+type Keyring struct {
+	// Current is the ID of the key new data is sealed with.
+	Current uint32
+	Keys    map[uint32][]byte
+}
+
+// ErrUnknownKey is returned when data was sealed with a key that isn't in the
+// keyring.
+var ErrUnknownKey = errors.New("encrypted: data sealed with an unknown key")
+
+// Storage is a storage.Storage encrypting the data of another one.
+type Storage struct {
+	inner storage.Storage
+
+	mu      sync.Mutex
+	current uint32
+	aeads   map[uint32]cipher.AEAD
+}
+
+// New returns a Storage encrypting the data it saves to inner with the keys
+// of keyring. inner must not be used directly afterwards.
+func New(inner storage.Storage, keyring Keyring) (*Storage, error) {
+	s := &Storage{inner: inner, aeads: make(map[uint32]cipher.AEAD)}
+	for id, key := range keyring.Keys {
+		if err := s.addKey(id, key); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := s.aeads[keyring.Current]; !ok {
+		return nil, fmt.Errorf("encrypted: current key %d isn't in the keyring", keyring.Current)
+	}
+	s.current = keyring.Current
+	return s, nil
+}
+
+// Rotate adds key to the keyring as id and seals the data saved from now on
+// with it.
+func (s *Storage) Rotate(id uint32, key []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.aeads[id]; ok {
+		return fmt.Errorf("encrypted: key %d is already in the keyring", id)
+	}
+	if err := s.addKey(id, key); err != nil {
+		return err
+	}
+	s.current = id
+	return nil
+}
+
+// KeysInUse returns the IDs of the keys that the stored entries and snapshot
+// are sealed with.
+func (s *Storage) KeysInUse() (map[uint32]bool, error) {
+	inUse := make(map[uint32]bool)
+	snap, ok, err := s.inner.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		inUse[keyID(snap.Data)] = true
+	}
+	first, err := s.inner.FirstIndex()
+	if err != nil {
+		return nil, err
+	}
+	last, err := s.inner.LastIndex()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := s.inner.Entries(first, last+1)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if sealed, ok := e.Command.([]byte); ok {
+			inUse[keyID(sealed)] = true
+		}
+	}
+	return inUse, nil
+}
+
+// addKey expects s.mu to be locked, or s not to be shared yet.
+func (s *Storage) addKey(id uint32, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("encrypted: key %d: %v", id, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	s.aeads[id] = aead
+	return nil
+}
+
+// seal encrypts plaintext with the current key. The result is the ID of the
+// key, the nonce and the ciphertext. ad binds it to the index and term it's
+// stored at, so that sealed data can't be moved around.
+func (s *Storage) seal(plaintext, ad []byte) ([]byte, error) {
+	s.mu.Lock()
+	id, aead := s.current, s.aeads[s.current]
+	s.mu.Unlock()
+	sealed := make([]byte, 4+aead.NonceSize(), 4+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	binary.BigEndian.PutUint32(sealed, id)
+	if _, err := rand.Read(sealed[4:]); err != nil {
+		return nil, err
+	}
+	return aead.Seal(sealed, sealed[4:], plaintext, ad), nil
+}
+
+func (s *Storage) open(sealed, ad []byte) ([]byte, error) {
+	if len(sealed) < 4 {
+		return nil, errors.New("encrypted: sealed data too short")
+	}
+	s.mu.Lock()
+	aead, ok := s.aeads[keyID(sealed)]
+	s.mu.Unlock()
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if len(sealed) < 4+aead.NonceSize() {
+		return nil, errors.New("encrypted: sealed data too short")
+	}
+	nonce, ciphertext := sealed[4:4+aead.NonceSize()], sealed[4+aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, ad)
+}
+
+func keyID(sealed []byte) uint32 {
+	if len(sealed) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(sealed)
+}
+
+// additionalData returns the additional data sealing a record of kind
+// ("entry" or "snapshot") at index and term.
+func additionalData(kind string, index, term int) []byte {
+	ad := make([]byte, len(kind)+16)
+	copy(ad, kind)
+	binary.BigEndian.PutUint64(ad[len(kind):], uint64(index))
+	binary.BigEndian.PutUint64(ad[len(kind)+8:], uint64(term))
+	return ad
+}
+
+// commandWrapper lets gob encode the dynamic type of a command.
+type commandWrapper struct {
+	Command interface{}
+}
+
+func (s *Storage) HardState() (storage.HardState, bool, error) {
+	return s.inner.HardState()
+}
+
+func (s *Storage) SetHardState(st storage.HardState) error {
+	return s.inner.SetHardState(st)
+}
+
+func (s *Storage) FirstIndex() (int, error) {
+	return s.inner.FirstIndex()
+}
+
+func (s *Storage) LastIndex() (int, error) {
+	return s.inner.LastIndex()
+}
+
+func (s *Storage) Entries(lo, hi int) ([]storage.Entry, error) {
+	entries, err := s.inner.Entries(lo, hi)
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range entries {
+		sealed, ok := e.Command.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("encrypted: entry %d isn't encrypted", e.Index)
+		}
+		plaintext, err := s.open(sealed, additionalData("entry", e.Index, e.Term))
+		if err != nil {
+			return nil, fmt.Errorf("decrypting entry %d: %w", e.Index, err)
+		}
+		var command commandWrapper
+		if err := gob.NewDecoder(bytes.NewReader(plaintext)).Decode(&command); err != nil {
+			return nil, fmt.Errorf("decoding entry %d: %v", e.Index, err)
+		}
+		entries[i].Command = command.Command
+	}
+	return entries, nil
+}
+
+func (s *Storage) Append(entries []storage.Entry) error {
+	sealed, err := s.sealEntries(entries)
+	if err != nil {
+		return err
+	}
+	return s.inner.Append(sealed)
+}
+
+// Save saves st and appends entries to the inner storage with storage.Save,
+// in a single write if it's a storage.Saver.
+func (s *Storage) Save(st storage.HardState, entries []storage.Entry) error {
+	sealed, err := s.sealEntries(entries)
+	if err != nil {
+		return err
+	}
+	return storage.Save(s.inner, st, sealed)
+}
+
+// sealEntries returns entries with their commands encrypted.
+func (s *Storage) sealEntries(entries []storage.Entry) ([]storage.Entry, error) {
+	sealedEntries := make([]storage.Entry, len(entries))
+	for i, e := range entries {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(commandWrapper{e.Command}); err != nil {
+			return nil, err
+		}
+		sealed, err := s.seal(buf.Bytes(), additionalData("entry", e.Index, e.Term))
+		if err != nil {
+			return nil, err
+		}
+		e.Command = sealed
+		sealedEntries[i] = e
+	}
+	return sealedEntries, nil
+}
+
+func (s *Storage) Snapshot() (storage.Snapshot, bool, error) {
+	snap, ok, err := s.inner.Snapshot()
+	if err != nil || !ok {
+		return snap, ok, err
+	}
+	snap.Data, err = s.open(snap.Data, additionalData("snapshot", snap.Index, snap.Term))
+	if err != nil {
+		return storage.Snapshot{}, false, fmt.Errorf("decrypting snapshot: %w", err)
+	}
+	return snap, true, nil
+}
+
+func (s *Storage) SaveSnapshot(snap storage.Snapshot) error {
+	sealed, err := s.seal(snap.Data, additionalData("snapshot", snap.Index, snap.Term))
+	if err != nil {
+		return err
+	}
+	snap.Data = sealed
+	return s.inner.SaveSnapshot(snap)
+}
+
+// PeerAddrs returns the addresses saved by the inner storage, or none if it
+// isn't a storage.AddressBook.
+func (s *Storage) PeerAddrs() (map[string]string, error) {
+	if book, ok := s.inner.(storage.AddressBook); ok {
+		return book.PeerAddrs()
+	}
+	return map[string]string{}, nil
+}
+
+// SetPeerAddrs saves addrs to the inner storage if it's a
+// storage.AddressBook, and does nothing otherwise.
+func (s *Storage) SetPeerAddrs(addrs map[string]string) error {
+	if book, ok := s.inner.(storage.AddressBook); ok {
+		return book.SetPeerAddrs(addrs)
+	}
+	return nil
+}
+
+func (s *Storage) Close() error {
+	return s.inner.Close()
+}
@@ -0,0 +1,129 @@
+package encrypted
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aecra/raft/storage"
+	"github.com/aecra/raft/storage/storagetest"
+	"github.com/aecra/raft/storage/wal"
+)
+
+var (
+	key1 = bytes.Repeat([]byte{1}, 32)
+	key2 = bytes.Repeat([]byte{2}, 32)
+)
+
+func openWAL(tb testing.TB, dir string, keyring Keyring) *Storage {
+	w, err := wal.Open(dir, wal.Options{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s, err := New(w, keyring)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return s
+}
+
+func TestEncrypted(t *testing.T) {
+	storagetest.Run(t, func(tb testing.TB, dir string) storage.Storage {
+		return openWAL(tb, dir, Keyring{Current: 1, Keys: map[uint32][]byte{1: key1}})
+	})
+}
+
+func TestNoPlaintext(t *testing.T) {
+	dir := t.TempDir()
+	s := openWAL(t, dir, Keyring{Current: 1, Keys: map[uint32][]byte{1: key1}})
+	secret := "very secret command"
+	if err := s.Append([]storage.Entry{{Index: 0, Term: 1, Command: secret}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveSnapshot(storage.Snapshot{Index: 0, Term: 1, Data: []byte(secret)}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte(secret)) {
+			t.Errorf("%s holds the plaintext", file)
+		}
+	}
+
+	s = openWAL(t, dir, Keyring{Current: 1, Keys: map[uint32][]byte{1: key1}})
+	defer s.Close()
+	snap, ok, err := s.Snapshot()
+	if err != nil || !ok || string(snap.Data) != secret {
+		t.Errorf("Expected snapshot %q, got %q (ok=%v, err=%v)", secret, snap.Data, ok, err)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	dir := t.TempDir()
+	s := openWAL(t, dir, Keyring{Current: 1, Keys: map[uint32][]byte{1: key1}})
+	if err := s.Append(storagetest.MakeEntries(0, 5, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Rotate(2, key2); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Rotate(2, key2); err == nil {
+		t.Error("Rotate accepted an existing key ID")
+	}
+	if err := s.Append(storagetest.MakeEntries(5, 10, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if inUse, err := s.KeysInUse(); err != nil || !inUse[1] || !inUse[2] {
+		t.Errorf("Expected keys 1 and 2 in use, got %v (err=%v)", inUse, err)
+	}
+	s.Close()
+
+	// Both keys are needed until the entries sealed with key 1 are compacted.
+	s = openWAL(t, dir, Keyring{Current: 2, Keys: map[uint32][]byte{1: key1, 2: key2}})
+	storagetest.CheckEntries(t, s, storagetest.MakeEntries(0, 10, 1))
+	if err := s.SaveSnapshot(storage.Snapshot{Index: 4, Term: 1, Data: []byte("state")}); err != nil {
+		t.Fatal(err)
+	}
+	if inUse, err := s.KeysInUse(); err != nil || inUse[1] || !inUse[2] {
+		t.Errorf("Expected only key 2 in use, got %v (err=%v)", inUse, err)
+	}
+	s.Close()
+
+	s = openWAL(t, dir, Keyring{Current: 2, Keys: map[uint32][]byte{2: key2}})
+	defer s.Close()
+	if _, err := s.Entries(5, 10); err != nil {
+		t.Errorf("Reading the entries sealed with key 2 failed: %v", err)
+	}
+	if _, _, err := s.Snapshot(); err != nil {
+		t.Errorf("Reading the snapshot failed: %v", err)
+	}
+}
+
+func TestUnknownKey(t *testing.T) {
+	dir := t.TempDir()
+	s := openWAL(t, dir, Keyring{Current: 1, Keys: map[uint32][]byte{1: key1}})
+	if err := s.Append(storagetest.MakeEntries(0, 3, 1)); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s = openWAL(t, dir, Keyring{Current: 2, Keys: map[uint32][]byte{2: key2}})
+	defer s.Close()
+	if _, err := s.Entries(0, 3); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Expected ErrUnknownKey, got %v", err)
+	}
+	if _, err := New(storage.NewMemoryStorage(), Keyring{Current: 3, Keys: map[uint32][]byte{2: key2}}); err == nil {
+		t.Error("New accepted a keyring without its current key")
+	}
+}
@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStableStore is a StableStore and AddressBook kept in a single small
+// file, rewritten atomically on every change.
+type FileStableStore struct {
+	mu    sync.Mutex
+	path  string
+	state fileState
+}
+
+// fileState is the content of the file of a FileStableStore.
+type fileState struct {
+	HardState *HardState        `json:",omitempty"`
+	PeerAddrs map[string]string `json:",omitempty"`
+}
+
+// OpenFileStableStore opens the stable store kept in the file at path,
+// creating its directory if needed. The file is only created by the first
+// change.
+func OpenFileStableStore(path string) (*FileStableStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, err
+	}
+	s := &FileStableStore{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.state); err != nil {
+		return nil, fmt.Errorf("storage: %s: %v", path, err)
+	}
+	return s, nil
+}
+
+func (s *FileStableStore) HardState() (HardState, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state.HardState == nil {
+		return HardState{}, false, nil
+	}
+	return *s.state.HardState, true, nil
+}
+
+func (s *FileStableStore) SetHardState(st HardState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.state
+	state.HardState = &st
+	return s.save(state)
+}
+
+func (s *FileStableStore) PeerAddrs() (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copyAddrs(s.state.PeerAddrs), nil
+}
+
+func (s *FileStableStore) SetPeerAddrs(addrs map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.state
+	state.PeerAddrs = copyAddrs(addrs)
+	return s.save(state)
+}
+
+// save writes state to the file and makes it the current state once it's
+// durable.
+// Expects s.mu to be locked.
+func (s *FileStableStore) save(state fileState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, data); err != nil {
+		return err
+	}
+	s.state = state
+	return nil
+}
+
+// FileSnapshotStore is a SnapshotStore keeping the last snapshot in a single
+// file, replaced atomically by SaveSnapshot. The file holds the index, term
+// and a CRC-32C checksum of the data, followed by the data.
+type FileSnapshotStore struct {
+	mu   sync.Mutex
+	path string
+
+	// index is the index of the saved snapshot, or -1 if there's none.
+	index int
+}
+
+const snapshotHeaderSize = 20
+
+var snapshotCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// OpenFileSnapshotStore opens the snapshot store kept in the file at path,
+// creating its directory if needed.
+func OpenFileSnapshotStore(path string) (*FileSnapshotStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, err
+	}
+	s := &FileSnapshotStore{path: path, index: -1}
+	snap, ok, err := s.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		s.index = snap.Index
+	}
+	return s, nil
+}
+
+// Snapshot reads the saved snapshot from the file.
+func (s *FileSnapshotStore) Snapshot() (Snapshot, bool, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Snapshot{}, false, nil
+	}
+	if err != nil {
+		return Snapshot{}, false, err
+	}
+	if len(data) < snapshotHeaderSize || crc32.Checksum(data[snapshotHeaderSize:], snapshotCRCTable) != binary.LittleEndian.Uint32(data[16:]) {
+		return Snapshot{}, false, fmt.Errorf("storage: %s: corrupt snapshot", s.path)
+	}
+	return Snapshot{
+		Index: int(int64(binary.LittleEndian.Uint64(data[0:]))),
+		Term:  int(int64(binary.LittleEndian.Uint64(data[8:]))),
+		Data:  data[snapshotHeaderSize:],
+	}, true, nil
+}
+
+func (s *FileSnapshotStore) SaveSnapshot(snap Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if snap.Index < s.index {
+		return ErrSnapshotOutOfDate
+	}
+	data := make([]byte, snapshotHeaderSize, snapshotHeaderSize+len(snap.Data))
+	binary.LittleEndian.PutUint64(data[0:], uint64(snap.Index))
+	binary.LittleEndian.PutUint64(data[8:], uint64(snap.Term))
+	binary.LittleEndian.PutUint32(data[16:], crc32.Checksum(snap.Data, snapshotCRCTable))
+	data = append(data, snap.Data...)
+	if err := writeFileAtomic(s.path, data); err != nil {
+		return err
+	}
+	s.index = snap.Index
+	return nil
+}
+
+// writeFileAtomic replaces the file at path with data, so that a crash leaves
+// either the old or the new content.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	d, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
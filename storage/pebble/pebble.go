@@ -0,0 +1,354 @@
+// Package pebble implements storage.Storage on top of Pebble, for logs with
+// high append rates that grow large. Pebble's LSM tree turns appends into
+// sequential writes and keeps lookups cheap as the log grows, where bbolt's
+// B+tree rewrites pages on every commit.
+//
+// Log entries are stored under "l" followed by their big-endian index, the
+// hard state under "h" (under "s" when votes were ints, which is still read),
+// the snapshot under "snapshot" and the peer addresses under "peers". Appends
+// are written as a single synced batch, and the entries they overwrite are
+// dropped with a range deletion, as are the entries a snapshot covers.
+// Commands are encoded with gob, so their concrete types must be registered
+// with gob.Register.
+package pebble
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/aecra/raft/storage"
+	"github.com/cockroachdb/pebble"
+)
+
+var (
+	logPrefix = []byte("l")
+	// logEnd is the first key past the log entries.
+	logEnd       = []byte("m")
+	hardStateKey = []byte("h")
+	// legacyHardStateKey holds the hard state saved when votes were ints.
+	legacyHardStateKey = []byte("s")
+	snapshotKey        = []byte("snapshot")
+	peersKey           = []byte("peers")
+)
+
+// PebbleStore is a storage.Storage backed by a Pebble database.
+type PebbleStore struct {
+	// mu serializes appends and snapshots, which read the log before
+	// writing.
+	mu sync.Mutex
+	db *pebble.DB
+}
+
+// storedEntry is the value stored for each log entry.
+type storedEntry struct {
+	Term     int
+	Command  interface{}
+	Checksum uint32
+}
+
+// Open opens the Pebble database in dir, creating it if needed.
+func Open(dir string) (*PebbleStore, error) {
+	db, err := pebble.Open(dir, &pebble.Options{})
+	if err != nil {
+		return nil, err
+	}
+	return &PebbleStore{db: db}, nil
+}
+
+func indexKey(index int) []byte {
+	key := make([]byte, len(logPrefix)+8)
+	copy(key, logPrefix)
+	binary.BigEndian.PutUint64(key[len(logPrefix):], uint64(index))
+	return key
+}
+
+func keyIndex(key []byte) int {
+	return int(binary.BigEndian.Uint64(key[len(logPrefix):]))
+}
+
+func (p *PebbleStore) HardState() (storage.HardState, bool, error) {
+	value, closer, err := p.db.Get(hardStateKey)
+	if err == pebble.ErrNotFound {
+		return p.legacyHardState()
+	}
+	if err != nil {
+		return storage.HardState{}, false, err
+	}
+	defer closer.Close()
+	if len(value) < 8 {
+		return storage.HardState{}, false, fmt.Errorf("pebble: bad hard state")
+	}
+	return storage.HardState{
+		CurrentTerm: int(int64(binary.BigEndian.Uint64(value[0:]))),
+		VotedFor:    string(value[8:]),
+	}, true, nil
+}
+
+// legacyHardState reads the hard state saved when votes were ints.
+func (p *PebbleStore) legacyHardState() (storage.HardState, bool, error) {
+	value, closer, err := p.db.Get(legacyHardStateKey)
+	if err == pebble.ErrNotFound {
+		return storage.HardState{}, false, nil
+	}
+	if err != nil {
+		return storage.HardState{}, false, err
+	}
+	defer closer.Close()
+	if len(value) != 16 {
+		return storage.HardState{}, false, fmt.Errorf("pebble: bad hard state")
+	}
+	return storage.HardState{
+		CurrentTerm: int(int64(binary.BigEndian.Uint64(value[0:]))),
+		VotedFor:    storage.LegacyVotedFor(int(int64(binary.BigEndian.Uint64(value[8:])))),
+	}, true, nil
+}
+
+func (p *PebbleStore) SetHardState(st storage.HardState) error {
+	return p.db.Set(hardStateKey, encodeHardState(st), pebble.Sync)
+}
+
+// encodeHardState encodes st as it's saved under hardStateKey.
+func encodeHardState(st storage.HardState) []byte {
+	value := make([]byte, 8, 8+len(st.VotedFor))
+	binary.BigEndian.PutUint64(value[0:], uint64(st.CurrentTerm))
+	return append(value, st.VotedFor...)
+}
+
+func (p *PebbleStore) PeerAddrs() (map[string]string, error) {
+	addrs := make(map[string]string)
+	value, closer, err := p.db.Get(peersKey)
+	if err == pebble.ErrNotFound {
+		return addrs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	if err := gob.NewDecoder(bytes.NewReader(value)).Decode(&addrs); err != nil {
+		return nil, fmt.Errorf("pebble: bad peer addresses: %v", err)
+	}
+	return addrs, nil
+}
+
+func (p *PebbleStore) SetPeerAddrs(addrs map[string]string) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(addrs); err != nil {
+		return err
+	}
+	return p.db.Set(peersKey, buf.Bytes(), pebble.Sync)
+}
+
+// reader is implemented by both *pebble.DB and *pebble.Snapshot.
+type reader interface {
+	Get(key []byte) ([]byte, io.Closer, error)
+	NewIter(o *pebble.IterOptions) *pebble.Iterator
+}
+
+// snapshot decodes the snapshot saved in r. Its index and term are -1 if
+// there's none.
+func snapshot(r reader) (storage.Snapshot, bool, error) {
+	value, closer, err := r.Get(snapshotKey)
+	if err == pebble.ErrNotFound {
+		return storage.Snapshot{Index: -1, Term: -1}, false, nil
+	}
+	if err != nil {
+		return storage.Snapshot{}, false, err
+	}
+	defer closer.Close()
+	if len(value) < 16 {
+		return storage.Snapshot{}, false, fmt.Errorf("pebble: bad snapshot")
+	}
+	return storage.Snapshot{
+		Index: int(int64(binary.BigEndian.Uint64(value[0:]))),
+		Term:  int(int64(binary.BigEndian.Uint64(value[8:]))),
+		Data:  append([]byte{}, value[16:]...),
+	}, true, nil
+}
+
+// lastIndex returns the index of the last entry in r, or of the snapshot if
+// no entry follows it.
+func lastIndex(r reader) (int, error) {
+	iter := r.NewIter(&pebble.IterOptions{LowerBound: logPrefix, UpperBound: logEnd})
+	last := -1
+	if iter.Last() {
+		last = keyIndex(iter.Key())
+	}
+	if err := iter.Close(); err != nil {
+		return -1, err
+	}
+	if last != -1 {
+		return last, nil
+	}
+	snap, _, err := snapshot(r)
+	return snap.Index, err
+}
+
+func (p *PebbleStore) FirstIndex() (int, error) {
+	snap, _, err := snapshot(p.db)
+	return snap.Index + 1, err
+}
+
+func (p *PebbleStore) LastIndex() (int, error) {
+	view := p.db.NewSnapshot()
+	defer view.Close()
+	return lastIndex(view)
+}
+
+func (p *PebbleStore) Entries(lo, hi int) ([]storage.Entry, error) {
+	if lo < 0 || lo > hi {
+		return nil, storage.ErrOutOfRange
+	}
+	// Read from a consistent view, in case a snapshot is being saved.
+	view := p.db.NewSnapshot()
+	defer view.Close()
+	snap, _, err := snapshot(view)
+	if err != nil {
+		return nil, err
+	}
+	if lo <= snap.Index {
+		return nil, storage.ErrCompacted
+	}
+	iter := view.NewIter(&pebble.IterOptions{LowerBound: indexKey(lo), UpperBound: indexKey(hi)})
+	defer iter.Close()
+	entries := make([]storage.Entry, 0, hi-lo)
+	for iter.First(); iter.Valid(); iter.Next() {
+		var stored storedEntry
+		if err := gob.NewDecoder(bytes.NewReader(iter.Value())).Decode(&stored); err != nil {
+			return nil, fmt.Errorf("decoding entry %d: %v", keyIndex(iter.Key()), err)
+		}
+		entries = append(entries, storage.Entry{Index: keyIndex(iter.Key()), Term: stored.Term, Command: stored.Command, Checksum: stored.Checksum})
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	if len(entries) != hi-lo {
+		return nil, storage.ErrOutOfRange
+	}
+	return entries, nil
+}
+
+func (p *PebbleStore) Append(entries []storage.Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	batch := p.db.NewBatch()
+	defer batch.Close()
+	if err := p.appendEntries(batch, entries); err != nil {
+		return err
+	}
+	return batch.Commit(pebble.Sync)
+}
+
+// Save saves st and appends entries in a single batch.
+func (p *PebbleStore) Save(st storage.HardState, entries []storage.Entry) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	batch := p.db.NewBatch()
+	defer batch.Close()
+	if err := p.appendEntries(batch, entries); err != nil {
+		return err
+	}
+	if err := batch.Set(hardStateKey, encodeHardState(st), nil); err != nil {
+		return err
+	}
+	return batch.Commit(pebble.Sync)
+}
+
+// appendEntries adds to batch the writes appending entries, overwriting the
+// ones from the index of the first on.
+// Expects p.mu to be locked.
+func (p *PebbleStore) appendEntries(batch *pebble.Batch, entries []storage.Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	snap, _, err := snapshot(p.db)
+	if err != nil {
+		return err
+	}
+	first := entries[0].Index
+	if first <= snap.Index {
+		return storage.ErrCompacted
+	}
+	last, err := lastIndex(p.db)
+	if err != nil {
+		return err
+	}
+	if first > last+1 {
+		return storage.ErrOutOfRange
+	}
+	// Discard the entries that are being overwritten.
+	if first <= last {
+		if err := batch.DeleteRange(indexKey(first), logEnd, nil); err != nil {
+			return err
+		}
+	}
+	for _, e := range entries {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(storedEntry{Term: e.Term, Command: e.Command, Checksum: e.Checksum}); err != nil {
+			return err
+		}
+		if err := batch.Set(indexKey(e.Index), buf.Bytes(), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *PebbleStore) Snapshot() (storage.Snapshot, bool, error) {
+	return snapshot(p.db)
+}
+
+func (p *PebbleStore) SaveSnapshot(snap storage.Snapshot) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	saved, _, err := snapshot(p.db)
+	if err != nil {
+		return err
+	}
+	if snap.Index < saved.Index {
+		return storage.ErrSnapshotOutOfDate
+	}
+	keep := snap.Index == saved.Index && snap.Term == saved.Term
+	value, closer, err := p.db.Get(indexKey(snap.Index))
+	switch err {
+	case nil:
+		var stored storedEntry
+		err := gob.NewDecoder(bytes.NewReader(value)).Decode(&stored)
+		closer.Close()
+		if err != nil {
+			return fmt.Errorf("decoding entry %d: %v", snap.Index, err)
+		}
+		keep = stored.Term == snap.Term
+	case pebble.ErrNotFound:
+	default:
+		return err
+	}
+
+	batch := p.db.NewBatch()
+	defer batch.Close()
+	end := indexKey(snap.Index + 1)
+	if !keep {
+		end = logEnd
+	}
+	if err := batch.DeleteRange(logPrefix, end, nil); err != nil {
+		return err
+	}
+	value = make([]byte, 16, 16+len(snap.Data))
+	binary.BigEndian.PutUint64(value[0:], uint64(snap.Index))
+	binary.BigEndian.PutUint64(value[8:], uint64(snap.Term))
+	value = append(value, snap.Data...)
+	if err := batch.Set(snapshotKey, value, nil); err != nil {
+		return err
+	}
+	return batch.Commit(pebble.Sync)
+}
+
+func (p *PebbleStore) Close() error {
+	return p.db.Close()
+}
@@ -0,0 +1,24 @@
+package pebble
+
+import (
+	"testing"
+
+	"github.com/aecra/raft/storage"
+	"github.com/aecra/raft/storage/storagetest"
+)
+
+func open(tb testing.TB, dir string) storage.Storage {
+	p, err := Open(dir)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return p
+}
+
+func TestPebbleStore(t *testing.T) {
+	storagetest.Run(t, open)
+}
+
+func BenchmarkAppend(b *testing.B) {
+	storagetest.Benchmark(b, open)
+}
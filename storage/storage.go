@@ -0,0 +1,331 @@
+// Package storage defines the interface Raft uses to persist its state, along
+// with an in-memory implementation. A Storage can also be combined from a
+// separate log, hard state and snapshot store, for which the package provides
+// small file-based implementations.
+package storage
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+)
+
+// Entry is a log entry as seen by a Storage. Persistent backends are
+// responsible for encoding Command; the in-memory one keeps it as is.
+type Entry struct {
+	Index   int
+	Term    int
+	Command interface{}
+
+	// Checksum is computed by Raft over Term and Command; backends store it
+	// along with them.
+	Checksum uint32
+}
+
+// HardState is the part of the Raft state that must be persisted before
+// responding to RPCs. VotedFor is the ID of the server voted for in
+// CurrentTerm, or "" if none.
+type HardState struct {
+	CurrentTerm int
+	VotedFor    string
+}
+
+// LegacyVotedFor converts the VotedFor of a hard state persisted when server
+// IDs were ints, -1 meaning none, to its current form.
+func LegacyVotedFor(votedFor int) string {
+	if votedFor < 0 {
+		return ""
+	}
+	return strconv.Itoa(votedFor)
+}
+
+// Snapshot is a snapshot of the application state that replaces the log up
+// to and including Index, whose entry has term Term.
+type Snapshot struct {
+	Index int
+	Term  int
+	Data  []byte
+}
+
+// ErrOutOfRange is returned when requested entries are not in the storage.
+var ErrOutOfRange = errors.New("storage: requested entries out of range")
+
+// ErrCompacted is returned when requested entries were discarded in favor of
+// a snapshot.
+var ErrCompacted = errors.New("storage: requested entries compacted")
+
+// ErrSnapshotOutOfDate is returned when saving a snapshot older than the
+// saved one.
+var ErrSnapshotOutOfDate = errors.New("storage: snapshot older than the saved one")
+
+// StableStore persists the hard state.
+type StableStore interface {
+	// HardState returns the last saved hard state. ok is false if nothing has
+	// been saved yet.
+	HardState() (st HardState, ok bool, err error)
+
+	// SetHardState saves the hard state.
+	SetHardState(st HardState) error
+}
+
+// SnapshotStore persists the last snapshot.
+type SnapshotStore interface {
+	// Snapshot returns the last saved snapshot. ok is false if nothing has
+	// been saved yet.
+	Snapshot() (snap Snapshot, ok bool, err error)
+
+	// SaveSnapshot saves snap. It returns ErrSnapshotOutOfDate if snap is
+	// older than the saved snapshot.
+	SaveSnapshot(snap Snapshot) error
+}
+
+// LogStore persists the log entries. Log indexes start at 0.
+type LogStore interface {
+	// FirstIndex returns the index of the first entry that wasn't compacted:
+	// the one following the last compaction point, or 0 if there's none.
+	FirstIndex() (int, error)
+
+	// LastIndex returns the index of the last entry, or FirstIndex()-1 if
+	// the log is empty.
+	LastIndex() (int, error)
+
+	// Entries returns the entries in [lo, hi). It returns ErrCompacted if lo
+	// is before FirstIndex.
+	Entries(lo, hi int) ([]Entry, error)
+
+	// Append appends entries to the log. If the first entry's index is not
+	// past the last index, the existing entries starting from it are
+	// discarded first.
+	Append(entries []Entry) error
+
+	// Compact discards the entries up to index, a snapshot having replaced
+	// them. The entries after it are kept if the entry at index has term
+	// term, and discarded otherwise. FirstIndex is index+1 afterwards. It
+	// returns ErrSnapshotOutOfDate if index is before the last compaction
+	// point.
+	Compact(index, term int) error
+}
+
+// Storage persists the Raft log, hard state and snapshot. Log indexes start
+// at 0. Combine makes one out of a LogStore, a StableStore and a
+// SnapshotStore.
+type Storage interface {
+	StableStore
+
+	// FirstIndex returns the index of the first entry that wasn't compacted:
+	// the one following the snapshot, or 0 if there's no snapshot.
+	FirstIndex() (int, error)
+
+	// LastIndex returns the index of the last entry, or of the snapshot if no
+	// entry follows it, or -1 if both the log and the snapshot are empty.
+	LastIndex() (int, error)
+
+	// Entries returns the entries in [lo, hi). It returns ErrCompacted if lo
+	// is before FirstIndex.
+	Entries(lo, hi int) ([]Entry, error)
+
+	// Append appends entries to the log. If the first entry's index is not
+	// past the last index, the existing entries starting from it are
+	// discarded first.
+	Append(entries []Entry) error
+
+	// SnapshotStore's SaveSnapshot also discards the entries up to
+	// snap.Index. The entries after it are kept if the entry at snap.Index
+	// has term snap.Term, and discarded otherwise.
+	SnapshotStore
+
+	// Close releases the resources held by the storage.
+	Close() error
+}
+
+// AddressBook is implemented by the storages that also persist the addresses
+// of the peers, so that a restarted server can dial them again on its own.
+type AddressBook interface {
+	// PeerAddrs returns the saved addresses by server ID, or an empty map if
+	// nothing has been saved yet.
+	PeerAddrs() (map[string]string, error)
+
+	// SetPeerAddrs replaces the saved addresses with addrs.
+	SetPeerAddrs(addrs map[string]string) error
+}
+
+// Saver is implemented by the storages that can persist a hard state along
+// with log entries in a single write, as a server learning of a new term from
+// the AppendEntries it appends does: a crash during the write never leaves
+// the entries persisted without the hard state.
+type Saver interface {
+	// Save saves st and appends entries, as SetHardState and Append do.
+	// entries may be empty.
+	Save(st HardState, entries []Entry) error
+}
+
+// Save saves st and appends entries to s, in a single write if s is a Saver,
+// and otherwise with SetHardState then Append, so that the entries are only
+// persisted once the hard state is.
+func Save(s Storage, st HardState, entries []Entry) error {
+	if saver, ok := s.(Saver); ok {
+		return saver.Save(st, entries)
+	}
+	if err := s.SetHardState(st); err != nil {
+		return err
+	}
+	return s.Append(entries)
+}
+
+// MemoryStorage is a Storage kept in memory. It's useful for tests and for
+// nodes that don't need to survive restarts.
+type MemoryStorage struct {
+	mu          sync.Mutex
+	hardState   HardState
+	hasState    bool
+	snapshot    Snapshot
+	hasSnapshot bool
+
+	// entries are the entries following the snapshot.
+	entries []Entry
+
+	peerAddrs map[string]string
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{snapshot: Snapshot{Index: -1, Term: -1}}
+}
+
+func (ms *MemoryStorage) HardState() (HardState, bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.hardState, ms.hasState, nil
+}
+
+func (ms *MemoryStorage) SetHardState(st HardState) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.hardState = st
+	ms.hasState = true
+	return nil
+}
+
+func (ms *MemoryStorage) FirstIndex() (int, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.snapshot.Index + 1, nil
+}
+
+func (ms *MemoryStorage) LastIndex() (int, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.snapshot.Index + len(ms.entries), nil
+}
+
+func (ms *MemoryStorage) Entries(lo, hi int) ([]Entry, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	first := ms.snapshot.Index + 1
+	if lo < first && lo <= hi {
+		return nil, ErrCompacted
+	}
+	if lo < 0 || hi > first+len(ms.entries) || lo > hi {
+		return nil, ErrOutOfRange
+	}
+	entries := make([]Entry, hi-lo)
+	copy(entries, ms.entries[lo-first:hi-first])
+	return entries, nil
+}
+
+func (ms *MemoryStorage) Append(entries []Entry) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.append(entries)
+}
+
+func (ms *MemoryStorage) Save(st HardState, entries []Entry) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if err := ms.checkAppend(entries); err != nil {
+		return err
+	}
+	ms.hardState = st
+	ms.hasState = true
+	return ms.append(entries)
+}
+
+// checkAppend returns the error appending entries would fail with.
+// Expects ms.mu to be locked.
+func (ms *MemoryStorage) checkAppend(entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	first := ms.snapshot.Index + 1
+	if entries[0].Index < first {
+		return ErrCompacted
+	}
+	if entries[0].Index > first+len(ms.entries) {
+		return ErrOutOfRange
+	}
+	return nil
+}
+
+// append appends entries, as Append does.
+// Expects ms.mu to be locked.
+func (ms *MemoryStorage) append(entries []Entry) error {
+	if err := ms.checkAppend(entries); err != nil || len(entries) == 0 {
+		return err
+	}
+	first := ms.snapshot.Index + 1
+	ms.entries = append(ms.entries[:entries[0].Index-first], entries...)
+	return nil
+}
+
+func (ms *MemoryStorage) Snapshot() (Snapshot, bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.snapshot, ms.hasSnapshot, nil
+}
+
+func (ms *MemoryStorage) SaveSnapshot(snap Snapshot) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if snap.Index < ms.snapshot.Index {
+		return ErrSnapshotOutOfDate
+	}
+	i := snap.Index - (ms.snapshot.Index + 1)
+	switch {
+	case i < 0:
+		// snap replaces the saved snapshot.
+		if snap.Term != ms.snapshot.Term {
+			ms.entries = nil
+		}
+	case i < len(ms.entries) && ms.entries[i].Term == snap.Term:
+		ms.entries = append([]Entry{}, ms.entries[i+1:]...)
+	default:
+		ms.entries = nil
+	}
+	ms.snapshot = snap
+	ms.hasSnapshot = true
+	return nil
+}
+
+func (ms *MemoryStorage) PeerAddrs() (map[string]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return copyAddrs(ms.peerAddrs), nil
+}
+
+func (ms *MemoryStorage) SetPeerAddrs(addrs map[string]string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.peerAddrs = copyAddrs(addrs)
+	return nil
+}
+
+func copyAddrs(addrs map[string]string) map[string]string {
+	c := make(map[string]string, len(addrs))
+	for id, addr := range addrs {
+		c[id] = addr
+	}
+	return c
+}
+
+func (ms *MemoryStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,80 @@
+package storage_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/aecra/raft/storage"
+	"github.com/aecra/raft/storage/storagetest"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	// A MemoryStorage doesn't outlive its process, so reopening a dir returns
+	// the same instance.
+	stores := make(map[string]*storage.MemoryStorage)
+	storagetest.Run(t, func(tb testing.TB, dir string) storage.Storage {
+		if stores[dir] == nil {
+			stores[dir] = storage.NewMemoryStorage()
+		}
+		return stores[dir]
+	})
+}
+
+func TestCombined(t *testing.T) {
+	// The log is kept in memory, and the hard state and snapshot in files.
+	logs := make(map[string]*storage.MemoryStorage)
+	storagetest.Run(t, func(tb testing.TB, dir string) storage.Storage {
+		if logs[dir] == nil {
+			logs[dir] = storage.NewMemoryStorage()
+		}
+		return combine(tb, logs[dir], dir)
+	})
+}
+
+func combine(tb testing.TB, log *storage.MemoryStorage, dir string) storage.Storage {
+	stable, err := storage.OpenFileStableStore(filepath.Join(dir, "state"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	snapshots, err := storage.OpenFileSnapshotStore(filepath.Join(dir, "snapshot"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s, err := storage.Combine(storage.AsLogStore(log), stable, snapshots)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return s
+}
+
+func TestCombinedRecovery(t *testing.T) {
+	dir := t.TempDir()
+	log := storage.NewMemoryStorage()
+	if err := log.Append(storagetest.MakeEntries(0, 10, 1)); err != nil {
+		t.Fatal(err)
+	}
+	// A crash after the snapshot was saved left the log uncompacted.
+	snapshots, err := storage.OpenFileSnapshotStore(filepath.Join(dir, "snapshot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := snapshots.SaveSnapshot(storage.Snapshot{Index: 4, Term: 1, Data: []byte("state")}); err != nil {
+		t.Fatal(err)
+	}
+	s := combine(t, log, dir)
+	if first, err := s.FirstIndex(); err != nil || first != 5 {
+		t.Errorf("Expected first index 5, got %d (err=%v)", first, err)
+	}
+
+	// A log compacted past the snapshot means the snapshot store lost it.
+	if err := log.SaveSnapshot(storage.Snapshot{Index: 7, Term: 1}); err != nil {
+		t.Fatal(err)
+	}
+	stable, err := storage.OpenFileStableStore(filepath.Join(dir, "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Combine(storage.AsLogStore(log), stable, snapshots); err == nil {
+		t.Errorf("Expected combining a log compacted past the snapshot to fail")
+	}
+}
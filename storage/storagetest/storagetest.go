@@ -0,0 +1,299 @@
+// Package storagetest provides a conformance test suite for implementations
+// of storage.Storage.
+package storagetest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aecra/raft/storage"
+)
+
+// Opener opens the storage kept in dir. Opening the same dir again must
+// return a storage holding what was persisted before it was closed; in-memory
+// implementations may return the same instance.
+type Opener func(tb testing.TB, dir string) storage.Storage
+
+// MakeEntries returns the entries with indexes in [lo, hi) of the given term,
+// each with a distinct int command and checksum.
+func MakeEntries(lo, hi, term int) []storage.Entry {
+	var entries []storage.Entry
+	for i := lo; i < hi; i++ {
+		entries = append(entries, storage.Entry{Index: i, Term: term, Command: i*10 + term, Checksum: uint32(i*100 + term)})
+	}
+	return entries
+}
+
+// CheckEntries checks that s holds exactly the entries in want.
+func CheckEntries(t *testing.T, s storage.Storage, want []storage.Entry) {
+	t.Helper()
+	checkEntries(t, s, 0, want)
+}
+
+// checkEntries checks that s holds exactly the entries in want from index
+// first on.
+func checkEntries(t *testing.T, s storage.Storage, first int, want []storage.Entry) {
+	t.Helper()
+	if got, err := s.FirstIndex(); err != nil || got != first {
+		t.Fatalf("Expected first index %d, got %d (err=%v)", first, got, err)
+	}
+	last, err := s.LastIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last != first+len(want)-1 {
+		t.Fatalf("Expected last index %d, got %d", first+len(want)-1, last)
+	}
+	got, err := s.Entries(first, first+len(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d entries, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i].Index != want[i].Index || got[i].Term != want[i].Term || got[i].Command != want[i].Command || got[i].Checksum != want[i].Checksum {
+			t.Fatalf("Expected entry %+v, got %+v", want[i], got[i])
+		}
+	}
+}
+
+// Run runs the conformance suite against the storages returned by open.
+func Run(t *testing.T, open Opener) {
+	t.Run("Empty", func(t *testing.T) {
+		s := open(t, t.TempDir())
+		defer s.Close()
+		if _, ok, err := s.HardState(); ok || err != nil {
+			t.Errorf("Expected no hard state, got ok=%v err=%v", ok, err)
+		}
+		if _, ok, err := s.Snapshot(); ok || err != nil {
+			t.Errorf("Expected no snapshot, got ok=%v err=%v", ok, err)
+		}
+		CheckEntries(t, s, nil)
+	})
+
+	t.Run("AppendAndReopen", func(t *testing.T) {
+		dir := t.TempDir()
+		s := open(t, dir)
+		entries := MakeEntries(0, 10, 1)
+		if err := s.Append(entries); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SetHardState(storage.HardState{CurrentTerm: 3, VotedFor: "2"}); err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+
+		s = open(t, dir)
+		defer s.Close()
+		CheckEntries(t, s, entries)
+		st, ok, err := s.HardState()
+		if err != nil || !ok || st.CurrentTerm != 3 || st.VotedFor != "2" {
+			t.Errorf("Expected hard state {3 2}, got %+v (ok=%v, err=%v)", st, ok, err)
+		}
+	})
+
+	t.Run("TruncateSuffix", func(t *testing.T) {
+		dir := t.TempDir()
+		s := open(t, dir)
+		if err := s.Append(MakeEntries(0, 10, 1)); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Append(MakeEntries(5, 7, 2)); err != nil {
+			t.Fatal(err)
+		}
+		want := append(MakeEntries(0, 5, 1), MakeEntries(5, 7, 2)...)
+		CheckEntries(t, s, want)
+		s.Close()
+
+		s = open(t, dir)
+		defer s.Close()
+		CheckEntries(t, s, want)
+	})
+
+	t.Run("OutOfRange", func(t *testing.T) {
+		s := open(t, t.TempDir())
+		defer s.Close()
+		if err := s.Append(MakeEntries(0, 3, 1)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Entries(2, 5); err == nil {
+			t.Errorf("Expected reading past the last index to fail")
+		}
+		if err := s.Append(MakeEntries(5, 6, 1)); err == nil {
+			t.Errorf("Expected appending past the end of the log to fail")
+		}
+	})
+
+	t.Run("Snapshot", func(t *testing.T) {
+		dir := t.TempDir()
+		s := open(t, dir)
+		if err := s.Append(MakeEntries(0, 10, 1)); err != nil {
+			t.Fatal(err)
+		}
+		snap := storage.Snapshot{Index: 5, Term: 1, Data: []byte("state")}
+		if err := s.SaveSnapshot(snap); err != nil {
+			t.Fatal(err)
+		}
+		checkEntries(t, s, 6, MakeEntries(6, 10, 1))
+		if _, err := s.Entries(5, 7); !errors.Is(err, storage.ErrCompacted) {
+			t.Errorf("Expected ErrCompacted, got %v", err)
+		}
+		if err := s.Append(MakeEntries(5, 6, 1)); !errors.Is(err, storage.ErrCompacted) {
+			t.Errorf("Expected ErrCompacted, got %v", err)
+		}
+		s.Close()
+
+		s = open(t, dir)
+		defer s.Close()
+		checkEntries(t, s, 6, MakeEntries(6, 10, 1))
+		checkSnapshot(t, s, snap)
+		if err := s.Append(MakeEntries(8, 12, 2)); err != nil {
+			t.Fatal(err)
+		}
+		checkEntries(t, s, 6, append(MakeEntries(6, 8, 1), MakeEntries(8, 12, 2)...))
+		if err := s.SaveSnapshot(storage.Snapshot{Index: 3, Term: 1}); !errors.Is(err, storage.ErrSnapshotOutOfDate) {
+			t.Errorf("Expected ErrSnapshotOutOfDate, got %v", err)
+		}
+	})
+
+	t.Run("SnapshotMismatch", func(t *testing.T) {
+		dir := t.TempDir()
+		s := open(t, dir)
+		if err := s.Append(MakeEntries(0, 10, 1)); err != nil {
+			t.Fatal(err)
+		}
+		// A snapshot from a leader whose log diverges from this one replaces
+		// it entirely.
+		snap := storage.Snapshot{Index: 5, Term: 2, Data: []byte("state")}
+		if err := s.SaveSnapshot(snap); err != nil {
+			t.Fatal(err)
+		}
+		checkEntries(t, s, 6, nil)
+		s.Close()
+
+		s = open(t, dir)
+		defer s.Close()
+		checkEntries(t, s, 6, nil)
+		checkSnapshot(t, s, snap)
+	})
+
+	t.Run("SnapshotPastEnd", func(t *testing.T) {
+		dir := t.TempDir()
+		s := open(t, dir)
+		if err := s.Append(MakeEntries(0, 3, 1)); err != nil {
+			t.Fatal(err)
+		}
+		snap := storage.Snapshot{Index: 7, Term: 2, Data: []byte("state")}
+		if err := s.SaveSnapshot(snap); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Append(MakeEntries(8, 10, 2)); err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+
+		s = open(t, dir)
+		defer s.Close()
+		checkEntries(t, s, 8, MakeEntries(8, 10, 2))
+		checkSnapshot(t, s, snap)
+	})
+
+	t.Run("Save", func(t *testing.T) {
+		dir := t.TempDir()
+		s := open(t, dir)
+		saver, ok := s.(storage.Saver)
+		if !ok {
+			s.Close()
+			t.Skip("not a storage.Saver")
+		}
+		if err := saver.Save(storage.HardState{CurrentTerm: 1, VotedFor: "1"}, MakeEntries(0, 10, 1)); err != nil {
+			t.Fatal(err)
+		}
+		if err := saver.Save(storage.HardState{CurrentTerm: 2, VotedFor: "3"}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := saver.Save(storage.HardState{CurrentTerm: 3}, MakeEntries(5, 8, 3)); err != nil {
+			t.Fatal(err)
+		}
+		if err := saver.Save(storage.HardState{CurrentTerm: 4}, MakeEntries(12, 13, 4)); !errors.Is(err, storage.ErrOutOfRange) {
+			t.Errorf("Expected ErrOutOfRange saving past the end, got %v", err)
+		}
+		s.Close()
+
+		s = open(t, dir)
+		defer s.Close()
+		CheckEntries(t, s, append(MakeEntries(0, 5, 1), MakeEntries(5, 8, 3)...))
+		st, ok, err := s.HardState()
+		if err != nil || !ok || st.CurrentTerm != 3 || st.VotedFor != "" {
+			t.Errorf("Expected hard state {3 }, got %+v (ok=%v, err=%v)", st, ok, err)
+		}
+	})
+
+	t.Run("PeerAddrs", func(t *testing.T) {
+		dir := t.TempDir()
+		s := open(t, dir)
+		book, ok := s.(storage.AddressBook)
+		if !ok {
+			s.Close()
+			t.Skip("not a storage.AddressBook")
+		}
+		if addrs, err := book.PeerAddrs(); err != nil || len(addrs) != 0 {
+			t.Errorf("Expected no addresses, got %v (err=%v)", addrs, err)
+		}
+		if err := book.SetPeerAddrs(map[string]string{"1": "a:1", "2": "b:2"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := book.SetPeerAddrs(map[string]string{"1": "a:1", "3": "c:3"}); err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+
+		s = open(t, dir)
+		defer s.Close()
+		addrs, err := s.(storage.AddressBook).PeerAddrs()
+		if err != nil || len(addrs) != 2 || addrs["1"] != "a:1" || addrs["3"] != "c:3" {
+			t.Errorf("Expected addresses map[1:a:1 3:c:3], got %v (err=%v)", addrs, err)
+		}
+	})
+}
+
+// checkSnapshot checks that want is the snapshot saved in s.
+func checkSnapshot(t *testing.T, s storage.Storage, want storage.Snapshot) {
+	t.Helper()
+	got, ok, err := s.Snapshot()
+	if err != nil || !ok || got.Index != want.Index || got.Term != want.Term || !bytes.Equal(got.Data, want.Data) {
+		t.Errorf("Expected snapshot %+v, got %+v (ok=%v, err=%v)", want, got, ok, err)
+	}
+}
+
+// Benchmark measures appends of single entries and of batches of entries,
+// with commands of several sizes. Running it for each backend gives
+// comparable numbers:
+//
+//	go test -run NONE -bench . ./storage/...
+func Benchmark(b *testing.B, open Opener) {
+	for _, size := range []int{128, 1024, 16 * 1024} {
+		for _, batch := range []int{1, 64} {
+			b.Run(fmt.Sprintf("size=%d/batch=%d", size, batch), func(b *testing.B) {
+				s := open(b, b.TempDir())
+				defer s.Close()
+				command := strings.Repeat("x", size)
+				entries := make([]storage.Entry, batch)
+				b.SetBytes(int64(size * batch))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					for j := range entries {
+						entries[j] = storage.Entry{Index: i*batch + j, Term: 1, Command: command}
+					}
+					if err := s.Append(entries); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
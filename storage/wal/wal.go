@@ -0,0 +1,1115 @@
+// Package wal implements a segmented write-ahead log. It is the default
+// persistent backend for the Raft log, opened by raft.WithDataDir.
+//
+// The log is a sequence of records spread over segment files of bounded
+// size. Each record is framed as:
+//
+//	| length (4 bytes) | crc32 (4 bytes) | type (1 byte) | payload (length bytes) |
+//
+// The checksum covers the type and the payload. Entry records carry the
+// index, term and data of a log entry; appending an entry whose index is not
+// past the end of the log implicitly discards the entries after it. Hard
+// state records carry the hard state, and snapshot records the index and
+// term of the last snapshot, whose data is kept in a separate file. Peers
+// records carry the addresses saved by SetPeerAddrs. The state records
+// written when votes were ints are still replayed. On recovery, an
+// incomplete or corrupt record at the tail of the last segment is treated as
+// a torn write and truncated, which TornWrite reports.
+//
+// Commands are encoded with gob, so their concrete types must be registered
+// with gob.Register. Each record is decoded on its own, so it carries the gob
+// type descriptor of its command: a 50-byte string command takes a 131-byte
+// record, of which 25 bytes are framing, index and term.
+//
+// Every record is kept until its whole segment is superseded: overwritten
+// entries and old hard states stay on disk until then. Whenever a new
+// segment is started, the current hard state, snapshot and peers records are
+// written at its head, and sealed segments holding no live entry are deleted.
+// Saving a snapshot makes the entries it covers dead, so the log only grows
+// between snapshots.
+//
+// The snapshot file is replaced atomically before its record is written. If
+// a crash happens in between, Open finds a snapshot file newer than the last
+// record and finishes saving it.
+//
+// Append and SetHardState fsync before returning unless Options.Sync asks for
+// a weaker policy.
+//
+// With Options.RetainSnapshots, the snapshots replaced by new ones are kept as
+// snapshot-<index> files, the oldest being pruned. Segments are deleted rather
+// than recycled: a reused file would hold stale records past the new ones,
+// which a replay could take for live ones.
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aecra/raft/storage"
+)
+
+// DefaultSegmentSize is the size at which a segment is closed and a new one
+// is started.
+const DefaultSegmentSize = 64 * 1024 * 1024
+
+// DefaultSyncInterval is how often SyncPeriodic fsyncs by default.
+const DefaultSyncInterval = 100 * time.Millisecond
+
+const (
+	headerSize    = 9
+	segmentSuffix = ".wal"
+	snapshotFile  = "snapshot"
+
+	entryRecord     byte = 1
+	snapshotRecord  byte = 3
+	peersRecord     byte = 4
+	hardStateRecord byte = 5
+
+	// stateRecord is the hard state record written when votes were ints.
+	// It's only replayed.
+	stateRecord byte = 2
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorrupt is returned when a record in a sealed segment fails validation.
+var ErrCorrupt = errors.New("wal: corrupt segment")
+
+// SyncPolicy says when the WAL fsyncs the records it writes.
+type SyncPolicy int
+
+const (
+	// SyncBatch fsyncs once per call to Append or SetHardState, before it
+	// returns. It's the default.
+	SyncBatch SyncPolicy = iota
+
+	// SyncEveryEntry fsyncs after every record, so that no entry of a batch
+	// is written before the previous one is durable.
+	SyncEveryEntry
+
+	// SyncPeriodic fsyncs every SyncInterval in the background. Append and
+	// SetHardState return before their records are durable, so a crash may
+	// lose the writes of the last interval. A node restarting after such a
+	// crash may have forgotten votes and entries it acknowledged, which Raft's
+	// safety relies on; use it only where throughput matters more.
+	SyncPeriodic
+)
+
+// Options configures a WAL.
+type Options struct {
+	// SegmentSize is the size in bytes after which a new segment is started.
+	// Zero means DefaultSegmentSize.
+	SegmentSize int64
+
+	// Sync is the fsync policy. The zero value is SyncBatch.
+	Sync SyncPolicy
+
+	// SyncInterval is how often SyncPeriodic fsyncs. Zero means
+	// DefaultSyncInterval.
+	SyncInterval time.Duration
+
+	// CompactInterval, if set, moves the maintenance of the directory off
+	// the write path: the dead segments are deleted, and the old snapshots
+	// pruned, by a background goroutine every CompactInterval rather than by
+	// the writes that make them dead.
+	CompactInterval time.Duration
+
+	// RetainSnapshots is the number of replaced snapshots kept besides the
+	// current one, to roll a node back or debug it.
+	RetainSnapshots int
+}
+
+// Stats are the statistics of the maintenance of a WAL.
+type Stats struct {
+	// Segments is the number of segment files.
+	Segments int
+
+	// ReclaimedSegments is the number of dead segments deleted since Open,
+	// and ReclaimedBytes their total size.
+	ReclaimedSegments int
+	ReclaimedBytes    int64
+
+	// RetainedSnapshots is the number of replaced snapshots kept, and
+	// PrunedSnapshots the number of those deleted since Open.
+	RetainedSnapshots int
+	PrunedSnapshots   int
+}
+
+// position locates a record in the log.
+type position struct {
+	segment int
+	offset  int64
+}
+
+// missing marks an entry whose record hasn't been replayed.
+var missing = position{segment: -1}
+
+type segment struct {
+	seq  int
+	file *os.File
+	size int64
+}
+
+// commandWrapper lets gob encode the dynamic type of a command, and holds the
+// checksum of the entry.
+type commandWrapper struct {
+	Command  interface{}
+	Checksum uint32
+}
+
+// WAL is a storage.Storage backed by segment files in a directory.
+type WAL struct {
+	mu sync.Mutex
+
+	dir  string
+	opts Options
+
+	// segments are the segment files in order; the last one is open for
+	// appending.
+	segments []*segment
+
+	// positions[i] is where the entry with index first+i is stored; first
+	// follows the snapshot.
+	positions []position
+	first     int
+
+	hardState storage.HardState
+	hasState  bool
+
+	// snapshot holds the index and term of the saved snapshot. Its data is
+	// only read from the snapshot file.
+	snapshot    storage.Snapshot
+	hasSnapshot bool
+
+	// peerAddrs are the addresses of the last peers record, if any.
+	peerAddrs map[string]string
+
+	// tornWrite is set if Open truncated a torn write.
+	tornWrite bool
+
+	// sealed is set when a segment was sealed since the last reclaim.
+	sealed bool
+
+	// dirty is set when records were written since the last fsync, and
+	// syncErr holds the error of a failed background fsync until the next
+	// write reports it. They're only used by SyncPeriodic.
+	dirty   bool
+	syncErr error
+
+	// compactErr holds the error of a failed background maintenance until
+	// the next write reports it.
+	compactErr error
+
+	stats Stats
+
+	// done is closed by Close to stop the background fsync and maintenance.
+	done chan struct{}
+
+	closed bool
+}
+
+// Open opens the WAL in dir, creating it if needed, and replays it.
+func Open(dir string, opts Options) (*WAL, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = DefaultSyncInterval
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	w := &WAL{dir: dir, opts: opts, snapshot: storage.Snapshot{Index: -1, Term: -1}}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		var seq int
+		if _, err := fmt.Sscanf(filepath.Base(name), "%016x.wal", &seq); err != nil {
+			w.Close()
+			return nil, fmt.Errorf("wal: bad segment name %q", name)
+		}
+		f, err := os.OpenFile(name, os.O_RDWR, 0640)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		seg := &segment{seq: seq, file: f}
+		w.segments = append(w.segments, seg)
+		if err := w.replay(seg, i == len(names)-1); err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+	snap, ok, err := readSnapshotFile(dir)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	if w.hasSnapshot && (!ok || snap.Index < w.snapshot.Index) {
+		w.Close()
+		return nil, fmt.Errorf("%w: snapshot %d is missing", ErrCorrupt, w.snapshot.Index)
+	}
+	if len(w.segments) == 0 {
+		if err := w.cut(); err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+	if ok && (!w.hasSnapshot || snap.Index > w.snapshot.Index) {
+		// A crash interrupted SaveSnapshot after it wrote the snapshot file.
+		if err := w.recordSnapshot(snap); err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+	for i, pos := range w.positions {
+		if pos == missing {
+			w.Close()
+			return nil, fmt.Errorf("%w: entry %d is missing", ErrCorrupt, w.first+i)
+		}
+	}
+	if opts.Sync == SyncPeriodic || opts.CompactInterval > 0 {
+		w.done = make(chan struct{})
+	}
+	if opts.Sync == SyncPeriodic {
+		go w.syncPeriodically()
+	}
+	if opts.CompactInterval > 0 {
+		go w.compactPeriodically()
+	}
+	return w, nil
+}
+
+// replay reads every record of seg. If last is set, a bad record is treated as
+// a torn write and the segment is truncated before it.
+func (w *WAL) replay(seg *segment, last bool) error {
+	info, err := seg.file.Stat()
+	if err != nil {
+		return err
+	}
+	var offset int64
+	for {
+		typ, payload, n, err := readRecord(seg.file, offset, info.Size())
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if !last {
+				return fmt.Errorf("%w: %s at offset %d: %v", ErrCorrupt, seg.file.Name(), offset, err)
+			}
+			w.tornWrite = true
+			if err := seg.file.Truncate(offset); err != nil {
+				return err
+			}
+			if err := seg.file.Sync(); err != nil {
+				return err
+			}
+			break
+		}
+		if err := w.apply(typ, payload, position{seg.seq, offset}); err != nil {
+			return err
+		}
+		offset += n
+	}
+	seg.size = offset
+	return nil
+}
+
+// apply updates the in-memory index with a replayed record.
+func (w *WAL) apply(typ byte, payload []byte, pos position) error {
+	switch typ {
+	case entryRecord:
+		e, err := decodeEntryHeader(payload)
+		if err != nil {
+			return err
+		}
+		if e.Index < w.first {
+			// Compacted by a snapshot.
+			return nil
+		}
+		// The entries before this one may have been in a reclaimed segment.
+		// This record is then dead too, and a later one truncates the gap or
+		// a snapshot covers it; Open fails if neither does.
+		for len(w.positions) < e.Index-w.first {
+			w.positions = append(w.positions, missing)
+		}
+		w.positions = append(w.positions[:e.Index-w.first], pos)
+	case stateRecord:
+		if len(payload) != 16 {
+			return fmt.Errorf("%w: bad state record", ErrCorrupt)
+		}
+		w.hardState = storage.HardState{
+			CurrentTerm: int(int64(binary.LittleEndian.Uint64(payload[0:]))),
+			VotedFor:    storage.LegacyVotedFor(int(int64(binary.LittleEndian.Uint64(payload[8:])))),
+		}
+		w.hasState = true
+	case hardStateRecord:
+		if len(payload) < 8 {
+			return fmt.Errorf("%w: bad hard state record", ErrCorrupt)
+		}
+		w.hardState = storage.HardState{
+			CurrentTerm: int(int64(binary.LittleEndian.Uint64(payload[0:]))),
+			VotedFor:    string(payload[8:]),
+		}
+		w.hasState = true
+	case snapshotRecord:
+		if len(payload) != 17 {
+			return fmt.Errorf("%w: bad snapshot record", ErrCorrupt)
+		}
+		w.compact(storage.Snapshot{
+			Index: int(int64(binary.LittleEndian.Uint64(payload[0:]))),
+			Term:  int(int64(binary.LittleEndian.Uint64(payload[8:]))),
+		}, payload[16] == 1)
+	case peersRecord:
+		var addrs map[string]string
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&addrs); err != nil {
+			return fmt.Errorf("%w: bad peers record: %v", ErrCorrupt, err)
+		}
+		w.peerAddrs = addrs
+	default:
+		return fmt.Errorf("%w: unknown record type %d", ErrCorrupt, typ)
+	}
+	return nil
+}
+
+// readRecord reads the record at offset of a file of the given size,
+// returning its type, payload and total framed size. It returns io.EOF if
+// offset is at the end of the file.
+func readRecord(f *os.File, offset int64, size int64) (byte, []byte, int64, error) {
+	var header [headerSize]byte
+	n, err := f.ReadAt(header[:], offset)
+	if n == 0 && err == io.EOF {
+		return 0, nil, 0, io.EOF
+	}
+	if n < headerSize {
+		return 0, nil, 0, fmt.Errorf("short header: %d bytes", n)
+	}
+	length := binary.LittleEndian.Uint32(header[0:])
+	sum := binary.LittleEndian.Uint32(header[4:])
+	typ := header[8]
+	if offset+headerSize+int64(length) > size {
+		return 0, nil, 0, fmt.Errorf("record length %d past end of file", length)
+	}
+	payload := make([]byte, length)
+	n, err = f.ReadAt(payload, offset+headerSize)
+	if n < int(length) {
+		return 0, nil, 0, fmt.Errorf("short payload: %d of %d bytes: %v", n, length, err)
+	}
+	crc := crc32.Update(crc32.Update(0, crcTable, []byte{typ}), crcTable, payload)
+	if crc != sum {
+		return 0, nil, 0, errors.New("checksum mismatch")
+	}
+	return typ, payload, headerSize + int64(length), nil
+}
+
+func encodeRecord(buf []byte, typ byte, payload []byte) []byte {
+	var header [headerSize]byte
+	binary.LittleEndian.PutUint32(header[0:], uint32(len(payload)))
+	crc := crc32.Update(crc32.Update(0, crcTable, []byte{typ}), crcTable, payload)
+	binary.LittleEndian.PutUint32(header[4:], crc)
+	header[8] = typ
+	buf = append(buf, header[:]...)
+	return append(buf, payload...)
+}
+
+// encodeEntry encodes the index and term of e followed by its command and
+// checksum. A new gob.Encoder is used for every entry, as records are read in
+// any order.
+func encodeEntry(e storage.Entry) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 16))
+	if err := gob.NewEncoder(buf).Encode(commandWrapper{e.Command, e.Checksum}); err != nil {
+		return nil, err
+	}
+	payload := buf.Bytes()
+	binary.LittleEndian.PutUint64(payload[0:], uint64(e.Index))
+	binary.LittleEndian.PutUint64(payload[8:], uint64(e.Term))
+	return payload, nil
+}
+
+// decodeEntryHeader decodes the index and term of an entry record, leaving
+// the command alone.
+func decodeEntryHeader(payload []byte) (storage.Entry, error) {
+	if len(payload) < 16 {
+		return storage.Entry{}, fmt.Errorf("%w: bad entry record", ErrCorrupt)
+	}
+	return storage.Entry{
+		Index: int(int64(binary.LittleEndian.Uint64(payload[0:]))),
+		Term:  int(int64(binary.LittleEndian.Uint64(payload[8:]))),
+	}, nil
+}
+
+func decodeEntry(payload []byte) (storage.Entry, error) {
+	e, err := decodeEntryHeader(payload)
+	if err != nil {
+		return e, err
+	}
+	var command commandWrapper
+	if err := gob.NewDecoder(bytes.NewReader(payload[16:])).Decode(&command); err != nil {
+		return e, fmt.Errorf("decoding entry %d: %v", e.Index, err)
+	}
+	e.Command = command.Command
+	e.Checksum = command.Checksum
+	return e, nil
+}
+
+// encodeState encodes the term of st followed by its vote.
+func encodeState(st storage.HardState) []byte {
+	payload := make([]byte, 8, 8+len(st.VotedFor))
+	binary.LittleEndian.PutUint64(payload[0:], uint64(st.CurrentTerm))
+	return append(payload, st.VotedFor...)
+}
+
+// encodeSnapshot encodes the index and term of snap, and whether the entries
+// following it are kept.
+func encodeSnapshot(snap storage.Snapshot, keep bool) []byte {
+	payload := make([]byte, 17)
+	binary.LittleEndian.PutUint64(payload[0:], uint64(snap.Index))
+	binary.LittleEndian.PutUint64(payload[8:], uint64(snap.Term))
+	if keep {
+		payload[16] = 1
+	}
+	return payload
+}
+
+func encodePeers(addrs map[string]string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(addrs); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeSnapshotFile atomically replaces the snapshot file in dir with snap,
+// framed as a single record.
+func writeSnapshotFile(dir string, snap storage.Snapshot) error {
+	payload := make([]byte, 16, 16+len(snap.Data))
+	binary.LittleEndian.PutUint64(payload[0:], uint64(snap.Index))
+	binary.LittleEndian.PutUint64(payload[8:], uint64(snap.Term))
+	payload = append(payload, snap.Data...)
+
+	name := filepath.Join(dir, snapshotFile)
+	f, err := os.OpenFile(name+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(encodeRecord(nil, snapshotRecord, payload)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// readSnapshotFile reads the snapshot file in dir. ok is false if there's
+// none.
+func readSnapshotFile(dir string) (snap storage.Snapshot, ok bool, err error) {
+	f, err := os.Open(filepath.Join(dir, snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return storage.Snapshot{}, false, nil
+	}
+	if err != nil {
+		return storage.Snapshot{}, false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return storage.Snapshot{}, false, err
+	}
+	typ, payload, _, err := readRecord(f, 0, info.Size())
+	if err == nil && (typ != snapshotRecord || len(payload) < 16) {
+		err = errors.New("bad record")
+	}
+	if err != nil {
+		return storage.Snapshot{}, false, fmt.Errorf("%w: %s: %v", ErrCorrupt, f.Name(), err)
+	}
+	return storage.Snapshot{
+		Index: int(int64(binary.LittleEndian.Uint64(payload[0:]))),
+		Term:  int(int64(binary.LittleEndian.Uint64(payload[8:]))),
+		Data:  payload[16:],
+	}, true, nil
+}
+
+// cut starts a new segment, carrying the current hard state, snapshot and
+// peers records over to it. The sealed segments are reclaimed once the write
+// that needed the new segment has succeeded.
+// Expects w.mu to be locked, or w to be unshared.
+func (w *WAL) cut() error {
+	seq := 0
+	if len(w.segments) > 0 {
+		last := w.segments[len(w.segments)-1]
+		if err := last.file.Sync(); err != nil {
+			return err
+		}
+		seq = last.seq + 1
+	}
+	name := filepath.Join(w.dir, fmt.Sprintf("%016x%s", seq, segmentSuffix))
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return err
+	}
+	seg := &segment{seq: seq, file: f}
+	w.segments = append(w.segments, seg)
+	var buf []byte
+	if w.hasState {
+		buf = encodeRecord(buf, hardStateRecord, encodeState(w.hardState))
+	}
+	if w.hasSnapshot {
+		buf = encodeRecord(buf, snapshotRecord, encodeSnapshot(w.snapshot, true))
+	}
+	if w.peerAddrs != nil {
+		payload, err := encodePeers(w.peerAddrs)
+		if err != nil {
+			return err
+		}
+		buf = encodeRecord(buf, peersRecord, payload)
+	}
+	if len(buf) > 0 {
+		if _, err := f.WriteAt(buf, 0); err != nil {
+			return err
+		}
+		seg.size = int64(len(buf))
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := syncDir(w.dir); err != nil {
+		return err
+	}
+	w.sealed = len(w.segments) > 1
+	return nil
+}
+
+// reclaim deletes the sealed segments that hold no live entry. Their hard
+// states, snapshot and peers records are superseded by the ones at the head
+// of the last segment, and their entries were overwritten by records in later
+// segments or compacted, so replaying the log without them yields the same
+// result. Dead records in the segments that are kept may then follow a gap in
+// the log, which replay allows.
+// Expects w.mu to be locked, or w to be unshared.
+func (w *WAL) reclaim() error {
+	if !w.sealed {
+		return nil
+	}
+	w.sealed = false
+	live := make(map[int]bool)
+	for _, pos := range w.positions {
+		live[pos.segment] = true
+	}
+	last := len(w.segments) - 1
+	kept := w.segments[:0]
+	removed := false
+	for i, seg := range w.segments {
+		if i == last || live[seg.seq] {
+			kept = append(kept, seg)
+			continue
+		}
+		if err := seg.file.Close(); err != nil {
+			return err
+		}
+		if err := os.Remove(seg.file.Name()); err != nil {
+			return err
+		}
+		removed = true
+		w.stats.ReclaimedSegments++
+		w.stats.ReclaimedBytes += seg.size
+	}
+	w.segments = kept
+	if removed {
+		return syncDir(w.dir)
+	}
+	return nil
+}
+
+// maintain deletes the dead segments and prunes the old snapshots after a
+// write, unless the background maintenance does. It then reports the error of
+// the last background maintenance instead, if it failed.
+// Expects w.mu to be locked, or w to be unshared.
+func (w *WAL) maintain() error {
+	if w.opts.CompactInterval > 0 {
+		err := w.compactErr
+		w.compactErr = nil
+		return err
+	}
+	if err := w.reclaim(); err != nil {
+		return err
+	}
+	return w.pruneSnapshots()
+}
+
+// compactPeriodically maintains the directory every CompactInterval until the
+// WAL is closed.
+func (w *WAL) compactPeriodically() {
+	ticker := time.NewTicker(w.opts.CompactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			if !w.closed {
+				err := w.reclaim()
+				if err == nil {
+					err = w.pruneSnapshots()
+				}
+				if err != nil {
+					w.compactErr = err
+				}
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+// retainedSnapshots returns the paths of the replaced snapshots kept in dir,
+// oldest first.
+func retainedSnapshots(dir string) ([]string, error) {
+	names, err := filepath.Glob(filepath.Join(dir, snapshotFile+"-*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// retainSnapshot keeps the current snapshot file, about to be replaced, as a
+// snapshot-<index> file if RetainSnapshots asks for it.
+// Expects w.mu to be locked.
+func (w *WAL) retainSnapshot() error {
+	if w.opts.RetainSnapshots <= 0 || !w.hasSnapshot {
+		return nil
+	}
+	name := filepath.Join(w.dir, fmt.Sprintf("%s-%016x", snapshotFile, w.snapshot.Index))
+	err := os.Link(filepath.Join(w.dir, snapshotFile), name)
+	if errors.Is(err, os.ErrExist) {
+		// A SaveSnapshot that failed after keeping it.
+		return nil
+	}
+	return err
+}
+
+// pruneSnapshots deletes the replaced snapshots beyond the RetainSnapshots
+// most recent ones.
+// Expects w.mu to be locked, or w to be unshared.
+func (w *WAL) pruneSnapshots() error {
+	names, err := retainedSnapshots(w.dir)
+	if err != nil {
+		return err
+	}
+	for len(names) > w.opts.RetainSnapshots {
+		if err := os.Remove(names[0]); err != nil {
+			return err
+		}
+		names = names[1:]
+		w.stats.PrunedSnapshots++
+	}
+	return nil
+}
+
+// Stats returns the statistics of the maintenance of w.
+func (w *WAL) Stats() (Stats, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return Stats{}, os.ErrClosed
+	}
+	names, err := retainedSnapshots(w.dir)
+	if err != nil {
+		return Stats{}, err
+	}
+	stats := w.stats
+	stats.Segments = len(w.segments)
+	stats.RetainedSnapshots = len(names)
+	return stats, nil
+}
+
+// write appends framed records to the current segment, starting a new one
+// first if the current one is full.
+// Expects w.mu to be locked.
+func (w *WAL) write(buf []byte) (position, error) {
+	seg := w.segments[len(w.segments)-1]
+	if seg.size > 0 && seg.size+int64(len(buf)) > w.opts.SegmentSize {
+		if err := w.cut(); err != nil {
+			return position{}, err
+		}
+		seg = w.segments[len(w.segments)-1]
+	}
+	pos := position{seg.seq, seg.size}
+	if _, err := seg.file.WriteAt(buf, seg.size); err != nil {
+		return position{}, err
+	}
+	seg.size += int64(len(buf))
+	if w.opts.Sync == SyncEveryEntry {
+		if err := seg.file.Sync(); err != nil {
+			return position{}, err
+		}
+	}
+	return pos, nil
+}
+
+// sync makes the records written by a call to Append, Save or SetHardState
+// durable, as far as the sync policy asks for.
+// Expects w.mu to be locked.
+func (w *WAL) sync() error {
+	switch w.opts.Sync {
+	case SyncEveryEntry:
+		// write has already synced every record.
+		return nil
+	case SyncPeriodic:
+		w.dirty = true
+		err := w.syncErr
+		w.syncErr = nil
+		return err
+	default:
+		return w.segments[len(w.segments)-1].file.Sync()
+	}
+}
+
+// syncPeriodically fsyncs the current segment every SyncInterval if it was
+// written to, until the WAL is closed. Sealed segments are synced by cut.
+func (w *WAL) syncPeriodically() {
+	ticker := time.NewTicker(w.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			if w.dirty && !w.closed {
+				w.dirty = false
+				if err := w.segments[len(w.segments)-1].file.Sync(); err != nil {
+					w.syncErr = err
+				}
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+// compact discards the entries covered by snap, and the ones following it
+// unless keep is set, and makes snap the saved snapshot.
+// Expects w.mu to be locked, or w to be unshared.
+func (w *WAL) compact(snap storage.Snapshot, keep bool) {
+	if i := snap.Index + 1 - w.first; keep && i <= len(w.positions) {
+		w.positions = w.positions[i:]
+	} else {
+		w.positions = nil
+	}
+	w.first = snap.Index + 1
+	w.snapshot = storage.Snapshot{Index: snap.Index, Term: snap.Term}
+	w.hasSnapshot = true
+}
+
+// recordSnapshot writes the snapshot record of snap, whose data is already in
+// the snapshot file, and compacts the log. The entries following snap are
+// kept if the log has its last entry.
+// Expects w.mu to be locked, or w to be unshared.
+func (w *WAL) recordSnapshot(snap storage.Snapshot) error {
+	var keep bool
+	if i := snap.Index - w.first; i < 0 {
+		keep = snap.Term == w.snapshot.Term
+	} else if i < len(w.positions) && w.positions[i] != missing {
+		e, err := w.read(snap.Index)
+		if err != nil {
+			return err
+		}
+		keep = snap.Term == e.Term
+	}
+	if _, err := w.write(encodeRecord(nil, snapshotRecord, encodeSnapshot(snap, keep))); err != nil {
+		return err
+	}
+	if err := w.sync(); err != nil {
+		return err
+	}
+	w.compact(snap, keep)
+	// The segments holding only compacted entries can go.
+	w.sealed = true
+	return w.maintain()
+}
+
+// read reads the entry at index, which must be in the log.
+// Expects w.mu to be locked, or w to be unshared.
+func (w *WAL) read(index int) (storage.Entry, error) {
+	pos := w.positions[index-w.first]
+	seg := w.segment(pos.segment)
+	_, payload, _, err := readRecord(seg.file, pos.offset, seg.size)
+	if err != nil {
+		return storage.Entry{}, fmt.Errorf("%w: entry %d: %v", ErrCorrupt, index, err)
+	}
+	return decodeEntry(payload)
+}
+
+func (w *WAL) segment(seq int) *segment {
+	i := sort.Search(len(w.segments), func(i int) bool { return w.segments[i].seq >= seq })
+	return w.segments[i]
+}
+
+// TornWrite reports whether Open found an incomplete or corrupt record at the
+// tail of the log, as left by a crash in the middle of a write, and truncated
+// it.
+func (w *WAL) TornWrite() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.tornWrite
+}
+
+func (w *WAL) HardState() (storage.HardState, bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return storage.HardState{}, false, os.ErrClosed
+	}
+	return w.hardState, w.hasState, nil
+}
+
+func (w *WAL) SetHardState(st storage.HardState) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	if _, err := w.write(encodeRecord(nil, hardStateRecord, encodeState(st))); err != nil {
+		return err
+	}
+	if err := w.sync(); err != nil {
+		return err
+	}
+	w.hardState = st
+	w.hasState = true
+	return w.maintain()
+}
+
+// PeerAddrs returns the addresses of the last peers record.
+func (w *WAL) PeerAddrs() (map[string]string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil, os.ErrClosed
+	}
+	addrs := make(map[string]string, len(w.peerAddrs))
+	for id, addr := range w.peerAddrs {
+		addrs[id] = addr
+	}
+	return addrs, nil
+}
+
+// SetPeerAddrs writes a peers record holding addrs.
+func (w *WAL) SetPeerAddrs(addrs map[string]string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	saved := make(map[string]string, len(addrs))
+	for id, addr := range addrs {
+		saved[id] = addr
+	}
+	payload, err := encodePeers(saved)
+	if err != nil {
+		return err
+	}
+	if _, err := w.write(encodeRecord(nil, peersRecord, payload)); err != nil {
+		return err
+	}
+	if err := w.sync(); err != nil {
+		return err
+	}
+	w.peerAddrs = saved
+	return w.maintain()
+}
+
+func (w *WAL) FirstIndex() (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	return w.first, nil
+}
+
+func (w *WAL) LastIndex() (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return -1, os.ErrClosed
+	}
+	return w.first + len(w.positions) - 1, nil
+}
+
+func (w *WAL) Entries(lo, hi int) ([]storage.Entry, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil, os.ErrClosed
+	}
+	if lo < w.first && lo <= hi {
+		return nil, storage.ErrCompacted
+	}
+	if hi > w.first+len(w.positions) || lo > hi {
+		return nil, storage.ErrOutOfRange
+	}
+	entries := make([]storage.Entry, 0, hi-lo)
+	for i := lo; i < hi; i++ {
+		e, err := w.read(i)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (w *WAL) Append(entries []storage.Entry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	return w.save(nil, entries)
+}
+
+// Save writes a hard state record, then the records of entries, and syncs
+// them once: as records are replayed in order, a crash never leaves the
+// entries without the hard state.
+func (w *WAL) Save(st storage.HardState, entries []storage.Entry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	return w.save(&st, entries)
+}
+
+// save writes a hard state record for st, if it isn't nil, followed by the
+// records of entries, and makes them durable with a single sync.
+// Expects w.mu to be locked.
+func (w *WAL) save(st *storage.HardState, entries []storage.Entry) error {
+	if len(entries) == 0 && st == nil {
+		return nil
+	}
+	if len(entries) > 0 && entries[0].Index < w.first {
+		return storage.ErrCompacted
+	}
+	if len(entries) > 0 && entries[0].Index > w.first+len(w.positions) {
+		return storage.ErrOutOfRange
+	}
+	if st != nil {
+		if _, err := w.write(encodeRecord(nil, hardStateRecord, encodeState(*st))); err != nil {
+			return err
+		}
+	}
+	// The index is only updated once the whole batch is durable, so that a
+	// failed append leaves it as it was.
+	staged := make([]position, 0, len(entries))
+	for _, e := range entries {
+		payload, err := encodeEntry(e)
+		if err != nil {
+			return err
+		}
+		pos, err := w.write(encodeRecord(nil, entryRecord, payload))
+		if err != nil {
+			return err
+		}
+		staged = append(staged, pos)
+	}
+	if err := w.sync(); err != nil {
+		return err
+	}
+	if st != nil {
+		w.hardState = *st
+		w.hasState = true
+	}
+	if len(entries) > 0 {
+		w.positions = append(w.positions[:entries[0].Index-w.first], staged...)
+	}
+	return w.maintain()
+}
+
+// Snapshot reads the saved snapshot from the snapshot file.
+func (w *WAL) Snapshot() (storage.Snapshot, bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return storage.Snapshot{}, false, os.ErrClosed
+	}
+	if !w.hasSnapshot {
+		return storage.Snapshot{}, false, nil
+	}
+	return readSnapshotFile(w.dir)
+}
+
+func (w *WAL) SaveSnapshot(snap storage.Snapshot) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	if snap.Index < w.snapshot.Index {
+		return storage.ErrSnapshotOutOfDate
+	}
+	if err := w.retainSnapshot(); err != nil {
+		return err
+	}
+	if err := writeSnapshotFile(w.dir, snap); err != nil {
+		return err
+	}
+	return w.recordSnapshot(snap)
+}
+
+// Close closes the segment files. Any later call returns os.ErrClosed.
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	w.closed = true
+	if w.done != nil {
+		close(w.done)
+	}
+	var firstErr error
+	for _, seg := range w.segments {
+		if err := seg.file.Sync(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := seg.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	w.segments = nil
+	return firstErr
+}
+
+// syncDir fsyncs a directory so that newly created files in it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,446 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aecra/raft/storage"
+	"github.com/aecra/raft/storage/storagetest"
+)
+
+func TestSegmentRotation(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(dir, Options{SegmentSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := storagetest.MakeEntries(0, 50, 1)
+	for _, e := range entries {
+		if err := w.Append([]storage.Entry{e}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	names, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if len(names) < 2 {
+		t.Fatalf("Expected several segments, got %d", len(names))
+	}
+	w, err = Open(dir, Options{SegmentSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	storagetest.CheckEntries(t, w, entries)
+}
+
+func TestTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := storagetest.MakeEntries(0, 5, 1)
+	if err := w.Append(entries); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// Chop the last record in half, as if the process crashed mid-write.
+	name := filepath.Join(dir, "0000000000000000"+segmentSuffix)
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(name, info.Size()-5); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !w.TornWrite() {
+		t.Errorf("Expected the torn write to be reported")
+	}
+	storagetest.CheckEntries(t, w, entries[:4])
+	// The log must be appendable after the torn tail was dropped.
+	if err := w.Append(entries[4:]); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	w, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	storagetest.CheckEntries(t, w, entries)
+}
+
+func TestCorruptSealedSegment(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(dir, Options{SegmentSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range storagetest.MakeEntries(0, 20, 1) {
+		if err := w.Append([]storage.Entry{e}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	// Flip a payload byte in the first segment, which is no longer the tail.
+	name := filepath.Join(dir, "0000000000000000"+segmentSuffix)
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[headerSize] ^= 0xff
+	if err := os.WriteFile(name, data, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(dir, Options{SegmentSize: 100}); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected ErrCorrupt, got %v", err)
+	}
+}
+
+func TestReclaimSegments(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(dir, Options{SegmentSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := storagetest.MakeEntries(0, 3, 1)
+	if err := w.Append(entries); err != nil {
+		t.Fatal(err)
+	}
+	// Every vote and term bump adds a record; segments holding nothing but
+	// superseded hard states must be dropped.
+	for term := 1; term <= 1000; term++ {
+		if err := w.SetHardState(storage.HardState{CurrentTerm: term, VotedFor: strconv.Itoa(term % 3)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	names, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if len(names) > 2 {
+		t.Errorf("Expected superseded segments to be reclaimed, got %d segments", len(names))
+	}
+	w, err = Open(dir, Options{SegmentSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	storagetest.CheckEntries(t, w, entries)
+	st, ok, err := w.HardState()
+	if err != nil || !ok || st.CurrentTerm != 1000 || st.VotedFor != "1" {
+		t.Errorf("Expected hard state {1000 1}, got %+v (ok=%v, err=%v)", st, ok, err)
+	}
+}
+
+func TestReclaimOverwrittenSegment(t *testing.T) {
+	dir := t.TempDir()
+	payload, err := encodeEntry(storagetest.MakeEntries(0, 1, 1)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Segments hold three records each.
+	opts := Options{SegmentSize: 3*int64(headerSize+len(payload)) + 2}
+	w, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range storagetest.MakeEntries(0, 7, 1) {
+		if err := w.Append([]storage.Entry{e}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Overwriting from index 1 leaves nothing live in the second segment,
+	// while the dead entry 6 stays in the third one.
+	for _, e := range storagetest.MakeEntries(1, 4, 2) {
+		if err := w.Append([]storage.Entry{e}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	names, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if len(names) != 3 {
+		t.Fatalf("Expected the second segment to be reclaimed, got %d segments", len(names))
+	}
+	w, err = Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	storagetest.CheckEntries(t, w, append(storagetest.MakeEntries(0, 1, 1), storagetest.MakeEntries(1, 4, 2)...))
+}
+
+func TestSnapshotReclaimsSegments(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(dir, Options{SegmentSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range storagetest.MakeEntries(0, 50, 1) {
+		if err := w.Append([]storage.Entry{e}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.SaveSnapshot(storage.Snapshot{Index: 49, Term: 1, Data: []byte("state")}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	names, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if len(names) > 2 {
+		t.Errorf("Expected compacted segments to be reclaimed, got %d segments", len(names))
+	}
+	w, err = Open(dir, Options{SegmentSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if last, err := w.LastIndex(); err != nil || last != 49 {
+		t.Errorf("Expected last index 49, got %d (err=%v)", last, err)
+	}
+}
+
+func TestBackgroundCompaction(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{SegmentSize: 100, CompactInterval: 20 * time.Millisecond, RetainSnapshots: 2}
+	w, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range storagetest.MakeEntries(0, 40, 1) {
+		if err := w.Append([]storage.Entry{e}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, index := range []int{9, 19, 29, 39} {
+		if err := w.SaveSnapshot(storage.Snapshot{Index: index, Term: 1, Data: []byte(strconv.Itoa(index))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The three replaced snapshots are kept until the maintenance prunes the
+	// oldest, along with the segments the snapshots compacted.
+	deadline := time.Now().Add(time.Second)
+	for {
+		stats, err := w.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.ReclaimedSegments > 0 && stats.PrunedSnapshots == 1 {
+			if stats.RetainedSnapshots != 2 || stats.Segments > 2 || stats.ReclaimedBytes <= 0 {
+				t.Errorf("Unexpected stats after the maintenance: %+v", stats)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the background maintenance to reclaim segments and prune a snapshot, stats are %+v", stats)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	w.Close()
+
+	names, err := retainedSnapshots(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || filepath.Base(names[0]) != fmt.Sprintf("snapshot-%016x", 19) || filepath.Base(names[1]) != fmt.Sprintf("snapshot-%016x", 29) {
+		t.Errorf("Expected snapshots 19 and 29 to be retained, got %v", names)
+	}
+	w, err = Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if snap, ok, err := w.Snapshot(); err != nil || !ok || string(snap.Data) != "39" {
+		t.Errorf("Expected snapshot 39, got %q (ok=%v, err=%v)", snap.Data, ok, err)
+	}
+}
+
+func TestLegacyStateRecord(t *testing.T) {
+	dir := t.TempDir()
+	payload := make([]byte, 16)
+	binary.LittleEndian.PutUint64(payload[0:], 7)
+	binary.LittleEndian.PutUint64(payload[8:], 2)
+	name := filepath.Join(dir, fmt.Sprintf("%016x%s", 0, segmentSuffix))
+	if err := os.WriteFile(name, encodeRecord(nil, stateRecord, payload), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	st, ok, err := w.HardState()
+	if err != nil || !ok || st.CurrentTerm != 7 || st.VotedFor != "2" {
+		t.Errorf("Expected hard state {7 2}, got %+v (ok=%v, err=%v)", st, ok, err)
+	}
+}
+
+func TestPeerAddrsSurviveReclaim(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(dir, Options{SegmentSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetPeerAddrs(map[string]string{"1": "a:1", "2": "b:2"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range storagetest.MakeEntries(0, 50, 1) {
+		if err := w.Append([]storage.Entry{e}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The segment holding the peers record is reclaimed; the record carried
+	// over to the last segment remains.
+	if err := w.SaveSnapshot(storage.Snapshot{Index: 49, Term: 1, Data: []byte("state")}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	w, err = Open(dir, Options{SegmentSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	addrs, err := w.PeerAddrs()
+	if err != nil || len(addrs) != 2 || addrs["1"] != "a:1" || addrs["2"] != "b:2" {
+		t.Errorf("Expected addresses map[1:a:1 2:b:2], got %v (err=%v)", addrs, err)
+	}
+}
+
+func TestInterruptedSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Append(storagetest.MakeEntries(0, 10, 1)); err != nil {
+		t.Fatal(err)
+	}
+	// Crash after the snapshot file was written, before its record was.
+	snap := storage.Snapshot{Index: 5, Term: 1, Data: []byte("state")}
+	if err := writeSnapshotFile(dir, snap); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	w, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if first, err := w.FirstIndex(); err != nil || first != 6 {
+		t.Errorf("Expected first index 6, got %d (err=%v)", first, err)
+	}
+	got, ok, err := w.Snapshot()
+	if err != nil || !ok || got.Index != 5 || string(got.Data) != "state" {
+		t.Errorf("Expected snapshot %+v, got %+v (ok=%v, err=%v)", snap, got, ok, err)
+	}
+}
+
+func TestFailedAppend(t *testing.T) {
+	w, err := Open(t.TempDir(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	// The second command can't be encoded, after the first one was written.
+	entries := []storage.Entry{
+		{Index: 0, Term: 1, Command: 1},
+		{Index: 1, Term: 1, Command: struct{ X int }{1}},
+	}
+	if err := w.Append(entries); err == nil {
+		t.Fatal("Expected appending an unregistered command to fail")
+	}
+	storagetest.CheckEntries(t, w, nil)
+}
+
+func TestSyncPolicies(t *testing.T) {
+	for name, policy := range map[string]SyncPolicy{
+		"Batch":      SyncBatch,
+		"EveryEntry": SyncEveryEntry,
+		"Periodic":   SyncPeriodic,
+	} {
+		t.Run(name, func(t *testing.T) {
+			storagetest.Run(t, func(tb testing.TB, dir string) storage.Storage {
+				w, err := Open(dir, Options{Sync: policy, SyncInterval: time.Millisecond})
+				if err != nil {
+					tb.Fatal(err)
+				}
+				return w
+			})
+		})
+	}
+}
+
+func TestSyncPeriodic(t *testing.T) {
+	w, err := Open(t.TempDir(), Options{Sync: SyncPeriodic, SyncInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.Append(storagetest.MakeEntries(0, 3, 1)); err != nil {
+		t.Fatal(err)
+	}
+	// The background fsync picks up the write within an interval.
+	deadline := time.Now().Add(time.Second)
+	for {
+		w.mu.Lock()
+		dirty := w.dirty
+		w.mu.Unlock()
+		if !dirty {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the append to be synced in the background")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestClosed(t *testing.T) {
+	w, err := Open(t.TempDir(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if err := w.Append(storagetest.MakeEntries(0, 1, 1)); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Expected os.ErrClosed from Append, got %v", err)
+	}
+	if err := w.SetHardState(storage.HardState{CurrentTerm: 1}); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Expected os.ErrClosed from SetHardState, got %v", err)
+	}
+}
+
+func open(tb testing.TB, dir string) storage.Storage {
+	w, err := Open(dir, Options{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return w
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, open)
+}
+
+func BenchmarkAppend(b *testing.B) {
+	storagetest.Benchmark(b, open)
+}